@@ -0,0 +1,125 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AWSCredentialsSpec defines the desired state of AWSCredentials
+type AWSCredentialsSpec struct {
+	// SecretRef is a Secret in the same namespace holding static keys in
+	// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, and optionally
+	// AWS_SESSION_TOKEN. The credentials of the controller are used when
+	// neither secretRef nor webIdentity is set.
+	// +optional
+	SecretRef *corev1.LocalObjectReference `json:"secretRef,omitempty"`
+
+	// WebIdentity assumes a role using a web identity token, such as the
+	// service account token of IAM roles for service accounts (IRSA).
+	// +optional
+	WebIdentity *WebIdentity `json:"webIdentity,omitempty"`
+
+	// AssumeRoles are assumed in order, each using the credentials obtained
+	// from the previous one.
+	// +optional
+	AssumeRoles []AssumeRole `json:"assumeRoles,omitempty"`
+}
+
+// WebIdentity configures assuming a role with a web identity token.
+type WebIdentity struct {
+	RoleARN string `json:"roleARN"`
+
+	// TokenFile is the path of the token in the controller container.
+	// Defaults to the token mounted for IRSA.
+	// +optional
+	TokenFile string `json:"tokenFile,omitempty"`
+}
+
+// AssumeRole configures assuming a role.
+type AssumeRole struct {
+	RoleARN string `json:"roleARN"`
+
+	// +optional
+	ExternalID string `json:"externalID,omitempty"`
+
+	// SessionName defaults to mapa-<namespace>-<name> of the
+	// AWSCredentials, so that CloudTrail events of the assumed role can be
+	// traced back to it.
+	// +optional
+	SessionName string `json:"sessionName,omitempty"`
+
+	// TagSession passes session tags identifying the controller and the
+	// namespace and name of the AWSCredentials when assuming the role.
+	// Requires sts:TagSession in the trust policy of the role.
+	// +optional
+	TagSession bool `json:"tagSession,omitempty"`
+}
+
+// AWSCredentialsStatus defines the observed state of AWSCredentials
+type AWSCredentialsStatus struct {
+	// Ready is true when the credentials were validated with STS.
+	Ready bool `json:"ready"`
+
+	// Account is the AWS account the credentials belong to.
+	// +optional
+	Account string `json:"account,omitempty"`
+
+	// ARN is the identity the credentials resolve to.
+	// +optional
+	ARN string `json:"arn,omitempty"`
+
+	// LastValidated is when the credentials were last checked.
+	// +optional
+	LastValidated *metav1.Time `json:"lastValidated,omitempty"`
+
+	// Conditions describe the observed state of the credentials.
+	// +optional
+	Conditions Conditions `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=awscredentials,scope=Namespaced,categories=machine-api
+// +kubebuilder:storageversion
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Ready",type="boolean",JSONPath=".status.ready",description="Credentials validated"
+// +kubebuilder:printcolumn:name="ARN",type="string",JSONPath=".status.arn",description="Caller identity"
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// AWSCredentials describes how to obtain AWS credentials for the
+// AWSMachines referencing it.
+type AWSCredentials struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AWSCredentialsSpec   `json:"spec,omitempty"`
+	Status AWSCredentialsStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// AWSCredentialsList contains a list of AWSCredentials
+type AWSCredentialsList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []AWSCredentials `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&AWSCredentials{}, &AWSCredentialsList{})
+}
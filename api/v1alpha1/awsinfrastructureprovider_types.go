@@ -17,23 +17,656 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// ImportAnnotation requests that existing instances in the provider region
+// with the tag given as the annotation value (key=value) are adopted by
+// creating AWSMachines for them. The annotation is removed once the import
+// completes.
+const ImportAnnotation = "infrastructure.crit.sh/import-instances"
+
+// ImportCredentialsAnnotation names the AWSCredentials in the provider
+// namespace that instances are imported with. The imported AWSMachines
+// refer to it, so that they are managed with the same credentials. The
+// credentials of the controller are used when it is not set.
+const ImportCredentialsAnnotation = "infrastructure.crit.sh/import-credentials"
+
+// KubernetesVersionLabel is the label of AWSMachines with the version of
+// Kubernetes they run, e.g. v1.18.2, matched against the AMI families of
+// the provider.
+const KubernetesVersionLabel = "infrastructure.crit.sh/kubernetes-version"
+
+const (
+	// ProviderFinalizer allows the controller to delete the key pairs it
+	// manages for a provider before the provider is removed.
+	ProviderFinalizer = "awsinfrastructureprovider.infrastructure.crit.sh"
+)
+
 // AWSInfrastructureProviderSpec defines the desired state of AWSInfrastructureProvider
 type AWSInfrastructureProviderSpec struct {
-	Region string `json:"region"`
-	// other stuff
+	// Region is the default region for AWSMachines in this namespace.
+	// Defaults to the region of the controller.
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// Regions are the regions AWSMachines in this namespace may be launched
+	// in, with defaults for machines in each region. An AWSMachine is placed
+	// in a region by setting spec.failureDomain to the region or one of its
+	// availability zones.
+	// +optional
+	Regions []RegionDefaults `json:"regions,omitempty"`
+
+	// AMIFamilies are images by operating system, architecture and
+	// Kubernetes version. AWSMachines that set neither spec.ami nor
+	// spec.imageReplication are launched from the image of the family
+	// matching the architecture of their instance type, so that a single
+	// template serves mixed x86_64 and arm64 fleets. They take precedence
+	// over the AMI of the region defaults.
+	// +optional
+	AMIFamilies []AMIFamily `json:"amiFamilies,omitempty"`
+
+	// MaintenanceWindows restricts when disruptive actions (such as
+	// recreating machines) may be performed on AWSMachines in this
+	// namespace. AWSMachines may override these with their own windows.
+	// +optional
+	MaintenanceWindows []MaintenanceWindow `json:"maintenanceWindows,omitempty"`
+
+	// MachineExpiry bounds how long the instances of AWSMachines in this
+	// namespace may run.
+	// +optional
+	MachineExpiry *MachineExpiry `json:"machineExpiry,omitempty"`
+
+	// Limits are guardrails on the AWSMachines launched in this namespace.
+	// Launches that would exceed them are held with the WithinLimits
+	// condition set to false until they fit, and new AWSMachines beyond
+	// MaxMachines are rejected when the controller serves webhooks.
+	// +optional
+	Limits *Limits `json:"limits,omitempty"`
+
+	// Pricing configures how machine costs are estimated. Defaults to the
+	// AWS Pricing API.
+	// +optional
+	Pricing *Pricing `json:"pricing,omitempty"`
+
+	// WarmPools keep stopped, pre-provisioned instances that are started
+	// for new AWSMachines referencing the pool instead of launching
+	// instances from scratch.
+	// +optional
+	WarmPools []WarmPool `json:"warmPools,omitempty"`
+
+	// SharedCredentials are Secrets in this namespace that AWSMachines in
+	// other namespaces may use with spec.secretRef. Machines may only use
+	// Secrets in their own namespace otherwise.
+	// +optional
+	SharedCredentials []SharedCredentials `json:"sharedCredentials,omitempty"`
+
+	// CredentialRoles are the IAM roles AWSCredentials in this namespace may
+	// assume with webIdentity or assumeRoles, and the web identity token
+	// files they may read. AWSCredentials assuming other roles or reading
+	// other token files are rejected, so that tenants cannot use the roles
+	// of other tenants by naming them.
+	// +optional
+	CredentialRoles *CredentialRoles `json:"credentialRoles,omitempty"`
+
+	// Timeouts override the requeue intervals and timeouts the controller
+	// was started with for AWSMachines in this namespace.
+	// +optional
+	Timeouts *Timeouts `json:"timeouts,omitempty"`
+
+	// AdditionalTags are added to every instance, volume and network
+	// interface launched for AWSMachines in this namespace. They take
+	// precedence over the tags of an AWSMachine, but not over the default
+	// tags the controller was started with.
+	// +optional
+	AdditionalTags map[string]string `json:"additionalTags,omitempty"`
+
+	// Consolidation configures the consolidation advisor, which recommends
+	// removing lightly used machines whose pods fit on the other machines
+	// in this namespace. The advisor runs when the controller is started
+	// with --consolidation-interval.
+	// +optional
+	Consolidation *Consolidation `json:"consolidation,omitempty"`
+
+	// MachineDefaults are written into the spec of AWSMachines created in
+	// this namespace that do not set the fields themselves. They are only
+	// applied when the controller serves webhooks.
+	// +optional
+	MachineDefaults *MachineDefaults `json:"machineDefaults,omitempty"`
+
+	// ImageReplications copy AMIs to other regions, so that machines in
+	// every region can use the same image. The copies are recorded in
+	// status and used by AWSMachines that set spec.imageReplication.
+	// +optional
+	ImageReplications []ImageReplication `json:"imageReplications,omitempty"`
+
+	// ProvisioningWindow is the rolling window over which the provisioning
+	// of AWSMachines in this namespace is summarized in status. Defaults to
+	// 24h, and is at most a week.
+	// +optional
+	ProvisioningWindow *metav1.Duration `json:"provisioningWindow,omitempty"`
+
+	// KeyPair is an EC2 key pair managed by the controller in the region of
+	// the provider and each of its regions, for AWSMachines to reference
+	// with spec.keyName. The key pairs are deleted with the provider.
+	// +optional
+	KeyPair *KeyPair `json:"keyPair,omitempty"`
+}
+
+// KeyPair is an EC2 key pair created by the controller.
+type KeyPair struct {
+	// Name of the key pair. A key pair with the name that was not created
+	// by the controller for this provider is never replaced.
+	Name string `json:"name"`
+
+	// PublicKey is an OpenSSH public key imported as the key pair. When not
+	// set, a key pair is created in each region and its private key stored
+	// in the Secret <provider name>-keypair, keyed by region. Changing the
+	// public key does not replace key pairs already imported.
+	// +optional
+	PublicKey string `json:"publicKey,omitempty"`
+}
+
+// MachineExpiry marks machines whose instance ran longer than a maximum age
+// as expired, e.g. to ensure that nodes are regularly rebuilt from current
+// images.
+type MachineExpiry struct {
+	// MaxAge is how long an instance may run before its machine expires.
+	// AWSMachines may override it with spec.maxAge.
+	// +optional
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+
+	// DeleteExpired deletes the Machine of an expired AWSMachine, for its
+	// MachineSet to replace it. Machines are deleted one at a time, within
+	// the maintenance windows of the machine. Expired machines are only
+	// marked with the Expired condition otherwise.
+	// +optional
+	DeleteExpired bool `json:"deleteExpired,omitempty"`
+}
+
+// MachineDefaults are defaults for the spec of new AWSMachines.
+type MachineDefaults struct {
+	// AMIs are the default images by instance family, the part of the
+	// instance type before the dot, e.g. m5 or t4g. The empty family is the
+	// default for instance types of other families.
+	// +optional
+	AMIs map[string]string `json:"amis,omitempty"`
+
+	// IAMInstanceProfile is the default instance profile.
+	// +optional
+	IAMInstanceProfile string `json:"iamInstanceProfile,omitempty"`
+
+	// KeyName is the default key pair.
+	// +optional
+	KeyName string `json:"keyName,omitempty"`
+
+	// VPCID is the default VPC.
+	// +optional
+	VPCID string `json:"vpcID,omitempty"`
+
+	// Tags are added to the tags of the spec that are not already set.
+	// Unlike spec.additionalTags, they do not replace the tags of an
+	// AWSMachine and are only applied when it is created.
+	// +optional
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// AMIFamily is a set of images built for the same operating system,
+// architecture and Kubernetes version, one per region.
+type AMIFamily struct {
+	// OSFamily of the images, matched against spec.osFamily. Defaults to
+	// linux.
+	// +optional
+	OSFamily OSFamily `json:"osFamily,omitempty"`
+
+	// Architecture of the images, matched against the architectures
+	// supported by the instance type of a machine.
+	// +kubebuilder:validation:Enum=x86_64;arm64
+	Architecture string `json:"architecture"`
+
+	// KubernetesVersion of the images, matched against the
+	// KubernetesVersionLabel of a machine. Families without a version match
+	// machines of any version, but a family with the version of the machine
+	// is preferred.
+	// +optional
+	KubernetesVersion string `json:"kubernetesVersion,omitempty"`
+
+	// AMIs are the images by region.
+	AMIs map[string]string `json:"amis"`
+}
+
+// RegionDefaults are applied to AWSMachines launched in a region that do
+// not set the fields themselves.
+type RegionDefaults struct {
+	// Name of the region, e.g. us-west-2.
+	Name string `json:"name"`
+
+	// AMI is the default image in the region. AMI IDs are specific to a
+	// region, so a machine template can only be shared across regions
+	// without setting spec.ami.
+	// +optional
+	AMI string `json:"ami,omitempty"`
+
+	// VPCID is the default VPC in the region.
+	// +optional
+	VPCID string `json:"vpcID,omitempty"`
+
+	// SubnetIDs are the default subnets in the region.
+	// +optional
+	SubnetIDs []string `json:"subnetIDs,omitempty"`
+
+	// SubnetExcludeSelector excludes subnets by tags for machines in the
+	// region that do not set their own.
+	// +optional
+	SubnetExcludeSelector *TagSelector `json:"subnetExcludeSelector,omitempty"`
+
+	// SecurityGroupIDs are the default security groups in the region.
+	// +optional
+	SecurityGroupIDs []string `json:"securityGroupIDs,omitempty"`
+}
+
+// ImageReplication copies an AMI to other regions. Copies of previous
+// source AMIs are kept when the source AMI changes, since machines may still
+// use them.
+type ImageReplication struct {
+	// Name of the replication, referenced by AWSMachines in
+	// spec.imageReplication.
+	Name string `json:"name"`
+
+	// SourceAMI is the image copied.
+	SourceAMI string `json:"sourceAMI"`
+
+	// SourceRegion is the region of the source AMI. Defaults to the region
+	// of the provider.
+	// +optional
+	SourceRegion string `json:"sourceRegion,omitempty"`
+
+	// Regions the AMI is copied to.
+	Regions []string `json:"regions"`
+
+	// Encrypted encrypts the snapshots of the copies, with the default EBS
+	// key of each region unless KMSKeyID is set.
+	// +optional
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	// KMSKeyID is the customer managed key the snapshots of the copies are
+	// encrypted with, e.g. an alias or multi-region key that resolves in
+	// every region. Implies Encrypted.
+	// +optional
+	KMSKeyID string `json:"kmsKeyID,omitempty"`
+}
+
+// ImageReplicationStatus is the progress of an image replication.
+type ImageReplicationStatus struct {
+	Name      string `json:"name"`
+	SourceAMI string `json:"sourceAMI"`
+
+	// AMIs are the available images by region, including the source AMI in
+	// its own region.
+	// +optional
+	AMIs map[string]string `json:"amis,omitempty"`
+
+	// Pending are the regions the AMI is still being copied to.
+	// +optional
+	Pending []string `json:"pending,omitempty"`
+
+	// Failed are the regions the AMI could not be copied to. The failed
+	// copies are kept for inspection and not retried.
+	// +optional
+	Failed []string `json:"failed,omitempty"`
+}
+
+// Consolidation configures the consolidation advisor.
+type Consolidation struct {
+	// UtilizationThreshold is the percentage of the allocatable CPU and
+	// memory of a node requested by its pods below which the machine of the
+	// node is a consolidation candidate. Defaults to 50.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	UtilizationThreshold *int32 `json:"utilizationThreshold,omitempty"`
+
+	// DeleteMachines deletes the Machine of one recommended candidate per
+	// evaluation instead of only recommending it.
+	// +optional
+	DeleteMachines bool `json:"deleteMachines,omitempty"`
+
+	// DeletePriority sets the DeletePriorityAnnotation of each ready machine
+	// on every evaluation, ranking the machines a scale down should remove
+	// first: the least utilized machines with Utilization, or the machines
+	// with the oldest AMIs with AMIAge.
+	// +kubebuilder:validation:Enum=Utilization;AMIAge
+	// +optional
+	DeletePriority DeletePriorityPolicy `json:"deletePriority,omitempty"`
+}
+
+// DeletePriorityPolicy is how the delete priority of machines is determined.
+type DeletePriorityPolicy string
+
+const (
+	DeletePriorityUtilization DeletePriorityPolicy = "Utilization"
+	DeletePriorityAMIAge      DeletePriorityPolicy = "AMIAge"
+)
+
+// Timeouts configure how AWSMachines wait on other resources.
+type Timeouts struct {
+	// ConfigRequeueInterval is how often a machine checks whether its
+	// Cluster API bootstrap config or launch group is ready. Machine API
+	// Configs are watched, and only checked at least a minute apart.
+	// +optional
+	ConfigRequeueInterval *metav1.Duration `json:"configRequeueInterval,omitempty"`
+
+	// DeleteRequeueInterval is how often a deleted machine checks whether
+	// its instance has terminated.
+	// +optional
+	DeleteRequeueInterval *metav1.Duration `json:"deleteRequeueInterval,omitempty"`
+
+	// DeleteTimeout is how long a deleted machine waits for its instance to
+	// terminate before it is marked failed. A zero duration waits forever.
+	// +optional
+	DeleteTimeout *metav1.Duration `json:"deleteTimeout,omitempty"`
+}
+
+// SharedCredentials allows namespaces to use the credentials in a Secret.
+type SharedCredentials struct {
+	// SecretName is the Secret holding the credentials.
+	SecretName string `json:"secretName"`
+
+	// Namespaces may launch AWSMachines with the credentials.
+	Namespaces []string `json:"namespaces"`
+}
+
+// CredentialRoles allows AWSCredentials to assume IAM roles.
+type CredentialRoles struct {
+	// RoleARNs may be assumed. An ARN ending in * allows the roles it is a
+	// prefix of, e.g. arn:aws:iam::123456789012:role/tenant-a-*.
+	// +optional
+	RoleARNs []string `json:"roleARNs,omitempty"`
+
+	// TokenFiles may be read by webIdentity. The token mounted for IRSA,
+	// used when tokenFile is not set, may always be read.
+	// +optional
+	TokenFiles []string `json:"tokenFiles,omitempty"`
+}
+
+// WarmPool is a set of stopped instances launched from a template.
+type WarmPool struct {
+	// Name of the pool, referenced by AWSMachines in spec.warmPool.
+	Name string `json:"name"`
+
+	// Size is the number of stopped instances kept available.
+	// +kubebuilder:validation:Minimum=0
+	Size int32 `json:"size"`
+
+	// Template is the spec instances of the pool are launched with. Only
+	// Linux instances using cloud-init are supported, since the instances
+	// are reset to be bootstrapped again when started.
+	Template AWSMachineSpec `json:"template"`
+}
+
+// WarmPoolStatus is the observed state of a warm pool.
+type WarmPoolStatus struct {
+	Name string `json:"name"`
+
+	// Ready is the number of stopped instances available.
+	Ready int32 `json:"ready"`
+
+	// Pending is the number of instances being prepared.
+	Pending int32 `json:"pending"`
+}
+
+// Pricing configures the source of instance prices.
+type Pricing struct {
+	// StaticPrices are hourly on-demand prices in USD by instance type,
+	// used instead of the AWS Pricing API (e.g. in air-gapped accounts).
+	// +optional
+	StaticPrices map[string]resource.Quantity `json:"staticPrices,omitempty"`
+}
+
+// Limits bound the total size of the AWSMachines launched in a namespace.
+// Only machines with a launched instance count towards the limits.
+type Limits struct {
+	// MaxMachines is the maximum number of machines.
+	// +optional
+	MaxMachines *int32 `json:"maxMachines,omitempty"`
+
+	// MaxVCPUs is the maximum total number of vCPUs across all machines.
+	// +optional
+	MaxVCPUs *int32 `json:"maxVCPUs,omitempty"`
+
+	// MaxHourlyCost is the maximum estimated on-demand cost per hour in USD
+	// across all machines, e.g. "25.50".
+	// +optional
+	MaxHourlyCost *resource.Quantity `json:"maxHourlyCost,omitempty"`
+}
+
+// MaintenanceWindow is a recurring period of time during which disruptive
+// actions are permitted.
+type MaintenanceWindow struct {
+	// Schedule is a standard 5-field cron expression for when the window
+	// opens.
+	Schedule string `json:"schedule"`
+
+	// Duration is how long the window stays open.
+	Duration metav1.Duration `json:"duration"`
+
+	// TimeZone is the IANA time zone the schedule is evaluated in. Defaults
+	// to UTC.
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
 }
 
 // InfrastructureProviderStatus defines the observed state of AWSInfrastructureProvider
 type AWSInfrastructureProviderStatus struct {
 	Ready       bool        `json:"ready"`
 	LastUpdated metav1.Time `json:"lastUpdated"`
+
+	// Region is the resolved region of the provider.
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// CapacityFailures is the recent history of launches in the account and
+	// regions of the provider that failed due to insufficient capacity.
+	// Availability zones with recent failures are deprioritized when
+	// selecting subnets for that instance type.
+	// +optional
+	CapacityFailures []CapacityFailure `json:"capacityFailures,omitempty"`
+
+	// Throttling describes AWS API requests made for machines in this
+	// namespace that were throttled since the controller started.
+	// +optional
+	Throttling *ThrottlingStatus `json:"throttling,omitempty"`
+
+	// EnabledRegions are the regions enabled for the account, including
+	// opt-in regions that have been enabled. AWSMachines in other regions
+	// cannot be launched.
+	// +optional
+	EnabledRegions []string `json:"enabledRegions,omitempty"`
+
+	// WarmPools describe the instances available in each warm pool.
+	// +optional
+	WarmPools []WarmPoolStatus `json:"warmPools,omitempty"`
+
+	// DedicatedHosts describe the utilization of the dedicated hosts in the
+	// region of the provider.
+	// +optional
+	DedicatedHosts []DedicatedHostStatus `json:"dedicatedHosts,omitempty"`
+
+	// Consolidation lists the machines the consolidation advisor recommends
+	// removing.
+	// +optional
+	Consolidation *ConsolidationStatus `json:"consolidation,omitempty"`
+
+	// Permissions is the result of the last check of the IAM permissions
+	// of the controller in the region of the provider.
+	// +optional
+	Permissions *PermissionsStatus `json:"permissions,omitempty"`
+
+	// ImageReplications are the copies of the AMIs of the image
+	// replications of the provider.
+	// +optional
+	ImageReplications []ImageReplicationStatus `json:"imageReplications,omitempty"`
+
+	// Provisioning summarizes how many AWSMachines in this namespace became
+	// ready over the provisioning window, and how long it took them.
+	// +optional
+	Provisioning *ProvisioningStatus `json:"provisioning,omitempty"`
+
+	// Subnets describe the free IP addresses of the subnets in the VPCs of
+	// the machines in this namespace, and of the default VPC.
+	// +optional
+	Subnets []SubnetStatus `json:"subnets,omitempty"`
+
+	// FailureDomains are the availability zones of the region that have
+	// subnets with free IP addresses in the VPCs of the machines in this
+	// namespace, for spreading machines across zones.
+	// +optional
+	FailureDomains []FailureDomain `json:"failureDomains,omitempty"`
+
+	// KeyPairs are the key pairs managed for spec.keyPair in each region.
+	// +optional
+	KeyPairs []KeyPairStatus `json:"keyPairs,omitempty"`
+
+	// Conditions describe the observed state of the provider.
+	// +optional
+	Conditions Conditions `json:"conditions,omitempty"`
+}
+
+// ProvisioningStatus summarizes the machines provisioned over a rolling
+// window, for service level objectives on provisioning. Only machines
+// provisioned since the controller started are counted.
+type ProvisioningStatus struct {
+	Window metav1.Duration `json:"window"`
+
+	// Succeeded is the number of machines that became ready.
+	Succeeded int32 `json:"succeeded"`
+
+	// Failed is the number of machines that failed before becoming ready.
+	Failed int32 `json:"failed"`
+
+	// SuccessRate is the percentage of machines that became ready, e.g.
+	// "99.5". It is not set when no machines were provisioned.
+	// +optional
+	SuccessRate string `json:"successRate,omitempty"`
+
+	// P95TimeToReady is the 95th percentile of the time from creation until
+	// ready of the machines that became ready.
+	// +optional
+	P95TimeToReady *metav1.Duration `json:"p95TimeToReady,omitempty"`
+}
+
+// SubnetStatus is the observed capacity of a subnet.
+type SubnetStatus struct {
+	SubnetID         string `json:"subnetID"`
+	VPCID            string `json:"vpcID"`
+	AvailabilityZone string `json:"availabilityZone"`
+
+	// AvailableIPAddresses is the number of unused private IPv4 addresses.
+	AvailableIPAddresses int64 `json:"availableIPAddresses"`
+}
+
+// FailureDomain is an availability zone machines can be launched in.
+type FailureDomain struct {
+	// Name is the name of the availability zone, which may be used as the
+	// failureDomain of an AWSMachine.
+	Name string `json:"name"`
+
+	// Subnets are the subnets in the zone with free IP addresses.
+	Subnets []string `json:"subnets"`
+
+	// AvailableIPAddresses is the number of unused private IPv4 addresses
+	// in the subnets.
+	AvailableIPAddresses int64 `json:"availableIPAddresses"`
+}
+
+// KeyPairStatus is a key pair managed by the controller.
+type KeyPairStatus struct {
+	Region      string `json:"region"`
+	Name        string `json:"name"`
+	KeyPairID   string `json:"keyPairID"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// PermissionsStatus lists the IAM actions needed to manage machines that
+// the controller is not allowed to perform.
+type PermissionsStatus struct {
+	LastChecked metav1.Time `json:"lastChecked"`
+
+	// Method is how permissions were checked: Simulation when the IAM
+	// policies of the controller were simulated, or DryRun when only the
+	// actions that can be made as dry-run requests were checked.
+	Method string `json:"method"`
+
+	// Missing are the actions that are not allowed.
+	// +optional
+	Missing []string `json:"missing,omitempty"`
+}
+
+// ThrottlingStatus is the AWS API throttling history of a provider.
+type ThrottlingStatus struct {
+	Count         int64       `json:"count"`
+	LastThrottled metav1.Time `json:"lastThrottled"`
+}
+
+// ConsolidationStatus is the result of the last consolidation evaluation.
+type ConsolidationStatus struct {
+	LastEvaluated metav1.Time `json:"lastEvaluated"`
+
+	// Recommendations are the machines whose pods fit on the other machines
+	// in the namespace, least utilized first.
+	// +optional
+	Recommendations []ConsolidationRecommendation `json:"recommendations,omitempty"`
+}
+
+// ConsolidationRecommendation recommends removing a machine.
+type ConsolidationRecommendation struct {
+	AWSMachine   string `json:"awsMachine"`
+	Node         string `json:"node"`
+	InstanceType string `json:"instanceType,omitempty"`
+
+	// CPUUtilization and MemoryUtilization are the percentages of the
+	// allocatable CPU and memory of the node requested by its pods.
+	CPUUtilization    int32 `json:"cpuUtilization"`
+	MemoryUtilization int32 `json:"memoryUtilization"`
+}
+
+// DedicatedHostStatus is the utilization of a dedicated host.
+type DedicatedHostStatus struct {
+	HostID           string `json:"hostID"`
+	AvailabilityZone string `json:"availabilityZone"`
+	// InstanceType or instance family the host supports.
+	InstanceType string `json:"instanceType"`
+	State        string `json:"state"`
+	// Instances is the number of instances running on the host.
+	Instances int32 `json:"instances"`
+	// AvailableCapacity is the number of additional instances of the
+	// instance type that fit on the host.
+	AvailableCapacity int32 `json:"availableCapacity"`
+}
+
+// CapacityFailure records InsufficientInstanceCapacity errors for an
+// instance type in an availability zone.
+type CapacityFailure struct {
+	// Account is the AWS account the launches were made in.
+	// +optional
+	Account string `json:"account,omitempty"`
+
+	InstanceType     string `json:"instanceType"`
+	AvailabilityZone string `json:"availabilityZone"`
+
+	// AvailabilityZoneID is the ID of the availability zone, e.g.
+	// use1-az1, which names the same zone in every account, unlike the
+	// zone name. Failures without one are not restored.
+	// +optional
+	AvailabilityZoneID string `json:"availabilityZoneID,omitempty"`
+
+	Count       int         `json:"count"`
+	LastFailure metav1.Time `json:"lastFailure"`
 }
 
 // +kubebuilder:object:root=true
-// +kubebuilder:resource:path=awsinfrastructureproviders,scope=Namespaced,categories=machine-api
+// +kubebuilder:resource:path=awsinfrastructureproviders,scope=Namespaced,categories=machine-api,shortName=awsip
 // +kubebuilder:storageversion
 // +kubebuilder:subresource:status
 // +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.ready",description="Provider is ready"
@@ -0,0 +1,161 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AWSMachinePoolTemplate describes the instances of a machine pool. It is
+// written to a new version of the launch template of the Auto Scaling group
+// when it changes.
+type AWSMachinePoolTemplate struct {
+	// AMI is the image instances of the pool are launched from.
+	AMI string `json:"ami"`
+
+	// InstanceType of the instances of the pool. Defaults to the instance
+	// type of the launch template of the group.
+	// +optional
+	InstanceType string `json:"instanceType,omitempty"`
+}
+
+// InstanceRefreshPreferences describes how the instances of a pool are
+// replaced when its template changes.
+type InstanceRefreshPreferences struct {
+	// MinHealthyPercentage is the percentage of the desired capacity of the
+	// group that must remain healthy during the refresh. Defaults to 90.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	MinHealthyPercentage *int32 `json:"minHealthyPercentage,omitempty"`
+
+	// InstanceWarmup is how long a new instance is given to become ready
+	// before it counts as healthy. Defaults to the health check grace period
+	// of the group.
+	// +optional
+	InstanceWarmup *metav1.Duration `json:"instanceWarmup,omitempty"`
+}
+
+// InstanceRefreshStatus describes the progress of an instance refresh.
+type InstanceRefreshStatus struct {
+	// ID of the instance refresh.
+	ID string `json:"id"`
+
+	// Status of the instance refresh, e.g. InProgress or Successful.
+	Status string `json:"status"`
+
+	// Reason describes the status, e.g. why the refresh failed.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+
+	// PercentageComplete is the percentage of instances that have been
+	// replaced and warmed up.
+	PercentageComplete int32 `json:"percentageComplete"`
+
+	// InstancesToUpdate is the number of instances left to replace.
+	InstancesToUpdate int32 `json:"instancesToUpdate"`
+
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// +optional
+	EndTime *metav1.Time `json:"endTime,omitempty"`
+}
+
+// AWSMachinePoolSpec defines the desired state of AWSMachinePool
+type AWSMachinePoolSpec struct {
+	// Region of the Auto Scaling group. Defaults to the region of the
+	// controller.
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// AutoScalingGroupName is the name of the Auto Scaling group of the pool.
+	// The group must launch its instances from a launch template.
+	AutoScalingGroupName string `json:"autoScalingGroupName"`
+
+	// Template describes the instances of the pool. When it changes, a new
+	// version of the launch template of the group is created and an instance
+	// refresh replaces the instances of the group.
+	Template AWSMachinePoolTemplate `json:"template"`
+
+	// InstanceRefresh configures how instances are replaced.
+	// +optional
+	InstanceRefresh *InstanceRefreshPreferences `json:"instanceRefresh,omitempty"`
+}
+
+// AWSMachinePoolStatus defines the observed state of AWSMachinePool
+type AWSMachinePoolStatus struct {
+	// TemplateHash is the hash of the template last rolled out to the group.
+	// +optional
+	TemplateHash string `json:"templateHash,omitempty"`
+
+	// LaunchTemplateID is the ID of the launch template of the group.
+	// +optional
+	LaunchTemplateID string `json:"launchTemplateID,omitempty"`
+
+	// LaunchTemplateVersion is the version of the launch template created
+	// for the template.
+	// +optional
+	LaunchTemplateVersion string `json:"launchTemplateVersion,omitempty"`
+
+	// DesiredCapacity is the desired capacity of the group.
+	DesiredCapacity int32 `json:"desiredCapacity"`
+
+	// InstanceRefresh describes the progress of the last instance refresh
+	// started for the pool.
+	// +optional
+	InstanceRefresh *InstanceRefreshStatus `json:"instanceRefresh,omitempty"`
+
+	// Message describes why the template cannot be rolled out.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	LastUpdated metav1.Time `json:"lastUpdated,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=awsmachinepools,scope=Namespaced,categories=machine-api
+// +kubebuilder:storageversion
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Group",type="string",JSONPath=".spec.autoScalingGroupName",description="Auto Scaling group"
+// +kubebuilder:printcolumn:name="AMI",type="string",JSONPath=".spec.template.ami",description="Target AMI"
+// +kubebuilder:printcolumn:name="Refresh",type="string",JSONPath=".status.instanceRefresh.status",description="Instance refresh status"
+// +kubebuilder:printcolumn:name="Complete",type="integer",JSONPath=".status.instanceRefresh.percentageComplete",description="Percentage of instances refreshed"
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// AWSMachinePool rolls out changes to the instances of an Auto Scaling group
+// with instance refreshes.
+type AWSMachinePool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AWSMachinePoolSpec   `json:"spec,omitempty"`
+	Status AWSMachinePoolStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// AWSMachinePoolList contains a list of AWSMachinePool
+type AWSMachinePoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []AWSMachinePool `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&AWSMachinePool{}, &AWSMachinePoolList{})
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AWSMachineRefreshPhase describes the progress of a refresh.
+type AWSMachineRefreshPhase string
+
+const (
+	RefreshCanary     AWSMachineRefreshPhase = "Canary"
+	RefreshInProgress AWSMachineRefreshPhase = "InProgress"
+	RefreshCompleted  AWSMachineRefreshPhase = "Completed"
+	RefreshRolledBack AWSMachineRefreshPhase = "RolledBack"
+
+	// RefreshFailed pauses a refresh while machines recreated with the
+	// target AMI have failed, see AWSMachineRefreshStatus.Failed. The
+	// refresh continues once they are deleted or no longer failed.
+	RefreshFailed AWSMachineRefreshPhase = "Failed"
+)
+
+// CanaryPolicy describes how a new AMI is tried on a small part of the
+// fleet before the remaining machines are refreshed.
+type CanaryPolicy struct {
+	// Percentage of the selected machines that are replaced first, rounded
+	// up to at least one machine. Defaults to 10.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	// +optional
+	Percentage *int32 `json:"percentage,omitempty"`
+
+	// SoakDuration is how long the nodes of all canary machines must stay
+	// Ready before the rest of the fleet is refreshed. Defaults to 10m.
+	// +optional
+	SoakDuration *metav1.Duration `json:"soakDuration,omitempty"`
+
+	// Timeout is how long the canary machines have to become Ready before
+	// they are rolled back. Defaults to 30m.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// CanaryMachine is a machine replaced as part of the canary.
+type CanaryMachine struct {
+	Name string `json:"name"`
+
+	// PreviousAMI is the AMI the machine is rolled back to if the canary
+	// fails.
+	PreviousAMI string `json:"previousAMI"`
+}
+
+// CanaryStatus describes the progress of a canary.
+type CanaryStatus struct {
+	// AMI is the image being tried.
+	AMI string `json:"ami"`
+
+	Machines []CanaryMachine `json:"machines"`
+
+	// StartTime is when the canary machines were first recreated.
+	StartTime metav1.Time `json:"startTime"`
+
+	// SoakStartTime is when all canary machines first became healthy.
+	// +optional
+	SoakStartTime *metav1.Time `json:"soakStartTime,omitempty"`
+
+	// Passed is true once the canary machines stayed healthy for the soak
+	// duration.
+	// +optional
+	Passed bool `json:"passed,omitempty"`
+
+	// Message describes why the canary was rolled back.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// AWSMachineRefreshSpec defines the desired state of AWSMachineRefresh
+type AWSMachineRefreshSpec struct {
+	// Selector selects the AWSMachines in the same namespace to refresh.
+	Selector metav1.LabelSelector `json:"selector"`
+
+	// AMI is the image that selected machines are rolled to.
+	AMI string `json:"ami"`
+
+	// MaxUnavailable is the maximum number of machines that may be
+	// recreated at the same time. Defaults to 1.
+	// +optional
+	MaxUnavailable *int32 `json:"maxUnavailable,omitempty"`
+
+	// Canary, when set, first replaces a small part of the fleet and only
+	// continues once its nodes stayed healthy, rolling the canary machines
+	// back to their previous AMI otherwise.
+	// +optional
+	Canary *CanaryPolicy `json:"canary,omitempty"`
+}
+
+// AWSMachineRefreshStatus defines the observed state of AWSMachineRefresh
+type AWSMachineRefreshStatus struct {
+	Phase AWSMachineRefreshPhase `json:"phase,omitempty"`
+
+	// Total is the number of machines matched by the selector that are
+	// refreshed, excluding machines being deleted and externally managed
+	// machines.
+	Total int32 `json:"total"`
+
+	// Updated is the number of machines running the desired AMI.
+	Updated int32 `json:"updated"`
+
+	// Recreating lists the machines currently being replaced.
+	// +optional
+	Recreating []string `json:"recreating,omitempty"`
+
+	// Failed lists the machines with the target AMI that have failed, e.g.
+	// because their instance could not be launched with it. No further
+	// machines are recreated while any have failed.
+	// +optional
+	Failed []string `json:"failed,omitempty"`
+
+	// Canary describes the progress of the canary, if one is configured.
+	// +optional
+	Canary *CanaryStatus `json:"canary,omitempty"`
+
+	LastUpdated metav1.Time `json:"lastUpdated,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=awsmachinerefreshes,scope=Namespaced,categories=machine-api
+// +kubebuilder:storageversion
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="AMI",type="string",JSONPath=".spec.ami",description="Target AMI"
+// +kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase",description="Refresh phase"
+// +kubebuilder:printcolumn:name="Updated",type="integer",JSONPath=".status.updated",description="Machines running the target AMI"
+// +kubebuilder:printcolumn:name="Total",type="integer",JSONPath=".status.total",description="Machines selected"
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// AWSMachineRefresh rolls a new AMI across a set of AWSMachines by
+// sequentially recreating them.
+type AWSMachineRefresh struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AWSMachineRefreshSpec   `json:"spec,omitempty"`
+	Status AWSMachineRefreshStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// AWSMachineRefreshList contains a list of AWSMachineRefresh
+type AWSMachineRefreshList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []AWSMachineRefresh `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&AWSMachineRefresh{}, &AWSMachineRefreshList{})
+}
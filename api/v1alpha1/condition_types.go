@@ -0,0 +1,172 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConditionType is the type of a Condition.
+type ConditionType string
+
+const (
+	// CredentialsValidCondition is false when AWS rejected the credentials
+	// used by the controller as expired or invalid.
+	CredentialsValidCondition ConditionType = "CredentialsValid"
+
+	// DecommissionedCondition records the result of notifying the
+	// decommissioning webhook that a machine is being deleted.
+	DecommissionedCondition ConditionType = "Decommissioned"
+
+	// QuotaAvailableCondition is false when launching the machine would
+	// exceed the EC2 on-demand vCPU quota of the account.
+	QuotaAvailableCondition ConditionType = "QuotaAvailable"
+
+	// InstanceUpToDateCondition is false when fields of the spec that only
+	// take effect at launch (such as the AMI, instance type, subnets or
+	// security groups) were changed after the instance was launched. The
+	// instance is not changed, the machine must be replaced for the changes
+	// to take effect.
+	InstanceUpToDateCondition ConditionType = "InstanceUpToDate"
+
+	// BootstrapOutOfDateCondition is true when the user data of the
+	// instance differs from the current bootstrap data of the machine, i.e.
+	// the instance was built from a stale config.
+	BootstrapOutOfDateCondition ConditionType = "BootstrapOutOfDate"
+
+	// PermissionsGrantedCondition is false when the controller is missing
+	// IAM permissions needed to manage machines, see
+	// AWSInfrastructureProviderStatus.Permissions.
+	PermissionsGrantedCondition ConditionType = "PermissionsGranted"
+
+	// NetworkCleanedUpCondition is false while the network interfaces of a
+	// terminated instance are still being released. Only set for machines
+	// that wait for network cleanup on delete.
+	NetworkCleanedUpCondition ConditionType = "NetworkCleanedUp"
+
+	// ProviderIDUniqueCondition is false when another, older AWSMachine
+	// claims the same instance. The duplicate leaves the instance alone,
+	// also when it is deleted.
+	ProviderIDUniqueCondition ConditionType = "ProviderIDUnique"
+
+	// InstanceProfileValidCondition is false when the instance profile of
+	// the machine does not exist, does not match the path of its ARN or has
+	// no role, which is checked before launch.
+	InstanceProfileValidCondition ConditionType = "InstanceProfileValid"
+
+	// CredentialOutageCondition is true while AWS has been rejecting the
+	// credentials of the provider namespace for a sustained period. Launches
+	// and terminations of AWSMachines in the namespace are paused until a
+	// request succeeds again.
+	CredentialOutageCondition ConditionType = "CredentialOutage"
+
+	// AutoScalingInServiceCondition is false while the instance is in an
+	// Auto Scaling lifecycle state other than InService, such as
+	// Terminating:Wait. Only set for instances in an Auto Scaling group.
+	AutoScalingInServiceCondition ConditionType = "AutoScalingInService"
+
+	// LaunchGroupProvisionedCondition is true once every machine of the
+	// launch group of the machine has launched an instance. Only set for
+	// machines in a launch group.
+	LaunchGroupProvisionedCondition ConditionType = "LaunchGroupProvisioned"
+
+	// MaintenanceScheduledCondition is true while the instance has an
+	// upcoming scheduled event, such as maintenance or retirement, so that
+	// drains can be planned around it.
+	MaintenanceScheduledCondition ConditionType = "MaintenanceScheduled"
+
+	// InstanceLaunchedCondition is false after a launch of the machine
+	// failed, with the AWS error code as reason and a remedy in the message
+	// for common errors, and true once an instance was launched.
+	InstanceLaunchedCondition ConditionType = "InstanceLaunched"
+
+	// ExpiredCondition is true once the instance of the machine has run
+	// longer than its maximum age, see MachineExpiry.
+	ExpiredCondition ConditionType = "Expired"
+
+	// WithinLimitsCondition is false while launching the machine would
+	// exceed the limits of the provider in its namespace. The launch is held
+	// and retried until machines are removed or the limits raised.
+	WithinLimitsCondition ConditionType = "WithinLimits"
+
+	// EndpointReachableCondition is false while the reachability check of
+	// the machine fails, delaying its launch.
+	EndpointReachableCondition ConditionType = "EndpointReachable"
+)
+
+// Condition describes an aspect of the observed state of a resource.
+type Condition struct {
+	Type   ConditionType          `json:"type"`
+	Status corev1.ConditionStatus `json:"status"`
+
+	// LastTransitionTime is the last time the status changed.
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+
+	// Reason is a CamelCase reason for the last transition.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+
+	// Message is a human readable description of the last transition.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// Conditions is a list of conditions with unique types.
+type Conditions []Condition
+
+// Get returns the condition of the given type, or nil.
+func (c Conditions) Get(t ConditionType) *Condition {
+	for i := range c {
+		if c[i].Type == t {
+			return &c[i]
+		}
+	}
+	return nil
+}
+
+// IsFalse returns true if the condition of the given type exists and is
+// false.
+func (c Conditions) IsFalse(t ConditionType) bool {
+	cond := c.Get(t)
+	return cond != nil && cond.Status == corev1.ConditionFalse
+}
+
+// IsTrue returns true if the condition of the given type exists and is
+// true.
+func (c Conditions) IsTrue(t ConditionType) bool {
+	cond := c.Get(t)
+	return cond != nil && cond.Status == corev1.ConditionTrue
+}
+
+// Set adds or replaces the condition of the same type, preserving the
+// transition time when the status has not changed.
+func (c *Conditions) Set(cond Condition) {
+	if existing := c.Get(cond.Type); existing != nil {
+		if existing.Status == cond.Status {
+			cond.LastTransitionTime = existing.LastTransitionTime
+		} else if cond.LastTransitionTime.IsZero() {
+			cond.LastTransitionTime = metav1.Now()
+		}
+		*existing = cond
+		return
+	}
+	if cond.LastTransitionTime.IsZero() {
+		cond.LastTransitionTime = metav1.Now()
+	}
+	*c = append(*c, cond)
+}
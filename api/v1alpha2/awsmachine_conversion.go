@@ -0,0 +1,529 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// ConvertTo converts this AWSMachine to the hub version (v1alpha1).
+func (src *AWSMachine) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*infrav1.AWSMachine)
+	in := src.DeepCopy()
+	dst.ObjectMeta = in.ObjectMeta
+	convertSpecTo(&in.Spec, &dst.Spec)
+	convertStatusTo(&in.Status, &dst.Status)
+	dst.Spec.ProviderID = in.Status.ProviderID
+	return nil
+}
+
+// ConvertFrom converts from the hub version (v1alpha1) to this version.
+func (dst *AWSMachine) ConvertFrom(srcRaw conversion.Hub) error {
+	in := srcRaw.(*infrav1.AWSMachine).DeepCopy()
+	dst.ObjectMeta = in.ObjectMeta
+	convertSpecFrom(&in.Spec, &dst.Spec)
+	convertStatusFrom(&in.Status, &dst.Status)
+	dst.Status.ProviderID = in.Spec.ProviderID
+	return nil
+}
+
+// v1alpha1 treats the first block device as the root volume, so additional
+// volumes without one are converted after an empty root volume. They are
+// rejected by the validating webhook, see validateBlockDevices, but must
+// still convert, e.g. when they were admitted without the webhook.
+func convertSpecTo(in *AWSMachineSpec, out *infrav1.AWSMachineSpec) {
+	*out = infrav1.AWSMachineSpec{
+		AMI:                               in.AMI,
+		InstanceType:                      in.InstanceType,
+		OSFamily:                          infrav1.OSFamily(in.OSFamily),
+		UserDataFormat:                    infrav1.UserDataFormat(in.UserDataFormat),
+		BootstrapDataKey:                  in.BootstrapDataKey,
+		BootstrapMode:                     infrav1.BootstrapMode(in.BootstrapMode),
+		EKS:                               (*infrav1.EKSBootstrap)(in.EKS),
+		InstanceStorePolicy:               infrav1.InstanceStorePolicy(in.InstanceStorePolicy),
+		IAMInstanceProfile:                in.IAMInstanceProfile,
+		KeyName:                           in.KeyName,
+		Tags:                              in.Tags,
+		AvailabilityZone:                  in.AvailabilityZone,
+		Region:                            in.Region,
+		VPCID:                             in.Networking.VPCID,
+		SubnetIDs:                         in.Networking.SubnetIDs,
+		SecurityGroupIDs:                  in.Networking.SecurityGroupIDs,
+		SecurityGroupNames:                in.Networking.SecurityGroupNames,
+		NetworkInterfaceIDs:               in.Networking.NetworkInterfaceIDs,
+		WaitForNetworkCleanup:             in.Networking.WaitForNetworkCleanup,
+		PublicIP:                          in.Networking.PublicIP,
+		IPFamily:                          infrav1.IPFamily(in.Networking.IPFamily),
+		IPv6AddressCount:                  in.Networking.IPv6AddressCount,
+		IPv6Addresses:                     in.Networking.IPv6Addresses,
+		SourceDestCheck:                   in.Networking.SourceDestCheck,
+		WarmPool:                          in.WarmPool,
+		SecretRef:                         in.SecretRef,
+		CredentialsRef:                    in.CredentialsRef,
+		BootstrapTokenTTL:                 in.BootstrapTokenTTL,
+		BootstrapTokenKMSKeyID:            in.BootstrapTokenKMSKeyID,
+		InstanceInitiatedShutdownBehavior: in.InstanceInitiatedShutdownBehavior,
+		DeletionPolicy:                    infrav1.DeletionPolicy(in.DeletionPolicy),
+		PrimaryAddressType:                in.PrimaryAddressType,
+		AddressTypes:                      in.AddressTypes,
+		NodeLabels:                        in.NodeLabels,
+		NodeTaints:                        in.NodeTaints,
+		TargetGroupARNs:                   in.TargetGroupARNs,
+		AutoScalingGroup:                  in.AutoScalingGroup,
+		ImageReplication:                  in.ImageReplication,
+		UserDataTemplate:                  (*infrav1.UserDataTemplate)(in.UserDataTemplate),
+		Naming:                            (*infrav1.InstanceNaming)(in.Naming),
+		Proxy:                             (*infrav1.Proxy)(in.Proxy),
+		MaxAge:                            in.MaxAge,
+		FailureDomain:                     in.FailureDomain,
+	}
+	if in.RootVolume != nil {
+		out.BlockDevices = append(out.BlockDevices, infrav1.AWSBlockDeviceMapping{
+			DeviceName: in.RootVolume.DeviceName,
+			VolumeSize: in.RootVolume.Size,
+			VolumeType: in.RootVolume.Type,
+			Encrypted:  in.RootVolume.Encrypted,
+		})
+	} else if len(in.AdditionalVolumes) > 0 {
+		out.BlockDevices = append(out.BlockDevices, infrav1.AWSBlockDeviceMapping{})
+	}
+	for _, v := range in.AdditionalVolumes {
+		out.BlockDevices = append(out.BlockDevices, infrav1.AWSBlockDeviceMapping{
+			DeviceName: v.DeviceName,
+			VolumeSize: v.Size,
+			VolumeType: v.Type,
+			Encrypted:  v.Encrypted,
+		})
+	}
+	if in.Networking.ENAExpress != nil {
+		e := infrav1.ENAExpress(*in.Networking.ENAExpress)
+		out.ENAExpress = &e
+	}
+	if in.Networking.VPCSelector != nil {
+		s := infrav1.TagSelector(*in.Networking.VPCSelector)
+		out.VPCSelector = &s
+	}
+	if in.Networking.ElasticIP != nil {
+		out.ElasticIP = &infrav1.ElasticIP{
+			AllocationID: in.Networking.ElasticIP.AllocationID,
+			Selector:     (*infrav1.TagSelector)(in.Networking.ElasticIP.Selector),
+		}
+	}
+	if in.Networking.SecurityGroupSelector != nil {
+		s := infrav1.TagSelector(*in.Networking.SecurityGroupSelector)
+		out.SecurityGroupSelector = &s
+	}
+	if in.Networking.SubnetSelector != nil {
+		s := infrav1.TagSelector(*in.Networking.SubnetSelector)
+		out.SubnetSelector = &s
+	}
+	if in.Networking.SubnetExcludeSelector != nil {
+		s := infrav1.TagSelector(*in.Networking.SubnetExcludeSelector)
+		out.SubnetExcludeSelector = &s
+	}
+	if in.HibernationOptions != nil {
+		h := infrav1.HibernationOptions(*in.HibernationOptions)
+		out.HibernationOptions = &h
+	}
+	if in.CPUOptions != nil {
+		o := infrav1.CPUOptions(*in.CPUOptions)
+		out.CPUOptions = &o
+	}
+	if in.EnclaveOptions != nil {
+		o := infrav1.EnclaveOptions(*in.EnclaveOptions)
+		out.EnclaveOptions = &o
+	}
+	if in.MetadataOptions != nil {
+		o := infrav1.MetadataOptions(*in.MetadataOptions)
+		out.MetadataOptions = &o
+	}
+	if in.Placement != nil {
+		p := infrav1.Placement(*in.Placement)
+		out.Placement = &p
+	}
+	if in.ReadinessChecks != nil {
+		r := infrav1.ReadinessChecks(*in.ReadinessChecks)
+		out.ReadinessChecks = &r
+	}
+	if in.ReachabilityCheck != nil {
+		out.ReachabilityCheck = &infrav1.ReachabilityCheck{
+			Endpoint: in.ReachabilityCheck.Endpoint,
+			Method:   infrav1.ReachabilityMethod(in.ReachabilityCheck.Method),
+		}
+	}
+	for _, w := range in.MaintenanceWindows {
+		out.MaintenanceWindows = append(out.MaintenanceWindows, infrav1.MaintenanceWindow(w))
+	}
+	for _, lb := range in.LoadBalancers {
+		out.LoadBalancers = append(out.LoadBalancers, infrav1.LoadBalancerRef{
+			Type:             infrav1.LoadBalancerType(lb.Type),
+			Name:             lb.Name,
+			TargetGroupARN:   lb.TargetGroupARN,
+			AuthorizeIngress: lb.AuthorizeIngress,
+		})
+	}
+	if in.DNS != nil {
+		out.DNS = &infrav1.DNSRecord{
+			Name:          in.DNS.Name,
+			HostedZoneID:  in.DNS.HostedZoneID,
+			PrivateZone:   in.DNS.PrivateZone,
+			Shared:        in.DNS.Shared,
+			RoutingPolicy: infrav1.DNSRoutingPolicy(in.DNS.RoutingPolicy),
+			SetIdentifier: in.DNS.SetIdentifier,
+			Weight:        in.DNS.Weight,
+		}
+		if in.DNS.HealthCheck != nil {
+			hc := infrav1.DNSHealthCheck(*in.DNS.HealthCheck)
+			out.DNS.HealthCheck = &hc
+		}
+	}
+}
+
+func convertSpecFrom(in *infrav1.AWSMachineSpec, out *AWSMachineSpec) {
+	*out = AWSMachineSpec{
+		AMI:                 in.AMI,
+		InstanceType:        in.InstanceType,
+		OSFamily:            OSFamily(in.OSFamily),
+		UserDataFormat:      UserDataFormat(in.UserDataFormat),
+		BootstrapDataKey:    in.BootstrapDataKey,
+		BootstrapMode:       BootstrapMode(in.BootstrapMode),
+		EKS:                 (*EKSBootstrap)(in.EKS),
+		InstanceStorePolicy: InstanceStorePolicy(in.InstanceStorePolicy),
+		IAMInstanceProfile:  in.IAMInstanceProfile,
+		KeyName:             in.KeyName,
+		Tags:                in.Tags,
+		AvailabilityZone:    in.AvailabilityZone,
+		Region:              in.Region,
+		Networking: Networking{
+			VPCID:                 in.VPCID,
+			SubnetIDs:             in.SubnetIDs,
+			SecurityGroupIDs:      in.SecurityGroupIDs,
+			SecurityGroupNames:    in.SecurityGroupNames,
+			NetworkInterfaceIDs:   in.NetworkInterfaceIDs,
+			WaitForNetworkCleanup: in.WaitForNetworkCleanup,
+			PublicIP:              in.PublicIP,
+			IPFamily:              IPFamily(in.IPFamily),
+			IPv6AddressCount:      in.IPv6AddressCount,
+			IPv6Addresses:         in.IPv6Addresses,
+			SourceDestCheck:       in.SourceDestCheck,
+		},
+		WarmPool:                          in.WarmPool,
+		SecretRef:                         in.SecretRef,
+		CredentialsRef:                    in.CredentialsRef,
+		BootstrapTokenTTL:                 in.BootstrapTokenTTL,
+		BootstrapTokenKMSKeyID:            in.BootstrapTokenKMSKeyID,
+		InstanceInitiatedShutdownBehavior: in.InstanceInitiatedShutdownBehavior,
+		DeletionPolicy:                    DeletionPolicy(in.DeletionPolicy),
+		PrimaryAddressType:                in.PrimaryAddressType,
+		AddressTypes:                      in.AddressTypes,
+		NodeLabels:                        in.NodeLabels,
+		NodeTaints:                        in.NodeTaints,
+		TargetGroupARNs:                   in.TargetGroupARNs,
+		AutoScalingGroup:                  in.AutoScalingGroup,
+		ImageReplication:                  in.ImageReplication,
+		UserDataTemplate:                  (*UserDataTemplate)(in.UserDataTemplate),
+		Naming:                            (*InstanceNaming)(in.Naming),
+		Proxy:                             (*Proxy)(in.Proxy),
+		MaxAge:                            in.MaxAge,
+		FailureDomain:                     in.FailureDomain,
+	}
+	for i, b := range in.BlockDevices {
+		v := Volume{
+			DeviceName: b.DeviceName,
+			Size:       b.VolumeSize,
+			Type:       b.VolumeType,
+			Encrypted:  b.Encrypted,
+		}
+		if i == 0 {
+			out.RootVolume = &v
+			continue
+		}
+		out.AdditionalVolumes = append(out.AdditionalVolumes, v)
+	}
+	if in.ENAExpress != nil {
+		e := ENAExpress(*in.ENAExpress)
+		out.Networking.ENAExpress = &e
+	}
+	if in.VPCSelector != nil {
+		s := TagSelector(*in.VPCSelector)
+		out.Networking.VPCSelector = &s
+	}
+	if in.ElasticIP != nil {
+		out.Networking.ElasticIP = &ElasticIP{
+			AllocationID: in.ElasticIP.AllocationID,
+			Selector:     (*TagSelector)(in.ElasticIP.Selector),
+		}
+	}
+	if in.SecurityGroupSelector != nil {
+		s := TagSelector(*in.SecurityGroupSelector)
+		out.Networking.SecurityGroupSelector = &s
+	}
+	if in.SubnetSelector != nil {
+		s := TagSelector(*in.SubnetSelector)
+		out.Networking.SubnetSelector = &s
+	}
+	if in.SubnetExcludeSelector != nil {
+		s := TagSelector(*in.SubnetExcludeSelector)
+		out.Networking.SubnetExcludeSelector = &s
+	}
+	if in.HibernationOptions != nil {
+		h := HibernationOptions(*in.HibernationOptions)
+		out.HibernationOptions = &h
+	}
+	if in.CPUOptions != nil {
+		o := CPUOptions(*in.CPUOptions)
+		out.CPUOptions = &o
+	}
+	if in.EnclaveOptions != nil {
+		o := EnclaveOptions(*in.EnclaveOptions)
+		out.EnclaveOptions = &o
+	}
+	if in.MetadataOptions != nil {
+		o := MetadataOptions(*in.MetadataOptions)
+		out.MetadataOptions = &o
+	}
+	if in.Placement != nil {
+		p := Placement(*in.Placement)
+		out.Placement = &p
+	}
+	if in.ReadinessChecks != nil {
+		r := ReadinessChecks(*in.ReadinessChecks)
+		out.ReadinessChecks = &r
+	}
+	if in.ReachabilityCheck != nil {
+		out.ReachabilityCheck = &ReachabilityCheck{
+			Endpoint: in.ReachabilityCheck.Endpoint,
+			Method:   ReachabilityMethod(in.ReachabilityCheck.Method),
+		}
+	}
+	for _, w := range in.MaintenanceWindows {
+		out.MaintenanceWindows = append(out.MaintenanceWindows, MaintenanceWindow(w))
+	}
+	for _, lb := range in.LoadBalancers {
+		out.LoadBalancers = append(out.LoadBalancers, LoadBalancerRef{
+			Type:             LoadBalancerType(lb.Type),
+			Name:             lb.Name,
+			TargetGroupARN:   lb.TargetGroupARN,
+			AuthorizeIngress: lb.AuthorizeIngress,
+		})
+	}
+	if in.DNS != nil {
+		out.DNS = &DNSRecord{
+			Name:          in.DNS.Name,
+			HostedZoneID:  in.DNS.HostedZoneID,
+			PrivateZone:   in.DNS.PrivateZone,
+			Shared:        in.DNS.Shared,
+			RoutingPolicy: DNSRoutingPolicy(in.DNS.RoutingPolicy),
+			SetIdentifier: in.DNS.SetIdentifier,
+			Weight:        in.DNS.Weight,
+		}
+		if in.DNS.HealthCheck != nil {
+			hc := DNSHealthCheck(*in.DNS.HealthCheck)
+			out.DNS.HealthCheck = &hc
+		}
+	}
+}
+
+func convertStatusTo(in *AWSMachineStatus, out *infrav1.AWSMachineStatus) {
+	*out = infrav1.AWSMachineStatus{
+		Ready:                      in.Ready,
+		Addresses:                  in.Addresses,
+		PrimaryAddress:             in.PrimaryAddress,
+		InstanceState:              in.InstanceState,
+		InstanceStateReason:        in.InstanceStateReason,
+		Region:                     in.Region,
+		InstanceID:                 in.InstanceID,
+		InstanceName:               in.InstanceName,
+		AvailabilityZone:           in.AvailabilityZone,
+		Architecture:               in.Architecture,
+		EstimatedHourlyCost:        in.EstimatedHourlyCost,
+		AccumulatedCost:            in.AccumulatedCost,
+		CostLastUpdated:            in.CostLastUpdated,
+		DNSName:                    in.DNSName,
+		RecommendationsLastUpdated: in.RecommendationsLastUpdated,
+		ScaleInProtected:           in.ScaleInProtected,
+		AutoScalingGroupName:       in.AutoScalingGroupName,
+		HostID:                     in.HostID,
+		LaunchFailures:             in.LaunchFailures,
+		LastLaunchFailure:          in.LastLaunchFailure,
+		LaunchToken:                in.LaunchToken,
+		FailureReason:              in.FailureReason,
+		FailureMessage:             in.FailureMessage,
+	}
+	for _, c := range in.Conditions {
+		out.Conditions = append(out.Conditions, infrav1.Condition{
+			Type:               infrav1.ConditionType(c.Type),
+			Status:             c.Status,
+			LastTransitionTime: c.LastTransitionTime,
+			Reason:             c.Reason,
+			Message:            c.Message,
+		})
+	}
+	for _, e := range in.ScheduledEvents {
+		out.ScheduledEvents = append(out.ScheduledEvents, infrav1.ScheduledEvent(e))
+	}
+	for _, r := range in.Recommendations {
+		out.Recommendations = append(out.Recommendations, infrav1.Recommendation{
+			Type:         infrav1.RecommendationType(r.Type),
+			InstanceType: r.InstanceType,
+			Message:      r.Message,
+		})
+	}
+	for _, r := range in.Registrations {
+		out.Registrations = append(out.Registrations, infrav1.Registration{
+			Kind:          infrav1.RegistrationKind(r.Kind),
+			Resource:      r.Resource,
+			Name:          r.Name,
+			Value:         r.Value,
+			SetIdentifier: r.SetIdentifier,
+			HealthCheckID: r.HealthCheckID,
+		})
+	}
+	if in.InstanceConnect != nil {
+		ic := infrav1.InstanceConnectStatus(*in.InstanceConnect)
+		out.InstanceConnect = &ic
+	}
+	if in.ElasticIP != nil {
+		e := infrav1.ElasticIPStatus(*in.ElasticIP)
+		out.ElasticIP = &e
+	}
+	if in.Network != nil {
+		n := infrav1.NetworkStatus(*in.Network)
+		out.Network = &n
+	}
+	if in.Console != nil {
+		c := infrav1.ConsoleStatus(*in.Console)
+		out.Console = &c
+	}
+	if in.LastReboot != nil {
+		r := infrav1.RebootStatus(*in.LastReboot)
+		out.LastReboot = &r
+	}
+	if in.LastSync != nil {
+		s := infrav1.SyncStatus(*in.LastSync)
+		out.LastSync = &s
+	}
+}
+
+func convertStatusFrom(in *infrav1.AWSMachineStatus, out *AWSMachineStatus) {
+	*out = AWSMachineStatus{
+		Ready:                      in.Ready,
+		Addresses:                  in.Addresses,
+		PrimaryAddress:             in.PrimaryAddress,
+		InstanceState:              in.InstanceState,
+		InstanceStateReason:        in.InstanceStateReason,
+		Region:                     in.Region,
+		InstanceID:                 in.InstanceID,
+		InstanceName:               in.InstanceName,
+		AvailabilityZone:           in.AvailabilityZone,
+		Architecture:               in.Architecture,
+		EstimatedHourlyCost:        in.EstimatedHourlyCost,
+		AccumulatedCost:            in.AccumulatedCost,
+		CostLastUpdated:            in.CostLastUpdated,
+		DNSName:                    in.DNSName,
+		RecommendationsLastUpdated: in.RecommendationsLastUpdated,
+		ScaleInProtected:           in.ScaleInProtected,
+		AutoScalingGroupName:       in.AutoScalingGroupName,
+		HostID:                     in.HostID,
+		LaunchFailures:             in.LaunchFailures,
+		LastLaunchFailure:          in.LastLaunchFailure,
+		LaunchToken:                in.LaunchToken,
+		FailureReason:              in.FailureReason,
+		FailureMessage:             in.FailureMessage,
+	}
+	for _, c := range in.Conditions {
+		out.Conditions = append(out.Conditions, Condition{
+			Type:               string(c.Type),
+			Status:             c.Status,
+			LastTransitionTime: c.LastTransitionTime,
+			Reason:             c.Reason,
+			Message:            c.Message,
+		})
+	}
+	for _, e := range in.ScheduledEvents {
+		out.ScheduledEvents = append(out.ScheduledEvents, ScheduledEvent(e))
+	}
+	for _, r := range in.Recommendations {
+		out.Recommendations = append(out.Recommendations, Recommendation{
+			Type:         RecommendationType(r.Type),
+			InstanceType: r.InstanceType,
+			Message:      r.Message,
+		})
+	}
+	for _, r := range in.Registrations {
+		out.Registrations = append(out.Registrations, Registration{
+			Kind:          RegistrationKind(r.Kind),
+			Resource:      r.Resource,
+			Name:          r.Name,
+			Value:         r.Value,
+			SetIdentifier: r.SetIdentifier,
+			HealthCheckID: r.HealthCheckID,
+		})
+	}
+	if in.InstanceConnect != nil {
+		ic := InstanceConnectStatus(*in.InstanceConnect)
+		out.InstanceConnect = &ic
+	}
+	if in.ElasticIP != nil {
+		e := ElasticIPStatus(*in.ElasticIP)
+		out.ElasticIP = &e
+	}
+	if in.Network != nil {
+		n := NetworkStatus(*in.Network)
+		out.Network = &n
+	}
+	if in.Console != nil {
+		c := ConsoleStatus(*in.Console)
+		out.Console = &c
+	}
+	if in.LastReboot != nil {
+		r := RebootStatus(*in.LastReboot)
+		out.LastReboot = &r
+	}
+	if in.LastSync != nil {
+		s := SyncStatus(*in.LastSync)
+		out.LastSync = &s
+	}
+}
+
+// ConvertTo converts this AWSMachineList to the hub version (v1alpha1).
+func (src *AWSMachineList) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*infrav1.AWSMachineList)
+	dst.ListMeta = src.ListMeta
+	dst.Items = make([]infrav1.AWSMachine, len(src.Items))
+	for i := range src.Items {
+		if err := src.Items[i].ConvertTo(&dst.Items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConvertFrom converts from the hub version (v1alpha1) to this version.
+func (dst *AWSMachineList) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*infrav1.AWSMachineList)
+	dst.ListMeta = src.ListMeta
+	dst.Items = make([]AWSMachine, len(src.Items))
+	for i := range src.Items {
+		if err := dst.Items[i].ConvertFrom(&src.Items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
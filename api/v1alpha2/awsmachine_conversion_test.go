@@ -0,0 +1,73 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"testing"
+
+	fuzz "github.com/google/gofuzz"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/diff"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// TestFuzzyConversion converts random hub AWSMachines to v1alpha2 and back,
+// which must not lose any field.
+func TestFuzzyConversion(t *testing.T) {
+	f := fuzz.New().NilChance(0.3).NumElements(0, 3).Funcs(
+		func(m *metav1.ObjectMeta, c fuzz.Continue) {
+			m.Name = c.RandString()
+			m.Namespace = c.RandString()
+			c.Fuzz(&m.Labels)
+			c.Fuzz(&m.Annotations)
+		},
+	)
+	for i := 0; i < 1000; i++ {
+		hub := &infrav1.AWSMachine{}
+		f.Fuzz(hub)
+		hub.TypeMeta = metav1.TypeMeta{}
+
+		spoke := &AWSMachine{}
+		if err := spoke.ConvertFrom(hub.DeepCopy()); err != nil {
+			t.Fatalf("cannot convert from hub: %v", err)
+		}
+		restored := &infrav1.AWSMachine{}
+		if err := spoke.ConvertTo(restored); err != nil {
+			t.Fatalf("cannot convert to hub: %v", err)
+		}
+		if !apiequality.Semantic.DeepEqual(hub, restored) {
+			t.Fatalf("round trip changed the AWSMachine:\n%s", diff.ObjectReflectDiff(hub, restored))
+		}
+	}
+}
+
+// TestConvertAdditionalVolumesWithoutRootVolume converts additional volumes
+// without a root volume, which the validating webhook rejects, instead of
+// failing to read the AWSMachine.
+func TestConvertAdditionalVolumesWithoutRootVolume(t *testing.T) {
+	spoke := &AWSMachine{Spec: AWSMachineSpec{AdditionalVolumes: []Volume{{Size: 100, Type: "gp3"}}}}
+	hub := &infrav1.AWSMachine{}
+	if err := spoke.ConvertTo(hub); err != nil {
+		t.Fatalf("cannot convert to hub: %v", err)
+	}
+	expected := []infrav1.AWSBlockDeviceMapping{{}, {VolumeSize: 100, VolumeType: "gp3"}}
+	if !apiequality.Semantic.DeepEqual(hub.Spec.BlockDevices, expected) {
+		t.Errorf("block devices = %+v, want %+v", hub.Spec.BlockDevices, expected)
+	}
+}
@@ -0,0 +1,1105 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	machinev1 "github.com/criticalstack/machine-api/api/v1alpha1"
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// OSFamily is the operating system family of the machine image, which
+// determines how bootstrap data is encoded into instance user data.
+type OSFamily string
+
+const (
+	OSFamilyLinux   OSFamily = "linux"
+	OSFamilyWindows OSFamily = "windows"
+	// OSFamilyBottlerocket machines receive TOML settings translated from
+	// the bootstrap data.
+	OSFamilyBottlerocket OSFamily = "bottlerocket"
+	// OSFamilyFlatcar machines receive an Ignition config translated from
+	// the bootstrap data.
+	OSFamilyFlatcar OSFamily = "flatcar"
+)
+
+// UserDataTemplate configures rendering the bootstrap data of a machine as
+// a Go template. The template can refer to:
+//
+//	{{ .MachineName }}       the name of the AWSMachine
+//	{{ .Namespace }}         the namespace of the AWSMachine
+//	{{ .Region }}            the region of the instance
+//	{{ .AvailabilityZone }}  the zone of the instance, when placed with
+//	                         availabilityZone, failureDomain or control plane
+//	                         placement, and empty otherwise
+//	{{ .InstanceType }}      the instance type
+//	{{ .Spec }}              the spec of the AWSMachine, e.g. {{ .Spec.AMI }}
+//	{{ .Variables.<name> }}  the variables below
+//
+// Referring to anything else fails the machine.
+type UserDataTemplate struct {
+	// Variables are custom values for the template.
+	// +optional
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+// Proxy is the HTTP proxy of an instance.
+type Proxy struct {
+	// HTTPProxy is the proxy URL for HTTP requests.
+	// +optional
+	HTTPProxy string `json:"httpProxy,omitempty"`
+
+	// HTTPSProxy is the proxy URL for HTTPS requests.
+	// +optional
+	HTTPSProxy string `json:"httpsProxy,omitempty"`
+
+	// NoProxy are the hosts, domains and CIDRs reached directly. The
+	// loopback addresses and the instance metadata service are always
+	// reached directly.
+	// +optional
+	NoProxy []string `json:"noProxy,omitempty"`
+}
+
+// InstanceNaming names instances after their machine, so that they can be
+// told apart in the EC2 console.
+type InstanceNaming struct {
+	// Template is a Go template executed with the AWSMachine, e.g.
+	// "{{ .Namespace }}-{{ .Name }}". The name is lowercased with
+	// characters other than letters, digits and hyphens replaced by
+	// hyphens, and suffixed with a hash of the machine UID when another
+	// instance already has the name. It overrides a Name tag of Tags.
+	Template string `json:"template"`
+
+	// Hostname also sets the hostname of the instance to the name, with a
+	// cloud-config part added to the bootstrap data. Requires Linux
+	// cloud-init bootstrap data and is ignored by the EKS bootstrap modes,
+	// whose nodes are named after their private DNS name.
+	// +optional
+	Hostname bool `json:"hostname,omitempty"`
+}
+
+// DeletionPolicy is what happens to the instance of a deleted machine.
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete terminates the instance, and the machine is
+	// only released once the instance has terminated.
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyRetain leaves the instance running.
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+)
+
+// BootstrapMode is how the instance of a machine joins its cluster.
+type BootstrapMode string
+
+const (
+	// BootstrapModeCrit instances run the bootstrap data of the Config of
+	// their Machine.
+	BootstrapModeCrit BootstrapMode = "crit"
+	// BootstrapModeEKS instances join an EKS cluster by running the
+	// /etc/eks/bootstrap.sh script of EKS optimized Amazon Linux 2 AMIs.
+	BootstrapModeEKS BootstrapMode = "eks"
+	// BootstrapModeNodeadm instances join an EKS cluster with a nodeadm
+	// NodeConfig, for EKS optimized Amazon Linux 2023 AMIs.
+	BootstrapModeNodeadm BootstrapMode = "nodeadm"
+)
+
+// EKSBootstrap configures how instances join an EKS cluster. Nodes
+// authenticate with the IAM role of their instance profile, which must be
+// mapped in the cluster.
+type EKSBootstrap struct {
+	// ClusterName is the name of the EKS cluster.
+	ClusterName string `json:"clusterName"`
+
+	// APIServerEndpoint, CertificateAuthority (base64 encoded PEM) and
+	// ServiceCIDR of the cluster. The ServiceCIDR is only used by nodeadm.
+	// Described with eks:DescribeCluster when not set.
+	// +optional
+	APIServerEndpoint string `json:"apiServerEndpoint,omitempty"`
+	// +optional
+	CertificateAuthority string `json:"certificateAuthority,omitempty"`
+	// +optional
+	ServiceCIDR string `json:"serviceCIDR,omitempty"`
+
+	// KubeletExtraArgs are additional flags of the kubelet, e.g.
+	// --node-labels=role=worker.
+	// +optional
+	KubeletExtraArgs []string `json:"kubeletExtraArgs,omitempty"`
+}
+
+// UserDataFormat is how bootstrap data is encoded into instance user data.
+type UserDataFormat string
+
+const (
+	// UserDataFormatCloudConfigGzip is gzipped cloud-init user data.
+	UserDataFormatCloudConfigGzip UserDataFormat = "cloud-config-gzip"
+	// UserDataFormatCloudConfig is uncompressed cloud-init user data.
+	UserDataFormatCloudConfig UserDataFormat = "cloud-config"
+	// UserDataFormatIgnition is an Ignition config, passed as is.
+	UserDataFormatIgnition UserDataFormat = "ignition"
+	// UserDataFormatRaw is the bootstrap data passed as is.
+	UserDataFormatRaw UserDataFormat = "raw"
+)
+
+// InstanceStorePolicy is how the instance store volumes of an instance are
+// prepared at boot.
+type InstanceStorePolicy string
+
+const (
+	// InstanceStorePolicyRAID0 assembles the instance store volumes into a
+	// RAID0 array mounted for the kubelet and containerd.
+	InstanceStorePolicyRAID0 InstanceStorePolicy = "RAID0"
+)
+
+// IPFamily is the IP address family of the instance network interface.
+type IPFamily string
+
+const (
+	IPFamilyIPv4      IPFamily = "IPv4"
+	IPFamilyDualStack IPFamily = "DualStack"
+	IPFamilyIPv6      IPFamily = "IPv6"
+)
+
+// RecommendationType is the kind of change suggested by a Recommendation.
+type RecommendationType string
+
+const (
+	RecommendationDownsize RecommendationType = "Downsize"
+	RecommendationUpsize   RecommendationType = "Upsize"
+)
+
+// AWSMachineSpec defines the desired state of AWSMachine
+type AWSMachineSpec struct {
+	AMI          string `json:"ami,omitempty"`
+	InstanceType string `json:"instanceType,omitempty"`
+	// OSFamily is the operating system family of the AMI. Linux machines
+	// receive gzipped cloud-init user data, while Windows machines receive
+	// uncompressed EC2Launch user data wrapped in <powershell> tags.
+	// Bottlerocket and Flatcar machines receive the bootstrap cloud-config
+	// translated into TOML settings and an Ignition config, respectively,
+	// unless UserDataFormat is set. Defaults to linux.
+	// +kubebuilder:validation:Enum=linux;windows;bottlerocket;flatcar
+	// +optional
+	OSFamily OSFamily `json:"osFamily,omitempty"`
+	// UserDataFormat is how the bootstrap data is encoded into user data,
+	// for AMIs that reject gzipped cloud-config. Setting it disables the
+	// translation of bootstrap data for the OSFamily. Defaults to the
+	// encoding of the OSFamily.
+	// +kubebuilder:validation:Enum=cloud-config-gzip;cloud-config;ignition;raw
+	// +optional
+	UserDataFormat UserDataFormat `json:"userDataFormat,omitempty"`
+	// BootstrapDataKey is the key of the bootstrap data in the data secret
+	// of the Config. By default the first of cloud-config, value,
+	// userData, user-data and ignition in the secret is used, so that
+	// secrets of Config providers other than crit can be used as is. The
+	// format of the data is still set by UserDataFormat.
+	// +optional
+	BootstrapDataKey string `json:"bootstrapDataKey,omitempty"`
+	// BootstrapMode is how the instance joins its cluster. In the eks and
+	// nodeadm modes the user data is generated from EKS, and the bootstrap
+	// data of the Config of the Machine is not used. Defaults to crit.
+	// +kubebuilder:validation:Enum=crit;eks;nodeadm
+	// +optional
+	BootstrapMode BootstrapMode `json:"bootstrapMode,omitempty"`
+	// EKS is the cluster joined in the eks and nodeadm bootstrap modes.
+	// +optional
+	EKS *EKSBootstrap `json:"eks,omitempty"`
+	// InstanceStorePolicy configures the instance store volumes of instance
+	// types that have them, e.g. i3 and i4i. With RAID0 the volumes are
+	// assembled into a single RAID0 array at boot, which is mounted for
+	// the kubelet and containerd so that pods can use the local disks.
+	// Requires an instance type with instance store volumes and Linux
+	// cloud-init user data, or an eks or nodeadm bootstrap mode.
+	// +kubebuilder:validation:Enum=RAID0
+	// +optional
+	InstanceStorePolicy InstanceStorePolicy `json:"instanceStorePolicy,omitempty"`
+	// Proxy is the HTTP proxy containerd, the kubelet and other bootstrap
+	// processes of the instance use to reach the internet, for instances
+	// in subnets without direct egress. It is added to the bootstrap data
+	// as a boothook and requires Linux cloud-init user data or an eks or
+	// nodeadm bootstrap mode.
+	// +optional
+	Proxy *Proxy `json:"proxy,omitempty"`
+	// RootVolume is the root volume of the instance. Uses the size and type
+	// of the AMI when not set.
+	// +optional
+	RootVolume *Volume `json:"rootVolume,omitempty"`
+	// AdditionalVolumes are attached to the instance in addition to the
+	// root volume. Requires RootVolume to be set.
+	// +optional
+	AdditionalVolumes []Volume `json:"additionalVolumes,omitempty"`
+	// IAMInstanceProfile is the name or ARN of the instance profile of the
+	// instance.
+	// +kubebuilder:validation:Pattern=`^(arn:aws[a-z-]*:iam::[0-9]{12}:instance-profile/([\w+=,.@-]+/)*)?[\w+=,.@-]{1,128}$`
+	// +optional
+	IAMInstanceProfile string `json:"iamInstanceProfile,omitempty"`
+	// +optional
+	KeyName string `json:"keyName,omitempty"`
+	// +optional
+	Tags map[string]string `json:"tags,omitempty"`
+	// AvailabilityZone of the instance.
+	// +optional
+	AvailabilityZone string `json:"availabilityZone,omitempty"`
+	// Region of the instance. Defaults to the region of the provider in the
+	// same namespace, and then to the region of the controller.
+	// +optional
+	Region string `json:"region,omitempty"`
+	// Networking configures the network interfaces of the instance.
+	// +optional
+	Networking Networking `json:"networking,omitempty"`
+	// WarmPool is the name of a warm pool of the provider in the same
+	// namespace. A stopped instance from the pool is started with fresh
+	// bootstrap data instead of launching a new one, as long as the AMI and
+	// instance type of the pool template match. Falls back to launching an
+	// instance when the pool is empty.
+	// +optional
+	WarmPool string `json:"warmPool,omitempty"`
+	// ImageReplication is the name of an image replication of the provider
+	// in the same namespace. The copy of its AMI in the region of the
+	// machine is used when AMI is not set, and the launch waits until the
+	// copy is available.
+	// +optional
+	ImageReplication string `json:"imageReplication,omitempty"`
+	// UserDataTemplate renders the bootstrap data as a Go template before
+	// it is encoded into user data, e.g. for per-machine hostnames, see
+	// UserDataTemplate. Bootstrap data is passed as is when unset.
+	// +optional
+	UserDataTemplate *UserDataTemplate `json:"userDataTemplate,omitempty"`
+	// Naming sets the Name tag, and optionally the hostname, of the
+	// instance from a template of the machine.
+	// +optional
+	Naming *InstanceNaming `json:"naming,omitempty"`
+	// SecretRef is a Secret holding static keys in AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY used for all AWS requests made for the machine.
+	// Secrets in other namespaces may only be used when the
+	// AWSInfrastructureProvider of their namespace shares them with the
+	// namespace of the machine, see sharedCredentials.
+	// +optional
+	SecretRef *corev1.ObjectReference `json:"secretRef,omitempty"`
+	// CredentialsRef is the name of an AWSCredentials in the same namespace
+	// used for all AWS requests made for the machine. Takes precedence over
+	// SecretRef.
+	// +optional
+	CredentialsRef *corev1.LocalObjectReference `json:"credentialsRef,omitempty"`
+	// BootstrapTokenTTL makes crit workers join with a new bootstrap token
+	// for every launch attempt, which expires after this long.
+	// +optional
+	BootstrapTokenTTL *metav1.Duration `json:"bootstrapTokenTTL,omitempty"`
+	// BootstrapTokenKMSKeyID is the KMS key the join token of crit worker
+	// bootstrap data is encrypted with, so that the token cannot be read
+	// from the user data of the instance. The token is decrypted on the
+	// instance with the AWS CLI before crit runs, so the AMI needs the AWS
+	// CLI and the instance profile kms:Decrypt on the key for the
+	// encryption context machine=<namespace>/<name>. Bootstrap fails before
+	// crit runs, with a message in the cloud-init output, otherwise.
+	// +optional
+	BootstrapTokenKMSKeyID string `json:"bootstrapTokenKMSKeyID,omitempty"`
+	// InstanceInitiatedShutdownBehavior controls whether the instance stops
+	// or terminates when shut down from within the operating system.
+	// +kubebuilder:validation:Enum=stop;terminate
+	// +optional
+	InstanceInitiatedShutdownBehavior string `json:"instanceInitiatedShutdownBehavior,omitempty"`
+	// DeletionPolicy is what happens to the instance when the machine is
+	// deleted. Retain leaves the instance and the resources created with
+	// it running, and only releases the machine. Defaults to Delete.
+	// +kubebuilder:validation:Enum=Delete;Retain
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	// HibernationOptions enables hibernation for the instance. Hibernation
+	// requires an encrypted root volume large enough to hold the instance
+	// memory and an instance type that supports it.
+	// +optional
+	HibernationOptions *HibernationOptions `json:"hibernationOptions,omitempty"`
+	// CPUOptions set the number of CPU cores and threads per core of the
+	// instance, e.g. to disable hyperthreading for license-bound or HPC
+	// workloads. The values must be valid for the instance type.
+	// +optional
+	CPUOptions *CPUOptions `json:"cpuOptions,omitempty"`
+	// EnclaveOptions enable AWS Nitro Enclaves on the instance.
+	// +optional
+	EnclaveOptions *EnclaveOptions `json:"enclaveOptions,omitempty"`
+	// MetadataOptions configures the instance metadata service.
+	// +optional
+	MetadataOptions *MetadataOptions `json:"metadataOptions,omitempty"`
+	// Placement places the instance on a dedicated host.
+	// +optional
+	Placement *Placement `json:"placement,omitempty"`
+	// PrimaryAddressType selects which address type is considered the
+	// machine's primary address, published in status.primaryAddress for
+	// node registration and DNS. Defaults to InternalIP.
+	// +kubebuilder:validation:Enum=InternalIP;InternalDNS;ExternalIP;ExternalDNS
+	// +optional
+	PrimaryAddressType machinev1.MachineAddressType `json:"primaryAddressType,omitempty"`
+	// AddressTypes are the address types published in status.addresses,
+	// in order, for components that use the first address of the machine.
+	// Addresses of other types are not published, e.g. leaving out
+	// ExternalIP and ExternalDNS keeps public addresses from being
+	// advertised. The primary address type must be included. Defaults to
+	// all addresses of each network interface, internal before external.
+	// +optional
+	AddressTypes []machinev1.MachineAddressType `json:"addressTypes,omitempty"`
+	// ReadinessChecks delays marking the machine ready until the instance
+	// passes the configured checks.
+	// +optional
+	ReadinessChecks *ReadinessChecks `json:"readinessChecks,omitempty"`
+	// ReachabilityCheck delays the launch of the machine until the control
+	// plane endpoint is reachable from the subnets it may be launched in,
+	// so that machines are not launched into subnets they cannot bootstrap
+	// from.
+	// +optional
+	ReachabilityCheck *ReachabilityCheck `json:"reachabilityCheck,omitempty"`
+	// MaintenanceWindows restricts when disruptive actions may be performed
+	// on this machine, overriding any windows set on the provider.
+	// +optional
+	MaintenanceWindows []MaintenanceWindow `json:"maintenanceWindows,omitempty"`
+	// NodeLabels are applied to the Node once it registers and kept in
+	// sync with the AWSMachine.
+	// +optional
+	NodeLabels map[string]string `json:"nodeLabels,omitempty"`
+	// NodeTaints are applied to the Node once it registers and kept in
+	// sync with the AWSMachine.
+	// +optional
+	NodeTaints []corev1.Taint `json:"nodeTaints,omitempty"`
+	// DNS creates an A record in Route53 for the machine once it is
+	// launched, and deletes it when the machine is deleted.
+	// +optional
+	DNS *DNSRecord `json:"dns,omitempty"`
+	// TargetGroupARNs are load balancer target groups the instance is
+	// registered with once it is launched, and deregistered from when the
+	// machine is deleted.
+	// +optional
+	TargetGroupARNs []string `json:"targetGroupARNs,omitempty"`
+	// LoadBalancers are existing Classic, Application and Network load
+	// balancers the instance is registered with once it is launched, and
+	// deregistered from when the machine is deleted.
+	// +optional
+	LoadBalancers []LoadBalancerRef `json:"loadBalancers,omitempty"`
+	// AutoScalingGroup is the name of an Auto Scaling group the instance
+	// is attached to once it is running, and detached from before it is
+	// terminated. Attaching increments the desired capacity of the group,
+	// detaching does not decrement it, so that the group replaces the
+	// instance.
+	// +optional
+	AutoScalingGroup string `json:"autoScalingGroup,omitempty"`
+	// MaxAge is how long the instance of the machine may run before the
+	// machine is due for replacement, overriding the max age of the
+	// provider. See MachineExpiry.
+	// +optional
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+	// FailureDomain is the failure domain unique identifier this Machine
+	// should be attached to. For this infrastructure provider, the ID is an
+	// AWS Availability Zone or region, which the region and availability
+	// zone of the machine default to.
+	// +optional
+	FailureDomain *string `json:"failureDomain,omitempty"`
+}
+
+// Volume is an EBS volume attached to the instance.
+type Volume struct {
+	// DeviceName defaults to the conventional device name for the position
+	// of the volume, e.g. /dev/xvda for the root volume on Linux. Legacy
+	// Linux device names (e.g. sdb, /dev/hdb or /dev/nvme1n1) are
+	// translated to the names EC2 expects.
+	// +optional
+	DeviceName string `json:"deviceName,omitempty"`
+	// Size of the volume in GiB.
+	Size int64 `json:"size"`
+	// +kubebuilder:validation:Enum=standard;gp2;gp3;io1;io2;st1;sc1
+	// +optional
+	Type string `json:"type,omitempty"`
+	// +optional
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// Networking configures the network interfaces of the instance.
+type Networking struct {
+	// +optional
+	VPCID string `json:"vpcID,omitempty"`
+	// VPCSelector selects the VPC by tags when the instance is launched.
+	// Ignored when VPCID is set. Exactly one VPC must match.
+	// +optional
+	VPCSelector *TagSelector `json:"vpcSelector,omitempty"`
+	// +optional
+	SubnetIDs []string `json:"subnetIDs,omitempty"`
+	// SubnetSelector selects subnets by tags when the instance is launched.
+	// When SubnetIDs are set as well, subnets must match both.
+	// +optional
+	SubnetSelector *TagSelector `json:"subnetSelector,omitempty"`
+	// SubnetExcludeSelector excludes subnets having any of its tags.
+	// +optional
+	SubnetExcludeSelector *TagSelector `json:"subnetExcludeSelector,omitempty"`
+	// +optional
+	SecurityGroupIDs []string `json:"securityGroupIDs,omitempty"`
+	// +optional
+	SecurityGroupNames []string `json:"securityGroupNames,omitempty"`
+	// SecurityGroupSelector adds the security groups of the VPC of the
+	// instance that have its tags, resolved when the instance is launched.
+	// +optional
+	SecurityGroupSelector *TagSelector `json:"securityGroupSelector,omitempty"`
+	// NetworkInterfaceIDs are existing network interfaces attached to the
+	// instance at launch, in device index order, instead of creating one.
+	// They determine the subnet, private addresses and security groups of
+	// the instance, and are left in place when the instance is terminated.
+	// +optional
+	NetworkInterfaceIDs []string `json:"networkInterfaceIDs,omitempty"`
+	// WaitForNetworkCleanup keeps the machine from being deleted until the
+	// network interfaces of its terminated instance have been released.
+	// +optional
+	WaitForNetworkCleanup bool `json:"waitForNetworkCleanup,omitempty"`
+	// PublicIP assigns a public IPv4 address to the primary network
+	// interface.
+	// +optional
+	PublicIP bool `json:"publicIP,omitempty"`
+	// ElasticIP associates an existing Elastic IP with the instance once
+	// it is running. Elastic IPs claimed from a pool are returned to the
+	// pool when the machine is deleted.
+	// +optional
+	ElasticIP *ElasticIP `json:"elasticIP,omitempty"`
+	// IPFamily selects IPv4, dual-stack or IPv6-only subnets. Defaults to
+	// DualStack when IPv6 addresses are requested and IPv4 otherwise.
+	// +kubebuilder:validation:Enum=IPv4;DualStack;IPv6
+	// +optional
+	IPFamily IPFamily `json:"ipFamily,omitempty"`
+	// IPv6AddressCount is the number of IPv6 addresses assigned to the
+	// primary network interface from the subnet range. Defaults to 1 for
+	// IPv6-only instances.
+	// +optional
+	IPv6AddressCount *int64 `json:"ipv6AddressCount,omitempty"`
+	// IPv6Addresses are specific IPv6 addresses assigned to the primary
+	// network interface. Cannot be used with IPv6AddressCount.
+	// +optional
+	IPv6Addresses []string `json:"ipv6Addresses,omitempty"`
+	// ENAExpress enables ENA Express (SRD) on the primary network interface
+	// for lower latency between instances in the same availability zone.
+	// The instance type must support ENA Express, which is validated at
+	// admission when the instance type can be described. ENA Express is
+	// configured on the interface once the instance is running.
+	// +optional
+	ENAExpress *ENAExpress `json:"enaExpress,omitempty"`
+	// SourceDestCheck sets the source/destination check of the instance,
+	// which must be disabled for instances routing traffic of other
+	// instances, e.g. NAT instances or egress gateways. The attribute is
+	// reset when changed out of band. Defaults to the EC2 default, enabled.
+	// +optional
+	SourceDestCheck *bool `json:"sourceDestCheck,omitempty"`
+}
+
+// TagSelector matches AWS resources by their tags.
+type TagSelector struct {
+	// Tags the resource must have. A value of "*" matches any value of the
+	// tag.
+	Tags map[string]string `json:"tags"`
+}
+
+// ReadinessChecks are performed after launch before the machine is marked
+// ready. If the checks do not pass within the timeout the machine fails.
+type ReadinessChecks struct {
+	// StatusChecks waits for the EC2 instance and system status checks to
+	// pass.
+	// +optional
+	StatusChecks bool `json:"statusChecks,omitempty"`
+
+	// TCPPort waits for the port (e.g. kubelet 10250) to accept connections
+	// on the machine's primary address.
+	// +optional
+	TCPPort *int32 `json:"tcpPort,omitempty"`
+
+	// LoadBalancers waits for the instance to be healthy in the load
+	// balancers and target groups it is registered with.
+	// +optional
+	LoadBalancers bool `json:"loadBalancers,omitempty"`
+
+	// Timeout is how long after launch the checks may take to pass.
+	// Defaults to 10m.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+}
+
+// MaintenanceWindow is a recurring period of time during which disruptive
+// actions are permitted.
+type MaintenanceWindow struct {
+	// Schedule is a standard 5-field cron expression for when the window
+	// opens.
+	Schedule string `json:"schedule"`
+
+	// Duration is how long the window stays open.
+	Duration metav1.Duration `json:"duration"`
+
+	// TimeZone is the IANA time zone the schedule is evaluated in. Defaults
+	// to UTC.
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// ReachabilityMethod is how the reachability of an endpoint is checked.
+type ReachabilityMethod string
+
+const (
+	// ReachabilityRoutes checks that the route tables of the subnets have
+	// an active route to the addresses of the endpoint.
+	ReachabilityRoutes ReachabilityMethod = "Routes"
+
+	// ReachabilityDial connects to the endpoint from the controller, which
+	// is only meaningful when the controller runs in the network of the
+	// machines.
+	ReachabilityDial ReachabilityMethod = "Dial"
+)
+
+// ReachabilityCheck is performed before launch, keeping the machine from
+// launching while the endpoint is unreachable.
+type ReachabilityCheck struct {
+	// Endpoint is the HOST:PORT of the control plane, e.g.
+	// "api.example.com:6443".
+	Endpoint string `json:"endpoint"`
+
+	// Method of the check. Defaults to Routes.
+	// +kubebuilder:validation:Enum=Routes;Dial
+	// +optional
+	Method ReachabilityMethod `json:"method,omitempty"`
+}
+
+// DNSRecord is a Route53 A record pointing at the machine.
+type DNSRecord struct {
+	// Name is a Go template for the record name, executed with the
+	// AWSMachine, e.g. "{{ .Name }}.nodes.example.com".
+	Name string `json:"name"`
+
+	// HostedZoneID is the hosted zone of the record, which may be public or
+	// private. Private zones must be associated with the VPC of the
+	// instance. The zone is looked up from the record name when not set.
+	// +optional
+	HostedZoneID string `json:"hostedZoneID,omitempty"`
+
+	// PrivateZone looks up the private hosted zone of the record name that
+	// is associated with the VPC of the instance, instead of the public
+	// zone. Ignored when HostedZoneID is set.
+	// +optional
+	PrivateZone bool `json:"privateZone,omitempty"`
+
+	// Shared adds the address of the machine to a record shared with other
+	// machines, e.g. a control plane endpoint, instead of replacing the
+	// addresses of the record. Only the address of the machine is removed
+	// when it is deleted.
+	// +optional
+	Shared bool `json:"shared,omitempty"`
+
+	// RoutingPolicy of the record. Simple records hold the addresses of
+	// every machine sharing them, while Weighted and MultiValue records are
+	// a record set per machine with the same name, distinguished by
+	// SetIdentifier. Defaults to Simple.
+	// +kubebuilder:validation:Enum=Simple;Weighted;MultiValue
+	// +optional
+	RoutingPolicy DNSRoutingPolicy `json:"routingPolicy,omitempty"`
+
+	// SetIdentifier is a Go template for the set identifier of Weighted and
+	// MultiValue records, executed with the AWSMachine. Defaults to the
+	// namespace and name of the machine.
+	// +optional
+	SetIdentifier string `json:"setIdentifier,omitempty"`
+
+	// Weight of Weighted records. Defaults to 1.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=255
+	// +optional
+	Weight *int64 `json:"weight,omitempty"`
+
+	// HealthCheck creates a Route53 health check of the address of the
+	// machine for Weighted and MultiValue records, so that the record is
+	// only returned while the machine is healthy. For Shared records, the
+	// address of the machine is only included in the record while its
+	// health check passes, though the last address is never removed. It
+	// is deleted along with the record.
+	// +optional
+	HealthCheck *DNSHealthCheck `json:"healthCheck,omitempty"`
+}
+
+// DNSRoutingPolicy is the Route53 routing policy of a record.
+type DNSRoutingPolicy string
+
+const (
+	DNSRoutingSimple     DNSRoutingPolicy = "Simple"
+	DNSRoutingWeighted   DNSRoutingPolicy = "Weighted"
+	DNSRoutingMultiValue DNSRoutingPolicy = "MultiValue"
+)
+
+// DNSHealthCheck is a Route53 health check of the address of a machine.
+type DNSHealthCheck struct {
+	// Type of the health check.
+	// +kubebuilder:validation:Enum=TCP;HTTP;HTTPS
+	Type string `json:"type"`
+
+	// Port checked, e.g. 6443 for a control plane endpoint.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int64 `json:"port"`
+
+	// ResourcePath requested by HTTP and HTTPS health checks.
+	// +optional
+	ResourcePath string `json:"resourcePath,omitempty"`
+}
+
+// LoadBalancerType is the type of an Elastic Load Balancing load balancer.
+type LoadBalancerType string
+
+const (
+	LoadBalancerClassic     LoadBalancerType = "Classic"
+	LoadBalancerApplication LoadBalancerType = "Application"
+	LoadBalancerNetwork     LoadBalancerType = "Network"
+)
+
+// LoadBalancerRef is an existing load balancer machines are registered
+// with. Classic load balancers are referred to by name, Application and
+// Network load balancers by the target group the instance is registered
+// with.
+type LoadBalancerRef struct {
+	// +kubebuilder:validation:Enum=Classic;Application;Network
+	Type LoadBalancerType `json:"type"`
+
+	// Name of a Classic load balancer.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// TargetGroupARN of an Application or Network load balancer target
+	// group.
+	// +optional
+	TargetGroupARN string `json:"targetGroupARN,omitempty"`
+
+	// AuthorizeIngress allows traffic from the security groups of the
+	// load balancer of the target group to the target group and health
+	// check ports of the instance, by adding rules to the first security
+	// group of the instance. The rules are not removed when the machine is
+	// deleted, since the security group may be shared with other machines.
+	// Only supported by Application and Network load balancers.
+	// +optional
+	AuthorizeIngress bool `json:"authorizeIngress,omitempty"`
+}
+
+// RegistrationKind is the kind of resource a machine is registered with.
+type RegistrationKind string
+
+const (
+	RegistrationDNSRecord           RegistrationKind = "DNSRecord"
+	RegistrationTargetGroup         RegistrationKind = "TargetGroup"
+	RegistrationClassicLoadBalancer RegistrationKind = "ClassicLoadBalancer"
+)
+
+// Registration records that the machine was added to a resource it does not
+// own, so that it is removed again when the machine is deleted.
+type Registration struct {
+	Kind RegistrationKind `json:"kind"`
+
+	// Resource is the hosted zone ID of DNS records, the ARN of target
+	// groups and the name of Classic load balancers.
+	Resource string `json:"resource"`
+
+	// Name is the name of DNS records.
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Value is the address added to DNS records and the instance ID
+	// registered with target groups and Classic load balancers.
+	Value string `json:"value"`
+
+	// SetIdentifier is the set identifier of Weighted and MultiValue DNS
+	// records.
+	// +optional
+	SetIdentifier string `json:"setIdentifier,omitempty"`
+
+	// HealthCheckID is the Route53 health check created for the DNS record.
+	// +optional
+	HealthCheckID string `json:"healthCheckID,omitempty"`
+}
+
+// ConsoleStatus refers to the Secret holding the collected console output
+// (console-output.txt) and screenshot (screenshot.jpg) of the instance.
+type ConsoleStatus struct {
+	SecretName     string      `json:"secretName"`
+	CollectionTime metav1.Time `json:"collectionTime"`
+}
+
+// RebootStatus records the last reboot requested with the
+// restart.infrastructure.crit.sh/requested-at annotation.
+type RebootStatus struct {
+	// RequestedAt is the value of the annotation that requested the reboot.
+	RequestedAt string `json:"requestedAt"`
+	// Time is when the instance was rebooted.
+	Time metav1.Time `json:"time"`
+}
+
+// SyncStatus records the last status sync requested with the
+// sync.infrastructure.crit.sh/requested-at annotation.
+type SyncStatus struct {
+	// RequestedAt is the value of the annotation that requested the sync.
+	RequestedAt string `json:"requestedAt"`
+	// Time is when the status was synced with the instance.
+	Time metav1.Time `json:"time"`
+}
+
+// ScheduledEvent is a scheduled event or spot interruption of an instance.
+type ScheduledEvent struct {
+	// Code is the type of the event, e.g. system-maintenance,
+	// instance-reboot, instance-retirement or spot-interruption.
+	Code string `json:"code"`
+	// Description describes the event.
+	// +optional
+	Description string `json:"description,omitempty"`
+	// NotBefore is the earliest time the event may start.
+	NotBefore metav1.Time `json:"notBefore"`
+}
+
+// Placement places an instance on a dedicated host, e.g. for software
+// licensed per socket or core.
+type Placement struct {
+	// HostID is the dedicated host the instance is launched on.
+	// +optional
+	HostID string `json:"hostID,omitempty"`
+
+	// Affinity of the instance to the host. With host affinity a stopped
+	// instance is always restarted on the same host. Defaults to default.
+	// +kubebuilder:validation:Enum=default;host
+	// +optional
+	Affinity string `json:"affinity,omitempty"`
+
+	// AllocateHost allocates a dedicated host for the instance when HostID
+	// is not set. The host is released once the instance has terminated.
+	// Requires the availability zone of the machine to be set.
+	// +optional
+	AllocateHost bool `json:"allocateHost,omitempty"`
+}
+
+// MetadataOptions configures the instance metadata service of the instance.
+type MetadataOptions struct {
+	// InstanceMetadataTags makes the tags of the instance readable from
+	// instance metadata. Tag keys of such instances may not contain "/" or
+	// spaces, so "/" in the keys of tags set by the controller is replaced
+	// with ":" on the instance. Defaults to disabled.
+	// +kubebuilder:validation:Enum=enabled;disabled
+	// +optional
+	InstanceMetadataTags string `json:"instanceMetadataTags,omitempty"`
+}
+
+// CPUOptions are the CPU cores and threads per core of an instance.
+type CPUOptions struct {
+	// CoreCount is the number of CPU cores. Defaults to the default core
+	// count of the instance type.
+	// +optional
+	CoreCount *int64 `json:"coreCount,omitempty"`
+	// ThreadsPerCore is the number of threads per core, 1 to disable
+	// hyperthreading. Defaults to the default threads per core of the
+	// instance type.
+	// +optional
+	ThreadsPerCore *int64 `json:"threadsPerCore,omitempty"`
+	// AMDSEVSNP enables AMD SEV-SNP, encrypting the memory of the instance
+	// with keys isolated from the hypervisor. Requires an instance type and
+	// AMI that support it.
+	// +optional
+	AMDSEVSNP bool `json:"amdSevSnp,omitempty"`
+}
+
+// EnclaveOptions configure AWS Nitro Enclaves.
+type EnclaveOptions struct {
+	// Enabled allows the instance to run Nitro Enclaves. Requires an
+	// instance type that supports them, and cannot be used with
+	// hibernation.
+	Enabled bool `json:"enabled"`
+}
+
+type HibernationOptions struct {
+	Configured bool `json:"configured"`
+}
+
+type ENAExpress struct {
+	Enabled bool `json:"enabled"`
+	// UDP enables ENA Express for UDP traffic in addition to TCP.
+	// +optional
+	UDP bool `json:"udp,omitempty"`
+}
+
+// Recommendation suggests a different instance type for a machine.
+type Recommendation struct {
+	Type RecommendationType `json:"type"`
+
+	// InstanceType is the suggested instance type.
+	InstanceType string `json:"instanceType"`
+
+	// Message explains the recommendation, e.g. "downsize to m5.large".
+	Message string `json:"message"`
+}
+
+// ElasticIP selects an existing Elastic IP associated with the instance.
+type ElasticIP struct {
+	// AllocationID is the allocation ID of the Elastic IP.
+	// +optional
+	AllocationID string `json:"allocationID,omitempty"`
+
+	// Selector claims an unassociated Elastic IP with its tags from a pool
+	// of Elastic IPs that are not claimed by other machines. Ignored when
+	// AllocationID is set.
+	// +optional
+	Selector *TagSelector `json:"selector,omitempty"`
+}
+
+// ElasticIPStatus is the Elastic IP claimed by a machine.
+type ElasticIPStatus struct {
+	AllocationID string `json:"allocationID"`
+	PublicIP     string `json:"publicIP,omitempty"`
+
+	// InstanceID is the instance the Elastic IP was last associated with.
+	// +optional
+	InstanceID string `json:"instanceID,omitempty"`
+}
+
+// NetworkStatus is the network placement of an instance.
+type NetworkStatus struct {
+	VPCID    string `json:"vpcID,omitempty"`
+	SubnetID string `json:"subnetID,omitempty"`
+
+	// PrimaryNetworkInterfaceID is the network interface at device index 0.
+	// +optional
+	PrimaryNetworkInterfaceID string `json:"primaryNetworkInterfaceID,omitempty"`
+
+	// SecurityGroupIDs are the security groups of the instance.
+	// +optional
+	SecurityGroupIDs []string `json:"securityGroupIDs,omitempty"`
+}
+
+// InstanceConnectStatus holds connection hints for reaching a private
+// instance through an EC2 Instance Connect Endpoint without a bastion.
+type InstanceConnectStatus struct {
+	EndpointID string `json:"endpointID"`
+	InstanceID string `json:"instanceID"`
+	// Command is an example AWS CLI command for opening an SSH session to
+	// the instance through the endpoint.
+	// +optional
+	Command string `json:"command,omitempty"`
+}
+
+// Condition describes an aspect of the observed state of a resource.
+type Condition struct {
+	Type   string                 `json:"type"`
+	Status corev1.ConditionStatus `json:"status"`
+
+	// LastTransitionTime is the last time the status changed.
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+
+	// Reason is a CamelCase reason for the last transition.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+
+	// Message is a human readable description of the last transition.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// AWSMachineStatus defines the observed state of AWSMachine
+type AWSMachineStatus struct {
+	// Ready is true when the provider resource is ready.
+	// +optional
+	Ready bool `json:"ready"`
+
+	// ProviderID is the identifier of the instance, in the form
+	// aws:///<availability-zone>/<instance-id>.
+	// +optional
+	ProviderID *string `json:"providerID,omitempty"`
+
+	// Addresses contains the AWS instance associated addresses.
+	Addresses machinev1.MachineAddresses `json:"addresses,omitempty"`
+	// PrimaryAddress is the address of the type selected by
+	// spec.primaryAddressType.
+	// +optional
+	PrimaryAddress string `json:"primaryAddress,omitempty"`
+	InstanceState  string `json:"instanceState,omitempty"`
+	// InstanceStateReason is why the instance was last stopped or
+	// terminated, as reported by EC2, e.g. a Spot interruption or a
+	// shutdown initiated from the instance.
+	// +optional
+	InstanceStateReason string `json:"instanceStateReason,omitempty"`
+
+	// Region is the resolved region of the instance.
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// InstanceID is the ID of the EC2 instance.
+	// +optional
+	InstanceID string `json:"instanceID,omitempty"`
+
+	// InstanceName is the name of the instance rendered from
+	// spec.naming, kept for the instances the machine launches later.
+	// +optional
+	InstanceName string `json:"instanceName,omitempty"`
+
+	// AvailabilityZone is the availability zone of the instance.
+	// +optional
+	AvailabilityZone string `json:"availabilityZone,omitempty"`
+
+	// Architecture is the processor architecture of the instance (e.g.
+	// x86_64 or arm64), suitable for use by node labelers.
+	// +optional
+	Architecture string `json:"architecture,omitempty"`
+
+	// EstimatedHourlyCost is the estimated on-demand cost per hour in USD of
+	// the instance.
+	// +optional
+	EstimatedHourlyCost string `json:"estimatedHourlyCost,omitempty"`
+
+	// AccumulatedCost is the estimated on-demand cost in USD of the instance
+	// since it was launched, accrued at the hourly cost in effect at each
+	// reconcile.
+	// +optional
+	AccumulatedCost string `json:"accumulatedCost,omitempty"`
+
+	// CostLastUpdated is when the accumulated cost was last accrued.
+	// +optional
+	CostLastUpdated *metav1.Time `json:"costLastUpdated,omitempty"`
+
+	// DNSName is the name of the A record created for the machine.
+	// +optional
+	DNSName string `json:"dnsName,omitempty"`
+
+	// Registrations are the DNS records and target groups the machine was
+	// added to, which it is removed from when deleted.
+	// +optional
+	Registrations []Registration `json:"registrations,omitempty"`
+
+	// Conditions describe the observed state of the machine.
+	// +optional
+	Conditions []Condition `json:"conditions,omitempty"`
+
+	// Recommendations are non-binding suggestions for a better fitting
+	// instance type, based on the CloudWatch utilization of the instance.
+	// +optional
+	Recommendations []Recommendation `json:"recommendations,omitempty"`
+
+	// RecommendationsLastUpdated is when the recommendations were last
+	// evaluated.
+	// +optional
+	RecommendationsLastUpdated *metav1.Time `json:"recommendationsLastUpdated,omitempty"`
+
+	// InstanceConnect describes how to connect to the instance through an
+	// EC2 Instance Connect Endpoint in its VPC, if one exists.
+	// +optional
+	InstanceConnect *InstanceConnectStatus `json:"instanceConnect,omitempty"`
+
+	// Network describes the network the instance was launched into.
+	// +optional
+	Network *NetworkStatus `json:"network,omitempty"`
+
+	// ElasticIP is the Elastic IP claimed for the instance.
+	// +optional
+	ElasticIP *ElasticIPStatus `json:"elasticIP,omitempty"`
+
+	// Console refers to the console output and screenshot of the instance
+	// last collected on request.
+	// +optional
+	Console *ConsoleStatus `json:"console,omitempty"`
+
+	// LastReboot is the last reboot of the instance requested with the
+	// restart.infrastructure.crit.sh/requested-at annotation.
+	// +optional
+	LastReboot *RebootStatus `json:"lastReboot,omitempty"`
+
+	// LastSync is the last status sync requested with the
+	// sync.infrastructure.crit.sh/requested-at annotation.
+	// +optional
+	LastSync *SyncStatus `json:"lastSync,omitempty"`
+
+	// ScheduledEvents are the upcoming scheduled events of the instance,
+	// such as maintenance, reboots and retirement, earliest first. Only
+	// polled when the controller is started with --event-poll-interval.
+	// +optional
+	ScheduledEvents []ScheduledEvent `json:"scheduledEvents,omitempty"`
+
+	// ScaleInProtected is true when the instance was protected from scale
+	// in of its Auto Scaling group.
+	// +optional
+	ScaleInProtected bool `json:"scaleInProtected,omitempty"`
+
+	// AutoScalingGroupName is the Auto Scaling group the instance is a
+	// member of.
+	// +optional
+	AutoScalingGroupName string `json:"autoScalingGroupName,omitempty"`
+
+	// HostID is the dedicated host of the instance, including a host
+	// allocated for the machine.
+	// +optional
+	HostID string `json:"hostID,omitempty"`
+
+	// LaunchFailures is the number of consecutive failed attempts to launch
+	// the instance. It is reset once an instance is launched.
+	// +optional
+	LaunchFailures int32 `json:"launchFailures,omitempty"`
+
+	// LastLaunchFailure is when the instance last failed to launch.
+	// +optional
+	LastLaunchFailure *metav1.Time `json:"lastLaunchFailure,omitempty"`
+
+	// LaunchToken is the client token of the launch of the instance. A
+	// launch whose response was lost is retried with the same token, so
+	// that the instance it launched is found instead of launching another.
+	// It is reset when the instance is replaced.
+	// +optional
+	LaunchToken string `json:"launchToken,omitempty"`
+
+	// FailureReason will be set in the event that there is a terminal problem
+	// reconciling the Machine and will contain a succinct value suitable
+	// for machine interpretation.
+	// +optional
+	FailureReason *mapierrors.MachineStatusError `json:"failureReason,omitempty"`
+
+	// FailureMessage will be set in the event that there is a terminal problem
+	// reconciling the Machine and will contain a more verbose string suitable
+	// for logging and human consumption.
+	// +optional
+	FailureMessage *string `json:"failureMessage,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=awsmachines,scope=Namespaced,categories=machine-api,shortName=awsm
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="State",type="string",JSONPath=".status.instanceState",description="EC2 instance state"
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.ready",description="Machine ready status"
+// +kubebuilder:printcolumn:name="InstanceID",type="string",JSONPath=".status.instanceID",description="EC2 instance ID"
+// +kubebuilder:printcolumn:name="Machine",type="string",JSONPath=".metadata.ownerReferences[?(@.kind==\"Machine\")].name",description="Machine object which owns with this AWSMachine"
+// +kubebuilder:printcolumn:name="Region",type="string",JSONPath=".status.region",description="AWS region"
+// +kubebuilder:printcolumn:name="Zone",type="string",JSONPath=".status.availabilityZone",description="EC2 availability zone",priority=1
+// +kubebuilder:printcolumn:name="Type",type="string",JSONPath=".spec.instanceType",description="EC2 instance type"
+// +kubebuilder:printcolumn:name="InternalIP",type="string",JSONPath=".status.addresses[?(@.type==\"InternalIP\")].address",description="Internal IP address",priority=1
+// +kubebuilder:printcolumn:name="ASG",type="string",JSONPath=".status.autoScalingGroupName",description="Auto Scaling group",priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// AWSMachine is the Schema for the awsmachines API
+type AWSMachine struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AWSMachineSpec   `json:"spec,omitempty"`
+	Status AWSMachineStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// AWSMachineList contains a list of AWSMachine
+type AWSMachineList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []AWSMachine `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&AWSMachine{}, &AWSMachineList{})
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command mapaws lists AWSMachines alongside the live state of their EC2
+// instances, for diagnosing mismatches between the cluster and EC2. Instances
+// are described with the same credentials the controller uses.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	machinev1 "github.com/criticalstack/machine-api/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	"github.com/criticalstack/machine-api-provider-aws/controllers"
+)
+
+func main() {
+	var namespace string
+	var timeout time.Duration
+	flag.StringVar(&namespace, "namespace", "", "Namespace of the AWSMachines to list. Lists all namespaces when empty.")
+	flag.DurationVar(&timeout, "timeout", time.Minute, "Timeout for listing and describing all machines.")
+	flag.Parse()
+
+	if err := run(namespace, timeout); err != nil {
+		fmt.Fprintf(os.Stderr, "mapaws: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(namespace string, timeout time.Duration) error {
+	scheme := runtime.NewScheme()
+	for _, add := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, infrav1.AddToScheme, machinev1.AddToScheme} {
+		if err := add(scheme); err != nil {
+			return err
+		}
+	}
+	cfg, err := ctrl.GetConfig()
+	if err != nil {
+		return err
+	}
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	descs, err := controllers.DescribeMachines(ctx, c, namespace)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tREADY\tSTATUS\tINSTANCE\tEC2 STATE\tTYPE\tZONE\tLAUNCHED\tASG\tERROR")
+	for _, d := range descs {
+		ec2State, launched, errMsg := "-", "-", ""
+		switch {
+		case d.Found:
+			ec2State = d.State
+			launched = d.LaunchTime.UTC().Format(time.RFC3339)
+		case d.InstanceID != "" && d.Err == nil:
+			ec2State = "not found"
+		}
+		if d.Err != nil {
+			errMsg = d.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			d.Namespace, d.Name, d.Ready, orDash(d.InstanceState), orDash(d.InstanceID), ec2State,
+			orDash(d.InstanceType), orDash(d.AvailabilityZone), launched, orDash(d.AutoScalingGroup), errMsg)
+	}
+	return w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// resolveAMIFamily sets the AMI of a machine that does not set one to the
+// image of the AMI family of the provider that matches the machine in its
+// region, falling back to the AMI of the region defaults. Region defaults
+// leave the AMI unset when the provider has AMI families, see
+// resolveRegion.
+func (r *AWSMachineReconciler) resolveAMIFamily(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine) error {
+	if am.Spec.AMI != "" {
+		return nil
+	}
+	p, err := getProvider(ctx, r.Client, am.Namespace)
+	if err != nil {
+		return err
+	}
+	if p == nil || len(p.Spec.AMIFamilies) == 0 {
+		return nil
+	}
+	var archs []string
+	if am.Spec.InstanceType != "" {
+		it, err := awsutil.DescribeInstanceType(ctx, awscfg, am.Spec.InstanceType)
+		if err != nil {
+			return err
+		}
+		if it.ProcessorInfo != nil {
+			archs = aws.StringValueSlice(it.ProcessorInfo.SupportedArchitectures)
+		}
+	}
+	region := aws.StringValue(awscfg.Region)
+	if ami := amiFamilyImage(p.Spec.AMIFamilies, am, archs, region); ami != "" {
+		am.Spec.AMI = ami
+		return nil
+	}
+	if d := regionDefaults(p, region); d != nil && d.AMI != "" {
+		am.Spec.AMI = d.AMI
+		return nil
+	}
+	return awsutil.NewConfigurationError("no AMI family of provider %q has an image in region %q for %s machines of architecture %s",
+		p.Name, region, osFamilyOrDefault(am.Spec.OSFamily), strings.Join(archs, " or "))
+}
+
+// amiFamilyImage returns the image in the region of the AMI family that
+// matches the OS family and Kubernetes version of the machine and one of
+// the architectures, preferring families with the Kubernetes version of the
+// machine over families without a version.
+func amiFamilyImage(families []infrav1.AMIFamily, am *infrav1.AWSMachine, archs []string, region string) string {
+	version := strings.TrimPrefix(am.Labels[infrav1.KubernetesVersionLabel], "v")
+	var fallback string
+	for _, f := range families {
+		ami, ok := f.AMIs[region]
+		if !ok || osFamilyOrDefault(f.OSFamily) != osFamilyOrDefault(am.Spec.OSFamily) || !containsString(archs, f.Architecture) {
+			continue
+		}
+		switch v := strings.TrimPrefix(f.KubernetesVersion, "v"); {
+		case v == "" && fallback == "":
+			fallback = ami
+		case v != "" && v == version:
+			return ami
+		}
+	}
+	return fallback
+}
+
+func osFamilyOrDefault(f infrav1.OSFamily) infrav1.OSFamily {
+	if f == "" {
+		return infrav1.OSFamilyLinux
+	}
+	return f
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// launchRecord holds the parameters an instance was launched with as
+// resolved by the launch, rather than as requested by the spec.
+type launchRecord struct {
+	InstanceID         string    `json:"instanceID"`
+	AMI                string    `json:"ami"`
+	InstanceType       string    `json:"instanceType"`
+	AvailabilityZone   string    `json:"availabilityZone,omitempty"`
+	SubnetID           string    `json:"subnetID,omitempty"`
+	SecurityGroupIDs   []string  `json:"securityGroupIDs,omitempty"`
+	IAMInstanceProfile string    `json:"iamInstanceProfile,omitempty"`
+	KeyName            string    `json:"keyName,omitempty"`
+	HostID             string    `json:"hostID,omitempty"`
+	WarmPool           string    `json:"warmPool,omitempty"`
+	UserDataSHA256     string    `json:"userDataSHA256"`
+	LaunchTime         time.Time `json:"launchTime"`
+}
+
+// recordLaunch records the launch parameters of the instance. The user data
+// may contain secrets, so only the hash of the encoded user data sent to
+// EC2 is recorded.
+func recordLaunch(am *infrav1.AWSMachine, instance *ec2.Instance, userData string) {
+	sum := sha256.Sum256([]byte(userData))
+	rec := launchRecord{
+		InstanceID:     aws.StringValue(instance.InstanceId),
+		AMI:            aws.StringValue(instance.ImageId),
+		InstanceType:   aws.StringValue(instance.InstanceType),
+		SubnetID:       aws.StringValue(instance.SubnetId),
+		KeyName:        aws.StringValue(instance.KeyName),
+		WarmPool:       am.Spec.WarmPool,
+		UserDataSHA256: hex.EncodeToString(sum[:]),
+		LaunchTime:     aws.TimeValue(instance.LaunchTime),
+	}
+	if instance.Placement != nil {
+		rec.AvailabilityZone = aws.StringValue(instance.Placement.AvailabilityZone)
+		rec.HostID = aws.StringValue(instance.Placement.HostId)
+	}
+	for _, sg := range instance.SecurityGroups {
+		rec.SecurityGroupIDs = append(rec.SecurityGroupIDs, aws.StringValue(sg.GroupId))
+	}
+	sort.Strings(rec.SecurityGroupIDs)
+	if instance.IamInstanceProfile != nil {
+		rec.IAMInstanceProfile = aws.StringValue(instance.IamInstanceProfile.Arn)
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	if am.Annotations == nil {
+		am.Annotations = make(map[string]string)
+	}
+	am.Annotations[infrav1.LaunchRecordAnnotation] = string(b)
+}
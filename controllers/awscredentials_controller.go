@@ -0,0 +1,159 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// credentialsValidationInterval is how often AWSCredentials are validated.
+const credentialsValidationInterval = 10 * time.Minute
+
+// AWSCredentialsReconciler validates AWSCredentials with STS and records the
+// identity they resolve to.
+type AWSCredentialsReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+
+	// WatchFilter restricts the controller to objects with matching labels.
+	WatchFilter labels.Selector
+
+	// ReconcileTimeout bounds each reconcile, so that a hung AWS request
+	// cannot stall a worker. Unbounded when 0.
+	ReconcileTimeout time.Duration
+}
+
+func (r *AWSCredentialsReconciler) SetupWithManager(mgr ctrl.Manager, options controller.Options) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&infrav1.AWSCredentials{}, builder.WithPredicates(watchFilterPredicate(r.WatchFilter))).
+		Watches(
+			&source.Kind{Type: &corev1.Secret{}},
+			&handler.EnqueueRequestsFromMapFunc{
+				ToRequests: handler.ToRequestsFunc(r.secretToCredentials),
+			},
+		).
+		WithOptions(options).
+		Complete(r)
+}
+
+// +kubebuilder:rbac:groups=infrastructure.crit.sh,resources=awscredentials,verbs=get;list;watch
+// +kubebuilder:rbac:groups=infrastructure.crit.sh,resources=awscredentials/status,verbs=get;update;patch
+
+func (r *AWSCredentialsReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := awsutil.WithNamespace(context.Background(), req.Namespace)
+	ctx = awsutil.WithObject(ctx, "awscredentials", req.Namespace, req.Name)
+	ctx, cancel := withReconcileTimeout(ctx, r.ReconcileTimeout)
+	defer cancel()
+	log := r.Log.WithValues("awscredentials", req.NamespacedName)
+
+	ac := &infrav1.AWSCredentials{}
+	if err := r.Get(ctx, req.NamespacedName, ac); err != nil {
+		if apierrors.IsNotFound(err) {
+			credentialsCache.invalidate(req.Namespace, req.Name)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	region := ""
+	if p, err := getProvider(ctx, r.Client, ac.Namespace); err != nil {
+		return ctrl.Result{}, err
+	} else if p != nil {
+		region = p.Spec.Region
+	}
+	region, err := awsutil.ResolveRegion(region)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	account, arn, err := r.validate(ctx, ac, region)
+	now := metav1.Now()
+	ac.Status.LastValidated = &now
+	ac.Status.Ready = err == nil
+	if err != nil {
+		log.Info("credentials are invalid", "reason", err.Error())
+		reason := "ValidationFailed"
+		if aerr, ok := errors.Cause(err).(awserr.Error); ok {
+			reason = aerr.Code()
+		}
+		ac.Status.Conditions.Set(infrav1.Condition{
+			Type:    infrav1.CredentialsValidCondition,
+			Status:  corev1.ConditionFalse,
+			Reason:  reason,
+			Message: err.Error(),
+		})
+	} else {
+		ac.Status.Account = account
+		ac.Status.ARN = arn
+		ac.Status.Conditions.Set(infrav1.Condition{
+			Type:   infrav1.CredentialsValidCondition,
+			Status: corev1.ConditionTrue,
+			Reason: "CredentialsAccepted",
+		})
+	}
+	wctx, wcancel := statusWriteContext()
+	defer wcancel()
+	if err := r.Status().Update(wctx, ac); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: credentialsValidationInterval}, nil
+}
+
+func (r *AWSCredentialsReconciler) validate(ctx context.Context, ac *infrav1.AWSCredentials, region string) (string, string, error) {
+	creds, err := resolveCredentials(ctx, r.Client, ac.Namespace, ac.Name, region)
+	if err != nil {
+		return "", "", err
+	}
+	return awsutil.GetCallerIdentity(ctx, &aws.Config{Region: aws.String(region), Credentials: creds})
+}
+
+// secretToCredentials maps a Secret to the AWSCredentials using it, so that
+// rotated keys are validated right away.
+func (r *AWSCredentialsReconciler) secretToCredentials(o handler.MapObject) []ctrl.Request {
+	list := &infrav1.AWSCredentialsList{}
+	if err := r.List(context.Background(), list, client.InNamespace(o.Meta.GetNamespace())); err != nil {
+		return nil
+	}
+	reqs := make([]ctrl.Request, 0)
+	for _, ac := range list.Items {
+		if ac.Spec.SecretRef != nil && ac.Spec.SecretRef.Name == o.Meta.GetName() {
+			reqs = append(reqs, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: ac.Namespace, Name: ac.Name}})
+		}
+	}
+	return reqs
+}
@@ -19,7 +19,9 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/criticalstack/machine-api/util"
 	"github.com/go-logr/logr"
 	"github.com/go-openapi/spec"
@@ -27,14 +29,18 @@ import (
 	v1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	"github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
 )
 
 // AWSInfrastructureProviderReconciler reconciles a AWSInfrastructureProvider object
@@ -43,25 +49,37 @@ type AWSInfrastructureProviderReconciler struct {
 	Log    logr.Logger
 	Scheme *runtime.Scheme
 
+	// WatchFilter restricts the controller to objects with matching labels.
+	WatchFilter labels.Selector
+
+	// ReconcileTimeout bounds each reconcile, so that a hung AWS request
+	// cannot stall a worker. Unbounded when 0.
+	ReconcileTimeout time.Duration
+
+	Recorder record.EventRecorder
+
 	config *rest.Config
 }
 
 func (r *AWSInfrastructureProviderReconciler) SetupWithManager(mgr ctrl.Manager, options controller.Options) error {
 	r.config = mgr.GetConfig()
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&v1alpha1.AWSInfrastructureProvider{}).
+		For(&v1alpha1.AWSInfrastructureProvider{}, builder.WithPredicates(watchFilterPredicate(r.WatchFilter))).
 		Owns(&v1.Secret{}).
 		WithOptions(options).
 		Complete(r)
 }
 
-// +kubebuilder:rbac:groups=infrastructure.crit.sh,resources=awsinfrastructureproviders,verbs=get;list;watch
+// +kubebuilder:rbac:groups=infrastructure.crit.sh,resources=awsinfrastructureproviders,verbs=get;list;watch;update;patch
 // +kubebuilder:rbac:groups=infrastructure.crit.sh,resources=awsinfrastructureproviders/status,verbs=create;update
 // +kubebuilder:rbac:groups=machine.crit.sh,resources=infrastructureproviders;infrastructureproviders/status,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=secrets,verbs=*
 
 func (r *AWSInfrastructureProviderReconciler) Reconcile(req ctrl.Request) (_ ctrl.Result, reterr error) {
-	ctx := context.Background()
+	ctx := awsutil.WithNamespace(context.Background(), req.Namespace)
+	ctx = awsutil.WithObject(ctx, "awsinfrastructureprovider", req.Namespace, req.Name)
+	ctx, cancel := withReconcileTimeout(ctx, r.ReconcileTimeout)
+	defer cancel()
 	log := r.Log.WithValues("awsinfrastructureprovider", req.NamespacedName)
 
 	ip := &v1alpha1.AWSInfrastructureProvider{}
@@ -72,6 +90,17 @@ func (r *AWSInfrastructureProviderReconciler) Reconcile(req ctrl.Request) (_ ctr
 		return ctrl.Result{}, err
 	}
 
+	if !ip.DeletionTimestamp.IsZero() {
+		if err := r.reconcileDelete(ctx, ip); err != nil {
+			log.Error(err, "cannot delete key pairs", awsutil.LogValues(err)...)
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+	if err := r.addKeyPairFinalizer(ctx, ip); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	ipOwner, err := util.GetOwnerInfrastructureProvider(ctx, r.Client, ip.ObjectMeta)
 	if err != nil {
 		return ctrl.Result{}, err
@@ -95,13 +124,80 @@ func (r *AWSInfrastructureProviderReconciler) Reconcile(req ctrl.Request) (_ ctr
 
 	ip.Status.Ready = !s.GetCreationTimestamp().Time.IsZero() // ready if secret already exists
 	ip.Status.LastUpdated = metav1.Now()
+	restoreCapacityFailures(ip.Status.CapacityFailures)
+	r.reconcileProvisioning(ip)
+	if stats := awsutil.Throttling.Stats(ip.Namespace); stats.Count > 0 {
+		ip.Status.Throttling = &v1alpha1.ThrottlingStatus{
+			Count:         stats.Count,
+			LastThrottled: metav1.NewTime(stats.LastThrottled),
+		}
+	}
+	var instanceTypes []awsutil.InstanceTypeSpec
+	region, err := awsutil.ResolveRegion(ip.Spec.Region)
+	if err != nil {
+		log.Error(err, "cannot resolve provider region")
+	} else {
+		ip.Status.Region = region
+		awscfg := &aws.Config{Region: aws.String(region)}
+		if account, err := awsutil.CapacityAccount(ctx, awscfg); err != nil {
+			log.Error(err, "cannot look up provider account", awsutil.LogValues(err)...)
+		} else {
+			ip.Status.CapacityFailures = capacityFailures(account, providerRegions(ip, region))
+		}
+		regions, err := awsutil.EnabledRegions(ctx, awscfg)
+		setCredentialsCondition(&ip.Status.Conditions, err)
+		if err != nil {
+			log.Error(err, "cannot list enabled regions", awsutil.LogValues(err)...)
+		} else {
+			ip.Status.EnabledRegions = regions
+		}
+		if err := r.reconcileWarmPools(ctx, awscfg, ip); err != nil {
+			log.Error(err, "cannot reconcile warm pools", awsutil.LogValues(err)...)
+		}
+		if err := r.reconcilePermissions(ctx, awscfg, ip); err != nil {
+			log.Error(err, "cannot check permissions", awsutil.LogValues(err)...)
+		}
+		if err := r.reconcileImageReplications(ctx, ip); err != nil {
+			log.Error(err, "cannot replicate images", awsutil.LogValues(err)...)
+		}
+		if err := r.reconcileSubnets(ctx, awscfg, ip); err != nil {
+			log.Error(err, "cannot describe subnets", awsutil.LogValues(err)...)
+		}
+		if err := r.reconcileKeyPairs(ctx, ip); err != nil {
+			log.Error(err, "cannot reconcile key pairs", awsutil.LogValues(err)...)
+		}
+		hosts, err := dedicatedHosts(ctx, awscfg)
+		if err != nil {
+			log.Error(err, "cannot describe dedicated hosts", awsutil.LogValues(err)...)
+		} else {
+			ip.Status.DedicatedHosts = hosts
+		}
+		instanceTypes, err = awsutil.DescribeInstanceTypeSpecs(ctx, awscfg)
+		if err != nil {
+			log.Error(err, "cannot describe instance types", awsutil.LogValues(err)...)
+		}
+	}
+	r.reconcileCredentialOutage(ip)
 	defer func() {
+		ctx, cancel := statusWriteContext()
+		defer cancel()
 		if err := r.Status().Update(ctx, ip); err != nil {
 			log.Error(err, "failed to update provider status")
 		}
 	}()
 
-	schema, err := r.schema(ctx, ip)
+	if filter, ok := ip.GetAnnotations()[v1alpha1.ImportAnnotation]; ok {
+		if err := r.importInstances(ctx, ip, filter); err != nil {
+			return ctrl.Result{}, err
+		}
+		patch := client.MergeFrom(ip.DeepCopy())
+		delete(ip.Annotations, v1alpha1.ImportAnnotation)
+		if err := r.Patch(ctx, ip, patch); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	schema, err := r.schema(ctx, ip, instanceTypes)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
@@ -118,12 +214,70 @@ func (r *AWSInfrastructureProviderReconciler) Reconcile(req ctrl.Request) (_ ctr
 	}
 
 	ip.Status.Ready = true
-	return ctrl.Result{}, nil
+	return ctrl.Result{RequeueAfter: time.Minute}, nil
+}
+
+// capacityFailures returns the capacity failures observed by this controller
+// in the account of the provider and in its regions that are still within
+// the cooldown period. Failures of machines using other credentials or in
+// other regions are kept out of the status, since the zones of other
+// accounts and providers are not the provider's to report.
+func capacityFailures(account string, regions map[string]bool) []v1alpha1.CapacityFailure {
+	failures := make([]v1alpha1.CapacityFailure, 0)
+	for _, f := range awsutil.Capacity.Failures(account) {
+		if time.Since(f.LastFailure) > awsutil.Capacity.Cooldown {
+			continue
+		}
+		if region, ok := awsutil.ZoneRegion(f.AvailabilityZone); !ok || !regions[region] {
+			continue
+		}
+		failures = append(failures, v1alpha1.CapacityFailure{
+			Account:            f.Account,
+			InstanceType:       f.InstanceType,
+			AvailabilityZone:   f.AvailabilityZone,
+			AvailabilityZoneID: f.AvailabilityZoneID,
+			Count:              f.Count,
+			LastFailure:        metav1.NewTime(f.LastFailure),
+		})
+	}
+	return failures
+}
+
+// providerRegions returns the regions AWSMachines of the provider may be
+// placed in: its resolved region and those of spec.regions.
+func providerRegions(ip *v1alpha1.AWSInfrastructureProvider, region string) map[string]bool {
+	regions := map[string]bool{region: true}
+	for _, r := range ip.Spec.Regions {
+		regions[r.Name] = true
+	}
+	return regions
+}
+
+// restoreCapacityFailures seeds the capacity tracker with the failures in
+// the provider status, which survive restarts of the controller.
+func restoreCapacityFailures(failures []v1alpha1.CapacityFailure) {
+	restored := make([]awsutil.CapacityFailure, 0, len(failures))
+	for _, f := range failures {
+		restored = append(restored, awsutil.CapacityFailure{
+			Account:            f.Account,
+			InstanceType:       f.InstanceType,
+			AvailabilityZone:   f.AvailabilityZone,
+			AvailabilityZoneID: f.AvailabilityZoneID,
+			Count:              f.Count,
+			LastFailure:        f.LastFailure.Time,
+		})
+	}
+	awsutil.Capacity.Restore(restored)
 }
 
 const OpenAPISchemaSecretName = "config-schema"
 
-func (r *AWSInfrastructureProviderReconciler) schema(ctx context.Context, ip *v1alpha1.AWSInfrastructureProvider) (*spec.Schema, error) {
+// instanceTypesExtension is the schema extension of the instanceType property
+// describing the capacity of each instance type, for UIs to show next to the
+// choice of instance type.
+const instanceTypesExtension = "x-instance-types"
+
+func (r *AWSInfrastructureProviderReconciler) schema(ctx context.Context, ip *v1alpha1.AWSInfrastructureProvider, instanceTypes []awsutil.InstanceTypeSpec) (*spec.Schema, error) {
 	required := []spec.SchemaProps{
 		{
 			ID:    "instanceType",
@@ -159,6 +313,17 @@ func (r *AWSInfrastructureProviderReconciler) schema(ctx context.Context, ip *v1
 		requiredIDs = append(requiredIDs, p.ID)
 		props[p.ID] = spec.Schema{SchemaProps: p}
 	}
+	if len(instanceTypes) != 0 {
+		p := props["instanceType"]
+		p.Enum = make([]interface{}, 0, len(instanceTypes))
+		specs := make(map[string]awsutil.InstanceTypeSpec, len(instanceTypes))
+		for _, t := range instanceTypes {
+			p.Enum = append(p.Enum, t.Name)
+			specs[t.Name] = t
+		}
+		p.AddExtension(instanceTypesExtension, specs)
+		props["instanceType"] = p
+	}
 	return &spec.Schema{
 		SchemaProps: spec.SchemaProps{
 			Type:  spec.StringOrArray{"object"},
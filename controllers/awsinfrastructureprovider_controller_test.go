@@ -0,0 +1,57 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+func TestCapacityFailures(t *testing.T) {
+	defer func(c *awsutil.CapacityTracker) { awsutil.Capacity = c }(awsutil.Capacity)
+	awsutil.Capacity = awsutil.NewCapacityTracker(time.Minute)
+	record := func(account, id, zone string) {
+		awsutil.Capacity.RecordFailure("m5.large", awsutil.CapacityZone{Account: account, ID: id, Name: zone})
+	}
+	record("111111111111", "use1-az1", "us-east-1a")
+	record("111111111111", "usw2-az1", "us-west-2a")
+	record("111111111111", "usw2-lax1-az1", "us-west-2-lax-1a")
+	record("111111111111", "euw1-az1", "eu-west-1a")
+	record("222222222222", "use1-az4", "us-east-1a")
+
+	ip := &infrav1.AWSInfrastructureProvider{
+		ObjectMeta: metav1.ObjectMeta{Name: "provider", Namespace: testNamespace},
+		Spec:       infrav1.AWSInfrastructureProviderSpec{Regions: []infrav1.RegionDefaults{{Name: "us-west-2"}}},
+	}
+	zones := make(map[string]bool)
+	for _, f := range capacityFailures("111111111111", providerRegions(ip, "us-east-1")) {
+		if f.Account != "111111111111" {
+			t.Errorf("failure of account %s published", f.Account)
+		}
+		zones[f.AvailabilityZone] = true
+	}
+	for zone, expected := range map[string]bool{"us-east-1a": true, "us-west-2a": true, "us-west-2-lax-1a": true, "eu-west-1a": false} {
+		if zones[zone] != expected {
+			t.Errorf("zone %s: expected published %v, got %v", zone, expected, zones[zone])
+		}
+	}
+}
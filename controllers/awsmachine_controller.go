@@ -18,35 +18,42 @@ package controllers
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
+	"net"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	machinev1 "github.com/criticalstack/machine-api/api/v1alpha1"
 	mapierrors "github.com/criticalstack/machine-api/errors"
 	"github.com/criticalstack/machine-api/util"
-	"github.com/criticalstack/machine-api/util/patch"
 	"github.com/go-logr/logr"
-	"github.com/labstack/gommon/log"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/pointer"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
 	"github.com/criticalstack/machine-api-provider-aws/internal"
 	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+	"github.com/criticalstack/machine-api-provider-aws/internal/maintenance"
 )
 
 // AWSMachineReconciler reconciles a AWSMachine object
@@ -55,21 +62,144 @@ type AWSMachineReconciler struct {
 	Log    logr.Logger
 	Scheme *runtime.Scheme
 
-	config *rest.Config
+	// WatchFilter restricts the controller to objects with matching labels.
+	WatchFilter labels.Selector
+
+	// ReconcileTimeout bounds each reconcile, so that a hung AWS request
+	// cannot stall a worker. Unbounded when 0.
+	ReconcileTimeout time.Duration
+
+	// MaxConcurrentRefreshes limits how many workers may refresh the status
+	// of ready machines at once, so that large fleets of healthy machines do
+	// not delay creating and deleting machines. Unlimited when 0.
+	MaxConcurrentRefreshes int
+
+	// MaxConcurrentPerNamespace limits how many workers may reconcile the
+	// machines of a single namespace at once, so that a scale-up in one
+	// namespace does not delay the machines of the others. Machines being
+	// deleted are not limited. Unlimited when 0.
+	MaxConcurrentPerNamespace int
+
+	// RecommendationInterval is how often the utilization of ready
+	// machines is evaluated for right-sizing recommendations. Disabled when
+	// 0.
+	RecommendationInterval time.Duration
+
+	// EventPollInterval is how often ready machines are checked for
+	// scheduled events and spot interruptions. Disabled when 0.
+	EventPollInterval time.Duration
+
+	// StatusSyncPeriod is how often the instance status of ready machines
+	// is refreshed, jittered so that machines created together do not
+	// refresh together. Disabled when 0.
+	StatusSyncPeriod time.Duration
+
+	// EventDrainLeadTime is how long before a scheduled event the node of
+	// the machine is drained. Nodes of interrupted spot instances are
+	// drained right away.
+	EventDrainLeadTime time.Duration
+
+	// ConfigRequeueInterval, DeleteRequeueInterval and DeleteTimeout are
+	// the defaults for the provider timeouts, see infrav1.Timeouts.
+	ConfigRequeueInterval time.Duration
+	DeleteRequeueInterval time.Duration
+	DeleteTimeout         time.Duration
+
+	// Decommission, when set, is notified before the instance of a deleted
+	// machine is terminated.
+	Decommission *DecommissionWebhook
+
+	// LaunchBackoffBase and LaunchBackoffMax bound the exponential wait
+	// between attempts to launch a machine whose launches failed.
+	LaunchBackoffBase time.Duration
+	LaunchBackoffMax  time.Duration
+
+	// MaxLaunchAttempts is how many times launching a machine may fail
+	// before the machine fails permanently. Unlimited when 0.
+	MaxLaunchAttempts int
+
+	// InstanceStateChanges, when set, receives events for machines whose
+	// instances changed state, see InstanceStateListener.
+	InstanceStateChanges <-chan event.GenericEvent
+
+	// ClusterAPIContract enables the upstream Cluster API infrastructure
+	// machine contract: AWSMachines owned by Cluster API Machines are
+	// launched with the bootstrap data of their Machine, see ownerMachine.
+	ClusterAPIContract bool
+
+	// DeleteNodes deletes the node of a deleted machine once its instance
+	// has terminated, instead of leaving it to the kubelet or the node
+	// lifecycle controller.
+	DeleteNodes bool
+
+	// Recorder records events for the resources deleted with a machine.
+	Recorder record.EventRecorder
+
+	// Decisions, when set, publishes the provisioning decisions of the
+	// controller outside of the cluster.
+	Decisions *DecisionPublisher
+
+	config    *rest.Config
+	refreshes refreshLimiter
+	tenants   *namespaceLimiter
+	route53   *awsutil.Route53Client
+
+	// separateStatusSync is set when ready machines are refreshed by an
+	// AWSMachineStatusReconciler instead.
+	separateStatusSync bool
 }
 
 func (r *AWSMachineReconciler) SetupWithManager(mgr ctrl.Manager, options controller.Options) error {
 	r.config = mgr.GetConfig()
-	return ctrl.NewControllerManagedBy(mgr).
+	r.refreshes = newRefreshLimiter(r.MaxConcurrentRefreshes)
+	r.tenants = newNamespaceLimiter(r.MaxConcurrentPerNamespace)
+	r.route53 = awsutil.NewRoute53Client(&aws.Config{})
+	b := ctrl.NewControllerManagedBy(mgr).
 		WithOptions(options).
-		For(&infrav1.AWSMachine{}).
+		For(&infrav1.AWSMachine{}, builder.WithPredicates(watchFilterPredicate(r.WatchFilter))).
 		Watches(
 			&source.Kind{Type: &machinev1.Machine{}},
 			&handler.EnqueueRequestsFromMapFunc{
 				ToRequests: util.MachineToInfrastructureMapFunc(infrav1.GroupVersion.WithKind("AWSMachine")),
 			},
 		).
-		Complete(r)
+		Watches(
+			&source.Kind{Type: &corev1.Secret{}},
+			&handler.EnqueueRequestsFromMapFunc{
+				ToRequests: handler.ToRequestsFunc(r.secretToAWSMachines),
+			},
+		).
+		Watches(
+			&source.Kind{Type: &corev1.Secret{}},
+			&handler.EnqueueRequestsFromMapFunc{
+				ToRequests: handler.ToRequestsFunc(r.bootstrapSecretToAWSMachines),
+			},
+		).
+		Watches(
+			&source.Kind{Type: &machinev1.Config{}},
+			&handler.EnqueueRequestsFromMapFunc{
+				ToRequests: handler.ToRequestsFunc(r.configToAWSMachines),
+			},
+		).
+		Watches(
+			&source.Kind{Type: &infrav1.AWSCredentials{}},
+			&handler.EnqueueRequestsFromMapFunc{
+				ToRequests: handler.ToRequestsFunc(r.credentialsToAWSMachines),
+			},
+		).
+		Watches(
+			&source.Kind{Type: &infrav1.AWSMachine{}},
+			&handler.EnqueueRequestsFromMapFunc{
+				ToRequests: handler.ToRequestsFunc(r.launchGroupToAWSMachines),
+			},
+		)
+	if r.InstanceStateChanges != nil {
+		b = b.Watches(
+			&source.Channel{Source: r.InstanceStateChanges},
+			&handler.EnqueueRequestForObject{},
+		)
+	}
+	return b.Complete(r)
 }
 
 // +kubebuilder:rbac:groups=infrastructure.crit.sh,resources=awsmachines,verbs=get;list;watch;create;update;patch;delete
@@ -77,11 +207,32 @@ func (r *AWSMachineReconciler) SetupWithManager(mgr ctrl.Manager, options contro
 // +kubebuilder:rbac:groups=machine.crit.sh,resources=machines;machines/status,verbs=get;list;watch
 // +kubebuilder:rbac:groups=machine.crit.sh,resources=configs;configs/status,verbs=get;list;watch
 // +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=infrastructure.crit.sh,resources=awscredentials,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
-func (r *AWSMachineReconciler) Reconcile(req ctrl.Request) (_ ctrl.Result, reterr error) {
-	ctx := context.Background()
+func (r *AWSMachineReconciler) Reconcile(req ctrl.Request) (res ctrl.Result, reterr error) {
+	if res, ok := beginInflight(); !ok {
+		return res, nil
+	}
+	defer awsutil.Inflight.End()
+	ctx := awsutil.WithNamespace(context.Background(), req.Namespace)
+	ctx = awsutil.WithObject(ctx, "awsmachine", req.Namespace, req.Name)
+	ctx, cancel := withReconcileTimeout(ctx, r.ReconcileTimeout)
+	defer cancel()
 	log := r.Log.WithValues("awsmachine", req.NamespacedName)
 
+	ctx, span := tracer.Start(ctx, "AWSMachine.Reconcile", trace.WithAttributes(
+		attribute.String("awsmachine", req.NamespacedName.String()),
+	))
+	defer func() { endSpan(span, reterr) }()
+
+	defer func() {
+		if kv := awsutil.LogValues(reterr); kv != nil {
+			log.Error(reterr, "AWS request failed", kv...)
+		}
+	}()
+
 	am := &infrav1.AWSMachine{}
 	if err := r.Get(ctx, req.NamespacedName, am); err != nil {
 		if apierrors.IsNotFound(err) {
@@ -89,12 +240,54 @@ func (r *AWSMachineReconciler) Reconcile(req ctrl.Request) (_ ctrl.Result, reter
 		}
 		return ctrl.Result{}, err
 	}
+	if !matchesWatchFilter(r.WatchFilter, am) {
+		return ctrl.Result{}, nil
+	}
+	// deletes are not deferred, so that a burst of machines created in a
+	// namespace does not hold up releasing the instances of deleted ones
+	if am.DeletionTimestamp.IsZero() {
+		if !r.tenants.tryAcquire(req.Namespace) {
+			return ctrl.Result{RequeueAfter: namespaceDeferral()}, nil
+		}
+		defer r.tenants.release(req.Namespace)
+	}
+
+	owner, err := r.providerIDOwner(ctx, am)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if owner != nil {
+		return ctrl.Result{}, r.reconcileDuplicate(ctx, am, owner)
+	}
+	if am.Status.Conditions.IsFalse(infrav1.ProviderIDUniqueCondition) {
+		am.Status.Conditions.Set(infrav1.Condition{
+			Type:   infrav1.ProviderIDUniqueCondition,
+			Status: corev1.ConditionTrue,
+			Reason: "Resolved",
+		})
+	}
+
+	if degraded, since := awsutil.CredentialOutages.Degraded(am.Namespace); degraded {
+		log.Info("AWS credentials are being rejected, pausing until they are accepted again", "since", since)
+		return ctrl.Result{RequeueAfter: credentialsBackoff}, nil
+	}
+
+	if isExternallyManaged(am) {
+		return r.reconcileExternallyManaged(ctx, am)
+	}
 
 	// Handle deleted machines
 	if !am.ObjectMeta.DeletionTimestamp.IsZero() {
-		if err := r.reconcileDelete(ctx, am); err != nil {
-			log.Error(err, "cannot delete node, may already be deleted")
+		if retainInstance(am) {
+			log.Info("retaining instance of deleted machine")
+			r.Recorder.Eventf(am, corev1.EventTypeNormal, "InstanceRetained", "Instance of deleted machine retained by deletion policy")
+		} else if res, released, err := r.reconcileDeleted(ctx, log, am); !released {
+			return res, err
 		}
+		deleteDeletionMetrics(am)
+		deleteRecommendationMetrics(am)
+		deleteCostMetrics(am)
+		deleteScheduledEventMetrics(am)
 		controllerutil.RemoveFinalizer(am, infrav1.MachineFinalizer)
 		if err := r.Update(ctx, am); err != nil {
 			return ctrl.Result{}, err
@@ -102,12 +295,19 @@ func (r *AWSMachineReconciler) Reconcile(req ctrl.Request) (_ ctrl.Result, reter
 		return ctrl.Result{}, nil
 	}
 
+	if err := r.reconcileConsole(ctx, am); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	if am.Status.FailureMessage != nil {
 		log.Info("machine has failure reason/message", "reason", am.Status.FailureReason, "message", am.Status.FailureMessage)
+		if err := r.reconcileReplacementZone(ctx, am); err != nil {
+			log.Error(err, "cannot determine replacement zone", awsutil.LogValues(err)...)
+		}
 		return ctrl.Result{}, nil
 	}
 
-	m, err := util.GetOwnerMachine(ctx, r.Client, am.ObjectMeta)
+	m, err := r.ownerMachine(ctx, am)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
@@ -119,130 +319,526 @@ func (r *AWSMachineReconciler) Reconcile(req ctrl.Request) (_ ctrl.Result, reter
 	log = log.WithValues("machine", m.Name)
 
 	// Patch any changes to Machine object on each reconciliation.
-	patchHelper, err := patch.NewHelper(am, r.Client)
-	if err != nil {
-		return ctrl.Result{}, err
-	}
+	patcher := newAWSMachinePatcher(am)
 	defer func() {
-		if err := patchHelper.Patch(ctx, am); err != nil {
-			if reterr == nil {
-				reterr = err
-			}
+		ctx, cancel := statusWriteContext()
+		defer cancel()
+		err := patcher.Patch(ctx, r.Client, am)
+		if apierrors.IsConflict(err) && reterr == nil {
+			// the status was written concurrently, reconcile the latest
+			// machine again
+			res, reterr = ctrl.Result{Requeue: true}, nil
+		} else if err != nil && reterr == nil {
+			reterr = err
+		}
+	}()
+	defer func() {
+		if setCredentialsCondition(&am.Status.Conditions, reterr) {
+			log.Error(reterr, "AWS credentials rejected, backing off", awsutil.LogValues(reterr)...)
+			res, reterr = ctrl.Result{RequeueAfter: credentialsBackoff}, nil
+		} else if errors.Is(reterr, awsutil.ErrThrottled) {
+			log.Info("AWS requests throttled, backing off", "reason", reterr.Error())
+			res, reterr = ctrl.Result{RequeueAfter: throttledDeferral()}, nil
+		}
+	}()
+
+	wasReady := am.Status.Ready
+	wasFailed := am.Status.FailureReason != nil
+	defer func() {
+		if !wasReady && am.Status.Ready {
+			observeSince(machineReadyDuration, am.CreationTimestamp.Time)
 		}
+		recordProvisioning(am, wasReady, wasFailed)
 	}()
 
 	// If the AWSMachine doesn't have a finalizer, add one.
 	controllerutil.AddFinalizer(am, infrav1.MachineFinalizer)
 
+	if _, ok := am.Annotations[infrav1.RecreateAnnotation]; ok && am.Spec.ProviderID != nil {
+		open, next, err := r.maintenanceWindowOpen(ctx, am)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !open {
+			log.Info("deferring recreate until next maintenance window", "next", next)
+			return ctrl.Result{RequeueAfter: time.Until(next)}, nil
+		}
+		log.Info("recreating machine")
+		return r.reconcileRecreate(ctx, am)
+	}
+
 	if am.Spec.ProviderID != nil {
 		log.Info("machine already exists")
+		if rolledBack, err := r.reconcileLaunchGroup(ctx, am); err != nil || rolledBack {
+			if err == nil {
+				return ctrl.Result{Requeue: true}, nil
+			}
+			return failOrRequeue(am, err)
+		}
+		if am.Status.Ready && r.separateStatusSync && !instanceBooting(am) {
+			// the status of ready machines is refreshed by the
+			// AWSMachineStatusReconciler
+			return ctrl.Result{}, nil
+		}
+		if am.Status.Ready && !syncRequested(am) && !instanceBooting(am) {
+			if !r.refreshes.tryAcquire() {
+				return ctrl.Result{RequeueAfter: refreshDeferral()}, nil
+			}
+			defer r.refreshes.release()
+		}
+		reconcileLaunchSpec(am)
 		if err := r.reconcileStatus(ctx, am); err != nil {
-			return ctrl.Result{}, err
+			return resultForError(err)
 		}
-		return ctrl.Result{}, nil
+		if err := r.reconcileSyncRequest(ctx, am); err != nil {
+			return resultForError(err)
+		}
+		if !am.Status.Ready || r.separateStatusSync {
+			return ctrl.Result{RequeueAfter: bootPollDelay(am, time.Now())}, nil
+		}
+		return r.refreshReady(ctx, am, m)
 	}
 
-	cfg := &machinev1.Config{}
-	if err := r.Get(ctx, client.ObjectKey{Name: m.Spec.ConfigRef.Name, Namespace: m.Namespace}, cfg); err != nil {
-		return ctrl.Result{}, err
+	var userData []byte
+	if !eksBootstrap(am) {
+		var requeue time.Duration
+		userData, requeue, err = r.configUserData(ctx, am, m)
+		if err != nil || requeue != 0 {
+			return ctrl.Result{RequeueAfter: requeue}, err
+		}
 	}
 
-	if !cfg.Status.Ready {
-		return ctrl.Result{RequeueAfter: 5 * time.Second}, nil
+	if err := r.launchBlocked(am); err != nil {
+		log.Info("deferring launch", "reason", err.Error())
+		return resultForError(err)
+	}
+	if err := r.launchGroupBlocked(ctx, am); err != nil {
+		if !awsutil.IsConfigurationError(err) {
+			log.Info("deferring launch", "reason", err.Error())
+		}
+		return failOrRequeue(am, err)
 	}
 
-	s := &corev1.Secret{}
-	if err := r.Get(ctx, client.ObjectKey{Name: *cfg.Status.DataSecretName, Namespace: m.Namespace}, s); err != nil {
+	region, err := r.resolveRegion(ctx, am)
+	if err != nil {
+		return failOrRequeue(am, err)
+	}
+	awscfg, err := r.awsConfig(ctx, am, region)
+	if err != nil {
+		return failOrRequeue(am, err)
+	}
+	if err := r.resolveAMIFamily(ctx, awscfg, am); err != nil {
+		return failOrRequeue(am, err)
+	}
+	if err := r.placeControlPlane(ctx, awscfg, am); err != nil {
 		return ctrl.Result{}, err
 	}
-	userData, ok := s.Data["cloud-config"]
-	if !ok {
-		return ctrl.Result{}, errors.Errorf("secret %q missing cloud-config", *cfg.Status.DataSecretName)
+	if ok, err := r.preflight(ctx, awscfg, am); err != nil || !ok {
+		if r.regionRequiresOptIn(ctx, awscfg, am, err) {
+			return ctrl.Result{}, nil
+		}
+		return resultForError(err)
 	}
-
-	awscfg := &aws.Config{Region: aws.String(am.Spec.Region)}
-
-	if am.Spec.SecretRef != nil {
-		s := &corev1.Secret{}
-		if err := r.Get(ctx, client.ObjectKey{Name: am.Spec.SecretRef.Name, Namespace: m.Namespace}, s); err != nil {
-			return ctrl.Result{}, err
+	if err := r.checkReachability(ctx, awscfg, am); err != nil {
+		return resultForError(err)
+	}
+	if eksBootstrap(am) {
+		userData, err = eksUserData(ctx, awscfg, am)
+		if err != nil {
+			return failOrRequeue(am, err)
 		}
-		id := string(s.Data["AWS_ACCESS_KEY_ID"])
-		secret := string(s.Data["AWS_SECRET_ACCESS_KEY"])
-		if id != "" && secret != "" {
-			awscfg.Credentials = credentials.NewStaticCredentials(id, secret, "")
+	}
+	if err := reconcileInstanceName(ctx, awscfg, am); err != nil {
+		return failOrRequeue(am, err)
+	}
+	rendered, err := renderUserData(am, region, userData)
+	if err != nil {
+		am.Status.SetFailure(mapierrors.InvalidConfigurationMachineError, err.Error())
+		return ctrl.Result{}, nil
+	}
+	if !eksBootstrap(am) {
+		rendered, err = r.issueBootstrapToken(ctx, am, rendered)
+		if err != nil {
+			return failOrRequeue(am, err)
+		}
+		rendered, err = encryptBootstrapToken(ctx, awscfg, am, region, rendered)
+		if err != nil {
+			return failOrRequeue(am, err)
+		}
+		rendered, err = internal.WithInstanceStore(am.Spec.InstanceStorePolicy, am.Spec.OSFamily, am.Spec.UserDataFormat, rendered)
+		if err != nil {
+			am.Status.SetFailure(mapierrors.InvalidConfigurationMachineError, err.Error())
+			return ctrl.Result{}, nil
+		}
+		if am.Spec.Naming != nil && am.Spec.Naming.Hostname {
+			rendered, err = internal.WithHostname(am.Status.InstanceName, am.Spec.OSFamily, am.Spec.UserDataFormat, rendered)
+			if err != nil {
+				am.Status.SetFailure(mapierrors.InvalidConfigurationMachineError, err.Error())
+				return ctrl.Result{}, nil
+			}
 		}
 	}
-	data, err := internal.Gzip(userData)
+	rendered, err = internal.WithProxy(am.Spec.Proxy, am.Spec.OSFamily, am.Spec.UserDataFormat, rendered)
 	if err != nil {
-		return ctrl.Result{}, err
+		am.Status.SetFailure(mapierrors.InvalidConfigurationMachineError, err.Error())
+		return ctrl.Result{}, nil
+	}
+	data, err := internal.EncodeUserData(am.Spec.OSFamily, am.Spec.UserDataFormat, rendered)
+	if err != nil {
+		am.Status.SetFailure(mapierrors.InvalidConfigurationMachineError, fmt.Sprintf("cannot encode bootstrap data for %s: %v", am.Spec.OSFamily, err))
+		return ctrl.Result{}, nil
+	}
+	if err := r.reconcileHost(ctx, awscfg, am); err != nil {
+		return failOrRequeue(am, err)
 	}
-	instance, err := awsutil.LaunchInstance(ctx, awscfg, am, base64.StdEncoding.EncodeToString(data))
+	instance, err := r.claimWarmInstance(ctx, awscfg, am, data)
 	if err != nil {
-		m.Status.SetFailure(mapierrors.CreateMachineError, err.Error())
 		return ctrl.Result{}, err
 	}
+	if instance != nil {
+		log.Info("started instance from warm pool", "instance", aws.StringValue(instance.InstanceId), "pool", am.Spec.WarmPool)
+	} else {
+		if am.Status.LaunchToken == "" {
+			am.Status.LaunchToken = string(uuid.NewUUID())
+		}
+		instance, err = awsutil.LaunchInstance(ctx, awscfg, am, data)
+		if err != nil {
+			if awsutil.LaunchRejected(err) {
+				am.Status.LaunchToken = ""
+			}
+			if awsutil.IsConfigurationError(err) {
+				am.Status.SetFailure(mapierrors.InvalidConfigurationMachineError, err.Error())
+				return ctrl.Result{}, nil
+			}
+			if r.regionRequiresOptIn(ctx, awscfg, am, err) {
+				return ctrl.Result{}, nil
+			}
+			if awsutil.IsQuotaError(err) {
+				log.Info("launch exceeded quota", "reason", err.Error())
+				r.recordLaunchError(am, m, err)
+				r.Decisions.launchFailed(am, region, err)
+				if inLaunchGroup(am) {
+					// the rest of the group rolls back on failed launches
+					quotaExceeded(am, err)
+					return resultForError(r.launchFailed(am, err))
+				}
+				return resultForError(quotaExceeded(am, err))
+			}
+			r.recordSubnetsExhausted(am, err)
+			r.Decisions.launchFailed(am, region, err)
+			if r.recordLaunchError(am, m, err) {
+				log.Error(err, "launch failed permanently", awsutil.LogValues(err)...)
+				return ctrl.Result{}, nil
+			}
+			log.Error(err, "launch failed", append(awsutil.LogValues(err), "failures", am.Status.LaunchFailures+1)...)
+			return resultForError(r.launchFailed(am, err))
+		}
+	}
+	launchSucceeded(am)
+	recordLaunched(am)
 	am.Spec.ProviderID = pointer.StringPtr(fmt.Sprintf("aws:///%s/%s", aws.StringValue(instance.Placement.AvailabilityZone), aws.StringValue(instance.InstanceId)))
-	am.Status.Addresses = getInstanceAddresses(instance)
-	am.Status.Ready = true
+	recordLaunchSpec(am)
+	recordLaunch(am, instance, data)
+	r.Decisions.launched(am, region, instance)
+	recordUserDataHash(am, userData)
+	setInstanceAddresses(am, instance)
+	am.Status.Ready = am.Spec.ReadinessChecks == nil
+	r.reconcileCost(ctx, awscfg, am)
 	if err := r.reconcileStatus(ctx, am); err != nil {
-		return ctrl.Result{}, err
+		return resultForError(err)
+	}
+	return ctrl.Result{RequeueAfter: bootPollDelay(am, time.Now())}, nil
+}
+
+// failOrRequeue records a configuration error as a terminal failure of the
+// machine, which is not retried, and converts any other error into the
+// result of the reconcile like resultForError.
+func failOrRequeue(am *infrav1.AWSMachine, err error) (ctrl.Result, error) {
+	if awsutil.IsConfigurationError(err) {
+		am.Status.SetFailure(mapierrors.InvalidConfigurationMachineError, err.Error())
+		return ctrl.Result{}, nil
+	}
+	return resultForError(err)
+}
+
+// resultForError converts a RequeueAfterError into a requeue result, and
+// returns any other error as is.
+func resultForError(err error) (ctrl.Result, error) {
+	if mapierrors.IsRequeueAfter(err) {
+		return ctrl.Result{RequeueAfter: errors.Cause(err).(mapierrors.HasRequeueAfterError).GetRequeueAfter()}, nil
+	}
+	return ctrl.Result{}, err
+}
+
+// regionRequiresOptIn checks whether err was caused by the machine's region
+// not being enabled for the account, and if so records a terminal failure on
+// the AWSMachine.
+func (r *AWSMachineReconciler) regionRequiresOptIn(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, err error) bool {
+	if !awsutil.IsRegionOptInError(err) {
+		return false
+	}
+	region := aws.StringValue(awscfg.Region)
+	ok, derr := awsutil.RegionRequiresOptIn(ctx, awscfg, region)
+	if derr != nil {
+		r.Log.Error(derr, "cannot determine region opt-in status", "region", region)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	am.Status.SetFailure(mapierrors.InvalidConfigurationMachineError, fmt.Sprintf("region %q requires opt-in, enable it for the account or choose another region", region))
+	return true
+}
+
+// setInstanceIdentity records the instance ID, availability zone and region
+// of the ProviderID in status, so that none has to be parsed from the
+// ProviderID. The region of the ProviderID takes precedence, so that
+// adopted machines and machines whose spec region changed make their calls
+// in the region of their instance.
+func setInstanceIdentity(am *infrav1.AWSMachine, p *awsutil.ProviderID) {
+	am.Status.InstanceID = p.InstanceID
+	am.Status.AvailabilityZone = p.AvailabilityZone
+	am.Status.Region = p.Region
+}
+
+// setInstanceAddresses records the instance addresses and the primary
+// address selected by the machine's PrimaryAddressType.
+func setInstanceAddresses(am *infrav1.AWSMachine, instance *ec2.Instance) {
+	am.Status.Addresses = publishedAddresses(getInstanceAddresses(instance), am.Spec.AddressTypes)
+	addrType := am.Spec.PrimaryAddressType
+	if addrType == "" {
+		addrType = machinev1.MachineInternalIP
+	}
+	am.Status.PrimaryAddress = ""
+	for _, addr := range am.Status.Addresses {
+		if addr.Type == addrType && addr.Address != "" {
+			am.Status.PrimaryAddress = addr.Address
+			break
+		}
+	}
+}
+
+// setInstanceNetwork records the VPC, subnet, primary network interface and
+// security groups of the instance.
+func setInstanceNetwork(am *infrav1.AWSMachine, instance *ec2.Instance) {
+	n := &infrav1.NetworkStatus{
+		VPCID:    aws.StringValue(instance.VpcId),
+		SubnetID: aws.StringValue(instance.SubnetId),
+	}
+	for _, eni := range instance.NetworkInterfaces {
+		if eni.Attachment != nil && aws.Int64Value(eni.Attachment.DeviceIndex) == 0 {
+			n.PrimaryNetworkInterfaceID = aws.StringValue(eni.NetworkInterfaceId)
+		}
+	}
+	for _, sg := range instance.SecurityGroups {
+		n.SecurityGroupIDs = append(n.SecurityGroupIDs, aws.StringValue(sg.GroupId))
+	}
+	am.Status.Network = n
+}
+
+// publishedAddresses returns the addresses of the types, ordered by type.
+// All addresses are returned when no types are given.
+func publishedAddresses(addresses machinev1.MachineAddresses, types []machinev1.MachineAddressType) machinev1.MachineAddresses {
+	if len(types) == 0 {
+		return addresses
+	}
+	published := make(machinev1.MachineAddresses, 0, len(addresses))
+	for _, t := range types {
+		for _, addr := range addresses {
+			if addr.Type == t {
+				published = append(published, addr)
+			}
+		}
 	}
-	return ctrl.Result{}, nil
+	return published
 }
 
 func getInstanceAddresses(instance *ec2.Instance) machinev1.MachineAddresses {
 	addresses := make([]machinev1.MachineAddress, 0)
-	for _, eni := range instance.NetworkInterfaces {
-		privateDNSAddress := machinev1.MachineAddress{
-			Type:    machinev1.MachineInternalDNS,
-			Address: aws.StringValue(eni.PrivateDnsName),
+	add := func(t machinev1.MachineAddressType, addr *string) {
+		// IPv6-only instances have no private IPv4 address
+		if aws.StringValue(addr) == "" {
+			return
 		}
-		privateIPAddress := machinev1.MachineAddress{
-			Type:    machinev1.MachineInternalIP,
-			Address: aws.StringValue(eni.PrivateIpAddress),
+		addresses = append(addresses, machinev1.MachineAddress{Type: t, Address: aws.StringValue(addr)})
+	}
+	for _, eni := range instance.NetworkInterfaces {
+		add(machinev1.MachineInternalDNS, eni.PrivateDnsName)
+		add(machinev1.MachineInternalIP, eni.PrivateIpAddress)
+
+		// IPv6 addresses are assigned from the VPC range and are not NATed,
+		// so they are reported as internal addresses like the kubelet does.
+		for _, addr := range eni.Ipv6Addresses {
+			add(machinev1.MachineInternalIP, addr.Ipv6Address)
 		}
-		addresses = append(addresses, privateDNSAddress, privateIPAddress)
 
 		// An elastic IP is attached if association is non nil pointer
 		if eni.Association != nil {
-			publicDNSAddress := machinev1.MachineAddress{
-				Type:    machinev1.MachineExternalDNS,
-				Address: aws.StringValue(eni.Association.PublicDnsName),
-			}
-			publicIPAddress := machinev1.MachineAddress{
-				Type:    machinev1.MachineExternalIP,
-				Address: aws.StringValue(eni.Association.PublicIp),
-			}
-			addresses = append(addresses, publicDNSAddress, publicIPAddress)
+			add(machinev1.MachineExternalDNS, eni.Association.PublicDnsName)
+			add(machinev1.MachineExternalIP, eni.Association.PublicIp)
 		}
 	}
 	return addresses
 }
 
 func (r *AWSMachineReconciler) reconcileDelete(ctx context.Context, am *infrav1.AWSMachine) error {
+	if err := r.deleteDNS(ctx, am); err != nil {
+		return err
+	}
+	if am.Spec.ProviderID == nil {
+		return r.reconcileDeleteByTag(ctx, am)
+	}
 	p, err := awsutil.ParseProviderID(*am.Spec.ProviderID)
 	if err != nil {
 		return err
 	}
-	awscfg := &aws.Config{Region: aws.String(p.Region)}
+	awscfg, err := r.deleteAWSConfig(ctx, am, p.Region)
+	if err != nil {
+		return err
+	}
+	if err := r.deregisterLoadBalancers(ctx, awscfg, am); err != nil {
+		return err
+	}
 	state, err := awsutil.DescribeInstanceStatus(ctx, awscfg, p.InstanceID)
 	if err != nil {
 		return err
 	}
+	if err := r.detachFromAutoScalingGroup(ctx, awscfg, am, p.InstanceID, state); err != nil {
+		return err
+	}
+	if err := r.terminateInstance(ctx, awscfg, am, p.InstanceID, state); err != nil {
+		return err
+	}
+	if err := r.waitForNetworkCleanup(ctx, awscfg, am, p.InstanceID); err != nil {
+		return err
+	}
+	if err := r.releaseElasticIP(ctx, awscfg, am); err != nil {
+		return err
+	}
+	if err := r.deleteOwnedResources(ctx, awscfg, am); err != nil {
+		return err
+	}
+	return r.releaseHosts(ctx, awscfg, am)
+}
+
+// reconcileDeleted terminates the instance of the deleted machine and
+// deletes the resources created with it, returning true once the machine
+// can be released. Failed deletions are retried, keeping the finalizer so
+// that the instance is not leaked, unless the machine is force deleted.
+func (r *AWSMachineReconciler) reconcileDeleted(ctx context.Context, log logr.Logger, am *infrav1.AWSMachine) (ctrl.Result, bool, error) {
+	err := r.decommission(ctx, am)
+	if err != nil && !forceDelete(am) {
+		log.Info("waiting for decommissioning webhook", "reason", err.Error())
+		res, err := resultForError(err)
+		return res, false, err
+	}
+	if err == nil {
+		err = r.reconcileDelete(ctx, am)
+	}
+	if err == nil && r.DeleteNodes {
+		err = r.deleteOwnedNodes(ctx, am)
+	}
+	if err == nil {
+		return ctrl.Result{}, true, nil
+	}
+	observeDeletionPending(am)
+	if forceDelete(am) {
+		log.Error(err, "cannot delete machine, releasing it as requested", awsutil.LogValues(err)...)
+		r.Recorder.Eventf(am, corev1.EventTypeWarning, "ForceDeleted", "Machine released by %s, instance may still be running: %v", infrav1.ForceDeleteAnnotation, err)
+		return ctrl.Result{}, true, nil
+	}
+	if mapierrors.IsRequeueAfter(err) {
+		if r.deleteTimedOut(ctx, am) {
+			log.Info("instance did not terminate in time", "reason", err.Error())
+			if err := r.setDeleteFailure(ctx, am, err); err != nil {
+				return ctrl.Result{}, false, err
+			}
+		}
+		log.Info("waiting for instance termination", "reason", err.Error())
+		res, err := resultForError(err)
+		return res, false, err
+	}
+	if awsutil.IsCredentialError(err) {
+		awsutil.RecordCredentialError(err)
+		log.Error(err, "AWS credentials rejected, backing off", awsutil.LogValues(err)...)
+		return ctrl.Result{RequeueAfter: credentialsBackoff}, false, nil
+	}
+	if errors.Is(err, awsutil.ErrThrottled) {
+		log.Info("AWS requests throttled, backing off", "reason", err.Error())
+		return ctrl.Result{RequeueAfter: throttledDeferral()}, false, nil
+	}
+	r.Recorder.Eventf(am, corev1.EventTypeWarning, "DeleteFailed", "Cannot delete instance, retrying: %v", err)
+	if r.deleteTimedOut(ctx, am) {
+		if err := r.setDeleteFailure(ctx, am, err); err != nil {
+			return ctrl.Result{}, false, err
+		}
+	}
+	return ctrl.Result{}, false, err
+}
+
+// reconcileDeleteByTag handles deleting an AWSMachine whose ProviderID was
+// never recorded, for example when a launch raced with deletion. Any
+// instances tagged as launched by this AWSMachine or launched with its
+// launch token are terminated before the finalizer can be released.
+func (r *AWSMachineReconciler) reconcileDeleteByTag(ctx context.Context, am *infrav1.AWSMachine) error {
+	region, err := r.deleteRegion(ctx, am)
+	if err != nil {
+		return err
+	}
+	awscfg, err := r.deleteAWSConfig(ctx, am, region)
+	if err != nil {
+		return err
+	}
+	instances, err := awsutil.DescribeInstancesByTag(ctx, awscfg, awsutil.MachineUIDTagKey, string(am.UID))
+	if err != nil {
+		return err
+	}
+	if am.Status.LaunchToken != "" {
+		launched, err := awsutil.DescribeInstancesByClientToken(ctx, awscfg, am.Status.LaunchToken)
+		if err != nil {
+			return err
+		}
+		instances = append(instances, launched...)
+	}
+	seen := make(map[string]bool)
+	for _, instance := range instances {
+		if seen[aws.StringValue(instance.InstanceId)] {
+			continue
+		}
+		seen[aws.StringValue(instance.InstanceId)] = true
+		if err := r.terminateInstance(ctx, awscfg, am, aws.StringValue(instance.InstanceId), aws.StringValue(instance.State.Name)); err != nil {
+			return err
+		}
+		if err := r.waitForNetworkCleanup(ctx, awscfg, am, aws.StringValue(instance.InstanceId)); err != nil {
+			return err
+		}
+	}
+	if err := r.releaseElasticIP(ctx, awscfg, am); err != nil {
+		return err
+	}
+	if err := r.deleteOwnedResources(ctx, awscfg, am); err != nil {
+		return err
+	}
+	return r.releaseHosts(ctx, awscfg, am)
+}
+
+// terminateInstance moves the instance towards the terminated state,
+// returning a RequeueAfterError until termination has completed.
+func (r *AWSMachineReconciler) terminateInstance(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, instanceID, state string) error {
+	requeue := r.waitSettings(ctx, am.Namespace).DeleteRequeueInterval
 	switch state {
 	case ec2.InstanceStateNamePending:
-		return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: 10 * time.Second}, "machine %q pending, waiting until ready to delete", am.Name)
+		return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: requeue}, "machine %q pending, waiting until ready to delete", am.Name)
 	case ec2.InstanceStateNameStopping:
-		return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: 10 * time.Second}, "machine %q stopping, waiting until stopped to delete", am.Name)
+		return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: requeue}, "machine %q stopping, waiting until stopped to delete", am.Name)
 	case ec2.InstanceStateNameRunning, ec2.InstanceStateNameStopped:
-		log.Info("terminate running instance", "InstanceID", p.InstanceID)
-		if err := awsutil.TerminateInstance(ctx, awscfg, p.InstanceID); err != nil {
+		r.Log.Info("terminate running instance", "awsmachine", am.Name, "instanceID", instanceID)
+		if err := awsutil.TerminateInstance(ctx, awscfg, instanceID); err != nil {
 			return err
 		}
-		return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: 10 * time.Second}, "machine %q terminating", am.Name)
+		return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: requeue}, "machine %q terminating", am.Name)
 	case ec2.InstanceStateNameShuttingDown:
-		return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: 10 * time.Second}, "machine %q terminating", am.Name)
+		return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: requeue}, "machine %q terminating", am.Name)
 	case ec2.InstanceStateNameTerminated:
 		return nil
 	default:
@@ -250,25 +846,332 @@ func (r *AWSMachineReconciler) reconcileDelete(ctx context.Context, am *infrav1.
 	}
 }
 
+// configResyncInterval is the least time a machine waits before checking
+// a Config that is not ready again, in case its update was missed.
+const configResyncInterval = time.Minute
+
+// configUserData returns the bootstrap data of the Config of the Machine,
+// or how long to wait for the Config to render it.
+func (r *AWSMachineReconciler) configUserData(ctx context.Context, am *infrav1.AWSMachine, m *machinev1.Machine) ([]byte, time.Duration, error) {
+	if isClusterAPIMachine(m) {
+		if m.Spec.ConfigRef.Name == "" {
+			return nil, r.waitSettings(ctx, am.Namespace).ConfigRequeueInterval, nil
+		}
+		userData, err := r.clusterAPIUserData(ctx, m)
+		return userData, 0, err
+	}
+	_, cspan := tracer.Start(ctx, "WaitForBootstrapConfig")
+	cfg := &machinev1.Config{}
+	if err := r.Get(ctx, client.ObjectKey{Name: m.Spec.ConfigRef.Name, Namespace: m.Namespace}, cfg); err != nil {
+		endSpan(cspan, err)
+		return nil, 0, err
+	}
+	cspan.SetAttributes(attribute.Bool("ready", cfg.Status.Ready))
+	endSpan(cspan, nil)
+
+	// Configs are watched, so the requeue only guards against missed
+	// events
+	waits := r.waitSettings(ctx, am.Namespace)
+	requeue := waits.ConfigRequeueInterval
+	if requeue < configResyncInterval {
+		requeue = configResyncInterval
+	}
+	if !cfg.Status.Ready {
+		return nil, requeue, nil
+	}
+
+	_, uspan := tracer.Start(ctx, "FetchUserData")
+	s := &corev1.Secret{}
+	err := r.Get(ctx, client.ObjectKey{Name: *cfg.Status.DataSecretName, Namespace: m.Namespace}, s)
+	endSpan(uspan, err)
+	if err != nil {
+		return nil, 0, err
+	}
+	userData, err := bootstrapData(am, s)
+	return userData, 0, err
+}
+
+// refreshReady performs the periodic work on a ready machine: requested
+// reboots, cost and drift tracking, recommendations and scheduled events.
+// It returns when the machine should be refreshed again.
+func (r *AWSMachineReconciler) refreshReady(ctx context.Context, am *infrav1.AWSMachine, m *machinev1.Machine) (ctrl.Result, error) {
+	if err := r.reconcileReboot(ctx, am); err != nil {
+		return resultForError(err)
+	}
+	r.refreshCost(ctx, am)
+	if err := r.reconcileBootstrapDrift(ctx, am, m); err != nil {
+		r.Log.WithValues("awsmachine", am.Name).Error(err, "cannot compare bootstrap data", awsutil.LogValues(err)...)
+	}
+	requeue, err := r.reconcileExpiry(ctx, am, m)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	checked, err := r.reconcileDNSHealth(ctx, am)
+	if err != nil {
+		return resultForError(err)
+	}
+	if checked && (requeue == 0 || dnsHealthInterval < requeue) {
+		requeue = dnsHealthInterval
+	}
+	if r.RecommendationInterval > 0 {
+		r.reconcileRecommendations(ctx, am)
+		if requeue == 0 || r.RecommendationInterval < requeue {
+			requeue = r.RecommendationInterval
+		}
+	}
+	if r.EventPollInterval > 0 {
+		if err := r.reconcileEvents(ctx, am); err != nil {
+			return resultForError(err)
+		}
+		if requeue == 0 || r.EventPollInterval < requeue {
+			requeue = r.EventPollInterval
+		}
+	}
+	if r.StatusSyncPeriod > 0 {
+		if sync := statusSyncDelay(r.StatusSyncPeriod); requeue == 0 || sync < requeue {
+			requeue = sync
+		}
+	}
+	if boot := bootPollDelay(am, time.Now()); boot != 0 && (requeue == 0 || boot < requeue) {
+		requeue = boot
+	}
+	return ctrl.Result{RequeueAfter: requeue}, nil
+}
+
+// maintenanceWindowOpen reports whether disruptive actions may currently be
+// performed on the machine, and if not, when the next window opens. Windows
+// set on the machine take precedence over those set on the provider.
+func (r *AWSMachineReconciler) maintenanceWindowOpen(ctx context.Context, am *infrav1.AWSMachine) (bool, time.Time, error) {
+	windows := am.Spec.MaintenanceWindows
+	if len(windows) == 0 {
+		p, err := getProvider(ctx, r.Client, am.Namespace)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+		if p != nil {
+			windows = p.Spec.MaintenanceWindows
+		}
+	}
+	return maintenance.Open(windows, time.Now())
+}
+
+// reconcileRecreate replaces the instance backing an AWSMachine. The node is
+// drained and the instance terminated, after which the ProviderID is cleared
+// so that the next reconcile launches a new instance with the same spec.
+func (r *AWSMachineReconciler) reconcileRecreate(ctx context.Context, am *infrav1.AWSMachine) (ctrl.Result, error) {
+	n, err := getNodeByProviderID(ctx, r.Client, *am.Spec.ProviderID)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if n != nil {
+		k, err := kubernetes.NewForConfig(r.config)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		drained, err := drainNode(ctx, k, n)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !drained {
+			return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+		}
+	}
+	if err := r.reconcileDelete(ctx, am); err != nil {
+		return resultForError(err)
+	}
+	if n != nil {
+		if err := r.Delete(ctx, n); client.IgnoreNotFound(err) != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	clearInstance(am)
+	delete(am.Annotations, infrav1.RecreateAnnotation)
+	return ctrl.Result{Requeue: true}, nil
+}
+
+// clearInstance forgets the terminated instance of the machine, so that the
+// next reconcile launches a new instance.
+func clearInstance(am *infrav1.AWSMachine) {
+	am.Spec.ProviderID = nil
+	am.Status.Ready = false
+	am.Status.Addresses = nil
+	am.Status.Network = nil
+	am.Status.InstanceState = ""
+	am.Status.InstanceID = ""
+	am.Status.AvailabilityZone = ""
+	am.Status.LaunchToken = ""
+}
+
+// reconcileInstanceStopped records why the instance of the machine was
+// stopped or terminated outside of its deletion, which is otherwise lost
+// once EC2 forgets the instance. A terminated instance fails the machine
+// with the reason, and true is returned so that the status is not refreshed
+// further.
+func (r *AWSMachineReconciler) reconcileInstanceStopped(am *infrav1.AWSMachine, instance *ec2.Instance, exists bool) bool {
+	state := ec2.InstanceStateNameTerminated
+	reason := "instance no longer exists"
+	if exists {
+		state = aws.StringValue(instance.State.Name)
+		reason = awsutil.StateReason(instance)
+	}
+	switch state {
+	case ec2.InstanceStateNameStopping, ec2.InstanceStateNameStopped:
+		if reason != "" && reason != am.Status.InstanceStateReason {
+			r.Recorder.Eventf(am, corev1.EventTypeWarning, "InstanceStopped", "Instance %s was stopped: %s", am.Status.InstanceID, reason)
+			am.Status.InstanceStateReason = reason
+		}
+		return false
+	case ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameTerminated:
+		am.Status.InstanceState = state
+		am.Status.Ready = false
+		if reason != "" && (exists || am.Status.InstanceStateReason == "") {
+			am.Status.InstanceStateReason = reason
+		}
+		if am.Status.FailureReason == nil {
+			msg := fmt.Sprintf("instance %s was terminated", am.Status.InstanceID)
+			if am.Status.InstanceStateReason != "" {
+				msg += ": " + am.Status.InstanceStateReason
+			}
+			r.Recorder.Eventf(am, corev1.EventTypeWarning, "InstanceTerminated", "%s", msg)
+			am.Status.SetFailure(mapierrors.UpdateMachineError, msg)
+		}
+		return true
+	}
+	return false
+}
+
 func (r *AWSMachineReconciler) reconcileStatus(ctx context.Context, am *infrav1.AWSMachine) error {
 	p, err := awsutil.ParseProviderID(*am.Spec.ProviderID)
 	if err != nil {
 		return err
 	}
-	awscfg := &aws.Config{Region: aws.String(p.Region)}
-	state, err := awsutil.DescribeInstanceStatus(ctx, awscfg, p.InstanceID)
+	setInstanceIdentity(am, p)
+	awscfg, err := r.awsConfig(ctx, am, p.Region)
 	if err != nil {
 		return err
 	}
-	am.Status.InstanceState = state
+	instance, ok, err := awsutil.DescribeInstance(ctx, awscfg, p.InstanceID)
+	if err != nil {
+		return err
+	}
+	if r.reconcileInstanceStopped(am, instance, ok) {
+		return nil
+	}
+	am.Status.InstanceState = aws.StringValue(instance.State.Name)
+	r.reconcileAutoScalingGroup(ctx, awscfg, am, p.InstanceID)
+	if err := r.attachToAutoScalingGroup(ctx, awscfg, am, p.InstanceID); err != nil {
+		return err
+	}
+	if err := r.reconcileScaleInProtection(ctx, awscfg, am, p.InstanceID); err != nil {
+		return err
+	}
+	if am.Spec.SourceDestCheck != nil {
+		changed, err := awsutil.EnsureSourceDestCheck(ctx, awscfg, p.InstanceID, *am.Spec.SourceDestCheck)
+		if err != nil {
+			return err
+		}
+		if changed && am.Status.Ready {
+			r.Recorder.Eventf(am, corev1.EventTypeWarning, "SourceDestCheckReset", "Source/destination check of instance %s was changed out of band, reset to %v", p.InstanceID, *am.Spec.SourceDestCheck)
+		}
+	}
+	if err := r.reconcileElasticIP(ctx, awscfg, am, instance); err != nil {
+		return err
+	}
 	if !am.Status.Ready {
 		instance, _, err := awsutil.DescribeInstance(ctx, awscfg, p.InstanceID)
 		if err != nil {
 			//m.Status.SetFailure(mapierrors.CreateMachineError, err.Error())
 			return err
 		}
-		am.Status.Addresses = getInstanceAddresses(instance)
+		setInstanceAddresses(am, instance)
+		setInstanceNetwork(am, instance)
+		am.Status.Architecture = aws.StringValue(instance.Architecture)
+		if instance.Placement != nil && instance.Placement.HostId != nil {
+			am.Status.HostID = aws.StringValue(instance.Placement.HostId)
+		}
+		r.reconcileInstanceConnect(ctx, awscfg, am, instance)
+		if am.Spec.DNS != nil && am.Status.DNSName == "" {
+			if err := r.reconcileDNS(ctx, am, aws.StringValue(instance.VpcId)); err != nil {
+				return err
+			}
+		}
+		if err := r.reconcileLoadBalancers(ctx, awscfg, am, instance); err != nil {
+			return err
+		}
+		if am.Spec.ENAExpress != nil {
+			if err := awsutil.EnsureENAExpress(ctx, awscfg, instance, am.Spec.ENAExpress.Enabled, am.Spec.ENAExpress.UDP); err != nil {
+				return err
+			}
+		}
+		if am.Spec.ReadinessChecks != nil {
+			return r.reconcileReadiness(ctx, awscfg, am, instance)
+		}
 		am.Status.Ready = true
 	}
 	return nil
 }
+
+// reconcileInstanceConnect records connection hints when an EC2 Instance
+// Connect Endpoint is available for the instance. Failing to look up
+// endpoints (e.g. due to missing permissions) is not an error.
+func (r *AWSMachineReconciler) reconcileInstanceConnect(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, instance *ec2.Instance) {
+	endpoint, err := awsutil.DescribeInstanceConnectEndpoint(ctx, awscfg, aws.StringValue(instance.VpcId), aws.StringValue(instance.SubnetId))
+	if err != nil {
+		r.Log.V(1).Info("cannot describe instance connect endpoints", "error", err.Error())
+		return
+	}
+	if endpoint == "" {
+		am.Status.InstanceConnect = nil
+		return
+	}
+	instanceID := aws.StringValue(instance.InstanceId)
+	am.Status.InstanceConnect = &infrav1.InstanceConnectStatus{
+		EndpointID: endpoint,
+		InstanceID: instanceID,
+		Command:    fmt.Sprintf("aws ec2-instance-connect ssh --region %s --instance-id %s --connection-type eice", aws.StringValue(awscfg.Region), instanceID),
+	}
+}
+
+const defaultReadinessTimeout = 10 * time.Minute
+
+// reconcileReadiness marks the machine ready once the instance passes its
+// readiness checks, requeueing until they pass or the timeout elapses.
+func (r *AWSMachineReconciler) reconcileReadiness(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, instance *ec2.Instance) error {
+	checks := am.Spec.ReadinessChecks
+	timeout := defaultReadinessTimeout
+	if checks.Timeout != nil {
+		timeout = checks.Timeout.Duration
+	}
+	ready := true
+	if checks.StatusChecks {
+		ok, err := awsutil.DescribeInstanceHealth(ctx, awscfg, aws.StringValue(instance.InstanceId))
+		if err != nil {
+			return err
+		}
+		ready = ready && ok
+	}
+	if checks.LoadBalancers && ready {
+		ok, err := loadBalancersHealthy(ctx, awscfg, am)
+		if err != nil {
+			return err
+		}
+		ready = ok
+	}
+	if checks.TCPPort != nil && ready {
+		addr := net.JoinHostPort(am.Status.PrimaryAddress, strconv.Itoa(int(*checks.TCPPort)))
+		conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
+		if err == nil {
+			conn.Close()
+		}
+		ready = err == nil
+	}
+	if ready {
+		am.Status.Ready = true
+		return nil
+	}
+	if launched := aws.TimeValue(instance.LaunchTime); !launched.IsZero() && time.Since(launched) > timeout {
+		am.Status.SetFailure(mapierrors.CreateMachineError, fmt.Sprintf("instance did not pass readiness checks within %v", timeout))
+		return nil
+	}
+	return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: 15 * time.Second}, "machine %q waiting for readiness checks", am.Name)
+}
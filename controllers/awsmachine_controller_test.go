@@ -0,0 +1,646 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	machinev1 "github.com/criticalstack/machine-api/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+const testNamespace = "test"
+
+func newTestScheme(t testing.TB) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	for _, add := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, infrav1.AddToScheme, machinev1.AddToScheme} {
+		if err := add(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return scheme
+}
+
+func newTestAWSMachineReconciler(t *testing.T, objs ...runtime.Object) *AWSMachineReconciler {
+	scheme := newTestScheme(t)
+	return &AWSMachineReconciler{
+		Client:   fake.NewFakeClientWithScheme(scheme, objs...),
+		Log:      log.NullLogger{},
+		Scheme:   scheme,
+		Recorder: record.NewFakeRecorder(100),
+	}
+}
+
+func reconcileAWSMachine(r *AWSMachineReconciler, name string) (ctrl.Result, error) {
+	return r.Reconcile(ctrl.Request{NamespacedName: client.ObjectKey{Namespace: testNamespace, Name: name}})
+}
+
+func TestReconcileDelete(t *testing.T) {
+	cases := []struct {
+		name          string
+		state         string
+		wantTerminate bool
+		wantRequeue   bool
+	}{
+		{name: "pending", state: "pending", wantTerminate: false, wantRequeue: true},
+		{name: "running", state: "running", wantTerminate: true, wantRequeue: true},
+		{name: "stopping", state: "stopping", wantTerminate: false, wantRequeue: true},
+		{name: "stopped", state: "stopped", wantTerminate: true, wantRequeue: true},
+		{name: "shutting down", state: "shutting-down", wantTerminate: false, wantRequeue: true},
+		{name: "terminated", state: "terminated", wantTerminate: false, wantRequeue: false},
+		{name: "not found", state: "", wantTerminate: false, wantRequeue: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ec2 := newMockEC2(t)
+			if tc.state != "" {
+				ec2.instances["i-0123456789abcdef0"] = &mockInstance{State: tc.state}
+			}
+			now := metav1.Now()
+			am := &infrav1.AWSMachine{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              "m",
+					Namespace:         testNamespace,
+					Finalizers:        []string{infrav1.MachineFinalizer},
+					DeletionTimestamp: &now,
+				},
+				Spec: infrav1.AWSMachineSpec{
+					ProviderID: pointer.StringPtr("aws:///us-east-1a/i-0123456789abcdef0"),
+				},
+			}
+			r := newTestAWSMachineReconciler(t, am)
+
+			res, err := reconcileAWSMachine(r, am.Name)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := ec2.called("TerminateInstances") > 0; got != tc.wantTerminate {
+				t.Errorf("terminated instance = %v, want %v", got, tc.wantTerminate)
+			}
+			if got := res.RequeueAfter > 0; got != tc.wantRequeue {
+				t.Errorf("requeued = %v, want %v", got, tc.wantRequeue)
+			}
+			updated := &infrav1.AWSMachine{}
+			if err := r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: am.Name}, updated); err != nil {
+				t.Fatal(err)
+			}
+			if got := len(updated.Finalizers) > 0; got != tc.wantRequeue {
+				t.Errorf("finalizer kept = %v, want %v", got, tc.wantRequeue)
+			}
+		})
+	}
+}
+
+// newBootstrapObjects returns an AWSMachine owned by a Machine whose
+// bootstrap data Secret has the given data.
+func newBootstrapObjects(data map[string][]byte) []runtime.Object {
+	return []runtime.Object{
+		&machinev1.Machine{
+			ObjectMeta: metav1.ObjectMeta{Name: "m", Namespace: testNamespace},
+			Spec: machinev1.MachineSpec{
+				ConfigRef: corev1.ObjectReference{Name: "m"},
+			},
+		},
+		&machinev1.Config{
+			ObjectMeta: metav1.ObjectMeta{Name: "m", Namespace: testNamespace},
+			Status: machinev1.ConfigStatus{
+				Ready:          true,
+				DataSecretName: pointer.StringPtr("m-bootstrap"),
+			},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "m-bootstrap", Namespace: testNamespace},
+			Data:       data,
+		},
+		&infrav1.AWSMachine{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "m",
+				Namespace: testNamespace,
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: machinev1.GroupVersion.String(),
+					Kind:       "Machine",
+					Name:       "m",
+				}},
+			},
+			Spec: infrav1.AWSMachineSpec{
+				Region:       "us-east-1",
+				AMI:          "ami-0123456789abcdef0",
+				InstanceType: "t3.small",
+			},
+		},
+	}
+}
+
+func TestReconcileMissingCloudConfig(t *testing.T) {
+	cases := []struct {
+		name string
+		data map[string][]byte
+	}{
+		{name: "no data", data: nil},
+		{name: "unknown key", data: map[string][]byte{"bootstrap": []byte("#cloud-config\n")}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ec2 := newMockEC2(t)
+			r := newTestAWSMachineReconciler(t, newBootstrapObjects(tc.data)...)
+
+			_, err := reconcileAWSMachine(r, "m")
+			if err == nil || !strings.Contains(err.Error(), "missing cloud-config") {
+				t.Fatalf("expected missing cloud-config error, got %v", err)
+			}
+			if n := ec2.called("RunInstances"); n != 0 {
+				t.Errorf("launched %d instances without bootstrap data", n)
+			}
+			am := &infrav1.AWSMachine{}
+			if err := r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "m"}, am); err != nil {
+				t.Fatal(err)
+			}
+			if am.Status.FailureMessage != nil {
+				t.Errorf("machine failed permanently: %s", *am.Status.FailureMessage)
+			}
+		})
+	}
+}
+
+func TestBootstrapData(t *testing.T) {
+	cases := []struct {
+		name     string
+		key      string
+		data     map[string][]byte
+		expected string
+		err      bool
+	}{
+		{name: "cloud-config", data: map[string][]byte{"cloud-config": []byte("crit")}, expected: "crit"},
+		{name: "value", data: map[string][]byte{"value": []byte("capi")}, expected: "capi"},
+		{name: "userData", data: map[string][]byte{"userData": []byte("other")}, expected: "other"},
+		{
+			name: "cloud-config wins",
+			data: map[string][]byte{
+				"ignition":     []byte("ignition"),
+				"userData":     []byte("other"),
+				"value":        []byte("capi"),
+				"cloud-config": []byte("crit"),
+			},
+			expected: "crit",
+		},
+		{
+			name:     "explicit key",
+			key:      "ignition",
+			data:     map[string][]byte{"cloud-config": []byte("crit"), "ignition": []byte("ignition")},
+			expected: "ignition",
+		},
+		{name: "explicit key missing", key: "ignition", data: map[string][]byte{"cloud-config": []byte("crit")}, err: true},
+		{name: "no known key", data: map[string][]byte{"bootstrap": []byte("#cloud-config\n")}, err: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			am := &infrav1.AWSMachine{Spec: infrav1.AWSMachineSpec{BootstrapDataKey: tc.key}}
+			s := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "m-bootstrap"}, Data: tc.data}
+			data, err := bootstrapData(am, s)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got %q", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, data)
+			}
+		})
+	}
+}
+
+// concurrentWriter runs write before the first Patch, as if another writer
+// modified the object between the reconciler reading and patching it.
+type concurrentWriter struct {
+	client.Client
+	write func() error
+}
+
+func (c *concurrentWriter) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if c.write != nil {
+		write := c.write
+		c.write = nil
+		if err := write(); err != nil {
+			return err
+		}
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func TestReconcilePatchConflict(t *testing.T) {
+	newMockEC2(t)
+	r := newTestAWSMachineReconciler(t, newBootstrapObjects(nil)...)
+	c := r.Client
+	r.Client = &concurrentWriter{
+		Client: c,
+		write: func() error {
+			am := &infrav1.AWSMachine{}
+			if err := c.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "m"}, am); err != nil {
+				return err
+			}
+			am.Labels = map[string]string{"team": "infra"}
+			return c.Update(context.Background(), am)
+		},
+	}
+
+	if _, err := reconcileAWSMachine(r, "m"); err == nil || !strings.Contains(err.Error(), "missing cloud-config") {
+		t.Fatalf("expected missing cloud-config error, got %v", err)
+	}
+	am := &infrav1.AWSMachine{}
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "m"}, am); err != nil {
+		t.Fatal(err)
+	}
+	if am.Labels["team"] != "infra" {
+		t.Errorf("concurrent change was overwritten, labels = %v", am.Labels)
+	}
+	if len(am.Finalizers) != 1 || am.Finalizers[0] != infrav1.MachineFinalizer {
+		t.Errorf("finalizers = %v, want %v", am.Finalizers, []string{infrav1.MachineFinalizer})
+	}
+}
+
+func TestAWSConfigSecretRef(t *testing.T) {
+	cases := []struct {
+		name      string
+		data      map[string][]byte
+		namespace string
+		shared    []string
+		missing   bool
+		wantErr   bool
+		wantCreds bool
+	}{
+		{
+			name:      "keys",
+			data:      map[string][]byte{"AWS_ACCESS_KEY_ID": []byte("AKID"), "AWS_SECRET_ACCESS_KEY": []byte("secret")},
+			wantCreds: true,
+		},
+		{
+			name: "empty access key",
+			data: map[string][]byte{"AWS_ACCESS_KEY_ID": []byte(""), "AWS_SECRET_ACCESS_KEY": []byte("secret")},
+		},
+		{
+			name: "empty secret key",
+			data: map[string][]byte{"AWS_ACCESS_KEY_ID": []byte("AKID"), "AWS_SECRET_ACCESS_KEY": []byte("")},
+		},
+		{
+			name: "no keys",
+			data: map[string][]byte{},
+		},
+		{
+			name:    "missing secret",
+			missing: true,
+			wantErr: true,
+		},
+		{
+			name:      "other namespace",
+			data:      map[string][]byte{"AWS_ACCESS_KEY_ID": []byte("AKID"), "AWS_SECRET_ACCESS_KEY": []byte("secret")},
+			namespace: "other",
+			shared:    []string{"another"},
+			wantErr:   true,
+		},
+		{
+			name:      "shared from other namespace",
+			data:      map[string][]byte{"AWS_ACCESS_KEY_ID": []byte("AKID"), "AWS_SECRET_ACCESS_KEY": []byte("secret")},
+			namespace: "other",
+			shared:    []string{testNamespace},
+			wantCreds: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			am := &infrav1.AWSMachine{
+				ObjectMeta: metav1.ObjectMeta{Name: "m", Namespace: testNamespace},
+				Spec: infrav1.AWSMachineSpec{
+					SecretRef: &corev1.ObjectReference{Name: "creds", Namespace: tc.namespace},
+				},
+			}
+			namespace := testNamespace
+			if tc.namespace != "" {
+				namespace = tc.namespace
+			}
+			objs := []runtime.Object{am}
+			if !tc.missing {
+				objs = append(objs, &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: namespace},
+					Data:       tc.data,
+				})
+			}
+			if tc.shared != nil {
+				objs = append(objs, &infrav1.AWSInfrastructureProvider{
+					ObjectMeta: metav1.ObjectMeta{Name: "provider", Namespace: namespace},
+					Spec: infrav1.AWSInfrastructureProviderSpec{
+						SharedCredentials: []infrav1.SharedCredentials{{SecretName: "creds", Namespaces: tc.shared}},
+					},
+				})
+			}
+			r := newTestAWSMachineReconciler(t, objs...)
+
+			awscfg, err := r.awsConfig(context.Background(), am, "us-east-1")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// without keys the default credential chain is used
+			if got := awscfg.Credentials != nil; got != tc.wantCreds {
+				t.Fatalf("static credentials = %v, want %v", got, tc.wantCreds)
+			}
+			if !tc.wantCreds {
+				return
+			}
+			v, err := awscfg.Credentials.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.AccessKeyID != "AKID" || v.SecretAccessKey != "secret" {
+				t.Errorf("credentials = %q/%q, want AKID/secret", v.AccessKeyID, v.SecretAccessKey)
+			}
+		})
+	}
+}
+
+func TestResolveCredentialsRoles(t *testing.T) {
+	const role = "arn:aws:iam::123456789012:role/tenant-a-launcher"
+	cases := []struct {
+		name    string
+		spec    infrav1.AWSCredentialsSpec
+		allowed *infrav1.CredentialRoles
+		wantErr bool
+	}{
+		{
+			name: "no roles",
+		},
+		{
+			name:    "role without provider allowlist",
+			spec:    infrav1.AWSCredentialsSpec{AssumeRoles: []infrav1.AssumeRole{{RoleARN: role}}},
+			wantErr: true,
+		},
+		{
+			name:    "allowed role",
+			spec:    infrav1.AWSCredentialsSpec{AssumeRoles: []infrav1.AssumeRole{{RoleARN: role}}},
+			allowed: &infrav1.CredentialRoles{RoleARNs: []string{role}},
+		},
+		{
+			name:    "allowed role prefix",
+			spec:    infrav1.AWSCredentialsSpec{WebIdentity: &infrav1.WebIdentity{RoleARN: role}},
+			allowed: &infrav1.CredentialRoles{RoleARNs: []string{"arn:aws:iam::123456789012:role/tenant-a-*"}},
+		},
+		{
+			name:    "role of another tenant",
+			spec:    infrav1.AWSCredentialsSpec{AssumeRoles: []infrav1.AssumeRole{{RoleARN: "arn:aws:iam::123456789012:role/tenant-b-launcher"}}},
+			allowed: &infrav1.CredentialRoles{RoleARNs: []string{"arn:aws:iam::123456789012:role/tenant-a-*"}},
+			wantErr: true,
+		},
+		{
+			name:    "token file of another tenant",
+			spec:    infrav1.AWSCredentialsSpec{WebIdentity: &infrav1.WebIdentity{RoleARN: role, TokenFile: "/var/run/secrets/tenant-b/token"}},
+			allowed: &infrav1.CredentialRoles{RoleARNs: []string{role}},
+			wantErr: true,
+		},
+		{
+			name:    "allowed token file",
+			spec:    infrav1.AWSCredentialsSpec{WebIdentity: &infrav1.WebIdentity{RoleARN: role, TokenFile: "/var/run/secrets/tenant-a/token"}},
+			allowed: &infrav1.CredentialRoles{RoleARNs: []string{role}, TokenFiles: []string{"/var/run/secrets/tenant-a/token"}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			objs := []runtime.Object{&infrav1.AWSCredentials{
+				ObjectMeta: metav1.ObjectMeta{Name: "creds", Namespace: testNamespace},
+				Spec:       tc.spec,
+			}}
+			if tc.allowed != nil {
+				objs = append(objs, &infrav1.AWSInfrastructureProvider{
+					ObjectMeta: metav1.ObjectMeta{Name: "provider", Namespace: testNamespace},
+					Spec:       infrav1.AWSInfrastructureProviderSpec{CredentialRoles: tc.allowed},
+				})
+			}
+			c := fake.NewFakeClientWithScheme(newTestScheme(t), objs...)
+
+			_, err := resolveCredentials(context.Background(), c, testNamespace, "creds", "us-east-1")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tc.wantErr)
+			}
+			if err != nil && !awsutil.IsConfigurationError(err) {
+				t.Errorf("error = %v, want a ConfigurationError", err)
+			}
+			am := &infrav1.AWSMachine{
+				ObjectMeta: metav1.ObjectMeta{Name: "m", Namespace: testNamespace},
+				Spec:       infrav1.AWSMachineSpec{CredentialsRef: &corev1.LocalObjectReference{Name: "creds"}},
+			}
+			v := &AWSMachineValidator{Client: c}
+			if msg := v.checkCredentialRoles(context.Background(), am); (msg != "") != tc.wantErr {
+				t.Errorf("webhook message = %q, want denied %v", msg, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestReconcileDuplicateProviderID(t *testing.T) {
+	ec2 := newMockEC2(t)
+	ec2.instances["i-0123456789abcdef0"] = &mockInstance{State: "running"}
+	providerID := pointer.StringPtr("aws:///us-east-1a/i-0123456789abcdef0")
+	now := metav1.Now()
+	owner := &infrav1.AWSMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "a",
+			Namespace:         testNamespace,
+			UID:               "a",
+			CreationTimestamp: metav1.NewTime(now.Add(-time.Hour)),
+		},
+		Spec: infrav1.AWSMachineSpec{ProviderID: providerID},
+	}
+	duplicate := &infrav1.AWSMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "b",
+			Namespace:         testNamespace,
+			UID:               "b",
+			CreationTimestamp: now,
+			Finalizers:        []string{infrav1.MachineFinalizer},
+			DeletionTimestamp: &now,
+		},
+		Spec: infrav1.AWSMachineSpec{ProviderID: providerID},
+	}
+	r := newTestAWSMachineReconciler(t, owner, duplicate)
+
+	if _, err := reconcileAWSMachine(r, duplicate.Name); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := ec2.called("TerminateInstances"); n != 0 {
+		t.Errorf("deleting the duplicate terminated the instance of its owner")
+	}
+	updated := &infrav1.AWSMachine{}
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: duplicate.Name}, updated); err != nil {
+		t.Fatal(err)
+	}
+	if len(updated.Finalizers) != 0 {
+		t.Errorf("finalizers = %v, want none", updated.Finalizers)
+	}
+}
+
+func TestRecordLaunchError(t *testing.T) {
+	cases := []struct {
+		name       string
+		code       string
+		wantFailed bool
+	}{
+		{name: "terminal", code: "InvalidAMIID.NotFound", wantFailed: true},
+		{name: "retried", code: "InstanceLimitExceeded", wantFailed: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			objs := newBootstrapObjects(nil)
+			m := objs[0].(*machinev1.Machine)
+			am := objs[3].(*infrav1.AWSMachine)
+			r := newTestAWSMachineReconciler(t, objs...)
+
+			if got := r.recordLaunchError(am, m, awserr.New(tc.code, "launch failed", nil)); got != tc.wantFailed {
+				t.Errorf("terminal = %v, want %v", got, tc.wantFailed)
+			}
+			if got := am.Status.FailureReason != nil && am.Status.FailureMessage != nil; got != tc.wantFailed {
+				t.Errorf("AWSMachine failed = %v, want %v", got, tc.wantFailed)
+			}
+			if m.Status.FailureReason != nil || m.Status.FailureMessage != nil {
+				t.Errorf("failure set on the Machine, which is owned by the Machine controller")
+			}
+			if c := am.Status.Conditions.Get(infrav1.InstanceLaunchedCondition); c == nil || c.Reason != tc.code {
+				t.Errorf("InstanceLaunched condition = %+v, want reason %s", c, tc.code)
+			}
+			select {
+			case e := <-r.Recorder.(*record.FakeRecorder).Events:
+				if !strings.Contains(e, "InstanceLaunchFailed") || !strings.Contains(e, tc.code) {
+					t.Errorf("event = %q, want InstanceLaunchFailed with %s", e, tc.code)
+				}
+			default:
+				t.Errorf("no event recorded on the Machine")
+			}
+		})
+	}
+}
+
+func TestReconcileLaunchFailure(t *testing.T) {
+	ec2 := newMockEC2(t)
+	ec2.responses["DescribeImages"] = "<imagesSet><item><imageId>ami-0123456789abcdef0</imageId><imageState>available</imageState>" +
+		"<architecture>x86_64</architecture><creationDate>2020-01-01T00:00:00.000Z</creationDate><rootDeviceName>/dev/xvda</rootDeviceName></item></imagesSet>"
+	ec2.responses["DescribeSubnets"] = "<subnetSet><item><subnetId>subnet-0123456789abcdef0</subnetId><vpcId>vpc-0123456789abcdef0</vpcId>" +
+		"<availabilityZone>us-east-1a</availabilityZone><state>available</state><availableIpAddressCount>100</availableIpAddressCount>" +
+		"<defaultForAz>true</defaultForAz></item></subnetSet>"
+	ec2.errors["GetServiceQuota"] = "NoSuchResourceException"
+	ec2.errors["RunInstances"] = "InvalidAMIID.NotFound"
+	r := newTestAWSMachineReconciler(t, newBootstrapObjects(map[string][]byte{"cloud-config": []byte("#cloud-config\n")})...)
+
+	// terminal failures are not retried
+	if _, err := reconcileAWSMachine(r, "m"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := ec2.called("RunInstances"); n != 1 {
+		t.Fatalf("expected 1 launch, got %d", n)
+	}
+	am := &infrav1.AWSMachine{}
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "m"}, am); err != nil {
+		t.Fatal(err)
+	}
+	if am.Status.FailureReason == nil || am.Status.FailureMessage == nil {
+		t.Fatalf("failure not stored on the AWSMachine, status = %+v", am.Status)
+	}
+	if !strings.Contains(*am.Status.FailureMessage, "InvalidAMIID.NotFound") {
+		t.Errorf("failure message = %q, want InvalidAMIID.NotFound", *am.Status.FailureMessage)
+	}
+	m := &machinev1.Machine{}
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "m"}, m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Status.FailureReason != nil || m.Status.FailureMessage != nil {
+		t.Errorf("failure set on the Machine, which is owned by the Machine controller")
+	}
+}
+
+func TestReconcileLaunchToken(t *testing.T) {
+	ec2 := newMockEC2(t)
+	ec2.responses["DescribeImages"] = "<imagesSet><item><imageId>ami-0123456789abcdef0</imageId><imageState>available</imageState>" +
+		"<architecture>x86_64</architecture><creationDate>2020-01-01T00:00:00.000Z</creationDate><rootDeviceName>/dev/xvda</rootDeviceName></item></imagesSet>"
+	ec2.responses["DescribeSubnets"] = "<subnetSet><item><subnetId>subnet-0123456789abcdef0</subnetId><vpcId>vpc-0123456789abcdef0</vpcId>" +
+		"<availabilityZone>us-east-1a</availabilityZone><state>available</state><availableIpAddressCount>100</availableIpAddressCount>" +
+		"<defaultForAz>true</defaultForAz></item></subnetSet>"
+	ec2.errors["GetServiceQuota"] = "NoSuchResourceException"
+	ec2.instances["i-0123456789abcdef0"] = &mockInstance{State: "running", ClientToken: "token"}
+	objs := newBootstrapObjects(map[string][]byte{"cloud-config": []byte("#cloud-config\n")})
+	objs[3].(*infrav1.AWSMachine).Status.LaunchToken = "token"
+	r := newTestAWSMachineReconciler(t, objs...)
+
+	// the instance of a launch whose response was lost is found by its token
+	if _, err := reconcileAWSMachine(r, "m"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := ec2.called("RunInstances"); n != 0 {
+		t.Fatalf("expected no launch, got %d", n)
+	}
+	am := &infrav1.AWSMachine{}
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "m"}, am); err != nil {
+		t.Fatal(err)
+	}
+	if am.Spec.ProviderID == nil || !strings.HasSuffix(*am.Spec.ProviderID, "/i-0123456789abcdef0") {
+		t.Errorf("expected the launched instance to be recorded, ProviderID = %v", am.Spec.ProviderID)
+	}
+}
+
+func TestReconcileLaunchRejectedResetsToken(t *testing.T) {
+	ec2 := newMockEC2(t)
+	ec2.responses["DescribeImages"] = "<imagesSet><item><imageId>ami-0123456789abcdef0</imageId><imageState>available</imageState>" +
+		"<architecture>x86_64</architecture><creationDate>2020-01-01T00:00:00.000Z</creationDate><rootDeviceName>/dev/xvda</rootDeviceName></item></imagesSet>"
+	ec2.responses["DescribeSubnets"] = "<subnetSet><item><subnetId>subnet-0123456789abcdef0</subnetId><vpcId>vpc-0123456789abcdef0</vpcId>" +
+		"<availabilityZone>us-east-1a</availabilityZone><state>available</state><availableIpAddressCount>100</availableIpAddressCount>" +
+		"<defaultForAz>true</defaultForAz></item></subnetSet>"
+	ec2.errors["GetServiceQuota"] = "NoSuchResourceException"
+	ec2.errors["RunInstances"] = "InstanceLimitExceeded"
+	r := newTestAWSMachineReconciler(t, newBootstrapObjects(map[string][]byte{"cloud-config": []byte("#cloud-config\n")})...)
+
+	// no instance was launched, so the retry gets a new token
+	if _, err := reconcileAWSMachine(r, "m"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := ec2.called("RunInstances"); n != 1 {
+		t.Fatalf("expected 1 launch, got %d", n)
+	}
+	am := &infrav1.AWSMachine{}
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "m"}, am); err != nil {
+		t.Fatal(err)
+	}
+	if am.Status.LaunchToken != "" {
+		t.Errorf("expected the launch token to be reset, got %q", am.Status.LaunchToken)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// AWSMachineStatusReconciler refreshes the status of ready AWSMachines in a
+// work queue of its own, so that polling the instances of a large fleet
+// cannot delay launching and terminating machines. Its AWS requests are
+// made with the status budget, see awsutil.WithStatusBudget. Machines that
+// are not ready are left to the AWSMachineReconciler, whose settings it
+// shares.
+type AWSMachineStatusReconciler struct {
+	*AWSMachineReconciler
+
+	// InstanceStateChanges, when set, receives events for machines whose
+	// instances changed state. It must not be the channel of the
+	// AWSMachineReconciler.
+	InstanceStateChanges <-chan event.GenericEvent
+}
+
+// SetupWithManager must be called after the SetupWithManager of the
+// AWSMachineReconciler.
+func (r *AWSMachineStatusReconciler) SetupWithManager(mgr ctrl.Manager, options controller.Options) error {
+	r.separateStatusSync = true
+	b := ctrl.NewControllerManagedBy(mgr).
+		Named("awsmachinestatus").
+		WithOptions(options).
+		For(&infrav1.AWSMachine{}, builder.WithPredicates(watchFilterPredicate(r.WatchFilter))).
+		Watches(
+			&source.Kind{Type: &corev1.Secret{}},
+			&handler.EnqueueRequestsFromMapFunc{
+				ToRequests: handler.ToRequestsFunc(r.bootstrapSecretToAWSMachines),
+			},
+		)
+	if r.InstanceStateChanges != nil {
+		b = b.Watches(
+			&source.Channel{Source: r.InstanceStateChanges},
+			&handler.EnqueueRequestForObject{},
+		)
+	}
+	return b.Complete(r)
+}
+
+func (r *AWSMachineStatusReconciler) Reconcile(req ctrl.Request) (res ctrl.Result, reterr error) {
+	if res, ok := beginInflight(); !ok {
+		return res, nil
+	}
+	defer awsutil.Inflight.End()
+	ctx := awsutil.WithNamespace(context.Background(), req.Namespace)
+	ctx = awsutil.WithObject(ctx, "awsmachine", req.Namespace, req.Name)
+	ctx = awsutil.WithStatusBudget(ctx)
+	ctx, cancel := withReconcileTimeout(ctx, r.ReconcileTimeout)
+	defer cancel()
+	log := r.Log.WithValues("awsmachine", req.NamespacedName, "controller", "awsmachinestatus")
+
+	am := &infrav1.AWSMachine{}
+	if err := r.Get(ctx, req.NamespacedName, am); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	if !matchesWatchFilter(r.WatchFilter, am) || !needsStatusSync(am) {
+		return ctrl.Result{}, nil
+	}
+	if degraded, _ := awsutil.CredentialOutages.Degraded(am.Namespace); degraded {
+		return ctrl.Result{RequeueAfter: credentialsBackoff}, nil
+	}
+	m, err := r.ownerMachine(ctx, am)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if m == nil {
+		return ctrl.Result{}, nil
+	}
+
+	patcher := newAWSMachinePatcher(am)
+	defer func() {
+		ctx, cancel := statusWriteContext()
+		defer cancel()
+		err := patcher.Patch(ctx, r.Client, am)
+		if apierrors.IsConflict(err) && reterr == nil {
+			// the status was written concurrently, reconcile the latest
+			// machine again
+			res, reterr = ctrl.Result{Requeue: true}, nil
+		} else if err != nil && reterr == nil {
+			reterr = err
+		}
+	}()
+	defer func() {
+		if setCredentialsCondition(&am.Status.Conditions, reterr) {
+			log.Error(reterr, "AWS credentials rejected, backing off", awsutil.LogValues(reterr)...)
+			res, reterr = ctrl.Result{RequeueAfter: credentialsBackoff}, nil
+		} else if errors.Is(reterr, awsutil.ErrThrottled) {
+			log.Info("AWS requests throttled, backing off", "reason", reterr.Error())
+			res, reterr = ctrl.Result{RequeueAfter: throttledDeferral()}, nil
+		}
+	}()
+
+	reconcileLaunchSpec(am)
+	if err := r.reconcileStatus(ctx, am); err != nil {
+		return resultForError(err)
+	}
+	if err := r.reconcileSyncRequest(ctx, am); err != nil {
+		return resultForError(err)
+	}
+	return r.refreshReady(ctx, am, m)
+}
+
+// needsStatusSync returns true for the machines the status reconciler
+// refreshes: ready machines that are managed by the controller and are
+// neither failed, being recreated nor deleted.
+func needsStatusSync(am *infrav1.AWSMachine) bool {
+	if _, ok := am.Annotations[infrav1.RecreateAnnotation]; ok {
+		return false
+	}
+	return am.Spec.ProviderID != nil && am.Status.Ready && am.Status.FailureMessage == nil &&
+		am.DeletionTimestamp.IsZero() && !isExternallyManaged(am)
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// instanceRefreshPollInterval is how often the progress of an instance
+// refresh is checked.
+const instanceRefreshPollInterval = 30 * time.Second
+
+// AWSMachinePoolReconciler reconciles a AWSMachinePool object by rolling
+// changes of its template out to the instances of its Auto Scaling group.
+// A new version of the launch template of the group is created for the
+// template and an instance refresh replaces the instances of the group,
+// keeping the minimum healthy percentage of the pool in service.
+type AWSMachinePoolReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// WatchFilter restricts the controller to objects with matching labels.
+	WatchFilter labels.Selector
+
+	// ReconcileTimeout bounds the time a single reconcile may take.
+	ReconcileTimeout time.Duration
+}
+
+func (r *AWSMachinePoolReconciler) SetupWithManager(mgr ctrl.Manager, options controller.Options) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&infrav1.AWSMachinePool{}).
+		WithEventFilter(watchFilterPredicate(r.WatchFilter)).
+		WithOptions(options).
+		Complete(r)
+}
+
+// +kubebuilder:rbac:groups=infrastructure.crit.sh,resources=awsmachinepools,verbs=get;list;watch
+// +kubebuilder:rbac:groups=infrastructure.crit.sh,resources=awsmachinepools/status,verbs=get;update;patch
+
+func (r *AWSMachinePoolReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	if res, ok := beginInflight(); !ok {
+		return res, nil
+	}
+	defer awsutil.Inflight.End()
+	ctx := awsutil.WithNamespace(context.Background(), req.Namespace)
+	ctx = awsutil.WithObject(ctx, "awsmachinepool", req.Namespace, req.Name)
+	ctx, cancel := withReconcileTimeout(ctx, r.ReconcileTimeout)
+	defer cancel()
+	log := r.Log.WithValues("awsmachinepool", req.NamespacedName)
+
+	mp := &infrav1.AWSMachinePool{}
+	if err := r.Get(ctx, req.NamespacedName, mp); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	var res ctrl.Result
+	region, err := awsutil.ResolveRegion(mp.Spec.Region)
+	if err == nil {
+		res, err = r.reconcileInstanceRefresh(ctx, log, &aws.Config{Region: aws.String(region)}, mp)
+	}
+	mp.Status.Message = ""
+	if awsutil.IsConfigurationError(err) {
+		mp.Status.Message = err.Error()
+		err = nil
+	}
+	mp.Status.LastUpdated = metav1.Now()
+	sctx, scancel := statusWriteContext()
+	defer scancel()
+	if uerr := r.Status().Update(sctx, mp); uerr != nil && err == nil {
+		return ctrl.Result{}, uerr
+	}
+	return res, err
+}
+
+// reconcileInstanceRefresh records the progress of the last instance
+// refresh of the pool and starts a new one once the template changed and no
+// refresh of the group is active. A failed refresh is not retried until the
+// template changes again.
+func (r *AWSMachinePoolReconciler) reconcileInstanceRefresh(ctx context.Context, log logr.Logger, awscfg *aws.Config, mp *infrav1.AWSMachinePool) (ctrl.Result, error) {
+	group, err := awsutil.DescribeGroup(ctx, awscfg, mp.Spec.AutoScalingGroupName)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	mp.Status.DesiredCapacity = int32(aws.Int64Value(group.DesiredCapacity))
+
+	if s := mp.Status.InstanceRefresh; s != nil {
+		refreshes, err := awsutil.DescribeInstanceRefreshes(ctx, awscfg, mp.Spec.AutoScalingGroupName, s.ID)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if len(refreshes) != 0 {
+			wasActive := s.EndTime == nil
+			mp.Status.InstanceRefresh = instanceRefreshStatus(refreshes[0])
+			if awsutil.InstanceRefreshActive(refreshes[0]) {
+				return ctrl.Result{RequeueAfter: instanceRefreshPollInterval}, nil
+			}
+			if wasActive && aws.StringValue(refreshes[0].Status) != autoscaling.InstanceRefreshStatusSuccessful {
+				r.Recorder.Eventf(mp, corev1.EventTypeWarning, "InstanceRefreshFailed", "Instance refresh %s %s: %s", s.ID, aws.StringValue(refreshes[0].Status), aws.StringValue(refreshes[0].StatusReason))
+			}
+		}
+	}
+
+	hash := poolTemplateHash(&mp.Spec.Template)
+	if hash == mp.Status.TemplateHash {
+		return ctrl.Result{}, nil
+	}
+	// a group can only have one active refresh, which may have been started
+	// outside of the pool
+	refreshes, err := awsutil.DescribeInstanceRefreshes(ctx, awscfg, mp.Spec.AutoScalingGroupName)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	for _, refresh := range refreshes {
+		if awsutil.InstanceRefreshActive(refresh) {
+			log.Info("waiting for active instance refresh to finish", "instanceRefresh", aws.StringValue(refresh.InstanceRefreshId))
+			return ctrl.Result{RequeueAfter: instanceRefreshPollInterval}, nil
+		}
+	}
+
+	lt, err := awsutil.DescribeGroupLaunchTemplate(ctx, awscfg, group)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	mp.Status.LaunchTemplateID = lt.ID
+	if mp.Status.TemplateHash == "" && templateMatches(&mp.Spec.Template, lt) {
+		// the group already launches instances from the template
+		mp.Status.TemplateHash = hash
+		mp.Status.LaunchTemplateVersion = strconv.FormatInt(lt.Version, 10)
+		return ctrl.Result{}, nil
+	}
+	version, err := awsutil.CreateLaunchTemplateVersion(ctx, awscfg, lt, mp.Spec.Template.AMI, mp.Spec.Template.InstanceType)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	minHealthy, warmup := refreshPreferences(mp.Spec.InstanceRefresh)
+	id, err := awsutil.StartInstanceRefresh(ctx, awscfg, group, version, minHealthy, warmup)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	log.Info("started instance refresh", "instanceRefresh", id, "launchTemplate", version.ID, "version", version.Version)
+	r.Recorder.Eventf(mp, corev1.EventTypeNormal, "InstanceRefreshStarted", "Started instance refresh %s to version %d of launch template %s", id, version.Version, version.ID)
+	now := metav1.Now()
+	mp.Status.TemplateHash = hash
+	mp.Status.LaunchTemplateVersion = strconv.FormatInt(version.Version, 10)
+	mp.Status.InstanceRefresh = &infrav1.InstanceRefreshStatus{
+		ID:        id,
+		Status:    autoscaling.InstanceRefreshStatusPending,
+		StartTime: &now,
+	}
+	return ctrl.Result{RequeueAfter: instanceRefreshPollInterval}, nil
+}
+
+// poolTemplateHash returns a short hash identifying the template.
+func poolTemplateHash(t *infrav1.AWSMachinePoolTemplate) string {
+	data, _ := json.Marshal(t)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:10]
+}
+
+// templateMatches returns true if instances launched from the launch
+// template match the template.
+func templateMatches(t *infrav1.AWSMachinePoolTemplate, lt *awsutil.LaunchTemplate) bool {
+	return t.AMI == lt.ImageID && (t.InstanceType == "" || t.InstanceType == lt.InstanceType)
+}
+
+// refreshPreferences returns the minimum healthy percentage and instance
+// warmup in seconds of the preferences, nil when they default to the
+// settings of the group.
+func refreshPreferences(p *infrav1.InstanceRefreshPreferences) (minHealthy, warmup *int64) {
+	if p == nil {
+		return nil, nil
+	}
+	if p.MinHealthyPercentage != nil {
+		minHealthy = aws.Int64(int64(*p.MinHealthyPercentage))
+	}
+	if p.InstanceWarmup != nil {
+		warmup = aws.Int64(int64(p.InstanceWarmup.Duration / time.Second))
+	}
+	return minHealthy, warmup
+}
+
+func instanceRefreshStatus(refresh *autoscaling.InstanceRefresh) *infrav1.InstanceRefreshStatus {
+	s := &infrav1.InstanceRefreshStatus{
+		ID:                 aws.StringValue(refresh.InstanceRefreshId),
+		Status:             aws.StringValue(refresh.Status),
+		Reason:             aws.StringValue(refresh.StatusReason),
+		PercentageComplete: int32(aws.Int64Value(refresh.PercentageComplete)),
+		InstancesToUpdate:  int32(aws.Int64Value(refresh.InstancesToUpdate)),
+	}
+	if refresh.StartTime != nil {
+		t := metav1.NewTime(*refresh.StartTime)
+		s.StartTime = &t
+	}
+	if refresh.EndTime != nil {
+		t := metav1.NewTime(*refresh.EndTime)
+		s.EndTime = &t
+	}
+	return s
+}
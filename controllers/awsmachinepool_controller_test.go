@@ -0,0 +1,140 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+func newTestAWSMachinePool(ami string) *infrav1.AWSMachinePool {
+	return &infrav1.AWSMachinePool{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "pool"},
+		Spec: infrav1.AWSMachinePoolSpec{
+			Region:               "us-east-1",
+			AutoScalingGroupName: "pool",
+			Template:             infrav1.AWSMachinePoolTemplate{AMI: ami},
+		},
+	}
+}
+
+// mockInstanceRefresh sets the responses of the group of a pool launching
+// instances from version 1 of a launch template with ami-old.
+func mockInstanceRefresh(ec2 *mockEC2) {
+	ec2.responses["DescribeAutoScalingGroups"] = "<DescribeAutoScalingGroupsResult><AutoScalingGroups><member>" +
+		"<AutoScalingGroupName>pool</AutoScalingGroupName><DesiredCapacity>3</DesiredCapacity>" +
+		"<LaunchTemplate><LaunchTemplateId>lt-1</LaunchTemplateId><Version>1</Version></LaunchTemplate>" +
+		"</member></AutoScalingGroups></DescribeAutoScalingGroupsResult>"
+	ec2.responses["DescribeLaunchTemplateVersions"] = "<launchTemplateVersionSet><item><launchTemplateId>lt-1</launchTemplateId>" +
+		"<versionNumber>1</versionNumber><launchTemplateData><imageId>ami-old</imageId></launchTemplateData></item></launchTemplateVersionSet>"
+	ec2.responses["CreateLaunchTemplateVersion"] = "<launchTemplateVersion><launchTemplateId>lt-1</launchTemplateId>" +
+		"<versionNumber>2</versionNumber><launchTemplateData><imageId>ami-new</imageId></launchTemplateData></launchTemplateVersion>"
+	ec2.responses["StartInstanceRefresh"] = "<StartInstanceRefreshResult><InstanceRefreshId>r-1</InstanceRefreshId></StartInstanceRefreshResult>"
+}
+
+func setInstanceRefresh(ec2 *mockEC2, status, percentage string) {
+	ec2.mu.Lock()
+	defer ec2.mu.Unlock()
+	ec2.responses["DescribeInstanceRefreshes"] = "<DescribeInstanceRefreshesResult><InstanceRefreshes><member>" +
+		"<InstanceRefreshId>r-1</InstanceRefreshId><AutoScalingGroupName>pool</AutoScalingGroupName>" +
+		"<Status>" + status + "</Status><PercentageComplete>" + percentage + "</PercentageComplete>" +
+		"</member></InstanceRefreshes></DescribeInstanceRefreshesResult>"
+}
+
+func TestReconcileAWSMachinePool(t *testing.T) {
+	cases := []struct {
+		name      string
+		ami       string
+		refreshes int
+	}{
+		{name: "template changed", ami: "ami-new", refreshes: 1},
+		{name: "template already rolled out", ami: "ami-old", refreshes: 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ec2 := newMockEC2(t)
+			mockInstanceRefresh(ec2)
+			r := &AWSMachinePoolReconciler{
+				Client:   fake.NewFakeClientWithScheme(newTestScheme(t), newTestAWSMachinePool(tc.ami)),
+				Log:      log.NullLogger{},
+				Recorder: record.NewFakeRecorder(10),
+			}
+			req := ctrl.Request{NamespacedName: client.ObjectKey{Namespace: testNamespace, Name: "pool"}}
+			mp := &infrav1.AWSMachinePool{}
+
+			res, err := r.Reconcile(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := ec2.called("StartInstanceRefresh"); n != tc.refreshes {
+				t.Fatalf("expected %d instance refreshes, got %d", tc.refreshes, n)
+			}
+			if err := r.Get(context.Background(), req.NamespacedName, mp); err != nil {
+				t.Fatal(err)
+			}
+			if mp.Status.TemplateHash != poolTemplateHash(&mp.Spec.Template) {
+				t.Errorf("template hash not recorded, status = %+v", mp.Status)
+			}
+			if tc.refreshes == 0 {
+				if mp.Status.LaunchTemplateVersion != "1" || mp.Status.InstanceRefresh != nil || res.RequeueAfter != 0 {
+					t.Errorf("expected the current launch template to be adopted, status = %+v", mp.Status)
+				}
+				return
+			}
+			if mp.Status.LaunchTemplateVersion != "2" || mp.Status.InstanceRefresh == nil || mp.Status.InstanceRefresh.ID != "r-1" {
+				t.Fatalf("instance refresh not recorded, status = %+v", mp.Status)
+			}
+			if res.RequeueAfter != instanceRefreshPollInterval {
+				t.Errorf("expected requeue after %v, got %v", instanceRefreshPollInterval, res.RequeueAfter)
+			}
+
+			// progress is recorded until the refresh finished
+			setInstanceRefresh(ec2, "InProgress", "50")
+			if res, err = r.Reconcile(req); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Get(context.Background(), req.NamespacedName, mp); err != nil {
+				t.Fatal(err)
+			}
+			if s := mp.Status.InstanceRefresh; s.Status != "InProgress" || s.PercentageComplete != 50 || res.RequeueAfter == 0 {
+				t.Errorf("progress not recorded, status = %+v, result = %+v", s, res)
+			}
+			setInstanceRefresh(ec2, "Successful", "100")
+			if res, err = r.Reconcile(req); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Get(context.Background(), req.NamespacedName, mp); err != nil {
+				t.Fatal(err)
+			}
+			if s := mp.Status.InstanceRefresh; s.Status != "Successful" || s.PercentageComplete != 100 || res.RequeueAfter != 0 {
+				t.Errorf("completion not recorded, status = %+v, result = %+v", s, res)
+			}
+			if n := ec2.called("StartInstanceRefresh"); n != 1 {
+				t.Errorf("expected no further instance refreshes, got %d", n-1)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// AWSMachineRefreshReconciler reconciles a AWSMachineRefresh object by
+// recreating the selected AWSMachines with the target AMI, at most
+// MaxUnavailable at a time, optionally only after a canary of the new AMI
+// passed. Node drains go through the eviction API so PodDisruptionBudgets are
+// respected.
+type AWSMachineRefreshReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+
+	// WatchFilter restricts the controller to objects with matching labels.
+	WatchFilter labels.Selector
+
+	// ReconcileTimeout bounds the time a single reconcile may take.
+	ReconcileTimeout time.Duration
+}
+
+func (r *AWSMachineRefreshReconciler) SetupWithManager(mgr ctrl.Manager, options controller.Options) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&infrav1.AWSMachineRefresh{}).
+		Watches(
+			&source.Kind{Type: &infrav1.AWSMachine{}},
+			&handler.EnqueueRequestsFromMapFunc{
+				ToRequests: handler.ToRequestsFunc(r.awsMachineToRefreshes),
+			},
+		).
+		WithEventFilter(watchFilterPredicate(r.WatchFilter)).
+		WithOptions(options).
+		Complete(r)
+}
+
+// awsMachineToRefreshes maps an AWSMachine to the refreshes selecting it, so
+// that the next machine is recreated as soon as one becomes ready instead of
+// on the next periodic requeue.
+func (r *AWSMachineRefreshReconciler) awsMachineToRefreshes(o handler.MapObject) []ctrl.Request {
+	list := &infrav1.AWSMachineRefreshList{}
+	if err := r.List(context.Background(), list, client.InNamespace(o.Meta.GetNamespace())); err != nil {
+		return nil
+	}
+	reqs := make([]ctrl.Request, 0)
+	for _, mr := range list.Items {
+		selector, err := metav1.LabelSelectorAsSelector(&mr.Spec.Selector)
+		if err != nil || !selector.Matches(labels.Set(o.Meta.GetLabels())) {
+			continue
+		}
+		reqs = append(reqs, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: mr.Namespace, Name: mr.Name}})
+	}
+	return reqs
+}
+
+// +kubebuilder:rbac:groups=infrastructure.crit.sh,resources=awsmachinerefreshes,verbs=get;list;watch
+// +kubebuilder:rbac:groups=infrastructure.crit.sh,resources=awsmachinerefreshes/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=infrastructure.crit.sh,resources=awsmachines,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
+
+func (r *AWSMachineRefreshReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx, cancel := withReconcileTimeout(context.Background(), r.ReconcileTimeout)
+	defer cancel()
+	log := r.Log.WithValues("awsmachinerefresh", req.NamespacedName)
+
+	mr := &infrav1.AWSMachineRefresh{}
+	if err := r.Get(ctx, req.NamespacedName, mr); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(&mr.Spec.Selector)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	machines := &infrav1.AWSMachineList{}
+	if err := r.List(ctx, machines, client.InNamespace(mr.Namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if mr.Status.Phase == infrav1.RefreshRolledBack && mr.Status.Canary != nil && mr.Status.Canary.AMI == mr.Spec.AMI {
+		return ctrl.Result{}, nil
+	}
+
+	active := make([]*infrav1.AWSMachine, 0)
+	managed := machines.Items[:0]
+	for i := range machines.Items {
+		// the AMI of externally managed machines cannot be changed
+		if !isExternallyManaged(&machines.Items[i]) {
+			managed = append(managed, machines.Items[i])
+		}
+	}
+	machines.Items = managed
+	for i := range machines.Items {
+		if machines.Items[i].DeletionTimestamp.IsZero() {
+			active = append(active, &machines.Items[i])
+		}
+	}
+	mr.Status.Phase = infrav1.RefreshInProgress
+	proceed, err := r.reconcileCanary(ctx, mr, active)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	maxUnavailable := int32(1)
+	if mr.Spec.MaxUnavailable != nil && *mr.Spec.MaxUnavailable > 0 {
+		maxUnavailable = *mr.Spec.MaxUnavailable
+	}
+
+	// machines that failed with the target AMI are not recreated again, so
+	// they pause the refresh instead of taking up a recreating slot forever
+	var updated int32
+	recreating := make([]string, 0)
+	failed := make([]string, 0)
+	outdated := make([]*infrav1.AWSMachine, 0)
+	for _, am := range active {
+		_, pending := am.Annotations[infrav1.RecreateAnnotation]
+		switch {
+		case am.Spec.AMI != mr.Spec.AMI:
+			outdated = append(outdated, am)
+		case am.Status.FailureReason != nil || am.Status.FailureMessage != nil:
+			failed = append(failed, am.Name)
+		case pending || am.Spec.ProviderID == nil || !am.Status.Ready:
+			recreating = append(recreating, am.Name)
+		default:
+			updated++
+		}
+	}
+
+	for _, am := range outdated {
+		if !proceed || len(failed) > 0 || int32(len(recreating)) >= maxUnavailable {
+			break
+		}
+		log.Info("recreating machine with new AMI", "awsmachine", am.Name, "ami", mr.Spec.AMI)
+		if err := r.recreate(ctx, am, mr.Spec.AMI, mr.Name); err != nil {
+			return ctrl.Result{}, err
+		}
+		recreating = append(recreating, am.Name)
+	}
+
+	mr.Status.Total = int32(len(active))
+	mr.Status.Updated = updated
+	mr.Status.Recreating = recreating
+	mr.Status.Failed = failed
+	switch {
+	case mr.Status.Phase == infrav1.RefreshRolledBack:
+	case !proceed:
+		mr.Status.Phase = infrav1.RefreshCanary
+	case len(failed) > 0:
+		log.Info("pausing refresh, machines failed with the new AMI", "failed", failed)
+		mr.Status.Phase = infrav1.RefreshFailed
+	case updated == mr.Status.Total:
+		mr.Status.Phase = infrav1.RefreshCompleted
+	}
+	mr.Status.LastUpdated = metav1.Now()
+	sctx, scancel := statusWriteContext()
+	defer scancel()
+	if err := r.Status().Update(sctx, mr); err != nil {
+		return ctrl.Result{}, err
+	}
+	if mr.Status.Phase == infrav1.RefreshCompleted || mr.Status.Phase == infrav1.RefreshRolledBack {
+		return ctrl.Result{}, nil
+	}
+	return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+}
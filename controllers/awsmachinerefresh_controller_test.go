@@ -0,0 +1,234 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+func newRefreshMachine(name, pool, ami string) *infrav1.AWSMachine {
+	return &infrav1.AWSMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace, Labels: map[string]string{"pool": pool}},
+		Spec: infrav1.AWSMachineSpec{
+			AMI:        ami,
+			ProviderID: pointer.StringPtr("aws:///us-east-1a/i-" + name),
+		},
+		Status: infrav1.AWSMachineStatus{Ready: true},
+	}
+}
+
+func newRefresh(canary *infrav1.CanaryPolicy) *infrav1.AWSMachineRefresh {
+	return &infrav1.AWSMachineRefresh{
+		ObjectMeta: metav1.ObjectMeta{Name: "refresh", Namespace: testNamespace},
+		Spec: infrav1.AWSMachineRefreshSpec{
+			Selector: metav1.LabelSelector{MatchLabels: map[string]string{"pool": "a"}},
+			AMI:      "ami-new",
+			Canary:   canary,
+		},
+	}
+}
+
+func reconcileRefresh(t *testing.T, r *AWSMachineRefreshReconciler) (*infrav1.AWSMachineRefresh, []infrav1.AWSMachine) {
+	t.Helper()
+	key := client.ObjectKey{Namespace: testNamespace, Name: "refresh"}
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	mr := &infrav1.AWSMachineRefresh{}
+	if err := r.Get(context.Background(), key, mr); err != nil {
+		t.Fatal(err)
+	}
+	machines := &infrav1.AWSMachineList{}
+	if err := r.List(context.Background(), machines); err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(machines.Items, func(i, j int) bool { return machines.Items[i].Name < machines.Items[j].Name })
+	return mr, machines.Items
+}
+
+// finishRecreate marks the recreated machines as replaced and ready again.
+func finishRecreate(t *testing.T, c client.Client, machines []infrav1.AWSMachine) {
+	t.Helper()
+	for i := range machines {
+		am := &machines[i]
+		if _, ok := am.Annotations[infrav1.RecreateAnnotation]; !ok {
+			continue
+		}
+		delete(am.Annotations, infrav1.RecreateAnnotation)
+		if err := c.Update(context.Background(), am); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAWSMachineRefreshReconcile(t *testing.T) {
+	objs := []runtime.Object{
+		newRefresh(nil),
+		newRefreshMachine("a-0", "a", "ami-old"),
+		newRefreshMachine("a-1", "a", "ami-old"),
+		newRefreshMachine("b-0", "b", "ami-old"),
+	}
+	c := fake.NewFakeClientWithScheme(newTestScheme(t), objs...)
+	r := &AWSMachineRefreshReconciler{Client: c, Log: log.NullLogger{}}
+
+	mr, machines := reconcileRefresh(t, r)
+	if mr.Status.Phase != infrav1.RefreshInProgress || mr.Status.Total != 2 || len(mr.Status.Recreating) != 1 {
+		t.Fatalf("status = %+v, want one of two machines recreating", mr.Status)
+	}
+	if machines[0].Spec.AMI != "ami-new" || machines[0].Annotations[infrav1.RecreateAnnotation] != "refresh" {
+		t.Errorf("expected %s to be recreated with the new AMI", machines[0].Name)
+	}
+	if machines[1].Spec.AMI != "ami-old" {
+		t.Errorf("expected %s to wait for the recreated machine", machines[1].Name)
+	}
+	if machines[2].Spec.AMI != "ami-old" {
+		t.Errorf("expected %s outside the selector to be kept", machines[2].Name)
+	}
+
+	// the recreated machine blocks the next one until it is replaced
+	mr, machines = reconcileRefresh(t, r)
+	if machines[1].Spec.AMI != "ami-old" {
+		t.Fatalf("expected %s to wait, status = %+v", machines[1].Name, mr.Status)
+	}
+	finishRecreate(t, c, machines)
+	_, machines = reconcileRefresh(t, r)
+	if machines[1].Spec.AMI != "ami-new" {
+		t.Fatalf("expected %s to be recreated once %s was replaced", machines[1].Name, machines[0].Name)
+	}
+	finishRecreate(t, c, machines)
+	mr, _ = reconcileRefresh(t, r)
+	if mr.Status.Phase != infrav1.RefreshCompleted || mr.Status.Updated != 2 {
+		t.Errorf("status = %+v, want completed", mr.Status)
+	}
+}
+
+func TestAWSMachineRefreshFailedMachine(t *testing.T) {
+	objs := []runtime.Object{
+		newRefresh(nil),
+		newRefreshMachine("a-0", "a", "ami-old"),
+		newRefreshMachine("a-1", "a", "ami-old"),
+	}
+	r := &AWSMachineRefreshReconciler{Client: fake.NewFakeClientWithScheme(newTestScheme(t), objs...), Log: log.NullLogger{}}
+
+	_, machines := reconcileRefresh(t, r)
+	// the recreated machine fails to launch with the new AMI
+	am := &machines[0]
+	delete(am.Annotations, infrav1.RecreateAnnotation)
+	am.Spec.ProviderID = nil
+	am.Status.Ready = false
+	am.Status.SetFailure(mapierrors.InvalidConfigurationMachineError, "ami-new is not available")
+	if err := r.Update(context.Background(), am); err != nil {
+		t.Fatal(err)
+	}
+
+	mr, machines := reconcileRefresh(t, r)
+	if mr.Status.Phase != infrav1.RefreshFailed || len(mr.Status.Failed) != 1 || mr.Status.Failed[0] != "a-0" {
+		t.Fatalf("status = %+v, want the refresh failed on a-0", mr.Status)
+	}
+	if len(mr.Status.Recreating) != 0 {
+		t.Errorf("recreating = %v, want the failed machine not counted", mr.Status.Recreating)
+	}
+	if machines[1].Spec.AMI != "ami-old" {
+		t.Errorf("expected %s not to be recreated while a machine failed", machines[1].Name)
+	}
+
+	// deleting the failed machine resumes the refresh
+	if err := r.Delete(context.Background(), &machines[0]); err != nil {
+		t.Fatal(err)
+	}
+	mr, machines = reconcileRefresh(t, r)
+	if mr.Status.Phase != infrav1.RefreshInProgress || len(mr.Status.Failed) != 0 {
+		t.Fatalf("status = %+v, want the refresh resumed", mr.Status)
+	}
+	if machines[0].Spec.AMI != "ami-new" {
+		t.Errorf("expected %s to be recreated once the failed machine was deleted", machines[0].Name)
+	}
+}
+
+func TestAWSMachineRefreshCanaryRollback(t *testing.T) {
+	objs := []runtime.Object{
+		newRefresh(&infrav1.CanaryPolicy{Percentage: pointer.Int32Ptr(50)}),
+		newRefreshMachine("a-0", "a", "ami-old"),
+		newRefreshMachine("a-1", "a", "ami-old"),
+		newRefreshMachine("a-2", "a", "ami-old"),
+		newRefreshMachine("a-3", "a", "ami-old"),
+	}
+	c := fake.NewFakeClientWithScheme(newTestScheme(t), objs...)
+	r := &AWSMachineRefreshReconciler{Client: c, Log: log.NullLogger{}}
+
+	mr, machines := reconcileRefresh(t, r)
+	if mr.Status.Phase != infrav1.RefreshCanary || mr.Status.Canary == nil || len(mr.Status.Canary.Machines) != 2 {
+		t.Fatalf("status = %+v, want a canary of two machines", mr.Status)
+	}
+	for i, am := range machines {
+		if canary := i < 2; canary != (am.Spec.AMI == "ami-new") {
+			t.Errorf("machine %s has AMI %s, canary %v", am.Name, am.Spec.AMI, canary)
+		}
+	}
+
+	finishRecreate(t, c, machines)
+	failed := &machines[0]
+	failed.Status.FailureMessage = pointer.StringPtr("instance terminated")
+	if err := c.Status().Update(context.Background(), failed); err != nil {
+		t.Fatal(err)
+	}
+	mr, machines = reconcileRefresh(t, r)
+	if mr.Status.Phase != infrav1.RefreshRolledBack {
+		t.Fatalf("status = %+v, want rolled back", mr.Status)
+	}
+	for _, am := range machines {
+		if am.Spec.AMI != "ami-old" {
+			t.Errorf("machine %s has AMI %s, want the previous AMI", am.Name, am.Spec.AMI)
+		}
+	}
+
+	// a rolled back refresh is not retried with the same AMI
+	_, machines = reconcileRefresh(t, r)
+	for _, am := range machines {
+		if am.Spec.AMI != "ami-old" {
+			t.Errorf("machine %s has AMI %s after rollback", am.Name, am.Spec.AMI)
+		}
+	}
+}
+
+func TestAWSMachineToRefreshes(t *testing.T) {
+	other := newRefresh(nil)
+	other.Name = "other"
+	other.Spec.Selector.MatchLabels = map[string]string{"pool": "b"}
+	c := fake.NewFakeClientWithScheme(newTestScheme(t), newRefresh(nil), other)
+	r := &AWSMachineRefreshReconciler{Client: c, Log: log.NullLogger{}}
+
+	am := newRefreshMachine("a-0", "a", "ami-old")
+	reqs := r.awsMachineToRefreshes(handler.MapObject{Meta: am, Object: am})
+	if len(reqs) != 1 || reqs[0].Name != "refresh" || reqs[0].Namespace != testNamespace {
+		t.Errorf("requests = %v, want the refresh selecting the machine", reqs)
+	}
+}
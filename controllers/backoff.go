@@ -0,0 +1,98 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+var launchesBlockedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mapa_launches_blocked_by_backoff_total",
+	Help: "Number of launches deferred because previous launches of the AWSMachine failed.",
+}, []string{"namespace"})
+
+func init() {
+	metrics.Registry.MustRegister(launchesBlockedTotal)
+}
+
+// launchBackoff returns how long the launch of the machine has to wait
+// after its previous failures. The wait doubles with each failure, starting
+// at LaunchBackoffBase up to LaunchBackoffMax.
+func (r *AWSMachineReconciler) launchBackoff(am *infrav1.AWSMachine) time.Duration {
+	if am.Status.LaunchFailures == 0 || am.Status.LastLaunchFailure == nil || r.LaunchBackoffBase <= 0 {
+		return 0
+	}
+	d := r.LaunchBackoffBase
+	for i := int32(1); i < am.Status.LaunchFailures; i++ {
+		d *= 2
+		if r.LaunchBackoffMax > 0 && d >= r.LaunchBackoffMax {
+			d = r.LaunchBackoffMax
+			break
+		}
+	}
+	return time.Until(am.Status.LastLaunchFailure.Add(d))
+}
+
+// launchBlocked returns a RequeueAfterError if the machine is still backing
+// off from failed launches.
+func (r *AWSMachineReconciler) launchBlocked(am *infrav1.AWSMachine) error {
+	wait := r.launchBackoff(am)
+	if wait <= 0 {
+		return nil
+	}
+	launchesBlockedTotal.WithLabelValues(am.Namespace).Inc()
+	return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: wait}, "machine %q backing off after %d failed launches", am.Name, am.Status.LaunchFailures)
+}
+
+// launchFailed records a failed launch. The machine fails permanently once
+// it used up MaxLaunchAttempts, otherwise a RequeueAfterError for the next
+// attempt is returned.
+func (r *AWSMachineReconciler) launchFailed(am *infrav1.AWSMachine, cause error) error {
+	now := metav1.Now()
+	am.Status.LaunchFailures++
+	am.Status.LastLaunchFailure = &now
+	if r.MaxLaunchAttempts > 0 && am.Status.LaunchFailures >= int32(r.MaxLaunchAttempts) {
+		am.Status.SetFailure(mapierrors.CreateMachineError, fmt.Sprintf("launch failed %d times: %v", am.Status.LaunchFailures, cause))
+		return nil
+	}
+	return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: r.launchBackoff(am)}, "machine %q launch failed: %v", am.Name, cause)
+}
+
+// launchSucceeded resets the failed launches of the machine.
+func launchSucceeded(am *infrav1.AWSMachine) {
+	am.Status.LaunchFailures = 0
+	am.Status.LastLaunchFailure = nil
+}
+
+// throttledDeferral is how long a reconcile waits after AWS requests were
+// still throttled once their retries were used up, instead of being retried
+// with the error backoff of the controller, which starts at milliseconds. It
+// is jittered so that the machines throttled together do not exceed the
+// request rate again together.
+func throttledDeferral() time.Duration {
+	return 10*time.Second + time.Duration(rand.Int63n(int64(20*time.Second)))
+}
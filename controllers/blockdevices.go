@@ -0,0 +1,116 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// volumeSizes are the sizes in GiB EBS volumes of each type may have.
+var volumeSizes = map[string]struct{ min, max int64 }{
+	"standard": {1, 1024},
+	"gp2":      {1, 16384},
+	"gp3":      {1, 16384},
+	"io1":      {4, 16384},
+	"io2":      {4, 65536},
+	"st1":      {125, 16384},
+	"sc1":      {125, 16384},
+}
+
+const (
+	// maxNitroAttachments is how many EBS volumes and network interfaces
+	// can be attached to most Nitro instances together.
+	maxNitroAttachments = 28
+
+	// maxXenVolumes is the most EBS volumes supported on Xen instances.
+	maxXenVolumes = 40
+
+	// maxIO2Size is the largest io2 volume supported without io2 Block
+	// Express, which requires a Nitro instance.
+	maxIO2Size = 16384
+)
+
+// checkBlockDevices validates the block devices of the machine, see
+// validateBlockDevices.
+func checkBlockDevices(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, it *ec2.InstanceTypeInfo) (string, error) {
+	return validateBlockDevices(am, it), nil
+}
+
+// validateBlockDevices returns the first problem with the block devices of
+// the machine that EC2 would otherwise only report when launching the
+// instance: additional volumes without a root volume, unsupported sizes,
+// throughput optimized volumes as root volume, duplicate device names, and,
+// when the instance type info is given, more volumes or larger volumes than
+// the instance type supports.
+func validateBlockDevices(am *infrav1.AWSMachine, it *ec2.InstanceTypeInfo) string {
+	// v1alpha2 additionalVolumes without a rootVolume are converted to an
+	// empty first block device
+	if len(am.Spec.BlockDevices) > 1 && am.Spec.BlockDevices[0] == (infrav1.AWSBlockDeviceMapping{}) {
+		return "blockDevices[0] is the root volume and must not be empty when more block devices are set (spec.additionalVolumes requires spec.rootVolume)"
+	}
+	names := make(map[string]int)
+	for i, b := range am.Spec.BlockDevices {
+		name := awsutil.DeviceName(am.Spec.OSFamily, b, i)
+		if j, ok := names[name]; ok {
+			return fmt.Sprintf("blockDevices[%d] and blockDevices[%d] have the same device name %q", j, i, name)
+		}
+		names[name] = i
+		if b.VolumeType == "" {
+			continue
+		}
+		sizes, ok := volumeSizes[b.VolumeType]
+		if !ok {
+			return fmt.Sprintf("blockDevices[%d] has unknown volume type %q", i, b.VolumeType)
+		}
+		if i == 0 && (b.VolumeType == "st1" || b.VolumeType == "sc1") {
+			return fmt.Sprintf("blockDevices[0] is the root volume, which cannot have volume type %q", b.VolumeType)
+		}
+		if b.VolumeSize != 0 && (b.VolumeSize < sizes.min || b.VolumeSize > sizes.max) {
+			return fmt.Sprintf("blockDevices[%d] of volume type %q must be between %d and %d GiB, got %d GiB",
+				i, b.VolumeType, sizes.min, sizes.max, b.VolumeSize)
+		}
+	}
+	if it == nil || len(am.Spec.BlockDevices) == 0 {
+		return ""
+	}
+	nitro := aws.StringValue(it.Hypervisor) == ec2.InstanceTypeHypervisorNitro
+	max := maxXenVolumes
+	if nitro {
+		interfaces := len(am.Spec.NetworkInterfaceIDs)
+		if interfaces == 0 {
+			interfaces = 1
+		}
+		max = maxNitroAttachments - interfaces
+	}
+	if len(am.Spec.BlockDevices) > max {
+		return fmt.Sprintf("instance type %q supports at most %d EBS volumes, %d requested", am.Spec.InstanceType, max, len(am.Spec.BlockDevices))
+	}
+	for i, b := range am.Spec.BlockDevices {
+		if b.VolumeType == "io2" && b.VolumeSize > maxIO2Size && !nitro {
+			return fmt.Sprintf("blockDevices[%d] is an io2 volume larger than %d GiB, which requires a Nitro instance type, %q is not",
+				i, maxIO2Size, am.Spec.InstanceType)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+func TestValidateBlockDevices(t *testing.T) {
+	cases := []struct {
+		name    string
+		devices []infrav1.AWSBlockDeviceMapping
+		wantMsg bool
+	}{
+		{name: "none"},
+		{name: "root volume of the AMI", devices: []infrav1.AWSBlockDeviceMapping{{}}},
+		{name: "root and additional volume", devices: []infrav1.AWSBlockDeviceMapping{{VolumeSize: 20}, {VolumeSize: 100, VolumeType: "gp3"}}},
+		{name: "additional volume without root volume", devices: []infrav1.AWSBlockDeviceMapping{{}, {VolumeSize: 100, VolumeType: "gp3"}}, wantMsg: true},
+		{name: "throughput optimized root volume", devices: []infrav1.AWSBlockDeviceMapping{{VolumeSize: 500, VolumeType: "st1"}}, wantMsg: true},
+		{name: "same device name", devices: []infrav1.AWSBlockDeviceMapping{{VolumeSize: 20}, {DeviceName: "/dev/xvda"}}, wantMsg: true},
+	}
+	for _, tc := range cases {
+		am := &infrav1.AWSMachine{Spec: infrav1.AWSMachineSpec{BlockDevices: tc.devices}}
+		if msg := validateBlockDevices(am, nil); (msg != "") != tc.wantMsg {
+			t.Errorf("%s: message = %q, want rejected %v", tc.name, msg, tc.wantMsg)
+		}
+	}
+}
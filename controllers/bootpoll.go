@@ -0,0 +1,64 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+const (
+	// bootPollInterval is how soon the state of a just launched instance
+	// is polled.
+	bootPollInterval = 5 * time.Second
+
+	// bootPollMaxInterval is the longest interval between polls of a
+	// booting instance.
+	bootPollMaxInterval = time.Minute
+)
+
+// instanceBooting returns true if the instance of the machine was launched
+// but is not running yet.
+func instanceBooting(am *infrav1.AWSMachine) bool {
+	if am.Spec.ProviderID == nil || !am.Status.Conditions.IsTrue(infrav1.InstanceLaunchedCondition) {
+		return false
+	}
+	return am.Status.InstanceState == "" || am.Status.InstanceState == ec2.InstanceStateNamePending
+}
+
+// bootPollDelay is how long a booting instance waits before its state is
+// polled again, so that status.instanceState follows the instance through
+// its first minutes instead of waiting for the next resync. The interval
+// starts at bootPollInterval and doubles with the time since launch, up to
+// bootPollMaxInterval. Zero is returned once the instance is running.
+func bootPollDelay(am *infrav1.AWSMachine, now time.Time) time.Duration {
+	if !instanceBooting(am) {
+		return 0
+	}
+	elapsed := now.Sub(am.Status.Conditions.Get(infrav1.InstanceLaunchedCondition).LastTransitionTime.Time)
+	interval := bootPollInterval
+	for interval < elapsed && interval < bootPollMaxInterval {
+		interval *= 2
+	}
+	if interval > bootPollMaxInterval {
+		interval = bootPollMaxInterval
+	}
+	return interval
+}
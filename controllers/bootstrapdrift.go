@@ -0,0 +1,158 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	machinev1 "github.com/criticalstack/machine-api/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	"github.com/criticalstack/machine-api-provider-aws/internal"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// recordUserDataHash records the hash of the bootstrap data the instance
+// was launched with.
+func recordUserDataHash(am *infrav1.AWSMachine, data []byte) {
+	if am.Annotations == nil {
+		am.Annotations = make(map[string]string)
+	}
+	am.Annotations[infrav1.UserDataHashAnnotation] = internal.UserDataHash(am.Spec.OSFamily, am.Spec.UserDataFormat, data)
+}
+
+// bootstrapSecretToAWSMachines maps a bootstrap data Secret to the
+// AWSMachines of the Machines whose Config rendered it, so that changed
+// bootstrap data is noticed right away.
+func (r *AWSMachineReconciler) bootstrapSecretToAWSMachines(o handler.MapObject) []ctrl.Request {
+	ctx := context.Background()
+	configs := &machinev1.ConfigList{}
+	if err := r.List(ctx, configs, client.InNamespace(o.Meta.GetNamespace())); err != nil {
+		return nil
+	}
+	names := make(map[string]bool)
+	for _, cfg := range configs.Items {
+		if cfg.Status.DataSecretName != nil && *cfg.Status.DataSecretName == o.Meta.GetName() {
+			names[cfg.Name] = true
+		}
+	}
+	return r.configsToAWSMachines(ctx, o.Meta.GetNamespace(), names)
+}
+
+// configToAWSMachines maps a Config to the AWSMachines of its Machines, so
+// that launches waiting for bootstrap data start as soon as the Config is
+// ready.
+func (r *AWSMachineReconciler) configToAWSMachines(o handler.MapObject) []ctrl.Request {
+	return r.configsToAWSMachines(context.Background(), o.Meta.GetNamespace(), map[string]bool{o.Meta.GetName(): true})
+}
+
+// configsToAWSMachines returns the AWSMachines of the Machines in the
+// namespace whose Config is one of names.
+func (r *AWSMachineReconciler) configsToAWSMachines(ctx context.Context, namespace string, names map[string]bool) []ctrl.Request {
+	if len(names) == 0 {
+		return nil
+	}
+	machines := &machinev1.MachineList{}
+	if err := r.List(ctx, machines, client.InNamespace(namespace)); err != nil {
+		return nil
+	}
+	infraNames := make(map[string]bool)
+	for _, m := range machines.Items {
+		if names[m.Spec.ConfigRef.Name] && m.Spec.InfrastructureRef.Kind == "AWSMachine" {
+			infraNames[m.Spec.InfrastructureRef.Name] = true
+		}
+	}
+	if len(infraNames) == 0 {
+		return nil
+	}
+	return r.awsMachinesUsing(ctx, namespace, func(am *infrav1.AWSMachine) bool {
+		return infraNames[am.Name]
+	})
+}
+
+// reconcileBootstrapDrift sets the BootstrapOutOfDate condition and the
+// bootstrap hash annotation by comparing the user data of the instance with
+// the current bootstrap data of the machine. The user data of instances
+// launched before their hash was recorded is described once.
+func (r *AWSMachineReconciler) reconcileBootstrapDrift(ctx context.Context, am *infrav1.AWSMachine, m *machinev1.Machine) error {
+	if eksBootstrap(am) || isClusterAPIMachine(m) {
+		// the user data is not taken from a Config
+		return nil
+	}
+	cfg := &machinev1.Config{}
+	if err := r.Get(ctx, client.ObjectKey{Name: m.Spec.ConfigRef.Name, Namespace: m.Namespace}, cfg); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !cfg.Status.Ready || cfg.Status.DataSecretName == nil {
+		// new bootstrap data is being rendered
+		return nil
+	}
+	s := &corev1.Secret{}
+	if err := r.Get(ctx, client.ObjectKey{Name: *cfg.Status.DataSecretName, Namespace: m.Namespace}, s); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	data, err := bootstrapData(am, s)
+	if err != nil {
+		return nil
+	}
+	instanceHash, ok := am.Annotations[infrav1.UserDataHashAnnotation]
+	if !ok {
+		p, err := awsutil.ParseProviderID(*am.Spec.ProviderID)
+		if err != nil {
+			return err
+		}
+		awscfg, err := r.awsConfig(ctx, am, p.Region)
+		if err != nil {
+			return err
+		}
+		userData, err := awsutil.DescribeUserData(ctx, awscfg, p.InstanceID)
+		if err != nil {
+			return err
+		}
+		userData, err = internal.DecodeUserData(am.Spec.OSFamily, am.Spec.UserDataFormat, userData)
+		if err != nil {
+			return err
+		}
+		recordUserDataHash(am, userData)
+		instanceHash = am.Annotations[infrav1.UserDataHashAnnotation]
+	}
+	hash := internal.UserDataHash(am.Spec.OSFamily, am.Spec.UserDataFormat, data)
+	metav1.SetMetaDataAnnotation(&am.ObjectMeta, infrav1.BootstrapHashAnnotation, hash)
+	if instanceHash == hash {
+		am.Status.Conditions.Set(infrav1.Condition{
+			Type:   infrav1.BootstrapOutOfDateCondition,
+			Status: corev1.ConditionFalse,
+			Reason: "UpToDate",
+		})
+		return nil
+	}
+	if !am.Status.Conditions.IsTrue(infrav1.BootstrapOutOfDateCondition) {
+		r.Recorder.Eventf(am, corev1.EventTypeNormal, "BootstrapDataChanged", "Bootstrap data of secret %s changed since the instance was launched", s.Name)
+	}
+	am.Status.Conditions.Set(infrav1.Condition{
+		Type:    infrav1.BootstrapOutOfDateCondition,
+		Status:  corev1.ConditionTrue,
+		Reason:  "BootstrapDataChanged",
+		Message: "the bootstrap data of secret " + s.Name + " changed since the instance was launched",
+	})
+	return nil
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/criticalstack/crit/pkg/kubernetes/pki"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	"github.com/criticalstack/machine-api-provider-aws/internal"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// bootstrapTokenGroup is the group crit grants the permissions needed to
+// join to.
+const bootstrapTokenGroup = "system:bootstrappers:crit:default-node-token"
+
+// issueBootstrapToken replaces the join token of the bootstrap data of a
+// machine with a BootstrapTokenTTL with a new bootstrap token, which is
+// created for the launch attempt and expires after the TTL. Expired tokens
+// are removed by the token cleaner of the controller manager. Bootstrap data
+// without a join token, e.g. of control plane machines, is used as is, and
+// bootstrap data that cannot be rewritten is a ConfigurationError.
+func (r *AWSMachineReconciler) issueBootstrapToken(ctx context.Context, am *infrav1.AWSMachine, data []byte) ([]byte, error) {
+	ttl := am.Spec.BootstrapTokenTTL
+	if ttl == nil || ttl.Duration <= 0 {
+		return data, nil
+	}
+	var createErr error
+	data, err := internal.SetBootstrapToken(am.Spec.OSFamily, am.Spec.UserDataFormat, data, func() (string, error) {
+		id, secret := pki.GenerateBootstrapToken()
+		createErr = r.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "bootstrap-token-" + id,
+				Namespace: metav1.NamespaceSystem,
+			},
+			Type: corev1.SecretTypeBootstrapToken,
+			StringData: map[string]string{
+				"token-id":                       id,
+				"token-secret":                   secret,
+				"usage-bootstrap-authentication": "true",
+				"usage-bootstrap-signing":        "true",
+				"auth-extra-groups":              bootstrapTokenGroup,
+				"description":                    fmt.Sprintf("join token of AWSMachine %s/%s", am.Namespace, am.Name),
+				"expiration":                     time.Now().Add(ttl.Duration).UTC().Format(time.RFC3339),
+			},
+		})
+		if createErr != nil {
+			return "", errors.Wrap(createErr, "cannot create bootstrap token")
+		}
+		return id + "." + secret, nil
+	})
+	if err != nil && createErr == nil {
+		return nil, awsutil.NewConfigurationError("%v", err)
+	}
+	return data, err
+}
+
+// encryptBootstrapToken encrypts the join token of the bootstrap data with
+// the BootstrapTokenKMSKeyID of the machine, bound to the machine by the
+// encryption context. Bootstrap data that cannot be encrypted is a
+// ConfigurationError.
+func encryptBootstrapToken(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, region string, data []byte) ([]byte, error) {
+	if am.Spec.BootstrapTokenKMSKeyID == "" {
+		return data, nil
+	}
+	encryptionContext := map[string]string{"machine": am.Namespace + "/" + am.Name}
+	var encryptErr error
+	encrypted, err := internal.EncryptBootstrapToken(am.Spec.OSFamily, am.Spec.UserDataFormat, data, region, encryptionContext, func(token []byte) ([]byte, error) {
+		ciphertext, err := awsutil.Encrypt(ctx, awscfg, am.Spec.BootstrapTokenKMSKeyID, token, encryptionContext)
+		encryptErr = err
+		return ciphertext, err
+	})
+	if err != nil && encryptErr == nil {
+		return nil, awsutil.NewConfigurationError("%v", err)
+	}
+	return encrypted, err
+}
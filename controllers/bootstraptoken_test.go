@@ -0,0 +1,290 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	machinev1 "github.com/criticalstack/machine-api/api/v1alpha1"
+	"github.com/criticalstack/machine-api/util/cloudinit"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	"github.com/criticalstack/machine-api-provider-aws/internal"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// newWorkerBootstrapData returns bootstrap data of a crit worker as
+// rendered by a crit Config, a MIME message with the cloud-config.
+func newWorkerBootstrapData(t *testing.T) []byte {
+	cc := "#cloud-config\nwrite_files:\n- path: /var/lib/crit/config.yaml\n  encoding: b64\n  content: " +
+		base64.StdEncoding.EncodeToString([]byte(testWorkerConfiguration)) + "\nruncmd:\n- crit up --config /var/lib/crit/config.yaml\n"
+	data, err := cloudinit.CreateMessage([]byte(cc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestIssueBootstrapToken(t *testing.T) {
+	cases := []struct {
+		name      string
+		ttl       *metav1.Duration
+		data      []byte
+		issued    bool
+		configErr bool
+	}{
+		{name: "no TTL", data: newWorkerBootstrapData(t)},
+		{name: "worker", ttl: &metav1.Duration{Duration: 15 * time.Minute}, data: newWorkerBootstrapData(t), issued: true},
+		{
+			name: "control plane",
+			ttl:  &metav1.Duration{Duration: 15 * time.Minute},
+			data: []byte("#cloud-config\nwrite_files:\n- path: /var/lib/crit/config.yaml\n  content: |\n    apiVersion: crit.sh/v1alpha2\n    kind: ControlPlaneConfiguration\n"),
+		},
+		{name: "script", ttl: &metav1.Duration{Duration: 15 * time.Minute}, data: []byte("#!/bin/sh\ncrit up\n"), configErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			am := &infrav1.AWSMachine{
+				ObjectMeta: metav1.ObjectMeta{Name: "m", Namespace: testNamespace},
+				Spec:       infrav1.AWSMachineSpec{BootstrapTokenTTL: tc.ttl},
+			}
+			r := newTestAWSMachineReconciler(t)
+
+			data, err := r.issueBootstrapToken(context.Background(), am, tc.data)
+			if tc.configErr {
+				if !awsutil.IsConfigurationError(err) {
+					t.Fatalf("err = %v, want a configuration error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens := &corev1.SecretList{}
+			if err := r.List(context.Background(), tokens, client.InNamespace(metav1.NamespaceSystem)); err != nil {
+				t.Fatal(err)
+			}
+			if !tc.issued {
+				if string(data) != string(tc.data) || len(tokens.Items) != 0 {
+					t.Errorf("data = %q with %d tokens, want it unchanged", data, len(tokens.Items))
+				}
+				return
+			}
+			if len(tokens.Items) != 1 {
+				t.Fatalf("created %d bootstrap tokens, want 1", len(tokens.Items))
+			}
+			token := tokens.Items[0]
+			if token.Type != corev1.SecretTypeBootstrapToken || token.StringData["auth-extra-groups"] != bootstrapTokenGroup {
+				t.Errorf("token = %+v, want a crit bootstrap token", token)
+			}
+			expiration, err := time.Parse(time.RFC3339, token.StringData["expiration"])
+			if err != nil || expiration.After(time.Now().Add(tc.ttl.Duration)) || expiration.Before(time.Now().Add(tc.ttl.Duration-time.Minute)) {
+				t.Errorf("expiration = %q, want the TTL from now", token.StringData["expiration"])
+			}
+			want := "bootstrapToken: " + token.StringData["token-id"] + "." + token.StringData["token-secret"]
+			if !strings.Contains(string(data), want) || strings.Contains(string(data), "abcdef.0123456789abcdef") {
+				t.Errorf("data = %q, want the new token", data)
+			}
+			if !strings.HasPrefix(string(data), "MIME-Version: 1.0") || !strings.Contains(string(data), "crit up --config") {
+				t.Errorf("data = %q, want the MIME message with the rest of the cloud-config", data)
+			}
+		})
+	}
+}
+
+func TestReconcileRetriedLaunchIssuesBootstrapToken(t *testing.T) {
+	ec2 := newMockEC2(t)
+	ec2.responses["DescribeImages"] = "<imagesSet><item><imageId>ami-0123456789abcdef0</imageId><imageState>available</imageState>" +
+		"<architecture>x86_64</architecture><creationDate>2020-01-01T00:00:00.000Z</creationDate><rootDeviceName>/dev/xvda</rootDeviceName></item></imagesSet>"
+	ec2.responses["DescribeSubnets"] = "<subnetSet><item><subnetId>subnet-0123456789abcdef0</subnetId><vpcId>vpc-0123456789abcdef0</vpcId>" +
+		"<availabilityZone>us-east-1a</availabilityZone><state>available</state><availableIpAddressCount>100</availableIpAddressCount>" +
+		"<defaultForAz>true</defaultForAz></item></subnetSet>"
+	ec2.errors["GetServiceQuota"] = "NoSuchResourceException"
+	ec2.errors["RunInstances"] = "InstanceLimitExceeded"
+	objs := newBootstrapObjects(map[string][]byte{"cloud-config": newWorkerBootstrapData(t)})
+	// the bootstrap data was rendered long before the retry
+	objs[2].(*corev1.Secret).CreationTimestamp = metav1.NewTime(time.Now().Add(-48 * time.Hour))
+	am := objs[3].(*infrav1.AWSMachine)
+	am.Spec.BootstrapTokenTTL = &metav1.Duration{Duration: 15 * time.Minute}
+	am.Status.LaunchFailures = 2
+	r := newTestAWSMachineReconciler(t, objs...)
+
+	// every attempt launches with a token of its own, without waiting for
+	// the bootstrap provider
+	tokens := make(map[string]bool)
+	for attempt := 0; attempt < 2; attempt++ {
+		if _, err := reconcileAWSMachine(r, "m"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n := ec2.called("RunInstances"); n != attempt+1 {
+			t.Fatalf("expected %d launches, got %d", attempt+1, n)
+		}
+		encoded, err := base64.StdEncoding.DecodeString(ec2.requests["RunInstances"].Get("UserData"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		userData, err := internal.DecodeUserData(am.Spec.OSFamily, am.Spec.UserDataFormat, encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(userData), "abcdef.0123456789abcdef") {
+			t.Fatalf("attempt %d launched with the token of the Config", attempt)
+		}
+		secrets := &corev1.SecretList{}
+		if err := r.List(context.Background(), secrets, client.InNamespace(metav1.NamespaceSystem)); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range secrets.Items {
+			token := s.StringData["token-id"] + "." + s.StringData["token-secret"]
+			if strings.Contains(string(userData), token) {
+				tokens[token] = true
+			}
+		}
+		if len(tokens) != attempt+1 {
+			t.Fatalf("attempt %d did not launch with a new token", attempt)
+		}
+	}
+	cfg := &machinev1.Config{}
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: "m"}, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Status.Ready || cfg.Status.DataSecretName == nil {
+		t.Errorf("Config status = %+v, want it untouched", cfg.Status)
+	}
+}
+
+const testWorkerConfiguration = `apiVersion: crit.sh/v1alpha2
+kind: WorkerConfiguration
+bootstrapToken: abcdef.0123456789abcdef
+controlPlaneEndpoint:
+  host: 10.0.0.1
+`
+
+func TestEncryptBootstrapToken(t *testing.T) {
+	ciphertext := base64.StdEncoding.EncodeToString([]byte("ciphertext"))
+	cloudConfig := func(content, encoding string) string {
+		return "#cloud-config\nntp:\n  enabled: true\nwrite_files:\n- path: /var/lib/crit/config.yaml\n  encoding: " + encoding +
+			"\n  content: " + content + "\nruncmd:\n- crit up --config /var/lib/crit/config.yaml\n"
+	}
+	cases := []struct {
+		name      string
+		key       string
+		data      string
+		encrypted bool
+		kmsErr    string
+		configErr bool
+	}{
+		{name: "no key", data: cloudConfig(base64.StdEncoding.EncodeToString([]byte(testWorkerConfiguration)), "b64")},
+		{
+			name:      "worker",
+			key:       "alias/bootstrap",
+			data:      cloudConfig(base64.StdEncoding.EncodeToString([]byte(testWorkerConfiguration)), "b64"),
+			encrypted: true,
+		},
+		{
+			name: "control plane",
+			key:  "alias/bootstrap",
+			data: cloudConfig(base64.StdEncoding.EncodeToString([]byte("apiVersion: crit.sh/v1alpha2\nkind: ControlPlaneConfiguration\n")), "b64"),
+		},
+		{name: "script", key: "alias/bootstrap", data: "#!/bin/sh\ncrit up\n", configErr: true},
+		{
+			name:   "access denied",
+			key:    "alias/bootstrap",
+			data:   cloudConfig(base64.StdEncoding.EncodeToString([]byte(testWorkerConfiguration)), "b64"),
+			kmsErr: "AccessDeniedException",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ec2 := newMockEC2(t)
+			ec2.responses["Encrypt"] = `{"CiphertextBlob":"` + ciphertext + `"}`
+			if tc.kmsErr != "" {
+				ec2.errors["Encrypt"] = tc.kmsErr
+			}
+			am := &infrav1.AWSMachine{
+				ObjectMeta: metav1.ObjectMeta{Name: "m", Namespace: testNamespace},
+				Spec:       infrav1.AWSMachineSpec{BootstrapTokenKMSKeyID: tc.key},
+			}
+			awscfg := &aws.Config{Region: aws.String("us-east-1")}
+
+			data, err := encryptBootstrapToken(context.Background(), awscfg, am, "us-east-1", []byte(tc.data))
+			if tc.configErr || tc.kmsErr != "" {
+				if err == nil {
+					t.Fatalf("expected error, got %q", data)
+				}
+				if awsutil.IsConfigurationError(err) != tc.configErr {
+					t.Errorf("configuration error = %v, want %v: %v", !tc.configErr, tc.configErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.encrypted {
+				if string(data) != tc.data {
+					t.Errorf("data = %q, want it unchanged", data)
+				}
+				if n := ec2.called("Encrypt"); n != 0 {
+					t.Errorf("encrypted %d times", n)
+				}
+				return
+			}
+			if strings.Contains(string(data), "abcdef.0123456789abcdef") {
+				t.Fatalf("bootstrap token in user data:\n%s", data)
+			}
+			var cc struct {
+				NTP        map[string]interface{} `json:"ntp"`
+				WriteFiles []struct {
+					Path     string `json:"path"`
+					Content  string `json:"content"`
+					Encoding string `json:"encoding"`
+				} `json:"write_files"`
+				RunCmd []string `json:"runcmd"`
+			}
+			if !strings.HasPrefix(string(data), "#cloud-config\n") {
+				t.Fatalf("data is not a cloud-config:\n%s", data)
+			}
+			if err := yaml.Unmarshal(data, &cc); err != nil {
+				t.Fatal(err)
+			}
+			if cc.NTP["enabled"] != true {
+				t.Errorf("ntp = %v, want it kept", cc.NTP)
+			}
+			if len(cc.WriteFiles) != 2 || cc.WriteFiles[0].Encoding != "" || !strings.Contains(cc.WriteFiles[0].Content, "bootstrapToken: kms-encrypted-bootstrap-token") {
+				t.Fatalf("write_files = %+v, want the WorkerConfiguration without its token", cc.WriteFiles)
+			}
+			if cc.WriteFiles[1].Content != ciphertext || cc.WriteFiles[1].Encoding != "b64" {
+				t.Errorf("write_files = %+v, want the ciphertext", cc.WriteFiles)
+			}
+			if len(cc.RunCmd) != 2 || !strings.Contains(cc.RunCmd[0], "aws kms decrypt") || !strings.Contains(cc.RunCmd[0], "'machine=test/m'") || !strings.HasPrefix(cc.RunCmd[1], "crit up") {
+				t.Errorf("runcmd = %q, want the token decrypted before crit runs", cc.RunCmd)
+			}
+			if !strings.HasPrefix(cc.RunCmd[0], "command -v aws") || !strings.Contains(cc.RunCmd[0], "requires the AWS CLI") {
+				t.Errorf("runcmd[0] = %q, want bootstrap to fail clearly without the AWS CLI", cc.RunCmd[0])
+			}
+		})
+	}
+}
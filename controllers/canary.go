@@ -0,0 +1,178 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+const (
+	defaultCanaryPercentage = 10
+	defaultCanarySoak       = 10 * time.Minute
+	defaultCanaryTimeout    = 30 * time.Minute
+)
+
+// reconcileCanary drives the canary of a refresh, returning true once the
+// remaining machines may be refreshed. Canary machines are recreated with
+// the new AMI and must stay healthy for the soak duration, otherwise they are
+// rolled back to their previous AMI and the refresh stops.
+func (r *AWSMachineRefreshReconciler) reconcileCanary(ctx context.Context, mr *infrav1.AWSMachineRefresh, machines []*infrav1.AWSMachine) (bool, error) {
+	policy := mr.Spec.Canary
+	if policy == nil {
+		return true, nil
+	}
+	cs := mr.Status.Canary
+	if cs == nil || cs.AMI != mr.Spec.AMI {
+		return false, r.startCanary(ctx, mr, machines)
+	}
+	if cs.Passed {
+		return true, nil
+	}
+
+	nodes := &corev1.NodeList{}
+	if err := r.List(ctx, nodes); err != nil {
+		return false, err
+	}
+	ready := make(map[string]bool)
+	for _, n := range nodes.Items {
+		ready[n.Spec.ProviderID] = isNodeReady(&n)
+	}
+	byName := make(map[string]*infrav1.AWSMachine)
+	for _, am := range machines {
+		byName[am.Name] = am
+	}
+
+	healthy := true
+	for _, c := range cs.Machines {
+		am, ok := byName[c.Name]
+		if !ok {
+			return false, r.rollbackCanary(ctx, mr, byName, fmt.Sprintf("canary machine %q was deleted", c.Name))
+		}
+		if am.Status.FailureMessage != nil {
+			return false, r.rollbackCanary(ctx, mr, byName, fmt.Sprintf("canary machine %q failed: %s", c.Name, *am.Status.FailureMessage))
+		}
+		_, pending := am.Annotations[infrav1.RecreateAnnotation]
+		if pending || am.Spec.ProviderID == nil || !am.Status.Ready || !ready[*am.Spec.ProviderID] {
+			healthy = false
+		}
+	}
+
+	now := metav1.Now()
+	switch {
+	case !healthy && cs.SoakStartTime != nil:
+		return false, r.rollbackCanary(ctx, mr, byName, "canary node became unhealthy during the soak period")
+	case !healthy && now.Sub(cs.StartTime.Time) > durationOrDefault(policy.Timeout, defaultCanaryTimeout):
+		return false, r.rollbackCanary(ctx, mr, byName, "canary machines did not become ready in time")
+	case !healthy:
+		return false, nil
+	case cs.SoakStartTime == nil:
+		r.Log.Info("canary machines healthy, starting soak", "awsmachinerefresh", mr.Name)
+		cs.SoakStartTime = &now
+		return false, nil
+	case now.Sub(cs.SoakStartTime.Time) < durationOrDefault(policy.SoakDuration, defaultCanarySoak):
+		return false, nil
+	}
+	r.Log.Info("canary passed, refreshing remaining machines", "awsmachinerefresh", mr.Name)
+	cs.Passed = true
+	return true, nil
+}
+
+// startCanary recreates the canary machines with the new AMI, recording
+// their previous AMI for rollback.
+func (r *AWSMachineRefreshReconciler) startCanary(ctx context.Context, mr *infrav1.AWSMachineRefresh, machines []*infrav1.AWSMachine) error {
+	pct := int32(defaultCanaryPercentage)
+	if mr.Spec.Canary.Percentage != nil {
+		pct = *mr.Spec.Canary.Percentage
+	}
+	n := (int(pct)*len(machines) + 99) / 100
+	if n < 1 {
+		n = 1
+	}
+	cs := &infrav1.CanaryStatus{
+		AMI:       mr.Spec.AMI,
+		Machines:  make([]infrav1.CanaryMachine, 0),
+		StartTime: metav1.Now(),
+	}
+	for _, am := range machines {
+		if len(cs.Machines) >= n {
+			break
+		}
+		if am.Spec.AMI == mr.Spec.AMI {
+			continue
+		}
+		r.Log.Info("recreating canary machine with new AMI", "awsmachine", am.Name, "ami", mr.Spec.AMI)
+		cs.Machines = append(cs.Machines, infrav1.CanaryMachine{Name: am.Name, PreviousAMI: am.Spec.AMI})
+		if err := r.recreate(ctx, am, mr.Spec.AMI, mr.Name); err != nil {
+			return err
+		}
+	}
+	mr.Status.Canary = cs
+	return nil
+}
+
+// rollbackCanary recreates the canary machines with their previous AMI and
+// marks the refresh as rolled back.
+func (r *AWSMachineRefreshReconciler) rollbackCanary(ctx context.Context, mr *infrav1.AWSMachineRefresh, machines map[string]*infrav1.AWSMachine, reason string) error {
+	r.Log.Info("rolling back canary", "awsmachinerefresh", mr.Name, "reason", reason)
+	for _, c := range mr.Status.Canary.Machines {
+		am, ok := machines[c.Name]
+		if !ok || am.Spec.AMI == c.PreviousAMI {
+			continue
+		}
+		if err := r.recreate(ctx, am, c.PreviousAMI, mr.Name); err != nil {
+			return err
+		}
+	}
+	mr.Status.Canary.Message = reason
+	mr.Status.Phase = infrav1.RefreshRolledBack
+	return nil
+}
+
+// recreate requests that the machine be replaced using the given AMI.
+func (r *AWSMachineRefreshReconciler) recreate(ctx context.Context, am *infrav1.AWSMachine, ami, refresh string) error {
+	patchBase := client.MergeFrom(am.DeepCopy())
+	am.Spec.AMI = ami
+	if am.Annotations == nil {
+		am.Annotations = make(map[string]string)
+	}
+	am.Annotations[infrav1.RecreateAnnotation] = refresh
+	return r.Patch(ctx, am, patchBase)
+}
+
+func isNodeReady(n *corev1.Node) bool {
+	for _, c := range n.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func durationOrDefault(d *metav1.Duration, def time.Duration) time.Duration {
+	if d == nil {
+		return def
+	}
+	return d.Duration
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	machinev1 "github.com/criticalstack/machine-api/api/v1alpha1"
+	"github.com/criticalstack/machine-api/util"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// clusterAPIGroup is the API group of the upstream Cluster API, whose
+// Machines may own AWSMachines in Cluster API contract mode.
+const clusterAPIGroup = "cluster.x-k8s.io"
+
+// clusterAPIDataKey is the key of the bootstrap data in the data secret of a
+// Cluster API Machine.
+const clusterAPIDataKey = "value"
+
+// +kubebuilder:rbac:groups=cluster.x-k8s.io,resources=machines,verbs=get;list;watch;delete
+
+// ownerMachine returns the Machine owning the AWSMachine, or nil when it is
+// not owned yet. In Cluster API contract mode, AWSMachines owned by an
+// upstream Cluster API Machine are also accepted, see clusterAPIMachine.
+func (r *AWSMachineReconciler) ownerMachine(ctx context.Context, am *infrav1.AWSMachine) (*machinev1.Machine, error) {
+	m, err := util.GetOwnerMachine(ctx, r.Client, am.ObjectMeta)
+	if err != nil || m != nil || !r.ClusterAPIContract {
+		return m, err
+	}
+	for _, ref := range am.OwnerReferences {
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err != nil || gv.Group != clusterAPIGroup || ref.Kind != "Machine" {
+			continue
+		}
+		return clusterAPIMachine(ctx, r.Client, gv.WithKind(ref.Kind), am.Namespace, ref.Name)
+	}
+	return nil, nil
+}
+
+// clusterAPIMachine reads a Cluster API Machine as the Machine of this
+// machine API. Only the fields both APIs share are kept, and the ConfigRef
+// refers to the data secret of the Machine rather than to a Config, since
+// Cluster API bootstrap providers render the bootstrap data themselves. The
+// ConfigRef is empty while the bootstrap data is not ready.
+func clusterAPIMachine(ctx context.Context, c client.Client, gvk schema.GroupVersionKind, namespace, name string) (*machinev1.Machine, error) {
+	u := &unstructured.Unstructured{}
+	u.SetGroupVersionKind(gvk)
+	if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, u); err != nil {
+		return nil, err
+	}
+	m := &machinev1.Machine{
+		TypeMeta: metav1.TypeMeta{APIVersion: u.GetAPIVersion(), Kind: u.GetKind()},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              u.GetName(),
+			Namespace:         u.GetNamespace(),
+			UID:               u.GetUID(),
+			Labels:            u.GetLabels(),
+			Annotations:       u.GetAnnotations(),
+			CreationTimestamp: u.GetCreationTimestamp(),
+			DeletionTimestamp: u.GetDeletionTimestamp(),
+		},
+	}
+	if s, ok, _ := unstructured.NestedString(u.Object, "spec", "providerID"); ok {
+		m.Spec.ProviderID = &s
+	}
+	if s, ok, _ := unstructured.NestedString(u.Object, "spec", "failureDomain"); ok {
+		m.Spec.FailureDomain = &s
+	}
+	if s, ok, _ := unstructured.NestedString(u.Object, "spec", "bootstrap", "dataSecretName"); ok && s != "" {
+		m.Spec.ConfigRef = corev1.ObjectReference{APIVersion: "v1", Kind: "Secret", Namespace: namespace, Name: s}
+	}
+	return m, nil
+}
+
+// isClusterAPIMachine returns true if the Machine was read from the
+// Cluster API, see clusterAPIMachine.
+func isClusterAPIMachine(m *machinev1.Machine) bool {
+	return strings.HasPrefix(m.APIVersion, clusterAPIGroup+"/")
+}
+
+// clusterAPIUserData returns the bootstrap data of a Cluster API Machine
+// whose bootstrap data is ready.
+func (r *AWSMachineReconciler) clusterAPIUserData(ctx context.Context, m *machinev1.Machine) ([]byte, error) {
+	s := &corev1.Secret{}
+	if err := r.Get(ctx, client.ObjectKey{Name: m.Spec.ConfigRef.Name, Namespace: m.Namespace}, s); err != nil {
+		return nil, err
+	}
+	userData, ok := s.Data[clusterAPIDataKey]
+	if !ok {
+		return nil, errors.Errorf("secret %q missing %s", s.Name, clusterAPIDataKey)
+	}
+	return userData, nil
+}
+
+// deleteMachine deletes the Machine owning the AWSMachine, which may be a
+// Cluster API Machine.
+func (r *AWSMachineReconciler) deleteMachine(ctx context.Context, m *machinev1.Machine) error {
+	if !isClusterAPIMachine(m) {
+		return r.Delete(ctx, m)
+	}
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion(m.APIVersion)
+	u.SetKind(m.Kind)
+	u.SetNamespace(m.Namespace)
+	u.SetName(m.Name)
+	return r.Delete(ctx, u)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// reconcileConsole collects the console output and screenshot of the
+// instance into a Secret when requested with the collect-console
+// annotation, which is then removed. This runs before failed machines stop
+// being reconciled, since instances that never join are the ones that need
+// it.
+func (r *AWSMachineReconciler) reconcileConsole(ctx context.Context, am *infrav1.AWSMachine) error {
+	if am.Annotations[infrav1.CollectConsoleAnnotation] != "true" || am.Spec.ProviderID == nil {
+		return nil
+	}
+	p, err := awsutil.ParseProviderID(*am.Spec.ProviderID)
+	if err != nil {
+		return err
+	}
+	awscfg, err := r.awsConfig(ctx, am, p.Region)
+	if err != nil {
+		return err
+	}
+	output, err := awsutil.GetConsoleOutput(ctx, awscfg, p.InstanceID)
+	if err != nil {
+		return err
+	}
+	screenshot, err := awsutil.GetConsoleScreenshot(ctx, awscfg, p.InstanceID)
+	if err != nil {
+		return err
+	}
+
+	// console output can include secrets printed during boot
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      am.Name + "-console",
+			Namespace: am.Namespace,
+		},
+	}
+	if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, s, func() error {
+		s.Data = map[string][]byte{"console-output.txt": []byte(output)}
+		if screenshot != nil {
+			s.Data["screenshot.jpg"] = screenshot
+		}
+		return controllerutil.SetControllerReference(am, s, r.Scheme)
+	}); err != nil {
+		return err
+	}
+
+	statusPatch := client.MergeFrom(am.DeepCopy())
+	am.Status.Console = &infrav1.ConsoleStatus{
+		SecretName:     s.Name,
+		CollectionTime: metav1.Now(),
+	}
+	if err := r.Status().Patch(ctx, am, statusPatch); err != nil {
+		return err
+	}
+	patch := client.MergeFrom(am.DeepCopy())
+	delete(am.Annotations, infrav1.CollectConsoleAnnotation)
+	return r.Patch(ctx, am, patch)
+}
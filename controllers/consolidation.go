@@ -0,0 +1,316 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/criticalstack/machine-api/util"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// defaultUtilizationThreshold is the default percentage of requested
+// resources below which a machine is a consolidation candidate.
+const defaultUtilizationThreshold = 50
+
+// ConsolidationReconciler evaluates the machines of each
+// AWSInfrastructureProvider namespace for consolidation: lightly used
+// machines whose pods fit on the other machines are recommended for removal
+// and, if the provider allows it, removed one at a time.
+type ConsolidationReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Recorder record.EventRecorder
+
+	// WatchFilter restricts the controller to objects with matching labels.
+	WatchFilter labels.Selector
+
+	// Interval is how often each namespace is evaluated.
+	Interval time.Duration
+}
+
+func (r *ConsolidationReconciler) SetupWithManager(mgr ctrl.Manager, options controller.Options) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("consolidation").
+		For(&infrav1.AWSInfrastructureProvider{}, builder.WithPredicates(watchFilterPredicate(r.WatchFilter))).
+		WithOptions(options).
+		Complete(r)
+}
+
+// +kubebuilder:rbac:groups=infrastructure.crit.sh,resources=awsinfrastructureproviders/status,verbs=patch
+// +kubebuilder:rbac:groups=machine.crit.sh,resources=machines,verbs=delete
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+
+func (r *ConsolidationReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	ctx := context.Background()
+	log := r.Log.WithValues("awsinfrastructureprovider", req.NamespacedName)
+
+	ip := &infrav1.AWSInfrastructureProvider{}
+	if err := r.Get(ctx, req.NamespacedName, ip); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	if last := ip.Status.Consolidation; last != nil && time.Since(last.LastEvaluated.Time) < r.Interval {
+		return ctrl.Result{RequeueAfter: r.Interval - time.Since(last.LastEvaluated.Time)}, nil
+	}
+	cfg := ip.Spec.Consolidation
+	if cfg == nil {
+		cfg = &infrav1.Consolidation{}
+	}
+	threshold := int32(defaultUtilizationThreshold)
+	if cfg.UtilizationThreshold != nil {
+		threshold = *cfg.UtilizationThreshold
+	}
+
+	machines := &infrav1.AWSMachineList{}
+	if err := r.List(ctx, machines, client.InNamespace(ip.Namespace)); err != nil {
+		return ctrl.Result{}, err
+	}
+	nodes := &corev1.NodeList{}
+	if err := r.List(ctx, nodes); err != nil {
+		return ctrl.Result{}, err
+	}
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods); err != nil {
+		return ctrl.Result{}, err
+	}
+	recs, byName := consolidate(machines.Items, nodes.Items, pods.Items, threshold)
+
+	patch := client.MergeFrom(ip.DeepCopy())
+	ip.Status.Consolidation = &infrav1.ConsolidationStatus{
+		LastEvaluated:   metav1.Now(),
+		Recommendations: recs,
+	}
+	if err := r.Status().Patch(ctx, ip, patch); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.reconcileDeletePriorities(ctx, cfg.DeletePriority, machines.Items, nodes.Items, pods.Items); err != nil {
+		return ctrl.Result{}, err
+	}
+	for _, rec := range recs {
+		r.Recorder.Eventf(byName[rec.AWSMachine], corev1.EventTypeNormal, "ConsolidationCandidate",
+			"Node %s requests %d%% CPU and %d%% memory, its pods fit on other machines", rec.Node, rec.CPUUtilization, rec.MemoryUtilization)
+	}
+	if cfg.DeleteMachines && len(recs) != 0 && !deleting(machines.Items) {
+		am := byName[recs[0].AWSMachine]
+		m, err := util.GetOwnerMachine(ctx, r.Client, am.ObjectMeta)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if m != nil {
+			log.Info("deleting machine to consolidate", "machine", m.Name, "awsmachine", am.Name)
+			r.Recorder.Eventf(am, corev1.EventTypeNormal, "Consolidating", "Deleting machine %s", m.Name)
+			if err := r.Delete(ctx, m); client.IgnoreNotFound(err) != nil {
+				return ctrl.Result{}, err
+			}
+		}
+	}
+	return ctrl.Result{RequeueAfter: r.Interval}, nil
+}
+
+// deleting returns true if any of the machines is being deleted, in which
+// case no further machines are removed until it is gone.
+func deleting(machines []infrav1.AWSMachine) bool {
+	for i := range machines {
+		if !machines[i].DeletionTimestamp.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeUsage is the resources of a node requested by its pods.
+type nodeUsage struct {
+	am   *infrav1.AWSMachine
+	node *corev1.Node
+
+	// pods are the requests of the pods that would move if the node was
+	// removed.
+	pods []podRequests
+
+	// free is the allocatable capacity not requested by any pod.
+	free podRequests
+
+	cpuPercent, memPercent int32
+}
+
+type podRequests struct {
+	cpu, memory int64
+}
+
+// consolidate returns the machines whose pods can be placed on the free
+// capacity of the remaining machines, least utilized first, as well as the
+// considered machines by name. Nodes that take pods of a removed node are
+// kept.
+func consolidate(machines []infrav1.AWSMachine, nodes []corev1.Node, pods []corev1.Pod, threshold int32) ([]infrav1.ConsolidationRecommendation, map[string]*infrav1.AWSMachine) {
+	usages := nodeUsages(machines, nodes, pods)
+	byName := make(map[string]*infrav1.AWSMachine)
+	for _, u := range usages {
+		byName[u.am.Name] = u.am
+	}
+	sort.SliceStable(usages, func(i, j int) bool {
+		return max32(usages[i].cpuPercent, usages[i].memPercent) < max32(usages[j].cpuPercent, usages[j].memPercent)
+	})
+
+	recs := make([]infrav1.ConsolidationRecommendation, 0)
+	removed := make(map[*nodeUsage]bool)
+	kept := make(map[*nodeUsage]bool)
+	for _, u := range usages {
+		if kept[u] || max32(u.cpuPercent, u.memPercent) >= threshold {
+			continue
+		}
+		targets := make([]*nodeUsage, 0)
+		for _, t := range usages {
+			if t != u && !removed[t] {
+				targets = append(targets, t)
+			}
+		}
+		placed, ok := place(u.pods, targets)
+		if !ok {
+			continue
+		}
+		for t, req := range placed {
+			t.free.cpu -= req.cpu
+			t.free.memory -= req.memory
+			kept[t] = true
+		}
+		removed[u] = true
+		recs = append(recs, infrav1.ConsolidationRecommendation{
+			AWSMachine:        u.am.Name,
+			Node:              u.node.Name,
+			InstanceType:      u.am.Spec.InstanceType,
+			CPUUtilization:    u.cpuPercent,
+			MemoryUtilization: u.memPercent,
+		})
+	}
+	return recs, byName
+}
+
+// nodeUsages returns the resources requested on the schedulable nodes of
+// the ready machines that are not being deleted.
+func nodeUsages(machines []infrav1.AWSMachine, nodes []corev1.Node, pods []corev1.Pod) []*nodeUsage {
+	byProviderID := make(map[string]*corev1.Node)
+	for i := range nodes {
+		byProviderID[nodes[i].Spec.ProviderID] = &nodes[i]
+	}
+	usages := make([]*nodeUsage, 0)
+	byNode := make(map[string]*nodeUsage)
+	for i := range machines {
+		am := &machines[i]
+		if am.Spec.ProviderID == nil || !am.Status.Ready || !am.DeletionTimestamp.IsZero() || isExternallyManaged(am) {
+			continue
+		}
+		n, ok := byProviderID[*am.Spec.ProviderID]
+		if !ok || n.Spec.Unschedulable {
+			continue
+		}
+		u := &nodeUsage{
+			am:   am,
+			node: n,
+			free: podRequests{
+				cpu:    n.Status.Allocatable.Cpu().MilliValue(),
+				memory: n.Status.Allocatable.Memory().Value(),
+			},
+		}
+		usages = append(usages, u)
+		byNode[n.Name] = u
+	}
+	for i := range pods {
+		pod := &pods[i]
+		u, ok := byNode[pod.Spec.NodeName]
+		if !ok || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		req := requestsOf(pod)
+		u.free.cpu -= req.cpu
+		u.free.memory -= req.memory
+		if isEvictable(pod) {
+			u.pods = append(u.pods, req)
+		}
+	}
+	for _, u := range usages {
+		u.cpuPercent = percentUsed(u.free.cpu, u.node.Status.Allocatable.Cpu().MilliValue())
+		u.memPercent = percentUsed(u.free.memory, u.node.Status.Allocatable.Memory().Value())
+	}
+	return usages
+}
+
+// place assigns the pods, largest first, to the first target with enough
+// free capacity. It returns the requests added to each target, or false if
+// a pod does not fit anywhere.
+func place(pods []podRequests, targets []*nodeUsage) (map[*nodeUsage]podRequests, bool) {
+	pods = append([]podRequests(nil), pods...)
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].cpu > pods[j].cpu
+	})
+	placed := make(map[*nodeUsage]podRequests)
+	for _, pod := range pods {
+		fits := false
+		for _, t := range targets {
+			p := placed[t]
+			if t.free.cpu-p.cpu >= pod.cpu && t.free.memory-p.memory >= pod.memory {
+				placed[t] = podRequests{cpu: p.cpu + pod.cpu, memory: p.memory + pod.memory}
+				fits = true
+				break
+			}
+		}
+		if !fits {
+			return nil, false
+		}
+	}
+	return placed, true
+}
+
+// requestsOf returns the CPU and memory requested by the containers of the
+// pod.
+func requestsOf(pod *corev1.Pod) podRequests {
+	var req podRequests
+	for _, c := range pod.Spec.Containers {
+		req.cpu += c.Resources.Requests.Cpu().MilliValue()
+		req.memory += c.Resources.Requests.Memory().Value()
+	}
+	return req
+}
+
+func percentUsed(free, allocatable int64) int32 {
+	if allocatable <= 0 {
+		return 100
+	}
+	return int32((allocatable - free) * 100 / allocatable)
+}
+
+func max32(a, b int32) int32 {
+	if a > b {
+		return a
+	}
+	return b
+}
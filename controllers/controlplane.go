@@ -0,0 +1,116 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+func isControlPlane(am *infrav1.AWSMachine) bool {
+	_, ok := am.Labels[infrav1.ControlPlaneLabelName]
+	return ok
+}
+
+// controlPlaneZone returns the availability zone with the fewest healthy
+// control plane machines in the namespace of am, other than am itself. Only
+// zones of the subnets of am are considered when it sets SubnetIDs. Ties are
+// broken by zone name so that the choice is stable.
+func (r *AWSMachineReconciler) controlPlaneZone(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine) (string, error) {
+	var zones []string
+	if len(am.Spec.SubnetIDs) != 0 {
+		for _, id := range am.Spec.SubnetIDs {
+			subnet, err := awsutil.DescribeSubnet(ctx, awscfg, id)
+			if err != nil {
+				return "", err
+			}
+			zones = append(zones, aws.StringValue(subnet.AvailabilityZone))
+		}
+	} else {
+		var err error
+		zones, err = awsutil.AvailableZones(ctx, awscfg)
+		if err != nil {
+			return "", err
+		}
+	}
+	machines := &infrav1.AWSMachineList{}
+	if err := r.List(ctx, machines, client.InNamespace(am.Namespace), client.HasLabels{infrav1.ControlPlaneLabelName}); err != nil {
+		return "", err
+	}
+	counts := make(map[string]int)
+	for i := range machines.Items {
+		m := &machines.Items[i]
+		if m.UID == am.UID || !m.DeletionTimestamp.IsZero() || m.Status.FailureMessage != nil {
+			continue
+		}
+		zone := m.Status.AvailabilityZone
+		if zone == "" {
+			zone = m.Spec.AvailabilityZone
+		}
+		counts[zone]++
+	}
+	best := ""
+	for _, zone := range zones {
+		if best == "" || counts[zone] < counts[best] || (counts[zone] == counts[best] && zone < best) {
+			best = zone
+		}
+	}
+	return best, nil
+}
+
+// placeControlPlane sets the availability zone of a control plane machine
+// that has none to the zone with the fewest control plane machines.
+func (r *AWSMachineReconciler) placeControlPlane(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine) error {
+	if !isControlPlane(am) || am.Spec.AvailabilityZone != "" || len(am.Spec.NetworkInterfaceIDs) != 0 {
+		return nil
+	}
+	zone, err := r.controlPlaneZone(ctx, awscfg, am)
+	if err != nil || zone == "" {
+		return err
+	}
+	r.Log.Info("placing control plane machine", "awsmachine", am.Name, "availabilityZone", zone)
+	am.Spec.AvailabilityZone = zone
+	return nil
+}
+
+// reconcileReplacementZone annotates a failed control plane machine with the
+// zone its replacement should be placed in, for the controller replacing
+// it. The zone is only determined once.
+func (r *AWSMachineReconciler) reconcileReplacementZone(ctx context.Context, am *infrav1.AWSMachine) error {
+	if !isControlPlane(am) || am.Status.Region == "" || am.Annotations[infrav1.ReplacementZoneAnnotation] != "" {
+		return nil
+	}
+	awscfg, err := r.awsConfig(ctx, am, am.Status.Region)
+	if err != nil {
+		return err
+	}
+	zone, err := r.controlPlaneZone(ctx, awscfg, am)
+	if err != nil || zone == "" {
+		return err
+	}
+	patch := client.MergeFrom(am.DeepCopy())
+	if am.Annotations == nil {
+		am.Annotations = make(map[string]string)
+	}
+	am.Annotations[infrav1.ReplacementZoneAnnotation] = zone
+	return r.Patch(ctx, am, patch)
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+	"github.com/criticalstack/machine-api-provider-aws/internal/pricing"
+)
+
+var (
+	machineHourlyCost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mapa_machine_hourly_cost_dollars",
+		Help: "Estimated on-demand cost per hour in USD of an AWSMachine.",
+	}, []string{"namespace", "awsmachine", "instance_type"})
+	machineAccumulatedCost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mapa_machine_accumulated_cost_dollars",
+		Help: "Estimated on-demand cost in USD of an AWSMachine since launch.",
+	}, []string{"namespace", "awsmachine"})
+	clusterHourlyCost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mapa_cluster_hourly_cost_dollars",
+		Help: "Estimated on-demand cost per hour in USD of all AWSMachines of a cluster namespace.",
+	}, []string{"namespace"})
+	clusterAccumulatedCost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mapa_cluster_accumulated_cost_dollars",
+		Help: "Estimated on-demand cost in USD of the existing AWSMachines of a cluster namespace since launch.",
+	}, []string{"namespace"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(machineHourlyCost, machineAccumulatedCost, clusterHourlyCost, clusterAccumulatedCost)
+}
+
+// machineCost is the last cost reported for a machine.
+type machineCost struct {
+	hourly      float64
+	accumulated float64
+}
+
+// costs keeps the per-machine costs of each namespace to report the cluster
+// totals.
+var costs = struct {
+	sync.Mutex
+	byNamespace map[string]map[types.UID]machineCost
+}{byNamespace: make(map[string]map[types.UID]machineCost)}
+
+// reconcileCost records the estimated hourly cost of the machine. Failing to
+// estimate the cost is not an error.
+func (r *AWSMachineReconciler) reconcileCost(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine) {
+	p, err := getProvider(ctx, r.Client, am.Namespace)
+	if err != nil {
+		return
+	}
+	price, err := pricing.ForProvider(awscfg, p).HourlyPrice(ctx, aws.StringValue(awscfg.Region), am.Spec.InstanceType, am.Spec.OSFamily)
+	if err != nil {
+		r.Log.V(1).Info("cannot estimate machine cost", "error", err.Error())
+		return
+	}
+	accrueCost(am, metav1.Now())
+	am.Status.EstimatedHourlyCost = strconv.FormatFloat(price, 'f', -1, 64)
+	setCostMetrics(am)
+}
+
+// refreshCost updates the hourly cost of a running machine with the current
+// price and accrues its accumulated cost.
+func (r *AWSMachineReconciler) refreshCost(ctx context.Context, am *infrav1.AWSMachine) {
+	p, err := awsutil.ParseProviderID(*am.Spec.ProviderID)
+	if err != nil {
+		return
+	}
+	awscfg, err := r.awsConfig(ctx, am, p.Region)
+	if err != nil {
+		return
+	}
+	r.reconcileCost(ctx, awscfg, am)
+}
+
+// accrueCost adds the cost since the last accrual at the previously recorded
+// hourly cost to the accumulated cost. Machines without a prior accrual accrue
+// from their creation.
+func accrueCost(am *infrav1.AWSMachine, now metav1.Time) {
+	last := am.Status.CostLastUpdated
+	if last == nil {
+		last = &am.CreationTimestamp
+	}
+	hourly, _ := strconv.ParseFloat(am.Status.EstimatedHourlyCost, 64)
+	accumulated, _ := strconv.ParseFloat(am.Status.AccumulatedCost, 64)
+	if elapsed := now.Sub(last.Time); elapsed > 0 && !last.IsZero() {
+		accumulated += hourly * elapsed.Hours()
+	}
+	am.Status.AccumulatedCost = strconv.FormatFloat(accumulated, 'f', 4, 64)
+	am.Status.CostLastUpdated = &now
+}
+
+func setCostMetrics(am *infrav1.AWSMachine) {
+	hourly, _ := strconv.ParseFloat(am.Status.EstimatedHourlyCost, 64)
+	accumulated, _ := strconv.ParseFloat(am.Status.AccumulatedCost, 64)
+	machineHourlyCost.WithLabelValues(am.Namespace, am.Name, am.Spec.InstanceType).Set(hourly)
+	machineAccumulatedCost.WithLabelValues(am.Namespace, am.Name).Set(accumulated)
+
+	costs.Lock()
+	defer costs.Unlock()
+	machines, ok := costs.byNamespace[am.Namespace]
+	if !ok {
+		machines = make(map[types.UID]machineCost)
+		costs.byNamespace[am.Namespace] = machines
+	}
+	machines[am.UID] = machineCost{hourly: hourly, accumulated: accumulated}
+	setClusterCostMetrics(am.Namespace, machines)
+}
+
+func deleteCostMetrics(am *infrav1.AWSMachine) {
+	machineHourlyCost.DeleteLabelValues(am.Namespace, am.Name, am.Spec.InstanceType)
+	machineAccumulatedCost.DeleteLabelValues(am.Namespace, am.Name)
+
+	costs.Lock()
+	defer costs.Unlock()
+	machines := costs.byNamespace[am.Namespace]
+	delete(machines, am.UID)
+	if len(machines) == 0 {
+		delete(costs.byNamespace, am.Namespace)
+		clusterHourlyCost.DeleteLabelValues(am.Namespace)
+		clusterAccumulatedCost.DeleteLabelValues(am.Namespace)
+		return
+	}
+	setClusterCostMetrics(am.Namespace, machines)
+}
+
+func setClusterCostMetrics(ns string, machines map[types.UID]machineCost) {
+	var hourly, accumulated float64
+	for _, c := range machines {
+		hourly += c.hourly
+		accumulated += c.accumulated
+	}
+	clusterHourlyCost.WithLabelValues(ns).Set(hourly)
+	clusterAccumulatedCost.WithLabelValues(ns).Set(accumulated)
+}
@@ -0,0 +1,367 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// credentialsBackoff is how long reconciles are delayed after AWS rejects
+// the credentials, giving them time to be refreshed instead of retrying
+// with the usual error backoff.
+const credentialsBackoff = 5 * time.Minute
+
+// setCredentialsCondition updates the CredentialsValid condition from the
+// error of an AWS operation, returning true if the credentials were
+// rejected. The condition only becomes true again once it had been false and
+// an operation succeeds.
+func setCredentialsCondition(conditions *infrav1.Conditions, err error) bool {
+	if awsutil.IsCredentialError(err) {
+		awsutil.RecordCredentialError(err)
+		reason := "CredentialsRejected"
+		if aerr, ok := errors.Cause(err).(awserr.Error); ok {
+			reason = aerr.Code()
+		}
+		conditions.Set(infrav1.Condition{
+			Type:    infrav1.CredentialsValidCondition,
+			Status:  corev1.ConditionFalse,
+			Reason:  reason,
+			Message: err.Error(),
+		})
+		return true
+	}
+	if err == nil && conditions.IsFalse(infrav1.CredentialsValidCondition) {
+		conditions.Set(infrav1.Condition{
+			Type:   infrav1.CredentialsValidCondition,
+			Status: corev1.ConditionTrue,
+			Reason: "CredentialsAccepted",
+		})
+	}
+	return false
+}
+
+// reconcileCredentialOutage sets the CredentialOutage condition of the
+// provider while the credentials of its namespace are being rejected,
+// recording an event when an outage starts and ends. The requests of the
+// provider itself probe whether the outage has ended.
+func (r *AWSInfrastructureProviderReconciler) reconcileCredentialOutage(ip *infrav1.AWSInfrastructureProvider) {
+	degraded, since := awsutil.CredentialOutages.Degraded(ip.Namespace)
+	cond := ip.Status.Conditions.Get(infrav1.CredentialOutageCondition)
+	switch {
+	case degraded && (cond == nil || cond.Status != corev1.ConditionTrue):
+		ip.Status.Conditions.Set(infrav1.Condition{
+			Type:    infrav1.CredentialOutageCondition,
+			Status:  corev1.ConditionTrue,
+			Reason:  "CredentialsRejected",
+			Message: fmt.Sprintf("AWS has been rejecting credentials since %s, launches and terminations are paused", since.UTC().Format(time.RFC3339)),
+		})
+		r.Recorder.Eventf(ip, corev1.EventTypeWarning, "CredentialOutage", "AWS has been rejecting credentials since %s, pausing launches and terminations", since.UTC().Format(time.RFC3339))
+	case !degraded && cond != nil && cond.Status == corev1.ConditionTrue:
+		ip.Status.Conditions.Set(infrav1.Condition{
+			Type:   infrav1.CredentialOutageCondition,
+			Status: corev1.ConditionFalse,
+			Reason: "CredentialsAccepted",
+		})
+		r.Recorder.Eventf(ip, corev1.EventTypeNormal, "CredentialOutageEnded", "AWS accepts credentials again, resuming launches and terminations")
+	}
+}
+
+// awsConfig returns the configuration for AWS requests made for the machine
+// in the region, using the credentials of its AWSCredentials or SecretRef.
+// The credentials of the controller are used when neither is set.
+func (r *AWSMachineReconciler) awsConfig(ctx context.Context, am *infrav1.AWSMachine, region string) (*aws.Config, error) {
+	awscfg := &aws.Config{Region: aws.String(region)}
+	switch {
+	case am.Spec.CredentialsRef != nil:
+		creds, err := resolveCredentials(ctx, r.Client, am.Namespace, am.Spec.CredentialsRef.Name, region)
+		if err != nil {
+			return nil, err
+		}
+		awscfg.Credentials = creds
+	case am.Spec.SecretRef != nil:
+		namespace, err := secretRefNamespace(ctx, r.Client, am)
+		if err != nil {
+			return nil, err
+		}
+		s := &corev1.Secret{}
+		if err := r.Get(ctx, client.ObjectKey{Name: am.Spec.SecretRef.Name, Namespace: namespace}, s); err != nil {
+			return nil, err
+		}
+		awscfg.Credentials = staticCredentials(s)
+	}
+	return awscfg, nil
+}
+
+// secretRefNamespace returns the namespace of the SecretRef of the machine.
+// A ConfigurationError is returned for Secrets in other namespaces unless
+// the AWSInfrastructureProvider of their namespace shares them with the
+// namespace of the machine, so that machines cannot use the credentials of
+// other tenants by naming their Secrets.
+func secretRefNamespace(ctx context.Context, c client.Client, am *infrav1.AWSMachine) (string, error) {
+	ref := am.Spec.SecretRef
+	if ref.Namespace == "" || ref.Namespace == am.Namespace {
+		return am.Namespace, nil
+	}
+	ip, err := getProvider(ctx, c, ref.Namespace)
+	if err != nil {
+		return "", err
+	}
+	if ip != nil {
+		for _, shared := range ip.Spec.SharedCredentials {
+			if shared.SecretName == ref.Name && containsString(shared.Namespaces, am.Namespace) {
+				return ref.Namespace, nil
+			}
+		}
+	}
+	return "", awsutil.NewConfigurationError("secret %s/%s is not shared with namespace %s", ref.Namespace, ref.Name, am.Namespace)
+}
+
+// resolveCredentials returns the credentials described by the named
+// AWSCredentials, see checkCredentialRoles. Credentials are cached so that
+// assumed roles are reused until they expire, and rebuilt once the
+// AWSCredentials or its Secret changes, e.g. when keys are rotated.
+func resolveCredentials(ctx context.Context, c client.Client, namespace, name, region string) (*credentials.Credentials, error) {
+	ac := &infrav1.AWSCredentials{}
+	if err := c.Get(ctx, client.ObjectKey{Name: name, Namespace: namespace}, ac); err != nil {
+		return nil, err
+	}
+	if err := checkCredentialRoles(ctx, c, ac); err != nil {
+		return nil, err
+	}
+	version := ac.ResourceVersion
+	var s *corev1.Secret
+	if ac.Spec.SecretRef != nil {
+		s = &corev1.Secret{}
+		if err := c.Get(ctx, client.ObjectKey{Name: ac.Spec.SecretRef.Name, Namespace: namespace}, s); err != nil {
+			return nil, err
+		}
+		version += "/" + s.ResourceVersion
+	}
+	key := credentialsKey{namespace: namespace, name: name, region: region}
+	if creds := credentialsCache.get(key, version); creds != nil {
+		return creds, nil
+	}
+	var base *credentials.Credentials
+	if s != nil {
+		base = staticCredentials(s)
+		if base == nil {
+			return nil, errors.Errorf("secret %q missing AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY", s.Name)
+		}
+	}
+	creds := awsutil.NewCredentials(region, base, ac)
+	credentialsCache.set(key, version, creds)
+	return creds, nil
+}
+
+// checkCredentialRoles returns a ConfigurationError for AWSCredentials
+// assuming roles or reading web identity token files that are not in the
+// CredentialRoles of the provider of their namespace, so that tenants cannot
+// use the roles of other tenants by naming them.
+func checkCredentialRoles(ctx context.Context, c client.Client, ac *infrav1.AWSCredentials) error {
+	if ac.Spec.WebIdentity == nil && len(ac.Spec.AssumeRoles) == 0 {
+		return nil
+	}
+	ip, err := getProvider(ctx, c, ac.Namespace)
+	if err != nil {
+		return err
+	}
+	allowed := &infrav1.CredentialRoles{}
+	if ip != nil && ip.Spec.CredentialRoles != nil {
+		allowed = ip.Spec.CredentialRoles
+	}
+	roles := make([]string, 0)
+	if wi := ac.Spec.WebIdentity; wi != nil {
+		if wi.TokenFile != "" && !containsString(allowed.TokenFiles, wi.TokenFile) {
+			return awsutil.NewConfigurationError("web identity token file %s is not allowed in namespace %s", wi.TokenFile, ac.Namespace)
+		}
+		roles = append(roles, wi.RoleARN)
+	}
+	for _, role := range ac.Spec.AssumeRoles {
+		roles = append(roles, role.RoleARN)
+	}
+	for _, role := range roles {
+		if !roleAllowed(allowed.RoleARNs, role) {
+			return awsutil.NewConfigurationError("role %s is not allowed in namespace %s", role, ac.Namespace)
+		}
+	}
+	return nil
+}
+
+// roleAllowed returns true if the role matches one of the allowed ARNs,
+// which match the roles they are a prefix of when ending in *.
+func roleAllowed(allowed []string, role string) bool {
+	for _, arn := range allowed {
+		if arn == role || (strings.HasSuffix(arn, "*") && strings.HasPrefix(role, strings.TrimSuffix(arn, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+type credentialsKey struct {
+	namespace, name, region string
+}
+
+type cachedCredentials struct {
+	version string
+	creds   *credentials.Credentials
+}
+
+// credentialsCache holds the credentials built for AWSCredentials, keyed by
+// the resource versions of the objects they were built from.
+var credentialsCache = &credentialsStore{entries: make(map[credentialsKey]cachedCredentials)}
+
+type credentialsStore struct {
+	mu      sync.Mutex
+	entries map[credentialsKey]cachedCredentials
+}
+
+// get returns the cached credentials, or nil if there are none for the
+// version.
+func (s *credentialsStore) get(key credentialsKey, version string) *credentials.Credentials {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok || e.version != version {
+		return nil
+	}
+	return e.creds
+}
+
+func (s *credentialsStore) set(key credentialsKey, version string, creds *credentials.Credentials) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok && e.version != version {
+		e.creds.Expire()
+	}
+	s.entries[key] = cachedCredentials{version: version, creds: creds}
+}
+
+// invalidate drops the cached credentials of the AWSCredentials in all
+// regions.
+func (s *credentialsStore) invalidate(namespace, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, e := range s.entries {
+		if key.namespace == namespace && key.name == name {
+			e.creds.Expire()
+			delete(s.entries, key)
+		}
+	}
+}
+
+// staticCredentials returns the keys stored in the secret, or nil if they are
+// missing.
+func staticCredentials(s *corev1.Secret) *credentials.Credentials {
+	id := string(s.Data["AWS_ACCESS_KEY_ID"])
+	secret := string(s.Data["AWS_SECRET_ACCESS_KEY"])
+	if id == "" || secret == "" {
+		return nil
+	}
+	return credentials.NewStaticCredentials(id, secret, string(s.Data["AWS_SESSION_TOKEN"]))
+}
+
+// deleteAWSConfig is awsConfig for deleting machines. Failing to resolve the
+// credentials requeues the deletion instead of releasing the machine, since
+// the instance could otherwise be left running.
+func (r *AWSMachineReconciler) deleteAWSConfig(ctx context.Context, am *infrav1.AWSMachine, region string) (*aws.Config, error) {
+	awscfg, err := r.awsConfig(ctx, am, region)
+	if err != nil {
+		return nil, errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: 30 * time.Second}, "cannot resolve credentials: %v", err)
+	}
+	return awscfg, nil
+}
+
+// secretToAWSMachines maps a Secret to the AWSMachines using it for
+// credentials, directly or through an AWSCredentials, including machines in
+// the namespaces it is shared with, so that rotated keys are used right
+// away.
+func (r *AWSMachineReconciler) secretToAWSMachines(o handler.MapObject) []ctrl.Request {
+	ctx := context.Background()
+	creds := &infrav1.AWSCredentialsList{}
+	if err := r.List(ctx, creds, client.InNamespace(o.Meta.GetNamespace())); err != nil {
+		return nil
+	}
+	names := make(map[string]bool)
+	for _, ac := range creds.Items {
+		if ac.Spec.SecretRef != nil && ac.Spec.SecretRef.Name == o.Meta.GetName() {
+			names[ac.Name] = true
+		}
+	}
+	reqs := r.awsMachinesUsing(ctx, o.Meta.GetNamespace(), func(am *infrav1.AWSMachine) bool {
+		if am.Spec.CredentialsRef != nil {
+			return names[am.Spec.CredentialsRef.Name]
+		}
+		return am.Spec.SecretRef != nil && am.Spec.SecretRef.Name == o.Meta.GetName() &&
+			(am.Spec.SecretRef.Namespace == "" || am.Spec.SecretRef.Namespace == am.Namespace)
+	})
+	ip, err := getProvider(ctx, r.Client, o.Meta.GetNamespace())
+	if err != nil || ip == nil {
+		return reqs
+	}
+	for _, shared := range ip.Spec.SharedCredentials {
+		if shared.SecretName != o.Meta.GetName() {
+			continue
+		}
+		for _, namespace := range shared.Namespaces {
+			reqs = append(reqs, r.awsMachinesUsing(ctx, namespace, func(am *infrav1.AWSMachine) bool {
+				return am.Spec.CredentialsRef == nil && am.Spec.SecretRef != nil &&
+					am.Spec.SecretRef.Name == o.Meta.GetName() && am.Spec.SecretRef.Namespace == o.Meta.GetNamespace()
+			})...)
+		}
+	}
+	return reqs
+}
+
+// credentialsToAWSMachines maps an AWSCredentials to the AWSMachines
+// referencing it.
+func (r *AWSMachineReconciler) credentialsToAWSMachines(o handler.MapObject) []ctrl.Request {
+	return r.awsMachinesUsing(context.Background(), o.Meta.GetNamespace(), func(am *infrav1.AWSMachine) bool {
+		return am.Spec.CredentialsRef != nil && am.Spec.CredentialsRef.Name == o.Meta.GetName()
+	})
+}
+
+func (r *AWSMachineReconciler) awsMachinesUsing(ctx context.Context, namespace string, uses func(*infrav1.AWSMachine) bool) []ctrl.Request {
+	machines := &infrav1.AWSMachineList{}
+	if err := r.List(ctx, machines, client.InNamespace(namespace)); err != nil {
+		return nil
+	}
+	reqs := make([]ctrl.Request, 0)
+	for i := range machines.Items {
+		if am := &machines.Items[i]; uses(am) && matchesWatchFilter(r.WatchFilter, am) {
+			reqs = append(reqs, ctrl.Request{NamespacedName: client.ObjectKey{Namespace: am.Namespace, Name: am.Name}})
+		}
+	}
+	return reqs
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+const (
+	// decisionFlushInterval is how often recorded decisions are published.
+	decisionFlushInterval = 5 * time.Second
+
+	// decisionBufferSize is how many decisions may wait to be published
+	// before further decisions are dropped.
+	decisionBufferSize = 1000
+
+	// decisionPublishTimeout bounds each publish to the sink.
+	decisionPublishTimeout = 30 * time.Second
+)
+
+var decisionsDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "mapa_decision_records_dropped_total",
+	Help: "Number of provisioning decision records dropped because the buffer was full or publishing failed.",
+})
+
+func init() {
+	metrics.Registry.MustRegister(decisionsDroppedTotal)
+}
+
+// DecisionPublisher publishes the provisioning decisions of the AWSMachine
+// controller, such as where instances were launched and why launches
+// failed, to a sink outside of the cluster. Decisions are buffered and
+// published in the background so that reconciles never wait on the sink;
+// decisions that cannot be published are dropped.
+type DecisionPublisher struct {
+	Log  logr.Logger
+	Sink awsutil.DecisionSink
+
+	records chan awsutil.DecisionRecord
+}
+
+func (p *DecisionPublisher) SetupWithManager(mgr ctrl.Manager) error {
+	p.records = make(chan awsutil.DecisionRecord, decisionBufferSize)
+	return mgr.Add(p)
+}
+
+// Start publishes buffered decisions until stop is closed.
+func (p *DecisionPublisher) Start(stop <-chan struct{}) error {
+	ticker := time.NewTicker(decisionFlushInterval)
+	defer ticker.Stop()
+	var pending []awsutil.DecisionRecord
+	for {
+		select {
+		case rec := <-p.records:
+			pending = append(pending, rec)
+		case <-ticker.C:
+			if len(pending) == 0 {
+				continue
+			}
+			p.publish(pending)
+			pending = nil
+		case <-stop:
+			if len(pending) != 0 {
+				p.publish(pending)
+			}
+			return nil
+		}
+	}
+}
+
+func (p *DecisionPublisher) publish(records []awsutil.DecisionRecord) {
+	ctx, cancel := context.WithTimeout(context.Background(), decisionPublishTimeout)
+	defer cancel()
+	if err := p.Sink.Publish(ctx, records); err != nil {
+		p.Log.Error(err, "cannot publish provisioning decisions", append(awsutil.LogValues(err), "records", len(records))...)
+		decisionsDroppedTotal.Add(float64(len(records)))
+	}
+}
+
+// record queues the decision about the machine, dropping it if the buffer
+// is full. Decisions are not recorded when p is nil.
+func (p *DecisionPublisher) record(am *infrav1.AWSMachine, rec awsutil.DecisionRecord) {
+	if p == nil || p.records == nil {
+		return
+	}
+	rec.Time = time.Now()
+	rec.Namespace = am.Namespace
+	rec.Name = am.Name
+	rec.UID = string(am.UID)
+	if rec.Region == "" {
+		rec.Region = am.Status.Region
+	}
+	if rec.InstanceType == "" {
+		rec.InstanceType = am.Spec.InstanceType
+	}
+	select {
+	case p.records <- rec:
+	default:
+		decisionsDroppedTotal.Inc()
+	}
+}
+
+// launched records where the instance of the machine was launched.
+func (p *DecisionPublisher) launched(am *infrav1.AWSMachine, region string, instance *ec2.Instance) {
+	rec := awsutil.DecisionRecord{
+		Decision:     "Launched",
+		Region:       region,
+		InstanceID:   aws.StringValue(instance.InstanceId),
+		InstanceType: aws.StringValue(instance.InstanceType),
+		SubnetID:     aws.StringValue(instance.SubnetId),
+	}
+	if instance.Placement != nil {
+		rec.AvailabilityZone = aws.StringValue(instance.Placement.AvailabilityZone)
+	}
+	p.record(am, rec)
+}
+
+// launchFailed records why launching the instance of the machine failed.
+func (p *DecisionPublisher) launchFailed(am *infrav1.AWSMachine, region string, err error) {
+	reason := "LaunchFailed"
+	if aerr, ok := errors.Cause(err).(awserr.Error); ok {
+		reason = aerr.Code()
+	}
+	p.record(am, awsutil.DecisionRecord{
+		Decision:         "LaunchFailed",
+		Region:           region,
+		AvailabilityZone: am.Spec.AvailabilityZone,
+		Reason:           reason,
+		Message:          err.Error(),
+	})
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// decommissionRequeue is how long deletion waits before calling the
+// decommissioning webhook again after all attempts failed.
+const decommissionRequeue = 30 * time.Second
+
+// DecommissionWebhook is an external endpoint, such as a CMDB, that is told
+// about machines before their instances are terminated.
+type DecommissionWebhook struct {
+	// URL receives a POST with a JSON decommissionRequest body. Any 2xx
+	// response is considered a success.
+	URL string
+
+	// Timeout bounds each attempt.
+	Timeout time.Duration
+
+	// Retries is the number of additional attempts made before deletion is
+	// requeued.
+	Retries int
+}
+
+type decommissionRequest struct {
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	UID        string `json:"uid"`
+	ProviderID string `json:"providerID,omitempty"`
+	InstanceID string `json:"instanceID,omitempty"`
+	Region     string `json:"region,omitempty"`
+}
+
+func newDecommissionRequest(am *infrav1.AWSMachine) *decommissionRequest {
+	req := &decommissionRequest{
+		Namespace: am.Namespace,
+		Name:      am.Name,
+		UID:       string(am.UID),
+		Region:    am.Status.Region,
+	}
+	if am.Spec.ProviderID != nil {
+		req.ProviderID = *am.Spec.ProviderID
+		if p, err := awsutil.ParseProviderID(req.ProviderID); err == nil {
+			req.InstanceID = p.InstanceID
+			req.Region = p.Region
+		}
+	}
+	return req
+}
+
+// Notify posts the request to the webhook, retrying failed attempts with a
+// linear backoff.
+func (w *DecommissionWebhook) Notify(ctx context.Context, req *decommissionRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err = w.post(ctx, body)
+		if err == nil || attempt >= w.Retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt+1) * time.Second):
+		}
+	}
+}
+
+func (w *DecommissionWebhook) post(ctx context.Context, body []byte) error {
+	if w.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("decommissioning webhook returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// decommission notifies the decommissioning webhook about a deleted machine
+// and records the result in the Decommissioned condition. The instance is not
+// terminated until the webhook succeeded, so a RequeueAfterError is returned
+// while it keeps failing.
+func (r *AWSMachineReconciler) decommission(ctx context.Context, am *infrav1.AWSMachine) error {
+	if r.Decommission == nil || r.Decommission.URL == "" {
+		return nil
+	}
+	if cond := am.Status.Conditions.Get(infrav1.DecommissionedCondition); cond != nil && cond.Status == corev1.ConditionTrue {
+		return nil
+	}
+	ctx, span := tracer.Start(ctx, "Decommission")
+	err := r.Decommission.Notify(ctx, newDecommissionRequest(am))
+	endSpan(span, err)
+
+	orig := am.DeepCopy()
+	if err != nil {
+		am.Status.Conditions.Set(infrav1.Condition{
+			Type:    infrav1.DecommissionedCondition,
+			Status:  corev1.ConditionFalse,
+			Reason:  "WebhookFailed",
+			Message: err.Error(),
+		})
+	} else {
+		am.Status.Conditions.Set(infrav1.Condition{
+			Type:   infrav1.DecommissionedCondition,
+			Status: corev1.ConditionTrue,
+			Reason: "WebhookSucceeded",
+		})
+	}
+	if perr := r.Status().Patch(ctx, am, client.MergeFrom(orig)); perr != nil {
+		return perr
+	}
+	if err != nil {
+		return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: decommissionRequeue}, "decommissioning webhook failed: %v", err)
+	}
+	return nil
+}
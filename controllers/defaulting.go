@@ -0,0 +1,125 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-logr/logr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// +kubebuilder:webhook:path=/mutate-infrastructure-crit-sh-v1alpha1-awsmachine,mutating=true,failurePolicy=ignore,groups=infrastructure.crit.sh,resources=awsmachines,verbs=create,versions=v1alpha1,name=mawsmachine.infrastructure.crit.sh
+
+const defaultingWebhookPath = "/mutate-infrastructure-crit-sh-v1alpha1-awsmachine"
+
+// AWSMachineDefaulter writes the machine defaults of the provider in the
+// namespace into the spec of new AWSMachines.
+type AWSMachineDefaulter struct {
+	Client client.Client
+	Log    logr.Logger
+
+	decoder *admission.Decoder
+}
+
+// SetupWebhookWithManager registers the defaulting webhook for AWSMachine.
+func (d *AWSMachineDefaulter) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+	d.decoder = decoder
+	mgr.GetWebhookServer().Register(defaultingWebhookPath, &webhook.Admission{Handler: d})
+	return nil
+}
+
+// Handle applies the machine defaults to the AWSMachine of the request and
+// translates legacy device names of its block devices. Machine defaults are
+// not applied when the provider cannot be read, since they are a
+// convenience and not required to launch.
+func (d *AWSMachineDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+	am := &infrav1.AWSMachine{}
+	if err := d.decoder.Decode(req, am); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	normalizeDeviceNames(am)
+	p, err := getProvider(ctx, d.Client, req.Namespace)
+	if err != nil {
+		d.Log.Error(err, "cannot get provider, machine defaults not applied", "awsmachine", am.Name, "namespace", req.Namespace)
+	} else if p != nil && p.Spec.MachineDefaults != nil {
+		applyMachineDefaults(am, p.Spec.MachineDefaults)
+	}
+	data, err := json.Marshal(am)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, data)
+}
+
+// normalizeDeviceNames translates legacy device names of the block devices,
+// see awsutil.NormalizeDeviceName.
+func normalizeDeviceNames(am *infrav1.AWSMachine) {
+	for i := range am.Spec.BlockDevices {
+		b := &am.Spec.BlockDevices[i]
+		b.DeviceName = awsutil.NormalizeDeviceName(am.Spec.OSFamily, b.DeviceName)
+	}
+}
+
+// applyMachineDefaults sets the fields of the spec that are unset to the
+// machine defaults.
+func applyMachineDefaults(am *infrav1.AWSMachine, d *infrav1.MachineDefaults) {
+	if am.Spec.AMI == "" {
+		if ami, ok := d.AMIs[instanceFamily(am.Spec.InstanceType)]; ok {
+			am.Spec.AMI = ami
+		} else {
+			am.Spec.AMI = d.AMIs[""]
+		}
+	}
+	if am.Spec.IAMInstanceProfile == "" {
+		am.Spec.IAMInstanceProfile = d.IAMInstanceProfile
+	}
+	if am.Spec.KeyName == "" {
+		am.Spec.KeyName = d.KeyName
+	}
+	// network interfaces determine the network of the instance
+	if am.Spec.VPCID == "" && am.Spec.VPCSelector == nil && len(am.Spec.NetworkInterfaceIDs) == 0 {
+		am.Spec.VPCID = d.VPCID
+	}
+	for k, v := range d.Tags {
+		if am.Spec.Tags == nil {
+			am.Spec.Tags = make(map[string]string)
+		}
+		if _, ok := am.Spec.Tags[k]; !ok {
+			am.Spec.Tags[k] = v
+		}
+	}
+}
+
+// instanceFamily returns the family of an instance type, e.g. m5 for
+// m5.large.
+func instanceFamily(instanceType string) string {
+	return strings.SplitN(instanceType, ".", 2)[0]
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// reconcileDeletePriorities sets the DeletePriorityAnnotation of the
+// machines according to the policy. The annotation is removed from machines
+// without a priority, e.g. machines that are not ready.
+func (r *ConsolidationReconciler) reconcileDeletePriorities(ctx context.Context, policy infrav1.DeletePriorityPolicy, machines []infrav1.AWSMachine, nodes []corev1.Node, pods []corev1.Pod) error {
+	var priorities map[string]int32
+	switch policy {
+	case infrav1.DeletePriorityUtilization:
+		priorities = utilizationPriorities(nodeUsages(machines, nodes, pods))
+	case infrav1.DeletePriorityAMIAge:
+		priorities = r.amiAgePriorities(ctx, machines)
+	default:
+		return nil
+	}
+	for i := range machines {
+		am := &machines[i]
+		if !am.DeletionTimestamp.IsZero() {
+			continue
+		}
+		priority, ok := priorities[am.Name]
+		value := ""
+		if ok {
+			value = strconv.Itoa(int(priority))
+		}
+		if am.Annotations[infrav1.DeletePriorityAnnotation] == value {
+			continue
+		}
+		patch := client.MergeFrom(am.DeepCopy())
+		if ok {
+			if am.Annotations == nil {
+				am.Annotations = make(map[string]string)
+			}
+			am.Annotations[infrav1.DeletePriorityAnnotation] = value
+		} else {
+			delete(am.Annotations, infrav1.DeletePriorityAnnotation)
+		}
+		if err := r.Patch(ctx, am, patch); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// utilizationPriorities prioritizes machines by the share of the CPU or
+// memory of their node that is not requested, whichever is lower.
+func utilizationPriorities(usages []*nodeUsage) map[string]int32 {
+	priorities := make(map[string]int32)
+	for _, u := range usages {
+		p := 100 - max32(u.cpuPercent, u.memPercent)
+		if p < 0 {
+			p = 0
+		}
+		priorities[u.am.Name] = p
+	}
+	return priorities
+}
+
+// amiAgePriorities prioritizes ready machines by the creation date of their
+// AMI, from 100 for the oldest AMI to 0 for the newest. Machines whose AMI
+// cannot be described are left without a priority.
+func (r *ConsolidationReconciler) amiAgePriorities(ctx context.Context, machines []infrav1.AWSMachine) map[string]int32 {
+	ar := &AWSMachineReconciler{Client: r.Client}
+	created := make(map[string]time.Time)
+	byName := make(map[string]time.Time)
+	for i := range machines {
+		am := &machines[i]
+		if am.Spec.ProviderID == nil || !am.Status.Ready || am.Spec.AMI == "" || isExternallyManaged(am) {
+			continue
+		}
+		key := am.Status.Region + "/" + am.Spec.AMI
+		t, ok := created[key]
+		if !ok {
+			awscfg, err := ar.awsConfig(ctx, am, am.Status.Region)
+			if err != nil {
+				r.Log.V(1).Info("cannot get aws config for delete priority", "awsmachine", am.Name, "error", err.Error())
+				continue
+			}
+			t, err = awsutil.DescribeImageCreationDate(ctx, awscfg, am.Spec.AMI)
+			if err != nil {
+				r.Log.V(1).Info("cannot describe AMI for delete priority", "awsmachine", am.Name, "ami", am.Spec.AMI, "error", err.Error())
+				continue
+			}
+			created[key] = t
+		}
+		byName[am.Name] = t
+	}
+	return rankPriorities(byName)
+}
+
+// rankPriorities spreads the priorities of the machines evenly from 100 for
+// the earliest time to 0 for the latest. Machines with the same time have
+// the same priority.
+func rankPriorities(times map[string]time.Time) map[string]int32 {
+	distinct := make([]time.Time, 0)
+	seen := make(map[time.Time]bool)
+	for _, t := range times {
+		if !seen[t] {
+			seen[t] = true
+			distinct = append(distinct, t)
+		}
+	}
+	sort.Slice(distinct, func(i, j int) bool {
+		return distinct[i].Before(distinct[j])
+	})
+	rank := make(map[time.Time]int32)
+	for i, t := range distinct {
+		if len(distinct) > 1 {
+			rank[t] = int32(100 - 100*i/(len(distinct)-1))
+		}
+	}
+	priorities := make(map[string]int32)
+	for name, t := range times {
+		priorities[name] = rank[t]
+	}
+	return priorities
+}
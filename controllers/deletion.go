@@ -0,0 +1,58 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+var deletionPendingSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "mapa_machine_deletion_pending_seconds",
+	Help: "Seconds since a machine was deleted, for deleted machines that are still waiting for their instance to terminate or whose deletion failed.",
+}, []string{"namespace", "name"})
+
+func init() {
+	metrics.Registry.MustRegister(deletionPendingSeconds)
+}
+
+// observeDeletionPending records how long the deletion of the machine has
+// been pending.
+func observeDeletionPending(am *infrav1.AWSMachine) {
+	deletionPendingSeconds.WithLabelValues(am.Namespace, am.Name).Set(time.Since(am.DeletionTimestamp.Time).Seconds())
+}
+
+// deleteDeletionMetrics removes the deletion metrics of a released machine.
+func deleteDeletionMetrics(am *infrav1.AWSMachine) {
+	deletionPendingSeconds.DeleteLabelValues(am.Namespace, am.Name)
+}
+
+// retainInstance returns true if the instance of the deleted machine is
+// left running.
+func retainInstance(am *infrav1.AWSMachine) bool {
+	return am.Spec.DeletionPolicy == infrav1.DeletionPolicyRetain
+}
+
+// forceDelete returns true if the deleted machine is released even though
+// its instance or resources could not be deleted.
+func forceDelete(am *infrav1.AWSMachine) bool {
+	return am.Annotations[infrav1.ForceDeleteAnnotation] == "true"
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// MachineDescription is an AWSMachine alongside the live state of its
+// instance, for comparing the cluster with EC2.
+type MachineDescription struct {
+	Namespace string
+	Name      string
+
+	// InstanceID is the instance of the ProviderID of the machine, if set.
+	InstanceID string
+
+	// Ready and InstanceState are from the status of the machine.
+	Ready         bool
+	InstanceState string
+
+	// Found is false when the instance does not exist in EC2. The fields
+	// below are only set when the instance was found.
+	Found            bool
+	State            string
+	InstanceType     string
+	AvailabilityZone string
+	LaunchTime       time.Time
+	AutoScalingGroup string
+
+	// Err is why the instance could not be described.
+	Err error
+}
+
+// DescribeMachines describes the AWSMachines in the namespace, or all
+// namespaces when empty, along with their instances. Instances are described
+// with the credentials the controller would use for each machine. Failing to
+// describe an instance is recorded in its description rather than returned.
+func DescribeMachines(ctx context.Context, c client.Client, namespace string) ([]MachineDescription, error) {
+	machines := &infrav1.AWSMachineList{}
+	if err := c.List(ctx, machines, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	r := &AWSMachineReconciler{Client: c}
+	descs := make([]MachineDescription, 0, len(machines.Items))
+	for i := range machines.Items {
+		descs = append(descs, r.describeMachine(ctx, &machines.Items[i]))
+	}
+	return descs, nil
+}
+
+func (r *AWSMachineReconciler) describeMachine(ctx context.Context, am *infrav1.AWSMachine) MachineDescription {
+	d := MachineDescription{
+		Namespace:     am.Namespace,
+		Name:          am.Name,
+		Ready:         am.Status.Ready,
+		InstanceState: am.Status.InstanceState,
+	}
+	if am.Spec.ProviderID == nil {
+		return d
+	}
+	p, err := awsutil.ParseProviderID(*am.Spec.ProviderID)
+	if err != nil {
+		d.Err = err
+		return d
+	}
+	d.InstanceID = p.InstanceID
+	awscfg, err := r.awsConfig(ctx, am, p.Region)
+	if err != nil {
+		d.Err = err
+		return d
+	}
+	instance, found, err := awsutil.DescribeInstance(ctx, awscfg, p.InstanceID)
+	if err != nil || !found {
+		d.Err = err
+		return d
+	}
+	d.Found = true
+	d.State = aws.StringValue(instance.State.Name)
+	d.InstanceType = aws.StringValue(instance.InstanceType)
+	if instance.Placement != nil {
+		d.AvailabilityZone = aws.StringValue(instance.Placement.AvailabilityZone)
+	}
+	d.LaunchTime = aws.TimeValue(instance.LaunchTime)
+	d.AutoScalingGroup, d.Err = awsutil.DescribeAutoscalingInstances(ctx, awscfg, p.InstanceID)
+	return d
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	machinev1 "github.com/criticalstack/machine-api/api/v1alpha1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// dnsRecordName renders the record name template of the machine.
+func dnsRecordName(am *infrav1.AWSMachine) (string, error) {
+	name, err := executeDNSTemplate(am, am.Spec.DNS.Name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.ToLower(name), "."), nil
+}
+
+// dnsRouting returns the routing of the record set of the machine. Simple
+// records have no set identifier.
+func dnsRouting(am *infrav1.AWSMachine) (awsutil.RecordRouting, error) {
+	var routing awsutil.RecordRouting
+	switch am.Spec.DNS.RoutingPolicy {
+	case infrav1.DNSRoutingWeighted:
+		routing.Weight = am.Spec.DNS.Weight
+		if routing.Weight == nil {
+			routing.Weight = aws.Int64(1)
+		}
+	case infrav1.DNSRoutingMultiValue:
+		routing.MultiValue = true
+	default:
+		return routing, nil
+	}
+	routing.SetIdentifier = am.Namespace + "/" + am.Name
+	if am.Spec.DNS.SetIdentifier != "" {
+		id, err := executeDNSTemplate(am, am.Spec.DNS.SetIdentifier)
+		if err != nil {
+			return routing, errors.Wrap(err, "cannot render dns set identifier")
+		}
+		routing.SetIdentifier = id
+	}
+	return routing, nil
+}
+
+func executeDNSTemplate(am *infrav1.AWSMachine, text string) (string, error) {
+	t, err := template.New("dns").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, am); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// dnsRecordAddress returns the IPv4 address the machine A record points to,
+// which is the primary address when it is an IPv4 address and the internal
+// IPv4 address otherwise.
+func dnsRecordAddress(am *infrav1.AWSMachine) string {
+	if isIPv4(am.Status.PrimaryAddress) {
+		return am.Status.PrimaryAddress
+	}
+	for _, addr := range am.Status.Addresses {
+		if addr.Type == machinev1.MachineInternalIP && isIPv4(addr.Address) {
+			return addr.Address
+		}
+	}
+	return ""
+}
+
+func isIPv4(s string) bool {
+	ip := net.ParseIP(s)
+	return ip != nil && ip.To4() != nil
+}
+
+// reconcileDNS creates the A record for the machine, or adds the address of
+// the machine to a shared record. Weighted and multi-value records are a
+// record set of the machine, optionally with a health check of its address.
+// Health checked addresses of shared records are added by
+// reconcileDNSHealth.
+// Private hosted zones must be associated with the VPC of the instance.
+func (r *AWSMachineReconciler) reconcileDNS(ctx context.Context, am *infrav1.AWSMachine, vpcID string) error {
+	name, err := dnsRecordName(am)
+	if err != nil {
+		return errors.Wrap(err, "cannot render dns record name")
+	}
+	addr := dnsRecordAddress(am)
+	if addr == "" {
+		return errors.Errorf("machine has no IP address for dns record: %#v", name)
+	}
+	zoneID, err := r.hostedZoneID(ctx, am, name, vpcID)
+	if err != nil {
+		return err
+	}
+	if am.Spec.DNS.HostedZoneID != "" && vpcID != "" {
+		ok, err := r.route53.IsAssociated(ctx, zoneID, vpcID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.Errorf("private hosted zone %s is not associated with VPC %s", zoneID, vpcID)
+		}
+	}
+	routing, err := dnsRouting(am)
+	if err != nil {
+		return err
+	}
+	var healthCheckID string
+	if am.Spec.DNS.HealthCheck != nil && (routing.SetIdentifier != "" || am.Spec.DNS.Shared) {
+		hc := am.Spec.DNS.HealthCheck
+		healthCheckID, err = r.route53.EnsureHealthCheck(ctx, string(am.UID)+"-"+addr, addr, hc.Type, hc.Port, hc.ResourcePath)
+		if err != nil {
+			return errors.Wrap(err, "cannot create dns health check")
+		}
+	}
+	if am.Spec.DNS.Shared && routing.SetIdentifier == "" {
+		// simple records cannot refer to health checks, so the address of
+		// a health checked machine is added by reconcileDNSHealth once
+		// its health check passes
+		if healthCheckID == "" {
+			err = r.route53.AddAddress(ctx, zoneID, name, addr)
+		}
+	} else {
+		routing.HealthCheckID = healthCheckID
+		err = r.route53.Update(ctx, zoneID, name, []string{addr}, routing)
+	}
+	if err != nil {
+		return err
+	}
+	am.Status.DNSName = name
+	addRegistration(am, infrav1.Registration{
+		Kind:          infrav1.RegistrationDNSRecord,
+		Resource:      zoneID,
+		Name:          name,
+		Value:         addr,
+		SetIdentifier: routing.SetIdentifier,
+		HealthCheckID: healthCheckID,
+	})
+	return nil
+}
+
+// dnsHealthInterval is how often the health of the addresses of health
+// checked machines in shared records is checked.
+const dnsHealthInterval = time.Minute
+
+// reconcileDNSHealth updates the membership of the addresses of health
+// checked machines in shared records, adding the address when its health
+// check passes and removing it when it fails. The last address of a record
+// is never removed, since an empty record fails every client rather than
+// some of them. It returns true if the machine has health checked addresses
+// in shared records.
+func (r *AWSMachineReconciler) reconcileDNSHealth(ctx context.Context, am *infrav1.AWSMachine) (bool, error) {
+	checked := false
+	for _, reg := range registrations(am, infrav1.RegistrationDNSRecord) {
+		if reg.SetIdentifier != "" || reg.HealthCheckID == "" {
+			continue
+		}
+		checked = true
+		healthy, err := r.route53.HealthCheckHealthy(ctx, reg.HealthCheckID)
+		if err != nil {
+			return checked, errors.Wrap(err, "cannot get dns health check status")
+		}
+		addrs, err := r.route53.List(ctx, reg.Resource, reg.Name)
+		if err != nil {
+			return checked, err
+		}
+		member := false
+		for _, a := range addrs {
+			if a == reg.Value {
+				member = true
+			}
+		}
+		switch {
+		case healthy && !member:
+			if err := r.route53.AddAddress(ctx, reg.Resource, reg.Name, reg.Value); err != nil {
+				return checked, err
+			}
+			r.Recorder.Eventf(am, corev1.EventTypeNormal, "DNSHealthy", "Added %s to dns record %s", reg.Value, reg.Name)
+		case !healthy && member && len(addrs) > 1:
+			if err := r.route53.RemoveAddress(ctx, reg.Resource, reg.Name, reg.Value); err != nil {
+				return checked, err
+			}
+			r.Recorder.Eventf(am, corev1.EventTypeWarning, "DNSUnhealthy", "Removed %s from dns record %s", reg.Value, reg.Name)
+		}
+	}
+	return checked, nil
+}
+
+// deleteDNS removes the address of the machine from the A records it was
+// added to, deleting records left without addresses along with the record
+// sets and health checks of the machine. Records created before
+// registrations were recorded are deleted.
+func (r *AWSMachineReconciler) deleteDNS(ctx context.Context, am *infrav1.AWSMachine) error {
+	registered := false
+	for _, reg := range registrations(am, infrav1.RegistrationDNSRecord) {
+		registered = true
+		if reg.SetIdentifier != "" {
+			if err := r.route53.Delete(ctx, reg.Resource, reg.Name, reg.SetIdentifier); err != nil {
+				return err
+			}
+		} else if err := r.route53.RemoveAddress(ctx, reg.Resource, reg.Name, reg.Value); err != nil {
+			return err
+		}
+		if reg.HealthCheckID != "" {
+			if err := r.route53.DeleteHealthCheck(ctx, reg.HealthCheckID); err != nil {
+				return err
+			}
+		}
+		removeRegistration(am, reg)
+	}
+	if am.Status.DNSName != "" && !registered {
+		zoneID, err := r.hostedZoneID(ctx, am, am.Status.DNSName, "")
+		if err != nil {
+			return err
+		}
+		if err := r.route53.Delete(ctx, zoneID, am.Status.DNSName, ""); err != nil {
+			return err
+		}
+	}
+	am.Status.DNSName = ""
+	return nil
+}
+
+// hostedZoneID returns the hosted zone of the record of the machine, looking
+// it up from the name when the spec does not set it. Private zones are only
+// looked up among zones associated with the VPC when vpcID is set.
+func (r *AWSMachineReconciler) hostedZoneID(ctx context.Context, am *infrav1.AWSMachine, name, vpcID string) (string, error) {
+	if am.Spec.DNS == nil {
+		return r.route53.LookupZoneID(ctx, name, false, "")
+	}
+	if am.Spec.DNS.HostedZoneID != "" {
+		return am.Spec.DNS.HostedZoneID, nil
+	}
+	return r.route53.LookupZoneID(ctx, name, am.Spec.DNS.PrivateZone, vpcID)
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	nodeutil "github.com/criticalstack/crit/pkg/kubernetes/util/node"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=pods/eviction,verbs=create
+
+// getNodeByProviderID returns the Node with the given providerID, or nil if
+// no such Node has registered.
+func getNodeByProviderID(ctx context.Context, c client.Client, providerID string) (*corev1.Node, error) {
+	nodes, err := nodesForInstance(ctx, c, providerID)
+	if err != nil || len(nodes) == 0 {
+		return nil, err
+	}
+	return &nodes[0], nil
+}
+
+// drainNode cordons the node and requests eviction of every pod that is not
+// managed by a DaemonSet or is a mirror pod. Evictions are subject to
+// PodDisruptionBudgets, so a node may take several calls to drain. It returns
+// true once no evictable pods remain on the node. The pods of the node are
+// listed from the API server by field selector rather than caching every
+// pod of the cluster.
+func drainNode(ctx context.Context, k kubernetes.Interface, n *corev1.Node) (bool, error) {
+	if !n.Spec.Unschedulable {
+		if err := nodeutil.PatchNode(ctx, k, n.Name, func(n *corev1.Node) {
+			n.Spec.Unschedulable = true
+		}); err != nil {
+			return false, err
+		}
+	}
+	pods, err := k.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", n.Name).String(),
+	})
+	if err != nil {
+		return false, err
+	}
+	drained := true
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName != n.Name || !isEvictable(&pod) {
+			continue
+		}
+		drained = false
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		err := k.PolicyV1beta1().Evictions(pod.Namespace).Evict(ctx, &policyv1beta1.Eviction{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      pod.Name,
+				Namespace: pod.Namespace,
+			},
+		})
+		switch {
+		case err == nil, apierrors.IsNotFound(err), apierrors.IsTooManyRequests(err):
+			// TooManyRequests indicates the eviction would violate a
+			// PodDisruptionBudget, so it is retried on a later call.
+		default:
+			return false, err
+		}
+	}
+	return drained, nil
+}
+
+func isEvictable(pod *corev1.Pod) bool {
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return false
+	}
+	if _, ok := pod.Annotations[corev1.MirrorPodAnnotationKey]; ok {
+		return false
+	}
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind == "DaemonSet" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestGetNodeByProviderID(t *testing.T) {
+	node := func(name, providerID string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       corev1.NodeSpec{ProviderID: providerID},
+		}
+	}
+	c := fake.NewFakeClientWithScheme(newTestScheme(t),
+		node("unregistered", ""),
+		node("other", "aws:///us-east-1a/i-0fedcba9876543210"),
+		node("worker", "aws:///us-east-1a/i-0123456789abcdef0"),
+	)
+	cases := []struct {
+		name       string
+		providerID string
+		want       string
+	}{
+		{name: "same ProviderID", providerID: "aws:///us-east-1a/i-0123456789abcdef0", want: "worker"},
+		{name: "same instance", providerID: "aws:////i-0123456789abcdef0", want: "worker"},
+		{name: "not registered", providerID: "aws:///us-east-1a/i-00000000000000000"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := getNodeByProviderID(context.Background(), c, tc.providerID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if n != nil {
+				got = n.Name
+			}
+			if got != tc.want {
+				t.Errorf("node = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDrainNode(t *testing.T) {
+	pod := func(name, nodeName string, mutate func(*corev1.Pod)) *corev1.Pod {
+		p := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       corev1.PodSpec{NodeName: nodeName},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		}
+		if mutate != nil {
+			mutate(p)
+		}
+		return p
+	}
+	n := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   "worker",
+		Labels: map[string]string{corev1.LabelHostname: "worker"},
+	}}
+	k := kfake.NewSimpleClientset(n,
+		pod("app", "worker", nil),
+		pod("other-node", "other", nil),
+		pod("daemon", "worker", func(p *corev1.Pod) {
+			p.OwnerReferences = []metav1.OwnerReference{{Kind: "DaemonSet", Name: "daemon"}}
+		}),
+		pod("completed", "worker", func(p *corev1.Pod) {
+			p.Status.Phase = corev1.PodSucceeded
+		}),
+	)
+	drained, err := drainNode(context.Background(), k, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drained {
+		t.Error("expected the node to wait for the evicted pod")
+	}
+	var evicted []string
+	for _, a := range k.Actions() {
+		if a.GetSubresource() == "eviction" {
+			evicted = append(evicted, a.(k8stesting.CreateAction).GetObject().(metav1.Object).GetName())
+		}
+	}
+	if len(evicted) != 1 || evicted[0] != "app" {
+		t.Errorf("evicted = %v, want [app]", evicted)
+	}
+	updated, err := k.CoreV1().Nodes().Get(context.Background(), "worker", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.Spec.Unschedulable {
+		t.Error("expected the node to be cordoned")
+	}
+}
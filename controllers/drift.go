@@ -0,0 +1,137 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// launchSpec holds the fields of the AWSMachine spec that only take effect
+// when the instance is launched.
+type launchSpec struct {
+	AMI                   string                          `json:"ami,omitempty"`
+	InstanceType          string                          `json:"instanceType,omitempty"`
+	BlockDevices          []infrav1.AWSBlockDeviceMapping `json:"blockDevices,omitempty"`
+	IAMInstanceProfile    string                          `json:"iamInstanceProfile,omitempty"`
+	KeyName               string                          `json:"keyName,omitempty"`
+	VPCID                 string                          `json:"vpcID,omitempty"`
+	SubnetIDs             []string                        `json:"subnetIDs,omitempty"`
+	SecurityGroupIDs      []string                        `json:"securityGroupIDs,omitempty"`
+	SecurityGroupNames    []string                        `json:"securityGroupNames,omitempty"`
+	SecurityGroupSelector *infrav1.TagSelector            `json:"securityGroupSelector,omitempty"`
+	UserDataFormat        infrav1.UserDataFormat          `json:"userDataFormat,omitempty"`
+	CPUOptions            *infrav1.CPUOptions             `json:"cpuOptions,omitempty"`
+	EnclaveOptions        *infrav1.EnclaveOptions         `json:"enclaveOptions,omitempty"`
+	InstanceStore         infrav1.InstanceStorePolicy     `json:"instanceStorePolicy,omitempty"`
+	Proxy                 *infrav1.Proxy                  `json:"proxy,omitempty"`
+}
+
+func launchSpecOf(am *infrav1.AWSMachine) launchSpec {
+	return launchSpec{
+		AMI:                   am.Spec.AMI,
+		InstanceType:          am.Spec.InstanceType,
+		BlockDevices:          am.Spec.BlockDevices,
+		IAMInstanceProfile:    am.Spec.IAMInstanceProfile,
+		KeyName:               am.Spec.KeyName,
+		VPCID:                 am.Spec.VPCID,
+		SubnetIDs:             am.Spec.SubnetIDs,
+		SecurityGroupIDs:      am.Spec.SecurityGroupIDs,
+		SecurityGroupNames:    am.Spec.SecurityGroupNames,
+		SecurityGroupSelector: am.Spec.SecurityGroupSelector,
+		UserDataFormat:        am.Spec.UserDataFormat,
+		CPUOptions:            am.Spec.CPUOptions,
+		EnclaveOptions:        am.Spec.EnclaveOptions,
+		InstanceStore:         am.Spec.InstanceStorePolicy,
+		Proxy:                 am.Spec.Proxy,
+	}
+}
+
+// recordLaunchSpec records the launch fields of the spec the instance was
+// launched with.
+func recordLaunchSpec(am *infrav1.AWSMachine) {
+	b, err := json.Marshal(launchSpecOf(am))
+	if err != nil {
+		return
+	}
+	if am.Annotations == nil {
+		am.Annotations = make(map[string]string)
+	}
+	am.Annotations[infrav1.LaunchSpecAnnotation] = string(b)
+	am.Status.Conditions.Set(infrav1.Condition{
+		Type:   infrav1.InstanceUpToDateCondition,
+		Status: corev1.ConditionTrue,
+		Reason: "Launched",
+	})
+}
+
+// reconcileLaunchSpec sets the InstanceUpToDate condition from the launch
+// fields that changed since the instance was launched. Machines launched
+// before launch fields were recorded use their current spec.
+func reconcileLaunchSpec(am *infrav1.AWSMachine) {
+	value, ok := am.Annotations[infrav1.LaunchSpecAnnotation]
+	if !ok {
+		recordLaunchSpec(am)
+		return
+	}
+	launched := launchSpec{}
+	if err := json.Unmarshal([]byte(value), &launched); err != nil {
+		recordLaunchSpec(am)
+		return
+	}
+	changed := changedLaunchFields(launched, launchSpecOf(am))
+	if len(changed) == 0 {
+		am.Status.Conditions.Set(infrav1.Condition{
+			Type:   infrav1.InstanceUpToDateCondition,
+			Status: corev1.ConditionTrue,
+			Reason: "Launched",
+		})
+		return
+	}
+	am.Status.Conditions.Set(infrav1.Condition{
+		Type:   infrav1.InstanceUpToDateCondition,
+		Status: corev1.ConditionFalse,
+		Reason: "ReplacementRequired",
+		Message: fmt.Sprintf("%s changed after the instance was launched and only take effect on a new instance, "+
+			"replace the machine (e.g. with the %s annotation) to apply them", strings.Join(changed, ", "), infrav1.RecreateAnnotation),
+	})
+}
+
+// changedLaunchFields returns the spec paths of the fields that differ.
+func changedLaunchFields(a, b launchSpec) []string {
+	changed := make([]string, 0)
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	t := va.Type()
+	for i := 0; i < t.NumField(); i++ {
+		x, y := va.Field(i), vb.Field(i)
+		// nil and empty lists are the same after a JSON round trip
+		if x.Kind() == reflect.Slice && x.Len() == 0 && y.Len() == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(x.Interface(), y.Interface()) {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			changed = append(changed, "spec."+name)
+		}
+	}
+	return changed
+}
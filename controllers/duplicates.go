@@ -0,0 +1,98 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// providerIDOwner returns the AWSMachine that owns the instance of am when
+// another AWSMachine claims the same instance, e.g. after a node adoption
+// race. The oldest AWSMachine owns the instance, so that exactly one of them
+// manages it. Returns nil if am owns its instance.
+func (r *AWSMachineReconciler) providerIDOwner(ctx context.Context, am *infrav1.AWSMachine) (*infrav1.AWSMachine, error) {
+	if am.Spec.ProviderID == nil {
+		return nil, nil
+	}
+	p, err := awsutil.ParseProviderID(*am.Spec.ProviderID)
+	if err != nil {
+		return nil, nil
+	}
+	machines, err := machinesForInstance(ctx, r.Client, p.InstanceID)
+	if err != nil {
+		return nil, err
+	}
+	var owner *infrav1.AWSMachine
+	for i := range machines {
+		other := &machines[i]
+		if other.UID == am.UID {
+			continue
+		}
+		if createdBefore(other, am) && (owner == nil || createdBefore(other, owner)) {
+			owner = other
+		}
+	}
+	return owner, nil
+}
+
+// createdBefore orders AWSMachines by creation, breaking ties by namespace
+// and name.
+func createdBefore(a, b *infrav1.AWSMachine) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	if a.Namespace != b.Namespace {
+		return a.Namespace < b.Namespace
+	}
+	return a.Name < b.Name
+}
+
+// reconcileDuplicate stops a duplicate AWSMachine from managing the instance
+// of owner. The ProviderIDUnique condition is set to false, and deleting the
+// duplicate leaves the instance to its owner.
+func (r *AWSMachineReconciler) reconcileDuplicate(ctx context.Context, am, owner *infrav1.AWSMachine) error {
+	if !am.DeletionTimestamp.IsZero() {
+		r.Log.Info("releasing duplicate machine without terminating its instance", "awsmachine", am.Name, "owner", owner.Namespace+"/"+owner.Name)
+		controllerutil.RemoveFinalizer(am, infrav1.MachineFinalizer)
+		return r.Update(ctx, am)
+	}
+	msg := fmt.Sprintf("instance %s is managed by AWSMachine %s/%s", *am.Spec.ProviderID, owner.Namespace, owner.Name)
+	if cond := am.Status.Conditions.Get(infrav1.ProviderIDUniqueCondition); cond != nil && cond.Status == corev1.ConditionFalse && cond.Message == msg {
+		return nil
+	}
+	orig := am.DeepCopy()
+	am.Status.Conditions.Set(infrav1.Condition{
+		Type:    infrav1.ProviderIDUniqueCondition,
+		Status:  corev1.ConditionFalse,
+		Reason:  "Duplicate",
+		Message: msg,
+	})
+	if err := r.Status().Patch(ctx, am, client.MergeFrom(orig)); err != nil {
+		return err
+	}
+	r.Log.Info("machine claims the instance of another machine", "awsmachine", am.Name, "owner", owner.Namespace+"/"+owner.Name)
+	r.Recorder.Eventf(am, corev1.EventTypeWarning, "DuplicateProviderID", "Instance %s is managed by AWSMachine %s/%s", *am.Spec.ProviderID, owner.Namespace, owner.Name)
+	return nil
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	"github.com/criticalstack/machine-api-provider-aws/internal"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// eksBootstrap returns true for machines joining an EKS cluster, whose user
+// data is generated instead of taken from the Config of their Machine.
+func eksBootstrap(am *infrav1.AWSMachine) bool {
+	switch am.Spec.BootstrapMode {
+	case infrav1.BootstrapModeEKS, infrav1.BootstrapModeNodeadm:
+		return true
+	default:
+		return false
+	}
+}
+
+// eksUserData generates the user data of a machine joining an EKS cluster,
+// describing the cluster for the values the spec does not set. nodeadm user
+// data is MIME multi-part, so the user data format of nodeadm machines
+// defaults to raw. A ConfigurationError is returned when the cluster is not
+// set or does not exist.
+func eksUserData(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine) ([]byte, error) {
+	if am.Spec.EKS == nil || am.Spec.EKS.ClusterName == "" {
+		return nil, awsutil.NewConfigurationError("bootstrap mode %s requires spec.eks.clusterName", am.Spec.BootstrapMode)
+	}
+	e := am.Spec.EKS.DeepCopy()
+	nodeadm := am.Spec.BootstrapMode == infrav1.BootstrapModeNodeadm
+	if e.APIServerEndpoint == "" || e.CertificateAuthority == "" || (nodeadm && e.ServiceCIDR == "") {
+		c, err := awsutil.DescribeEKSCluster(ctx, awscfg, e.ClusterName)
+		if errors.Is(err, awsutil.ErrNotFound) {
+			return nil, awsutil.NewConfigurationError("EKS cluster %q does not exist in region %s", e.ClusterName, aws.StringValue(awscfg.Region))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e.APIServerEndpoint == "" {
+			e.APIServerEndpoint = c.Endpoint
+		}
+		if e.CertificateAuthority == "" {
+			e.CertificateAuthority = c.CertificateAuthority
+		}
+		if e.ServiceCIDR == "" {
+			e.ServiceCIDR = c.ServiceCIDR
+		}
+	}
+	if !nodeadm {
+		return internal.EKSBootstrapScript(e, am.Spec.InstanceStorePolicy), nil
+	}
+	if am.Spec.UserDataFormat == "" {
+		am.Spec.UserDataFormat = infrav1.UserDataFormatRaw
+	}
+	return internal.NodeadmConfig(e, am.Spec.InstanceStorePolicy)
+}
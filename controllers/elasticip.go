@@ -0,0 +1,107 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// elasticIPRequeue is how long associating an Elastic IP waits for the
+// instance to be running.
+const elasticIPRequeue = 10 * time.Second
+
+// reconcileElasticIP claims the Elastic IP of the machine and associates it
+// with the instance once the instance is running. The claimed Elastic IP is
+// recorded in the status, so that a recreated instance gets the same one.
+func (r *AWSMachineReconciler) reconcileElasticIP(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, instance *ec2.Instance) error {
+	if am.Spec.ElasticIP == nil {
+		return nil
+	}
+	instanceID := aws.StringValue(instance.InstanceId)
+	if am.Status.ElasticIP != nil && am.Status.ElasticIP.InstanceID == instanceID {
+		return nil
+	}
+	if am.Status.ElasticIP == nil {
+		addr, err := awsutil.ClaimElasticIP(ctx, awscfg, am)
+		if err != nil {
+			if awsutil.IsConfigurationError(err) {
+				am.Status.SetFailure(mapierrors.InvalidConfigurationMachineError, err.Error())
+			}
+			return errors.Wrap(err, "cannot claim elastic IP")
+		}
+		am.Status.ElasticIP = &infrav1.ElasticIPStatus{
+			AllocationID: aws.StringValue(addr.AllocationId),
+			PublicIP:     aws.StringValue(addr.PublicIp),
+		}
+	}
+	if state := aws.StringValue(instance.State.Name); state != ec2.InstanceStateNameRunning {
+		return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: elasticIPRequeue}, "machine %q %s, waiting until running to associate elastic IP", am.Name, state)
+	}
+	eip := am.Status.ElasticIP
+	if err := awsutil.AssociateElasticIP(ctx, awscfg, eip.AllocationID, instanceID); err != nil {
+		r.Recorder.Eventf(am, corev1.EventTypeWarning, "ElasticIPAssociationFailed", "Cannot associate elastic IP %s with instance %s: %v", eip.PublicIP, instanceID, err)
+		return errors.Wrapf(err, "cannot associate elastic IP %s", eip.AllocationID)
+	}
+	eip.InstanceID = instanceID
+	r.Recorder.Eventf(am, corev1.EventTypeNormal, "ElasticIPAssociated", "Associated elastic IP %s with instance %s", eip.PublicIP, instanceID)
+
+	// the public address of the instance changed
+	instance, ok, err := awsutil.DescribeInstance(ctx, awscfg, instanceID)
+	if err != nil || !ok {
+		return err
+	}
+	setInstanceAddresses(am, instance)
+	return nil
+}
+
+// releaseElasticIP returns the Elastic IP claimed by the deleted machine to
+// its pool. Claims that were not recorded in the status, e.g. because the
+// status update was lost, are found by their tag.
+func (r *AWSMachineReconciler) releaseElasticIP(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine) error {
+	eip := am.Status.ElasticIP
+	if eip == nil {
+		if am.Spec.ElasticIP == nil || am.Spec.ElasticIP.Selector == nil {
+			return nil
+		}
+		ids, err := awsutil.ClaimedElasticIPs(ctx, awscfg, string(am.UID))
+		if err != nil {
+			return errors.Wrap(err, "cannot describe claimed elastic IPs")
+		}
+		for _, id := range ids {
+			if err := awsutil.ReleaseElasticIPClaim(ctx, awscfg, id, ""); err != nil {
+				return errors.Wrapf(err, "cannot release elastic IP %s", id)
+			}
+		}
+		return nil
+	}
+	if err := awsutil.ReleaseElasticIPClaim(ctx, awscfg, eip.AllocationID, eip.InstanceID); err != nil {
+		return errors.Wrapf(err, "cannot release elastic IP %s", eip.AllocationID)
+	}
+	r.Recorder.Eventf(am, corev1.EventTypeNormal, "ElasticIPReleased", "Released elastic IP %s", eip.PublicIP)
+	am.Status.ElasticIP = nil
+	return nil
+}
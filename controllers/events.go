@@ -0,0 +1,187 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	nodeutil "github.com/criticalstack/crit/pkg/kubernetes/util/node"
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+var scheduledEventTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "mapa_instance_scheduled_event_timestamp_seconds",
+	Help: "Earliest start as a Unix timestamp of the upcoming scheduled events of the instance of an AWSMachine, by event code.",
+}, []string{"namespace", "awsmachine", "code"})
+
+func init() {
+	metrics.Registry.MustRegister(scheduledEventTime)
+}
+
+// scheduledEvent is the value of the ScheduledEventAnnotation.
+type scheduledEvent struct {
+	awsutil.InstanceEvent
+
+	// Drained is true once the node was cordoned for the event, so that it
+	// can be uncordoned after the event.
+	Drained bool `json:"drained,omitempty"`
+}
+
+// reconcileEvents records the next scheduled event or spot interruption of
+// the instance on the machine, draining its node ahead of the event. The
+// node is uncordoned once the event has passed and the instance is still
+// running.
+func (r *AWSMachineReconciler) reconcileEvents(ctx context.Context, am *infrav1.AWSMachine) error {
+	p, err := awsutil.ParseProviderID(*am.Spec.ProviderID)
+	if err != nil {
+		return err
+	}
+	awscfg, err := r.awsConfig(ctx, am, p.Region)
+	if err != nil {
+		return err
+	}
+	instance, exists, err := awsutil.DescribeInstance(ctx, awscfg, p.InstanceID)
+	if err != nil || !exists {
+		return err
+	}
+	events, err := awsutil.DescribeInstanceEvents(ctx, awscfg, instance)
+	if err != nil {
+		return err
+	}
+	setScheduledEvents(am, events)
+
+	var prev scheduledEvent
+	if v, ok := am.Annotations[infrav1.ScheduledEventAnnotation]; ok {
+		if err := json.Unmarshal([]byte(v), &prev); err != nil {
+			r.Log.Info("ignoring invalid scheduled event annotation", "awsmachine", am.Name, "error", err.Error())
+		}
+	}
+	if len(events) == 0 {
+		if prev.Code == "" {
+			return nil
+		}
+		r.Log.Info("scheduled event has passed", "awsmachine", am.Name, "event", prev.Code)
+		if prev.Drained {
+			if err := r.uncordonNode(ctx, am); err != nil {
+				return err
+			}
+		}
+		delete(am.Annotations, infrav1.ScheduledEventAnnotation)
+		return nil
+	}
+
+	ev := scheduledEvent{InstanceEvent: events[0], Drained: prev.Drained}
+	if ev.Code != prev.Code {
+		r.Log.Info("instance has a scheduled event", "awsmachine", am.Name, "event", ev.Code, "notBefore", ev.NotBefore, "description", ev.Description)
+	}
+	var drainErr error
+	if ev.Code == awsutil.SpotInterruptionEventCode || time.Until(ev.NotBefore) <= r.EventDrainLeadTime {
+		drained, err := r.drainForEvent(ctx, am)
+		if err != nil {
+			return err
+		}
+		ev.Drained = true
+		if !drained {
+			drainErr = errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: 10 * time.Second}, "draining node ahead of %s", ev.Code)
+		}
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	metav1.SetMetaDataAnnotation(&am.ObjectMeta, infrav1.ScheduledEventAnnotation, string(data))
+	return drainErr
+}
+
+// setScheduledEvents publishes the upcoming events of the instance in the
+// status, the MaintenanceScheduled condition and metrics.
+func setScheduledEvents(am *infrav1.AWSMachine, events []awsutil.InstanceEvent) {
+	deleteScheduledEventMetrics(am)
+	am.Status.ScheduledEvents = nil
+	for _, e := range events {
+		am.Status.ScheduledEvents = append(am.Status.ScheduledEvents, infrav1.ScheduledEvent{
+			Code:        e.Code,
+			Description: e.Description,
+			NotBefore:   metav1.NewTime(e.NotBefore),
+		})
+		scheduledEventTime.WithLabelValues(am.Namespace, am.Name, e.Code).Set(float64(e.NotBefore.Unix()))
+	}
+	if len(events) == 0 {
+		if am.Status.Conditions.Get(infrav1.MaintenanceScheduledCondition) != nil {
+			am.Status.Conditions.Set(infrav1.Condition{
+				Type:   infrav1.MaintenanceScheduledCondition,
+				Status: corev1.ConditionFalse,
+				Reason: "NoScheduledEvents",
+			})
+		}
+		return
+	}
+	am.Status.Conditions.Set(infrav1.Condition{
+		Type:    infrav1.MaintenanceScheduledCondition,
+		Status:  corev1.ConditionTrue,
+		Reason:  events[0].Code,
+		Message: fmt.Sprintf("%s not before %s", events[0].Description, events[0].NotBefore.UTC().Format(time.RFC3339)),
+	})
+}
+
+// deleteScheduledEventMetrics removes the metrics of the events in the
+// status of the machine.
+func deleteScheduledEventMetrics(am *infrav1.AWSMachine) {
+	for _, e := range am.Status.ScheduledEvents {
+		scheduledEventTime.DeleteLabelValues(am.Namespace, am.Name, e.Code)
+	}
+}
+
+// drainForEvent drains the node of the machine, returning true once no
+// evictable pods remain or if the node has not registered.
+func (r *AWSMachineReconciler) drainForEvent(ctx context.Context, am *infrav1.AWSMachine) (bool, error) {
+	n, err := getNodeByProviderID(ctx, r.Client, *am.Spec.ProviderID)
+	if err != nil || n == nil {
+		return true, err
+	}
+	k, err := kubernetes.NewForConfig(r.config)
+	if err != nil {
+		return false, err
+	}
+	return drainNode(ctx, k, n)
+}
+
+func (r *AWSMachineReconciler) uncordonNode(ctx context.Context, am *infrav1.AWSMachine) error {
+	n, err := getNodeByProviderID(ctx, r.Client, *am.Spec.ProviderID)
+	if err != nil || n == nil || !n.Spec.Unschedulable {
+		return err
+	}
+	k, err := kubernetes.NewForConfig(r.config)
+	if err != nil {
+		return err
+	}
+	return nodeutil.PatchNode(ctx, k, n.Name, func(n *corev1.Node) {
+		n.Spec.Unschedulable = false
+	})
+}
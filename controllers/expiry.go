@@ -0,0 +1,88 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	machinev1 "github.com/criticalstack/machine-api/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// reconcileExpiry sets the Expired condition of a machine whose instance
+// ran longer than its maximum age, deleting its Machine when the provider
+// deletes expired machines. It returns how long until the machine expires,
+// or 0 when it has no maximum age or already expired.
+func (r *AWSMachineReconciler) reconcileExpiry(ctx context.Context, am *infrav1.AWSMachine, m *machinev1.Machine) (time.Duration, error) {
+	p, err := getProvider(ctx, r.Client, am.Namespace)
+	if err != nil {
+		return 0, err
+	}
+	var expiry infrav1.MachineExpiry
+	if p != nil && p.Spec.MachineExpiry != nil {
+		expiry = *p.Spec.MachineExpiry
+	}
+	if am.Spec.MaxAge != nil {
+		expiry.MaxAge = am.Spec.MaxAge
+	}
+	if expiry.MaxAge == nil || expiry.MaxAge.Duration <= 0 {
+		return 0, nil
+	}
+	launched := launchTime(am)
+	if launched.IsZero() {
+		launched = am.CreationTimestamp.Time
+	}
+	if remaining := time.Until(launched.Add(expiry.MaxAge.Duration)); remaining > 0 {
+		am.Status.Conditions.Set(infrav1.Condition{
+			Type:   infrav1.ExpiredCondition,
+			Status: corev1.ConditionFalse,
+			Reason: "WithinMaxAge",
+		})
+		return remaining, nil
+	}
+	if !am.Status.Conditions.IsTrue(infrav1.ExpiredCondition) {
+		r.Recorder.Eventf(am, corev1.EventTypeNormal, "Expired", "Instance launched at %s exceeded the max age of %v", launched.UTC().Format(time.RFC3339), expiry.MaxAge.Duration)
+	}
+	am.Status.Conditions.Set(infrav1.Condition{
+		Type:    infrav1.ExpiredCondition,
+		Status:  corev1.ConditionTrue,
+		Reason:  "MaxAgeExceeded",
+		Message: fmt.Sprintf("instance launched at %s exceeded the max age of %v", launched.UTC().Format(time.RFC3339), expiry.MaxAge.Duration),
+	})
+	if !expiry.DeleteExpired || !m.DeletionTimestamp.IsZero() {
+		return 0, nil
+	}
+	open, _, err := r.maintenanceWindowOpen(ctx, am)
+	if err != nil || !open {
+		return 0, err
+	}
+	machines := &infrav1.AWSMachineList{}
+	if err := r.List(ctx, machines, client.InNamespace(am.Namespace)); err != nil {
+		return 0, err
+	}
+	if deleting(machines.Items) {
+		return 0, nil
+	}
+	r.Log.Info("deleting expired machine", "machine", m.Name, "awsmachine", am.Name)
+	r.Recorder.Eventf(am, corev1.EventTypeNormal, "DeletingExpired", "Deleting machine %s", m.Name)
+	return 0, client.IgnoreNotFound(r.deleteMachine(ctx, m))
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/criticalstack/machine-api/util/patch"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// isExternallyManaged returns true if the instance of the machine is
+// managed by other tooling.
+func isExternallyManaged(am *infrav1.AWSMachine) bool {
+	return am.Annotations[infrav1.ManagedByAnnotation] != ""
+}
+
+// reconcileExternallyManaged reports the status of the instance of an
+// externally managed machine without changing it. Deleting the machine
+// leaves the instance running.
+func (r *AWSMachineReconciler) reconcileExternallyManaged(ctx context.Context, am *infrav1.AWSMachine) (_ ctrl.Result, reterr error) {
+	log := r.Log.WithValues("awsmachine", am.Namespace+"/"+am.Name, "managedBy", am.Annotations[infrav1.ManagedByAnnotation])
+
+	patchHelper, err := patch.NewHelper(am, r.Client)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	defer func() {
+		if err := patchHelper.Patch(ctx, am); err != nil {
+			if reterr == nil {
+				reterr = err
+			}
+		}
+	}()
+
+	if !am.DeletionTimestamp.IsZero() {
+		log.Info("leaving instance of externally managed machine")
+		controllerutil.RemoveFinalizer(am, infrav1.MachineFinalizer)
+		return ctrl.Result{}, nil
+	}
+	if am.Spec.ProviderID == nil {
+		log.Info("externally managed machine has no ProviderID, not launching an instance")
+		return ctrl.Result{}, nil
+	}
+	p, err := awsutil.ParseProviderID(*am.Spec.ProviderID)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	awscfg, err := r.awsConfig(ctx, am, p.Region)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	instance, ok, err := awsutil.DescribeInstance(ctx, awscfg, p.InstanceID)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	am.Status.Region = p.Region
+	setInstanceIdentity(am, p)
+	if !ok {
+		am.Status.InstanceState = ec2.InstanceStateNameTerminated
+		am.Status.Ready = false
+		return ctrl.Result{}, nil
+	}
+	setInstanceAddresses(am, instance)
+	am.Status.Architecture = aws.StringValue(instance.Architecture)
+	if instance.State != nil {
+		am.Status.InstanceState = aws.StringValue(instance.State.Name)
+	}
+	am.Status.Ready = am.Status.InstanceState == ec2.InstanceStateNameRunning
+	return ctrl.Result{}, nil
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var namespaceDeferrals = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mapa_namespace_reconciles_deferred_total",
+	Help: "Number of AWSMachine reconciles deferred because their namespace was using all of its workers.",
+}, []string{"namespace"})
+
+func init() {
+	metrics.Registry.MustRegister(namespaceDeferrals)
+}
+
+// refreshLimiter bounds how many reconcile workers may be refreshing the
+// status of healthy machines at once, keeping the remaining workers free for
+// creates and deletes. A nil refreshLimiter does not limit refreshes.
+type refreshLimiter chan struct{}
+
+func newRefreshLimiter(n int) refreshLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(refreshLimiter, n)
+}
+
+// tryAcquire reserves a refresh slot without blocking, returning false if
+// none are available.
+func (l refreshLimiter) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l refreshLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l
+}
+
+// refreshDeferral is how long a refresh is deferred when no slots are
+// available. It is jittered so that deferred refreshes do not all return to
+// the queue at once.
+func refreshDeferral() time.Duration {
+	return 5*time.Second + time.Duration(rand.Int63n(int64(5*time.Second)))
+}
+
+// statusSyncDelay is how long a ready machine waits before its status is
+// refreshed again. It is jittered by up to a fifth of the period so that
+// machines created together spread their refreshes out.
+func statusSyncDelay(period time.Duration) time.Duration {
+	return period + time.Duration(rand.Int63n(int64(period)/5+1))
+}
+
+// namespaceLimiter bounds how many reconcile workers the machines of a
+// single namespace may hold at once, so that a burst of machines created in
+// one namespace cannot starve the machines of other namespaces sharing the
+// work queue. A nil namespaceLimiter does not limit namespaces.
+type namespaceLimiter struct {
+	max int
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newNamespaceLimiter(n int) *namespaceLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return &namespaceLimiter{max: n, active: make(map[string]int)}
+}
+
+// tryAcquire reserves a worker for the namespace without blocking,
+// returning false if the namespace is using all of its workers.
+func (l *namespaceLimiter) tryAcquire(namespace string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[namespace] >= l.max {
+		namespaceDeferrals.WithLabelValues(namespace).Inc()
+		return false
+	}
+	l.active[namespace]++
+	return true
+}
+
+func (l *namespaceLimiter) release(namespace string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[namespace]--; l.active[namespace] <= 0 {
+		delete(l.active, namespace)
+	}
+}
+
+// namespaceDeferral is how long a reconcile is deferred when its namespace
+// is using all of its workers. It is shorter than a refresh deferral, since
+// the deferred machines are usually being created, and jittered so that a
+// burst returns to the queue spread out behind the machines of other
+// namespaces.
+func namespaceDeferral() time.Duration {
+	return time.Second + time.Duration(rand.Int63n(int64(2*time.Second)))
+}
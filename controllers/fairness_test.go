@@ -0,0 +1,114 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+func TestNamespaceLimiter(t *testing.T) {
+	l := newNamespaceLimiter(2)
+	for i := 0; i < 2; i++ {
+		if !l.tryAcquire("a") {
+			t.Fatalf("acquire %d: expected a worker for namespace a", i)
+		}
+	}
+	if l.tryAcquire("a") {
+		t.Fatal("expected namespace a to be using all of its workers")
+	}
+	if !l.tryAcquire("b") {
+		t.Fatal("expected namespace b not to be limited by namespace a")
+	}
+
+	l.release("a")
+	if !l.tryAcquire("a") {
+		t.Fatal("expected a released worker to be acquired again")
+	}
+	l.release("a")
+	l.release("a")
+	l.release("b")
+	if len(l.active) != 0 {
+		t.Errorf("expected released namespaces to be forgotten, got %v", l.active)
+	}
+
+	var unlimited *namespaceLimiter
+	for i := 0; i < 10; i++ {
+		if !unlimited.tryAcquire("a") {
+			t.Fatal("expected a nil limiter not to limit namespaces")
+		}
+	}
+	unlimited.release("a")
+}
+
+func TestReconcileNamespaceDeferral(t *testing.T) {
+	t.Run("create", func(t *testing.T) {
+		ec2 := newMockEC2(t)
+		r := newTestAWSMachineReconciler(t, newBootstrapObjects(nil)...)
+		r.tenants = newNamespaceLimiter(1)
+		r.tenants.tryAcquire(testNamespace)
+
+		res, err := reconcileAWSMachine(r, "m")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if res.RequeueAfter <= 0 {
+			t.Error("expected the reconcile to be deferred")
+		}
+		if n := ec2.total(); n != 0 {
+			t.Errorf("deferred reconcile made %d AWS requests", n)
+		}
+	})
+	t.Run("delete", func(t *testing.T) {
+		ec2 := newMockEC2(t)
+		now := metav1.Now()
+		am := &infrav1.AWSMachine{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "m",
+				Namespace:         testNamespace,
+				Finalizers:        []string{infrav1.MachineFinalizer},
+				DeletionTimestamp: &now,
+			},
+			Spec: infrav1.AWSMachineSpec{
+				ProviderID: pointer.StringPtr("aws:///us-east-1a/i-0123456789abcdef0"),
+			},
+		}
+		r := newTestAWSMachineReconciler(t, am)
+		r.tenants = newNamespaceLimiter(1)
+		r.tenants.tryAcquire(testNamespace)
+
+		if _, err := reconcileAWSMachine(r, am.Name); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ec2.called("DescribeInstances") == 0 {
+			t.Error("expected the delete not to be deferred")
+		}
+		updated := &infrav1.AWSMachine{}
+		if err := r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: am.Name}, updated); err != nil {
+			t.Fatal(err)
+		}
+		if len(updated.Finalizers) != 0 {
+			t.Errorf("finalizers = %v, want none", updated.Finalizers)
+		}
+	})
+}
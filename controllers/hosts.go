@@ -0,0 +1,107 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"github.com/pkg/errors"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// reconcileHost allocates a dedicated host for a machine launched with
+// placement.allocateHost, recording it in status. A host allocated by an
+// earlier attempt is found by its tags and reused.
+func (r *AWSMachineReconciler) reconcileHost(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine) error {
+	if am.Spec.Placement == nil || !am.Spec.Placement.AllocateHost || am.Spec.Placement.HostID != "" {
+		return nil
+	}
+	hosts, err := awsutil.DescribeHosts(ctx, awscfg, awsutil.MachineUIDTagKey, string(am.UID))
+	if err != nil {
+		return err
+	}
+	for _, h := range hosts {
+		am.Status.HostID = aws.StringValue(h.HostId)
+		return nil
+	}
+	id, err := awsutil.AllocateHost(ctx, awscfg, am)
+	if err != nil {
+		return err
+	}
+	r.Log.Info("allocated dedicated host", "awsmachine", am.Name, "host", id)
+	am.Status.HostID = id
+	return nil
+}
+
+// releaseHosts releases the dedicated hosts allocated for the machine once
+// its instance has terminated.
+func (r *AWSMachineReconciler) releaseHosts(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine) error {
+	if am.Spec.Placement == nil || !am.Spec.Placement.AllocateHost {
+		return nil
+	}
+	hosts, err := awsutil.DescribeHosts(ctx, awscfg, awsutil.MachineUIDTagKey, string(am.UID))
+	if err != nil || len(hosts) == 0 {
+		return err
+	}
+	ids := make([]string, 0)
+	for _, h := range hosts {
+		ids = append(ids, aws.StringValue(h.HostId))
+	}
+	r.Log.Info("releasing dedicated hosts", "awsmachine", am.Name, "hosts", ids)
+	if err := awsutil.ReleaseHosts(ctx, awscfg, ids); err != nil {
+		// the host may still list the terminated instance for a while
+		requeue := r.waitSettings(ctx, am.Namespace).DeleteRequeueInterval
+		return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: requeue}, "machine %q: %v", am.Name, err)
+	}
+	am.Status.HostID = ""
+	return nil
+}
+
+// dedicatedHosts returns the utilization of the dedicated hosts in the
+// region.
+func dedicatedHosts(ctx context.Context, awscfg *aws.Config) ([]infrav1.DedicatedHostStatus, error) {
+	hosts, err := awsutil.DescribeHosts(ctx, awscfg, "", "")
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]infrav1.DedicatedHostStatus, 0)
+	for _, h := range hosts {
+		s := infrav1.DedicatedHostStatus{
+			HostID:           aws.StringValue(h.HostId),
+			AvailabilityZone: aws.StringValue(h.AvailabilityZone),
+			State:            aws.StringValue(h.State),
+			Instances:        int32(len(h.Instances)),
+		}
+		if h.HostProperties != nil {
+			s.InstanceType = aws.StringValue(h.HostProperties.InstanceType)
+			if s.InstanceType == "" {
+				s.InstanceType = aws.StringValue(h.HostProperties.InstanceFamily)
+			}
+		}
+		if h.AvailableCapacity != nil {
+			for _, c := range h.AvailableCapacity.AvailableInstanceCapacity {
+				s.AvailableCapacity += int32(aws.Int64Value(c.AvailableCapacity))
+			}
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// imageReplicationWait is how long a machine waits for the copy of the AMI
+// of its image replication to become available.
+const imageReplicationWait = time.Minute
+
+// reconcileImageReplications copies the AMIs of the image replications of
+// the provider to their regions, recording the copies in status. The
+// previous status of a replication is kept when it cannot be reconciled, so
+// that machines can still use the copies already made.
+func (r *AWSInfrastructureProviderReconciler) reconcileImageReplications(ctx context.Context, ip *infrav1.AWSInfrastructureProvider) error {
+	previous := make(map[string]infrav1.ImageReplicationStatus)
+	for _, s := range ip.Status.ImageReplications {
+		previous[s.Name] = s
+	}
+	statuses := make([]infrav1.ImageReplicationStatus, 0, len(ip.Spec.ImageReplications))
+	var reterr error
+	for i := range ip.Spec.ImageReplications {
+		rep := &ip.Spec.ImageReplications[i]
+		status, err := r.reconcileImageReplication(ctx, ip, rep, previous[rep.Name])
+		if err != nil {
+			if reterr == nil {
+				reterr = errors.Wrapf(err, "image replication %q", rep.Name)
+			}
+			if s, ok := previous[rep.Name]; ok {
+				statuses = append(statuses, s)
+			}
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+	ip.Status.ImageReplications = statuses
+	return reterr
+}
+
+func (r *AWSInfrastructureProviderReconciler) reconcileImageReplication(ctx context.Context, ip *infrav1.AWSInfrastructureProvider, rep *infrav1.ImageReplication, previous infrav1.ImageReplicationStatus) (infrav1.ImageReplicationStatus, error) {
+	sourceRegion := rep.SourceRegion
+	if sourceRegion == "" {
+		sourceRegion = ip.Status.Region
+	}
+	status := infrav1.ImageReplicationStatus{
+		Name:      rep.Name,
+		SourceAMI: rep.SourceAMI,
+		AMIs:      map[string]string{sourceRegion: rep.SourceAMI},
+	}
+	replication := ip.Namespace + "/" + rep.Name
+	for _, region := range rep.Regions {
+		if region == sourceRegion {
+			continue
+		}
+		awscfg := &aws.Config{Region: aws.String(region)}
+		copies, err := awsutil.DescribeImageCopies(ctx, awscfg, replication, rep.SourceAMI)
+		if err != nil {
+			return status, errors.Wrapf(err, "region %s", region)
+		}
+		if len(copies) == 0 {
+			id, err := awsutil.CopyImage(ctx, awscfg, replication, rep.SourceAMI, sourceRegion, awsutil.ImageCopyOptions{
+				Encrypted: rep.Encrypted,
+				KMSKeyID:  rep.KMSKeyID,
+			}, ip.Spec.AdditionalTags)
+			if err != nil {
+				return status, errors.Wrapf(err, "region %s", region)
+			}
+			r.Recorder.Eventf(ip, corev1.EventTypeNormal, "CopyingImage", "Copying AMI %s from %s to %s as %s", rep.SourceAMI, sourceRegion, region, id)
+			status.Pending = append(status.Pending, region)
+			continue
+		}
+		image := copies[0]
+		switch aws.StringValue(image.State) {
+		case ec2.ImageStateAvailable:
+			status.AMIs[region] = aws.StringValue(image.ImageId)
+		case ec2.ImageStatePending:
+			status.Pending = append(status.Pending, region)
+		default:
+			if !containsString(previous.Failed, region) {
+				r.Recorder.Eventf(ip, corev1.EventTypeWarning, "ImageCopyFailed", "Copy %s of AMI %s to %s failed: %s",
+					aws.StringValue(image.ImageId), rep.SourceAMI, region, imageStateReason(image))
+			}
+			status.Failed = append(status.Failed, region)
+		}
+	}
+	sort.Strings(status.Pending)
+	sort.Strings(status.Failed)
+	return status, nil
+}
+
+func imageStateReason(image *ec2.Image) string {
+	if image.StateReason != nil && image.StateReason.Message != nil {
+		return aws.StringValue(image.StateReason.Message)
+	}
+	return aws.StringValue(image.State)
+}
+
+// replicatedAMI returns the copy of the AMI of the image replication in the
+// region. A RequeueAfterError is returned while the copy is not available.
+func replicatedAMI(p *infrav1.AWSInfrastructureProvider, name, region string) (string, error) {
+	if p == nil {
+		return "", awsutil.NewConfigurationError("image replication %q requires a provider", name)
+	}
+	found := false
+	for _, rep := range p.Spec.ImageReplications {
+		found = found || rep.Name == name
+	}
+	if !found {
+		return "", awsutil.NewConfigurationError("image replication %q is not one of the image replications of provider %q", name, p.Name)
+	}
+	for _, s := range p.Status.ImageReplications {
+		if s.Name != name {
+			continue
+		}
+		if ami, ok := s.AMIs[region]; ok {
+			return ami, nil
+		}
+		if containsString(s.Failed, region) {
+			return "", awsutil.NewConfigurationError("copy of AMI %s to region %q failed", s.SourceAMI, region)
+		}
+	}
+	return "", errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: imageReplicationWait}, "waiting for image replication %q to copy AMI to region %q", name, region)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
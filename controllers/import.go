@@ -0,0 +1,198 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// importInstances creates AWSMachines in the provider namespace for
+// instances in the provider region with the tag described by filter
+// (key=value). Instances that already belong to an AWSMachine are skipped.
+//
+// Each instance is first tagged with the name of its AWSMachine, which
+// claims it for this namespace, and then tagged with the UID of the created
+// AWSMachine, so that an import interrupted in between is resumed by the
+// next attempt rather than creating a second AWSMachine.
+func (r *AWSInfrastructureProviderReconciler) importInstances(ctx context.Context, ip *infrav1.AWSInfrastructureProvider, filter string) error {
+	log := r.Log.WithValues("awsinfrastructureprovider", client.ObjectKey{Namespace: ip.Namespace, Name: ip.Name})
+
+	parts := strings.SplitN(filter, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return errors.Errorf("invalid import tag filter %q, must be in the form key=value", filter)
+	}
+	region, err := awsutil.ResolveRegion(ip.Spec.Region)
+	if err != nil {
+		return err
+	}
+	awscfg := &aws.Config{Region: aws.String(region)}
+	var credentialsRef *corev1.LocalObjectReference
+	if name := ip.GetAnnotations()[infrav1.ImportCredentialsAnnotation]; name != "" {
+		creds, err := resolveCredentials(ctx, r.Client, ip.Namespace, name, region)
+		if err != nil {
+			return err
+		}
+		awscfg.Credentials = creds
+		credentialsRef = &corev1.LocalObjectReference{Name: name}
+	}
+	instances, err := awsutil.DescribeInstancesByTag(ctx, awscfg, parts[0], parts[1])
+	if err != nil {
+		return err
+	}
+	machines := &infrav1.AWSMachineList{}
+	if err := r.List(ctx, machines); err != nil {
+		return err
+	}
+	owners := make(map[string]string)
+	for _, am := range machines.Items {
+		if am.Spec.ProviderID != nil {
+			owners[providerInstanceID(*am.Spec.ProviderID)] = am.Namespace + "/" + am.Name
+		}
+	}
+	for _, instance := range instances {
+		if hasTag(instance.Tags, awsutil.MachineUIDTagKey) {
+			continue
+		}
+		// AWSMachines are named after their instance
+		id := aws.StringValue(instance.InstanceId)
+		name := ip.Namespace + "/" + id
+		if owner, ok := owners[id]; ok && owner != name {
+			continue
+		}
+		if claimed, ok := awsutil.TagValue(instance.Tags, awsutil.MachineNameTagKey); ok && claimed != name {
+			log.V(1).Info("instance is claimed by another AWSMachine, not importing", "instance", id, "awsmachine", claimed)
+			continue
+		}
+		am, err := awsMachineFromInstance(ctx, awscfg, instance)
+		if err != nil {
+			return err
+		}
+		am.Namespace = ip.Namespace
+		am.Spec.CredentialsRef = credentialsRef
+		if err := awsutil.CreateTags(ctx, awscfg, id, map[string]string{awsutil.MachineNameTagKey: name}); err != nil {
+			return err
+		}
+		if err := r.Create(ctx, am); err != nil && !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+		// the UID of an AWSMachine created by an earlier attempt is only
+		// known once read back
+		if err := r.Get(ctx, client.ObjectKey{Namespace: am.Namespace, Name: am.Name}, am); err != nil {
+			return err
+		}
+		if am.Spec.ProviderID == nil || providerInstanceID(*am.Spec.ProviderID) != id {
+			return errors.Errorf("AWSMachine %s exists for another instance", name)
+		}
+		if err := awsutil.CreateTags(ctx, awscfg, id, awsutil.OwnerTags(am)); err != nil {
+			return err
+		}
+		log.Info("imported instance", "instance", id, "awsmachine", am.Name)
+	}
+	return nil
+}
+
+// awsMachineFromInstance reconstructs an AWSMachine spec from an existing
+// instance. The AWSMachine is named after the instance ID.
+func awsMachineFromInstance(ctx context.Context, awscfg *aws.Config, instance *ec2.Instance) (*infrav1.AWSMachine, error) {
+	az := aws.StringValue(instance.Placement.AvailabilityZone)
+	am := &infrav1.AWSMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: aws.StringValue(instance.InstanceId),
+		},
+		Spec: infrav1.AWSMachineSpec{
+			ProviderID:       pointer.StringPtr(fmt.Sprintf("aws:///%s/%s", az, aws.StringValue(instance.InstanceId))),
+			AMI:              aws.StringValue(instance.ImageId),
+			InstanceType:     aws.StringValue(instance.InstanceType),
+			KeyName:          aws.StringValue(instance.KeyName),
+			AvailabilityZone: az,
+			Region:           awsutil.ParseRegionFromAZ(az),
+			VPCID:            aws.StringValue(instance.VpcId),
+			PublicIP:         aws.StringValue(instance.PublicIpAddress) != "",
+			Tags:             make(map[string]string),
+		},
+	}
+	if instance.SubnetId != nil {
+		am.Spec.SubnetIDs = []string{aws.StringValue(instance.SubnetId)}
+	}
+	if instance.IamInstanceProfile != nil {
+		am.Spec.IAMInstanceProfile = aws.StringValue(instance.IamInstanceProfile.Arn)
+	}
+	if aws.StringValue(instance.Platform) == ec2.PlatformValuesWindows {
+		am.Spec.OSFamily = infrav1.OSFamilyWindows
+	}
+	for _, sg := range instance.SecurityGroups {
+		am.Spec.SecurityGroupIDs = append(am.Spec.SecurityGroupIDs, aws.StringValue(sg.GroupId))
+	}
+	for _, t := range instance.Tags {
+		// owner tags are set for the AWSMachine rather than being part of
+		// its spec
+		switch key := aws.StringValue(t.Key); {
+		case strings.HasPrefix(key, "aws:"), key == awsutil.MachineNameTagKey, key == awsutil.MachineUIDTagKey:
+			continue
+		}
+		am.Spec.Tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	for _, bd := range instance.BlockDeviceMappings {
+		if bd.Ebs == nil {
+			continue
+		}
+		v, err := awsutil.DescribeVolume(ctx, awscfg, aws.StringValue(bd.Ebs.VolumeId))
+		if err != nil {
+			return nil, err
+		}
+		device := infrav1.AWSBlockDeviceMapping{
+			DeviceName: aws.StringValue(bd.DeviceName),
+			VolumeSize: aws.Int64Value(v.Size),
+			VolumeType: aws.StringValue(v.VolumeType),
+			Encrypted:  aws.BoolValue(v.Encrypted),
+		}
+		// the root device is always first in the spec
+		if aws.StringValue(bd.DeviceName) == aws.StringValue(instance.RootDeviceName) {
+			am.Spec.BlockDevices = append([]infrav1.AWSBlockDeviceMapping{device}, am.Spec.BlockDevices...)
+		} else {
+			am.Spec.BlockDevices = append(am.Spec.BlockDevices, device)
+		}
+	}
+	behavior, err := awsutil.DescribeInstanceShutdownBehavior(ctx, awscfg, aws.StringValue(instance.InstanceId))
+	if err != nil {
+		return nil, err
+	}
+	am.Spec.InstanceInitiatedShutdownBehavior = behavior
+	if instance.HibernationOptions != nil && aws.BoolValue(instance.HibernationOptions.Configured) {
+		am.Spec.HibernationOptions = &infrav1.HibernationOptions{Configured: true}
+	}
+	return am, nil
+}
+
+func hasTag(tags []*ec2.Tag, key string) bool {
+	_, ok := awsutil.TagValue(tags, key)
+	return ok
+}
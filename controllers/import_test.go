@@ -0,0 +1,185 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+func TestImportInstances(t *testing.T) {
+	const id = "i-0123456789abcdef0"
+	name := testNamespace + "/" + id
+	legacy := func(tags map[string]string) *mockInstance {
+		i := &mockInstance{State: "running", Tags: map[string]string{"env": "legacy"}}
+		for k, v := range tags {
+			i.Tags[k] = v
+		}
+		return i
+	}
+	cases := []struct {
+		name        string
+		instance    *mockInstance
+		objs        []runtime.Object
+		credentials string
+		imported    bool
+		wantErr     bool
+	}{
+		{
+			name:     "new instance",
+			instance: legacy(nil),
+			imported: true,
+		},
+		{
+			name:     "interrupted after claiming the instance",
+			instance: legacy(map[string]string{awsutil.MachineNameTagKey: name}),
+			imported: true,
+		},
+		{
+			name:     "interrupted after creating the AWSMachine",
+			instance: legacy(map[string]string{awsutil.MachineNameTagKey: name}),
+			objs: []runtime.Object{&infrav1.AWSMachine{
+				ObjectMeta: metav1.ObjectMeta{Name: id, Namespace: testNamespace, UID: types.UID("uid")},
+				Spec:       infrav1.AWSMachineSpec{ProviderID: pointer.StringPtr("aws:///us-east-1a/" + id)},
+			}},
+			imported: true,
+		},
+		{
+			name:     "claimed by another namespace",
+			instance: legacy(map[string]string{awsutil.MachineNameTagKey: "other/" + id}),
+		},
+		{
+			name:     "launched by an AWSMachine",
+			instance: legacy(map[string]string{awsutil.MachineUIDTagKey: "uid"}),
+		},
+		{
+			name:     "adopted by the node controller",
+			instance: legacy(nil),
+			objs: []runtime.Object{&infrav1.AWSMachine{
+				ObjectMeta: metav1.ObjectMeta{Name: "ip-10-0-0-1", Namespace: testNamespace},
+				Spec:       infrav1.AWSMachineSpec{ProviderID: pointer.StringPtr("aws:///us-east-1a/" + id)},
+			}},
+		},
+		{
+			name:     "AWSMachine of another instance",
+			instance: legacy(map[string]string{awsutil.MachineNameTagKey: name}),
+			objs: []runtime.Object{&infrav1.AWSMachine{
+				ObjectMeta: metav1.ObjectMeta{Name: id, Namespace: testNamespace},
+				Spec:       infrav1.AWSMachineSpec{ProviderID: pointer.StringPtr("aws:///us-east-1a/i-0fedcba9876543210")},
+			}},
+			wantErr: true,
+		},
+		{
+			name:     "with credentials",
+			instance: legacy(nil),
+			objs: []runtime.Object{
+				&infrav1.AWSCredentials{
+					ObjectMeta: metav1.ObjectMeta{Name: "legacy", Namespace: testNamespace},
+					Spec:       infrav1.AWSCredentialsSpec{SecretRef: &corev1.LocalObjectReference{Name: "legacy"}},
+				},
+				&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "legacy", Namespace: testNamespace},
+					Data:       map[string][]byte{"AWS_ACCESS_KEY_ID": []byte("AKIDLEGACY"), "AWS_SECRET_ACCESS_KEY": []byte("secret")},
+				},
+			},
+			credentials: "legacy",
+			imported:    true,
+		},
+		{
+			name:        "missing credentials",
+			instance:    legacy(nil),
+			credentials: "legacy",
+			wantErr:     true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ec2 := newMockEC2(t)
+			ec2.instances[id] = tc.instance
+			owner := tc.instance.Tags[awsutil.MachineUIDTagKey]
+			ec2.instances["i-0fedcba9876543210"] = &mockInstance{State: "running"}
+			ip := &infrav1.AWSInfrastructureProvider{
+				ObjectMeta: metav1.ObjectMeta{Name: "provider", Namespace: testNamespace},
+				Spec:       infrav1.AWSInfrastructureProviderSpec{Region: "us-east-1"},
+			}
+			if tc.credentials != "" {
+				ip.Annotations = map[string]string{infrav1.ImportCredentialsAnnotation: tc.credentials}
+			}
+			r := &AWSInfrastructureProviderReconciler{
+				Client: fake.NewFakeClientWithScheme(newTestScheme(t), tc.objs...),
+				Log:    log.NullLogger{},
+			}
+
+			// a second attempt finds nothing left to do
+			for attempt := 0; attempt < 2; attempt++ {
+				err := r.importInstances(context.Background(), ip, "env=legacy")
+				if (err != nil) != tc.wantErr {
+					t.Fatalf("attempt %d: err = %v, want error %v", attempt, err, tc.wantErr)
+				}
+			}
+			am := &infrav1.AWSMachine{}
+			err := r.Get(context.Background(), client.ObjectKey{Namespace: testNamespace, Name: id}, am)
+			if imported := err == nil && !tc.wantErr; imported != tc.imported {
+				t.Fatalf("imported = %v, want %v", imported, tc.imported)
+			}
+			machines := &infrav1.AWSMachineList{}
+			if err := r.List(context.Background(), machines); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(machinesOfInstance(machines.Items, id)); n > 1 {
+				t.Errorf("instance was imported into %d AWSMachines", n)
+			}
+			if !tc.imported {
+				if tc.instance.Tags[awsutil.MachineUIDTagKey] != owner {
+					t.Errorf("owner tag = %q, want %q", tc.instance.Tags[awsutil.MachineUIDTagKey], owner)
+				}
+				return
+			}
+			if tc.instance.Tags[awsutil.MachineNameTagKey] != name || tc.instance.Tags[awsutil.MachineUIDTagKey] != string(am.UID) {
+				t.Errorf("instance tags = %v, want the owner tags of %s", tc.instance.Tags, name)
+			}
+			if _, ok := am.Spec.Tags[awsutil.MachineNameTagKey]; ok {
+				t.Errorf("spec tags = %v, want no owner tags", am.Spec.Tags)
+			}
+			if tc.credentials != "" && (am.Spec.CredentialsRef == nil || am.Spec.CredentialsRef.Name != tc.credentials) {
+				t.Errorf("credentialsRef = %v, want %s", am.Spec.CredentialsRef, tc.credentials)
+			}
+		})
+	}
+}
+
+func machinesOfInstance(machines []infrav1.AWSMachine, id string) []infrav1.AWSMachine {
+	found := make([]infrav1.AWSMachine, 0)
+	for _, am := range machines {
+		if am.Spec.ProviderID != nil && providerInstanceID(*am.Spec.ProviderID) == id {
+			found = append(found, am)
+		}
+	}
+	return found
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+const (
+	// instanceIDField is the field index of AWSMachines by the ID of their
+	// instance.
+	instanceIDField = "status.instanceID"
+
+	// nodeInstanceIDField is the field index of Nodes by the ID of the
+	// instance in their ProviderID.
+	nodeInstanceIDField = "spec.providerID"
+)
+
+// IndexInstanceID registers the field indexes of AWSMachines and Nodes by
+// instance ID, which the AWSMachine and Node controllers and the instance
+// state listener look machines and nodes up by. It must be registered once
+// before the manager starts.
+func IndexInstanceID(ctx context.Context, indexer client.FieldIndexer) error {
+	if err := indexer.IndexField(ctx, &infrav1.AWSMachine{}, instanceIDField, func(o runtime.Object) []string {
+		if id := machineInstanceID(o.(*infrav1.AWSMachine)); id != "" {
+			return []string{id}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return indexer.IndexField(ctx, &corev1.Node{}, nodeInstanceIDField, func(o runtime.Object) []string {
+		if id := providerInstanceID(o.(*corev1.Node).Spec.ProviderID); id != "" {
+			return []string{id}
+		}
+		return nil
+	})
+}
+
+// machineInstanceID returns the ID of the instance of the machine. It is
+// parsed from the ProviderID of machines whose status.instanceID has not
+// been recorded yet, e.g. machines launched by earlier releases.
+func machineInstanceID(am *infrav1.AWSMachine) string {
+	if am.Status.InstanceID != "" {
+		return am.Status.InstanceID
+	}
+	if am.Spec.ProviderID == nil {
+		return ""
+	}
+	p, err := awsutil.ParseProviderID(*am.Spec.ProviderID)
+	if err != nil {
+		return ""
+	}
+	return p.InstanceID
+}
+
+// providerInstanceID returns the instance ID of the ProviderID, or the
+// ProviderID itself if it is not an EC2 ProviderID, see sameInstance.
+func providerInstanceID(providerID string) string {
+	p, err := awsutil.ParseProviderID(providerID)
+	if err != nil {
+		return providerID
+	}
+	return p.InstanceID
+}
+
+// nodesForInstance returns the Nodes registered by the instance with the
+// ProviderID.
+func nodesForInstance(ctx context.Context, c client.Reader, providerID string) ([]corev1.Node, error) {
+	nodes := &corev1.NodeList{}
+	if err := c.List(ctx, nodes, client.MatchingFields{nodeInstanceIDField: providerInstanceID(providerID)}); err != nil {
+		return nil, err
+	}
+	// not every client applies the index, e.g. the fake client of tests
+	found := make([]corev1.Node, 0, 1)
+	for _, n := range nodes.Items {
+		if n.Spec.ProviderID != "" && sameInstance(providerID, n.Spec.ProviderID) {
+			found = append(found, n)
+		}
+	}
+	return found, nil
+}
+
+// machinesForInstance returns the AWSMachines of the instance.
+func machinesForInstance(ctx context.Context, c client.Reader, instanceID string) ([]infrav1.AWSMachine, error) {
+	machines := &infrav1.AWSMachineList{}
+	if err := c.List(ctx, machines, client.MatchingFields{instanceIDField: instanceID}); err != nil {
+		return nil, err
+	}
+	// not every client applies the index, e.g. the fake client of tests
+	found := make([]infrav1.AWSMachine, 0, 1)
+	for _, am := range machines.Items {
+		if machineInstanceID(&am) == instanceID {
+			found = append(found, am)
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	machinev1 "github.com/criticalstack/machine-api/api/v1alpha1"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+const (
+	// InventoryFormatJSON exports the inventory as a JSON array.
+	InventoryFormatJSON = "json"
+
+	// InventoryFormatCSV exports the inventory as CSV with a header row.
+	InventoryFormatCSV = "csv"
+
+	// inventoryExportTimeout bounds each export.
+	inventoryExportTimeout = time.Minute
+
+	// maxConfigMapSize is the most data a ConfigMap can hold.
+	maxConfigMapSize = 1 << 20
+)
+
+// inventoryRecord is the inventory entry of an AWSMachine.
+type inventoryRecord struct {
+	Namespace        string            `json:"namespace"`
+	Name             string            `json:"name"`
+	UID              string            `json:"uid"`
+	Machine          string            `json:"machine,omitempty"`
+	InstanceID       string            `json:"instanceID,omitempty"`
+	InstanceType     string            `json:"instanceType,omitempty"`
+	InstanceState    string            `json:"instanceState,omitempty"`
+	Region           string            `json:"region,omitempty"`
+	AvailabilityZone string            `json:"availabilityZone,omitempty"`
+	PrivateIPs       []string          `json:"privateIPs,omitempty"`
+	PublicIPs        []string          `json:"publicIPs,omitempty"`
+	Tags             map[string]string `json:"tags,omitempty"`
+	Ready            bool              `json:"ready"`
+}
+
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;create;update
+
+// InventoryExporter periodically exports a snapshot of all AWSMachines, with
+// their instances, addresses, tags and owning Machine, to an S3 object
+// and/or a ConfigMap, for asset inventory systems that cannot query the
+// Kubernetes API.
+type InventoryExporter struct {
+	client.Client
+	Log logr.Logger
+
+	// Interval is how often the inventory is exported.
+	Interval time.Duration
+
+	// Format is InventoryFormatJSON or InventoryFormatCSV.
+	Format string
+
+	// Bucket and Key are the S3 object the inventory is written to. Not
+	// written when Bucket is empty.
+	Bucket string
+	Key    string
+
+	// ConfigMap is the ConfigMap the inventory is written to, in the key
+	// named after the format. Not written when the name is empty.
+	ConfigMap types.NamespacedName
+
+	reader client.Reader
+}
+
+func (e *InventoryExporter) SetupWithManager(mgr ctrl.Manager) error {
+	if e.Format != InventoryFormatJSON && e.Format != InventoryFormatCSV {
+		return errors.Errorf("unknown inventory format %q", e.Format)
+	}
+	// ConfigMaps are read directly rather than cached cluster-wide
+	e.reader = mgr.GetAPIReader()
+	return mgr.Add(e)
+}
+
+// NeedLeaderElection ensures that only the leader exports the inventory.
+func (e *InventoryExporter) NeedLeaderElection() bool {
+	return true
+}
+
+// Start exports the inventory every Interval until stop is closed.
+func (e *InventoryExporter) Start(stop <-chan struct{}) error {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		if err := e.export(); err != nil {
+			e.Log.Error(err, "cannot export inventory", awsutil.LogValues(err)...)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+func (e *InventoryExporter) export() error {
+	ctx, cancel := context.WithTimeout(context.Background(), inventoryExportTimeout)
+	defer cancel()
+	ams := &infrav1.AWSMachineList{}
+	if err := e.List(ctx, ams); err != nil {
+		return err
+	}
+	records := make([]inventoryRecord, 0, len(ams.Items))
+	for i := range ams.Items {
+		records = append(records, inventoryRecordOf(&ams.Items[i]))
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Namespace != records[j].Namespace {
+			return records[i].Namespace < records[j].Namespace
+		}
+		return records[i].Name < records[j].Name
+	})
+	data, contentType, err := encodeInventory(records, e.Format)
+	if err != nil {
+		return err
+	}
+	if e.Bucket != "" {
+		awscfg := &aws.Config{Region: aws.String(awsutil.DefaultRegion)}
+		if err := awsutil.PutObject(ctx, awscfg, e.Bucket, e.Key, contentType, data); err != nil {
+			return errors.Wrapf(err, "cannot write inventory to s3://%s/%s", e.Bucket, e.Key)
+		}
+	}
+	if e.ConfigMap.Name != "" {
+		if err := e.writeConfigMap(ctx, data); err != nil {
+			return errors.Wrapf(err, "cannot write inventory to ConfigMap %s", e.ConfigMap)
+		}
+	}
+	e.Log.V(1).Info("exported inventory", "machines", len(records))
+	return nil
+}
+
+func (e *InventoryExporter) writeConfigMap(ctx context.Context, data []byte) error {
+	if len(data) > maxConfigMapSize {
+		return errors.Errorf("inventory of %d bytes exceeds the ConfigMap limit of %d bytes", len(data), maxConfigMapSize)
+	}
+	key := "inventory." + e.Format
+	cm := &corev1.ConfigMap{}
+	err := e.reader.Get(ctx, e.ConfigMap, cm)
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: e.ConfigMap.Namespace, Name: e.ConfigMap.Name},
+			Data:       map[string]string{key: string(data)},
+		}
+		return e.Create(ctx, cm)
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[key] = string(data)
+	return e.Update(ctx, cm)
+}
+
+func inventoryRecordOf(am *infrav1.AWSMachine) inventoryRecord {
+	rec := inventoryRecord{
+		Namespace:        am.Namespace,
+		Name:             am.Name,
+		UID:              string(am.UID),
+		InstanceID:       am.Status.InstanceID,
+		InstanceType:     am.Spec.InstanceType,
+		InstanceState:    am.Status.InstanceState,
+		Region:           am.Status.Region,
+		AvailabilityZone: am.Status.AvailabilityZone,
+		Tags:             am.Spec.Tags,
+		Ready:            am.Status.Ready,
+	}
+	for _, ref := range am.OwnerReferences {
+		if ref.Kind == "Machine" {
+			rec.Machine = ref.Name
+		}
+	}
+	for _, addr := range am.Status.Addresses {
+		switch addr.Type {
+		case machinev1.MachineInternalIP:
+			rec.PrivateIPs = append(rec.PrivateIPs, addr.Address)
+		case machinev1.MachineExternalIP:
+			rec.PublicIPs = append(rec.PublicIPs, addr.Address)
+		}
+	}
+	return rec
+}
+
+// encodeInventory encodes the records in the format, returning the content
+// type of the encoding. Lists and tags are joined with semicolons in CSV.
+func encodeInventory(records []inventoryRecord, format string) ([]byte, string, error) {
+	if format == InventoryFormatJSON {
+		b, err := json.Marshal(records)
+		return b, "application/json", err
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"namespace", "name", "uid", "machine", "instanceID", "instanceType", "instanceState",
+		"region", "availabilityZone", "privateIPs", "publicIPs", "tags", "ready"})
+	for _, rec := range records {
+		tags := make([]string, 0, len(rec.Tags))
+		for k, v := range rec.Tags {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+		w.Write([]string{rec.Namespace, rec.Name, rec.UID, rec.Machine, rec.InstanceID, rec.InstanceType, rec.InstanceState,
+			rec.Region, rec.AvailabilityZone, strings.Join(rec.PrivateIPs, ";"), strings.Join(rec.PublicIPs, ";"),
+			strings.Join(tags, ";"), strconv.FormatBool(rec.Ready)})
+	}
+	w.Flush()
+	return buf.Bytes(), "text/csv", w.Error()
+}
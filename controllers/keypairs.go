@@ -0,0 +1,193 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// keyPairSecretName returns the name of the Secret holding the private keys
+// of the key pairs created for the provider.
+func keyPairSecretName(ip *infrav1.AWSInfrastructureProvider) string {
+	return ip.Name + "-keypair"
+}
+
+// keyPairRegions returns the regions the key pair of the provider is
+// managed in: the region of the provider and each of its regions.
+func keyPairRegions(ip *infrav1.AWSInfrastructureProvider) []string {
+	regions := []string{ip.Status.Region}
+	for _, r := range ip.Spec.Regions {
+		if !containsString(regions, r.Name) {
+			regions = append(regions, r.Name)
+		}
+	}
+	return regions
+}
+
+// addKeyPairFinalizer adds the finalizer of a provider that requests a key
+// pair, before any key pair is created. It is patched before the status of
+// the provider is computed, since the patch replaces the provider with the
+// stored one.
+func (r *AWSInfrastructureProviderReconciler) addKeyPairFinalizer(ctx context.Context, ip *infrav1.AWSInfrastructureProvider) error {
+	if ip.Spec.KeyPair == nil || containsString(ip.Finalizers, infrav1.ProviderFinalizer) {
+		return nil
+	}
+	patch := client.MergeFrom(ip.DeepCopy())
+	controllerutil.AddFinalizer(ip, infrav1.ProviderFinalizer)
+	return r.Patch(ctx, ip, patch)
+}
+
+// reconcileKeyPairs creates or imports the key pair of the provider in each
+// of its regions, and deletes the key pairs it managed that are no longer
+// wanted. The finalizer of the provider, see addKeyPairFinalizer, is
+// removed once it no longer manages key pairs.
+func (r *AWSInfrastructureProviderReconciler) reconcileKeyPairs(ctx context.Context, ip *infrav1.AWSInfrastructureProvider) error {
+	kp := ip.Spec.KeyPair
+	var regions []string
+	if kp != nil {
+		regions = keyPairRegions(ip)
+	}
+	statuses := make([]infrav1.KeyPairStatus, 0, len(regions))
+	var reterr error
+	for _, s := range ip.Status.KeyPairs {
+		if kp != nil && s.Name == kp.Name && containsString(regions, s.Region) {
+			continue
+		}
+		if err := r.deleteKeyPair(ctx, ip, s); err != nil {
+			if reterr == nil {
+				reterr = errors.Wrapf(err, "key pair %q in %s", s.Name, s.Region)
+			}
+			statuses = append(statuses, s)
+		}
+	}
+	for _, region := range regions {
+		status, err := r.reconcileKeyPair(ctx, ip, region)
+		if err != nil {
+			if reterr == nil {
+				reterr = errors.Wrapf(err, "key pair %q in %s", kp.Name, region)
+			}
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+	ip.Status.KeyPairs = statuses
+	if kp == nil && len(statuses) == 0 && containsString(ip.Finalizers, infrav1.ProviderFinalizer) {
+		// keep the status computed so far, which the patch replaces
+		status := ip.Status.DeepCopy()
+		patch := client.MergeFrom(ip.DeepCopy())
+		controllerutil.RemoveFinalizer(ip, infrav1.ProviderFinalizer)
+		if err := r.Patch(ctx, ip, patch); err != nil {
+			return err
+		}
+		ip.Status = *status
+	}
+	return reterr
+}
+
+func (r *AWSInfrastructureProviderReconciler) reconcileKeyPair(ctx context.Context, ip *infrav1.AWSInfrastructureProvider, region string) (infrav1.KeyPairStatus, error) {
+	kp := ip.Spec.KeyPair
+	provider := ip.Namespace + "/" + ip.Name
+	awscfg := &aws.Config{Region: aws.String(region)}
+	status := infrav1.KeyPairStatus{Region: region, Name: kp.Name}
+	existing, err := awsutil.DescribeKeyPair(ctx, awscfg, kp.Name)
+	if err != nil {
+		return status, err
+	}
+	if existing != nil {
+		if !awsutil.KeyPairManagedBy(existing, provider) {
+			return status, awsutil.NewConfigurationError("key pair %q already exists in %s and was not created for this provider", kp.Name, region)
+		}
+		status.KeyPairID = aws.StringValue(existing.KeyPairId)
+		status.Fingerprint = aws.StringValue(existing.KeyFingerprint)
+		return status, nil
+	}
+	if kp.PublicKey != "" {
+		status.KeyPairID, status.Fingerprint, err = awsutil.ImportKeyPair(ctx, awscfg, kp.Name, kp.PublicKey, provider)
+		if err != nil {
+			return status, err
+		}
+		r.Recorder.Eventf(ip, corev1.EventTypeNormal, "KeyPairImported", "Imported key pair %s in %s", kp.Name, region)
+		return status, nil
+	}
+	var privateKey string
+	status.KeyPairID, status.Fingerprint, privateKey, err = awsutil.CreateKeyPair(ctx, awscfg, kp.Name, provider)
+	if err != nil {
+		return status, err
+	}
+	if err := r.storePrivateKey(ctx, ip, region, privateKey); err != nil {
+		// The private key cannot be retrieved again, so the key pair is
+		// deleted for it to be created again on the next reconcile.
+		if derr := awsutil.DeleteKeyPair(ctx, awscfg, status.KeyPairID); derr != nil {
+			return status, errors.Wrapf(derr, "cannot delete key pair after failing to store its private key: %v", err)
+		}
+		return status, err
+	}
+	r.Recorder.Eventf(ip, corev1.EventTypeNormal, "KeyPairCreated", "Created key pair %s in %s", kp.Name, region)
+	return status, nil
+}
+
+// storePrivateKey adds the private key of the key pair in the region to the
+// key pair Secret of the provider.
+func (r *AWSInfrastructureProviderReconciler) storePrivateKey(ctx context.Context, ip *infrav1.AWSInfrastructureProvider, region, privateKey string) error {
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      keyPairSecretName(ip),
+			Namespace: ip.Namespace,
+		},
+	}
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, s, func() error {
+		if s.Data == nil {
+			s.Data = make(map[string][]byte)
+		}
+		s.Data[region] = []byte(privateKey)
+		return controllerutil.SetControllerReference(ip, s, r.Scheme)
+	})
+	return err
+}
+
+func (r *AWSInfrastructureProviderReconciler) deleteKeyPair(ctx context.Context, ip *infrav1.AWSInfrastructureProvider, s infrav1.KeyPairStatus) error {
+	if err := awsutil.DeleteKeyPair(ctx, &aws.Config{Region: aws.String(s.Region)}, s.KeyPairID); err != nil {
+		return err
+	}
+	r.Recorder.Eventf(ip, corev1.EventTypeNormal, "KeyPairDeleted", "Deleted key pair %s in %s", s.Name, s.Region)
+	return nil
+}
+
+// reconcileDelete deletes the key pairs managed for the provider before
+// removing its finalizer.
+func (r *AWSInfrastructureProviderReconciler) reconcileDelete(ctx context.Context, ip *infrav1.AWSInfrastructureProvider) error {
+	if !containsString(ip.Finalizers, infrav1.ProviderFinalizer) {
+		return nil
+	}
+	for _, s := range ip.Status.KeyPairs {
+		if err := r.deleteKeyPair(ctx, ip, s); err != nil {
+			return errors.Wrapf(err, "key pair %q in %s", s.Name, s.Region)
+		}
+	}
+	controllerutil.RemoveFinalizer(ip, infrav1.ProviderFinalizer)
+	return r.Update(ctx, ip)
+}
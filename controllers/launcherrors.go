@@ -0,0 +1,113 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	machinev1 "github.com/criticalstack/machine-api/api/v1alpha1"
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// launchErrorClass describes a RunInstances error code.
+type launchErrorClass struct {
+	reason mapierrors.MachineStatusError
+
+	// terminal errors cannot succeed when retried without changing the
+	// spec, so the machine fails on the first occurrence.
+	terminal bool
+
+	// hint suggests how to remedy the error.
+	hint string
+}
+
+// launchErrorClasses are the RunInstances error codes with a remedy known
+// to the controller. Other errors are recorded as CreateError and retried.
+var launchErrorClasses = map[string]launchErrorClass{
+	"UnauthorizedOperation": {
+		reason: mapierrors.CreateMachineError,
+		hint:   "grant the controller ec2:RunInstances and the permissions of the resources it launches with, see status.permissions of the provider",
+	},
+	"InvalidAMIID.NotFound": {
+		reason:   mapierrors.InvalidConfigurationMachineError,
+		terminal: true,
+		hint:     "check that spec.ami exists in the region of the machine and is shared with the account",
+	},
+	"InvalidAMIID.Malformed": {
+		reason:   mapierrors.InvalidConfigurationMachineError,
+		terminal: true,
+		hint:     "spec.ami must be an AMI ID, e.g. ami-0123456789abcdef0",
+	},
+	"InstanceLimitExceeded": {
+		reason: mapierrors.InsufficientResourcesMachineError,
+		hint:   "request an increase of the instance limit of the account in the region, or remove other instances",
+	},
+	"Unsupported": {
+		reason:   mapierrors.InvalidConfigurationMachineError,
+		terminal: true,
+		hint:     "the instance type or an option of the spec is not supported in the availability zone, choose another zone or instance type",
+	},
+}
+
+// recordLaunchError sets the InstanceLaunched condition of the machine to
+// false with the AWS error code of the failed launch as reason, including a
+// remedy when known, and reports the failure as an event on the owning
+// Machine. It returns true when the error is terminal, in which case the
+// failure of the AWSMachine is set to the class of the error. The status of
+// the Machine is left to the Machine controller, which learns of the
+// failure from the AWSMachine.
+func (r *AWSMachineReconciler) recordLaunchError(am *infrav1.AWSMachine, m *machinev1.Machine, err error) bool {
+	code := "LaunchFailed"
+	if aerr, ok := errors.Cause(err).(awserr.Error); ok {
+		code = aerr.Code()
+	}
+	class, ok := launchErrorClasses[code]
+	if !ok {
+		class = launchErrorClass{reason: mapierrors.CreateMachineError}
+	}
+	msg := err.Error()
+	if class.hint != "" {
+		msg = fmt.Sprintf("%s (%s)", msg, class.hint)
+	}
+	am.Status.Conditions.Set(infrav1.Condition{
+		Type:    infrav1.InstanceLaunchedCondition,
+		Status:  corev1.ConditionFalse,
+		Reason:  code,
+		Message: msg,
+	})
+	if class.terminal {
+		am.Status.SetFailure(class.reason, msg)
+		r.Recorder.Eventf(m, corev1.EventTypeWarning, "InstanceLaunchFailed", "Cannot launch instance of AWSMachine %s, not retrying: %s", am.Name, msg)
+		return true
+	}
+	r.Recorder.Eventf(m, corev1.EventTypeWarning, "InstanceLaunchFailed", "Cannot launch instance of AWSMachine %s: %s", am.Name, msg)
+	return false
+}
+
+// recordLaunched sets the InstanceLaunched condition of the machine to true.
+func recordLaunched(am *infrav1.AWSMachine) {
+	am.Status.Conditions.Set(infrav1.Condition{
+		Type:   infrav1.InstanceLaunchedCondition,
+		Status: corev1.ConditionTrue,
+		Reason: "Launched",
+	})
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+func inLaunchGroup(am *infrav1.AWSMachine) bool {
+	_, ok := am.Labels[infrav1.LaunchGroupLabel]
+	return ok
+}
+
+// launchGroupMembers returns the machines in the launch group of the
+// machine, including the machine, and the size of the group.
+func (r *AWSMachineReconciler) launchGroupMembers(ctx context.Context, am *infrav1.AWSMachine) ([]infrav1.AWSMachine, int, error) {
+	group := am.Labels[infrav1.LaunchGroupLabel]
+	size, err := strconv.Atoi(am.Annotations[infrav1.LaunchGroupSizeAnnotation])
+	if err != nil || size < 1 {
+		return nil, 0, awsutil.NewConfigurationError("launch group %q requires a positive %s annotation", group, infrav1.LaunchGroupSizeAnnotation)
+	}
+	machines := &infrav1.AWSMachineList{}
+	if err := r.List(ctx, machines, client.InNamespace(am.Namespace), client.MatchingLabels{infrav1.LaunchGroupLabel: group}); err != nil {
+		return nil, 0, err
+	}
+	members := make([]infrav1.AWSMachine, 0, len(machines.Items))
+	for _, m := range machines.Items {
+		if m.DeletionTimestamp.IsZero() {
+			members = append(members, m)
+		}
+	}
+	if len(members) > size {
+		return nil, 0, awsutil.NewConfigurationError("launch group %q has %d machines, more than its size %d", group, len(members), size)
+	}
+	return members, size, nil
+}
+
+// launchGroupBlocked returns a RequeueAfterError while the launch group of
+// the machine is incomplete or one of its members is backing off from a
+// failed launch, so that the members launch together. A ConfigurationError
+// is returned once a member of the group failed permanently.
+func (r *AWSMachineReconciler) launchGroupBlocked(ctx context.Context, am *infrav1.AWSMachine) error {
+	if !inLaunchGroup(am) {
+		return nil
+	}
+	group := am.Labels[infrav1.LaunchGroupLabel]
+	members, size, err := r.launchGroupMembers(ctx, am)
+	if err != nil {
+		return err
+	}
+	if len(members) < size {
+		setLaunchGroupCondition(am, corev1.ConditionFalse, "WaitingForMembers", fmt.Sprintf("%d of %d machines exist", len(members), size))
+		return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: r.waitSettings(ctx, am.Namespace).ConfigRequeueInterval},
+			"launch group %q has %d of %d machines", group, len(members), size)
+	}
+	var wait time.Duration
+	for i := range members {
+		m := &members[i]
+		if m.Name == am.Name {
+			continue
+		}
+		if m.Status.FailureReason != nil && !m.Status.Ready {
+			return awsutil.NewConfigurationError("machine %q of launch group %q failed", m.Name, group)
+		}
+		if d := r.launchBackoff(m); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		setLaunchGroupCondition(am, corev1.ConditionFalse, "WaitingForRetry", "a machine of the group is backing off from a failed launch")
+		return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: wait}, "launch group %q is backing off after a failed launch", group)
+	}
+	setLaunchGroupCondition(am, corev1.ConditionFalse, "Launching", "")
+	return nil
+}
+
+// reconcileLaunchGroup marks the launch group of a launched machine as
+// provisioned once every member launched. Until then, the instance of the
+// machine is terminated when another member fails to launch after it, and
+// the machine launches again with the group. It returns true when the
+// instance is being rolled back.
+func (r *AWSMachineReconciler) reconcileLaunchGroup(ctx context.Context, am *infrav1.AWSMachine) (bool, error) {
+	if !inLaunchGroup(am) || am.Status.Conditions.IsTrue(infrav1.LaunchGroupProvisionedCondition) {
+		return false, nil
+	}
+	group := am.Labels[infrav1.LaunchGroupLabel]
+	members, size, err := r.launchGroupMembers(ctx, am)
+	if err != nil {
+		return false, err
+	}
+	launched := launchTime(am)
+	provisioned := len(members) == size
+	for i := range members {
+		m := &members[i]
+		if m.Name == am.Name {
+			continue
+		}
+		failed := m.Status.FailureReason != nil && !m.Status.Ready
+		if failed || (m.Status.LastLaunchFailure != nil && m.Status.LastLaunchFailure.Time.After(launched)) {
+			r.Recorder.Eventf(am, corev1.EventTypeWarning, "LaunchGroupRolledBack", "Terminating instance since machine %s of launch group %s failed to launch", m.Name, group)
+			setLaunchGroupCondition(am, corev1.ConditionFalse, "RolledBack", fmt.Sprintf("machine %s failed to launch", m.Name))
+			if err := r.reconcileDelete(ctx, am); err != nil {
+				return true, err
+			}
+			clearInstance(am)
+			return true, nil
+		}
+		if m.Spec.ProviderID == nil {
+			provisioned = false
+		}
+	}
+	if provisioned {
+		setLaunchGroupCondition(am, corev1.ConditionTrue, "Provisioned", "")
+	}
+	return false, nil
+}
+
+// launchGroupToAWSMachines maps an AWSMachine to the other machines of its
+// launch group, so that they wait for, and roll back with, its launch.
+func (r *AWSMachineReconciler) launchGroupToAWSMachines(o handler.MapObject) []ctrl.Request {
+	group, ok := o.Meta.GetLabels()[infrav1.LaunchGroupLabel]
+	if !ok {
+		return nil
+	}
+	return r.awsMachinesUsing(context.Background(), o.Meta.GetNamespace(), func(am *infrav1.AWSMachine) bool {
+		return am.Name != o.Meta.GetName() && am.Labels[infrav1.LaunchGroupLabel] == group
+	})
+}
+
+func setLaunchGroupCondition(am *infrav1.AWSMachine, status corev1.ConditionStatus, reason, message string) {
+	am.Status.Conditions.Set(infrav1.Condition{
+		Type:    infrav1.LaunchGroupProvisionedCondition,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+}
+
+// launchTime returns when the instance of the machine was launched, as
+// recorded in its launch record.
+func launchTime(am *infrav1.AWSMachine) time.Time {
+	var rec launchRecord
+	if err := json.Unmarshal([]byte(am.Annotations[infrav1.LaunchRecordAnnotation]), &rec); err != nil {
+		return time.Time{}
+	}
+	return rec.LaunchTime
+}
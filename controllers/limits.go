@@ -0,0 +1,168 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+	"github.com/criticalstack/machine-api-provider-aws/internal/pricing"
+)
+
+// limitsBackoff is how long a launch held by the limits of the provider
+// waits before it is retried.
+const limitsBackoff = time.Minute
+
+// checkLimits returns a message if launching the machine would exceed the
+// limits of the provider in its namespace. Machines launched concurrently
+// are not accounted for, so the limits may be briefly exceeded by up to the
+// number of concurrent reconciles.
+func (r *AWSMachineReconciler) checkLimits(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine) (string, error) {
+	p, err := getProvider(ctx, r.Client, am.Namespace)
+	if err != nil {
+		return "", err
+	}
+	if p == nil || p.Spec.Limits == nil {
+		return "", nil
+	}
+	limits := p.Spec.Limits
+	machines := &infrav1.AWSMachineList{}
+	if err := r.List(ctx, machines, client.InNamespace(am.Namespace)); err != nil {
+		return "", err
+	}
+	instanceTypes := []string{am.Spec.InstanceType}
+	for _, m := range machines.Items {
+		if m.UID == am.UID || m.Spec.ProviderID == nil || !m.DeletionTimestamp.IsZero() {
+			continue
+		}
+		instanceTypes = append(instanceTypes, m.Spec.InstanceType)
+	}
+	if limits.MaxMachines != nil && len(instanceTypes) > int(*limits.MaxMachines) {
+		return fmt.Sprintf("launching would exceed the limit of %d machines", *limits.MaxMachines), nil
+	}
+	if limits.MaxVCPUs != nil {
+		vcpus, err := countVCPUs(ctx, awscfg, instanceTypes)
+		if err != nil {
+			return "", err
+		}
+		if vcpus > int64(*limits.MaxVCPUs) {
+			return fmt.Sprintf("launching would exceed the limit of %d vCPUs (%d)", *limits.MaxVCPUs, vcpus), nil
+		}
+	}
+	if limits.MaxHourlyCost != nil {
+		cost, err := estimateHourlyCost(ctx, pricing.ForProvider(awscfg, p), am, instanceTypes)
+		if err != nil {
+			return "", err
+		}
+		if max := float64(limits.MaxHourlyCost.MilliValue()) / 1000; cost > max {
+			return fmt.Sprintf("launching would exceed the limit of $%.2f per hour (estimated $%.2f)", max, cost), nil
+		}
+	}
+	return "", nil
+}
+
+// limitsExceeded sets the WithinLimits condition to false, recording an
+// event when the machine was not held already, and returns a
+// RequeueAfterError retrying the launch after limitsBackoff.
+func (r *AWSMachineReconciler) limitsExceeded(am *infrav1.AWSMachine, msg string) error {
+	if !am.Status.Conditions.IsFalse(infrav1.WithinLimitsCondition) {
+		r.Recorder.Eventf(am, corev1.EventTypeWarning, "LimitExceeded", "Holding launch: %s", msg)
+	}
+	am.Status.Conditions.Set(infrav1.Condition{
+		Type:    infrav1.WithinLimitsCondition,
+		Status:  corev1.ConditionFalse,
+		Reason:  "LimitExceeded",
+		Message: msg,
+	})
+	return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: limitsBackoff}, "machine %q: %s", am.Name, msg)
+}
+
+// machineLimitExceeded returns a message if creating the machine would
+// exceed the maximum number of machines of the provider in its namespace.
+// Unlike checkLimits, machines count whether or not they launched an
+// instance, so that a runaway scale up is rejected before AWSMachines pile
+// up waiting for the limit.
+func machineLimitExceeded(ctx context.Context, c client.Client, am *infrav1.AWSMachine) (string, error) {
+	p, err := getProvider(ctx, c, am.Namespace)
+	if err != nil {
+		return "", err
+	}
+	if p == nil || p.Spec.Limits == nil || p.Spec.Limits.MaxMachines == nil {
+		return "", nil
+	}
+	machines := &infrav1.AWSMachineList{}
+	if err := c.List(ctx, machines, client.InNamespace(am.Namespace)); err != nil {
+		return "", err
+	}
+	n := 0
+	for _, m := range machines.Items {
+		if m.DeletionTimestamp.IsZero() {
+			n++
+		}
+	}
+	if max := int(*p.Spec.Limits.MaxMachines); n >= max {
+		return fmt.Sprintf("namespace %s already has %d AWSMachines, the limit of its provider is %d", am.Namespace, n, max), nil
+	}
+	return "", nil
+}
+
+func countVCPUs(ctx context.Context, awscfg *aws.Config, instanceTypes []string) (int64, error) {
+	cache := make(map[string]int64)
+	var total int64
+	for _, t := range instanceTypes {
+		if t == "" {
+			continue
+		}
+		if _, ok := cache[t]; !ok {
+			it, err := awsutil.DescribeInstanceType(ctx, awscfg, t)
+			if err != nil {
+				return 0, err
+			}
+			if it.VCpuInfo != nil {
+				cache[t] = aws.Int64Value(it.VCpuInfo.DefaultVCpus)
+			}
+		}
+		total += cache[t]
+	}
+	return total, nil
+}
+
+// estimateHourlyCost estimates the on-demand cost of the instance types,
+// assuming they all run the operating system of the machine being launched.
+func estimateHourlyCost(ctx context.Context, e pricing.Estimator, am *infrav1.AWSMachine, instanceTypes []string) (float64, error) {
+	var total float64
+	for _, t := range instanceTypes {
+		if t == "" {
+			continue
+		}
+		price, err := e.HourlyPrice(ctx, am.Status.Region, t, am.Spec.OSFamily)
+		if err != nil {
+			return 0, err
+		}
+		total += price
+	}
+	return total, nil
+}
@@ -0,0 +1,273 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// mockInstance is an EC2 instance known to mockEC2.
+type mockInstance struct {
+	State       string
+	Tags        map[string]string
+	ClientToken string
+}
+
+// mockEC2 serves the EC2 query API from memory. It is installed as the HTTP
+// client of all AWS requests by newMockEC2. Actions without a handler
+// succeed with their response in responses, or else an empty response, and
+// actions in errors fail with the error code.
+type mockEC2 struct {
+	mu        sync.Mutex
+	instances map[string]*mockInstance
+	responses map[string]string
+	errors    map[string]string
+	calls     []string
+	// requests is the last request of each action
+	requests map[string]url.Values
+}
+
+// newMockEC2 installs a mockEC2 for the duration of the test, along with
+// static credentials so that no credentials are looked up.
+func newMockEC2(t testing.TB) *mockEC2 {
+	m := &mockEC2{
+		instances: make(map[string]*mockInstance),
+		responses: make(map[string]string),
+		errors:    make(map[string]string),
+		requests:  make(map[string]url.Values),
+	}
+	client := awsutil.HTTPClient
+	awsutil.HTTPClient = &http.Client{Transport: m}
+	env := map[string]string{
+		"AWS_ACCESS_KEY_ID":         "AKIDTEST",
+		"AWS_SECRET_ACCESS_KEY":     "secret",
+		"AWS_EC2_METADATA_DISABLED": "true",
+	}
+	for k, v := range env {
+		old, ok := os.LookupEnv(k)
+		os.Setenv(k, v)
+		k := k
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(k, old)
+			} else {
+				os.Unsetenv(k)
+			}
+		})
+	}
+	t.Cleanup(func() { awsutil.HTTPClient = client })
+	return m
+}
+
+// called returns how many times the action was requested.
+func (m *mockEC2) called(action string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, c := range m.calls {
+		if c == action {
+			n++
+		}
+	}
+	return n
+}
+
+// total returns how many requests were made.
+func (m *mockEC2) total() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.calls)
+}
+
+func (m *mockEC2) RoundTrip(req *http.Request) (*http.Response, error) {
+	if target := req.Header.Get("X-Amz-Target"); target != "" {
+		return m.roundTripJSON(req, target), nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	action := form.Get("Action")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, action)
+	m.requests[action] = form
+	var status int
+	var resp string
+	switch code, fail := m.errors[action]; {
+	case fail:
+		status, resp = mockError(code, action+" failed")
+	case action == "DescribeInstances":
+		status, resp = m.describeInstances(form)
+	case action == "TerminateInstances":
+		status, resp = m.terminateInstances(form)
+	case action == "CreateTags":
+		status, resp = m.createTags(form)
+	case action == "DescribeInstanceTypes":
+		status, resp = describeInstanceTypes(form)
+	case m.responses[action] != "":
+		status, resp = http.StatusOK, fmt.Sprintf("<%[1]sResponse>%[2]s</%[1]sResponse>", action, m.responses[action])
+	default:
+		status, resp = http.StatusOK, fmt.Sprintf("<%[1]sResponse></%[1]sResponse>", action)
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"text/xml"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(resp)),
+		Request:    req,
+	}, nil
+}
+
+// roundTripJSON answers requests of services using the JSON protocol, e.g.
+// the Pricing API, with an empty response, or the error of the action in
+// errors.
+func (m *mockEC2) roundTripJSON(req *http.Request, target string) *http.Response {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	action := target[strings.LastIndex(target, ".")+1:]
+	m.calls = append(m.calls, action)
+	status, resp := http.StatusOK, "{}"
+	if r, ok := m.responses[action]; ok {
+		resp = r
+	}
+	if code, ok := m.errors[action]; ok {
+		status, resp = http.StatusBadRequest, fmt.Sprintf(`{"__type":%q,"message":"%s failed"}`, code, action)
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/x-amz-json-1.1"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(resp)),
+		Request:    req,
+	}
+}
+
+func (m *mockEC2) describeInstances(form url.Values) (int, string) {
+	ids := instanceIDs(form)
+	if token := filterValue(form, "client-token"); token != "" {
+		for id, i := range m.instances {
+			if i.ClientToken == token && i.State != "terminated" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	for i := 1; form.Get(fmt.Sprintf("Filter.%d.Name", i)) != ""; i++ {
+		key := strings.TrimPrefix(form.Get(fmt.Sprintf("Filter.%d.Name", i)), "tag:")
+		if key == form.Get(fmt.Sprintf("Filter.%d.Name", i)) {
+			continue
+		}
+		for id, inst := range m.instances {
+			if v, ok := inst.Tags[key]; ok && v == form.Get(fmt.Sprintf("Filter.%d.Value.1", i)) && inst.State != "terminated" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	var b strings.Builder
+	for _, id := range ids {
+		i, ok := m.instances[id]
+		if !ok {
+			return mockError("InvalidInstanceID.NotFound", "The instance ID '"+id+"' does not exist")
+		}
+		fmt.Fprintf(&b, "<item><instanceId>%s</instanceId><instanceState><name>%s</name></instanceState>"+
+			"<placement><availabilityZone>us-east-1a</availabilityZone></placement><tagSet>", id, i.State)
+		for k, v := range i.Tags {
+			fmt.Fprintf(&b, "<item><key>%s</key><value>%s</value></item>", k, v)
+		}
+		b.WriteString("</tagSet></item>")
+	}
+	return http.StatusOK, "<DescribeInstancesResponse><reservationSet><item><instancesSet>" + b.String() +
+		"</instancesSet></item></reservationSet></DescribeInstancesResponse>"
+}
+
+func (m *mockEC2) terminateInstances(form url.Values) (int, string) {
+	for _, id := range instanceIDs(form) {
+		i, ok := m.instances[id]
+		if !ok {
+			return mockError("InvalidInstanceID.NotFound", "The instance ID '"+id+"' does not exist")
+		}
+		i.State = "shutting-down"
+	}
+	return http.StatusOK, "<TerminateInstancesResponse></TerminateInstancesResponse>"
+}
+
+func (m *mockEC2) createTags(form url.Values) (int, string) {
+	for i := 1; form.Get(fmt.Sprintf("ResourceId.%d", i)) != ""; i++ {
+		inst, ok := m.instances[form.Get(fmt.Sprintf("ResourceId.%d", i))]
+		if !ok {
+			continue
+		}
+		if inst.Tags == nil {
+			inst.Tags = make(map[string]string)
+		}
+		for j := 1; form.Get(fmt.Sprintf("Tag.%d.Key", j)) != ""; j++ {
+			inst.Tags[form.Get(fmt.Sprintf("Tag.%d.Key", j))] = form.Get(fmt.Sprintf("Tag.%d.Value", j))
+		}
+	}
+	return http.StatusOK, "<CreateTagsResponse></CreateTagsResponse>"
+}
+
+// describeInstanceTypes describes every requested instance type as a small
+// x86_64 type.
+func describeInstanceTypes(form url.Values) (int, string) {
+	var b strings.Builder
+	for i := 1; form.Get(fmt.Sprintf("InstanceType.%d", i)) != ""; i++ {
+		fmt.Fprintf(&b, "<item><instanceType>%s</instanceType>"+
+			"<processorInfo><supportedArchitectures><item>x86_64</item></supportedArchitectures></processorInfo>"+
+			"<vCpuInfo><defaultVCpus>2</defaultVCpus></vCpuInfo><memoryInfo><sizeInMiB>2048</sizeInMiB></memoryInfo></item>",
+			form.Get(fmt.Sprintf("InstanceType.%d", i)))
+	}
+	return http.StatusOK, "<DescribeInstanceTypesResponse><instanceTypeSet>" + b.String() +
+		"</instanceTypeSet></DescribeInstanceTypesResponse>"
+}
+
+// filterValue returns the first value of the filter with the name.
+func filterValue(form url.Values, name string) string {
+	for i := 1; form.Get(fmt.Sprintf("Filter.%d.Name", i)) != ""; i++ {
+		if form.Get(fmt.Sprintf("Filter.%d.Name", i)) == name {
+			return form.Get(fmt.Sprintf("Filter.%d.Value.1", i))
+		}
+	}
+	return ""
+}
+
+func instanceIDs(form url.Values) []string {
+	ids := make([]string, 0)
+	for i := 1; form.Get(fmt.Sprintf("InstanceId.%d", i)) != ""; i++ {
+		ids = append(ids, form.Get(fmt.Sprintf("InstanceId.%d", i)))
+	}
+	return ids
+}
+
+func mockError(code, message string) (int, string) {
+	return http.StatusBadRequest, fmt.Sprintf("<Response><Errors><Error><Code>%s</Code><Message>%s</Message></Error></Errors></Response>", code, message)
+}
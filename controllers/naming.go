@@ -0,0 +1,96 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// maxInstanceNameLength keeps instance names usable as hostnames.
+const maxInstanceNameLength = 63
+
+// reconcileInstanceName names the instance of the machine from its naming
+// template, recording the name in its status so that it is only chosen
+// once. A ConfigurationError is returned when the template cannot be
+// rendered.
+func reconcileInstanceName(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine) error {
+	if am.Spec.Naming == nil || am.Status.InstanceName != "" {
+		return nil
+	}
+	t, err := template.New("naming").Option("missingkey=error").Parse(am.Spec.Naming.Template)
+	if err != nil {
+		return awsutil.NewConfigurationError("cannot parse naming template: %v", err)
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, am); err != nil {
+		return awsutil.NewConfigurationError("cannot render naming template: %v", err)
+	}
+	name := sanitizeInstanceName(b.String())
+	if name == "" {
+		return awsutil.NewConfigurationError("naming template %q renders an empty name", am.Spec.Naming.Template)
+	}
+	instances, err := awsutil.DescribeInstancesByTag(ctx, awscfg, awsutil.NameTagKey, name)
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		if tagValue(instance.Tags, awsutil.MachineUIDTagKey) != string(am.UID) {
+			name = suffixInstanceName(name, string(am.UID))
+			break
+		}
+	}
+	am.Status.InstanceName = name
+	return nil
+}
+
+// sanitizeInstanceName lowercases the name and replaces the characters that
+// are not valid in a hostname with hyphens.
+func sanitizeInstanceName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, name)
+	if len(name) > maxInstanceNameLength {
+		name = name[:maxInstanceNameLength]
+	}
+	return strings.Trim(name, "-")
+}
+
+// suffixInstanceName makes the name unique to the machine with a short hash
+// of its UID.
+func suffixInstanceName(name, uid string) string {
+	sum := sha256.Sum256([]byte(uid))
+	suffix := "-" + hex.EncodeToString(sum[:])[:5]
+	if len(name)+len(suffix) > maxInstanceNameLength {
+		name = strings.TrimRight(name[:maxInstanceNameLength-len(suffix)], "-")
+	}
+	return name + suffix
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// waitForNetworkCleanup returns a RequeueAfterError while network interfaces
+// of the terminated instance are still attached, for machines that wait for
+// network cleanup. The NetworkCleanedUp condition records the progress.
+func (r *AWSMachineReconciler) waitForNetworkCleanup(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, instanceID string) error {
+	if !am.Spec.WaitForNetworkCleanup {
+		return nil
+	}
+	ids, err := awsutil.AttachedNetworkInterfaces(ctx, awscfg, instanceID)
+	if err != nil {
+		return err
+	}
+	cond := infrav1.Condition{
+		Type:   infrav1.NetworkCleanedUpCondition,
+		Status: corev1.ConditionTrue,
+		Reason: "Released",
+	}
+	if len(ids) != 0 {
+		cond.Status = corev1.ConditionFalse
+		cond.Reason = "Detaching"
+		cond.Message = fmt.Sprintf("waiting for network interfaces %s to be released", strings.Join(ids, ", "))
+	}
+	if old := am.Status.Conditions.Get(infrav1.NetworkCleanedUpCondition); old == nil || old.Status != cond.Status || old.Message != cond.Message {
+		orig := am.DeepCopy()
+		am.Status.Conditions.Set(cond)
+		if err := r.Status().Patch(ctx, am, client.MergeFrom(orig)); err != nil {
+			return err
+		}
+	}
+	if len(ids) != 0 {
+		requeue := r.waitSettings(ctx, am.Namespace).DeleteRequeueInterval
+		return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: requeue}, "machine %q: %d network interfaces detaching", am.Name, len(ids))
+	}
+	return nil
+}
@@ -19,22 +19,28 @@ package controllers
 import (
 	"context"
 	"encoding/json"
-	"errors"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	nodeutil "github.com/criticalstack/crit/pkg/kubernetes/util/node"
 	machinev1 "github.com/criticalstack/machine-api/api/v1alpha1"
+	"github.com/criticalstack/machine-api/util/patch"
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/utils/pointer"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
 	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
@@ -49,6 +55,22 @@ type NodeReconciler struct {
 	Log    logr.Logger
 	Scheme *runtime.Scheme
 
+	// WatchFilter restricts the controller to objects with matching labels.
+	WatchFilter labels.Selector
+
+	// ReconcileTimeout bounds each reconcile, so that a hung AWS request
+	// cannot stall a worker. Unbounded when 0.
+	ReconcileTimeout time.Duration
+
+	// ClusterName restricts adoption to nodes whose instances are tagged as
+	// members of the cluster, see awsutil.ClusterTagKeyPrefix, so that nodes
+	// of another cluster sharing the API server, e.g. during a migration,
+	// are not adopted. All nodes are adopted when empty.
+	ClusterName string
+
+	// Recorder records events for nodes that are skipped.
+	Recorder record.EventRecorder
+
 	config *rest.Config
 }
 
@@ -56,6 +78,12 @@ func (r *NodeReconciler) SetupWithManager(mgr ctrl.Manager, options controller.O
 	r.config = mgr.GetConfig()
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.Node{}).
+		Watches(
+			&source.Kind{Type: &infrav1.AWSMachine{}},
+			&handler.EnqueueRequestsFromMapFunc{
+				ToRequests: handler.ToRequestsFunc(r.awsMachineToNode),
+			},
+		).
 		WithOptions(options).
 		Complete(r)
 }
@@ -63,13 +91,23 @@ func (r *NodeReconciler) SetupWithManager(mgr ctrl.Manager, options controller.O
 // +kubebuilder:rbac:groups=infrastructure.crit.sh,resources=awsmachines,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=infrastructure.crit.sh,resources=awsmachines/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=machine.crit.sh,resources=machines;machines/status,verbs=get;list;watch
+// +kubebuilder:rbac:groups=machine.crit.sh,resources=machines,verbs=update;patch
 // +kubebuilder:rbac:groups=machine.crit.sh,resources=configs;configs/status,verbs=get;list;watch
 // +kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
-func (r *NodeReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
-	ctx := context.Background()
+func (r *NodeReconciler) Reconcile(req ctrl.Request) (_ ctrl.Result, reterr error) {
+	ctx := awsutil.WithObject(context.Background(), "node", "", req.Name)
+	ctx, cancel := withReconcileTimeout(ctx, r.ReconcileTimeout)
+	defer cancel()
 	log := r.Log.WithValues("node", req.NamespacedName)
 
+	defer func() {
+		if kv := awsutil.LogValues(reterr); kv != nil {
+			log.Error(reterr, "AWS request failed", kv...)
+		}
+	}()
+
 	n := &corev1.Node{}
 	if err := r.Get(ctx, req.NamespacedName, n); err != nil {
 		if apierrors.IsNotFound(err) {
@@ -78,9 +116,18 @@ func (r *NodeReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{}, err
 	}
 
+	if skip, reason := r.skipNode(n); skip {
+		log.V(1).Info("skipping node", "reason", reason)
+		return ctrl.Result{}, nil
+	}
+
 	// TODO: branch here on node NotReady and check provider api for terminated
 	// machines, and delete machine if necessary (since no longer valid
 
+	if repaired, err := r.repairNodeOwner(ctx, n); err != nil || repaired {
+		// the patched node is reconciled again
+		return ctrl.Result{}, err
+	}
 	annotations := n.GetAnnotations()
 	if _, ok := annotations[infrav1.NodeOwnerLabelName]; !ok {
 		log.Info("awsmachine label not found")
@@ -95,42 +142,116 @@ func (r *NodeReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		}
 		awsRefData, ok := annotations[infrav1.NodeOwnerLabelName]
 		if !ok {
-			return ctrl.Result{}, errors.New("cannot find AWSMachine, missing infra annotation")
+			// the node is reconciled again once the annotation is set,
+			// either above or when its AWSMachine records the ProviderID
+			log.V(1).Info("waiting for awsmachine annotation")
+			return ctrl.Result{}, nil
 		}
-		var amRef corev1.ObjectReference
-		if err := json.Unmarshal([]byte(awsRefData), &amRef); err != nil {
+		amRef, err := parseNodeOwner(awsRefData)
+		if err != nil {
 			return ctrl.Result{}, err
 		}
-		//log.Info("machine label not found")
 		am := &infrav1.AWSMachine{}
-		if err := r.Get(ctx, client.ObjectKey{Namespace: metav1.NamespaceSystem, Name: amRef.Name}, am); err != nil {
+		if err := r.Get(ctx, client.ObjectKey{Namespace: amRef.Namespace, Name: amRef.Name}, am); err != nil {
 			return ctrl.Result{}, err
 		}
 		if err := r.ensureMachineHasInfraRef(ctx, am, ref); err != nil {
 			return ctrl.Result{}, err
 		}
 	}
+	if err := r.reconcileNodeLabelsAndTaints(ctx, n); err != nil {
+		return ctrl.Result{}, err
+	}
 	return ctrl.Result{}, nil
 }
 
-func (r *NodeReconciler) ensureMachineHasInfraRef(ctx context.Context, am *infrav1.AWSMachine, ref corev1.ObjectReference) error {
-	m := &machinev1.Machine{}
-	if err := r.Get(ctx, client.ObjectKey{Namespace: metav1.NamespaceSystem, Name: ref.Name}, m); err != nil {
+// skipNode returns true if the node is not managed by this controller,
+// either because it opted out or because it is not an EC2 instance (e.g.
+// Fargate or another cloud provider). Nodes without a ProviderID are skipped
+// until the cloud provider sets one.
+func (r *NodeReconciler) skipNode(n *corev1.Node) (bool, string) {
+	if n.Labels[infrav1.NodeIgnoreAnnotation] == "true" || n.Annotations[infrav1.NodeIgnoreAnnotation] == "true" {
+		return true, "node opted out with " + infrav1.NodeIgnoreAnnotation
+	}
+	if n.Spec.ProviderID == "" {
+		return true, "node has no ProviderID"
+	}
+	if !awsutil.IsEC2ProviderID(n.Spec.ProviderID) {
+		if r.Recorder != nil {
+			r.Recorder.Eventf(n, corev1.EventTypeNormal, "Skipped", "ProviderID %q is not an EC2 instance", n.Spec.ProviderID)
+		}
+		return true, "ProviderID is not an EC2 instance"
+	}
+	return false, ""
+}
+
+// reconcileNodeLabelsAndTaints keeps the labels and taints of the Node in
+// sync with the spec of its AWSMachine. The kubelet and other controllers
+// write the Node as well, so the patch only applies to the Node as read and
+// is retried on conflicts.
+func (r *NodeReconciler) reconcileNodeLabelsAndTaints(ctx context.Context, n *corev1.Node) error {
+	data, ok := n.GetAnnotations()[infrav1.NodeOwnerLabelName]
+	if !ok {
+		return nil
+	}
+	ref, err := parseNodeOwner(data)
+	if err != nil {
 		return err
 	}
-	if m.Spec.InfrastructureRef.Kind == "AWSMachine" && m.Spec.InfrastructureRef.Name == am.Name {
+	am := &infrav1.AWSMachine{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: ref.Namespace, Name: ref.Name}, am); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !matchesWatchFilter(r.WatchFilter, am) {
 		return nil
 	}
-	m.Spec.InfrastructureRef = corev1.ObjectReference{
-		APIVersion: am.APIVersion,
-		Kind:       "AWSMachine",
-		Name:       am.ObjectMeta.Name,
-		Namespace:  am.Namespace,
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		latest := &corev1.Node{}
+		if err := r.Get(ctx, client.ObjectKey{Name: n.Name}, latest); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		before := latest.DeepCopy()
+		if !syncNodeLabelsAndTaints(latest, am) {
+			return nil
+		}
+		return r.Patch(ctx, latest, &lockedMergePatch{from: before})
+	})
+}
+
+// awsMachineToNode maps an AWSMachine to the Node with the same ProviderID.
+func (r *NodeReconciler) awsMachineToNode(o handler.MapObject) []ctrl.Request {
+	am, ok := o.Object.(*infrav1.AWSMachine)
+	if !ok || am.Spec.ProviderID == nil {
+		return nil
 	}
-	if err := r.Update(ctx, m); err != nil {
-		return err
+	n, err := getNodeByProviderID(context.Background(), r.Client, *am.Spec.ProviderID)
+	if err != nil || n == nil {
+		return nil
 	}
-	return nil
+	return []ctrl.Request{{NamespacedName: client.ObjectKey{Name: n.Name}}}
+}
+
+// ensureMachineHasInfraRef points the Machine at the AWSMachine. The Machine
+// controller writes the Machine as well, so the patch only applies to the
+// Machine as read and is retried on conflicts.
+func (r *NodeReconciler) ensureMachineHasInfraRef(ctx context.Context, am *infrav1.AWSMachine, ref corev1.ObjectReference) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		m := &machinev1.Machine{}
+		if err := r.Get(ctx, client.ObjectKey{Namespace: metav1.NamespaceSystem, Name: ref.Name}, m); err != nil {
+			return err
+		}
+		if m.Spec.InfrastructureRef.Kind == "AWSMachine" && m.Spec.InfrastructureRef.Name == am.Name {
+			return nil
+		}
+		before := m.DeepCopy()
+		m.Spec.InfrastructureRef = corev1.ObjectReference{
+			APIVersion: am.APIVersion,
+			Kind:       "AWSMachine",
+			Name:       am.ObjectMeta.Name,
+			Namespace:  am.Namespace,
+		}
+		return r.Patch(ctx, m, &lockedMergePatch{from: before})
+	})
 }
 
 func (r *NodeReconciler) ensureAWSMachineForNode(ctx context.Context, n *corev1.Node) error {
@@ -140,43 +261,108 @@ func (r *NodeReconciler) ensureAWSMachineForNode(ctx context.Context, n *corev1.
 	if _, ok := annotations[infrav1.NodeOwnerLabelName]; ok {
 		return nil
 	}
-	machines := &infrav1.AWSMachineList{}
-	if err := r.List(ctx, machines); err != nil {
+	p, err := awsutil.ParseProviderID(n.Spec.ProviderID)
+	if err != nil {
+		return err
+	}
+	machines, err := machinesForInstance(ctx, r.Client, p.InstanceID)
+	if err != nil {
 		return err
 	}
-	for _, m := range machines.Items {
+	for _, m := range machines {
 		if m.Spec.ProviderID != nil && *m.Spec.ProviderID == n.Spec.ProviderID {
+			if !matchesWatchFilter(r.WatchFilter, &m) {
+				// the controller of the shard of the machine annotates it
+				return nil
+			}
 			log.V(1).Info("node already has a machine associated with it, only needs an annotation")
+			observeSince(nodeRegistrationDuration, m.CreationTimestamp.Time)
 			return r.setAWSMachineAnnotation(ctx, &m, n.Name)
 		}
 	}
-	p, err := awsutil.ParseProviderID(n.Spec.ProviderID)
-	if err != nil {
-		return err
+	// an adopted AWSMachine would not carry the labels of any shard, so
+	// adoption is left to a controller without a watch filter
+	if r.WatchFilter != nil {
+		log.V(1).Info("not adopting node with a watch filter")
+		return nil
 	}
 	awscfg := &aws.Config{Region: aws.String(p.Region)}
-	instance, _, err := awsutil.DescribeInstance(ctx, awscfg, p.InstanceID)
-	if err != nil {
+	instance, ok, err := awsutil.DescribeInstance(ctx, awscfg, p.InstanceID)
+	if err != nil || !ok {
 		return err
 	}
-	am := &infrav1.AWSMachine{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      n.Name,
-			Namespace: metav1.NamespaceSystem,
-		},
-		Spec: infrav1.AWSMachineSpec{
-			ProviderID: pointer.StringPtr(n.Spec.ProviderID),
-		},
-		Status: infrav1.AWSMachineStatus{
-			Addresses: getInstanceAddresses(instance),
-		},
+	// An instance launched by an AWSMachine can register its node before
+	// the AWSMachine records the ProviderID. The node is reconciled again
+	// once it does, see awsMachineToNode. Instances whose AWSMachine no
+	// longer exists are adopted like any other.
+	if uid, ok := awsutil.TagValue(instance.Tags, awsutil.MachineUIDTagKey); ok {
+		exists, err := r.awsMachineExists(ctx, uid)
+		if err != nil {
+			return err
+		}
+		if exists {
+			log.V(1).Info("instance was launched by an AWSMachine, not adopting node")
+			return nil
+		}
+		log.Info("AWSMachine that launched the instance no longer exists, adopting node", "uid", uid)
+	}
+	if r.ClusterName != "" && !hasTag(instance.Tags, awsutil.ClusterTagKeyPrefix+r.ClusterName) {
+		log.V(1).Info("instance is not tagged as a member of the cluster, not adopting node", "cluster", r.ClusterName)
+		if r.Recorder != nil {
+			r.Recorder.Eventf(n, corev1.EventTypeNormal, "Skipped", "Instance %s is not tagged %s%s", p.InstanceID, awsutil.ClusterTagKeyPrefix, r.ClusterName)
+		}
+		return nil
+	}
+	// the spec is reconstructed from the instance, so that the AWSMachine
+	// records how it was launched and drift is detected against it
+	am, err := awsMachineFromInstance(ctx, awscfg, instance)
+	if err != nil {
+		return err
 	}
+	am.Name = n.Name
+	am.Namespace = metav1.NamespaceSystem
+	am.Spec.ProviderID = pointer.StringPtr(n.Spec.ProviderID)
 	if err := r.Create(ctx, am); err != nil {
 		return err
 	}
+
+	// status is a subresource, so it is dropped on create and must be
+	// written separately
+	if err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if err := r.Get(ctx, client.ObjectKey{Namespace: am.Namespace, Name: am.Name}, am); err != nil {
+			return err
+		}
+		patchHelper, err := patch.NewHelper(am, r.Client)
+		if err != nil {
+			return err
+		}
+		recordLaunchSpec(am)
+		setInstanceAddresses(am, instance)
+		setInstanceIdentity(am, p)
+		if instance.State != nil {
+			am.Status.InstanceState = aws.StringValue(instance.State.Name)
+		}
+		return patchHelper.Patch(ctx, am)
+	}); err != nil {
+		return err
+	}
 	return r.setAWSMachineAnnotation(ctx, am, n.Name)
 }
 
+// awsMachineExists returns true if the AWSMachine with the UID exists.
+func (r *NodeReconciler) awsMachineExists(ctx context.Context, uid string) (bool, error) {
+	machines := &infrav1.AWSMachineList{}
+	if err := r.List(ctx, machines); err != nil {
+		return false, err
+	}
+	for _, am := range machines.Items {
+		if string(am.UID) == uid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (r *NodeReconciler) setAWSMachineAnnotation(ctx context.Context, m *infrav1.AWSMachine, name string) error {
 	ref := corev1.ObjectReference{
 		APIVersion: m.APIVersion,
@@ -193,7 +379,6 @@ func (r *NodeReconciler) setAWSMachineAnnotation(ctx context.Context, m *infrav1
 		return err
 	}
 	return nodeutil.PatchNode(ctx, k, name, func(n *corev1.Node) {
-		annotations := n.GetAnnotations()
-		annotations[infrav1.NodeOwnerLabelName] = string(data)
+		metav1.SetMetaDataAnnotation(&n.ObjectMeta, infrav1.NodeOwnerLabelName, string(data))
 	})
 }
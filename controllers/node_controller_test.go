@@ -0,0 +1,253 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// TestEnsureAWSMachineForNodeRace covers nodes registering before the
+// AWSMachine that launched their instance has recorded the ProviderID. Such
+// nodes must not be adopted into a second AWSMachine.
+func TestEnsureAWSMachineForNodeRace(t *testing.T) {
+	const providerID = "aws:///us-east-1a/i-0123456789abcdef0"
+	cases := []struct {
+		name        string
+		instance    *mockInstance
+		owned       bool
+		clusterName string
+		shard       string
+		objs        []runtime.Object
+	}{
+		{
+			name:     "launched by an AWSMachine",
+			instance: &mockInstance{State: "running", Tags: map[string]string{awsutil.MachineUIDTagKey: "uid"}},
+			objs: []runtime.Object{&infrav1.AWSMachine{
+				ObjectMeta: metav1.ObjectMeta{Name: "m", Namespace: testNamespace, UID: "uid"},
+			}},
+		},
+		{
+			name:     "already adopted",
+			instance: &mockInstance{State: "running"},
+			owned:    true,
+		},
+		{
+			name: "instance terminated since",
+		},
+		{
+			name:        "instance of another cluster",
+			instance:    &mockInstance{State: "running", Tags: map[string]string{awsutil.ClusterTagKeyPrefix + "old": "owned"}},
+			clusterName: "new",
+		},
+		{
+			name:     "controller with a watch filter",
+			instance: &mockInstance{State: "running"},
+			shard:    "a",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ec2 := newMockEC2(t)
+			if tc.instance != nil {
+				ec2.instances["i-0123456789abcdef0"] = tc.instance
+			}
+			n := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "ip-10-0-0-1"},
+				Spec:       corev1.NodeSpec{ProviderID: providerID},
+			}
+			if tc.owned {
+				n.Annotations = map[string]string{infrav1.NodeOwnerLabelName: `{"kind":"AWSMachine","name":"ip-10-0-0-1"}`}
+			}
+			r := &NodeReconciler{
+				Client:      fake.NewFakeClientWithScheme(newTestScheme(t), append(tc.objs, n)...),
+				Log:         log.NullLogger{},
+				ClusterName: tc.clusterName,
+			}
+			if tc.shard != "" {
+				r.WatchFilter = labels.SelectorFromSet(labels.Set{"shard": tc.shard})
+			}
+
+			if err := r.ensureAWSMachineForNode(context.Background(), n); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			machines := &infrav1.AWSMachineList{}
+			if err := r.List(context.Background(), machines); err != nil {
+				t.Fatal(err)
+			}
+			if len(machines.Items) != len(tc.objs) {
+				t.Errorf("node was adopted into AWSMachine %s", machines.Items[len(machines.Items)-1].Name)
+			}
+		})
+	}
+}
+
+// TestEnsureAWSMachineForOrphanedNode covers nodes of instances launched by
+// an AWSMachine that no longer exists, which are adopted.
+func TestEnsureAWSMachineForOrphanedNode(t *testing.T) {
+	ec2 := newMockEC2(t)
+	ec2.instances["i-0123456789abcdef0"] = &mockInstance{State: "running", Tags: map[string]string{awsutil.MachineUIDTagKey: "deleted"}}
+	n := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "ip-10-0-0-1", Labels: map[string]string{corev1.LabelHostname: "ip-10-0-0-1"}},
+		Spec:       corev1.NodeSpec{ProviderID: "aws:///us-east-1a/i-0123456789abcdef0"},
+	}
+	// the owner annotation is patched through the API server
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(n)
+	}))
+	defer api.Close()
+	r := &NodeReconciler{
+		Client: fake.NewFakeClientWithScheme(newTestScheme(t), n),
+		Log:    log.NullLogger{},
+		config: &rest.Config{Host: api.URL},
+	}
+
+	if err := r.ensureAWSMachineForNode(context.Background(), n); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	am := &infrav1.AWSMachine{}
+	if err := r.Get(context.Background(), client.ObjectKey{Namespace: metav1.NamespaceSystem, Name: n.Name}, am); err != nil {
+		t.Fatalf("node was not adopted: %v", err)
+	}
+	if am.Spec.ProviderID == nil || *am.Spec.ProviderID != n.Spec.ProviderID {
+		t.Errorf("providerID = %v, want %s", am.Spec.ProviderID, n.Spec.ProviderID)
+	}
+}
+
+func TestNodeOwnerMismatch(t *testing.T) {
+	am := &infrav1.AWSMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: "worker-0", Namespace: metav1.NamespaceSystem},
+		Spec:       infrav1.AWSMachineSpec{ProviderID: pointer.StringPtr("aws:///us-east-1a/i-0123456789abcdef0")},
+	}
+	cases := []struct {
+		name       string
+		owner      string
+		providerID string
+		mismatch   bool
+	}{
+		{
+			name:       "matching AWSMachine",
+			owner:      `{"kind":"AWSMachine","name":"worker-0"}`,
+			providerID: "aws:///us-east-1a/i-0123456789abcdef0",
+		},
+		{
+			name:       "AWSMachine does not exist",
+			owner:      `{"kind":"AWSMachine","name":"worker-1"}`,
+			providerID: "aws:///us-east-1a/i-0123456789abcdef0",
+			mismatch:   true,
+		},
+		{
+			name:       "AWSMachine of another instance",
+			owner:      `{"kind":"AWSMachine","name":"worker-0","namespace":"kube-system"}`,
+			providerID: "aws:///us-east-1b/i-0fedcba9876543210",
+			mismatch:   true,
+		},
+		{
+			name:     "invalid reference",
+			owner:    `worker-0`,
+			mismatch: true,
+		},
+	}
+	c := fake.NewFakeClientWithScheme(newTestScheme(t), am)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			n := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "ip-10-0-0-1",
+					Annotations: map[string]string{infrav1.NodeOwnerLabelName: tc.owner},
+				},
+				Spec: corev1.NodeSpec{ProviderID: tc.providerID},
+			}
+			msg, err := nodeOwnerMismatch(context.Background(), c, n)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (msg != "") != tc.mismatch {
+				t.Errorf("expected mismatch %v, got %q", tc.mismatch, msg)
+			}
+		})
+	}
+}
+
+func TestDeleteOwnedNodes(t *testing.T) {
+	am := &infrav1.AWSMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: "worker-0", Namespace: metav1.NamespaceSystem},
+		Spec:       infrav1.AWSMachineSpec{ProviderID: pointer.StringPtr("aws:///us-east-1a/i-0123456789abcdef0")},
+	}
+	node := func(name, owner, providerID string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Annotations: map[string]string{infrav1.NodeOwnerLabelName: owner},
+			},
+			Spec: corev1.NodeSpec{ProviderID: providerID},
+		}
+	}
+	c := fake.NewFakeClientWithScheme(newTestScheme(t), am,
+		node("owned", `{"kind":"AWSMachine","name":"worker-0"}`, "aws:///us-east-1a/i-0123456789abcdef0"),
+		node("other-machine", `{"kind":"AWSMachine","name":"worker-1"}`, "aws:///us-east-1a/i-0fedcba9876543210"),
+		node("other-instance", `{"kind":"AWSMachine","name":"worker-0"}`, "aws:///us-east-1b/i-0fedcba9876543210"),
+		node("unregistered", `{"kind":"AWSMachine","name":"worker-0"}`, ""),
+	)
+	r := &AWSMachineReconciler{Client: c, Log: log.NullLogger{}, Recorder: record.NewFakeRecorder(10)}
+	if err := r.deleteOwnedNodes(context.Background(), am); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	nodes := &corev1.NodeList{}
+	if err := c.List(context.Background(), nodes); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, n := range nodes.Items {
+		names = append(names, n.Name)
+	}
+	sort.Strings(names)
+	if len(names) != 3 || names[0] != "other-instance" || names[1] != "other-machine" || names[2] != "unregistered" {
+		t.Errorf("expected only the owned node to be deleted, got %v", names)
+	}
+
+	// a machine that never recorded a ProviderID owns no nodes
+	am.Spec.ProviderID = nil
+	if err := r.deleteOwnedNodes(context.Background(), am); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.List(context.Background(), nodes); err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes.Items) != 3 {
+		t.Errorf("expected no nodes to be deleted, got %d left", len(nodes.Items))
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// syncNodeLabelsAndTaints applies the labels and taints from the AWSMachine
+// spec to the Node, removing any that were previously applied but are no
+// longer in the spec. It returns true if the Node was changed.
+func syncNodeLabelsAndTaints(n *corev1.Node, am *infrav1.AWSMachine) bool {
+	changed := false
+	if n.Labels == nil {
+		n.Labels = make(map[string]string)
+	}
+	if n.Annotations == nil {
+		n.Annotations = make(map[string]string)
+	}
+	for _, k := range splitKeys(n.Annotations[infrav1.NodeLabelsAnnotation]) {
+		if _, ok := am.Spec.NodeLabels[k]; ok {
+			continue
+		}
+		if _, ok := n.Labels[k]; ok {
+			delete(n.Labels, k)
+			changed = true
+		}
+	}
+	labelKeys := make([]string, 0)
+	for k, v := range am.Spec.NodeLabels {
+		labelKeys = append(labelKeys, k)
+		if n.Labels[k] != v {
+			n.Labels[k] = v
+			changed = true
+		}
+	}
+
+	desired := make(map[string]corev1.Taint)
+	taintKeys := make([]string, 0)
+	for _, t := range am.Spec.NodeTaints {
+		desired[taintKey(t)] = t
+		taintKeys = append(taintKeys, taintKey(t))
+	}
+	applied := make(map[string]bool)
+	for _, k := range splitKeys(n.Annotations[infrav1.NodeTaintsAnnotation]) {
+		applied[k] = true
+	}
+	taints := make([]corev1.Taint, 0)
+	for _, t := range n.Spec.Taints {
+		k := taintKey(t)
+		if d, ok := desired[k]; ok {
+			if t.Value != d.Value {
+				t.Value = d.Value
+				changed = true
+			}
+			delete(desired, k)
+		} else if applied[k] {
+			changed = true
+			continue
+		}
+		taints = append(taints, t)
+	}
+	for _, k := range taintKeys {
+		if t, ok := desired[k]; ok {
+			taints = append(taints, t)
+			changed = true
+		}
+	}
+	n.Spec.Taints = taints
+
+	if setKeysAnnotation(n, infrav1.NodeLabelsAnnotation, labelKeys) {
+		changed = true
+	}
+	if setKeysAnnotation(n, infrav1.NodeTaintsAnnotation, taintKeys) {
+		changed = true
+	}
+	return changed
+}
+
+// taintKey identifies a taint on a Node, which may only have one taint for a
+// given key and effect.
+func taintKey(t corev1.Taint) string {
+	return t.Key + ":" + string(t.Effect)
+}
+
+func splitKeys(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func setKeysAnnotation(n *corev1.Node, name string, keys []string) bool {
+	sort.Strings(keys)
+	value := strings.Join(keys, ",")
+	if n.Annotations[name] == value {
+		return false
+	}
+	if value == "" {
+		delete(n.Annotations, name)
+	} else {
+		n.Annotations[name] = value
+	}
+	return true
+}
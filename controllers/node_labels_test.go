@@ -0,0 +1,186 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+func TestSyncNodeLabelsAndTaints(t *testing.T) {
+	noSchedule := func(key, value string) corev1.Taint {
+		return corev1.Taint{Key: key, Value: value, Effect: corev1.TaintEffectNoSchedule}
+	}
+	cases := []struct {
+		name            string
+		labels          map[string]string
+		annotations     map[string]string
+		taints          []corev1.Taint
+		nodeLabels      map[string]string
+		nodeTaints      []corev1.Taint
+		changed         bool
+		wantLabels      map[string]string
+		wantAnnotations map[string]string
+		wantTaints      []corev1.Taint
+	}{
+		{
+			name:            "nothing to apply",
+			changed:         false,
+			wantLabels:      map[string]string{},
+			wantAnnotations: map[string]string{},
+			wantTaints:      []corev1.Taint{},
+		},
+		{
+			name:            "apply labels and taints",
+			labels:          map[string]string{"kubernetes.io/os": "linux"},
+			nodeLabels:      map[string]string{"team": "infra", "role": "worker"},
+			nodeTaints:      []corev1.Taint{noSchedule("dedicated", "infra")},
+			changed:         true,
+			wantLabels:      map[string]string{"kubernetes.io/os": "linux", "team": "infra", "role": "worker"},
+			wantAnnotations: map[string]string{infrav1.NodeLabelsAnnotation: "role,team", infrav1.NodeTaintsAnnotation: "dedicated:NoSchedule"},
+			wantTaints:      []corev1.Taint{noSchedule("dedicated", "infra")},
+		},
+		{
+			name:            "already in sync",
+			labels:          map[string]string{"team": "infra"},
+			annotations:     map[string]string{infrav1.NodeLabelsAnnotation: "team", infrav1.NodeTaintsAnnotation: "dedicated:NoSchedule"},
+			taints:          []corev1.Taint{noSchedule("dedicated", "infra")},
+			nodeLabels:      map[string]string{"team": "infra"},
+			nodeTaints:      []corev1.Taint{noSchedule("dedicated", "infra")},
+			changed:         false,
+			wantLabels:      map[string]string{"team": "infra"},
+			wantAnnotations: map[string]string{infrav1.NodeLabelsAnnotation: "team", infrav1.NodeTaintsAnnotation: "dedicated:NoSchedule"},
+			wantTaints:      []corev1.Taint{noSchedule("dedicated", "infra")},
+		},
+		{
+			name:            "update values",
+			labels:          map[string]string{"team": "infra"},
+			annotations:     map[string]string{infrav1.NodeLabelsAnnotation: "team", infrav1.NodeTaintsAnnotation: "dedicated:NoSchedule"},
+			taints:          []corev1.Taint{noSchedule("dedicated", "infra")},
+			nodeLabels:      map[string]string{"team": "data"},
+			nodeTaints:      []corev1.Taint{noSchedule("dedicated", "data")},
+			changed:         true,
+			wantLabels:      map[string]string{"team": "data"},
+			wantAnnotations: map[string]string{infrav1.NodeLabelsAnnotation: "team", infrav1.NodeTaintsAnnotation: "dedicated:NoSchedule"},
+			wantTaints:      []corev1.Taint{noSchedule("dedicated", "data")},
+		},
+		{
+			name:            "remove only what was applied",
+			labels:          map[string]string{"team": "infra", "zone": "a"},
+			annotations:     map[string]string{infrav1.NodeLabelsAnnotation: "team", infrav1.NodeTaintsAnnotation: "dedicated:NoSchedule"},
+			taints:          []corev1.Taint{noSchedule("dedicated", "infra"), noSchedule("node.kubernetes.io/not-ready", "")},
+			changed:         true,
+			wantLabels:      map[string]string{"zone": "a"},
+			wantAnnotations: map[string]string{},
+			wantTaints:      []corev1.Taint{noSchedule("node.kubernetes.io/not-ready", "")},
+		},
+		{
+			name:            "take over an existing label",
+			labels:          map[string]string{"team": "infra"},
+			nodeLabels:      map[string]string{"team": "infra"},
+			changed:         true,
+			wantLabels:      map[string]string{"team": "infra"},
+			wantAnnotations: map[string]string{infrav1.NodeLabelsAnnotation: "team"},
+			wantTaints:      []corev1.Taint{},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			n := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node", Labels: tc.labels, Annotations: tc.annotations},
+				Spec:       corev1.NodeSpec{Taints: tc.taints},
+			}
+			am := &infrav1.AWSMachine{Spec: infrav1.AWSMachineSpec{NodeLabels: tc.nodeLabels, NodeTaints: tc.nodeTaints}}
+			if changed := syncNodeLabelsAndTaints(n, am); changed != tc.changed {
+				t.Errorf("changed = %v, want %v", changed, tc.changed)
+			}
+			if !reflect.DeepEqual(n.Labels, tc.wantLabels) {
+				t.Errorf("labels = %v, want %v", n.Labels, tc.wantLabels)
+			}
+			if !reflect.DeepEqual(n.Annotations, tc.wantAnnotations) {
+				t.Errorf("annotations = %v, want %v", n.Annotations, tc.wantAnnotations)
+			}
+			if !reflect.DeepEqual(n.Spec.Taints, tc.wantTaints) {
+				t.Errorf("taints = %v, want %v", n.Spec.Taints, tc.wantTaints)
+			}
+		})
+	}
+}
+
+// conflictingClient writes the Node concurrently before the first patch of
+// the reconcile, as the kubelet would.
+type conflictingClient struct {
+	client.Client
+	patches int
+}
+
+func (c *conflictingClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if c.patches++; c.patches == 1 {
+		n := &corev1.Node{}
+		if err := c.Get(ctx, client.ObjectKey{Name: "node"}, n); err != nil {
+			return err
+		}
+		n.Labels["kubelet"] = "true"
+		if err := c.Update(ctx, n); err != nil {
+			return err
+		}
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func TestReconcileNodeLabelsAndTaintsConflict(t *testing.T) {
+	am := &infrav1.AWSMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: "m", Namespace: testNamespace},
+		Spec:       infrav1.AWSMachineSpec{NodeLabels: map[string]string{"team": "infra"}},
+	}
+	n := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:            "node",
+		ResourceVersion: "1",
+		Labels:          map[string]string{"kubernetes.io/os": "linux"},
+		Annotations:     map[string]string{infrav1.NodeOwnerLabelName: `{"namespace":"test","name":"m"}`},
+	}}
+	c := &conflictingClient{Client: fake.NewFakeClientWithScheme(newTestScheme(t), am, n)}
+	r := &NodeReconciler{Client: c, Log: log.Log}
+
+	stale := &corev1.Node{}
+	if err := c.Get(context.Background(), client.ObjectKey{Name: "node"}, stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reconcileNodeLabelsAndTaints(context.Background(), stale); err != nil {
+		t.Fatal(err)
+	}
+	if c.patches != 2 {
+		t.Errorf("patches = %d, want a retry after the conflict", c.patches)
+	}
+	updated := &corev1.Node{}
+	if err := c.Get(context.Background(), client.ObjectKey{Name: "node"}, updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated.Labels["team"] != "infra" || updated.Labels["kubelet"] != "true" {
+		t.Errorf("labels = %v, want both the applied and the concurrent label", updated.Labels)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// deleteOwnedNodes deletes the nodes whose owner annotation refers to the
+// deleted machine once its instance has terminated, so that they are not
+// left NotReady until the node lifecycle controller evicts their pods. Nodes
+// registered by another instance are kept, as are all nodes of machines
+// that never recorded a ProviderID.
+func (r *AWSMachineReconciler) deleteOwnedNodes(ctx context.Context, am *infrav1.AWSMachine) error {
+	if am.Spec.ProviderID == nil {
+		return nil
+	}
+	nodes, err := nodesForInstance(ctx, r.Client, *am.Spec.ProviderID)
+	if err != nil {
+		return err
+	}
+	for i := range nodes {
+		n := &nodes[i]
+		if !ownsNode(am, n) {
+			continue
+		}
+		r.Log.Info("deleting node of deleted machine", "awsmachine", am.Name, "node", n.Name)
+		if err := r.Delete(ctx, n); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		r.Recorder.Eventf(am, corev1.EventTypeNormal, "NodeDeleted", "Deleted node %s of terminated instance", n.Name)
+	}
+	return nil
+}
+
+// ownsNode returns true if the owner annotation of the node refers to the
+// machine and the node was registered by the instance of the machine. Nodes
+// are never owned by a machine without a ProviderID, nor are nodes without
+// one owned by any machine.
+func ownsNode(am *infrav1.AWSMachine, n *corev1.Node) bool {
+	data, ok := n.Annotations[infrav1.NodeOwnerLabelName]
+	if !ok {
+		return false
+	}
+	ref, err := parseNodeOwner(data)
+	if err != nil || (ref.Kind != "" && ref.Kind != "AWSMachine") {
+		return false
+	}
+	if ref.Namespace != am.Namespace || ref.Name != am.Name {
+		return false
+	}
+	return am.Spec.ProviderID != nil && n.Spec.ProviderID != "" && sameInstance(*am.Spec.ProviderID, n.Spec.ProviderID)
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	nodeutil "github.com/criticalstack/crit/pkg/kubernetes/util/node"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// +kubebuilder:webhook:path=/validate-v1-node,mutating=false,failurePolicy=ignore,groups="",resources=nodes,verbs=create;update,versions=v1,name=vnode.infrastructure.crit.sh
+
+const nodeOwnerWebhookPath = "/validate-v1-node"
+
+// NodeOwnerValidator rejects nodes whose infrastructure.crit.sh/awsmachine
+// annotation refers to an AWSMachine that does not exist or whose instance
+// is not the instance of the node.
+type NodeOwnerValidator struct {
+	Client client.Client
+	Log    logr.Logger
+
+	decoder *admission.Decoder
+}
+
+// SetupWebhookWithManager registers the validating webhook for Node.
+func (v *NodeOwnerValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+	v.decoder = decoder
+	mgr.GetWebhookServer().Register(nodeOwnerWebhookPath, &webhook.Admission{Handler: v})
+	return nil
+}
+
+// Handle validates the owner annotation of the Node of the request. Only
+// requests that set or change the annotation are validated, so that nodes
+// with an annotation that went stale can still be updated until the
+// NodeReconciler repairs it.
+func (v *NodeOwnerValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	n := &corev1.Node{}
+	if err := v.decoder.Decode(req, n); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	data, ok := n.Annotations[infrav1.NodeOwnerLabelName]
+	if !ok {
+		return admission.Allowed("")
+	}
+	if len(req.OldObject.Raw) != 0 {
+		old := &corev1.Node{}
+		if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if old.Annotations[infrav1.NodeOwnerLabelName] == data && old.Spec.ProviderID == n.Spec.ProviderID {
+			return admission.Allowed("")
+		}
+	}
+	msg, err := nodeOwnerMismatch(ctx, v.Client, n)
+	if err != nil {
+		v.Log.V(1).Info("cannot validate node owner", "node", n.Name, "error", err.Error())
+		return admission.Allowed("")
+	}
+	if msg != "" {
+		return admission.Denied(fmt.Sprintf("annotation %s: %s", infrav1.NodeOwnerLabelName, msg))
+	}
+	return admission.Allowed("")
+}
+
+// parseNodeOwner returns the AWSMachine referred to by the owner annotation
+// of a node. AWSMachines without a namespace are in kube-system.
+func parseNodeOwner(data string) (corev1.ObjectReference, error) {
+	var ref corev1.ObjectReference
+	if err := json.Unmarshal([]byte(data), &ref); err != nil {
+		return ref, err
+	}
+	if ref.Namespace == "" {
+		ref.Namespace = metav1.NamespaceSystem
+	}
+	return ref, nil
+}
+
+// nodeOwnerMismatch returns why the owner annotation of the node does not
+// refer to the AWSMachine of its instance, or an empty string if it does.
+func nodeOwnerMismatch(ctx context.Context, c client.Client, n *corev1.Node) (string, error) {
+	ref, err := parseNodeOwner(n.Annotations[infrav1.NodeOwnerLabelName])
+	if err != nil {
+		return fmt.Sprintf("invalid reference: %v", err), nil
+	}
+	if ref.Kind != "" && ref.Kind != "AWSMachine" {
+		return fmt.Sprintf("refers to a %s instead of an AWSMachine", ref.Kind), nil
+	}
+	am := &infrav1.AWSMachine{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: ref.Namespace, Name: ref.Name}, am); err != nil {
+		if apierrors.IsNotFound(err) {
+			return fmt.Sprintf("AWSMachine %s/%s does not exist", ref.Namespace, ref.Name), nil
+		}
+		return "", err
+	}
+	if am.Spec.ProviderID == nil || n.Spec.ProviderID == "" || sameInstance(*am.Spec.ProviderID, n.Spec.ProviderID) {
+		return "", nil
+	}
+	return fmt.Sprintf("AWSMachine %s/%s has ProviderID %s, not %s", ref.Namespace, ref.Name, *am.Spec.ProviderID, n.Spec.ProviderID), nil
+}
+
+// sameInstance returns true if both ProviderIDs refer to the same instance,
+// regardless of the availability zone they include.
+func sameInstance(a, b string) bool {
+	pa, err := awsutil.ParseProviderID(a)
+	if err != nil {
+		return a == b
+	}
+	pb, err := awsutil.ParseProviderID(b)
+	if err != nil {
+		return a == b
+	}
+	return pa.InstanceID == pb.InstanceID
+}
+
+// repairNodeOwner fixes an owner annotation that no longer refers to the
+// AWSMachine of the instance of the node, e.g. after the AWSMachine was
+// deleted and recreated. The annotation is pointed at the AWSMachine with
+// the ProviderID of the node, or removed so that the node is adopted again
+// when there is none. It returns true if the node was patched.
+func (r *NodeReconciler) repairNodeOwner(ctx context.Context, n *corev1.Node) (bool, error) {
+	if _, ok := n.Annotations[infrav1.NodeOwnerLabelName]; !ok {
+		return false, nil
+	}
+	msg, err := nodeOwnerMismatch(ctx, r.Client, n)
+	if err != nil || msg == "" {
+		return false, err
+	}
+	var machines []infrav1.AWSMachine
+	if p, err := awsutil.ParseProviderID(n.Spec.ProviderID); err == nil {
+		if machines, err = machinesForInstance(ctx, r.Client, p.InstanceID); err != nil {
+			return false, err
+		}
+	}
+	if len(machines) > 0 {
+		am := &machines[0]
+		r.Log.Info("repairing stale owner annotation", "node", n.Name, "reason", msg, "awsmachine", am.Name)
+		if r.Recorder != nil {
+			r.Recorder.Eventf(n, corev1.EventTypeNormal, "OwnerRepaired", "Owner annotation %s, pointing it at AWSMachine %s/%s", msg, am.Namespace, am.Name)
+		}
+		return true, r.setAWSMachineAnnotation(ctx, am, n.Name)
+	}
+	r.Log.Info("removing stale owner annotation", "node", n.Name, "reason", msg)
+	if r.Recorder != nil {
+		r.Recorder.Eventf(n, corev1.EventTypeNormal, "OwnerRepaired", "Owner annotation %s, removing it", msg)
+	}
+	k, err := kubernetes.NewForConfig(r.config)
+	if err != nil {
+		return false, err
+	}
+	return true, nodeutil.PatchNode(ctx, k, n.Name, func(n *corev1.Node) {
+		delete(n.Annotations, infrav1.NodeOwnerLabelName)
+	})
+}
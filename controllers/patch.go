@@ -0,0 +1,100 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// awsMachinePatcher writes the changes made to an AWSMachine during a
+// reconcile, like the machine-api patch.Helper. The AWSMachine and
+// AWSMachineStatus controllers both write the status of ready machines, and
+// a merge patch replaces status.conditions as a whole, so the status is
+// patched with the resourceVersion the machine was last read or written at
+// by the reconcile: a concurrent status write fails the patch with a
+// conflict instead of being overwritten. Metadata and spec are merged
+// without a precondition.
+type awsMachinePatcher struct {
+	before *infrav1.AWSMachine
+}
+
+func newAWSMachinePatcher(am *infrav1.AWSMachine) *awsMachinePatcher {
+	return &awsMachinePatcher{before: am.DeepCopy()}
+}
+
+// Patch writes the changes made to the machine since it was read. A
+// conflict writing the status is returned as is, see apierrors.IsConflict.
+func (p *awsMachinePatcher) Patch(ctx context.Context, c client.Client, am *infrav1.AWSMachine) error {
+	var statusErr error
+	if !equality.Semantic.DeepEqual(p.before.Status, am.Status) {
+		statusErr = c.Status().Patch(ctx, am.DeepCopy(), &lockedMergePatch{from: p.before})
+	}
+	// the resourceVersion changes with the writes of the reconcile, and is
+	// left out of the patch so that it has no precondition
+	before, after := p.before.DeepCopy(), am.DeepCopy()
+	before.ResourceVersion = am.ResourceVersion
+	before.Status, after.Status = infrav1.AWSMachineStatus{}, infrav1.AWSMachineStatus{}
+	if !equality.Semantic.DeepEqual(before, after) {
+		if err := c.Patch(ctx, after, client.MergeFrom(before)); err != nil {
+			return kerrors.NewAggregate([]error{statusErr, err})
+		}
+	}
+	return statusErr
+}
+
+// lockedMergePatch is a merge patch from an object that only applies if the
+// object was not changed since the patched object was read, by including
+// the resourceVersion of the patched object.
+type lockedMergePatch struct {
+	from runtime.Object
+}
+
+func (p *lockedMergePatch) Type() types.PatchType {
+	return types.MergePatchType
+}
+
+func (p *lockedMergePatch) Data(obj runtime.Object) ([]byte, error) {
+	data, err := client.MergeFrom(p.from).Data(obj)
+	if err != nil {
+		return nil, err
+	}
+	var patch map[string]interface{}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, err
+	}
+	to, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := patch["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = make(map[string]interface{})
+	}
+	metadata["resourceVersion"] = to.GetResourceVersion()
+	patch["metadata"] = metadata
+	return json.Marshal(patch)
+}
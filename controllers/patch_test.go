@@ -0,0 +1,94 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+func TestAWSMachinePatcher(t *testing.T) {
+	key := client.ObjectKey{Namespace: testNamespace, Name: "m"}
+	get := func(t *testing.T, c client.Client) *infrav1.AWSMachine {
+		am := &infrav1.AWSMachine{}
+		if err := c.Get(context.Background(), key, am); err != nil {
+			t.Fatal(err)
+		}
+		return am
+	}
+	setCondition := func(am *infrav1.AWSMachine, t infrav1.ConditionType) {
+		am.Status.Conditions.Set(infrav1.Condition{Type: t, Status: corev1.ConditionTrue})
+	}
+
+	t.Run("concurrent status write", func(t *testing.T) {
+		c := fake.NewFakeClientWithScheme(newTestScheme(t), &infrav1.AWSMachine{
+			ObjectMeta: metav1.ObjectMeta{Name: "m", Namespace: testNamespace, ResourceVersion: "1"},
+		})
+		am := get(t, c)
+		patcher := newAWSMachinePatcher(am)
+
+		other := get(t, c)
+		setCondition(other, infrav1.InstanceUpToDateCondition)
+		if err := c.Status().Patch(context.Background(), other, client.MergeFrom(am)); err != nil {
+			t.Fatal(err)
+		}
+
+		setCondition(am, infrav1.ProviderIDUniqueCondition)
+		if err := patcher.Patch(context.Background(), c, am); !apierrors.IsConflict(err) {
+			t.Fatalf("expected conflict, got %v", err)
+		}
+		if !get(t, c).Status.Conditions.IsTrue(infrav1.InstanceUpToDateCondition) {
+			t.Error("concurrent status write was overwritten")
+		}
+	})
+
+	t.Run("own writes", func(t *testing.T) {
+		c := fake.NewFakeClientWithScheme(newTestScheme(t), &infrav1.AWSMachine{
+			ObjectMeta: metav1.ObjectMeta{Name: "m", Namespace: testNamespace, ResourceVersion: "1"},
+		})
+		am := get(t, c)
+		patcher := newAWSMachinePatcher(am)
+
+		// writes made during the reconcile update the machine in place
+		patch := client.MergeFrom(am.DeepCopy())
+		am.Labels = map[string]string{"team": "infra"}
+		if err := c.Patch(context.Background(), am, patch); err != nil {
+			t.Fatal(err)
+		}
+
+		setCondition(am, infrav1.ProviderIDUniqueCondition)
+		am.Finalizers = []string{infrav1.MachineFinalizer}
+		if err := patcher.Patch(context.Background(), c, am); err != nil {
+			t.Fatal(err)
+		}
+		updated := get(t, c)
+		if !updated.Status.Conditions.IsTrue(infrav1.ProviderIDUniqueCondition) {
+			t.Errorf("conditions = %+v, want %s", updated.Status.Conditions, infrav1.ProviderIDUniqueCondition)
+		}
+		if len(updated.Finalizers) != 1 || updated.Labels["team"] != "infra" {
+			t.Errorf("metadata = %+v, want the finalizer and label", updated.ObjectMeta)
+		}
+	})
+}
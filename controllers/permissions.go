@@ -0,0 +1,89 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// permissionsCheckInterval is how often the IAM permissions of the
+// controller are checked for each provider. Policy simulation is rate
+// limited by IAM, so checks are not repeated on every provider reconcile.
+const permissionsCheckInterval = time.Hour
+
+// reconcilePermissions checks that the controller is allowed the IAM
+// actions needed to manage machines in the region of the provider, so that
+// missing permissions are surfaced before the first machine is launched.
+func (r *AWSInfrastructureProviderReconciler) reconcilePermissions(ctx context.Context, awscfg *aws.Config, ip *infrav1.AWSInfrastructureProvider) error {
+	if p := ip.Status.Permissions; p != nil && time.Since(p.LastChecked.Time) < permissionsCheckInterval {
+		return nil
+	}
+	missing, method, err := awsutil.MissingPermissions(ctx, awscfg, awsutil.RequiredActions)
+	if err != nil {
+		return err
+	}
+	ip.Status.Permissions = &infrav1.PermissionsStatus{
+		LastChecked: metav1.Now(),
+		Method:      method,
+		Missing:     missing,
+	}
+	if len(missing) > 0 {
+		ip.Status.Conditions.Set(infrav1.Condition{
+			Type:    infrav1.PermissionsGrantedCondition,
+			Status:  corev1.ConditionFalse,
+			Reason:  "MissingPermissions",
+			Message: fmt.Sprintf("not allowed %s", strings.Join(missing, ", ")),
+		})
+		return nil
+	}
+	ip.Status.Conditions.Set(infrav1.Condition{
+		Type:   infrav1.PermissionsGrantedCondition,
+		Status: corev1.ConditionTrue,
+		Reason: "PermissionsGranted",
+	})
+	return nil
+}
+
+// LogMissingPermissions checks the IAM permissions of the controller in the
+// default region at startup, logging any that are missing. Failing to check
+// is logged and otherwise ignored.
+func LogMissingPermissions(ctx context.Context, log logr.Logger) {
+	region, err := awsutil.ResolveRegion("")
+	if err != nil {
+		log.Info("cannot check AWS permissions", "reason", err.Error())
+		return
+	}
+	missing, method, err := awsutil.MissingPermissions(ctx, &aws.Config{Region: aws.String(region)}, awsutil.RequiredActions)
+	if err != nil {
+		log.Info("cannot check AWS permissions", "reason", err.Error())
+		return
+	}
+	if len(missing) > 0 {
+		log.Info("controller is missing AWS permissions", "region", region, "method", method, "actions", missing)
+	}
+}
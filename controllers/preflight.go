@@ -0,0 +1,301 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// preflightCheck validates an AWSMachine spec before launch. A non-empty
+// message indicates a problem with the spec, while an error indicates the
+// check itself could not be performed. The instance type info is nil when
+// the spec does not set an instance type.
+type preflightCheck func(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, it *ec2.InstanceTypeInfo) (string, error)
+
+var preflightChecks = []preflightCheck{
+	checkArchitecture,
+	checkHibernation,
+	checkENAExpress,
+	checkCPUOptions,
+	checkEnclaves,
+	checkInstanceStore,
+	checkLoadBalancers,
+	checkNetworkInterfaces,
+	checkInstanceProfile,
+	checkBlockDevices,
+}
+
+// preflight runs all preflight checks, recording the first problem found as
+// a terminal failure on the AWSMachine. It returns true when the machine may
+// be launched.
+func (r *AWSMachineReconciler) preflight(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine) (_ bool, reterr error) {
+	ctx, span := tracer.Start(ctx, "Preflight")
+	defer func() { endSpan(span, reterr) }()
+
+	var it *ec2.InstanceTypeInfo
+	if am.Spec.InstanceType != "" {
+		var err error
+		it, err = awsutil.DescribeInstanceType(ctx, awscfg, am.Spec.InstanceType)
+		if err != nil {
+			return false, err
+		}
+	}
+	for _, check := range preflightChecks {
+		msg, err := check(ctx, awscfg, am, it)
+		if err != nil {
+			return false, err
+		}
+		if msg != "" {
+			am.Status.SetFailure(mapierrors.InvalidConfigurationMachineError, msg)
+			return false, nil
+		}
+	}
+	msg, err := r.checkLimits(ctx, awscfg, am)
+	if err != nil {
+		return false, err
+	}
+	if msg != "" {
+		return false, r.limitsExceeded(am, msg)
+	}
+	if am.Status.Conditions.IsFalse(infrav1.WithinLimitsCondition) {
+		am.Status.Conditions.Set(infrav1.Condition{
+			Type:   infrav1.WithinLimitsCondition,
+			Status: corev1.ConditionTrue,
+			Reason: "WithinLimits",
+		})
+	}
+	if err := checkQuota(ctx, awscfg, am, it); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// checkArchitecture ensures the AMI architecture is supported by the instance
+// type. Launching an x86_64 AMI on a Graviton instance type (or vice versa) is
+// otherwise only discovered when the instance fails to boot.
+func checkArchitecture(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, it *ec2.InstanceTypeInfo) (string, error) {
+	if am.Spec.AMI == "" || it == nil || it.ProcessorInfo == nil {
+		return "", nil
+	}
+	arch, err := awsutil.DescribeImageArchitecture(ctx, awscfg, am.Spec.AMI)
+	if err != nil {
+		return "", err
+	}
+	supported := aws.StringValueSlice(it.ProcessorInfo.SupportedArchitectures)
+	for _, a := range supported {
+		if a == arch {
+			am.Status.Architecture = arch
+			return "", nil
+		}
+	}
+	return fmt.Sprintf("AMI %q has architecture %q which is not supported by instance type %q (supported: %s)",
+		am.Spec.AMI, arch, am.Spec.InstanceType, strings.Join(supported, ", ")), nil
+}
+
+// checkHibernation validates the hibernation prerequisites: the instance type
+// must support hibernation and the root volume must be encrypted and large
+// enough to hold the contents of memory.
+func checkHibernation(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, it *ec2.InstanceTypeInfo) (string, error) {
+	if am.Spec.HibernationOptions == nil || !am.Spec.HibernationOptions.Configured {
+		return "", nil
+	}
+	if it != nil && !aws.BoolValue(it.HibernationSupported) {
+		return fmt.Sprintf("instance type %q does not support hibernation", am.Spec.InstanceType), nil
+	}
+	if len(am.Spec.BlockDevices) == 0 || !am.Spec.BlockDevices[0].Encrypted {
+		return "hibernation requires an encrypted root volume, set blockDevices[0].encrypted", nil
+	}
+	if it != nil && it.MemoryInfo != nil {
+		mem := aws.Int64Value(it.MemoryInfo.SizeInMiB)
+		if root := am.Spec.BlockDevices[0].VolumeSize * 1024; root <= mem {
+			return fmt.Sprintf("hibernation requires a root volume larger than instance memory (%d MiB), root volume is %d GiB",
+				mem, am.Spec.BlockDevices[0].VolumeSize), nil
+		}
+	}
+	return "", nil
+}
+
+// checkENAExpress validates that the instance type supports ENA Express.
+// It is also run at admission.
+func checkENAExpress(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, it *ec2.InstanceTypeInfo) (string, error) {
+	if am.Spec.ENAExpress == nil {
+		return "", nil
+	}
+	if am.Spec.ENAExpress.UDP && !am.Spec.ENAExpress.Enabled {
+		return "enaExpress.udp requires enaExpress.enabled", nil
+	}
+	if !am.Spec.ENAExpress.Enabled || it == nil {
+		return "", nil
+	}
+	if it.NetworkInfo == nil || !aws.BoolValue(it.NetworkInfo.EnaSrdSupported) {
+		return fmt.Sprintf("instance type %q does not support ENA Express", am.Spec.InstanceType), nil
+	}
+	return "", nil
+}
+
+// checkCPUOptions validates that the instance type allows the core count
+// and threads per core of the machine.
+func checkCPUOptions(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, it *ec2.InstanceTypeInfo) (string, error) {
+	if am.Spec.CPUOptions == nil || it == nil || it.VCpuInfo == nil {
+		return "", nil
+	}
+	o := am.Spec.CPUOptions
+	if o.CoreCount != nil && !containsInt64(it.VCpuInfo.ValidCores, *o.CoreCount) {
+		return fmt.Sprintf("instance type %q does not allow %d cores (valid: %s)",
+			am.Spec.InstanceType, *o.CoreCount, joinInt64s(it.VCpuInfo.ValidCores)), nil
+	}
+	if o.ThreadsPerCore != nil && !containsInt64(it.VCpuInfo.ValidThreadsPerCore, *o.ThreadsPerCore) {
+		return fmt.Sprintf("instance type %q does not allow %d threads per core (valid: %s)",
+			am.Spec.InstanceType, *o.ThreadsPerCore, joinInt64s(it.VCpuInfo.ValidThreadsPerCore)), nil
+	}
+	if o.AMDSEVSNP && (it.ProcessorInfo == nil || !containsString(aws.StringValueSlice(it.ProcessorInfo.SupportedFeatures), ec2.SupportedAdditionalProcessorFeatureAmdSevSnp)) {
+		return fmt.Sprintf("instance type %q does not support AMD SEV-SNP", am.Spec.InstanceType), nil
+	}
+	return "", nil
+}
+
+// checkEnclaves validates that the instance type supports Nitro Enclaves,
+// which cannot be used together with hibernation.
+func checkEnclaves(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, it *ec2.InstanceTypeInfo) (string, error) {
+	if am.Spec.EnclaveOptions == nil || !am.Spec.EnclaveOptions.Enabled {
+		return "", nil
+	}
+	if am.Spec.HibernationOptions != nil && am.Spec.HibernationOptions.Configured {
+		return "Nitro Enclaves cannot be enabled on instances configured for hibernation", nil
+	}
+	if it != nil && aws.StringValue(it.NitroEnclavesSupport) != ec2.NitroEnclavesSupportSupported {
+		return fmt.Sprintf("instance type %q does not support Nitro Enclaves", am.Spec.InstanceType), nil
+	}
+	return "", nil
+}
+
+func containsInt64(values []*int64, v int64) bool {
+	for _, x := range values {
+		if aws.Int64Value(x) == v {
+			return true
+		}
+	}
+	return false
+}
+
+func joinInt64s(values []*int64) string {
+	if len(values) == 0 {
+		return "not configurable"
+	}
+	s := make([]string, 0, len(values))
+	for _, v := range values {
+		s = append(s, strconv.FormatInt(aws.Int64Value(v), 10))
+	}
+	return strings.Join(s, ", ")
+}
+
+// checkNetworkInterfaces validates that the instance type supports attaching
+// all network interfaces of the machine.
+func checkNetworkInterfaces(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, it *ec2.InstanceTypeInfo) (string, error) {
+	if len(am.Spec.NetworkInterfaceIDs) == 0 || it == nil || it.NetworkInfo == nil {
+		return "", nil
+	}
+	if max := aws.Int64Value(it.NetworkInfo.MaximumNetworkInterfaces); int64(len(am.Spec.NetworkInterfaceIDs)) > max {
+		return fmt.Sprintf("instance type %q supports at most %d network interfaces, %d requested",
+			am.Spec.InstanceType, max, len(am.Spec.NetworkInterfaceIDs)), nil
+	}
+	return "", nil
+}
+
+// checkInstanceProfile validates that the instance profile exists, matches
+// the path of its ARN and has a role, which RunInstances otherwise only
+// reports as an invalid instance profile. The check is skipped when the
+// controller may not get instance profiles.
+func checkInstanceProfile(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, it *ec2.InstanceTypeInfo) (string, error) {
+	if am.Spec.IAMInstanceProfile == "" {
+		return "", nil
+	}
+	msg := ""
+	profile, err := awsutil.DescribeInstanceProfile(ctx, awscfg, awsutil.InstanceProfileName(am.Spec.IAMInstanceProfile))
+	if errors.Is(err, awsutil.ErrUnauthorized) {
+		return "", nil
+	}
+	if errors.Is(err, awsutil.ErrNotFound) {
+		msg = fmt.Sprintf("instance profile %q does not exist", am.Spec.IAMInstanceProfile)
+	}
+	switch {
+	case msg != "":
+	case err != nil:
+		return "", err
+	case strings.HasPrefix(am.Spec.IAMInstanceProfile, "arn:") && aws.StringValue(profile.Arn) != am.Spec.IAMInstanceProfile:
+		msg = fmt.Sprintf("instance profile %q does not match the ARN %q of the profile with its name, check its path", am.Spec.IAMInstanceProfile, aws.StringValue(profile.Arn))
+	case len(profile.Roles) == 0:
+		msg = fmt.Sprintf("instance profile %q has no role", am.Spec.IAMInstanceProfile)
+	}
+	cond := infrav1.Condition{
+		Type:   infrav1.InstanceProfileValidCondition,
+		Status: corev1.ConditionTrue,
+		Reason: "Found",
+	}
+	if msg != "" {
+		cond.Status = corev1.ConditionFalse
+		cond.Reason = "Invalid"
+		cond.Message = msg
+	}
+	am.Status.Conditions.Set(cond)
+	return msg, nil
+}
+
+// checkInstanceStore validates that the instance type has instance store
+// volumes for the instance store policy to prepare.
+func checkInstanceStore(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, it *ec2.InstanceTypeInfo) (string, error) {
+	if am.Spec.InstanceStorePolicy == "" || it == nil {
+		return "", nil
+	}
+	if !aws.BoolValue(it.InstanceStorageSupported) {
+		return fmt.Sprintf("instance type %q has no instance store volumes for instance store policy %s", am.Spec.InstanceType, am.Spec.InstanceStorePolicy), nil
+	}
+	return "", nil
+}
+
+// checkLoadBalancers validates that load balancers are referred to by the
+// name or target group their type requires.
+func checkLoadBalancers(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, it *ec2.InstanceTypeInfo) (string, error) {
+	for i, lb := range am.Spec.LoadBalancers {
+		switch lb.Type {
+		case infrav1.LoadBalancerClassic:
+			if lb.Name == "" || lb.TargetGroupARN != "" {
+				return fmt.Sprintf("load balancer %d of type %s requires a name and no target group", i, lb.Type), nil
+			}
+			if lb.AuthorizeIngress {
+				return fmt.Sprintf("load balancer %d of type %s does not support authorizeIngress", i, lb.Type), nil
+			}
+		default:
+			if lb.TargetGroupARN == "" || lb.Name != "" {
+				return fmt.Sprintf("load balancer %d of type %s requires a target group and no name", i, lb.Type), nil
+			}
+		}
+	}
+	return "", nil
+}
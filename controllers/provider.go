@@ -0,0 +1,39 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// getProvider returns the AWSInfrastructureProvider in the given namespace,
+// or nil if one does not exist. Provider-level settings apply to every
+// AWSMachine in the same namespace.
+func getProvider(ctx context.Context, c client.Client, namespace string) (*infrav1.AWSInfrastructureProvider, error) {
+	providers := &infrav1.AWSInfrastructureProviderList{}
+	if err := c.List(ctx, providers, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	if len(providers.Items) == 0 {
+		return nil, nil
+	}
+	return &providers.Items[0], nil
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+const (
+	defaultProvisioningWindow = 24 * time.Hour
+
+	// maxProvisioningWindow is how long provisioning outcomes are kept.
+	maxProvisioningWindow = 7 * 24 * time.Hour
+)
+
+var (
+	provisioningSuccessRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mapa_provisioning_success_ratio",
+		Help: "Fraction of AWSMachines provisioned over the provisioning window of the provider that became ready, by namespace.",
+	}, []string{"namespace"})
+	provisioningTimeToReadyP95 = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mapa_provisioning_time_to_ready_p95_seconds",
+		Help: "95th percentile of the time until ready of AWSMachines provisioned over the provisioning window of the provider, by namespace.",
+	}, []string{"namespace"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(provisioningSuccessRatio, provisioningTimeToReadyP95)
+}
+
+// provisioning tracks the outcome of provisioning each machine since the
+// controller started.
+var provisioning = &provisioningTracker{outcomes: make(map[string][]provisioningOutcome)}
+
+type provisioningOutcome struct {
+	time     time.Time
+	ready    bool
+	duration time.Duration
+}
+
+type provisioningTracker struct {
+	mu       sync.Mutex
+	outcomes map[string][]provisioningOutcome
+}
+
+// recordProvisioning records that a machine became ready, or failed before
+// becoming ready, during the reconcile that started in the given state.
+func recordProvisioning(am *infrav1.AWSMachine, wasReady, wasFailed bool) {
+	if wasReady || am.CreationTimestamp.IsZero() {
+		return
+	}
+	switch {
+	case am.Status.Ready:
+		provisioning.record(am.Namespace, provisioningOutcome{
+			time:     time.Now(),
+			ready:    true,
+			duration: time.Since(am.CreationTimestamp.Time),
+		})
+	case !wasFailed && am.Status.FailureReason != nil:
+		provisioning.record(am.Namespace, provisioningOutcome{time: time.Now()})
+	}
+}
+
+func (t *provisioningTracker) record(namespace string, o provisioningOutcome) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	outcomes := t.outcomes[namespace]
+	i := 0
+	for i < len(outcomes) && time.Since(outcomes[i].time) > maxProvisioningWindow {
+		i++
+	}
+	t.outcomes[namespace] = append(outcomes[i:], o)
+}
+
+// summary summarizes the outcomes in the namespace within the window.
+func (t *provisioningTracker) summary(namespace string, window time.Duration) *infrav1.ProvisioningStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &infrav1.ProvisioningStatus{Window: metav1.Duration{Duration: window}}
+	durations := make([]time.Duration, 0)
+	for _, o := range t.outcomes[namespace] {
+		if time.Since(o.time) > window {
+			continue
+		}
+		if !o.ready {
+			s.Failed++
+			continue
+		}
+		s.Succeeded++
+		durations = append(durations, o.duration)
+	}
+	if total := s.Succeeded + s.Failed; total > 0 {
+		s.SuccessRate = strconv.FormatFloat(100*float64(s.Succeeded)/float64(total), 'f', 1, 64)
+	}
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		// nearest rank
+		rank := (95*len(durations) + 99) / 100
+		s.P95TimeToReady = &metav1.Duration{Duration: durations[rank-1].Round(time.Second)}
+	}
+	return s
+}
+
+// reconcileProvisioning summarizes the provisioning of the machines in the
+// namespace of the provider over its provisioning window.
+func (r *AWSInfrastructureProviderReconciler) reconcileProvisioning(ip *infrav1.AWSInfrastructureProvider) {
+	window := defaultProvisioningWindow
+	if w := ip.Spec.ProvisioningWindow; w != nil && w.Duration > 0 {
+		window = w.Duration
+	}
+	if window > maxProvisioningWindow {
+		window = maxProvisioningWindow
+	}
+	s := provisioning.summary(ip.Namespace, window)
+	ip.Status.Provisioning = s
+	if total := s.Succeeded + s.Failed; total > 0 {
+		provisioningSuccessRatio.WithLabelValues(ip.Namespace).Set(float64(s.Succeeded) / float64(total))
+	} else {
+		provisioningSuccessRatio.DeleteLabelValues(ip.Namespace)
+	}
+	if s.P95TimeToReady != nil {
+		provisioningTimeToReadyP95.WithLabelValues(ip.Namespace).Set(s.P95TimeToReady.Seconds())
+	} else {
+		provisioningTimeToReadyP95.DeleteLabelValues(ip.Namespace)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// quotaBackoff is how long a launch is delayed when it would exceed the
+// vCPU quota of the account, giving other instances time to terminate or
+// the quota time to be raised.
+const quotaBackoff = 2 * time.Minute
+
+// checkQuota returns a RequeueAfterError when launching the machine would
+// exceed the running on-demand vCPU quota of its instance type, rather than
+// attempting a launch that fails with VcpuLimitExceeded.
+func checkQuota(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, it *ec2.InstanceTypeInfo) error {
+	if it == nil || it.VCpuInfo == nil {
+		return nil
+	}
+	q, err := awsutil.DescribeVCPUQuota(ctx, awscfg, am.Spec.InstanceType)
+	if err != nil || q == nil {
+		return err
+	}
+	vcpus := aws.Int64Value(it.VCpuInfo.DefaultVCpus)
+	if q.Usage+vcpus > q.Limit {
+		return quotaExceeded(am, errors.Errorf("launching %s (%d vCPUs) would exceed the quota %q (%s) of %d vCPUs, %d in use",
+			am.Spec.InstanceType, vcpus, q.Name, q.Code, q.Limit, q.Usage))
+	}
+	if am.Status.Conditions.IsFalse(infrav1.QuotaAvailableCondition) {
+		am.Status.Conditions.Set(infrav1.Condition{
+			Type:   infrav1.QuotaAvailableCondition,
+			Status: corev1.ConditionTrue,
+			Reason: "QuotaAvailable",
+		})
+	}
+	return nil
+}
+
+// quotaExceeded sets the QuotaAvailable condition to false and returns a
+// RequeueAfterError retrying the launch after quotaBackoff.
+func quotaExceeded(am *infrav1.AWSMachine, cause error) error {
+	reason := "VcpuLimitExceeded"
+	if aerr, ok := errors.Cause(cause).(awserr.Error); ok {
+		reason = aerr.Code()
+	}
+	am.Status.Conditions.Set(infrav1.Condition{
+		Type:    infrav1.QuotaAvailableCondition,
+		Status:  corev1.ConditionFalse,
+		Reason:  reason,
+		Message: cause.Error(),
+	})
+	return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: quotaBackoff}, "machine %q: %v", am.Name, cause)
+}
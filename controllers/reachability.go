@@ -0,0 +1,135 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+const (
+	// reachabilityBackoff is how long the launch of a machine whose
+	// endpoint is unreachable is held before checking again.
+	reachabilityBackoff = time.Minute
+
+	// reachabilityDialTimeout bounds how long the controller waits for a
+	// connection to the endpoint.
+	reachabilityDialTimeout = 5 * time.Second
+)
+
+// checkReachability runs the reachability check of the machine, holding its
+// launch with the EndpointReachable condition false while the endpoint is
+// unreachable.
+func (r *AWSMachineReconciler) checkReachability(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine) error {
+	check := am.Spec.ReachabilityCheck
+	if check == nil {
+		return nil
+	}
+	var msg string
+	var err error
+	switch check.Method {
+	case infrav1.ReachabilityDial:
+		msg = dialEndpoint(ctx, check.Endpoint)
+	default:
+		msg, err = routeToEndpoint(ctx, awscfg, am, check.Endpoint)
+	}
+	if err != nil {
+		return err
+	}
+	if msg == "" {
+		am.Status.Conditions.Set(infrav1.Condition{
+			Type:   infrav1.EndpointReachableCondition,
+			Status: corev1.ConditionTrue,
+			Reason: "Reachable",
+		})
+		return nil
+	}
+	if !am.Status.Conditions.IsFalse(infrav1.EndpointReachableCondition) {
+		r.Recorder.Eventf(am, corev1.EventTypeWarning, "EndpointUnreachable", "Holding launch: %s", msg)
+	}
+	am.Status.Conditions.Set(infrav1.Condition{
+		Type:    infrav1.EndpointReachableCondition,
+		Status:  corev1.ConditionFalse,
+		Reason:  "Unreachable",
+		Message: msg,
+	})
+	return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: reachabilityBackoff}, "machine %q: %s", am.Name, msg)
+}
+
+// dialEndpoint returns a message if the controller cannot connect to the
+// endpoint.
+func dialEndpoint(ctx context.Context, endpoint string) string {
+	ctx, cancel := context.WithTimeout(ctx, reachabilityDialTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", endpoint)
+	if err != nil {
+		return fmt.Sprintf("cannot connect to %s: %v", endpoint, err)
+	}
+	conn.Close()
+	return ""
+}
+
+// routeToEndpoint returns a message naming the subnets the machine may be
+// launched in whose route tables have no route to an address of the
+// endpoint.
+func routeToEndpoint(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, endpoint string) (string, error) {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host = endpoint
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Sprintf("cannot resolve %s: %v", host, err), nil
+	}
+	subnets, err := awsutil.LaunchSubnets(ctx, awscfg, am)
+	if err != nil {
+		return "", err
+	}
+	unrouted := make([]string, 0)
+	for _, s := range subnets {
+		routed := false
+		for _, ip := range ips {
+			ok, err := awsutil.SubnetRoutesTo(ctx, awscfg, s, ip)
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				routed = true
+				break
+			}
+		}
+		if !routed {
+			unrouted = append(unrouted, aws.StringValue(s.SubnetId))
+		}
+	}
+	if len(unrouted) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("subnets %s have no route to %s", strings.Join(unrouted, ", "), endpoint), nil
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// reconcileReboot reboots the instance once for each value of the
+// restart.infrastructure.crit.sh/requested-at annotation, recording the
+// value in status.lastReboot so that the same request is never repeated.
+func (r *AWSMachineReconciler) reconcileReboot(ctx context.Context, am *infrav1.AWSMachine) error {
+	requestedAt, ok := am.Annotations[infrav1.RebootRequestedAtAnnotation]
+	if !ok || requestedAt == "" {
+		return nil
+	}
+	if am.Status.LastReboot != nil && am.Status.LastReboot.RequestedAt == requestedAt {
+		return nil
+	}
+	p, err := awsutil.ParseProviderID(*am.Spec.ProviderID)
+	if err != nil {
+		return err
+	}
+	awscfg, err := r.awsConfig(ctx, am, p.Region)
+	if err != nil {
+		return err
+	}
+	if err := awsutil.RebootInstance(ctx, awscfg, p.InstanceID); err != nil {
+		return err
+	}
+	am.Status.LastReboot = &infrav1.RebootStatus{
+		RequestedAt: requestedAt,
+		Time:        metav1.Now(),
+	}
+	r.Log.Info("rebooted instance", "awsmachine", am.Name, "instance", p.InstanceID, "requestedAt", requestedAt)
+	r.Recorder.Eventf(am, corev1.EventTypeNormal, "Rebooted", "Rebooted instance %s as requested at %s", p.InstanceID, requestedAt)
+	return nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// resolveRegion returns the region of the machine, defaulting it from the
+// failure domain, then the provider in the same namespace and then the
+// controller, and records it in status. The AMI is set to the copy of the
+// image replication of the machine in the region, and other unset fields of
+// the spec are defaulted from the provider defaults for the region. The
+// additional tags of the provider are merged into the tags of the spec.
+func (r *AWSMachineReconciler) resolveRegion(ctx context.Context, am *infrav1.AWSMachine) (string, error) {
+	p, err := getProvider(ctx, r.Client, am.Namespace)
+	if err != nil {
+		return "", err
+	}
+	region := am.Spec.Region
+	if fd := am.Spec.FailureDomain; fd != nil && *fd != "" {
+		// ParseRegionFromAZ leaves region names as is
+		fdRegion := awsutil.ParseRegionFromAZ(*fd)
+		if region != "" && region != fdRegion {
+			return "", awsutil.NewConfigurationError("failure domain %q is not in region %q", *fd, region)
+		}
+		region = fdRegion
+		if *fd != fdRegion && am.Spec.AvailabilityZone == "" {
+			am.Spec.AvailabilityZone = *fd
+		}
+	}
+	if region == "" && p != nil {
+		region = p.Spec.Region
+	}
+	region, err = awsutil.ResolveRegion(region)
+	if err != nil {
+		return "", err
+	}
+	if am.Spec.AMI == "" && am.Spec.ImageReplication != "" {
+		ami, err := replicatedAMI(p, am.Spec.ImageReplication, region)
+		if err != nil {
+			return "", err
+		}
+		am.Spec.AMI = ami
+	}
+	if p != nil && len(p.Spec.Regions) != 0 {
+		defaults := regionDefaults(p, region)
+		if defaults == nil {
+			return "", awsutil.NewConfigurationError("region %q is not one of the regions of provider %q", region, p.Name)
+		}
+		if len(p.Spec.AMIFamilies) != 0 {
+			// the AMI is chosen by resolveAMIFamily, falling back to the
+			// AMI of the region defaults
+			d := *defaults
+			d.AMI = ""
+			defaults = &d
+		}
+		applyRegionDefaults(am, defaults)
+	}
+	if p != nil {
+		applyAdditionalTags(am, p.Spec.AdditionalTags)
+	}
+	am.Status.Region = region
+	return region, nil
+}
+
+// deleteRegion returns the region a machine without ProviderID may have
+// been launched in, resolving it like resolveRegion without changing the
+// machine. An error is returned if the region cannot be determined, so that
+// the finalizer is kept.
+func (r *AWSMachineReconciler) deleteRegion(ctx context.Context, am *infrav1.AWSMachine) (string, error) {
+	region := am.Spec.Region
+	if fd := am.Spec.FailureDomain; region == "" && fd != nil && *fd != "" {
+		region = awsutil.ParseRegionFromAZ(*fd)
+	}
+	if region == "" {
+		region = am.Status.Region
+	}
+	if region == "" {
+		p, err := getProvider(ctx, r.Client, am.Namespace)
+		if err != nil {
+			return "", err
+		}
+		if p != nil {
+			region = p.Spec.Region
+		}
+	}
+	return awsutil.ResolveRegion(region)
+}
+
+// regionDefaults returns the defaults of the provider for the region, or nil
+// if the provider does not list the region.
+func regionDefaults(p *infrav1.AWSInfrastructureProvider, region string) *infrav1.RegionDefaults {
+	for i := range p.Spec.Regions {
+		if p.Spec.Regions[i].Name == region {
+			return &p.Spec.Regions[i]
+		}
+	}
+	return nil
+}
+
+// applyRegionDefaults sets the fields of the spec that are unset to the
+// region defaults. The defaults are written to the spec so that later
+// changes to the provider do not affect launched machines.
+func applyRegionDefaults(am *infrav1.AWSMachine, d *infrav1.RegionDefaults) {
+	if am.Spec.AMI == "" {
+		am.Spec.AMI = d.AMI
+	}
+	// network interfaces determine the network of the instance
+	if len(am.Spec.NetworkInterfaceIDs) != 0 {
+		return
+	}
+	if am.Spec.VPCID == "" && am.Spec.VPCSelector == nil {
+		am.Spec.VPCID = d.VPCID
+	}
+	if len(am.Spec.SubnetIDs) == 0 && am.Spec.SubnetSelector == nil {
+		am.Spec.SubnetIDs = d.SubnetIDs
+	}
+	if am.Spec.SubnetExcludeSelector == nil && d.SubnetExcludeSelector != nil {
+		am.Spec.SubnetExcludeSelector = d.SubnetExcludeSelector.DeepCopy()
+	}
+	if len(am.Spec.SecurityGroupIDs) == 0 && len(am.Spec.SecurityGroupNames) == 0 && am.Spec.SecurityGroupSelector == nil {
+		am.Spec.SecurityGroupIDs = d.SecurityGroupIDs
+	}
+}
+
+// applyAdditionalTags merges the tags into the tags of the spec, replacing
+// the values of tags the spec already sets.
+func applyAdditionalTags(am *infrav1.AWSMachine, tags map[string]string) {
+	if len(tags) == 0 {
+		return
+	}
+	if am.Spec.Tags == nil {
+		am.Spec.Tags = make(map[string]string)
+	}
+	for k, v := range tags {
+		am.Spec.Tags[k] = v
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// registrations returns the registrations of the machine of the given kind.
+func registrations(am *infrav1.AWSMachine, kind infrav1.RegistrationKind) []infrav1.Registration {
+	regs := make([]infrav1.Registration, 0)
+	for _, reg := range am.Status.Registrations {
+		if reg.Kind == kind {
+			regs = append(regs, reg)
+		}
+	}
+	return regs
+}
+
+func hasRegistration(am *infrav1.AWSMachine, reg infrav1.Registration) bool {
+	for _, r := range am.Status.Registrations {
+		if r == reg {
+			return true
+		}
+	}
+	return false
+}
+
+func addRegistration(am *infrav1.AWSMachine, reg infrav1.Registration) {
+	if !hasRegistration(am, reg) {
+		am.Status.Registrations = append(am.Status.Registrations, reg)
+	}
+}
+
+func removeRegistration(am *infrav1.AWSMachine, reg infrav1.Registration) {
+	regs := am.Status.Registrations[:0]
+	for _, r := range am.Status.Registrations {
+		if r != reg {
+			regs = append(regs, r)
+		}
+	}
+	am.Status.Registrations = regs
+}
+
+// loadBalancerRegistrations returns the registrations of the instance with
+// the load balancers and target groups of the spec.
+func loadBalancerRegistrations(am *infrav1.AWSMachine, instanceID string) []infrav1.Registration {
+	regs := make([]infrav1.Registration, 0)
+	for _, arn := range am.Spec.TargetGroupARNs {
+		regs = append(regs, infrav1.Registration{
+			Kind:     infrav1.RegistrationTargetGroup,
+			Resource: arn,
+			Value:    instanceID,
+		})
+	}
+	for _, lb := range am.Spec.LoadBalancers {
+		reg := infrav1.Registration{
+			Kind:     infrav1.RegistrationTargetGroup,
+			Resource: lb.TargetGroupARN,
+			Value:    instanceID,
+		}
+		if lb.Type == infrav1.LoadBalancerClassic {
+			reg.Kind = infrav1.RegistrationClassicLoadBalancer
+			reg.Resource = lb.Name
+		}
+		regs = append(regs, reg)
+	}
+	return regs
+}
+
+// loadBalancer returns the load balancer or target group of the
+// registration.
+func loadBalancer(awscfg *aws.Config, reg infrav1.Registration) awsutil.LoadBalancer {
+	if reg.Kind == infrav1.RegistrationClassicLoadBalancer {
+		return awsutil.NewClassicLoadBalancer(awscfg, reg.Resource)
+	}
+	return awsutil.NewTargetGroup(awscfg, reg.Resource)
+}
+
+// reconcileLoadBalancers registers the instance with the load balancers and
+// target groups of the spec it is not registered with yet, first allowing
+// ingress from the load balancers that request it.
+func (r *AWSMachineReconciler) reconcileLoadBalancers(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, instance *ec2.Instance) error {
+	instanceID := aws.StringValue(instance.InstanceId)
+	for _, lb := range am.Spec.LoadBalancers {
+		if !lb.AuthorizeIngress || hasRegistration(am, infrav1.Registration{Kind: infrav1.RegistrationTargetGroup, Resource: lb.TargetGroupARN, Value: instanceID}) {
+			continue
+		}
+		if len(instance.SecurityGroups) == 0 {
+			return errors.Errorf("instance %s has no security group to authorize ingress from target group %s", instanceID, lb.TargetGroupARN)
+		}
+		if err := awsutil.AuthorizeTargetGroupIngress(ctx, awscfg, lb.TargetGroupARN, aws.StringValue(instance.SecurityGroups[0].GroupId)); err != nil {
+			return err
+		}
+	}
+	for _, reg := range loadBalancerRegistrations(am, instanceID) {
+		if hasRegistration(am, reg) {
+			continue
+		}
+		if err := loadBalancer(awscfg, reg).Register(ctx, instanceID); err != nil {
+			return err
+		}
+		addRegistration(am, reg)
+		if reg.Kind == infrav1.RegistrationClassicLoadBalancer {
+			r.Recorder.Eventf(am, corev1.EventTypeNormal, "RegisteredTarget", "Registered instance %s with load balancer %s", instanceID, reg.Resource)
+		} else {
+			r.Recorder.Eventf(am, corev1.EventTypeNormal, "RegisteredTarget", "Registered instance %s with target group %s", instanceID, reg.Resource)
+		}
+	}
+	return nil
+}
+
+// loadBalancersHealthy returns true if the instance is healthy in all the
+// load balancers and target groups it is registered with.
+func loadBalancersHealthy(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine) (bool, error) {
+	for _, reg := range am.Status.Registrations {
+		if reg.Kind != infrav1.RegistrationTargetGroup && reg.Kind != infrav1.RegistrationClassicLoadBalancer {
+			continue
+		}
+		ok, err := loadBalancer(awscfg, reg).Healthy(ctx, reg.Value)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// deregisterLoadBalancers deregisters the instance from the load balancers
+// and target groups it was registered with.
+func (r *AWSMachineReconciler) deregisterLoadBalancers(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine) error {
+	for _, reg := range am.Status.Registrations {
+		if reg.Kind != infrav1.RegistrationTargetGroup && reg.Kind != infrav1.RegistrationClassicLoadBalancer {
+			continue
+		}
+		if err := loadBalancer(awscfg, reg).Deregister(ctx, reg.Value); err != nil {
+			return err
+		}
+		removeRegistration(am, reg)
+		r.Log.Info("deregistered target", "awsmachine", am.Name, "loadBalancer", reg.Resource, "instanceID", reg.Value)
+	}
+	return nil
+}
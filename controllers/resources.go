@@ -0,0 +1,62 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// deleteOwnedResources deletes the volumes, network interfaces and elastic
+// IPs tagged with the machine UID that outlived its terminated instance.
+// Resources are detached by the time the instance has terminated, so those
+// in use were attached elsewhere and are left alone. Each resource is deleted
+// independently and failures are retried after DeleteRequeueInterval.
+func (r *AWSMachineReconciler) deleteOwnedResources(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine) error {
+	resources, err := awsutil.DescribeOwnedResources(ctx, awscfg, awsutil.MachineUIDTagKey, string(am.UID))
+	if err != nil || len(resources) == 0 {
+		return err
+	}
+	remaining := 0
+	for _, res := range resources {
+		if res.InUse {
+			// attached to another instance since, e.g. a reused volume
+			r.Log.Info("leaving resource in use", "awsmachine", am.Name, "kind", res.Kind, "id", res.ID)
+			continue
+		}
+		if err := awsutil.DeleteOwnedResource(ctx, awscfg, res); err != nil {
+			r.Log.Info("cannot delete resource", "awsmachine", am.Name, "kind", res.Kind, "id", res.ID, "reason", err.Error())
+			r.Recorder.Eventf(am, corev1.EventTypeWarning, "DeleteResourceFailed", "Cannot delete %s %s: %v", res.Kind, res.ID, err)
+			remaining++
+			continue
+		}
+		r.Log.Info("deleted resource", "awsmachine", am.Name, "kind", res.Kind, "id", res.ID)
+		r.Recorder.Eventf(am, corev1.EventTypeNormal, "DeletedResource", "Deleted %s %s", res.Kind, res.ID)
+	}
+	if remaining != 0 {
+		requeue := r.waitSettings(ctx, am.Namespace).DeleteRequeueInterval
+		return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: requeue}, "machine %q: %d resources remaining", am.Name, remaining)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// rightsizingPeriod is the utilization history recommendations are based
+// on.
+const rightsizingPeriod = 14 * 24 * time.Hour
+
+// instanceSizes are the instance sizes in increasing order. Not every
+// family offers every size.
+var instanceSizes = []string{
+	"nano", "micro", "small", "medium", "large", "xlarge", "2xlarge", "3xlarge",
+	"4xlarge", "6xlarge", "8xlarge", "9xlarge", "10xlarge", "12xlarge",
+	"16xlarge", "18xlarge", "24xlarge", "32xlarge", "48xlarge",
+}
+
+var rightsizingRecommendation = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "mapa_machine_rightsizing_recommendation",
+	Help: "Set to 1 for each instance type recommended for an AWSMachine.",
+}, []string{"namespace", "awsmachine", "instance_type", "recommended_instance_type", "type"})
+
+func init() {
+	metrics.Registry.MustRegister(rightsizingRecommendation)
+}
+
+// reconcileRecommendations evaluates the utilization of the instance at most
+// once per RecommendationInterval and records right-sizing recommendations.
+// Failures are only logged since recommendations are informational.
+func (r *AWSMachineReconciler) reconcileRecommendations(ctx context.Context, am *infrav1.AWSMachine) {
+	if last := am.Status.RecommendationsLastUpdated; last != nil && time.Since(last.Time) < r.RecommendationInterval {
+		// restore the metrics after a controller restart
+		setRecommendationMetrics(am)
+		return
+	}
+	p, err := awsutil.ParseProviderID(*am.Spec.ProviderID)
+	if err != nil {
+		return
+	}
+	awscfg, err := r.awsConfig(ctx, am, p.Region)
+	if err != nil {
+		return
+	}
+	u, err := awsutil.DescribeUtilization(ctx, awscfg, p.InstanceID, rightsizingPeriod)
+	if err != nil {
+		r.Log.V(1).Info("cannot describe instance utilization", "error", err.Error())
+		return
+	}
+	recs := make([]infrav1.Recommendation, 0)
+	if u != nil {
+		rec, err := recommend(ctx, awscfg, am.Spec.InstanceType, u)
+		if err != nil {
+			r.Log.V(1).Info("cannot recommend instance type", "error", err.Error())
+			return
+		}
+		if rec != nil {
+			recs = append(recs, *rec)
+		}
+	}
+	now := metav1.Now()
+	deleteRecommendationMetrics(am)
+	am.Status.Recommendations = recs
+	am.Status.RecommendationsLastUpdated = &now
+	setRecommendationMetrics(am)
+}
+
+// recommend returns a recommendation for a smaller instance type when the
+// instance is mostly idle, or a larger one when it is saturated.
+func recommend(ctx context.Context, awscfg *aws.Config, instanceType string, u *awsutil.Utilization) (*infrav1.Recommendation, error) {
+	var t infrav1.RecommendationType
+	var step int
+	switch {
+	case u.CPUAverage > 80 || (u.HasMemory && u.MemoryAverage > 85):
+		t, step = infrav1.RecommendationUpsize, 1
+	case u.CPUMaximum < 40 && u.CPUAverage < 20 && (!u.HasMemory || u.MemoryMaximum < 40):
+		t, step = infrav1.RecommendationDownsize, -1
+	default:
+		return nil, nil
+	}
+	it, err := adjacentInstanceType(ctx, awscfg, instanceType, step)
+	if err != nil || it == "" {
+		return nil, err
+	}
+	msg := fmt.Sprintf("%s to %s: CPU average %.0f%%, maximum %.0f%% over %s",
+		strings.ToLower(string(t)), it, u.CPUAverage, u.CPUMaximum, rightsizingPeriod)
+	if u.HasMemory {
+		msg += fmt.Sprintf(", memory average %.0f%%, maximum %.0f%%", u.MemoryAverage, u.MemoryMaximum)
+	}
+	return &infrav1.Recommendation{Type: t, InstanceType: it, Message: msg}, nil
+}
+
+// adjacentInstanceType returns the next smaller (step -1) or larger (step 1)
+// size of the same family offered in the region, or "" if there is none.
+func adjacentInstanceType(ctx context.Context, awscfg *aws.Config, instanceType string, step int) (string, error) {
+	parts := strings.SplitN(instanceType, ".", 2)
+	if len(parts) != 2 {
+		return "", nil
+	}
+	i := 0
+	for ; i < len(instanceSizes) && instanceSizes[i] != parts[1]; i++ {
+	}
+	if i == len(instanceSizes) {
+		return "", nil
+	}
+	for i += step; i >= 0 && i < len(instanceSizes); i += step {
+		it := parts[0] + "." + instanceSizes[i]
+		ok, err := awsutil.InstanceTypeExists(ctx, awscfg, it)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return it, nil
+		}
+	}
+	return "", nil
+}
+
+func setRecommendationMetrics(am *infrav1.AWSMachine) {
+	for _, rec := range am.Status.Recommendations {
+		rightsizingRecommendation.WithLabelValues(am.Namespace, am.Name, am.Spec.InstanceType, rec.InstanceType, string(rec.Type)).Set(1)
+	}
+}
+
+func deleteRecommendationMetrics(am *infrav1.AWSMachine) {
+	for _, rec := range am.Status.Recommendations {
+		rightsizingRecommendation.DeleteLabelValues(am.Namespace, am.Name, am.Spec.InstanceType, rec.InstanceType, string(rec.Type))
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	machinev1 "github.com/criticalstack/machine-api/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+var (
+	scaleMachines = flag.String("scale-machines", "1000,5000",
+		"Comma separated fleet sizes simulated by the scale benchmarks.")
+	scaleWorkers = flag.Int("scale-workers", 10,
+		"Concurrent reconciles of the scale benchmarks, as with --awsmachine-concurrency.")
+)
+
+// BenchmarkScaleRefresh measures refreshing the status of a fleet of ready
+// AWSMachines, the steady state of a large environment, against mockEC2.
+// Each op reconciles every machine once through a work queue drained by
+// -scale-workers workers. Besides the time per op, it reports:
+//
+//	machines/s        reconcile throughput
+//	aws-calls/machine AWS requests per reconcile
+//	max-queue-depth   largest backlog of the work queue, including requeues
+//
+// Objects are served by the fake client, which copies them through JSON on
+// every read, so throughput is lower than with the cache of the manager.
+// Compare results between revisions rather than against production. Run
+// with make bench or e.g.:
+//
+//	go test ./controllers -run '^$' -bench Scale -benchtime 1x -timeout 0 -scale-machines 1000,5000
+func BenchmarkScaleRefresh(b *testing.B) {
+	for _, n := range scaleSizes(b) {
+		b.Run(fmt.Sprintf("machines=%d", n), func(b *testing.B) {
+			ec2 := newMockEC2(b)
+			objs := make([]runtime.Object, 0, 2*n)
+			for i := 0; i < n; i++ {
+				id := fmt.Sprintf("i-%017x", i)
+				ec2.instances[id] = &mockInstance{State: "running"}
+				objs = append(objs, newScaleObjects(fmt.Sprintf("m-%d", i), id)...)
+			}
+			scheme := newTestScheme(b)
+			r := &AWSMachineReconciler{
+				Client:   fake.NewFakeClientWithScheme(scheme, objs...),
+				Log:      log.NullLogger{},
+				Scheme:   scheme,
+				Recorder: record.NewFakeRecorder(n),
+			}
+
+			b.ResetTimer()
+			start, calls, depth := time.Now(), ec2.total(), 0
+			for i := 0; i < b.N; i++ {
+				if d := drainFleet(b, r, n, *scaleWorkers); d > depth {
+					depth = d
+				}
+			}
+			b.StopTimer()
+			reconciles := float64(b.N * n)
+			b.ReportMetric(reconciles/time.Since(start).Seconds(), "machines/s")
+			b.ReportMetric(float64(ec2.total()-calls)/reconciles, "aws-calls/machine")
+			b.ReportMetric(float64(depth), "max-queue-depth")
+		})
+	}
+}
+
+// drainFleet reconciles the machines m-0 to m-(n-1) with the given number of
+// workers, requeueing machines whose reconcile asks to be requeued right
+// away, and returns the largest depth of the queue.
+func drainFleet(b *testing.B, r *AWSMachineReconciler, n, workers int) int {
+	q := workqueue.New()
+	for i := 0; i < n; i++ {
+		q.Add(ctrl.Request{NamespacedName: client.ObjectKey{Namespace: testNamespace, Name: fmt.Sprintf("m-%d", i)}})
+	}
+	var mu sync.Mutex
+	depth := q.Len()
+	pending := n
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				item, shutdown := q.Get()
+				if shutdown {
+					return
+				}
+				req := item.(ctrl.Request)
+				res, err := r.Reconcile(req)
+				if err != nil {
+					b.Errorf("reconcile %s: %v", req.Name, err)
+				}
+				mu.Lock()
+				if res.Requeue && err == nil {
+					q.Add(req)
+				} else {
+					pending--
+				}
+				if l := q.Len(); l > depth {
+					depth = l
+				}
+				if pending == 0 {
+					q.ShutDown()
+				}
+				mu.Unlock()
+				q.Done(item)
+			}
+		}()
+	}
+	wg.Wait()
+	return depth
+}
+
+// newScaleObjects returns a ready AWSMachine running the instance and the
+// Machine owning it.
+func newScaleObjects(name, instanceID string) []runtime.Object {
+	return []runtime.Object{
+		&machinev1.Machine{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace},
+		},
+		&infrav1.AWSMachine{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:       name,
+				Namespace:  testNamespace,
+				UID:        types.UID(instanceID),
+				Finalizers: []string{infrav1.MachineFinalizer},
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: machinev1.GroupVersion.String(),
+					Kind:       "Machine",
+					Name:       name,
+				}},
+			},
+			Spec: infrav1.AWSMachineSpec{
+				Region:       "us-east-1",
+				AMI:          "ami-0123456789abcdef0",
+				InstanceType: "t3.small",
+				ProviderID:   pointer.StringPtr("aws:///us-east-1a/" + instanceID),
+			},
+			Status: infrav1.AWSMachineStatus{Ready: true},
+		},
+	}
+}
+
+func scaleSizes(b *testing.B) []int {
+	sizes := make([]int, 0)
+	for _, s := range strings.Split(*scaleMachines, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 1 {
+			b.Fatalf("invalid -scale-machines %q", *scaleMachines)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes
+}
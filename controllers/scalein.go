@@ -0,0 +1,139 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// reconcileScaleInProtection sets the scale-in protection of the instance in
+// its Auto Scaling group to match the ScaleInProtectionAnnotation. The group
+// is only looked up when the protection has to change.
+func (r *AWSMachineReconciler) reconcileScaleInProtection(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, instanceID string) error {
+	protect := am.Annotations[infrav1.ScaleInProtectionAnnotation] == "true"
+	if protect == am.Status.ScaleInProtected {
+		return nil
+	}
+	group, err := awsutil.DescribeAutoscalingInstances(ctx, awscfg, instanceID)
+	if err != nil {
+		return err
+	}
+	if group == "" {
+		r.Log.V(1).Info("instance is not in an autoscaling group, ignoring scale-in protection", "awsmachine", am.Name, "instanceID", instanceID)
+		am.Status.ScaleInProtected = false
+		return nil
+	}
+	if err := awsutil.SetInstanceProtection(ctx, awscfg, group, instanceID, protect); err != nil {
+		return err
+	}
+	r.Log.Info("updated scale-in protection", "awsmachine", am.Name, "instanceID", instanceID, "group", group, "protected", protect)
+	am.Status.ScaleInProtected = protect
+	return nil
+}
+
+// reconcileAutoScalingGroup records the Auto Scaling group of the instance
+// and whether it is in service. Failing to describe the membership (e.g.
+// due to missing permissions) is not an error.
+func (r *AWSMachineReconciler) reconcileAutoScalingGroup(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, instanceID string) {
+	group, state, err := awsutil.DescribeAutoscalingMembership(ctx, awscfg, instanceID)
+	if err != nil {
+		r.Log.V(1).Info("cannot describe autoscaling membership", "awsmachine", am.Name, "instanceID", instanceID, "error", err.Error())
+		return
+	}
+	am.Status.AutoScalingGroupName = group
+	if group == "" {
+		if am.Status.Conditions.Get(infrav1.AutoScalingInServiceCondition) != nil {
+			am.Status.Conditions.Set(infrav1.Condition{
+				Type:    infrav1.AutoScalingInServiceCondition,
+				Status:  corev1.ConditionFalse,
+				Reason:  "Detached",
+				Message: "instance is not in an autoscaling group",
+			})
+		}
+		return
+	}
+	cond := infrav1.Condition{
+		Type:    infrav1.AutoScalingInServiceCondition,
+		Status:  corev1.ConditionTrue,
+		Reason:  autoscaling.LifecycleStateInService,
+		Message: fmt.Sprintf("instance is in service in autoscaling group %s", group),
+	}
+	if state != autoscaling.LifecycleStateInService {
+		cond.Status = corev1.ConditionFalse
+		// lifecycle states such as Terminating:Wait are not CamelCase
+		cond.Reason = strings.ReplaceAll(state, ":", "")
+		cond.Message = fmt.Sprintf("instance is %s in autoscaling group %s", state, group)
+	}
+	am.Status.Conditions.Set(cond)
+}
+
+// attachToAutoScalingGroup attaches the running instance to the Auto Scaling
+// group of the spec. Instances already in another group are left alone.
+func (r *AWSMachineReconciler) attachToAutoScalingGroup(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, instanceID string) error {
+	group := am.Spec.AutoScalingGroup
+	if group == "" || am.Status.AutoScalingGroupName == group || am.Status.InstanceState != ec2.InstanceStateNameRunning {
+		return nil
+	}
+	if am.Status.AutoScalingGroupName != "" {
+		r.Recorder.Eventf(am, corev1.EventTypeWarning, "AutoScalingGroupConflict", "Instance %s is in autoscaling group %s, not attaching to %s", instanceID, am.Status.AutoScalingGroupName, group)
+		return nil
+	}
+	if err := awsutil.AttachInstance(ctx, awscfg, group, instanceID); err != nil {
+		return errors.Wrapf(err, "cannot attach instance %s to autoscaling group %s", instanceID, group)
+	}
+	r.Log.Info("attached instance to autoscaling group", "awsmachine", am.Name, "instanceID", instanceID, "group", group)
+	r.Recorder.Eventf(am, corev1.EventTypeNormal, "AttachedToAutoScalingGroup", "Attached instance %s to autoscaling group %s", instanceID, group)
+	am.Status.AutoScalingGroupName = group
+	return nil
+}
+
+// detachFromAutoScalingGroup detaches the instance from the Auto Scaling
+// group of the spec before it is terminated, returning a RequeueAfterError
+// until the instance has left the group. Instances the group is already
+// terminating are left to the group.
+func (r *AWSMachineReconciler) detachFromAutoScalingGroup(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, instanceID, state string) error {
+	if am.Spec.AutoScalingGroup == "" || state == ec2.InstanceStateNameShuttingDown || state == ec2.InstanceStateNameTerminated {
+		return nil
+	}
+	group, lifecycle, err := awsutil.DescribeAutoscalingMembership(ctx, awscfg, instanceID)
+	if err != nil {
+		return err
+	}
+	if group != am.Spec.AutoScalingGroup || strings.HasPrefix(lifecycle, "Terminating") {
+		return nil
+	}
+	if lifecycle != autoscaling.LifecycleStateDetaching {
+		if err := awsutil.DetachInstance(ctx, awscfg, group, instanceID); err != nil {
+			return errors.Wrapf(err, "cannot detach instance %s from autoscaling group %s", instanceID, group)
+		}
+		r.Log.Info("detaching instance from autoscaling group", "awsmachine", am.Name, "instanceID", instanceID, "group", group)
+	}
+	requeue := r.waitSettings(ctx, am.Namespace).DeleteRequeueInterval
+	return errors.Wrapf(&mapierrors.RequeueAfterError{RequeueAfter: requeue}, "machine %q detaching from autoscaling group %s", am.Name, group)
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// beginInflight records the start of a reconcile that launches or
+// terminates instances or records their results, see awsutil.Inflight. Once
+// the controller is shutting down it returns false, and the request is
+// requeued with the result so that it is not dropped.
+func beginInflight() (ctrl.Result, bool) {
+	if !awsutil.Inflight.Begin() {
+		return ctrl.Result{Requeue: true}, false
+	}
+	return ctrl.Result{}, true
+}
+
+// DrainInflight is called once the manager stopped, stopping reconciles
+// from starting and waiting up to grace for the reconciles and batches in
+// progress, including their status patches, to finish. It returns false
+// when the grace period expired first.
+func DrainInflight(grace time.Duration) bool {
+	return awsutil.Inflight.Drain(grace)
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/go-logr/logr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// stateChangeRetryInterval is how long the listener waits after failing to
+// receive from the queue.
+const stateChangeRetryInterval = 10 * time.Second
+
+// InstanceStateListener receives EC2 instance state change notifications
+// from an SQS queue, delivered by an EventBridge rule, and sends an event
+// for the AWSMachine of each instance so that state changes are picked up
+// without waiting for the next periodic reconcile.
+type InstanceStateListener struct {
+	client.Client
+	Log logr.Logger
+
+	// QueueURL is the URL of the SQS queue.
+	QueueURL string
+
+	// Events receives an event for each AWSMachine whose instance changed
+	// state.
+	Events chan<- event.GenericEvent
+
+	awscfg *aws.Config
+}
+
+func (l *InstanceStateListener) SetupWithManager(mgr ctrl.Manager) error {
+	region, err := awsutil.ParseQueueRegion(l.QueueURL)
+	if err != nil {
+		return err
+	}
+	l.awscfg = &aws.Config{Region: aws.String(region)}
+	return mgr.Add(l)
+}
+
+// NeedLeaderElection ensures that only the leader consumes the queue.
+func (l *InstanceStateListener) NeedLeaderElection() bool {
+	return true
+}
+
+// Start receives from the queue until stop is closed.
+func (l *InstanceStateListener) Start(stop <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+	for {
+		changes, err := awsutil.ReceiveInstanceStateChanges(ctx, l.awscfg, l.QueueURL)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			l.Log.Error(err, "cannot receive instance state changes", awsutil.LogValues(err)...)
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(stateChangeRetryInterval):
+			}
+			continue
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		if err := l.notify(ctx, stop, changes); err != nil {
+			l.Log.Error(err, "cannot look up AWSMachines of instance state changes")
+		}
+	}
+}
+
+// notify sends an event for the AWSMachine of each changed instance.
+func (l *InstanceStateListener) notify(ctx context.Context, stop <-chan struct{}, changes []awsutil.InstanceStateChange) error {
+	for _, c := range changes {
+		machines, err := machinesForInstance(ctx, l.Client, c.InstanceID)
+		if err != nil {
+			return err
+		}
+		if len(machines) == 0 {
+			continue
+		}
+		am := &machines[0]
+		l.Log.V(1).Info("instance changed state", "awsmachine", am.Namespace+"/"+am.Name, "instance", c.InstanceID, "state", c.State)
+		select {
+		case l.Events <- event.GenericEvent{Meta: am, Object: am}:
+		case <-stop:
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// reconcileSubnets records the free IP addresses of the subnets in the VPCs
+// used by machines in the namespace of the provider, so that subnets running
+// out of addresses are noticed before launches fail, and the availability
+// zones with usable subnets as failure domains.
+func (r *AWSInfrastructureProviderReconciler) reconcileSubnets(ctx context.Context, awscfg *aws.Config, ip *infrav1.AWSInfrastructureProvider) error {
+	machines := &infrav1.AWSMachineList{}
+	if err := r.List(ctx, machines, client.InNamespace(ip.Namespace)); err != nil {
+		return err
+	}
+	vpcs := make(map[string]bool)
+	if ip.Spec.MachineDefaults != nil && ip.Spec.MachineDefaults.VPCID != "" {
+		vpcs[ip.Spec.MachineDefaults.VPCID] = true
+	}
+	for _, am := range machines.Items {
+		if am.Spec.VPCID != "" {
+			vpcs[am.Spec.VPCID] = true
+		}
+		if am.Status.Network != nil && am.Status.Network.VPCID != "" {
+			vpcs[am.Status.Network.VPCID] = true
+		}
+	}
+	if len(vpcs) == 0 {
+		ip.Status.Subnets = nil
+		ip.Status.FailureDomains = nil
+		return nil
+	}
+	vpcIDs := make([]string, 0, len(vpcs))
+	for id := range vpcs {
+		vpcIDs = append(vpcIDs, id)
+	}
+	subnets, err := awsutil.DescribeSubnetsByVPC(ctx, awscfg, vpcIDs)
+	if err != nil {
+		return err
+	}
+	statuses := make([]infrav1.SubnetStatus, 0, len(subnets))
+	for _, s := range subnets {
+		statuses = append(statuses, infrav1.SubnetStatus{
+			SubnetID:             aws.StringValue(s.SubnetId),
+			VPCID:                aws.StringValue(s.VpcId),
+			AvailabilityZone:     aws.StringValue(s.AvailabilityZone),
+			AvailableIPAddresses: aws.Int64Value(s.AvailableIpAddressCount),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].SubnetID < statuses[j].SubnetID
+	})
+	ip.Status.Subnets = statuses
+	zones, err := awsutil.AvailableZones(ctx, awscfg)
+	if err != nil {
+		return err
+	}
+	ip.Status.FailureDomains = failureDomains(zones, subnets)
+	return nil
+}
+
+// failureDomains returns the zones that have available subnets with free IP
+// addresses, sorted by name.
+func failureDomains(zones []string, subnets []*ec2.Subnet) []infrav1.FailureDomain {
+	byZone := make(map[string]*infrav1.FailureDomain)
+	for _, zone := range zones {
+		byZone[zone] = &infrav1.FailureDomain{Name: zone, Subnets: make([]string, 0)}
+	}
+	for _, s := range subnets {
+		fd, ok := byZone[aws.StringValue(s.AvailabilityZone)]
+		if !ok || aws.StringValue(s.State) != ec2.SubnetStateAvailable || aws.Int64Value(s.AvailableIpAddressCount) == 0 {
+			continue
+		}
+		fd.Subnets = append(fd.Subnets, aws.StringValue(s.SubnetId))
+		fd.AvailableIPAddresses += aws.Int64Value(s.AvailableIpAddressCount)
+	}
+	domains := make([]infrav1.FailureDomain, 0, len(byZone))
+	for _, fd := range byZone {
+		if len(fd.Subnets) == 0 {
+			continue
+		}
+		sort.Strings(fd.Subnets)
+		domains = append(domains, *fd)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		return domains[i].Name < domains[j].Name
+	})
+	return domains
+}
+
+// recordSubnetsExhausted records an event listing the subnets considered for
+// a launch and why each was rejected, when none could be used.
+func (r *AWSMachineReconciler) recordSubnetsExhausted(am *infrav1.AWSMachine, err error) {
+	var serr *awsutil.SubnetsExhaustedError
+	if !errors.As(err, &serr) {
+		return
+	}
+	r.Recorder.Eventf(am, corev1.EventTypeWarning, "SubnetsExhausted", "No usable subnet in VPC %s: %s", serr.VPCID, serr.Rejections())
+}
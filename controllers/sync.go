@@ -0,0 +1,70 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// syncRequested returns true if the sync.infrastructure.crit.sh/requested-at
+// annotation requests a status sync that was not done yet.
+func syncRequested(am *infrav1.AWSMachine) bool {
+	requestedAt := am.Annotations[infrav1.SyncRequestedAtAnnotation]
+	return requestedAt != "" && (am.Status.LastSync == nil || am.Status.LastSync.RequestedAt != requestedAt)
+}
+
+// reconcileSyncRequest syncs the status of a ready machine with its
+// instance once for each value of the
+// sync.infrastructure.crit.sh/requested-at annotation. Unlike the periodic
+// refresh, which only follows the instance state, the addresses and network
+// of the instance are described again, for changes made out-of-band.
+func (r *AWSMachineReconciler) reconcileSyncRequest(ctx context.Context, am *infrav1.AWSMachine) error {
+	if !syncRequested(am) {
+		return nil
+	}
+	requestedAt := am.Annotations[infrav1.SyncRequestedAtAnnotation]
+	p, err := awsutil.ParseProviderID(*am.Spec.ProviderID)
+	if err != nil {
+		return err
+	}
+	awscfg, err := r.awsConfig(ctx, am, p.Region)
+	if err != nil {
+		return err
+	}
+	instance, _, err := awsutil.DescribeInstance(ctx, awscfg, p.InstanceID)
+	if err != nil {
+		return err
+	}
+	if instance.State != nil {
+		am.Status.InstanceState = aws.StringValue(instance.State.Name)
+	}
+	setInstanceAddresses(am, instance)
+	setInstanceNetwork(am, instance)
+	am.Status.LastSync = &infrav1.SyncStatus{
+		RequestedAt: requestedAt,
+		Time:        metav1.Now(),
+	}
+	r.Recorder.Eventf(am, corev1.EventTypeNormal, "StatusSynced", "Synced status with instance %s as requested at %s", p.InstanceID, requestedAt)
+	return nil
+}
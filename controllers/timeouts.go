@@ -0,0 +1,108 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	mapierrors "github.com/criticalstack/machine-api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// statusWriteTimeout bounds writing the status of an object at the end of a
+// reconcile. Status is written without the deadline of the reconcile, so
+// that what was observed before the deadline is not lost.
+const statusWriteTimeout = 30 * time.Second
+
+// withReconcileTimeout returns a context that is canceled once timeout has
+// passed, so that a hung AWS request fails the reconcile instead of
+// stalling the worker. There is no deadline when timeout is 0.
+func withReconcileTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// statusWriteContext returns a context for writing status at the end of a
+// reconcile, which may have exceeded its own deadline.
+func statusWriteContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), statusWriteTimeout)
+}
+
+// waitSettings are the requeue intervals and timeouts in effect for a
+// namespace.
+type waitSettings struct {
+	ConfigRequeueInterval time.Duration
+	DeleteRequeueInterval time.Duration
+	DeleteTimeout         time.Duration
+}
+
+// waitSettings returns the settings of the reconciler, overridden by the
+// timeouts of the provider in the namespace.
+func (r *AWSMachineReconciler) waitSettings(ctx context.Context, namespace string) waitSettings {
+	w := waitSettings{
+		ConfigRequeueInterval: r.ConfigRequeueInterval,
+		DeleteRequeueInterval: r.DeleteRequeueInterval,
+		DeleteTimeout:         r.DeleteTimeout,
+	}
+	if w.ConfigRequeueInterval <= 0 {
+		w.ConfigRequeueInterval = 5 * time.Second
+	}
+	if w.DeleteRequeueInterval <= 0 {
+		w.DeleteRequeueInterval = 10 * time.Second
+	}
+	p, err := getProvider(ctx, r.Client, namespace)
+	if err != nil || p == nil || p.Spec.Timeouts == nil {
+		return w
+	}
+	if d := p.Spec.Timeouts.ConfigRequeueInterval; d != nil && d.Duration > 0 {
+		w.ConfigRequeueInterval = d.Duration
+	}
+	if d := p.Spec.Timeouts.DeleteRequeueInterval; d != nil && d.Duration > 0 {
+		w.DeleteRequeueInterval = d.Duration
+	}
+	if d := p.Spec.Timeouts.DeleteTimeout; d != nil {
+		w.DeleteTimeout = d.Duration
+	}
+	return w
+}
+
+// deleteTimedOut returns true if the machine has been waiting for its
+// instance to terminate for longer than the delete timeout.
+func (r *AWSMachineReconciler) deleteTimedOut(ctx context.Context, am *infrav1.AWSMachine) bool {
+	timeout := r.waitSettings(ctx, am.Namespace).DeleteTimeout
+	return timeout > 0 && time.Since(am.DeletionTimestamp.Time) > timeout
+}
+
+// setDeleteFailure marks a deleted machine as failed after its instance did
+// not terminate in time. The finalizer is kept since the instance may still
+// be running, and the deletion completes on a later reconcile once the
+// instance has terminated.
+func (r *AWSMachineReconciler) setDeleteFailure(ctx context.Context, am *infrav1.AWSMachine, cause error) error {
+	if am.Status.FailureReason != nil && *am.Status.FailureReason == mapierrors.DeleteMachineError {
+		return nil
+	}
+	patch := client.MergeFrom(am.DeepCopy())
+	timeout := r.waitSettings(ctx, am.Namespace).DeleteTimeout
+	am.Status.SetFailure(mapierrors.DeleteMachineError, fmt.Sprintf("instance did not terminate within %s of deletion: %v", timeout, cause))
+	return r.Status().Patch(ctx, am, patch)
+}
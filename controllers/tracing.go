@@ -0,0 +1,65 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var tracer = otel.Tracer("github.com/criticalstack/machine-api-provider-aws/controllers")
+
+// endSpan records err on the span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// provisioningBuckets range from 10 seconds to about 40 minutes.
+var provisioningBuckets = prometheus.ExponentialBuckets(10, 1.5, 15)
+
+var (
+	machineReadyDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mapa_machine_ready_duration_seconds",
+		Help:    "Time from AWSMachine creation until it is ready.",
+		Buckets: provisioningBuckets,
+	})
+	nodeRegistrationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mapa_node_registration_duration_seconds",
+		Help:    "Time from AWSMachine creation until its Node registers.",
+		Buckets: provisioningBuckets,
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(machineReadyDuration, nodeRegistrationDuration)
+}
+
+func observeSince(h prometheus.Histogram, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	h.Observe(time.Since(t).Seconds())
+}
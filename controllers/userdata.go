@@ -0,0 +1,94 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// bootstrapDataKeys are the keys bootstrap data is looked up under, in
+// order, when the machine does not name one: crit Configs use cloud-config,
+// Cluster API bootstrap providers value, and other providers the rest.
+var bootstrapDataKeys = []string{"cloud-config", "value", "userData", "user-data", "ignition"}
+
+// bootstrapData returns the bootstrap data of the data secret, under the
+// BootstrapDataKey of the machine or else the first of bootstrapDataKeys.
+func bootstrapData(am *infrav1.AWSMachine, s *corev1.Secret) ([]byte, error) {
+	if key := am.Spec.BootstrapDataKey; key != "" {
+		data, ok := s.Data[key]
+		if !ok {
+			return nil, errors.Errorf("secret %q missing %s", s.Name, key)
+		}
+		return data, nil
+	}
+	for _, key := range bootstrapDataKeys {
+		if data, ok := s.Data[key]; ok {
+			return data, nil
+		}
+	}
+	return nil, errors.Errorf("secret %q missing cloud-config or any of %s, set spec.bootstrapDataKey", s.Name, strings.Join(bootstrapDataKeys[1:], ", "))
+}
+
+// userDataVars are the values available to the bootstrap data of machines
+// with a UserDataTemplate.
+type userDataVars struct {
+	MachineName      string
+	Namespace        string
+	Region           string
+	AvailabilityZone string
+	InstanceType     string
+	Spec             infrav1.AWSMachineSpec
+	Variables        map[string]string
+}
+
+// renderUserData renders the bootstrap data of machines with a
+// UserDataTemplate. A ConfigurationError is returned when the template is
+// invalid or refers to missing values.
+func renderUserData(am *infrav1.AWSMachine, region string, data []byte) ([]byte, error) {
+	if am.Spec.UserDataTemplate == nil {
+		return data, nil
+	}
+	t, err := template.New("userdata").Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, awsutil.NewConfigurationError("cannot parse bootstrap data template: %v", err)
+	}
+	vars := userDataVars{
+		MachineName:      am.Name,
+		Namespace:        am.Namespace,
+		Region:           region,
+		AvailabilityZone: am.Spec.AvailabilityZone,
+		InstanceType:     am.Spec.InstanceType,
+		Spec:             am.Spec,
+		Variables:        am.Spec.UserDataTemplate.Variables,
+	}
+	if vars.Variables == nil {
+		vars.Variables = make(map[string]string)
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, vars); err != nil {
+		return nil, awsutil.NewConfigurationError("cannot render bootstrap data template: %v", err)
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	machinev1 "github.com/criticalstack/machine-api/api/v1alpha1"
+	"github.com/go-logr/logr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// +kubebuilder:webhook:path=/validate-infrastructure-crit-sh-v1alpha1-awsmachine,mutating=false,failurePolicy=ignore,groups=infrastructure.crit.sh,resources=awsmachines,verbs=create;update,versions=v1alpha1,name=vawsmachine.infrastructure.crit.sh
+
+const validatingWebhookPath = "/validate-infrastructure-crit-sh-v1alpha1-awsmachine"
+
+// instanceTypeLookupTimeout bounds how long admission waits for the
+// instance type of a machine to be described.
+const instanceTypeLookupTimeout = 5 * time.Second
+
+// credentialCheckTimeout bounds how long admission waits for the
+// credentials of a machine to be verified in its region.
+const credentialCheckTimeout = 5 * time.Second
+
+// AWSMachineValidator rejects AWSMachines in unknown regions or
+// availability zones, see validateLocation, whose block devices cannot be
+// launched, see validateBlockDevices, whose address types leave out their
+// primary address, see validateAddressTypes, AWSMachines using the
+// credentials of another namespace that were not shared with them, see
+// secretRefNamespace, or not accepted in their region, see
+// checkRegionalCredentials, AWSMachines using AWSCredentials that assume
+// roles not allowed in their namespace, see checkCredentialRoles, and new
+// AWSMachines beyond the machine limit of their provider, see
+// machineLimitExceeded.
+type AWSMachineValidator struct {
+	Client client.Client
+	Log    logr.Logger
+
+	decoder *admission.Decoder
+}
+
+// SetupWebhookWithManager registers the validating webhook for AWSMachine.
+func (v *AWSMachineValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+	v.decoder = decoder
+	mgr.GetWebhookServer().Register(validatingWebhookPath, &webhook.Admission{Handler: v})
+	return nil
+}
+
+// Handle validates the location, credentials and block devices of the
+// AWSMachine of the request. Updates are only validated when they change the
+// region, the availability zone, the SecretRef, the CredentialsRef, the
+// block devices or the instance type, so that machines admitted before a
+// check was added can still be updated, e.g. to remove their finalizer. The
+// instance type is described with the credentials of the machine, and the
+// checks against it skipped when it cannot be described.
+func (v *AWSMachineValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	am := &infrav1.AWSMachine{}
+	if err := v.decoder.Decode(req, am); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if am.Namespace == "" {
+		am.Namespace = req.Namespace
+	}
+	old := &infrav1.AWSMachine{}
+	if len(req.OldObject.Raw) != 0 {
+		if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+	}
+	if len(req.OldObject.Raw) == 0 {
+		msg, err := machineLimitExceeded(ctx, v.Client, am)
+		if err != nil {
+			return admission.Errored(http.StatusInternalServerError, err)
+		}
+		if msg != "" {
+			return admission.Denied(msg)
+		}
+	}
+	if old.Spec.Region != am.Spec.Region || old.Spec.AvailabilityZone != am.Spec.AvailabilityZone {
+		if err := validateLocation(am); err != nil {
+			return admission.Denied(err.Error())
+		}
+	}
+	if msg := validateAddressTypes(am); msg != "" {
+		return admission.Denied(msg)
+	}
+	if e := am.Spec.ElasticIP; e != nil && e.AllocationID == "" && (e.Selector == nil || len(e.Selector.Tags) == 0) {
+		return admission.Denied("elasticIP requires an allocationID or selector tags")
+	}
+	if am.Spec.SecretRef != nil && (!reflect.DeepEqual(old.Spec.SecretRef, am.Spec.SecretRef) || old.Spec.Region != am.Spec.Region) {
+		if _, err := secretRefNamespace(ctx, v.Client, am); awsutil.IsConfigurationError(err) {
+			return admission.Denied(err.Error())
+		}
+		if msg := v.checkRegionalCredentials(ctx, am); msg != "" {
+			return admission.Denied(msg)
+		}
+	}
+	if am.Spec.CredentialsRef != nil && !reflect.DeepEqual(old.Spec.CredentialsRef, am.Spec.CredentialsRef) {
+		if msg := v.checkCredentialRoles(ctx, am); msg != "" {
+			return admission.Denied(msg)
+		}
+	}
+	if len(req.OldObject.Raw) != 0 {
+		if old.Spec.InstanceType == am.Spec.InstanceType && reflect.DeepEqual(old.Spec.BlockDevices, am.Spec.BlockDevices) &&
+			reflect.DeepEqual(old.Spec.ENAExpress, am.Spec.ENAExpress) {
+			return admission.Allowed("")
+		}
+	}
+	it := v.describeInstanceType(ctx, am)
+	if msg := validateBlockDevices(am, it); msg != "" {
+		return admission.Denied(msg)
+	}
+	if msg, _ := checkENAExpress(ctx, nil, am, it); msg != "" {
+		return admission.Denied(msg)
+	}
+	return admission.Allowed("")
+}
+
+// checkRegionalCredentials rejects a SecretRef whose credentials are not
+// accepted in the region of the machine, e.g. credentials of another
+// partition. Credentials that cannot be checked are not rejected.
+func (v *AWSMachineValidator) checkRegionalCredentials(ctx context.Context, am *infrav1.AWSMachine) string {
+	region, err := awsutil.ResolveRegion(am.Spec.Region)
+	if err != nil {
+		return ""
+	}
+	r := &AWSMachineReconciler{Client: v.Client}
+	awscfg, err := r.awsConfig(ctx, am, region)
+	if err != nil {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, credentialCheckTimeout)
+	defer cancel()
+	if err := awsutil.VerifyRegionalCredentials(ctx, awscfg); awsutil.IsCredentialError(err) {
+		return fmt.Sprintf("credentials of secret %s are not accepted in region %s: %v", am.Spec.SecretRef.Name, region, err)
+	} else if err != nil {
+		v.Log.V(1).Info("cannot verify credentials, skipping credential check", "awsmachine", am.Name, "region", region, "error", err.Error())
+	}
+	return ""
+}
+
+// checkCredentialRoles rejects a CredentialsRef to AWSCredentials assuming
+// roles that are not allowed in the namespace of the machine, see
+// checkCredentialRoles. AWSCredentials that do not exist yet are checked
+// when the machine is reconciled.
+func (v *AWSMachineValidator) checkCredentialRoles(ctx context.Context, am *infrav1.AWSMachine) string {
+	ac := &infrav1.AWSCredentials{}
+	if err := v.Client.Get(ctx, client.ObjectKey{Name: am.Spec.CredentialsRef.Name, Namespace: am.Namespace}, ac); err != nil {
+		return ""
+	}
+	if err := checkCredentialRoles(ctx, v.Client, ac); awsutil.IsConfigurationError(err) {
+		return fmt.Sprintf("credentials %s: %v", ac.Name, err)
+	}
+	return ""
+}
+
+func (v *AWSMachineValidator) describeInstanceType(ctx context.Context, am *infrav1.AWSMachine) *ec2.InstanceTypeInfo {
+	enaExpress := am.Spec.ENAExpress != nil && am.Spec.ENAExpress.Enabled
+	if am.Spec.InstanceType == "" || (len(am.Spec.BlockDevices) == 0 && !enaExpress) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, instanceTypeLookupTimeout)
+	defer cancel()
+	it, err := v.lookupInstanceType(ctx, am)
+	if err != nil {
+		v.Log.V(1).Info("cannot describe instance type, skipping instance type checks", "awsmachine", am.Name, "instanceType", am.Spec.InstanceType, "error", err.Error())
+		return nil
+	}
+	return it
+}
+
+func (v *AWSMachineValidator) lookupInstanceType(ctx context.Context, am *infrav1.AWSMachine) (*ec2.InstanceTypeInfo, error) {
+	region, err := awsutil.ResolveRegion(am.Spec.Region)
+	if err != nil {
+		return nil, err
+	}
+	r := &AWSMachineReconciler{Client: v.Client}
+	awscfg, err := r.awsConfig(ctx, am, region)
+	if err != nil {
+		return nil, err
+	}
+	return awsutil.DescribeInstanceType(ctx, awscfg, am.Spec.InstanceType)
+}
+
+// validateAddressTypes rejects unknown and repeated address types, and
+// address types that leave out the primary address type.
+func validateAddressTypes(am *infrav1.AWSMachine) string {
+	if len(am.Spec.AddressTypes) == 0 {
+		return ""
+	}
+	seen := make(map[machinev1.MachineAddressType]bool)
+	for i, t := range am.Spec.AddressTypes {
+		switch t {
+		case machinev1.MachineInternalIP, machinev1.MachineInternalDNS, machinev1.MachineExternalIP, machinev1.MachineExternalDNS:
+		default:
+			return fmt.Sprintf("addressTypes[%d] has unknown address type %q", i, t)
+		}
+		if seen[t] {
+			return fmt.Sprintf("addressTypes[%d] repeats address type %q", i, t)
+		}
+		seen[t] = true
+	}
+	primary := am.Spec.PrimaryAddressType
+	if primary == "" {
+		primary = machinev1.MachineInternalIP
+	}
+	if !seen[primary] {
+		return fmt.Sprintf("addressTypes must include the primary address type %q", primary)
+	}
+	return ""
+}
+
+// validateLocation rejects regions and availability zones unknown to the
+// AWS SDK, which would otherwise only fail when the instance is launched,
+// e.g. with a DNS error for the endpoint of a misspelled region.
+func validateLocation(am *infrav1.AWSMachine) error {
+	if am.Spec.Region != "" {
+		if err := awsutil.ValidateRegion(am.Spec.Region); err != nil {
+			return err
+		}
+	}
+	if am.Spec.AvailabilityZone != "" {
+		return awsutil.ValidateAvailabilityZone(am.Spec.AvailabilityZone, am.Spec.Region)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	"github.com/criticalstack/machine-api-provider-aws/internal"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// warmPoolUserData prepares a warm pool instance on its first boot. The
+// cloud-init state is cleaned, so that the bootstrap data supplied when the
+// instance is claimed is processed as on a first boot, and the instance then
+// stops itself.
+const warmPoolUserData = `#cloud-config
+runcmd:
+  - [cloud-init, clean, --logs]
+  - [shutdown, -h, now]
+`
+
+// warmPoolClaims serializes claiming warm pool instances so that concurrent
+// workers do not start the same instance.
+var warmPoolClaims sync.Mutex
+
+// reconcileWarmPools launches instances for warm pools below their size and
+// terminates surplus stopped instances, recording the pool sizes in the
+// provider status.
+func (r *AWSInfrastructureProviderReconciler) reconcileWarmPools(ctx context.Context, awscfg *aws.Config, ip *infrav1.AWSInfrastructureProvider) error {
+	statuses := make([]infrav1.WarmPoolStatus, 0)
+	defer func() {
+		ip.Status.WarmPools = statuses
+	}()
+	for i := range ip.Spec.WarmPools {
+		status, err := r.reconcileWarmPool(ctx, awscfg, ip, &ip.Spec.WarmPools[i])
+		if err != nil {
+			return errors.Wrapf(err, "warm pool %q", ip.Spec.WarmPools[i].Name)
+		}
+		statuses = append(statuses, status)
+	}
+	return nil
+}
+
+func (r *AWSInfrastructureProviderReconciler) reconcileWarmPool(ctx context.Context, awscfg *aws.Config, ip *infrav1.AWSInfrastructureProvider, pool *infrav1.WarmPool) (infrav1.WarmPoolStatus, error) {
+	status := infrav1.WarmPoolStatus{Name: pool.Name}
+	if pool.Template.OSFamily != "" && pool.Template.OSFamily != infrav1.OSFamilyLinux {
+		return status, errors.Errorf("%s instances are not supported", pool.Template.OSFamily)
+	}
+	if len(pool.Template.NetworkInterfaceIDs) != 0 {
+		return status, errors.New("networkInterfaceIDs cannot be used in a template")
+	}
+	if pool.Template.Region != "" {
+		awscfg = &aws.Config{Region: aws.String(pool.Template.Region)}
+	}
+	instances, err := awsutil.DescribeWarmPoolInstances(ctx, awscfg, ip.Namespace, pool.Name)
+	if err != nil {
+		return status, err
+	}
+	ready := make([]*ec2.Instance, 0)
+	for _, instance := range instances {
+		if awsutil.IsClaimed(instance) {
+			continue
+		}
+		switch aws.StringValue(instance.State.Name) {
+		case ec2.InstanceStateNameStopped:
+			ready = append(ready, instance)
+		case ec2.InstanceStateNameShuttingDown:
+		default:
+			status.Pending++
+		}
+	}
+	for int32(len(ready)) > pool.Size {
+		id := aws.StringValue(ready[len(ready)-1].InstanceId)
+		r.Log.Info("terminating surplus warm pool instance", "pool", pool.Name, "instance", id)
+		if err := awsutil.TerminateInstance(ctx, awscfg, id); err != nil {
+			return status, err
+		}
+		ready = ready[:len(ready)-1]
+	}
+	status.Ready = int32(len(ready))
+
+	if status.Ready+status.Pending >= pool.Size {
+		return status, nil
+	}
+	data, err := internal.EncodeUserData(infrav1.OSFamilyLinux, "", []byte(warmPoolUserData))
+	if err != nil {
+		return status, err
+	}
+	am := &infrav1.AWSMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "warm-pool-" + pool.Name,
+			Namespace: ip.Namespace,
+		},
+		Spec: *pool.Template.DeepCopy(),
+	}
+	applyAdditionalTags(am, ip.Spec.AdditionalTags)
+	if am.Spec.Tags == nil {
+		am.Spec.Tags = make(map[string]string)
+	}
+	am.Spec.Tags[awsutil.WarmPoolTagKey] = ip.Namespace + "/" + pool.Name
+	am.Spec.InstanceInitiatedShutdownBehavior = ec2.ShutdownBehaviorStop
+	for status.Ready+status.Pending < pool.Size {
+		instance, err := awsutil.LaunchInstance(ctx, awscfg, am, data)
+		if err != nil {
+			return status, err
+		}
+		r.Log.Info("launched warm pool instance", "pool", pool.Name, "instance", aws.StringValue(instance.InstanceId))
+		status.Pending++
+	}
+	return status, nil
+}
+
+// claimWarmInstance starts a stopped instance from the warm pool of the
+// machine with the given bootstrap data. It returns nil when the machine
+// does not use a warm pool or no instance is available.
+func (r *AWSMachineReconciler) claimWarmInstance(ctx context.Context, awscfg *aws.Config, am *infrav1.AWSMachine, userData string) (*ec2.Instance, error) {
+	if am.Spec.WarmPool == "" {
+		return nil, nil
+	}
+	ip, err := getProvider(ctx, r.Client, am.Namespace)
+	if err != nil || ip == nil {
+		return nil, err
+	}
+	var pool *infrav1.WarmPool
+	for i := range ip.Spec.WarmPools {
+		if ip.Spec.WarmPools[i].Name == am.Spec.WarmPool {
+			pool = &ip.Spec.WarmPools[i]
+		}
+	}
+	if pool == nil || pool.Template.AMI != am.Spec.AMI || pool.Template.InstanceType != am.Spec.InstanceType {
+		return nil, nil
+	}
+
+	warmPoolClaims.Lock()
+	defer warmPoolClaims.Unlock()
+
+	instances, err := awsutil.DescribeWarmPoolInstances(ctx, awscfg, am.Namespace, pool.Name)
+	if err != nil {
+		return nil, err
+	}
+	var claimed *ec2.Instance
+	for _, instance := range instances {
+		// an instance claimed earlier may have failed to start
+		if tagValue(instance.Tags, awsutil.MachineUIDTagKey) == string(am.UID) {
+			claimed = instance
+			break
+		}
+		if claimed == nil && !awsutil.IsClaimed(instance) && aws.StringValue(instance.State.Name) == ec2.InstanceStateNameStopped {
+			claimed = instance
+		}
+	}
+	if claimed == nil {
+		return nil, nil
+	}
+	id := aws.StringValue(claimed.InstanceId)
+	tags := awsutil.OwnerTags(am)
+	for k, v := range am.Spec.Tags {
+		tags[k] = v
+	}
+	if am.Status.InstanceName != "" {
+		tags[awsutil.NameTagKey] = am.Status.InstanceName
+	}
+	tags, err = awsutil.InstanceTags(claimed, tags)
+	if err != nil {
+		return nil, err
+	}
+	if err := awsutil.CreateTags(ctx, awscfg, id, tags); err != nil {
+		return nil, err
+	}
+	if aws.StringValue(claimed.State.Name) == ec2.InstanceStateNameStopped {
+		if err := awsutil.StartInstance(ctx, awscfg, id, userData); err != nil {
+			return nil, err
+		}
+	}
+	return claimed, nil
+}
+
+func tagValue(tags []*ec2.Tag, key string) string {
+	v, _ := awsutil.TagValue(tags, key)
+	return v
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// matchesWatchFilter returns true if the object labels match the watch
+// filter. A nil filter matches everything, so that multiple managers can each
+// own a subset of objects only when configured to do so.
+func matchesWatchFilter(filter labels.Selector, obj metav1.Object) bool {
+	if filter == nil {
+		return true
+	}
+	return filter.Matches(labels.Set(obj.GetLabels()))
+}
+
+// watchFilterPredicate filters events for objects that do not match the
+// watch filter.
+func watchFilterPredicate(filter labels.Selector) predicate.Funcs {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return matchesWatchFilter(filter, e.Meta)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return matchesWatchFilter(filter, e.MetaNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return matchesWatchFilter(filter, e.Meta)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return matchesWatchFilter(filter, e.Meta)
+		},
+	}
+}
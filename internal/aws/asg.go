@@ -2,15 +2,14 @@ package aws
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/pkg/errors"
 )
 
 func AttachInstance(ctx context.Context, cfg *aws.Config, groupName, instanceID string) error {
-	svc := autoscaling.New(session.New(cfg))
+	svc := autoscaling.New(newSession(cfg, autoscalingLimiter))
 	_, err := svc.AttachInstancesWithContext(ctx, &autoscaling.AttachInstancesInput{
 		AutoScalingGroupName: aws.String(groupName),
 		InstanceIds:          aws.StringSlice([]string{instanceID}),
@@ -18,40 +17,66 @@ func AttachInstance(ctx context.Context, cfg *aws.Config, groupName, instanceID
 	return err
 }
 
+// DetachInstance removes the instance from the group without decrementing
+// the desired capacity of the group, so that the group launches a
+// replacement.
 func DetachInstance(ctx context.Context, cfg *aws.Config, groupName, instanceID string) error {
-	svc := autoscaling.New(session.New(cfg))
+	svc := autoscaling.New(newSession(cfg, autoscalingLimiter))
 	_, err := svc.DetachInstancesWithContext(ctx, &autoscaling.DetachInstancesInput{
-		AutoScalingGroupName: aws.String(groupName),
-		InstanceIds:          aws.StringSlice([]string{instanceID}),
+		AutoScalingGroupName:           aws.String(groupName),
+		InstanceIds:                    aws.StringSlice([]string{instanceID}),
+		ShouldDecrementDesiredCapacity: aws.Bool(false),
 	})
 	return err
 }
 
-func DescribeGroup(ctx context.Context, cfg *aws.Config, groupName, instanceID string) error {
-	svc := autoscaling.New(session.New(cfg))
+func DescribeGroup(ctx context.Context, cfg *aws.Config, groupName string) (*autoscaling.Group, error) {
+	svc := autoscaling.New(newSession(cfg, autoscalingLimiter))
 	resp, err := svc.DescribeAutoScalingGroupsWithContext(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
 		AutoScalingGroupNames: aws.StringSlice([]string{groupName}),
 		MaxRecords:            aws.Int64(1),
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	fmt.Printf("resp = %+v\n", resp)
-
-	return err
+	if len(resp.AutoScalingGroups) == 0 {
+		return nil, errors.Errorf("cannot find autoscaling group: %#v", groupName)
+	}
+	return resp.AutoScalingGroups[0], nil
 }
 
 func DescribeAutoscalingInstances(ctx context.Context, cfg *aws.Config, instanceID string) (string, error) {
-	svc := autoscaling.New(session.New(cfg))
+	group, _, err := DescribeAutoscalingMembership(ctx, cfg, instanceID)
+	return group, err
+}
+
+// DescribeAutoscalingMembership returns the Auto Scaling group of the
+// instance and its lifecycle state in the group, e.g. InService or
+// Terminating:Wait. The group is empty when the instance is not a member of
+// a group.
+func DescribeAutoscalingMembership(ctx context.Context, cfg *aws.Config, instanceID string) (string, string, error) {
+	svc := autoscaling.New(newSession(cfg, autoscalingLimiter))
 	resp, err := svc.DescribeAutoScalingInstancesWithContext(ctx, &autoscaling.DescribeAutoScalingInstancesInput{
 		InstanceIds: aws.StringSlice([]string{instanceID}),
 		MaxRecords:  aws.Int64(1),
 	})
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	for _, instance := range resp.AutoScalingInstances {
-		return aws.StringValue(instance.AutoScalingGroupName), nil
+		return aws.StringValue(instance.AutoScalingGroupName), aws.StringValue(instance.LifecycleState), nil
 	}
-	return "", nil
+	return "", "", nil
+}
+
+// SetInstanceProtection protects the instance from, or exposes it to, being
+// terminated when the group scales in.
+func SetInstanceProtection(ctx context.Context, cfg *aws.Config, groupName, instanceID string, protected bool) error {
+	svc := autoscaling.New(newSession(cfg, autoscalingLimiter))
+	_, err := svc.SetInstanceProtectionWithContext(ctx, &autoscaling.SetInstanceProtectionInput{
+		AutoScalingGroupName: aws.String(groupName),
+		InstanceIds:          aws.StringSlice([]string{instanceID}),
+		ProtectedFromScaleIn: aws.Bool(protected),
+	})
+	return err
 }
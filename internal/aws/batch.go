@@ -0,0 +1,336 @@
+package aws
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+// Batcher coalesces launches of identical instances into fewer RunInstances
+// calls. Batching is disabled when nil.
+var Batcher *LaunchBatcher
+
+// batchTimeout bounds the requests made for a batch, which are made on
+// behalf of several reconciles rather than any one of them.
+const batchTimeout = 2 * time.Minute
+
+// launchBatchTagKey is the tag identifying the batch an instance was
+// launched in. Instances are launched with it, before they are tagged with
+// their owner tags, so that instances left without owner tags can be found.
+const launchBatchTagKey = "infrastructure.crit.sh/launch-batch"
+
+// LaunchBatcher collects launches made within a window and launches those
+// with identical RunInstances input, apart from the owner tags of their
+// AWSMachine, in a single call with a MaxCount of the batch size. The
+// instances are assigned to the waiting launches in order and then tagged
+// with their owner tags. Instances of batches that were not tagged with
+// their owner tags, e.g. because the controller restarted in between, are
+// terminated by later batches, see sweep.
+//
+// The input includes the user data, subnet and tags of the machine, so only
+// machines created from the same template with identical bootstrap data
+// are batched together. The size of a batch is bounded by the number of
+// concurrent reconciles, since each launch blocks its reconcile until the
+// batch has been launched.
+type LaunchBatcher struct {
+	Window  time.Duration
+	MaxSize int
+
+	mu      sync.Mutex
+	batches map[string]*launchBatch
+	swept   map[string]time.Time
+}
+
+func NewLaunchBatcher(window time.Duration, maxSize int) *LaunchBatcher {
+	return &LaunchBatcher{
+		Window:  window,
+		MaxSize: maxSize,
+		batches: make(map[string]*launchBatch),
+		swept:   make(map[string]time.Time),
+	}
+}
+
+type launchBatch struct {
+	scope        string
+	svc          *ec2.EC2
+	input        *ec2.RunInstancesInput
+	instanceType string
+	zone         CapacityZone
+	requests     []*launchRequest
+}
+
+type launchRequest struct {
+	ownerTags map[string]string
+	result    chan launchResult
+}
+
+type launchResult struct {
+	instance *ec2.Instance
+	err      error
+}
+
+// canBatch returns true if the launch does not reference resources specific
+// to a single instance.
+func canBatch(input *ec2.RunInstancesInput) bool {
+	return len(input.NetworkInterfaces) == 0 && len(input.Ipv6Addresses) == 0 && !instanceMetadataTags(input)
+}
+
+// launch adds the launch to a batch and waits for the batch to be launched.
+// The input must have been built from instanceTags(m).
+func (b *LaunchBatcher) launch(ctx context.Context, svc *ec2.EC2, input *ec2.RunInstancesInput, instanceType string, zone CapacityZone, ownerTags map[string]string) (*ec2.Instance, error) {
+	shared := withoutTags(input, ownerTags)
+	scope, err := terminateKey(ctx, &svc.Config)
+	if err != nil {
+		return nil, err
+	}
+	key := batchKey(scope, shared)
+	req := &launchRequest{ownerTags: ownerTags, result: make(chan launchResult, 1)}
+
+	b.mu.Lock()
+	batch, ok := b.batches[key]
+	if !ok {
+		batch = &launchBatch{scope: scope, svc: svc, input: shared, instanceType: instanceType, zone: zone}
+		b.batches[key] = batch
+		Inflight.hold()
+		time.AfterFunc(b.Window, func() { b.flush(key, batch) })
+	}
+	batch.requests = append(batch.requests, req)
+	full := b.MaxSize > 0 && len(batch.requests) >= b.MaxSize
+	b.mu.Unlock()
+	if full {
+		go b.flush(key, batch)
+	}
+
+	// the result is awaited even if ctx is done, since an instance may be
+	// launched for the request either way
+	trace.SpanFromContext(ctx).AddEvent("waiting for launch batch")
+	r := <-req.result
+	return r.instance, r.err
+}
+
+// flush launches the batch unless it has already been launched.
+func (b *LaunchBatcher) flush(key string, batch *launchBatch) {
+	b.mu.Lock()
+	if b.batches[key] != batch {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.batches, key)
+	b.mu.Unlock()
+	batch.run()
+	if b.sweepDue(batch.scope) {
+		batch.sweep()
+	}
+}
+
+// sweepDue returns true if the instances launched with the credentials and
+// region of the scope have not been swept for batchTimeout.
+func (b *LaunchBatcher) sweepDue(scope string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Since(b.swept[scope]) < batchTimeout {
+		return false
+	}
+	b.swept[scope] = time.Now()
+	return true
+}
+
+func (batch *launchBatch) run() {
+	defer Inflight.End()
+	n := len(batch.requests)
+	ctx, cancel := context.WithTimeout(context.Background(), batchTimeout)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, "RunInstances", trace.WithAttributes(
+		attribute.String("instanceType", batch.instanceType),
+		attribute.String("availabilityZone", batch.zone.Name),
+		attribute.Int("batchSize", n),
+	))
+	defer span.End()
+
+	// the batch ID is the client token, so that retried requests do not
+	// launch the batch again
+	id := string(uuid.NewUUID())
+	input := *batch.input
+	input.MinCount = aws.Int64(1)
+	input.MaxCount = aws.Int64(int64(n))
+	input.ClientToken = aws.String(id)
+	input.TagSpecifications = withInstanceTags(input.TagSpecifications, map[string]string{launchBatchTagKey: id})
+	if n == 1 {
+		input.TagSpecifications = withTags(input.TagSpecifications, batch.requests[0].ownerTags)
+	}
+	resp, err := batch.svc.RunInstancesWithContext(ctx, &input)
+	if err != nil {
+		if IsInsufficientCapacity(err) {
+			Capacity.RecordFailure(batch.instanceType, batch.zone)
+		}
+		for _, req := range batch.requests {
+			req.result <- launchResult{err: err}
+		}
+		return
+	}
+	for i, req := range batch.requests {
+		if i >= len(resp.Instances) {
+			// MinCount allows fewer instances than requested when capacity
+			// is short
+			Capacity.RecordFailure(batch.instanceType, batch.zone)
+			req.result <- launchResult{err: errors.Errorf("only %d of %d instances in batch were launched", len(resp.Instances), n)}
+			continue
+		}
+		instance := resp.Instances[i]
+		if n > 1 {
+			if err := tagBatchInstance(ctx, batch.svc, instance, req.ownerTags); err != nil {
+				req.result <- launchResult{err: err}
+				continue
+			}
+		}
+		req.result <- launchResult{instance: instance}
+	}
+}
+
+// tagBatchInstance adds the owner tags to an instance launched in a batch.
+// The instance is terminated if it cannot be tagged, since it would
+// otherwise not be found by its AWSMachine. Instances that cannot be
+// terminated either are terminated by a later sweep.
+func tagBatchInstance(ctx context.Context, svc *ec2.EC2, instance *ec2.Instance, ownerTags map[string]string) error {
+	_, err := svc.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{instance.InstanceId},
+		Tags:      convertTags(ownerTags),
+	})
+	if err == nil {
+		return nil
+	}
+	if _, terr := svc.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: []*string{instance.InstanceId},
+	}); terr != nil {
+		return errors.Wrapf(err, "cannot tag instance %q launched in batch, and terminating it failed: %v", aws.StringValue(instance.InstanceId), terr)
+	}
+	return errors.Wrapf(err, "cannot tag instance %q launched in batch", aws.StringValue(instance.InstanceId))
+}
+
+// sweep terminates the instances launched in batches with the credentials
+// and region of the batch that were not tagged with their owner tags, e.g.
+// because tagging failed or the controller restarted before tagging them.
+// Only instances launched more than batchTimeout ago are terminated, since
+// the requests of a batch are bounded by it, so that instances of batches
+// still being tagged are left alone.
+func (batch *launchBatch) sweep() {
+	ctx, cancel := context.WithTimeout(context.Background(), batchTimeout)
+	defer cancel()
+	ids := make([]*string, 0)
+	if err := batch.svc.DescribeInstancesPagesWithContext(ctx, &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag-key"),
+				Values: aws.StringSlice([]string{launchBatchTagKey}),
+			},
+			{
+				Name: aws.String("instance-state-name"),
+				Values: aws.StringSlice([]string{
+					ec2.InstanceStateNamePending,
+					ec2.InstanceStateNameRunning,
+					ec2.InstanceStateNameStopping,
+					ec2.InstanceStateNameStopped,
+				}),
+			},
+		},
+	}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, r := range page.Reservations {
+			for _, i := range r.Instances {
+				if untaggedBatchInstance(i, time.Now()) {
+					ids = append(ids, i.InstanceId)
+				}
+			}
+		}
+		return !lastPage
+	}); err != nil || len(ids) == 0 {
+		return
+	}
+	_, _ = batch.svc.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{InstanceIds: ids})
+}
+
+// untaggedBatchInstance returns true if the instance was launched in a
+// batch more than batchTimeout before now and has no owner tags. Instances
+// of warm pools are left to their pool, which counts them either way.
+func untaggedBatchInstance(i *ec2.Instance, now time.Time) bool {
+	if _, ok := TagValue(i.Tags, MachineUIDTagKey); ok {
+		return false
+	}
+	if _, ok := TagValue(i.Tags, WarmPoolTagKey); ok {
+		return false
+	}
+	return i.LaunchTime != nil && now.Sub(*i.LaunchTime) > batchTimeout
+}
+
+// withoutTags returns a copy of the input without the given tags.
+func withoutTags(input *ec2.RunInstancesInput, tags map[string]string) *ec2.RunInstancesInput {
+	out := *input
+	out.TagSpecifications = nil
+	for _, spec := range input.TagSpecifications {
+		s := &ec2.TagSpecification{ResourceType: spec.ResourceType}
+		for _, t := range spec.Tags {
+			if _, ok := tags[aws.StringValue(t.Key)]; !ok {
+				s.Tags = append(s.Tags, t)
+			}
+		}
+		sort.Slice(s.Tags, func(i, j int) bool {
+			return aws.StringValue(s.Tags[i].Key) < aws.StringValue(s.Tags[j].Key)
+		})
+		out.TagSpecifications = append(out.TagSpecifications, s)
+	}
+	return &out
+}
+
+// withTags returns the tag specifications with the given tags added.
+func withTags(specs []*ec2.TagSpecification, tags map[string]string) []*ec2.TagSpecification {
+	out := make([]*ec2.TagSpecification, 0, len(specs))
+	for _, spec := range specs {
+		out = append(out, &ec2.TagSpecification{
+			ResourceType: spec.ResourceType,
+			Tags:         append(append([]*ec2.Tag{}, spec.Tags...), convertTags(tags)...),
+		})
+	}
+	return out
+}
+
+// withInstanceTags returns the tag specifications with the given tags added
+// to those of the instance, which are added if there are none.
+func withInstanceTags(specs []*ec2.TagSpecification, tags map[string]string) []*ec2.TagSpecification {
+	out := make([]*ec2.TagSpecification, 0, len(specs)+1)
+	found := false
+	for _, spec := range specs {
+		if aws.StringValue(spec.ResourceType) != ec2.ResourceTypeInstance {
+			out = append(out, spec)
+			continue
+		}
+		found = true
+		out = append(out, &ec2.TagSpecification{
+			ResourceType: spec.ResourceType,
+			Tags:         append(append([]*ec2.Tag{}, spec.Tags...), convertTags(tags)...),
+		})
+	}
+	if !found {
+		out = append(out, &ec2.TagSpecification{
+			ResourceType: aws.String(ec2.ResourceTypeInstance),
+			Tags:         convertTags(tags),
+		})
+	}
+	return out
+}
+
+// batchKey identifies launches that can be batched: those with the same
+// input made in the scope of the same credentials and region, see
+// terminateKey.
+func batchKey(scope string, input *ec2.RunInstancesInput) string {
+	h := sha256.Sum256([]byte(input.String()))
+	return fmt.Sprintf("%s/%x", scope, h)
+}
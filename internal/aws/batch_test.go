@@ -0,0 +1,208 @@
+package aws
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// batchServer answers RunInstances with an instance per MaxCount, failing
+// CreateTags and TerminateInstances when told to, and records the requests
+// of each action.
+type batchServer struct {
+	failTags      bool
+	failTerminate bool
+	describe      string
+
+	mu    sync.Mutex
+	forms map[string][]url.Values
+}
+
+func (s *batchServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	action := form.Get("Action")
+	s.mu.Lock()
+	s.forms[action] = append(s.forms[action], form)
+	s.mu.Unlock()
+
+	status, resp := http.StatusOK, fmt.Sprintf("<%sResponse></%sResponse>", action, action)
+	switch action {
+	case "RunInstances":
+		var b strings.Builder
+		n := 0
+		fmt.Sscan(form.Get("MaxCount"), &n)
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&b, "<item><instanceId>i-%d</instanceId></item>", i)
+		}
+		resp = "<RunInstancesResponse><instancesSet>" + b.String() + "</instancesSet></RunInstancesResponse>"
+	case "CreateTags":
+		if s.failTags {
+			status, resp = http.StatusBadRequest, "<Response><Errors><Error><Code>InternalError</Code><Message>tagging failed</Message></Error></Errors></Response>"
+		}
+	case "TerminateInstances":
+		if s.failTerminate {
+			status, resp = http.StatusBadRequest, "<Response><Errors><Error><Code>InternalError</Code><Message>termination failed</Message></Error></Errors></Response>"
+		}
+	case "DescribeInstances":
+		resp = "<DescribeInstancesResponse><reservationSet><item><instancesSet>" + s.describe + "</instancesSet></item></reservationSet></DescribeInstancesResponse>"
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"text/xml"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(resp)),
+		Request:    req,
+	}, nil
+}
+
+func (s *batchServer) requests(action string) []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]url.Values(nil), s.forms[action]...)
+}
+
+func newBatchTest(s *batchServer, accessKey string) *ec2.EC2 {
+	s.forms = make(map[string][]url.Values)
+	return ec2.New(newBaseSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials(accessKey, "secret", ""),
+		HTTPClient:  &http.Client{Transport: s},
+		MaxRetries:  aws.Int(0),
+	}))
+}
+
+// formTags returns the instance tags of the RunInstances request.
+func formTags(form url.Values) map[string]string {
+	tags := make(map[string]string)
+	for i := 1; form.Get(fmt.Sprintf("TagSpecification.%d.ResourceType", i)) != ""; i++ {
+		if form.Get(fmt.Sprintf("TagSpecification.%d.ResourceType", i)) != ec2.ResourceTypeInstance {
+			continue
+		}
+		for j := 1; form.Get(fmt.Sprintf("TagSpecification.%d.Tag.%d.Key", i, j)) != ""; j++ {
+			tags[form.Get(fmt.Sprintf("TagSpecification.%d.Tag.%d.Key", i, j))] = form.Get(fmt.Sprintf("TagSpecification.%d.Tag.%d.Value", i, j))
+		}
+	}
+	return tags
+}
+
+func TestLaunchBatchTagsInstancesAtLaunch(t *testing.T) {
+	s := &batchServer{failTags: true, failTerminate: true}
+	svc := newBatchTest(s, "AKIDTEST")
+	input := &ec2.RunInstancesInput{
+		ImageId: aws.String("ami-1"),
+		TagSpecifications: []*ec2.TagSpecification{{
+			ResourceType: aws.String(ec2.ResourceTypeInstance),
+			Tags:         []*ec2.Tag{{Key: aws.String("team"), Value: aws.String("infra")}},
+		}},
+	}
+	batch := &launchBatch{svc: svc, input: input}
+	for _, uid := range []string{"uid-1", "uid-2"} {
+		batch.requests = append(batch.requests, &launchRequest{
+			ownerTags: map[string]string{MachineUIDTagKey: uid},
+			result:    make(chan launchResult, 1),
+		})
+	}
+	Inflight.hold()
+	batch.run()
+
+	runs := s.requests("RunInstances")
+	if len(runs) != 1 {
+		t.Fatalf("RunInstances requests = %d, want 1", len(runs))
+	}
+	tags := formTags(runs[0])
+	id := tags[launchBatchTagKey]
+	if id == "" || tags["team"] != "infra" {
+		t.Fatalf("instance tags = %v, want the batch ID and the shared tags", tags)
+	}
+	if token := runs[0].Get("ClientToken"); token != id {
+		t.Errorf("client token = %q, want the batch ID %q", token, id)
+	}
+	if _, ok := tags[MachineUIDTagKey]; ok {
+		t.Errorf("instance tags = %v, want the owner tags added after launch", tags)
+	}
+	for _, req := range batch.requests {
+		if r := <-req.result; r.err == nil {
+			t.Errorf("launch of %s succeeded, want the tagging error", req.ownerTags[MachineUIDTagKey])
+		}
+	}
+}
+
+func TestLaunchBatchSweep(t *testing.T) {
+	old := time.Now().Add(-2 * batchTimeout).UTC().Format(time.RFC3339)
+	recent := time.Now().UTC().Format(time.RFC3339)
+	instance := func(id, launched string, tags ...string) string {
+		var b strings.Builder
+		fmt.Fprintf(&b, "<item><instanceId>%s</instanceId><launchTime>%s</launchTime><tagSet>", id, launched)
+		fmt.Fprintf(&b, "<item><key>%s</key><value>batch</value></item>", launchBatchTagKey)
+		for _, key := range tags {
+			fmt.Fprintf(&b, "<item><key>%s</key><value></value></item>", key)
+		}
+		b.WriteString("</tagSet></item>")
+		return b.String()
+	}
+	s := &batchServer{describe: instance("i-leaked", old) +
+		instance("i-tagging", recent) +
+		instance("i-owned", old, MachineUIDTagKey) +
+		instance("i-warm", old, WarmPoolTagKey)}
+	svc := newBatchTest(s, "AKIDTEST")
+	(&launchBatch{svc: svc}).sweep()
+
+	describes := s.requests("DescribeInstances")
+	if len(describes) != 1 || describes[0].Get("Filter.1.Name") != "tag-key" || describes[0].Get("Filter.1.Value.1") != launchBatchTagKey {
+		t.Fatalf("DescribeInstances requests = %v, want instances with the batch tag", describes)
+	}
+	terminates := s.requests("TerminateInstances")
+	if len(terminates) != 1 || terminates[0].Get("InstanceId.1") != "i-leaked" || terminates[0].Get("InstanceId.2") != "" {
+		t.Fatalf("TerminateInstances requests = %v, want only i-leaked terminated", terminates)
+	}
+}
+
+func TestLaunchBatcherSweepDue(t *testing.T) {
+	b := NewLaunchBatcher(time.Hour, 10)
+	if !b.sweepDue("AKIDTEST/us-east-1") {
+		t.Fatal("first sweep is not due")
+	}
+	if b.sweepDue("AKIDTEST/us-east-1") {
+		t.Error("sweep is due again right away")
+	}
+	if !b.sweepDue("AKIDOTHER/us-east-1") {
+		t.Error("sweep of other credentials is not due")
+	}
+}
+
+func TestBatchKeyUsesAccessKey(t *testing.T) {
+	ctx := context.Background()
+	input := &ec2.RunInstancesInput{ImageId: aws.String("ami-1")}
+	key := func(accessKey string) string {
+		svc := newBatchTest(&batchServer{}, accessKey)
+		scope, err := terminateKey(ctx, &svc.Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return batchKey(scope, input)
+	}
+	// each reconcile builds its own credentials
+	if key("AKIDTEST") != key("AKIDTEST") {
+		t.Error("launches with the same access key are not batched together")
+	}
+	if key("AKIDTEST") == key("AKIDOTHER") {
+		t.Error("launches with different access keys are batched together")
+	}
+}
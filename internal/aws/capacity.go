@@ -0,0 +1,231 @@
+package aws
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	InsufficientInstanceCapacity = "InsufficientInstanceCapacity"
+
+	// DefaultCapacityCooldown is how long an availability zone is
+	// deprioritized for an instance type after a capacity failure.
+	DefaultCapacityCooldown = 10 * time.Minute
+)
+
+var insufficientCapacityTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mapa_insufficient_capacity_total",
+	Help: "Number of launches that failed with InsufficientInstanceCapacity, by instance type and availability zone ID.",
+}, []string{"instance_type", "availability_zone_id"})
+
+func init() {
+	metrics.Registry.MustRegister(insufficientCapacityTotal)
+}
+
+// Capacity tracks recent capacity failures for all launches made by this
+// process.
+var Capacity = NewCapacityTracker(DefaultCapacityCooldown)
+
+// CapacityZone identifies an availability zone of an account. Zone names
+// map to different physical zones in each account, so capacity is tracked
+// by account and zone ID, e.g. use1-az1.
+type CapacityZone struct {
+	Account string
+	ID      string
+	Name    string
+}
+
+func (z CapacityZone) key(instanceType string) string {
+	return z.Account + "/" + instanceType + "/" + z.ID
+}
+
+// CapacityFailure is the failure history for an instance type in an
+// availability zone of an account.
+type CapacityFailure struct {
+	Account            string
+	InstanceType       string
+	AvailabilityZone   string
+	AvailabilityZoneID string
+	Count              int
+	LastFailure        time.Time
+}
+
+func (f *CapacityFailure) zone() CapacityZone {
+	return CapacityZone{Account: f.Account, ID: f.AvailabilityZoneID, Name: f.AvailabilityZone}
+}
+
+// CapacityTracker records InsufficientInstanceCapacity errors per account,
+// instance type and availability zone ID so that subnet selection can avoid
+// zones that recently ran out of capacity. Zones whose ID is not known are
+// not tracked.
+type CapacityTracker struct {
+	Cooldown time.Duration
+
+	mu       sync.Mutex
+	failures map[string]*CapacityFailure
+}
+
+func NewCapacityTracker(cooldown time.Duration) *CapacityTracker {
+	return &CapacityTracker{
+		Cooldown: cooldown,
+		failures: make(map[string]*CapacityFailure),
+	}
+}
+
+// RecordFailure records a capacity failure for the instance type in the
+// availability zone.
+func (c *CapacityTracker) RecordFailure(instanceType string, zone CapacityZone) {
+	if zone.ID == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := zone.key(instanceType)
+	f, ok := c.failures[key]
+	if !ok {
+		f = &CapacityFailure{
+			Account:            zone.Account,
+			InstanceType:       instanceType,
+			AvailabilityZone:   zone.Name,
+			AvailabilityZoneID: zone.ID,
+		}
+		c.failures[key] = f
+	}
+	f.Count++
+	f.LastFailure = time.Now()
+	insufficientCapacityTotal.WithLabelValues(instanceType, zone.ID).Inc()
+}
+
+// Restore adds failures recorded by a previous process, e.g. from the status
+// of the infrastructure provider, so that subnet selection keeps avoiding
+// their availability zones after a restart. Failures already known are only
+// updated if the restored failure is more recent, and failures without a
+// zone ID are ignored.
+func (c *CapacityTracker) Restore(failures []CapacityFailure) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range failures {
+		if r.AvailabilityZoneID == "" {
+			continue
+		}
+		key := r.zone().key(r.InstanceType)
+		if f, ok := c.failures[key]; ok && !f.LastFailure.Before(r.LastFailure) {
+			continue
+		}
+		r := r
+		c.failures[key] = &r
+	}
+}
+
+// Failing reports whether the instance type has had a capacity failure in
+// the availability zone within the cooldown period.
+func (c *CapacityTracker) Failing(instanceType string, zone CapacityZone) bool {
+	if zone.ID == "" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.failures[zone.key(instanceType)]
+	return ok && time.Since(f.LastFailure) < c.Cooldown
+}
+
+// Failures returns the failure history of the account sorted by instance
+// type and availability zone.
+func (c *CapacityTracker) Failures(account string) []CapacityFailure {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	failures := make([]CapacityFailure, 0)
+	for _, f := range c.failures {
+		if f.Account == account {
+			failures = append(failures, *f)
+		}
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].InstanceType != failures[j].InstanceType {
+			return failures[i].InstanceType < failures[j].InstanceType
+		}
+		return failures[i].AvailabilityZone < failures[j].AvailabilityZone
+	})
+	return failures
+}
+
+// capacityScopes caches the account and availability zone IDs of each set
+// of credentials in a region, keyed like terminations, see terminateKey.
+var capacityScopes sync.Map
+
+type capacityScope struct {
+	account string
+	zoneIDs map[string]string
+}
+
+// zone returns the availability zone of the scope with the name. The zone
+// has no ID when the scope could not be looked up.
+func (s *capacityScope) zone(name string) CapacityZone {
+	return CapacityZone{Account: s.account, ID: s.zoneIDs[name], Name: name}
+}
+
+// lookupCapacityScope returns the account of the credentials of cfg and the
+// IDs of the availability zones of its region. They do not change, so they
+// are looked up once.
+func lookupCapacityScope(ctx context.Context, cfg *aws.Config) (*capacityScope, error) {
+	key, err := terminateKey(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := capacityScopes.Load(key); ok {
+		return s.(*capacityScope), nil
+	}
+	account, _, err := GetCallerIdentity(ctx, cfg.Copy().WithSTSRegionalEndpoint(endpoints.RegionalSTSEndpoint))
+	if err != nil {
+		return nil, err
+	}
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.DescribeAvailabilityZonesWithContext(ctx, &ec2.DescribeAvailabilityZonesInput{
+		AllAvailabilityZones: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &capacityScope{account: account, zoneIDs: make(map[string]string)}
+	for _, az := range resp.AvailabilityZones {
+		s.zoneIDs[aws.StringValue(az.ZoneName)] = aws.StringValue(az.ZoneId)
+	}
+	capacityScopes.Store(key, s)
+	return s, nil
+}
+
+// capacityScopeOrEmpty returns the capacity scope of cfg, or an empty scope
+// if it cannot be looked up, in which case capacity is not tracked for the
+// launch rather than failing it.
+func capacityScopeOrEmpty(ctx context.Context, cfg *aws.Config) *capacityScope {
+	s, err := lookupCapacityScope(ctx, cfg)
+	if err != nil {
+		return &capacityScope{}
+	}
+	return s
+}
+
+// CapacityAccount returns the account that the capacity failures of
+// launches made with cfg are recorded under.
+func CapacityAccount(ctx context.Context, cfg *aws.Config) (string, error) {
+	s, err := lookupCapacityScope(ctx, cfg)
+	if err != nil {
+		return "", err
+	}
+	return s.account, nil
+}
+
+// IsInsufficientCapacity returns true if the error is an EC2
+// InsufficientInstanceCapacity error.
+func IsInsufficientCapacity(err error) bool {
+	return errors.Is(err, ErrInsufficientCapacity)
+}
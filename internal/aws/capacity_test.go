@@ -0,0 +1,56 @@
+package aws
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCapacityTrackerZones(t *testing.T) {
+	c := NewCapacityTracker(time.Minute)
+	a := CapacityZone{Account: "111111111111", ID: "use1-az1", Name: "us-east-1a"}
+	c.RecordFailure("m5.large", a)
+
+	cases := []struct {
+		name         string
+		instanceType string
+		zone         CapacityZone
+		expected     bool
+	}{
+		{name: "same zone", instanceType: "m5.large", zone: a, expected: true},
+		{name: "other instance type", instanceType: "m5.xlarge", zone: a, expected: false},
+		{
+			name:         "same name in another account",
+			instanceType: "m5.large",
+			zone:         CapacityZone{Account: "222222222222", ID: "use1-az4", Name: "us-east-1a"},
+			expected:     false,
+		},
+		{
+			name:         "same zone named differently",
+			instanceType: "m5.large",
+			zone:         CapacityZone{Account: "111111111111", ID: "use1-az1", Name: "us-east-1c"},
+			expected:     true,
+		},
+		{
+			name:         "unknown zone ID",
+			instanceType: "m5.large",
+			zone:         CapacityZone{Account: "111111111111", Name: "us-east-1a"},
+			expected:     false,
+		},
+	}
+	for _, tc := range cases {
+		if got := c.Failing(tc.instanceType, tc.zone); got != tc.expected {
+			t.Errorf("%s: expected failing %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+
+	c.RecordFailure("m5.large", CapacityZone{Account: "111111111111", Name: "us-east-1b"})
+	c.Restore([]CapacityFailure{
+		{Account: "222222222222", InstanceType: "m5.large", AvailabilityZone: "us-east-1a", AvailabilityZoneID: "use1-az4", Count: 1, LastFailure: time.Now()},
+		{Account: "222222222222", InstanceType: "m5.large", AvailabilityZone: "us-east-1b", Count: 1, LastFailure: time.Now()},
+	})
+	for account, expected := range map[string]int{"111111111111": 1, "222222222222": 1, "333333333333": 0} {
+		if n := len(c.Failures(account)); n != expected {
+			t.Errorf("account %s: expected %d failures, got %d", account, expected, n)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package aws
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Utilization is the resource utilization of an instance over a period, in
+// percent.
+type Utilization struct {
+	CPUAverage float64
+	CPUMaximum float64
+
+	// Memory utilization is only available for instances running the
+	// CloudWatch agent with the mem_used_percent metric enabled.
+	HasMemory     bool
+	MemoryAverage float64
+	MemoryMaximum float64
+}
+
+// DescribeUtilization returns the CPU and memory utilization of the instance
+// over the period ending now. It returns nil if CloudWatch has no
+// datapoints for the instance.
+func DescribeUtilization(ctx context.Context, cfg *aws.Config, instanceID string, period time.Duration) (*Utilization, error) {
+	svc := cloudwatch.New(newSession(cfg, cloudwatchLimiter))
+	dims := []*cloudwatch.Dimension{{
+		Name:  aws.String("InstanceId"),
+		Value: aws.String(instanceID),
+	}}
+	cpuAvg, cpuMax, ok, err := metricStatistics(ctx, svc, "AWS/EC2", "CPUUtilization", dims, period)
+	if err != nil || !ok {
+		return nil, err
+	}
+	u := &Utilization{CPUAverage: cpuAvg, CPUMaximum: cpuMax}
+
+	// the CloudWatch agent appends further dimensions (e.g. ImageId and
+	// InstanceType) depending on its configuration, so find the exact set
+	// published for the instance
+	metrics, err := svc.ListMetricsWithContext(ctx, &cloudwatch.ListMetricsInput{
+		Namespace:  aws.String("CWAgent"),
+		MetricName: aws.String("mem_used_percent"),
+		Dimensions: []*cloudwatch.DimensionFilter{{
+			Name:  aws.String("InstanceId"),
+			Value: aws.String(instanceID),
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(metrics.Metrics) != 0 {
+		memAvg, memMax, ok, err := metricStatistics(ctx, svc, "CWAgent", "mem_used_percent", metrics.Metrics[0].Dimensions, period)
+		if err != nil {
+			return nil, err
+		}
+		u.HasMemory, u.MemoryAverage, u.MemoryMaximum = ok, memAvg, memMax
+	}
+	return u, nil
+}
+
+// metricStatistics returns the average and maximum of a metric over the
+// period, from hourly datapoints.
+func metricStatistics(ctx context.Context, svc *cloudwatch.CloudWatch, namespace, name string, dims []*cloudwatch.Dimension, period time.Duration) (avg, max float64, ok bool, err error) {
+	now := time.Now()
+	resp, err := svc.GetMetricStatisticsWithContext(ctx, &cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String(namespace),
+		MetricName: aws.String(name),
+		Dimensions: dims,
+		StartTime:  aws.Time(now.Add(-period)),
+		EndTime:    aws.Time(now),
+		Period:     aws.Int64(int64(time.Hour / time.Second)),
+		Statistics: aws.StringSlice([]string{cloudwatch.StatisticAverage, cloudwatch.StatisticMaximum}),
+	})
+	if err != nil || len(resp.Datapoints) == 0 {
+		return 0, 0, false, err
+	}
+	var sum float64
+	for _, dp := range resp.Datapoints {
+		sum += aws.Float64Value(dp.Average)
+		if m := aws.Float64Value(dp.Maximum); m > max {
+			max = m
+		}
+	}
+	return sum / float64(len(resp.Datapoints)), max, true, nil
+}
+
+// InstanceTypeExists returns true if the instance type is offered in the
+// region.
+func InstanceTypeExists(ctx context.Context, cfg *aws.Config, instanceType string) (bool, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.DescribeInstanceTypesWithContext(ctx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: aws.StringSlice([]string{instanceType}),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidInstanceType" {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(resp.InstanceTypes) != 0, nil
+}
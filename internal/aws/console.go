@@ -0,0 +1,56 @@
+package aws
+
+import (
+	"context"
+	"encoding/base64"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// GetConsoleOutput returns the serial console output of the instance. The
+// latest output is requested, which is only available on Nitro instances,
+// falling back to the output buffered at the last state transition.
+func GetConsoleOutput(ctx context.Context, cfg *aws.Config, instanceID string) (string, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	input := &ec2.GetConsoleOutputInput{
+		InstanceId: aws.String(instanceID),
+		Latest:     aws.Bool(true),
+	}
+	resp, err := svc.GetConsoleOutputWithContext(ctx, input)
+	if isUnsupportedOperation(err) {
+		input.Latest = nil
+		resp, err = svc.GetConsoleOutputWithContext(ctx, input)
+	}
+	if err != nil {
+		return "", err
+	}
+	out, err := base64.StdEncoding.DecodeString(aws.StringValue(resp.Output))
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// GetConsoleScreenshot returns a JPG screenshot of the instance console. It
+// returns nil when the instance type does not support screenshots.
+func GetConsoleScreenshot(ctx context.Context, cfg *aws.Config, instanceID string) ([]byte, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.GetConsoleScreenshotWithContext(ctx, &ec2.GetConsoleScreenshotInput{
+		InstanceId: aws.String(instanceID),
+		WakeUp:     aws.Bool(true),
+	})
+	if isUnsupportedOperation(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(aws.StringValue(resp.ImageData))
+}
+
+func isUnsupportedOperation(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "UnsupportedOperation"
+}
@@ -0,0 +1,100 @@
+package aws
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+const (
+	// defaultWebIdentityTokenFile is where the service account token of IAM
+	// roles for service accounts is mounted.
+	defaultWebIdentityTokenFile = "/var/run/secrets/eks.amazonaws.com/serviceaccount/token"
+)
+
+// NewCredentials returns credentials obtained by assuming the web identity
+// role of the AWSCredentials, if any, and then each role in order, starting
+// from the base credentials. The default credential chain is used when base
+// is nil.
+func NewCredentials(region string, base *credentials.Credentials, ac *infrav1.AWSCredentials) *credentials.Credentials {
+	creds := base
+	sess := func() *session.Session {
+		return withUserAgent(newBaseSession(&aws.Config{Region: aws.String(region), Credentials: creds}))
+	}
+	sessionName := roleSessionName(ac.Namespace, ac.Name)
+	if wi := ac.Spec.WebIdentity; wi != nil {
+		tokenFile := wi.TokenFile
+		if tokenFile == "" {
+			tokenFile = defaultWebIdentityTokenFile
+		}
+		creds = stscreds.NewWebIdentityCredentials(sess(), wi.RoleARN, sessionName, tokenFile)
+	}
+	for _, role := range ac.Spec.AssumeRoles {
+		role := role
+		creds = stscreds.NewCredentials(sess(), role.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = sessionName
+			if role.SessionName != "" {
+				p.RoleSessionName = role.SessionName
+			}
+			if role.ExternalID != "" {
+				p.ExternalID = aws.String(role.ExternalID)
+			}
+			if role.TagSession {
+				p.Tags = sessionTags(ac)
+			}
+		})
+	}
+	return creds
+}
+
+// sessionTags identify the controller and AWSCredentials that assumed a
+// role in CloudTrail, and can be used in IAM policy conditions.
+func sessionTags(ac *infrav1.AWSCredentials) []*sts.Tag {
+	tags := []*sts.Tag{
+		{Key: aws.String("kubernetes-namespace"), Value: aws.String(ac.Namespace)},
+		{Key: aws.String("awscredentials"), Value: aws.String(ac.Name)},
+	}
+	if ControllerIdentity != "" {
+		tags = append(tags, &sts.Tag{Key: aws.String("controller"), Value: aws.String(ControllerIdentity)})
+	}
+	return tags
+}
+
+// GetCallerIdentity returns the account and ARN of the credentials in cfg.
+// VerifyRegionalCredentials checks that the credentials of the config are
+// accepted in its region by calling the regional STS endpoint, since
+// credentials of one partition, e.g. aws, are rejected by the regions of
+// another, e.g. aws-cn, and regions that are not enabled reject all
+// credentials.
+func VerifyRegionalCredentials(ctx context.Context, cfg *aws.Config) error {
+	_, _, err := GetCallerIdentity(ctx, cfg.Copy().WithSTSRegionalEndpoint(endpoints.RegionalSTSEndpoint))
+	return err
+}
+
+func GetCallerIdentity(ctx context.Context, cfg *aws.Config) (account, arn string, err error) {
+	svc := sts.New(withUserAgent(newBaseSession(cfg)))
+	resp, err := svc.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", "", err
+	}
+	return aws.StringValue(resp.Account), aws.StringValue(resp.Arn), nil
+}
+
+// CredentialSource returns the name of the provider the default credential
+// chain gets its credentials from in the region, e.g. EnvConfigCredentials
+// or WebIdentityCredentials. The credentials themselves are not returned.
+func CredentialSource(ctx context.Context, region string) (string, error) {
+	sess := newBaseSession(&aws.Config{Region: aws.String(region)})
+	v, err := sess.Config.Credentials.GetWithContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	return v.ProviderName, nil
+}
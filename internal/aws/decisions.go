@@ -0,0 +1,184 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DecisionSource is the source of provisioning decision events.
+	DecisionSource = "infrastructure.crit.sh"
+
+	// DecisionDetailType is the detail type of provisioning decision
+	// events.
+	DecisionDetailType = "AWSMachine Provisioning Decision"
+
+	// maxPutEvents is the most entries PutEvents accepts.
+	maxPutEvents = 10
+
+	// maxPutLogEvents is the most events PutLogEvents accepts.
+	maxPutLogEvents = 10000
+)
+
+// DecisionRecord is a structured record of a provisioning decision made for
+// an AWSMachine, e.g. where its instance was launched or why the launch
+// failed.
+type DecisionRecord struct {
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	UID       string    `json:"uid"`
+
+	// Decision is what was decided, e.g. Launched or LaunchFailed.
+	Decision string `json:"decision"`
+
+	Region           string `json:"region,omitempty"`
+	InstanceID       string `json:"instanceID,omitempty"`
+	InstanceType     string `json:"instanceType,omitempty"`
+	AvailabilityZone string `json:"availabilityZone,omitempty"`
+	SubnetID         string `json:"subnetID,omitempty"`
+
+	// Reason and Message describe failures.
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// DecisionSink publishes decision records outside of the cluster.
+type DecisionSink interface {
+	Publish(ctx context.Context, records []DecisionRecord) error
+}
+
+// MultiDecisionSink publishes records to each of its sinks, returning the
+// first error.
+type MultiDecisionSink []DecisionSink
+
+func (m MultiDecisionSink) Publish(ctx context.Context, records []DecisionRecord) error {
+	var firstErr error
+	for _, s := range m {
+		if err := s.Publish(ctx, records); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// NewEventBridgeSink returns a sink putting each record as an event on the
+// event bus, which may be a name or an ARN.
+func NewEventBridgeSink(cfg *aws.Config, eventBus string) DecisionSink {
+	return &eventBridgeSink{
+		svc: eventbridge.New(withUserAgent(newBaseSession(cfg))),
+		bus: eventBus,
+	}
+}
+
+type eventBridgeSink struct {
+	svc *eventbridge.EventBridge
+	bus string
+}
+
+func (s *eventBridgeSink) Publish(ctx context.Context, records []DecisionRecord) error {
+	for len(records) > 0 {
+		n := len(records)
+		if n > maxPutEvents {
+			n = maxPutEvents
+		}
+		entries := make([]*eventbridge.PutEventsRequestEntry, 0, n)
+		for _, rec := range records[:n] {
+			b, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, &eventbridge.PutEventsRequestEntry{
+				EventBusName: aws.String(s.bus),
+				Source:       aws.String(DecisionSource),
+				DetailType:   aws.String(DecisionDetailType),
+				Detail:       aws.String(string(b)),
+				Time:         aws.Time(rec.Time),
+			})
+		}
+		resp, err := s.svc.PutEventsWithContext(ctx, &eventbridge.PutEventsInput{Entries: entries})
+		if err != nil {
+			return err
+		}
+		if failed := aws.Int64Value(resp.FailedEntryCount); failed != 0 {
+			for _, e := range resp.Entries {
+				if e.ErrorCode != nil {
+					return errors.Errorf("cannot put %d of %d events: %s: %s", failed, n, aws.StringValue(e.ErrorCode), aws.StringValue(e.ErrorMessage))
+				}
+			}
+		}
+		records = records[n:]
+	}
+	return nil
+}
+
+// NewCloudWatchLogsSink returns a sink writing each record as a JSON log
+// event to the log stream of the log group. The stream is created if it
+// does not exist; the group must exist.
+func NewCloudWatchLogsSink(cfg *aws.Config, logGroup, logStream string) DecisionSink {
+	return &cloudWatchLogsSink{
+		svc:    cloudwatchlogs.New(withUserAgent(newBaseSession(cfg))),
+		group:  logGroup,
+		stream: logStream,
+	}
+}
+
+type cloudWatchLogsSink struct {
+	svc    *cloudwatchlogs.CloudWatchLogs
+	group  string
+	stream string
+
+	created bool
+}
+
+func (s *cloudWatchLogsSink) Publish(ctx context.Context, records []DecisionRecord) error {
+	if !s.created {
+		_, err := s.svc.CreateLogStreamWithContext(ctx, &cloudwatchlogs.CreateLogStreamInput{
+			LogGroupName:  aws.String(s.group),
+			LogStreamName: aws.String(s.stream),
+		})
+		if !errors.Is(err, ErrAlreadyExists) {
+			if err != nil {
+				return errors.Wrapf(err, "cannot create log stream %s", s.stream)
+			}
+		}
+		s.created = true
+	}
+	// log events must be in chronological order
+	records = append([]DecisionRecord(nil), records...)
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	for len(records) > 0 {
+		n := len(records)
+		if n > maxPutLogEvents {
+			n = maxPutLogEvents
+		}
+		events := make([]*cloudwatchlogs.InputLogEvent, 0, n)
+		for _, rec := range records[:n] {
+			b, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			events = append(events, &cloudwatchlogs.InputLogEvent{
+				Message:   aws.String(string(b)),
+				Timestamp: aws.Int64(rec.Time.UnixNano() / int64(time.Millisecond)),
+			})
+		}
+		_, err := s.svc.PutLogEventsWithContext(ctx, &cloudwatchlogs.PutLogEventsInput{
+			LogGroupName:  aws.String(s.group),
+			LogStreamName: aws.String(s.stream),
+			LogEvents:     events,
+		})
+		if err != nil {
+			return err
+		}
+		records = records[n:]
+	}
+	return nil
+}
@@ -3,20 +3,39 @@ package aws
 import (
 	"context"
 	"encoding/base64"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
 )
 
-func LaunchInstance(ctx context.Context, cfg *aws.Config, m *infrav1.AWSMachine, userData string) (*ec2.Instance, error) {
+var tracer = otel.Tracer("github.com/criticalstack/machine-api-provider-aws/internal/aws")
+
+func LaunchInstance(ctx context.Context, cfg *aws.Config, m *infrav1.AWSMachine, userData string) (_ *ec2.Instance, reterr error) {
+	ctx, span := tracer.Start(ctx, "LaunchInstance")
+	defer func() {
+		if reterr != nil {
+			span.RecordError(reterr)
+			span.SetStatus(codes.Error, reterr.Error())
+		}
+		span.End()
+	}()
+
+	tags := instanceTags(m)
 	input := &ec2.RunInstancesInput{
-		BlockDeviceMappings: convertBlockDevices(m.Spec.BlockDevices),
+		BlockDeviceMappings: convertBlockDevices(m.Spec.OSFamily, m.Spec.BlockDevices),
 		ImageId:             aws.String(m.Spec.AMI),
 		InstanceType:        aws.String(m.Spec.InstanceType),
 		KeyName:             aws.String(m.Spec.KeyName),
@@ -25,11 +44,56 @@ func LaunchInstance(ctx context.Context, cfg *aws.Config, m *infrav1.AWSMachine,
 		TagSpecifications: []*ec2.TagSpecification{
 			{
 				ResourceType: aws.String("instance"),
-				Tags:         convertTags(m.Spec.Tags),
+				Tags:         convertTags(tags),
+			},
+			{
+				ResourceType: aws.String("volume"),
+				Tags:         convertTags(tags),
 			},
 		},
 		UserData: aws.String(userData),
 	}
+	// pre-created network interfaces are not tagged by RunInstances
+	if len(m.Spec.NetworkInterfaceIDs) == 0 {
+		input.TagSpecifications = append(input.TagSpecifications, &ec2.TagSpecification{
+			ResourceType: aws.String("network-interface"),
+			Tags:         convertTags(tags),
+		})
+	}
+	if m.Spec.MetadataOptions != nil && m.Spec.MetadataOptions.InstanceMetadataTags != "" {
+		input.MetadataOptions = &ec2.InstanceMetadataOptionsRequest{
+			InstanceMetadataTags: aws.String(m.Spec.MetadataOptions.InstanceMetadataTags),
+		}
+	}
+	if instanceMetadataTags(input) {
+		mtags, err := metadataTags(tags)
+		if err != nil {
+			return nil, err
+		}
+		input.TagSpecifications[0].Tags = convertTags(mtags)
+	}
+	if m.Spec.InstanceInitiatedShutdownBehavior != "" {
+		input.InstanceInitiatedShutdownBehavior = aws.String(m.Spec.InstanceInitiatedShutdownBehavior)
+	}
+	if m.Spec.HibernationOptions != nil {
+		input.HibernationOptions = &ec2.HibernationOptionsRequest{
+			Configured: aws.Bool(m.Spec.HibernationOptions.Configured),
+		}
+	}
+	if m.Spec.CPUOptions != nil {
+		input.CpuOptions = &ec2.CpuOptionsRequest{
+			CoreCount:      m.Spec.CPUOptions.CoreCount,
+			ThreadsPerCore: m.Spec.CPUOptions.ThreadsPerCore,
+		}
+		if m.Spec.CPUOptions.AMDSEVSNP {
+			input.CpuOptions.AmdSevSnp = aws.String(ec2.AmdSevSnpSpecificationEnabled)
+		}
+	}
+	if m.Spec.EnclaveOptions != nil {
+		input.EnclaveOptions = &ec2.EnclaveOptionsRequest{
+			Enabled: aws.Bool(m.Spec.EnclaveOptions.Enabled),
+		}
+	}
 	if strings.HasPrefix(m.Spec.IAMInstanceProfile, "arn") {
 		input.IamInstanceProfile = &ec2.IamInstanceProfileSpecification{
 			Arn: aws.String(m.Spec.IAMInstanceProfile),
@@ -39,38 +103,103 @@ func LaunchInstance(ctx context.Context, cfg *aws.Config, m *infrav1.AWSMachine,
 			Name: aws.String(m.Spec.IAMInstanceProfile),
 		}
 	}
-	svc := ec2.New(session.New(cfg))
+	if m.Status.LaunchToken != "" {
+		// the response of an earlier launch with the token may have been
+		// lost, in which case its instance is returned instead of
+		// launching another
+		instances, err := DescribeInstancesByClientToken(ctx, cfg, m.Status.LaunchToken)
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range instances {
+			return instance, nil
+		}
+	}
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	scope := capacityScopeOrEmpty(ctx, cfg)
+	if len(m.Spec.NetworkInterfaceIDs) != 0 {
+		az, err := attachNetworkInterfaces(ctx, svc, input, m)
+		if err != nil {
+			return nil, err
+		}
+		setHostPlacement(input, m)
+		return runInstance(ctx, svc, input, m, scope.zone(az))
+	}
+	vpcID, err := resolveVPC(ctx, svc, m)
+	if err != nil {
+		return nil, err
+	}
 	if len(m.Spec.SecurityGroupIDs) != 0 {
 		input.SecurityGroupIds = aws.StringSlice(m.Spec.SecurityGroupIDs)
 	}
 	if len(m.Spec.SecurityGroupNames) != 0 {
-		resp, err := svc.DescribeSecurityGroupsWithContext(ctx, &ec2.DescribeSecurityGroupsInput{
-			Filters: []*ec2.Filter{
-				{
-					Name:   aws.String("group-name"),
-					Values: aws.StringSlice(m.Spec.SecurityGroupNames),
-				},
-			},
-		})
+		ids, err := resolveSecurityGroupNames(ctx, svc, vpcID, m.Spec.SecurityGroupNames)
 		if err != nil {
 			return nil, err
 		}
-		for _, sg := range resp.SecurityGroups {
-			input.SecurityGroupIds = append(input.SecurityGroupIds, sg.GroupId)
+		input.SecurityGroupIds = append(input.SecurityGroupIds, aws.StringSlice(ids)...)
+	}
+	if m.Spec.SecurityGroupSelector != nil {
+		ids, err := resolveSecurityGroupSelector(ctx, svc, vpcID, m.Spec.SecurityGroupSelector)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[string]bool)
+		for _, id := range input.SecurityGroupIds {
+			seen[aws.StringValue(id)] = true
+		}
+		for _, id := range ids {
+			if !seen[id] {
+				input.SecurityGroupIds = append(input.SecurityGroupIds, aws.String(id))
+			}
+		}
+	}
+	subnets, err := resolveSubnets(ctx, svc, m, vpcID)
+	if err != nil {
+		return nil, err
+	}
+	family := ipFamily(m)
+	switch {
+	case len(m.Spec.IPv6Addresses) != 0:
+		for _, addr := range m.Spec.IPv6Addresses {
+			input.Ipv6Addresses = append(input.Ipv6Addresses, &ec2.InstanceIpv6Address{
+				Ipv6Address: aws.String(addr),
+			})
+		}
+	case m.Spec.IPv6AddressCount != nil:
+		input.Ipv6AddressCount = m.Spec.IPv6AddressCount
+	case family == infrav1.IPFamilyIPv6:
+		input.Ipv6AddressCount = aws.Int64(1)
+	}
+	subnet := randomSubnet(preferCapacity(m.Spec.InstanceType, scope, subnets))
+	input.SubnetId = subnet.SubnetId
+	if m.Spec.AvailabilityZone != "" {
+		input.Placement = &ec2.Placement{
+			AvailabilityZone: aws.String(m.Spec.AvailabilityZone),
 		}
 	}
+	setHostPlacement(input, m)
+	return runInstance(ctx, svc, input, m, scope.zone(aws.StringValue(subnet.AvailabilityZone)))
+}
+
+// resolveSubnets returns the subnets of the VPC the instance of the machine
+// may be launched in, rejecting those that cannot fit it.
+func resolveSubnets(ctx context.Context, svc *ec2.EC2, m *infrav1.AWSMachine, vpcID string) ([]*ec2.Subnet, error) {
 	sinput := &ec2.DescribeSubnetsInput{
 		Filters: []*ec2.Filter{
-			{
-				Name:   aws.String("vpc-id"),
-				Values: aws.StringSlice([]string{m.Spec.VPCID}),
-			},
 			{
 				Name:   aws.String("state"),
 				Values: aws.StringSlice([]string{ec2.SubnetStateAvailable}),
 			},
 		},
 	}
+	// subnets selected by tags may be in any VPC when no VPC is set
+	if vpcID != "" || m.Spec.SubnetSelector == nil {
+		sinput.Filters = append(sinput.Filters, &ec2.Filter{
+			Name:   aws.String("vpc-id"),
+			Values: aws.StringSlice([]string{vpcID}),
+		})
+	}
 	if m.Spec.AvailabilityZone != "" {
 		sinput.Filters = append(sinput.Filters, &ec2.Filter{
 			Name:   aws.String("availability-zone"),
@@ -83,33 +212,70 @@ func LaunchInstance(ctx context.Context, cfg *aws.Config, m *infrav1.AWSMachine,
 			Values: aws.StringSlice(m.Spec.SubnetIDs),
 		})
 	}
-	sresp, err := svc.DescribeSubnetsWithContext(ctx, sinput)
+	if m.Spec.SubnetSelector != nil {
+		sinput.Filters = append(sinput.Filters, tagFilters(m.Spec.SubnetSelector)...)
+	}
+	sctx, sspan := tracer.Start(ctx, "ResolveSubnet")
+	sresp, err := svc.DescribeSubnetsWithContext(sctx, sinput)
+	sspan.End()
 	if err != nil {
 		return nil, err
 	}
 	if len(sresp.Subnets) == 0 {
-		return nil, errors.Errorf("cannot determine subnet from VPC: %#v", m.Spec.VPCID)
+		return nil, errors.Errorf("cannot determine subnet from VPC: %#v", vpcID)
 	}
-	subnets := make([]string, 0)
+	family := ipFamily(m)
+	subnets := make([]*ec2.Subnet, 0)
+	rejected := make([]SubnetRejection, 0)
 	for _, subnet := range sresp.Subnets {
-		if aws.BoolValue(subnet.MapPublicIpOnLaunch) == m.Spec.PublicIP {
-			if aws.Int64Value(subnet.AvailableIpAddressCount) < 1 {
-				continue
-			}
-			subnets = append(subnets, aws.StringValue(subnet.SubnetId))
+		if reason := rejectSubnet(subnet, m, family); reason != "" {
+			rejected = append(rejected, SubnetRejection{SubnetID: aws.StringValue(subnet.SubnetId), Reason: reason})
+			continue
 		}
+		subnets = append(subnets, subnet)
 	}
 	if len(subnets) == 0 {
-		return nil, errors.Errorf("cannot determine subnet from VPC: %#v", m.Spec.VPCID)
+		return nil, &SubnetsExhaustedError{VPCID: vpcID, Rejected: rejected}
 	}
-	input.SubnetId = aws.String(random(subnets))
-	if m.Spec.AvailabilityZone != "" {
-		input.Placement = &ec2.Placement{
-			AvailabilityZone: aws.String(m.Spec.AvailabilityZone),
-		}
+	return subnets, nil
+}
+
+// LaunchSubnets returns the subnets the instance of the machine may be
+// launched in. Machines attached to network interfaces have none.
+func LaunchSubnets(ctx context.Context, cfg *aws.Config, m *infrav1.AWSMachine) ([]*ec2.Subnet, error) {
+	if len(m.Spec.NetworkInterfaceIDs) != 0 {
+		return nil, nil
+	}
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	vpcID, err := resolveVPC(ctx, svc, m)
+	if err != nil {
+		return nil, err
+	}
+	return resolveSubnets(ctx, svc, m, vpcID)
+}
+
+// runInstance launches the instance, recording capacity failures in the
+// availability zone. The launch is batched with identical launches when
+// batching is enabled. Batched launches share one request, so only
+// unbatched launches are made with the launch token of the machine as
+// client token; batched instances are found by their tags instead.
+func runInstance(ctx context.Context, svc *ec2.EC2, input *ec2.RunInstancesInput, m *infrav1.AWSMachine, zone CapacityZone) (*ec2.Instance, error) {
+	if Batcher != nil && canBatch(input) {
+		return Batcher.launch(ctx, svc, input, m.Spec.InstanceType, zone, launchTags(m))
+	}
+	if m.Status.LaunchToken != "" {
+		input.ClientToken = aws.String(m.Status.LaunchToken)
 	}
+	ctx, span := tracer.Start(ctx, "RunInstances", trace.WithAttributes(
+		attribute.String("instanceType", m.Spec.InstanceType),
+		attribute.String("availabilityZone", zone.Name),
+	))
+	defer span.End()
 	resp, err := svc.RunInstancesWithContext(ctx, input)
 	if err != nil {
+		if IsInsufficientCapacity(err) {
+			Capacity.RecordFailure(m.Spec.InstanceType, zone)
+		}
 		return nil, err
 	}
 	for _, instance := range resp.Instances {
@@ -118,11 +284,306 @@ func LaunchInstance(ctx context.Context, cfg *aws.Config, m *infrav1.AWSMachine,
 	return nil, errors.New("no instances")
 }
 
-func convertBlockDevices(blockDevices []infrav1.AWSBlockDeviceMapping) []*ec2.BlockDeviceMapping {
+// LaunchRejected returns true if EC2 answered a launch with a client error,
+// in which case no instance was launched and a new launch needs a new
+// client token.
+func LaunchRejected(err error) bool {
+	var aerr *APIError
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	code := aerr.StatusCode()
+	return code >= 400 && code < 500
+}
+
+// attachNetworkInterfaces configures the launch to attach the pre-created
+// network interfaces of the machine, in order, instead of creating one. The
+// interfaces determine the subnet, security groups and addresses of the
+// instance, so those cannot be set on the machine as well. It returns the
+// availability zone of the interfaces.
+func attachNetworkInterfaces(ctx context.Context, svc *ec2.EC2, input *ec2.RunInstancesInput, m *infrav1.AWSMachine) (string, error) {
+	if len(m.Spec.SubnetIDs) != 0 || len(m.Spec.SecurityGroupIDs) != 0 || len(m.Spec.SecurityGroupNames) != 0 || m.Spec.SecurityGroupSelector != nil {
+		return "", NewConfigurationError("networkInterfaceIDs cannot be combined with subnetIDs, securityGroupIDs, securityGroupNames or securityGroupSelector")
+	}
+	if m.Spec.PublicIP || m.Spec.IPv6AddressCount != nil || len(m.Spec.IPv6Addresses) != 0 {
+		return "", NewConfigurationError("networkInterfaceIDs cannot be combined with publicIP, ipv6AddressCount or ipv6Addresses")
+	}
+	resp, err := svc.DescribeNetworkInterfacesWithContext(ctx, &ec2.DescribeNetworkInterfacesInput{
+		NetworkInterfaceIds: aws.StringSlice(m.Spec.NetworkInterfaceIDs),
+	})
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return "", NewConfigurationError("cannot find network interfaces %v: %v", m.Spec.NetworkInterfaceIDs, err)
+		}
+		return "", err
+	}
+	var az string
+	for _, eni := range resp.NetworkInterfaces {
+		// interfaces of a machine being recreated are released once the
+		// previous instance has terminated
+		if status := aws.StringValue(eni.Status); status != ec2.NetworkInterfaceStatusAvailable {
+			return "", errors.Errorf("network interface %q is %s, waiting until available", aws.StringValue(eni.NetworkInterfaceId), status)
+		}
+		if az != "" && az != aws.StringValue(eni.AvailabilityZone) {
+			return "", NewConfigurationError("network interfaces %v are in different availability zones", m.Spec.NetworkInterfaceIDs)
+		}
+		az = aws.StringValue(eni.AvailabilityZone)
+	}
+	if m.Spec.AvailabilityZone != "" && m.Spec.AvailabilityZone != az {
+		return "", NewConfigurationError("network interfaces %v are not in availability zone %q", m.Spec.NetworkInterfaceIDs, m.Spec.AvailabilityZone)
+	}
+	for i, id := range m.Spec.NetworkInterfaceIDs {
+		input.NetworkInterfaces = append(input.NetworkInterfaces, &ec2.InstanceNetworkInterfaceSpecification{
+			DeviceIndex:        aws.Int64(int64(i)),
+			NetworkInterfaceId: aws.String(id),
+		})
+	}
+	input.Placement = &ec2.Placement{
+		AvailabilityZone: aws.String(az),
+	}
+	return az, nil
+}
+
+// setHostPlacement places the instance on the dedicated host of the machine,
+// which is either set in the spec or was allocated for it.
+func setHostPlacement(input *ec2.RunInstancesInput, m *infrav1.AWSMachine) {
+	if m.Spec.Placement == nil {
+		return
+	}
+	hostID := m.Spec.Placement.HostID
+	if hostID == "" && m.Spec.Placement.AllocateHost {
+		hostID = m.Status.HostID
+	}
+	if hostID == "" {
+		return
+	}
+	if input.Placement == nil {
+		input.Placement = &ec2.Placement{}
+	}
+	input.Placement.Tenancy = aws.String(ec2.TenancyHost)
+	input.Placement.HostId = aws.String(hostID)
+	if m.Spec.Placement.Affinity != "" {
+		input.Placement.Affinity = aws.String(m.Spec.Placement.Affinity)
+	}
+}
+
+// ipFamily returns the IP family of the machine, defaulting to dual-stack
+// when IPv6 addresses are requested.
+func ipFamily(m *infrav1.AWSMachine) infrav1.IPFamily {
+	if m.Spec.IPFamily != "" {
+		return m.Spec.IPFamily
+	}
+	if len(m.Spec.IPv6Addresses) != 0 || m.Spec.IPv6AddressCount != nil {
+		return infrav1.IPFamilyDualStack
+	}
+	return infrav1.IPFamilyIPv4
+}
+
+// subnetSupportsIPFamily returns true if instances of the IP family can be
+// launched in the subnet. IPv6-only subnets have no IPv4 range, while
+// dual-stack subnets have both.
+func subnetSupportsIPFamily(subnet *ec2.Subnet, family infrav1.IPFamily) bool {
+	if aws.BoolValue(subnet.Ipv6Native) {
+		return family == infrav1.IPFamilyIPv6
+	}
+	switch family {
+	case infrav1.IPFamilyIPv6:
+		return false
+	case infrav1.IPFamilyDualStack:
+		for _, assoc := range subnet.Ipv6CidrBlockAssociationSet {
+			if assoc.Ipv6CidrBlockState != nil && aws.StringValue(assoc.Ipv6CidrBlockState.State) == ec2.SubnetCidrBlockStateCodeAssociated {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// rejectSubnet returns why the subnet cannot be used for the machine, or an
+// empty string if it can.
+func rejectSubnet(subnet *ec2.Subnet, m *infrav1.AWSMachine, family infrav1.IPFamily) string {
+	if !subnetSupportsIPFamily(subnet, family) {
+		return fmt.Sprintf("does not support %s", family)
+	}
+	if m.Spec.SubnetExcludeSelector != nil && matchesAnyTag(subnet.Tags, m.Spec.SubnetExcludeSelector) {
+		return "excluded by subnetExcludeSelector"
+	}
+	if family == infrav1.IPFamilyIPv6 {
+		return ""
+	}
+	if aws.BoolValue(subnet.MapPublicIpOnLaunch) != m.Spec.PublicIP {
+		if m.Spec.PublicIP {
+			return "does not assign public IPs"
+		}
+		return "assigns public IPs"
+	}
+	if aws.Int64Value(subnet.AvailableIpAddressCount) < 1 {
+		return "no available IP addresses"
+	}
+	return ""
+}
+
+// resolveVPC returns the VPC of the machine, selecting it by tags when
+// VPCID is not set. A selector matching several VPCs is a ConfigurationError,
+// while one matching none is retried since the VPC may still be created.
+func resolveVPC(ctx context.Context, svc *ec2.EC2, m *infrav1.AWSMachine) (string, error) {
+	if m.Spec.VPCID != "" || m.Spec.VPCSelector == nil {
+		return m.Spec.VPCID, nil
+	}
+	resp, err := svc.DescribeVpcsWithContext(ctx, &ec2.DescribeVpcsInput{
+		Filters: tagFilters(m.Spec.VPCSelector),
+	})
+	if err != nil {
+		return "", err
+	}
+	ids := make([]string, 0)
+	for _, vpc := range resp.Vpcs {
+		ids = append(ids, aws.StringValue(vpc.VpcId))
+	}
+	switch len(ids) {
+	case 0:
+		return "", errors.Errorf("no VPC matches tags %v", m.Spec.VPCSelector.Tags)
+	case 1:
+		return ids[0], nil
+	default:
+		return "", NewConfigurationError("vpcSelector matches multiple VPCs: %s", strings.Join(ids, ", "))
+	}
+}
+
+// tagFilters returns the filters matching resources with the tags of the
+// selector.
+func tagFilters(sel *infrav1.TagSelector) []*ec2.Filter {
+	filters := make([]*ec2.Filter, 0)
+	for k, v := range sel.Tags {
+		if v == "*" {
+			filters = append(filters, &ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: aws.StringSlice([]string{k}),
+			})
+			continue
+		}
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("tag:" + k),
+			Values: aws.StringSlice([]string{v}),
+		})
+	}
+	return filters
+}
+
+// matchesAnyTag returns whether the tags include any tag of the selector.
+func matchesAnyTag(tags []*ec2.Tag, sel *infrav1.TagSelector) bool {
+	for _, t := range tags {
+		v, ok := sel.Tags[aws.StringValue(t.Key)]
+		if ok && (v == "*" || v == aws.StringValue(t.Value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSecurityGroupSelector returns the IDs of the security groups of the
+// VPC that have the tags of the selector. A selector matching none is
+// retried, since the groups may still be created.
+func resolveSecurityGroupSelector(ctx context.Context, svc *ec2.EC2, vpcID string, sel *infrav1.TagSelector) ([]string, error) {
+	filters := tagFilters(sel)
+	if vpcID != "" {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("vpc-id"),
+			Values: aws.StringSlice([]string{vpcID}),
+		})
+	}
+	ids := make([]string, 0)
+	err := svc.DescribeSecurityGroupsPagesWithContext(ctx, &ec2.DescribeSecurityGroupsInput{
+		Filters: filters,
+	}, func(page *ec2.DescribeSecurityGroupsOutput, lastPage bool) bool {
+		for _, sg := range page.SecurityGroups {
+			ids = append(ids, aws.StringValue(sg.GroupId))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, errors.Errorf("no security group matches tags %v", sel.Tags)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// resolveSecurityGroupNames resolves security group names to IDs within the
+// VPC. Group names are only unique per VPC, so every name must resolve to
+// exactly one group or a ConfigurationError is returned.
+func resolveSecurityGroupNames(ctx context.Context, svc *ec2.EC2, vpcID string, names []string) ([]string, error) {
+	filters := []*ec2.Filter{
+		{
+			Name:   aws.String("group-name"),
+			Values: aws.StringSlice(names),
+		},
+	}
+	if vpcID != "" {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("vpc-id"),
+			Values: aws.StringSlice([]string{vpcID}),
+		})
+	}
+	resp, err := svc.DescribeSecurityGroupsWithContext(ctx, &ec2.DescribeSecurityGroupsInput{
+		Filters: filters,
+	})
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]string)
+	for _, sg := range resp.SecurityGroups {
+		name := aws.StringValue(sg.GroupName)
+		groups[name] = append(groups[name], aws.StringValue(sg.GroupId))
+	}
+	ids := make([]string, 0)
+	unresolved := make([]string, 0)
+	ambiguous := make([]string, 0)
+	for _, name := range names {
+		switch len(groups[name]) {
+		case 0:
+			unresolved = append(unresolved, name)
+		case 1:
+			ids = append(ids, groups[name][0])
+		default:
+			ambiguous = append(ambiguous, fmt.Sprintf("%s (%s)", name, strings.Join(groups[name], ", ")))
+		}
+	}
+	if len(unresolved) > 0 {
+		return nil, NewConfigurationError("security groups not found in VPC %q: %s", vpcID, strings.Join(unresolved, ", "))
+	}
+	if len(ambiguous) > 0 {
+		return nil, NewConfigurationError("security group names match multiple groups, set vpcID: %s", strings.Join(ambiguous, "; "))
+	}
+	return ids, nil
+}
+
+// preferCapacity filters out subnets in availability zones that have
+// recently run out of capacity for the instance type. If every subnet is in
+// such a zone then all subnets are returned, since capacity may have
+// recovered.
+func preferCapacity(instanceType string, scope *capacityScope, subnets []*ec2.Subnet) []*ec2.Subnet {
+	preferred := make([]*ec2.Subnet, 0)
+	for _, subnet := range subnets {
+		if !Capacity.Failing(instanceType, scope.zone(aws.StringValue(subnet.AvailabilityZone))) {
+			preferred = append(preferred, subnet)
+		}
+	}
+	if len(preferred) == 0 {
+		return subnets
+	}
+	return preferred
+}
+
+func convertBlockDevices(osFamily infrav1.OSFamily, blockDevices []infrav1.AWSBlockDeviceMapping) []*ec2.BlockDeviceMapping {
 	blockDeviceMappings := make([]*ec2.BlockDeviceMapping, 0)
-	for _, b := range blockDevices {
+	for i, b := range blockDevices {
+		deviceName := DeviceName(osFamily, b, i)
 		blockDeviceMappings = append(blockDeviceMappings, &ec2.BlockDeviceMapping{
-			DeviceName: aws.String(b.DeviceName),
+			DeviceName: aws.String(deviceName),
 			Ebs: &ec2.EbsBlockDevice{
 				VolumeSize: aws.Int64(b.VolumeSize),
 				VolumeType: aws.String(b.VolumeType),
@@ -133,6 +594,152 @@ func convertBlockDevices(blockDevices []infrav1.AWSBlockDeviceMapping) []*ec2.Bl
 	return blockDeviceMappings
 }
 
+// DeviceName returns the device name of the block device at the given
+// index: its own name translated by NormalizeDeviceName, or the
+// conventional name for the index.
+func DeviceName(osFamily infrav1.OSFamily, b infrav1.AWSBlockDeviceMapping, i int) string {
+	if b.DeviceName == "" {
+		return defaultDeviceName(osFamily, i)
+	}
+	return NormalizeDeviceName(osFamily, b.DeviceName)
+}
+
+var nvmeDeviceRegex = regexp.MustCompile(`^/dev/nvme([0-9]+)n1$`)
+
+// NormalizeDeviceName translates legacy Linux device names to the names
+// accepted in EC2 block device mappings: names without the /dev/ prefix are
+// prefixed, IDE names (/dev/hdb) become SCSI names (/dev/sdb), and NVMe
+// names (/dev/nvme1n1), which the instance assigns itself, become the
+// conventional name for the same position (/dev/xvdb). Windows device names
+// are returned as is.
+func NormalizeDeviceName(osFamily infrav1.OSFamily, name string) string {
+	if osFamily == infrav1.OSFamilyWindows || name == "" {
+		return name
+	}
+	if !strings.HasPrefix(name, "/dev/") {
+		name = "/dev/" + name
+	}
+	if strings.HasPrefix(name, "/dev/hd") {
+		name = "/dev/sd" + strings.TrimPrefix(name, "/dev/hd")
+	}
+	if m := nvmeDeviceRegex.FindStringSubmatch(name); m != nil {
+		if i, err := strconv.Atoi(m[1]); err == nil && i < 26 {
+			name = defaultDeviceName(osFamily, i)
+		}
+	}
+	return name
+}
+
+// defaultDeviceName returns the conventional device name for the block device
+// at the given index, where the first device is the root volume.
+func defaultDeviceName(osFamily infrav1.OSFamily, i int) string {
+	switch osFamily {
+	case infrav1.OSFamilyWindows:
+		if i == 0 {
+			return "/dev/sda1"
+		}
+		return fmt.Sprintf("xvd%c", 'b'+i-1)
+	default:
+		if i == 0 {
+			return "/dev/xvda"
+		}
+		return fmt.Sprintf("/dev/xvd%c", 'b'+i-1)
+	}
+}
+
+const (
+	// MachineUIDTagKey is the tag identifying the AWSMachine that launched
+	// an instance, which allows the instance to be found before its
+	// ProviderID has been recorded.
+	MachineUIDTagKey = "infrastructure.crit.sh/awsmachine-uid"
+
+	// MachineNameTagKey is the namespaced name of the AWSMachine that
+	// launched an instance.
+	MachineNameTagKey = "infrastructure.crit.sh/awsmachine"
+
+	// NameTagKey is the tag naming an instance in the EC2 console.
+	NameTagKey = "Name"
+
+	// ClusterTagKeyPrefix prefixes the name of the Kubernetes cluster in the
+	// tag identifying the instances of the cluster, e.g.
+	// kubernetes.io/cluster/prod=owned.
+	ClusterTagKeyPrefix = "kubernetes.io/cluster/"
+)
+
+// DefaultTags are controller-wide tags applied to every resource created by
+// the controller. They are set once at startup and take precedence over
+// tags set on the AWSMachine, including the additional tags of its provider.
+var DefaultTags map[string]string
+
+func instanceTags(m *infrav1.AWSMachine) map[string]string {
+	tags := make(map[string]string)
+	for k, v := range m.Spec.Tags {
+		tags[k] = v
+	}
+	for k, v := range DefaultTags {
+		tags[k] = v
+	}
+	for k, v := range launchTags(m) {
+		tags[k] = v
+	}
+	return tags
+}
+
+// launchTags returns the tags that differ between the instances of
+// machines: the owner tags and the Name tag of named instances.
+func launchTags(m *infrav1.AWSMachine) map[string]string {
+	tags := OwnerTags(m)
+	if m.Status.InstanceName != "" {
+		tags[NameTagKey] = m.Status.InstanceName
+	}
+	return tags
+}
+
+// instanceMetadataTags returns true if the tags of the instance are
+// readable from instance metadata.
+func instanceMetadataTags(input *ec2.RunInstancesInput) bool {
+	return input.MetadataOptions != nil && aws.StringValue(input.MetadataOptions.InstanceMetadataTags) == ec2.InstanceMetadataTagsStateEnabled
+}
+
+// MetadataTagKey returns the key of a tag on instances whose tags are
+// readable from instance metadata, which do not allow "/" in tag keys.
+func MetadataTagKey(key string) string {
+	return strings.Replace(key, "/", ":", -1)
+}
+
+// metadataTags returns the tags with MetadataTagKey keys. Keys with spaces
+// cannot be used at all and are a ConfigurationError.
+func metadataTags(tags map[string]string) (map[string]string, error) {
+	mtags := make(map[string]string)
+	for k, v := range tags {
+		if strings.Contains(k, " ") {
+			return nil, NewConfigurationError("tag key %q contains spaces, which is not allowed with instanceMetadataTags enabled", k)
+		}
+		mtags[MetadataTagKey(k)] = v
+	}
+	return mtags, nil
+}
+
+// InstanceTags returns the tags as they must be applied to the instance.
+func InstanceTags(instance *ec2.Instance, tags map[string]string) (map[string]string, error) {
+	if instance.MetadataOptions == nil || aws.StringValue(instance.MetadataOptions.InstanceMetadataTags) != ec2.InstanceMetadataTagsStateEnabled {
+		return tags, nil
+	}
+	return metadataTags(tags)
+}
+
+// TagValue returns the value of the tag, which may have been applied with
+// its MetadataTagKey.
+func TagValue(tags []*ec2.Tag, key string) (string, bool) {
+	mkey := MetadataTagKey(key)
+	for _, t := range tags {
+		if k := aws.StringValue(t.Key); k == key || k == mkey {
+			return aws.StringValue(t.Value), true
+		}
+	}
+	return "", false
+}
+
 func convertTags(tags map[string]string) []*ec2.Tag {
 	ec2tags := make([]*ec2.Tag, 0)
 	for key, value := range tags {
@@ -144,9 +751,20 @@ func convertTags(tags map[string]string) []*ec2.Tag {
 	return ec2tags
 }
 
+// TerminateInstance terminates the instance. When terminations are batched,
+// see Terminator, the instance is only queued for termination, and errors
+// are returned by a later call for the same instance.
 func TerminateInstance(ctx context.Context, cfg *aws.Config, instanceID string) error {
-	svc := ec2.New(session.New(cfg))
-	_, err := svc.TerminateInstances(&ec2.TerminateInstancesInput{
+	if Terminator != nil {
+		return Terminator.terminate(ctx, cfg, instanceID)
+	}
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	return terminateInstances(ctx, svc, []string{instanceID})
+}
+
+func RebootInstance(ctx context.Context, cfg *aws.Config, instanceID string) error {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	_, err := svc.RebootInstancesWithContext(ctx, &ec2.RebootInstancesInput{
 		InstanceIds: aws.StringSlice([]string{instanceID}),
 	})
 	return err
@@ -163,8 +781,48 @@ func DescribeInstanceStatus(ctx context.Context, cfg *aws.Config, instanceID str
 	return aws.StringValue(instance.State.Name), nil
 }
 
+// StateReason returns why the instance last changed state, e.g.
+// "Server.SpotInstanceTermination: Spot instance termination (User initiated
+// (2020-06-01 12:00:00 GMT))", or "" if EC2 does not report a reason.
+func StateReason(instance *ec2.Instance) string {
+	reason := aws.StringValue(instance.StateTransitionReason)
+	if instance.StateReason == nil {
+		return reason
+	}
+	msg := aws.StringValue(instance.StateReason.Message)
+	if msg == "" {
+		msg = aws.StringValue(instance.StateReason.Code)
+	} else if code := aws.StringValue(instance.StateReason.Code); code != "" && !strings.HasPrefix(msg, code) {
+		msg = code + ": " + msg
+	}
+	if reason == "" || msg == "" {
+		return msg + reason
+	}
+	return fmt.Sprintf("%s (%s)", msg, reason)
+}
+
+// DescribeInstanceHealth returns true when both the instance and system
+// status checks for the instance have passed.
+func DescribeInstanceHealth(ctx context.Context, cfg *aws.Config, instanceID string) (bool, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.DescribeInstanceStatusWithContext(ctx, &ec2.DescribeInstanceStatusInput{
+		InstanceIds: aws.StringSlice([]string{instanceID}),
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, status := range resp.InstanceStatuses {
+		if status.InstanceStatus == nil || status.SystemStatus == nil {
+			return false, nil
+		}
+		return aws.StringValue(status.InstanceStatus.Status) == ec2.SummaryStatusOk &&
+			aws.StringValue(status.SystemStatus.Status) == ec2.SummaryStatusOk, nil
+	}
+	return false, nil
+}
+
 func DescribeSubnets(ctx context.Context, cfg *aws.Config, vpcID string) ([]string, error) {
-	svc := ec2.New(session.New(cfg))
+	svc := ec2.New(newSession(cfg, ec2Limiter))
 	resp, err := svc.DescribeSubnetsWithContext(ctx, &ec2.DescribeSubnetsInput{
 		Filters: []*ec2.Filter{
 			{
@@ -185,22 +843,43 @@ func DescribeSubnets(ctx context.Context, cfg *aws.Config, vpcID string) ([]stri
 	return subnets, nil
 }
 
+// DescribeSubnetsByVPC returns the available subnets of the VPCs.
+func DescribeSubnetsByVPC(ctx context.Context, cfg *aws.Config, vpcIDs []string) ([]*ec2.Subnet, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	subnets := make([]*ec2.Subnet, 0)
+	if err := svc.DescribeSubnetsPagesWithContext(ctx, &ec2.DescribeSubnetsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: aws.StringSlice(vpcIDs),
+			},
+			{
+				Name:   aws.String("state"),
+				Values: aws.StringSlice([]string{ec2.SubnetStateAvailable}),
+			},
+		},
+	}, func(page *ec2.DescribeSubnetsOutput, lastPage bool) bool {
+		subnets = append(subnets, page.Subnets...)
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	return subnets, nil
+}
+
 const (
 	InstanceNotFound = "InvalidInstanceID.NotFound"
 )
 
 func DescribeInstance(ctx context.Context, cfg *aws.Config, instanceID string) (*ec2.Instance, bool, error) {
-	svc := ec2.New(session.New(cfg))
+	svc := ec2.New(newSession(cfg, ec2Limiter))
 	resp, err := svc.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: aws.StringSlice([]string{instanceID}),
 	})
+	if errors.Is(err, ErrInstanceNotFound) {
+		return nil, false, nil
+	}
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case InstanceNotFound:
-				return nil, false, nil
-			}
-		}
 		return nil, false, err
 	}
 	if len(resp.Reservations) > 0 && len(resp.Reservations[0].Instances) > 0 {
@@ -209,8 +888,62 @@ func DescribeInstance(ctx context.Context, cfg *aws.Config, instanceID string) (
 	return nil, false, nil
 }
 
+// DescribeInstancesByTag returns all instances that are not yet terminated
+// with the given tag.
+func DescribeInstancesByTag(ctx context.Context, cfg *aws.Config, key, value string) ([]*ec2.Instance, error) {
+	instances, err := describeInstances(ctx, cfg, "tag:"+key, value)
+	if err != nil || MetadataTagKey(key) == key {
+		return instances, err
+	}
+	// instances with tags in instance metadata are tagged with a different key
+	more, err := describeInstances(ctx, cfg, "tag:"+MetadataTagKey(key), value)
+	if err != nil {
+		return nil, err
+	}
+	return append(instances, more...), nil
+}
+
+// DescribeInstancesByClientToken returns the instances launched with the
+// client token that have not been terminated.
+func DescribeInstancesByClientToken(ctx context.Context, cfg *aws.Config, token string) ([]*ec2.Instance, error) {
+	return describeInstances(ctx, cfg, "client-token", token)
+}
+
+// describeInstances returns the instances matching the filter that have not
+// been terminated.
+func describeInstances(ctx context.Context, cfg *aws.Config, filter, value string) ([]*ec2.Instance, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	instances := make([]*ec2.Instance, 0)
+	if err := svc.DescribeInstancesPagesWithContext(ctx, &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String(filter),
+				Values: aws.StringSlice([]string{value}),
+			},
+			{
+				Name: aws.String("instance-state-name"),
+				Values: aws.StringSlice([]string{
+					ec2.InstanceStateNamePending,
+					ec2.InstanceStateNameRunning,
+					ec2.InstanceStateNameShuttingDown,
+					ec2.InstanceStateNameStopping,
+					ec2.InstanceStateNameStopped,
+				}),
+			},
+		},
+	}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, r := range page.Reservations {
+			instances = append(instances, r.Instances...)
+		}
+		return !lastPage
+	}); err != nil {
+		return nil, err
+	}
+	return instances, nil
+}
+
 func DescribeInstanceTypes(ctx context.Context, cfg *aws.Config, instanceType, az string) (bool, error) {
-	svc := ec2.New(session.New(cfg))
+	svc := ec2.New(newSession(cfg, ec2Limiter))
 
 	resp, err := svc.DescribeInstanceTypeOfferingsWithContext(ctx, &ec2.DescribeInstanceTypeOfferingsInput{
 		Filters: []*ec2.Filter{
@@ -236,8 +969,55 @@ func DescribeInstanceTypes(ctx context.Context, cfg *aws.Config, instanceType, a
 
 }
 
+// DescribeImageArchitecture returns the processor architecture of the given
+// AMI, e.g. x86_64 or arm64.
+func DescribeImageArchitecture(ctx context.Context, cfg *aws.Config, imageID string) (string, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		ImageIds: aws.StringSlice([]string{imageID}),
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Images) == 0 {
+		return "", errors.Errorf("cannot find image: %#v", imageID)
+	}
+	return aws.StringValue(resp.Images[0].Architecture), nil
+}
+
+// DescribeImageCreationDate returns when the given AMI was created.
+func DescribeImageCreationDate(ctx context.Context, cfg *aws.Config, imageID string) (time.Time, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		ImageIds: aws.StringSlice([]string{imageID}),
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(resp.Images) == 0 {
+		return time.Time{}, errors.Errorf("cannot find image: %#v", imageID)
+	}
+	return time.Parse(time.RFC3339, aws.StringValue(resp.Images[0].CreationDate))
+}
+
+// DescribeInstanceType returns the capabilities (processor, memory,
+// networking, storage) of the given instance type.
+func DescribeInstanceType(ctx context.Context, cfg *aws.Config, instanceType string) (*ec2.InstanceTypeInfo, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.DescribeInstanceTypesWithContext(ctx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: aws.StringSlice([]string{instanceType}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.InstanceTypes) == 0 {
+		return nil, errors.Errorf("cannot find instance type: %#v", instanceType)
+	}
+	return resp.InstanceTypes[0], nil
+}
+
 func DescribeSubnet(ctx context.Context, cfg *aws.Config, subnetID string) (*ec2.Subnet, error) {
-	svc := ec2.New(session.New(cfg))
+	svc := ec2.New(newSession(cfg, ec2Limiter))
 	resp, err := svc.DescribeSubnetsWithContext(ctx, &ec2.DescribeSubnetsInput{
 		Filters: []*ec2.Filter{
 			{
@@ -256,7 +1036,7 @@ func DescribeSubnet(ctx context.Context, cfg *aws.Config, subnetID string) (*ec2
 }
 
 func DescribeVolume(ctx context.Context, cfg *aws.Config, volumeID string) (*ec2.Volume, error) {
-	svc := ec2.New(session.New(cfg))
+	svc := ec2.New(newSession(cfg, ec2Limiter))
 	resp, err := svc.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
 		VolumeIds: aws.StringSlice([]string{volumeID}),
 	})
@@ -270,7 +1050,7 @@ func DescribeVolume(ctx context.Context, cfg *aws.Config, volumeID string) (*ec2
 }
 
 func DescribeUserData(ctx context.Context, cfg *aws.Config, instanceID string) ([]byte, error) {
-	svc := ec2.New(session.New(cfg))
+	svc := ec2.New(newSession(cfg, ec2Limiter))
 	resp, err := svc.DescribeInstanceAttributeWithContext(ctx, &ec2.DescribeInstanceAttributeInput{
 		Attribute:  aws.String("userData"),
 		InstanceId: aws.String(instanceID),
@@ -281,3 +1061,135 @@ func DescribeUserData(ctx context.Context, cfg *aws.Config, instanceID string) (
 	userData := aws.StringValue(resp.UserData.Value)
 	return base64.StdEncoding.DecodeString(userData)
 }
+
+// EnsureENAExpress configures ENA Express on the primary network interface of
+// the instance, if it is not already configured as requested.
+func EnsureENAExpress(ctx context.Context, cfg *aws.Config, instance *ec2.Instance, enabled, udp bool) error {
+	var eniID string
+	for _, eni := range instance.NetworkInterfaces {
+		if eni.Attachment != nil && aws.Int64Value(eni.Attachment.DeviceIndex) == 0 {
+			eniID = aws.StringValue(eni.NetworkInterfaceId)
+		}
+	}
+	if eniID == "" {
+		return errors.Errorf("cannot find primary network interface: %#v", aws.StringValue(instance.InstanceId))
+	}
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.DescribeNetworkInterfacesWithContext(ctx, &ec2.DescribeNetworkInterfacesInput{
+		NetworkInterfaceIds: aws.StringSlice([]string{eniID}),
+	})
+	if err != nil {
+		return err
+	}
+	for _, eni := range resp.NetworkInterfaces {
+		if eni.Attachment == nil {
+			continue
+		}
+		if spec := eni.Attachment.EnaSrdSpecification; spec != nil && aws.BoolValue(spec.EnaSrdEnabled) == enabled {
+			if spec.EnaSrdUdpSpecification != nil && aws.BoolValue(spec.EnaSrdUdpSpecification.EnaSrdUdpEnabled) == (enabled && udp) {
+				return nil
+			}
+		}
+	}
+	_, err = svc.ModifyNetworkInterfaceAttributeWithContext(ctx, &ec2.ModifyNetworkInterfaceAttributeInput{
+		NetworkInterfaceId: aws.String(eniID),
+		EnaSrdSpecification: &ec2.EnaSrdSpecification{
+			EnaSrdEnabled: aws.Bool(enabled),
+			EnaSrdUdpSpecification: &ec2.EnaSrdUdpSpecification{
+				EnaSrdUdpEnabled: aws.Bool(enabled && udp),
+			},
+		},
+	})
+	return err
+}
+
+// EnsureSourceDestCheck sets the source/destination check of the instance,
+// if it is not already set as requested. It returns true when the attribute
+// was changed.
+func EnsureSourceDestCheck(ctx context.Context, cfg *aws.Config, instanceID string, enabled bool) (bool, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.DescribeInstanceAttributeWithContext(ctx, &ec2.DescribeInstanceAttributeInput{
+		InstanceId: aws.String(instanceID),
+		Attribute:  aws.String(ec2.InstanceAttributeNameSourceDestCheck),
+	})
+	if err != nil {
+		return false, err
+	}
+	if resp.SourceDestCheck != nil && aws.BoolValue(resp.SourceDestCheck.Value) == enabled {
+		return false, nil
+	}
+	_, err = svc.ModifyInstanceAttributeWithContext(ctx, &ec2.ModifyInstanceAttributeInput{
+		InstanceId:      aws.String(instanceID),
+		SourceDestCheck: &ec2.AttributeBooleanValue{Value: aws.Bool(enabled)},
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CreateTags adds or overwrites tags on an EC2 resource.
+func CreateTags(ctx context.Context, cfg *aws.Config, resourceID string, tags map[string]string) error {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	_, err := svc.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: aws.StringSlice([]string{resourceID}),
+		Tags:      convertTags(tags),
+	})
+	return err
+}
+
+// OwnerTags returns the tags identifying the AWSMachine that owns an
+// instance.
+func OwnerTags(m *infrav1.AWSMachine) map[string]string {
+	return map[string]string{
+		MachineUIDTagKey:  string(m.UID),
+		MachineNameTagKey: m.Namespace + "/" + m.Name,
+	}
+}
+
+// DescribeInstanceShutdownBehavior returns the instance initiated shutdown
+// behavior of the instance.
+func DescribeInstanceShutdownBehavior(ctx context.Context, cfg *aws.Config, instanceID string) (string, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.DescribeInstanceAttributeWithContext(ctx, &ec2.DescribeInstanceAttributeInput{
+		Attribute:  aws.String(ec2.InstanceAttributeNameInstanceInitiatedShutdownBehavior),
+		InstanceId: aws.String(instanceID),
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.InstanceInitiatedShutdownBehavior == nil {
+		return "", nil
+	}
+	return aws.StringValue(resp.InstanceInitiatedShutdownBehavior.Value), nil
+}
+
+// DescribeInstanceConnectEndpoint returns the ID of an available EC2 Instance
+// Connect Endpoint in the VPC, preferring one in the given subnet. It returns
+// an empty string if the VPC has no endpoint.
+func DescribeInstanceConnectEndpoint(ctx context.Context, cfg *aws.Config, vpcID, subnetID string) (string, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	var endpointID string
+	if err := svc.DescribeInstanceConnectEndpointsPagesWithContext(ctx, &ec2.DescribeInstanceConnectEndpointsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: aws.StringSlice([]string{vpcID}),
+			},
+			{
+				Name:   aws.String("state"),
+				Values: aws.StringSlice([]string{ec2.Ec2InstanceConnectEndpointStateCreateComplete}),
+			},
+		},
+	}, func(page *ec2.DescribeInstanceConnectEndpointsOutput, lastPage bool) bool {
+		for _, e := range page.InstanceConnectEndpoints {
+			if endpointID == "" || aws.StringValue(e.SubnetId) == subnetID {
+				endpointID = aws.StringValue(e.InstanceConnectEndpointId)
+			}
+		}
+		return !lastPage
+	}); err != nil {
+		return "", err
+	}
+	return endpointID, nil
+}
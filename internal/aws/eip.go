@@ -0,0 +1,181 @@
+package aws
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// ElasticIPClaimTagKey is the tag identifying the AWSMachine that claimed an
+// Elastic IP from a pool. Unlike MachineUIDTagKey, it does not make the
+// Elastic IP a resource of the machine that is released with it.
+const ElasticIPClaimTagKey = "infrastructure.crit.sh/elastic-ip-claimed-by"
+
+// eipClaims serializes claims, so that concurrent reconciles do not claim
+// the same Elastic IP. It only serializes the claims of this process, see
+// eipClaimSettle for claims made by other controllers.
+var eipClaims sync.Mutex
+
+// eipClaimSettle is how long a claim is left to settle before it is read
+// back. Tagging cannot be made conditional, so two controllers, e.g. during
+// a rollout, may tag the same Elastic IP; the last tag wins, and the other
+// claim is abandoned when it is read back.
+var eipClaimSettle = time.Second
+
+// ClaimElasticIP returns the Elastic IP of the machine, claiming one from
+// the pool selected by the machine's Elastic IP selector unless the machine
+// has already claimed one. An Elastic IP selected by allocation ID is not
+// claimed. An error is returned when no Elastic IP is available, or when
+// another controller claimed the same Elastic IP concurrently, in which case
+// the claim is retried by the next reconcile.
+func ClaimElasticIP(ctx context.Context, cfg *aws.Config, m *infrav1.AWSMachine) (*ec2.Address, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	if id := m.Spec.ElasticIP.AllocationID; id != "" {
+		resp, err := svc.DescribeAddressesWithContext(ctx, &ec2.DescribeAddressesInput{
+			AllocationIds: aws.StringSlice([]string{id}),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Addresses) == 0 {
+			return nil, errors.Errorf("cannot find elastic IP: %#v", id)
+		}
+		return resp.Addresses[0], nil
+	}
+	if m.Spec.ElasticIP.Selector == nil {
+		return nil, NewConfigurationError("elasticIP requires an allocationID or a selector")
+	}
+
+	eipClaims.Lock()
+	defer eipClaims.Unlock()
+	resp, err := svc.DescribeAddressesWithContext(ctx, &ec2.DescribeAddressesInput{
+		Filters: append(tagFilters(m.Spec.ElasticIP.Selector), &ec2.Filter{
+			Name:   aws.String("domain"),
+			Values: aws.StringSlice([]string{ec2.DomainTypeVpc}),
+		}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	addrs := resp.Addresses
+	sort.Slice(addrs, func(i, j int) bool {
+		return aws.StringValue(addrs[i].AllocationId) < aws.StringValue(addrs[j].AllocationId)
+	})
+	var free *ec2.Address
+	for _, a := range addrs {
+		claim, claimed := TagValue(a.Tags, ElasticIPClaimTagKey)
+		if claim == string(m.UID) {
+			return a, nil
+		}
+		if free == nil && !claimed && a.AssociationId == nil {
+			free = a
+		}
+	}
+	if free == nil {
+		return nil, errors.Errorf("no unclaimed elastic IP matches tags %v", m.Spec.ElasticIP.Selector.Tags)
+	}
+	_, err = svc.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{free.AllocationId},
+		Tags: []*ec2.Tag{{
+			Key:   aws.String(ElasticIPClaimTagKey),
+			Value: aws.String(string(m.UID)),
+		}},
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot claim elastic IP %s", aws.StringValue(free.AllocationId))
+	}
+	select {
+	case <-time.After(eipClaimSettle):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	resp, err = svc.DescribeAddressesWithContext(ctx, &ec2.DescribeAddressesInput{
+		AllocationIds: []*string{free.AllocationId},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range resp.Addresses {
+		if claim, _ := TagValue(a.Tags, ElasticIPClaimTagKey); claim != string(m.UID) {
+			return nil, errors.Errorf("elastic IP %s was claimed concurrently by %s", aws.StringValue(free.AllocationId), claim)
+		}
+		return a, nil
+	}
+	return nil, errors.Errorf("cannot find elastic IP: %#v", aws.StringValue(free.AllocationId))
+}
+
+// ClaimedElasticIPs returns the allocation IDs of the Elastic IPs claimed by
+// the machine with the UID.
+func ClaimedElasticIPs(ctx context.Context, cfg *aws.Config, uid string) ([]string, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.DescribeAddressesWithContext(ctx, &ec2.DescribeAddressesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("tag:" + ElasticIPClaimTagKey),
+			Values: aws.StringSlice([]string{uid}),
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(resp.Addresses))
+	for _, a := range resp.Addresses {
+		ids = append(ids, aws.StringValue(a.AllocationId))
+	}
+	return ids, nil
+}
+
+// AssociateElasticIP associates the Elastic IP with the instance. An Elastic
+// IP associated with another instance is not reassociated.
+func AssociateElasticIP(ctx context.Context, cfg *aws.Config, allocationID, instanceID string) error {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	_, err := svc.AssociateAddressWithContext(ctx, &ec2.AssociateAddressInput{
+		AllocationId:       aws.String(allocationID),
+		InstanceId:         aws.String(instanceID),
+		AllowReassociation: aws.Bool(false),
+	})
+	return err
+}
+
+// ReleaseElasticIPClaim disassociates the Elastic IP from the instance and
+// removes the claim of the machine, returning the Elastic IP to its pool.
+// The Elastic IP itself is kept. Elastic IPs that no longer exist are not an
+// error.
+func ReleaseElasticIPClaim(ctx context.Context, cfg *aws.Config, allocationID, instanceID string) error {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.DescribeAddressesWithContext(ctx, &ec2.DescribeAddressesInput{
+		AllocationIds: aws.StringSlice([]string{allocationID}),
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, a := range resp.Addresses {
+		if a.AssociationId != nil && instanceID != "" && aws.StringValue(a.InstanceId) == instanceID {
+			_, err := svc.DisassociateAddressWithContext(ctx, &ec2.DisassociateAddressInput{
+				AssociationId: a.AssociationId,
+			})
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return errors.Wrapf(err, "cannot disassociate elastic IP %s", allocationID)
+			}
+		}
+		if _, ok := TagValue(a.Tags, ElasticIPClaimTagKey); ok {
+			_, err := svc.DeleteTagsWithContext(ctx, &ec2.DeleteTagsInput{
+				Resources: []*string{a.AllocationId},
+				Tags:      []*ec2.Tag{{Key: aws.String(ElasticIPClaimTagKey)}},
+			})
+			if err != nil {
+				return errors.Wrapf(err, "cannot release claim of elastic IP %s", allocationID)
+			}
+		}
+	}
+	return nil
+}
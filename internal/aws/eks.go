@@ -0,0 +1,35 @@
+package aws
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/eks"
+)
+
+// EKSCluster is what nodes need to know to join an EKS cluster.
+type EKSCluster struct {
+	Endpoint             string
+	CertificateAuthority string
+	ServiceCIDR          string
+}
+
+// DescribeEKSCluster returns the endpoint, base64 encoded certificate
+// authority and service CIDR of the EKS cluster in the region of cfg.
+func DescribeEKSCluster(ctx context.Context, cfg *aws.Config, name string) (*EKSCluster, error) {
+	svc := eks.New(withUserAgent(newBaseSession(cfg)))
+	resp, err := svc.DescribeClusterWithContext(ctx, &eks.DescribeClusterInput{
+		Name: aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := &EKSCluster{Endpoint: aws.StringValue(resp.Cluster.Endpoint)}
+	if resp.Cluster.CertificateAuthority != nil {
+		c.CertificateAuthority = aws.StringValue(resp.Cluster.CertificateAuthority.Data)
+	}
+	if cfg := resp.Cluster.KubernetesNetworkConfig; cfg != nil {
+		c.ServiceCIDR = aws.StringValue(cfg.ServiceIpv4Cidr)
+	}
+	return c, nil
+}
@@ -0,0 +1,183 @@
+package aws
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/pkg/errors"
+)
+
+// LoadBalancer is a load balancer, or a target group of one, that instances
+// are registered with.
+type LoadBalancer interface {
+	// Register registers the instance. Registering a registered instance
+	// is not an error.
+	Register(ctx context.Context, instanceID string) error
+
+	// Deregister deregisters the instance. Load balancers and instances
+	// that no longer exist are not an error.
+	Deregister(ctx context.Context, instanceID string) error
+
+	// Healthy returns true if the load balancer considers the instance
+	// healthy.
+	Healthy(ctx context.Context, instanceID string) (bool, error)
+}
+
+// NewClassicLoadBalancer returns the Classic load balancer with the name.
+func NewClassicLoadBalancer(cfg *aws.Config, name string) LoadBalancer {
+	return &classicLoadBalancer{
+		svc:  elb.New(withUserAgent(newBaseSession(cfg))),
+		name: name,
+	}
+}
+
+// NewTargetGroup returns the Application or Network load balancer target
+// group with the ARN.
+func NewTargetGroup(cfg *aws.Config, targetGroupARN string) LoadBalancer {
+	return &targetGroup{
+		svc: elbv2.New(withUserAgent(newBaseSession(cfg))),
+		arn: targetGroupARN,
+	}
+}
+
+type classicLoadBalancer struct {
+	svc  *elb.ELB
+	name string
+}
+
+func (lb *classicLoadBalancer) Register(ctx context.Context, instanceID string) error {
+	_, err := lb.svc.RegisterInstancesWithLoadBalancerWithContext(ctx, &elb.RegisterInstancesWithLoadBalancerInput{
+		LoadBalancerName: aws.String(lb.name),
+		Instances:        []*elb.Instance{{InstanceId: aws.String(instanceID)}},
+	})
+	return err
+}
+
+func (lb *classicLoadBalancer) Deregister(ctx context.Context, instanceID string) error {
+	_, err := lb.svc.DeregisterInstancesFromLoadBalancerWithContext(ctx, &elb.DeregisterInstancesFromLoadBalancerInput{
+		LoadBalancerName: aws.String(lb.name),
+		Instances:        []*elb.Instance{{InstanceId: aws.String(instanceID)}},
+	})
+	// the load balancer no longer exists or the instance is not registered
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (lb *classicLoadBalancer) Healthy(ctx context.Context, instanceID string) (bool, error) {
+	resp, err := lb.svc.DescribeInstanceHealthWithContext(ctx, &elb.DescribeInstanceHealthInput{
+		LoadBalancerName: aws.String(lb.name),
+		Instances:        []*elb.Instance{{InstanceId: aws.String(instanceID)}},
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, s := range resp.InstanceStates {
+		if aws.StringValue(s.InstanceId) == instanceID {
+			return aws.StringValue(s.State) == "InService", nil
+		}
+	}
+	return false, nil
+}
+
+type targetGroup struct {
+	svc *elbv2.ELBV2
+	arn string
+}
+
+func (tg *targetGroup) Register(ctx context.Context, instanceID string) error {
+	_, err := tg.svc.RegisterTargetsWithContext(ctx, &elbv2.RegisterTargetsInput{
+		TargetGroupArn: aws.String(tg.arn),
+		Targets:        []*elbv2.TargetDescription{{Id: aws.String(instanceID)}},
+	})
+	return err
+}
+
+func (tg *targetGroup) Deregister(ctx context.Context, instanceID string) error {
+	_, err := tg.svc.DeregisterTargetsWithContext(ctx, &elbv2.DeregisterTargetsInput{
+		TargetGroupArn: aws.String(tg.arn),
+		Targets:        []*elbv2.TargetDescription{{Id: aws.String(instanceID)}},
+	})
+	// the target group no longer exists or the instance is not a target
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (tg *targetGroup) Healthy(ctx context.Context, instanceID string) (bool, error) {
+	resp, err := tg.svc.DescribeTargetHealthWithContext(ctx, &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(tg.arn),
+		Targets:        []*elbv2.TargetDescription{{Id: aws.String(instanceID)}},
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, d := range resp.TargetHealthDescriptions {
+		if d.Target != nil && aws.StringValue(d.Target.Id) == instanceID && d.TargetHealth != nil {
+			return aws.StringValue(d.TargetHealth.State) == elbv2.TargetHealthStateEnumHealthy, nil
+		}
+	}
+	return false, nil
+}
+
+// AuthorizeTargetGroupIngress allows TCP traffic from the security groups of
+// the load balancers of the target group to its traffic and health check
+// ports in the security group. Rules that already exist are not an error.
+func AuthorizeTargetGroupIngress(ctx context.Context, cfg *aws.Config, targetGroupARN, securityGroupID string) error {
+	svc := elbv2.New(withUserAgent(newBaseSession(cfg)))
+	tgs, err := svc.DescribeTargetGroupsWithContext(ctx, &elbv2.DescribeTargetGroupsInput{
+		TargetGroupArns: aws.StringSlice([]string{targetGroupARN}),
+	})
+	if err != nil {
+		return err
+	}
+	if len(tgs.TargetGroups) == 0 {
+		return errors.Errorf("target group not found: %#v", targetGroupARN)
+	}
+	tg := tgs.TargetGroups[0]
+	ports := []int64{aws.Int64Value(tg.Port)}
+	if p, err := strconv.ParseInt(aws.StringValue(tg.HealthCheckPort), 10, 64); err == nil && p != ports[0] {
+		ports = append(ports, p)
+	}
+	if len(tg.LoadBalancerArns) == 0 {
+		return nil
+	}
+	lbs, err := svc.DescribeLoadBalancersWithContext(ctx, &elbv2.DescribeLoadBalancersInput{
+		LoadBalancerArns: tg.LoadBalancerArns,
+	})
+	if err != nil {
+		return err
+	}
+	ec2svc := ec2.New(newSession(cfg, ec2Limiter))
+	for _, lb := range lbs.LoadBalancers {
+		for _, sg := range lb.SecurityGroups {
+			for _, port := range ports {
+				_, err := ec2svc.AuthorizeSecurityGroupIngressWithContext(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+					GroupId: aws.String(securityGroupID),
+					IpPermissions: []*ec2.IpPermission{{
+						IpProtocol: aws.String("tcp"),
+						FromPort:   aws.Int64(port),
+						ToPort:     aws.Int64(port),
+						UserIdGroupPairs: []*ec2.UserIdGroupPair{{
+							GroupId:     sg,
+							Description: aws.String("load balancer " + aws.StringValue(lb.LoadBalancerName)),
+						}},
+					}},
+				})
+				if errors.Is(err, ErrAlreadyExists) {
+					continue
+				}
+				if err != nil {
+					return errors.Wrapf(err, "cannot authorize ingress from security group %s", aws.StringValue(sg))
+				}
+			}
+		}
+	}
+	return nil
+}
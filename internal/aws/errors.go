@@ -0,0 +1,261 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/eks"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// The kinds of AWS errors reconcilers branch on. Errors of AWS requests
+// made by this package match the kind they are of with errors.Is.
+var (
+	// ErrInstanceNotFound indicates that an instance does not exist. It
+	// also matches ErrNotFound.
+	ErrInstanceNotFound = errors.New("instance not found")
+
+	// ErrNotFound indicates that a resource does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrAlreadyExists indicates that a resource or permission already
+	// exists.
+	ErrAlreadyExists = errors.New("already exists")
+
+	// ErrInvalidParameter indicates that a parameter of a request, e.g. a
+	// resource ID, is malformed or invalid.
+	ErrInvalidParameter = errors.New("invalid parameter")
+
+	// ErrIncorrectState indicates that a resource is not in a state that
+	// allows the operation, e.g. an instance protected from termination.
+	ErrIncorrectState = errors.New("incorrect state")
+
+	// ErrInsufficientCapacity indicates that EC2 has no capacity for an
+	// instance type in an availability zone.
+	ErrInsufficientCapacity = errors.New("insufficient capacity")
+
+	// ErrQuotaExceeded indicates that a request would exceed a vCPU or
+	// instance limit of the account.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+
+	// ErrSubnetExhausted indicates that no subnet has room for an
+	// instance.
+	ErrSubnetExhausted = errors.New("subnet exhausted")
+
+	// ErrThrottled indicates that a request was still throttled after it
+	// was retried.
+	ErrThrottled = errors.New("request throttled")
+
+	// ErrUnauthorized indicates that the credentials are not allowed to
+	// make a request.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrInvalidCredentials indicates that the credentials have expired or
+	// are invalid. Retrying will not succeed until they are refreshed.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// APIError is the error of an AWS request, matching the kind of error it is
+// with errors.Is. It implements awserr.RequestFailure, so that the AWS error
+// code can still be inspected.
+type APIError struct {
+	err       awserr.Error
+	kind      error
+	requestID string
+}
+
+func (e *APIError) Error() string {
+	if _, ok := e.err.(awserr.RequestFailure); !ok && e.requestID != "" {
+		return fmt.Sprintf("%s, request id: %s", e.err.Error(), e.requestID)
+	}
+	return e.err.Error()
+}
+
+func (e *APIError) Code() string    { return e.err.Code() }
+func (e *APIError) Message() string { return e.err.Message() }
+func (e *APIError) OrigErr() error  { return e.err.OrigErr() }
+func (e *APIError) Unwrap() error   { return e.err }
+
+// Is returns true if target is the kind of the error.
+func (e *APIError) Is(target error) bool {
+	if e.kind == ErrInstanceNotFound && target == ErrNotFound {
+		return true
+	}
+	return e.kind != nil && e.kind == target
+}
+
+// StatusCode returns the HTTP status code of the response, or 0 if the
+// request failed before a response was received.
+func (e *APIError) StatusCode() int {
+	if rerr, ok := e.err.(awserr.RequestFailure); ok {
+		return rerr.StatusCode()
+	}
+	return 0
+}
+
+// RequestID returns the ID of the request, for correlating the error with
+// CloudTrail and AWS support.
+func (e *APIError) RequestID() string {
+	if rerr, ok := e.err.(awserr.RequestFailure); ok {
+		return rerr.RequestID()
+	}
+	return e.requestID
+}
+
+// errorKind returns the sentinel error of the AWS error code, or nil. EC2
+// error codes of missing, duplicate and malformed resources end in
+// .NotFound, .Duplicate and .Malformed; other services have their own
+// codes.
+func errorKind(err awserr.Error) error {
+	code := err.Code()
+	switch code {
+	case InstanceNotFound:
+		return ErrInstanceNotFound
+	case "InsufficientFreeAddressesInSubnet":
+		return ErrSubnetExhausted
+	case InsufficientInstanceCapacity:
+		return ErrInsufficientCapacity
+	case "UnauthorizedOperation", "AccessDenied", "AccessDeniedException":
+		return ErrUnauthorized
+	case "ExpiredToken", "ExpiredTokenException", "InvalidClientTokenId", "AuthFailure":
+		return ErrInvalidCredentials
+	case "VcpuLimitExceeded", "InstanceLimitExceeded":
+		return ErrQuotaExceeded
+	case "OperationNotPermitted", "IncorrectInstanceState", "IncorrectState":
+		return ErrIncorrectState
+	case "InvalidParameter", "InvalidParameterValue", "InvalidParameterCombination":
+		return ErrInvalidParameter
+	case elb.ErrCodeAccessPointNotFoundException, elb.ErrCodeInvalidEndPointException,
+		elbv2.ErrCodeTargetGroupNotFoundException, elbv2.ErrCodeInvalidTargetException,
+		route53.ErrCodeNoSuchHealthCheck, servicequotas.ErrCodeNoSuchResourceException,
+		iam.ErrCodeNoSuchEntityException, eks.ErrCodeResourceNotFoundException:
+		return ErrNotFound
+	case cloudwatchlogs.ErrCodeResourceAlreadyExistsException:
+		return ErrAlreadyExists
+	}
+	switch {
+	case strings.HasSuffix(code, ".NotFound"):
+		return ErrNotFound
+	case strings.HasSuffix(code, ".Duplicate"):
+		return ErrAlreadyExists
+	case strings.HasSuffix(code, ".Malformed"):
+		return ErrInvalidParameter
+	case request.IsErrorThrottle(err):
+		return ErrThrottled
+	}
+	return nil
+}
+
+// classifyError is an after retry handler wrapping the error of a request
+// that is not retried in an APIError. It must run after the retry decision,
+// since the error of a retried request is cleared.
+func classifyError(r *request.Request) {
+	aerr, ok := r.Error.(awserr.Error)
+	if !ok {
+		return
+	}
+	if _, ok := aerr.(*APIError); ok {
+		return
+	}
+	r.Error = &APIError{err: aerr, kind: errorKind(aerr), requestID: r.RequestID}
+}
+
+// ConfigurationError indicates that an AWSMachine spec cannot be satisfied
+// as written, so retrying the operation will not succeed.
+type ConfigurationError struct {
+	msg string
+}
+
+func NewConfigurationError(format string, args ...interface{}) error {
+	return &ConfigurationError{msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *ConfigurationError) Error() string {
+	return e.msg
+}
+
+// IsConfigurationError returns true if the error is a ConfigurationError.
+func IsConfigurationError(err error) bool {
+	_, ok := errors.Cause(err).(*ConfigurationError)
+	return ok
+}
+
+// SubnetRejection is a candidate subnet that could not be used for a launch.
+type SubnetRejection struct {
+	SubnetID string
+	Reason   string
+}
+
+// SubnetsExhaustedError indicates that every subnet matching the machine was
+// rejected, e.g. because none has a free IP address.
+type SubnetsExhaustedError struct {
+	VPCID    string
+	Rejected []SubnetRejection
+}
+
+func (e *SubnetsExhaustedError) Error() string {
+	return fmt.Sprintf("cannot determine subnet from VPC: %#v: %s", e.VPCID, e.Rejections())
+}
+
+// Is returns true for ErrSubnetExhausted.
+func (e *SubnetsExhaustedError) Is(target error) bool {
+	return target == ErrSubnetExhausted
+}
+
+// Rejections describes each rejected subnet and why it was rejected.
+func (e *SubnetsExhaustedError) Rejections() string {
+	rejected := make([]string, 0, len(e.Rejected))
+	for _, r := range e.Rejected {
+		rejected = append(rejected, fmt.Sprintf("%s (%s)", r.SubnetID, r.Reason))
+	}
+	return strings.Join(rejected, ", ")
+}
+
+// LogValues returns structured logging key/value pairs describing an AWS
+// error, including the error code and request ID when available, so that
+// controller logs can be correlated with CloudTrail. It returns nil for
+// errors that did not originate from an AWS API call.
+func LogValues(err error) []interface{} {
+	var kv []interface{}
+	if aerr, ok := errors.Cause(err).(awserr.Error); ok {
+		kv = append(kv, "awsErrorCode", aerr.Code())
+	}
+	if rerr, ok := errors.Cause(err).(awserr.RequestFailure); ok {
+		kv = append(kv, "awsRequestID", rerr.RequestID(), "awsStatusCode", rerr.StatusCode())
+	}
+	return kv
+}
+
+var credentialErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mapa_aws_credential_errors_total",
+	Help: "Number of AWS requests rejected due to expired or invalid credentials, by error code.",
+}, []string{"code"})
+
+func init() {
+	metrics.Registry.MustRegister(credentialErrorsTotal)
+}
+
+// IsCredentialError returns true if AWS rejected the request because the
+// credentials have expired or are invalid. Retrying will not succeed until
+// the credentials are refreshed.
+func IsCredentialError(err error) bool {
+	return errors.Is(err, ErrInvalidCredentials)
+}
+
+// RecordCredentialError increments the credential error metric for the
+// error code of err.
+func RecordCredentialError(err error) {
+	if aerr, ok := errors.Cause(err).(awserr.Error); ok {
+		credentialErrorsTotal.WithLabelValues(aerr.Code()).Inc()
+	}
+}
@@ -0,0 +1,46 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/pkg/errors"
+)
+
+func TestErrorKind(t *testing.T) {
+	cases := []struct {
+		code string
+		kind error
+	}{
+		{"InvalidInstanceID.NotFound", ErrInstanceNotFound},
+		{"InvalidInstanceID.NotFound", ErrNotFound},
+		{"InvalidKeyPair.NotFound", ErrNotFound},
+		{"NoSuchEntity", ErrNotFound},
+		{"InvalidPermission.Duplicate", ErrAlreadyExists},
+		{"InvalidInstanceID.Malformed", ErrInvalidParameter},
+		{"IncorrectInstanceState", ErrIncorrectState},
+		{"ExpiredToken", ErrInvalidCredentials},
+		{"UnauthorizedOperation", ErrUnauthorized},
+		{"VcpuLimitExceeded", ErrQuotaExceeded},
+		{"InsufficientInstanceCapacity", ErrInsufficientCapacity},
+		{"RequestLimitExceeded", ErrThrottled},
+	}
+	for _, tc := range cases {
+		r := &request.Request{Error: awserr.New(tc.code, "failed", nil), RequestID: "req-1"}
+		classifyError(r)
+		// reconcilers receive errors wrapped with context
+		err := errors.Wrap(r.Error, "cannot do it")
+		if !errors.Is(err, tc.kind) {
+			t.Errorf("%s: expected %v", tc.code, tc.kind)
+		}
+		if aerr, ok := errors.Cause(err).(awserr.Error); !ok || aerr.Code() != tc.code {
+			t.Errorf("%s: error code not preserved: %v", tc.code, err)
+		}
+	}
+	r := &request.Request{Error: awserr.New("InvalidKeyPair.NotFound", "failed", nil)}
+	classifyError(r)
+	if errors.Is(r.Error, ErrInstanceNotFound) {
+		t.Errorf("a missing key pair matches ErrInstanceNotFound")
+	}
+}
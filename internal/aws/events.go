@@ -0,0 +1,77 @@
+package aws
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// SpotInterruptionEventCode is the code of events describing the
+// interruption of a spot instance.
+const SpotInterruptionEventCode = "spot-interruption"
+
+// spotInterruptionWarning is how long before being interrupted a spot
+// instance is marked for interruption.
+const spotInterruptionWarning = 2 * time.Minute
+
+// InstanceEvent is an upcoming event disrupting an instance.
+type InstanceEvent struct {
+	Code        string    `json:"code"`
+	Description string    `json:"description,omitempty"`
+	NotBefore   time.Time `json:"notBefore"`
+}
+
+// DescribeInstanceEvents returns the scheduled events and spot
+// interruptions of the instance that have not completed or been canceled,
+// earliest first. Rebalance recommendations are only available from the
+// instance metadata service and are not included.
+func DescribeInstanceEvents(ctx context.Context, cfg *aws.Config, instance *ec2.Instance) ([]InstanceEvent, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	events := make([]InstanceEvent, 0)
+	resp, err := svc.DescribeInstanceStatusWithContext(ctx, &ec2.DescribeInstanceStatusInput{
+		InstanceIds:         []*string{instance.InstanceId},
+		IncludeAllInstances: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range resp.InstanceStatuses {
+		for _, e := range status.Events {
+			desc := aws.StringValue(e.Description)
+			if strings.HasPrefix(desc, "[Completed]") || strings.HasPrefix(desc, "[Canceled]") {
+				continue
+			}
+			events = append(events, InstanceEvent{
+				Code:        aws.StringValue(e.Code),
+				Description: desc,
+				NotBefore:   aws.TimeValue(e.NotBefore),
+			})
+		}
+	}
+	if instance.SpotInstanceRequestId != nil {
+		resp, err := svc.DescribeSpotInstanceRequestsWithContext(ctx, &ec2.DescribeSpotInstanceRequestsInput{
+			SpotInstanceRequestIds: []*string{instance.SpotInstanceRequestId},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, req := range resp.SpotInstanceRequests {
+			if req.Status == nil || !strings.HasPrefix(aws.StringValue(req.Status.Code), "marked-for-") {
+				continue
+			}
+			events = append(events, InstanceEvent{
+				Code:        SpotInterruptionEventCode,
+				Description: aws.StringValue(req.Status.Message),
+				NotBefore:   aws.TimeValue(req.Status.UpdateTime).Add(spotInterruptionWarning),
+			})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].NotBefore.Before(events[j].NotBefore)
+	})
+	return events, nil
+}
@@ -0,0 +1,94 @@
+package aws
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// AllocateHost allocates a dedicated host for the instance type of the
+// machine in its availability zone, tagged with the owner tags of the
+// machine so that it can be found again.
+func AllocateHost(ctx context.Context, cfg *aws.Config, m *infrav1.AWSMachine) (string, error) {
+	if m.Spec.AvailabilityZone == "" {
+		return "", NewConfigurationError("allocating a dedicated host requires the availability zone of the machine to be set")
+	}
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.AllocateHostsWithContext(ctx, &ec2.AllocateHostsInput{
+		AvailabilityZone: aws.String(m.Spec.AvailabilityZone),
+		InstanceType:     aws.String(m.Spec.InstanceType),
+		Quantity:         aws.Int64(1),
+		TagSpecifications: []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String(ec2.ResourceTypeDedicatedHost),
+				Tags:         convertTags(instanceTags(m)),
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, id := range resp.HostIds {
+		return aws.StringValue(id), nil
+	}
+	return "", errors.New("no hosts allocated")
+}
+
+// DescribeHosts returns the dedicated hosts that are not released. When key
+// is set, only hosts with the tag are returned.
+func DescribeHosts(ctx context.Context, cfg *aws.Config, key, value string) ([]*ec2.Host, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	input := &ec2.DescribeHostsInput{
+		Filter: []*ec2.Filter{
+			{
+				Name: aws.String("state"),
+				Values: aws.StringSlice([]string{
+					ec2.AllocationStateAvailable,
+					ec2.AllocationStateUnderAssessment,
+					ec2.AllocationStatePermanentFailure,
+					ec2.AllocationStatePending,
+				}),
+			},
+		},
+	}
+	if key != "" {
+		input.Filter = append(input.Filter, &ec2.Filter{
+			Name:   aws.String("tag:" + key),
+			Values: aws.StringSlice([]string{value}),
+		})
+	}
+	hosts := make([]*ec2.Host, 0)
+	for {
+		resp, err := svc.DescribeHostsWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, resp.Hosts...)
+		if aws.StringValue(resp.NextToken) == "" {
+			return hosts, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+// ReleaseHosts releases the dedicated hosts. Hosts with running instances
+// cannot be released.
+func ReleaseHosts(ctx context.Context, cfg *aws.Config, hostIDs []string) error {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.ReleaseHostsWithContext(ctx, &ec2.ReleaseHostsInput{
+		HostIds: aws.StringSlice(hostIDs),
+	})
+	if err != nil {
+		return err
+	}
+	for _, item := range resp.Unsuccessful {
+		if item.Error != nil {
+			return errors.Errorf("cannot release host %q: %s", aws.StringValue(item.ResourceId), aws.StringValue(item.Error.Message))
+		}
+	}
+	return nil
+}
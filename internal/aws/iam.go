@@ -0,0 +1,30 @@
+package aws
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+// InstanceProfileName returns the name of an instance profile given by name
+// or ARN. The path of an ARN is not part of the name.
+func InstanceProfileName(s string) string {
+	if !strings.HasPrefix(s, "arn:") {
+		return s
+	}
+	return s[strings.LastIndex(s, "/")+1:]
+}
+
+// DescribeInstanceProfile returns the instance profile with the given name.
+func DescribeInstanceProfile(ctx context.Context, cfg *aws.Config, name string) (*iam.InstanceProfile, error) {
+	svc := iam.New(withUserAgent(newBaseSession(cfg)))
+	resp, err := svc.GetInstanceProfileWithContext(ctx, &iam.GetInstanceProfileInput{
+		InstanceProfileName: aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.InstanceProfile, nil
+}
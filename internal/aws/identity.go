@@ -0,0 +1,62 @@
+package aws
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// userAgentName is added to the User-Agent of all AWS requests.
+const userAgentName = "machine-api-provider-aws"
+
+// ControllerIdentity identifies this controller process, e.g. by pod name,
+// in the User-Agent of AWS requests and the session tags of assumed roles.
+var ControllerIdentity string
+
+type objectKey struct{}
+
+// WithObject returns a context attributing AWS requests made with it to the
+// Kubernetes object of the kind, e.g. "awsmachine", so that CloudTrail
+// events can be traced back to the object that triggered them.
+func WithObject(ctx context.Context, kind, namespace, name string) context.Context {
+	if namespace != "" {
+		name = namespace + "/" + name
+	}
+	return context.WithValue(ctx, objectKey{}, kind+"/"+name)
+}
+
+// addUserAgent is a build handler adding the controller identity and the
+// object the request was made for to the User-Agent, which CloudTrail
+// records with each event.
+func addUserAgent(r *request.Request) {
+	parts := []string{userAgentName}
+	if ControllerIdentity != "" {
+		parts = append(parts, "controller/"+ControllerIdentity)
+	}
+	if o, ok := r.Context().Value(objectKey{}).(string); ok {
+		parts = append(parts, o)
+	}
+	request.AddToUserAgent(r, strings.Join(parts, " "))
+}
+
+// withUserAgent adds the User-Agent handler to the session.
+func withUserAgent(sess *session.Session) *session.Session {
+	sess.Handlers.Build.PushBack(addUserAgent)
+	return sess
+}
+
+var invalidSessionNameChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// roleSessionName returns the default role session name for credentials of
+// the AWSCredentials, shown as the principal of the assumed role in
+// CloudTrail.
+func roleSessionName(namespace, name string) string {
+	s := invalidSessionNameChars.ReplaceAllString("mapa-"+namespace+"-"+name, "-")
+	if len(s) > 64 {
+		s = s[:64]
+	}
+	return s
+}
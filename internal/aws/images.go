@@ -0,0 +1,112 @@
+package aws
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ImageReplicationTagKey is the tag identifying the image replication
+	// (namespace/name) an AMI was copied for.
+	ImageReplicationTagKey = "infrastructure.crit.sh/image-replication"
+
+	// SourceImageTagKey is the tag of copied AMIs with the ID of the AMI
+	// they were copied from.
+	SourceImageTagKey = "infrastructure.crit.sh/source-ami"
+)
+
+// DescribeImageCopies returns the copies of the source AMI made for the
+// image replication in the region of cfg.
+func DescribeImageCopies(ctx context.Context, cfg *aws.Config, replication, sourceAMI string) ([]*ec2.Image, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		Owners: aws.StringSlice([]string{"self"}),
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:" + ImageReplicationTagKey),
+				Values: aws.StringSlice([]string{replication}),
+			},
+			{
+				Name:   aws.String("tag:" + SourceImageTagKey),
+				Values: aws.StringSlice([]string{sourceAMI}),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Images, nil
+}
+
+// ImageCopyOptions configure the encryption of a copied AMI.
+type ImageCopyOptions struct {
+	Encrypted bool
+	KMSKeyID  string
+}
+
+// CopyImage copies the source AMI from sourceRegion to the region of cfg
+// for the image replication, returning the ID of the copy. Copies made again
+// with the same arguments return the same copy, so that a copy is not
+// duplicated when tagging it fails.
+func CopyImage(ctx context.Context, cfg *aws.Config, replication, sourceAMI, sourceRegion string, o ImageCopyOptions, tags map[string]string) (string, error) {
+	src := ec2.New(newSession(cfg.Copy().WithRegion(sourceRegion), ec2Limiter))
+	resp, err := src.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		ImageIds: aws.StringSlice([]string{sourceAMI}),
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Images) == 0 {
+		return "", errors.Errorf("cannot find image: %#v", sourceAMI)
+	}
+	source := resp.Images[0]
+	region := aws.StringValue(cfg.Region)
+	token := sha256.Sum256([]byte(replication + "/" + sourceAMI + "/" + region))
+	input := &ec2.CopyImageInput{
+		ClientToken:   aws.String(hex.EncodeToString(token[:])),
+		CopyImageTags: aws.Bool(true),
+		Description:   aws.String(fmt.Sprintf("Copy of %s from %s", sourceAMI, sourceRegion)),
+		Name:          aws.String(copyImageName(aws.StringValue(source.Name), sourceAMI)),
+		SourceImageId: aws.String(sourceAMI),
+		SourceRegion:  aws.String(sourceRegion),
+	}
+	if o.Encrypted || o.KMSKeyID != "" {
+		input.Encrypted = aws.Bool(true)
+	}
+	if o.KMSKeyID != "" {
+		input.KmsKeyId = aws.String(o.KMSKeyID)
+	}
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	out, err := svc.CopyImageWithContext(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	id := aws.StringValue(out.ImageId)
+	copyTags := map[string]string{
+		ImageReplicationTagKey: replication,
+		SourceImageTagKey:      sourceAMI,
+	}
+	for k, v := range tags {
+		copyTags[k] = v
+	}
+	if err := CreateTags(ctx, cfg, id, copyTags); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// copyImageName returns the name of a copy of the AMI, which must be unique
+// in the region and at most 128 characters.
+func copyImageName(name, sourceAMI string) string {
+	suffix := " (" + sourceAMI + ")"
+	if len(name)+len(suffix) > 128 {
+		name = name[:128-len(suffix)]
+	}
+	return name + suffix
+}
@@ -0,0 +1,73 @@
+package aws
+
+import (
+	"sync"
+	"time"
+)
+
+// Inflight tracks the reconciles and batches in progress, so that launches
+// and terminations can finish and record their results in status when the
+// controller shuts down, instead of leaving instances without a ProviderID.
+var Inflight = &InflightTracker{}
+
+type InflightTracker struct {
+	mu       sync.Mutex
+	n        int
+	idle     chan struct{}
+	draining bool
+}
+
+// Begin records the start of a reconcile. It returns false once the
+// controller is shutting down, in which case no new work is started.
+func (t *InflightTracker) Begin() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.n++
+	return true
+}
+
+// hold records the start of a batch queued by a reconcile in progress. The
+// batch is waited for even once the controller is shutting down, since the
+// reconcile queued it before.
+func (t *InflightTracker) hold() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.n++
+}
+
+// End records the end of a reconcile or batch.
+func (t *InflightTracker) End() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.n--
+	if t.n == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// Drain stops new reconciles from starting and waits up to grace for the
+// reconciles and batches in progress to finish. It returns false when the
+// grace period expired first.
+func (t *InflightTracker) Drain(grace time.Duration) bool {
+	t.mu.Lock()
+	t.draining = true
+	if t.n == 0 {
+		t.mu.Unlock()
+		return true
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+	select {
+	case <-idle:
+		return true
+	case <-time.After(grace):
+		return false
+	}
+}
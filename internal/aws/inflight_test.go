@@ -0,0 +1,62 @@
+package aws
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInflightTracker(t *testing.T) {
+	t.Run("idle", func(t *testing.T) {
+		tr := &InflightTracker{}
+		if !tr.Drain(0) {
+			t.Error("expected drain without work in progress to finish")
+		}
+		if tr.Begin() {
+			t.Error("expected no reconcile to begin while draining")
+		}
+	})
+
+	t.Run("waits for reconciles and batches", func(t *testing.T) {
+		tr := &InflightTracker{}
+		if !tr.Begin() {
+			t.Fatal("expected reconcile to begin")
+		}
+		// a batch queued by the reconcile outlives it
+		tr.hold()
+		tr.End()
+
+		drained := make(chan bool)
+		go func() { drained <- tr.Drain(time.Minute) }()
+		for !func() bool {
+			tr.mu.Lock()
+			defer tr.mu.Unlock()
+			return tr.draining
+		}() {
+			time.Sleep(time.Millisecond)
+		}
+		if tr.Begin() {
+			t.Error("expected no reconcile to begin while draining")
+		}
+		// batches queued while draining are waited for as well
+		tr.hold()
+		tr.End()
+		select {
+		case <-drained:
+			t.Fatal("expected drain to wait for the batch")
+		case <-time.After(10 * time.Millisecond):
+		}
+		tr.End()
+		if !<-drained {
+			t.Error("expected drain to finish with the batch")
+		}
+	})
+
+	t.Run("grace period expires", func(t *testing.T) {
+		tr := &InflightTracker{}
+		tr.Begin()
+		if tr.Drain(10 * time.Millisecond) {
+			t.Error("expected drain to time out with a reconcile in progress")
+		}
+		tr.End()
+	})
+}
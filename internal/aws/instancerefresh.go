@@ -0,0 +1,153 @@
+package aws
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+)
+
+// LaunchTemplate is a version of a launch template.
+type LaunchTemplate struct {
+	ID           string
+	Version      int64
+	ImageID      string
+	InstanceType string
+}
+
+// groupLaunchTemplate returns the launch template the group launches
+// instances from, or nil if it uses a launch configuration.
+func groupLaunchTemplate(group *autoscaling.Group) *autoscaling.LaunchTemplateSpecification {
+	if p := group.MixedInstancesPolicy; p != nil && p.LaunchTemplate != nil {
+		return p.LaunchTemplate.LaunchTemplateSpecification
+	}
+	return group.LaunchTemplate
+}
+
+// DescribeGroupLaunchTemplate returns the version of the launch template the
+// group launches instances from.
+func DescribeGroupLaunchTemplate(ctx context.Context, cfg *aws.Config, group *autoscaling.Group) (*LaunchTemplate, error) {
+	spec := groupLaunchTemplate(group)
+	if spec == nil {
+		return nil, NewConfigurationError("autoscaling group %q does not use a launch template", aws.StringValue(group.AutoScalingGroupName))
+	}
+	input := &ec2.DescribeLaunchTemplateVersionsInput{
+		Versions: aws.StringSlice([]string{"$Default"}),
+	}
+	if spec.Version != nil {
+		input.Versions = aws.StringSlice([]string{aws.StringValue(spec.Version)})
+	}
+	if spec.LaunchTemplateId != nil {
+		input.LaunchTemplateId = spec.LaunchTemplateId
+	} else {
+		input.LaunchTemplateName = spec.LaunchTemplateName
+	}
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.DescribeLaunchTemplateVersionsWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.LaunchTemplateVersions) == 0 {
+		return nil, errors.Errorf("cannot find launch template of autoscaling group: %#v", aws.StringValue(group.AutoScalingGroupName))
+	}
+	return newLaunchTemplate(resp.LaunchTemplateVersions[0]), nil
+}
+
+// CreateLaunchTemplateVersion creates a version of the launch template from
+// the source version, replacing its image and, if set, its instance type.
+func CreateLaunchTemplateVersion(ctx context.Context, cfg *aws.Config, source *LaunchTemplate, imageID, instanceType string) (*LaunchTemplate, error) {
+	data := &ec2.RequestLaunchTemplateData{
+		ImageId: aws.String(imageID),
+	}
+	if instanceType != "" {
+		data.InstanceType = aws.String(instanceType)
+	}
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.CreateLaunchTemplateVersionWithContext(ctx, &ec2.CreateLaunchTemplateVersionInput{
+		LaunchTemplateId:   aws.String(source.ID),
+		SourceVersion:      aws.String(strconv.FormatInt(source.Version, 10)),
+		LaunchTemplateData: data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newLaunchTemplate(resp.LaunchTemplateVersion), nil
+}
+
+func newLaunchTemplate(v *ec2.LaunchTemplateVersion) *LaunchTemplate {
+	lt := &LaunchTemplate{
+		ID:      aws.StringValue(v.LaunchTemplateId),
+		Version: aws.Int64Value(v.VersionNumber),
+	}
+	if v.LaunchTemplateData != nil {
+		lt.ImageID = aws.StringValue(v.LaunchTemplateData.ImageId)
+		lt.InstanceType = aws.StringValue(v.LaunchTemplateData.InstanceType)
+	}
+	return lt
+}
+
+// StartInstanceRefresh starts replacing the instances of the group with
+// instances launched from the version of the launch template, returning the
+// ID of the refresh. The group is changed to the version once the refresh
+// succeeds.
+func StartInstanceRefresh(ctx context.Context, cfg *aws.Config, group *autoscaling.Group, lt *LaunchTemplate, minHealthyPercentage, instanceWarmup *int64) (string, error) {
+	spec := &autoscaling.LaunchTemplateSpecification{
+		LaunchTemplateId: aws.String(lt.ID),
+		Version:          aws.String(strconv.FormatInt(lt.Version, 10)),
+	}
+	desired := &autoscaling.DesiredConfiguration{}
+	if p := group.MixedInstancesPolicy; p != nil && p.LaunchTemplate != nil {
+		policy := awsutil.CopyOf(p).(*autoscaling.MixedInstancesPolicy)
+		policy.LaunchTemplate.LaunchTemplateSpecification = spec
+		desired.MixedInstancesPolicy = policy
+	} else {
+		desired.LaunchTemplate = spec
+	}
+	svc := autoscaling.New(newSession(cfg, autoscalingLimiter))
+	resp, err := svc.StartInstanceRefreshWithContext(ctx, &autoscaling.StartInstanceRefreshInput{
+		AutoScalingGroupName: group.AutoScalingGroupName,
+		DesiredConfiguration: desired,
+		Preferences: &autoscaling.RefreshPreferences{
+			InstanceWarmup:       instanceWarmup,
+			MinHealthyPercentage: minHealthyPercentage,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(resp.InstanceRefreshId), nil
+}
+
+// DescribeInstanceRefreshes returns the instance refreshes of the group,
+// most recent first, or only those with the IDs if any are given.
+func DescribeInstanceRefreshes(ctx context.Context, cfg *aws.Config, groupName string, ids ...string) ([]*autoscaling.InstanceRefresh, error) {
+	input := &autoscaling.DescribeInstanceRefreshesInput{
+		AutoScalingGroupName: aws.String(groupName),
+	}
+	if len(ids) != 0 {
+		input.InstanceRefreshIds = aws.StringSlice(ids)
+	}
+	svc := autoscaling.New(newSession(cfg, autoscalingLimiter))
+	resp, err := svc.DescribeInstanceRefreshesWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return resp.InstanceRefreshes, nil
+}
+
+// InstanceRefreshActive returns true until the refresh has finished,
+// including rolling back.
+func InstanceRefreshActive(refresh *autoscaling.InstanceRefresh) bool {
+	switch aws.StringValue(refresh.Status) {
+	case autoscaling.InstanceRefreshStatusPending,
+		autoscaling.InstanceRefreshStatusInProgress,
+		autoscaling.InstanceRefreshStatusCancelling,
+		autoscaling.InstanceRefreshStatusRollbackInProgress:
+		return true
+	}
+	return false
+}
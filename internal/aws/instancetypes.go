@@ -0,0 +1,90 @@
+package aws
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// instanceTypeCacheTTL is how long the instance types of a region are used
+// before they are described again. New instance types are added rarely.
+const instanceTypeCacheTTL = 24 * time.Hour
+
+// InstanceTypeSpec describes the capacity of an instance type.
+type InstanceTypeSpec struct {
+	Name               string `json:"name"`
+	VCPUs              int64  `json:"vcpus"`
+	MemoryMiB          int64  `json:"memoryMiB"`
+	GPUs               int64  `json:"gpus,omitempty"`
+	GPUManufacturer    string `json:"gpuManufacturer,omitempty"`
+	GPUName            string `json:"gpuName,omitempty"`
+	NetworkPerformance string `json:"networkPerformance,omitempty"`
+}
+
+type cachedInstanceTypes struct {
+	specs   []InstanceTypeSpec
+	fetched time.Time
+}
+
+var (
+	instanceTypeCacheMu sync.Mutex
+	instanceTypeCache   = make(map[string]cachedInstanceTypes)
+)
+
+// DescribeInstanceTypeSpecs returns the instance types offered in the region
+// of cfg, sorted by name. The instance types are cached for
+// instanceTypeCacheTTL.
+func DescribeInstanceTypeSpecs(ctx context.Context, cfg *aws.Config) ([]InstanceTypeSpec, error) {
+	region := aws.StringValue(cfg.Region)
+	instanceTypeCacheMu.Lock()
+	cached, ok := instanceTypeCache[region]
+	instanceTypeCacheMu.Unlock()
+	if ok && time.Since(cached.fetched) < instanceTypeCacheTTL {
+		return cached.specs, nil
+	}
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	specs := make([]InstanceTypeSpec, 0)
+	err := svc.DescribeInstanceTypesPagesWithContext(ctx, &ec2.DescribeInstanceTypesInput{}, func(page *ec2.DescribeInstanceTypesOutput, lastPage bool) bool {
+		for _, t := range page.InstanceTypes {
+			specs = append(specs, instanceTypeSpec(t))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Name < specs[j].Name })
+	instanceTypeCacheMu.Lock()
+	instanceTypeCache[region] = cachedInstanceTypes{specs: specs, fetched: time.Now()}
+	instanceTypeCacheMu.Unlock()
+	return specs, nil
+}
+
+func instanceTypeSpec(t *ec2.InstanceTypeInfo) InstanceTypeSpec {
+	s := InstanceTypeSpec{
+		Name: aws.StringValue(t.InstanceType),
+	}
+	if t.VCpuInfo != nil {
+		s.VCPUs = aws.Int64Value(t.VCpuInfo.DefaultVCpus)
+	}
+	if t.MemoryInfo != nil {
+		s.MemoryMiB = aws.Int64Value(t.MemoryInfo.SizeInMiB)
+	}
+	if t.GpuInfo != nil {
+		for _, gpu := range t.GpuInfo.Gpus {
+			s.GPUs += aws.Int64Value(gpu.Count)
+			if s.GPUName == "" {
+				s.GPUManufacturer = aws.StringValue(gpu.Manufacturer)
+				s.GPUName = aws.StringValue(gpu.Name)
+			}
+		}
+	}
+	if t.NetworkInfo != nil {
+		s.NetworkPerformance = aws.StringValue(t.NetworkInfo.NetworkPerformance)
+	}
+	return s
+}
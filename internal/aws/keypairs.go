@@ -0,0 +1,100 @@
+package aws
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+)
+
+// KeyPairTagKey is the tag identifying the provider (namespace/name) that
+// created or imported a key pair.
+const KeyPairTagKey = "infrastructure.crit.sh/key-pair"
+
+// DescribeKeyPair returns the key pair with the name in the region of cfg,
+// or nil when there is no such key pair.
+func DescribeKeyPair(ctx context.Context, cfg *aws.Config, name string) (*ec2.KeyPairInfo, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.DescribeKeyPairsWithContext(ctx, &ec2.DescribeKeyPairsInput{
+		KeyNames: aws.StringSlice([]string{name}),
+	})
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, kp := range resp.KeyPairs {
+		return kp, nil
+	}
+	return nil, nil
+}
+
+// ImportKeyPair imports the OpenSSH public key as a key pair in the region
+// of cfg, tagged as managed by the provider, returning the ID and
+// fingerprint of the key pair.
+func ImportKeyPair(ctx context.Context, cfg *aws.Config, name, publicKey, provider string) (string, string, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.ImportKeyPairWithContext(ctx, &ec2.ImportKeyPairInput{
+		KeyName:           aws.String(name),
+		PublicKeyMaterial: []byte(publicKey),
+		TagSpecifications: keyPairTagSpecifications(provider),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return aws.StringValue(resp.KeyPairId), aws.StringValue(resp.KeyFingerprint), nil
+}
+
+// CreateKeyPair creates a key pair in the region of cfg, tagged as managed
+// by the provider, returning the ID, fingerprint and PEM encoded private key
+// of the key pair. The private key cannot be retrieved again.
+func CreateKeyPair(ctx context.Context, cfg *aws.Config, name, provider string) (string, string, string, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.CreateKeyPairWithContext(ctx, &ec2.CreateKeyPairInput{
+		KeyName:           aws.String(name),
+		TagSpecifications: keyPairTagSpecifications(provider),
+	})
+	if err != nil {
+		return "", "", "", err
+	}
+	return aws.StringValue(resp.KeyPairId), aws.StringValue(resp.KeyFingerprint), aws.StringValue(resp.KeyMaterial), nil
+}
+
+// DeleteKeyPair deletes the key pair with the ID in the region of cfg. Key
+// pairs that no longer exist are ignored.
+func DeleteKeyPair(ctx context.Context, cfg *aws.Config, id string) error {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	_, err := svc.DeleteKeyPairWithContext(ctx, &ec2.DeleteKeyPairInput{
+		KeyPairId: aws.String(id),
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// KeyPairManagedBy returns true if the key pair is tagged as managed by the
+// provider.
+func KeyPairManagedBy(kp *ec2.KeyPairInfo, provider string) bool {
+	for _, t := range kp.Tags {
+		if aws.StringValue(t.Key) == KeyPairTagKey {
+			return aws.StringValue(t.Value) == provider
+		}
+	}
+	return false
+}
+
+func keyPairTagSpecifications(provider string) []*ec2.TagSpecification {
+	tags := map[string]string{KeyPairTagKey: provider}
+	for k, v := range DefaultTags {
+		tags[k] = v
+	}
+	return []*ec2.TagSpecification{
+		{
+			ResourceType: aws.String(ec2.ResourceTypeKeyPair),
+			Tags:         convertTags(tags),
+		},
+	}
+}
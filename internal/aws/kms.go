@@ -0,0 +1,23 @@
+package aws
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// Encrypt encrypts the plaintext with the KMS key. The same encryption
+// context must be given to decrypt the ciphertext.
+func Encrypt(ctx context.Context, cfg *aws.Config, keyID string, plaintext []byte, encryptionContext map[string]string) ([]byte, error) {
+	svc := kms.New(withUserAgent(newBaseSession(cfg)))
+	out, err := svc.EncryptWithContext(ctx, &kms.EncryptInput{
+		KeyId:             aws.String(keyID),
+		Plaintext:         plaintext,
+		EncryptionContext: aws.StringMap(encryptionContext),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.CiphertextBlob, nil
+}
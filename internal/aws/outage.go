@@ -0,0 +1,82 @@
+package aws
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// DefaultOutageThreshold is how long requests of a provider namespace must
+// have been failing with rejected credentials before the namespace is
+// considered in a credential outage.
+const DefaultOutageThreshold = 2 * time.Minute
+
+// outageProbeInterval is how long an outage lasts without further rejected
+// requests, after which requests are let through again to probe whether
+// the credentials are accepted, e.g. in namespaces without a provider.
+const outageProbeInterval = 5 * time.Minute
+
+// CredentialOutages tracks credential outages for all AWS requests made by
+// this process.
+var CredentialOutages = &OutageTracker{Threshold: DefaultOutageThreshold}
+
+// OutageTracker tracks, per provider namespace, since when AWS has been
+// rejecting credentials without any request succeeding in between.
+type OutageTracker struct {
+	Threshold time.Duration
+
+	mu      sync.Mutex
+	outages map[string]outage
+}
+
+type outage struct {
+	since time.Time
+	last  time.Time
+}
+
+func (t *OutageTracker) recordFailure(namespace string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.outages == nil {
+		t.outages = make(map[string]outage)
+	}
+	o, ok := t.outages[namespace]
+	if !ok {
+		o.since = time.Now()
+	}
+	o.last = time.Now()
+	t.outages[namespace] = o
+}
+
+func (t *OutageTracker) recordSuccess(namespace string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.outages, namespace)
+}
+
+// Degraded returns true, and since when credentials have been rejected, if
+// requests of the provider namespace have been failing with rejected
+// credentials for longer than the threshold, and were still being rejected
+// within outageProbeInterval. Any successful request ends the outage.
+func (t *OutageTracker) Degraded(namespace string) (bool, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	o, ok := t.outages[namespace]
+	if !ok || time.Since(o.last) > outageProbeInterval {
+		return false, time.Time{}
+	}
+	return o.last.Sub(o.since) >= t.Threshold, o.since
+}
+
+// recordCredentialOutage is a complete handler tracking requests rejected
+// due to their credentials, and successful requests.
+func recordCredentialOutage(r *request.Request) {
+	namespace, _ := r.Context().Value(namespaceKey{}).(string)
+	switch {
+	case r.Error == nil:
+		CredentialOutages.recordSuccess(namespace)
+	case IsCredentialError(r.Error):
+		CredentialOutages.recordFailure(namespace)
+	}
+}
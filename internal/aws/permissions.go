@@ -0,0 +1,157 @@
+package aws
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/pkg/errors"
+)
+
+// RequiredActions are the IAM actions needed to launch, describe and
+// terminate instances. Actions only used by optional features are not
+// included.
+var RequiredActions = []string{
+	"ec2:CreateTags",
+	"ec2:DescribeAddresses",
+	"ec2:DescribeImages",
+	"ec2:DescribeInstanceStatus",
+	"ec2:DescribeInstanceTypes",
+	"ec2:DescribeInstances",
+	"ec2:DescribeNetworkInterfaces",
+	"ec2:DescribeRegions",
+	"ec2:DescribeSubnets",
+	"ec2:DescribeVolumes",
+	"ec2:RunInstances",
+	"ec2:TerminateInstances",
+}
+
+const (
+	// PermissionsSimulated is the method of permission checks that
+	// simulated the IAM policies of the caller.
+	PermissionsSimulated = "Simulation"
+
+	// PermissionsProbed is the method of permission checks that made
+	// dry-run requests, for callers that may not simulate their policies.
+	// Only describe actions can be probed.
+	PermissionsProbed = "DryRun"
+)
+
+// MissingPermissions returns which of the actions the credentials of cfg are
+// not allowed to perform, and how this was determined. The IAM policies of
+// the caller are simulated, falling back to dry-run requests when the
+// caller cannot be simulated, e.g. when not allowed
+// iam:SimulatePrincipalPolicy.
+func MissingPermissions(ctx context.Context, cfg *aws.Config, actions []string) ([]string, string, error) {
+	_, arn, err := GetCallerIdentity(ctx, cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	if principal, ok := principalARN(arn); ok {
+		missing, err := simulatePermissions(ctx, cfg, principal, actions)
+		if err == nil {
+			return missing, PermissionsSimulated, nil
+		}
+		if !errors.Is(err, ErrUnauthorized) && !errors.Is(err, ErrNotFound) {
+			return nil, "", err
+		}
+	}
+	missing, err := probePermissions(ctx, cfg, actions)
+	if err != nil {
+		return nil, "", err
+	}
+	return missing, PermissionsProbed, nil
+}
+
+// principalARN returns the IAM ARN of the caller to simulate. Assumed role
+// sessions are simulated as their role, which only resolves for roles
+// without a path.
+func principalARN(arn string) (string, bool) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 {
+		return "", false
+	}
+	switch {
+	case parts[2] == "iam" && strings.HasPrefix(parts[5], "user/"):
+		return arn, true
+	case parts[2] == "iam" && strings.HasPrefix(parts[5], "role/"):
+		return arn, true
+	case parts[2] == "sts" && strings.HasPrefix(parts[5], "assumed-role/"):
+		role := strings.SplitN(strings.TrimPrefix(parts[5], "assumed-role/"), "/", 2)[0]
+		return strings.Join([]string{parts[0], parts[1], "iam", "", parts[4], "role/" + role}, ":"), true
+	default:
+		return "", false
+	}
+}
+
+func simulatePermissions(ctx context.Context, cfg *aws.Config, principal string, actions []string) ([]string, error) {
+	svc := iam.New(withUserAgent(newBaseSession(cfg)))
+	missing := make([]string, 0)
+	err := svc.SimulatePrincipalPolicyPagesWithContext(ctx, &iam.SimulatePrincipalPolicyInput{
+		PolicySourceArn: aws.String(principal),
+		ActionNames:     aws.StringSlice(actions),
+	}, func(page *iam.SimulatePolicyResponse, lastPage bool) bool {
+		for _, r := range page.EvaluationResults {
+			if aws.StringValue(r.EvalDecision) != iam.PolicyEvaluationDecisionTypeAllowed {
+				missing = append(missing, aws.StringValue(r.EvalActionName))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// dryRunProbes make a dry-run request for each action that can be probed
+// without referring to existing resources.
+var dryRunProbes = map[string]func(context.Context, *ec2.EC2) error{
+	"ec2:DescribeImages": func(ctx context.Context, svc *ec2.EC2) error {
+		_, err := svc.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{DryRun: aws.Bool(true), Owners: aws.StringSlice([]string{"self"})})
+		return err
+	},
+	"ec2:DescribeInstances": func(ctx context.Context, svc *ec2.EC2) error {
+		_, err := svc.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{DryRun: aws.Bool(true)})
+		return err
+	},
+	"ec2:DescribeRegions": func(ctx context.Context, svc *ec2.EC2) error {
+		_, err := svc.DescribeRegionsWithContext(ctx, &ec2.DescribeRegionsInput{DryRun: aws.Bool(true)})
+		return err
+	},
+	"ec2:DescribeSubnets": func(ctx context.Context, svc *ec2.EC2) error {
+		_, err := svc.DescribeSubnetsWithContext(ctx, &ec2.DescribeSubnetsInput{DryRun: aws.Bool(true)})
+		return err
+	},
+	"ec2:DescribeVolumes": func(ctx context.Context, svc *ec2.EC2) error {
+		_, err := svc.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{DryRun: aws.Bool(true)})
+		return err
+	},
+}
+
+func probePermissions(ctx context.Context, cfg *aws.Config, actions []string) ([]string, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	missing := make([]string, 0)
+	for _, action := range actions {
+		probe, ok := dryRunProbes[action]
+		if !ok {
+			continue
+		}
+		err := probe(ctx, svc)
+		aerr, ok := err.(awserr.Error)
+		switch {
+		case err == nil, ok && aerr.Code() == "DryRunOperation":
+		case errors.Is(err, ErrUnauthorized):
+			missing = append(missing, action)
+		default:
+			return nil, err
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
@@ -0,0 +1,97 @@
+package aws
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/pricing"
+	"github.com/pkg/errors"
+)
+
+// pricingRegion is the region serving the AWS Pricing API.
+const pricingRegion = "us-east-1"
+
+// priceCacheTTL is how long a fetched price is used before it is looked up
+// again. On-demand prices change rarely.
+const priceCacheTTL = 24 * time.Hour
+
+type cachedPrice struct {
+	price   float64
+	fetched time.Time
+}
+
+var (
+	priceCacheMu sync.Mutex
+	priceCache   = make(map[string]cachedPrice)
+)
+
+// DescribeOnDemandPrice returns the hourly on-demand price in USD of a shared
+// tenancy instance type in the region. Prices are cached for priceCacheTTL.
+func DescribeOnDemandPrice(ctx context.Context, cfg *aws.Config, region, instanceType, operatingSystem string) (float64, error) {
+	key := region + "/" + instanceType + "/" + operatingSystem
+	priceCacheMu.Lock()
+	cached, ok := priceCache[key]
+	priceCacheMu.Unlock()
+	if ok && time.Since(cached.fetched) < priceCacheTTL {
+		return cached.price, nil
+	}
+	filters := map[string]string{
+		"regionCode":      region,
+		"instanceType":    instanceType,
+		"operatingSystem": operatingSystem,
+		"tenancy":         "Shared",
+		"preInstalledSw":  "NA",
+		"capacitystatus":  "Used",
+	}
+	input := &pricing.GetProductsInput{
+		ServiceCode: aws.String("AmazonEC2"),
+		MaxResults:  aws.Int64(1),
+	}
+	for k, v := range filters {
+		input.Filters = append(input.Filters, &pricing.Filter{
+			Type:  aws.String(pricing.FilterTypeTermMatch),
+			Field: aws.String(k),
+			Value: aws.String(v),
+		})
+	}
+	svc := pricing.New(newSession(cfg.Copy().WithRegion(pricingRegion), nil))
+	resp, err := svc.GetProductsWithContext(ctx, input)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.PriceList) == 0 {
+		return 0, errors.Errorf("cannot find price for instance type: %#v", instanceType)
+	}
+	price, err := parseOnDemandPrice(resp.PriceList[0])
+	if err != nil {
+		return 0, err
+	}
+	priceCacheMu.Lock()
+	priceCache[key] = cachedPrice{price: price, fetched: time.Now()}
+	priceCacheMu.Unlock()
+	return price, nil
+}
+
+// parseOnDemandPrice extracts the hourly USD price from a price list
+// product, which has the form:
+//
+//	{"terms": {"OnDemand": {"<offer>": {"priceDimensions": {"<rate>": {"pricePerUnit": {"USD": "0.0416"}}}}}}}
+func parseOnDemandPrice(product aws.JSONValue) (float64, error) {
+	terms, _ := product["terms"].(map[string]interface{})
+	onDemand, _ := terms["OnDemand"].(map[string]interface{})
+	for _, offer := range onDemand {
+		offer, _ := offer.(map[string]interface{})
+		dimensions, _ := offer["priceDimensions"].(map[string]interface{})
+		for _, d := range dimensions {
+			d, _ := d.(map[string]interface{})
+			ppu, _ := d["pricePerUnit"].(map[string]interface{})
+			if usd, ok := ppu["USD"].(string); ok {
+				return strconv.ParseFloat(usd, 64)
+			}
+		}
+	}
+	return 0, errors.New("cannot find on-demand USD price in price list")
+}
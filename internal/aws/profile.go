@@ -0,0 +1,49 @@
+package aws
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Profile is the shared config profile sessions are created from when set,
+// e.g. to run the controller locally with the credentials of a developer.
+// Profiles of the shared config file are supported, including SSO and
+// assumed role profiles. It is set once at startup with SetProfile.
+var Profile string
+
+// SetProfile makes sessions use the shared config profile and returns the
+// region of the profile, if any.
+func SetProfile(profile string) (string, error) {
+	Profile = profile
+	sess, err := session.NewSessionWithOptions(profileOptions(aws.NewConfig()))
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(sess.Config.Region), nil
+}
+
+// newProfileSession returns a session of the shared config Profile. The
+// requests of the session fail when the profile cannot be loaded. Requests
+// failing validation are not retried, so the error is classified here.
+func newProfileSession(cfg *aws.Config) *session.Session {
+	c := aws.NewConfig().WithHTTPClient(HTTPClient)
+	c.MergeIn(cfg)
+	sess, err := session.NewSessionWithOptions(profileOptions(c))
+	if err != nil {
+		sess = session.New(c)
+		sess.Handlers.Validate.PushFront(func(r *request.Request) {
+			r.Error = err
+			classifyError(r)
+		})
+	}
+	return sess
+}
+
+func profileOptions(cfg *aws.Config) session.Options {
+	return session.Options{
+		Config:            *cfg,
+		Profile:           Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+}
@@ -0,0 +1,139 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/servicequotas"
+	"github.com/pkg/errors"
+)
+
+// vcpuQuotaCodes are the Service Quotas codes of the running on-demand
+// instance vCPU limits, by instance class (the letters of the instance
+// family before the generation, e.g. "inf" for inf2).
+var vcpuQuotaCodes = map[string]string{
+	"a": "L-1216C47A", "c": "L-1216C47A", "d": "L-1216C47A", "h": "L-1216C47A",
+	"i": "L-1216C47A", "im": "L-1216C47A", "is": "L-1216C47A", "m": "L-1216C47A",
+	"r": "L-1216C47A", "t": "L-1216C47A", "z": "L-1216C47A",
+	"f":   "L-74FC7D96",
+	"g":   "L-DB2E81BA",
+	"vt":  "L-DB2E81BA",
+	"inf": "L-1945791B",
+	"p":   "L-417A185B",
+	"x":   "L-7295265B",
+}
+
+// instanceClass returns the letters of the instance type before the
+// generation number, e.g. "m" for m5.large.
+func instanceClass(instanceType string) string {
+	if i := strings.IndexAny(instanceType, "0123456789.-"); i >= 0 {
+		return instanceType[:i]
+	}
+	return instanceType
+}
+
+// VCPUQuota is the running on-demand vCPU limit of an instance class in a
+// region, and the vCPUs used by instances counting towards it.
+type VCPUQuota struct {
+	Code  string
+	Name  string
+	Limit int64
+	Usage int64
+}
+
+// quotaCacheTTL is how long a quota limit is cached. Limits change rarely,
+// usually after a requested increase.
+const quotaCacheTTL = 10 * time.Minute
+
+type cachedQuota struct {
+	name    string
+	limit   int64
+	fetched time.Time
+}
+
+var (
+	quotaCacheMu sync.Mutex
+	quotaCache   = make(map[string]cachedQuota)
+)
+
+// DescribeVCPUQuota returns the on-demand vCPU quota the instance type counts
+// towards and its current usage in the region. It returns nil when the
+// instance type has no known quota, or when Service Quotas cannot be
+// queried with the credentials, so that launches are not blocked by a
+// missing servicequotas:GetServiceQuota permission.
+func DescribeVCPUQuota(ctx context.Context, cfg *aws.Config, instanceType string) (*VCPUQuota, error) {
+	class := instanceClass(instanceType)
+	code, ok := vcpuQuotaCodes[class]
+	if !ok {
+		return nil, nil
+	}
+	// credentials differ between accounts, so are part of the key
+	key := fmt.Sprintf("%p/%s/%s", cfg.Credentials, aws.StringValue(cfg.Region), code)
+	quotaCacheMu.Lock()
+	q, ok := quotaCache[key]
+	quotaCacheMu.Unlock()
+	if !ok || time.Since(q.fetched) > quotaCacheTTL {
+		svc := servicequotas.New(newSession(cfg, servicequotasLimiter))
+		resp, err := svc.GetServiceQuotaWithContext(ctx, &servicequotas.GetServiceQuotaInput{
+			ServiceCode: aws.String("ec2"),
+			QuotaCode:   aws.String(code),
+		})
+		if err != nil {
+			if errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrNotFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		q = cachedQuota{
+			name:    aws.StringValue(resp.Quota.QuotaName),
+			limit:   int64(aws.Float64Value(resp.Quota.Value)),
+			fetched: time.Now(),
+		}
+		quotaCacheMu.Lock()
+		quotaCache[key] = q
+		quotaCacheMu.Unlock()
+	}
+	usage, err := runningOnDemandVCPUs(ctx, cfg, code)
+	if err != nil {
+		return nil, err
+	}
+	return &VCPUQuota{Code: code, Name: q.name, Limit: q.limit, Usage: usage}, nil
+}
+
+// runningOnDemandVCPUs returns the vCPUs of the pending and running
+// on-demand instances in the region counting towards the quota.
+func runningOnDemandVCPUs(ctx context.Context, cfg *aws.Config, code string) (int64, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	var total int64
+	err := svc.DescribeInstancesPagesWithContext(ctx, &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice([]string{ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning}),
+		}},
+	}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, r := range page.Reservations {
+			for _, i := range r.Instances {
+				// spot and scheduled instances have separate quotas
+				if i.InstanceLifecycle != nil || vcpuQuotaCodes[instanceClass(aws.StringValue(i.InstanceType))] != code {
+					continue
+				}
+				if i.CpuOptions != nil {
+					total += aws.Int64Value(i.CpuOptions.CoreCount) * aws.Int64Value(i.CpuOptions.ThreadsPerCore)
+				}
+			}
+		}
+		return true
+	})
+	return total, err
+}
+
+// IsQuotaError returns true if a launch failed because it would exceed the
+// vCPU or instance limit of the account.
+func IsQuotaError(err error) bool {
+	return errors.Is(err, ErrQuotaExceeded)
+}
@@ -0,0 +1,134 @@
+package aws
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"golang.org/x/time/rate"
+)
+
+// Client-side rate limits for AWS API requests, shared by every request to
+// the service made by the controller in a region. They are unlimited by
+// default.
+var (
+	ec2Limiter           = newRegionLimiters(0, 0)
+	autoscalingLimiter   = newRegionLimiters(0, 0)
+	cloudwatchLimiter    = newRegionLimiters(0, 0)
+	servicequotasLimiter = newRegionLimiters(0, 0)
+
+	// statusLimiter limits the requests made to refresh the status of
+	// machines, see WithStatusBudget.
+	statusLimiter = newRegionLimiters(0, 0)
+)
+
+// SetEC2RateLimit limits EC2 API requests to qps with the given burst in
+// each region. A qps of zero or less disables the limit. It must be called
+// before any requests are made.
+func SetEC2RateLimit(qps float64, burst int) {
+	ec2Limiter = newRegionLimiters(qps, burst)
+}
+
+// SetAutoscalingRateLimit limits Auto Scaling API requests to qps with the
+// given burst in each region. A qps of zero or less disables the limit. It
+// must be called before any requests are made.
+func SetAutoscalingRateLimit(qps float64, burst int) {
+	autoscalingLimiter = newRegionLimiters(qps, burst)
+}
+
+// SetCloudWatchRateLimit limits CloudWatch API requests to qps with the
+// given burst in each region. A qps of zero or less disables the limit. It
+// must be called before any requests are made.
+func SetCloudWatchRateLimit(qps float64, burst int) {
+	cloudwatchLimiter = newRegionLimiters(qps, burst)
+}
+
+// SetServiceQuotasRateLimit limits Service Quotas API requests to qps with
+// the given burst in each region. A qps of zero or less disables the limit.
+// It must be called before any requests are made.
+func SetServiceQuotasRateLimit(qps float64, burst int) {
+	servicequotasLimiter = newRegionLimiters(qps, burst)
+}
+
+// SetStatusRateLimit limits the requests made with a context returned by
+// WithStatusBudget to qps with the given burst in each region, across all
+// services. A qps of zero or less disables the limit. It must be called
+// before any requests are made.
+func SetStatusRateLimit(qps float64, burst int) {
+	statusLimiter = newRegionLimiters(qps, burst)
+}
+
+type statusBudgetKey struct{}
+
+// WithStatusBudget returns a context whose requests wait on the status rate
+// limit instead of the rate limit of their service, so that refreshing the
+// status of many machines cannot use up the requests available for
+// launching and terminating instances.
+func WithStatusBudget(ctx context.Context) context.Context {
+	return context.WithValue(ctx, statusBudgetKey{}, true)
+}
+
+// regionLimiters holds a limiter per region, since AWS applies its request
+// limits to each region separately and a busy region should not slow down
+// requests to the others.
+type regionLimiters struct {
+	qps   float64
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func newRegionLimiters(qps float64, burst int) *regionLimiters {
+	return &regionLimiters{qps: qps, burst: burst, limiters: make(map[string]*rate.Limiter)}
+}
+
+// get returns the limiter of the region, creating it on first use.
+func (l *regionLimiters) get(region string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lim, ok := l.limiters[region]; ok {
+		return lim
+	}
+	lim := newLimiter(l.qps, l.burst)
+	l.limiters[region] = lim
+	return lim
+}
+
+func newLimiter(qps float64, burst int) *rate.Limiter {
+	if qps <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(qps), burst)
+}
+
+// newSession returns a session whose requests wait on the limiter of the
+// configured region, or the status limiter of the region for requests made
+// with a status budget, before being sent, and whose throttled requests are
+// recorded. Services without a rate limit of their own pass a nil l, so
+// that their requests do not use up the budget of another service.
+func newSession(cfg *aws.Config, l *regionLimiters) *session.Session {
+	sess := newBaseSession(cfg)
+	region := aws.StringValue(sess.Config.Region)
+	sess.Handlers.Send.PushFront(func(r *request.Request) {
+		var lim *rate.Limiter
+		if status, _ := r.Context().Value(statusBudgetKey{}).(bool); status {
+			lim = statusLimiter.get(region)
+		} else if l != nil {
+			lim = l.get(region)
+		}
+		if lim == nil {
+			return
+		}
+		if err := lim.Wait(r.Context()); err != nil {
+			r.Error = err
+		}
+	})
+	sess.Handlers.Retry.PushBack(recordThrottle)
+	return withUserAgent(sess)
+}
@@ -0,0 +1,72 @@
+package aws
+
+import (
+	"context"
+	"net"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// SubnetRoutesTo returns true if the route table of the subnet has an active
+// route to the IP address. Routes to prefix lists are assumed to match,
+// since their entries are not resolved. Network ACLs and security groups
+// are not evaluated.
+func SubnetRoutesTo(ctx context.Context, cfg *aws.Config, subnet *ec2.Subnet, ip net.IP) (bool, error) {
+	rt, err := subnetRouteTable(ctx, ec2.New(newSession(cfg, ec2Limiter)), subnet)
+	if err != nil || rt == nil {
+		return false, err
+	}
+	for _, route := range rt.Routes {
+		if aws.StringValue(route.State) != ec2.RouteStateActive {
+			continue
+		}
+		if route.DestinationPrefixListId != nil {
+			return true, nil
+		}
+		cidr := aws.StringValue(route.DestinationCidrBlock)
+		if ip.To4() == nil {
+			cidr = aws.StringValue(route.DestinationIpv6CidrBlock)
+		}
+		if _, n, err := net.ParseCIDR(cidr); err == nil && n.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// subnetRouteTable returns the route table explicitly associated with the
+// subnet, or else the main route table of its VPC.
+func subnetRouteTable(ctx context.Context, svc *ec2.EC2, subnet *ec2.Subnet) (*ec2.RouteTable, error) {
+	resp, err := svc.DescribeRouteTablesWithContext(ctx, &ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{{
+			Name:   aws.String("association.subnet-id"),
+			Values: []*string{subnet.SubnetId},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.RouteTables) != 0 {
+		return resp.RouteTables[0], nil
+	}
+	resp, err = svc.DescribeRouteTablesWithContext(ctx, &ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: []*string{subnet.VpcId},
+			},
+			{
+				Name:   aws.String("association.main"),
+				Values: aws.StringSlice([]string{"true"}),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.RouteTables) == 0 {
+		return nil, nil
+	}
+	return resp.RouteTables[0], nil
+}
@@ -0,0 +1,170 @@
+package aws
+
+import (
+	"context"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+)
+
+// partitionDefaultRegions are regions enabled by default for every account in
+// a partition, used to query region status when the target region itself may
+// not be usable.
+var partitionDefaultRegions = map[string]string{
+	endpoints.AwsPartitionID:      endpoints.UsEast1RegionID,
+	endpoints.AwsCnPartitionID:    endpoints.CnNorth1RegionID,
+	endpoints.AwsUsGovPartitionID: endpoints.UsGovWest1RegionID,
+}
+
+// DescribeRegions returns all regions in the partition of the configured
+// region, including those that are not enabled for the account.
+func DescribeRegions(ctx context.Context, cfg *aws.Config) ([]*ec2.Region, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.DescribeRegionsWithContext(ctx, &ec2.DescribeRegionsInput{
+		AllRegions: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Regions, nil
+}
+
+// EnabledRegions returns the sorted names of the regions enabled for the
+// account.
+func EnabledRegions(ctx context.Context, cfg *aws.Config) ([]string, error) {
+	regions, err := DescribeRegions(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, r := range regions {
+		if aws.StringValue(r.OptInStatus) == "not-opted-in" {
+			continue
+		}
+		names = append(names, aws.StringValue(r.RegionName))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// IsRegionOptInError returns true if the error could have been caused by
+// calling an API in a region that is not enabled for the account. AWS does
+// not return a specific error for this, so RegionRequiresOptIn should be used
+// to confirm.
+func IsRegionOptInError(err error) bool {
+	if aerr, ok := errors.Cause(err).(awserr.Error); ok {
+		switch aerr.Code() {
+		case "OptInRequired", "AuthFailure", "UnrecognizedClientException":
+			return true
+		}
+	}
+	return false
+}
+
+// RegionRequiresOptIn returns true if the given region exists but has not
+// been enabled for the account. The region status is queried from the
+// default region of the partition, since the region itself will reject
+// requests.
+func RegionRequiresOptIn(ctx context.Context, cfg *aws.Config, region string) (bool, error) {
+	p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
+	if !ok {
+		return false, errors.Errorf("cannot find partition for region: %#v", region)
+	}
+	defaultRegion, ok := partitionDefaultRegions[p.ID()]
+	if !ok {
+		return false, errors.Errorf("cannot find default region for partition: %#v", p.ID())
+	}
+	regions, err := DescribeRegions(ctx, cfg.Copy().WithRegion(defaultRegion))
+	if err != nil {
+		return false, err
+	}
+	for _, r := range regions {
+		if aws.StringValue(r.RegionName) == region {
+			return aws.StringValue(r.OptInStatus) == "not-opted-in", nil
+		}
+	}
+	return false, nil
+}
+
+// AvailableZones returns the names of the availability zones of the region
+// of cfg that are available, excluding local and wavelength zones.
+func AvailableZones(ctx context.Context, cfg *aws.Config) ([]string, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	resp, err := svc.DescribeAvailabilityZonesWithContext(ctx, &ec2.DescribeAvailabilityZonesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("state"),
+				Values: aws.StringSlice([]string{ec2.AvailabilityZoneStateAvailable}),
+			},
+			{
+				Name:   aws.String("zone-type"),
+				Values: aws.StringSlice([]string{"availability-zone"}),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	zones := make([]string, 0, len(resp.AvailabilityZones))
+	for _, az := range resp.AvailabilityZones {
+		zones = append(zones, aws.StringValue(az.ZoneName))
+	}
+	return zones, nil
+}
+
+// ValidateRegion returns a configuration error if the region is not known
+// to any partition of the SDK, e.g. because of a typo. Regions launched
+// after the SDK was released are rejected until it is updated.
+func ValidateRegion(region string) error {
+	if _, ok := partitionRegion(region); !ok {
+		return NewConfigurationError("region %q is not a known AWS region", region)
+	}
+	return nil
+}
+
+// ValidateAvailabilityZone returns a configuration error if the zone does
+// not belong to a region known to the SDK, or, when region is set, does not
+// belong to region. Zones are the region followed by a letter, or by the
+// name of a local or wavelength zone.
+func ValidateAvailabilityZone(zone, region string) error {
+	zoneRegion, ok := ZoneRegion(zone)
+	if !ok {
+		return NewConfigurationError("availability zone %q is not in a known AWS region", zone)
+	}
+	if region != "" && zoneRegion != region {
+		return NewConfigurationError("availability zone %q is not in region %q", zone, region)
+	}
+	return nil
+}
+
+// ZoneRegion returns the region known to the SDK that the zone belongs to.
+func ZoneRegion(zone string) (string, bool) {
+	if n := len(zone); n > 1 && zone[n-1] >= 'a' && zone[n-1] <= 'z' {
+		if _, ok := partitionRegion(zone[:n-1]); ok {
+			return zone[:n-1], true
+		}
+	}
+	// local and wavelength zones, e.g. us-west-2-lax-1a
+	for i, c := range zone {
+		if c != '-' || i == len(zone)-1 {
+			continue
+		}
+		if _, ok := partitionRegion(zone[:i]); ok {
+			return zone[:i], true
+		}
+	}
+	return "", false
+}
+
+func partitionRegion(region string) (endpoints.Region, bool) {
+	for _, p := range endpoints.DefaultPartitions() {
+		if r, ok := p.Regions()[region]; ok {
+			return r, true
+		}
+	}
+	return endpoints.Region{}, false
+}
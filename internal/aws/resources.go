@@ -0,0 +1,151 @@
+package aws
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+)
+
+// Kinds of resources created alongside instances.
+const (
+	ResourceVolume           = "volume"
+	ResourceNetworkInterface = "network-interface"
+	ResourceElasticIP        = "elastic-ip"
+)
+
+// OwnedResource is a resource tagged as belonging to a machine that may
+// outlive its instance, e.g. volumes not marked DeleteOnTermination.
+type OwnedResource struct {
+	Kind string
+	ID   string
+
+	// InUse is true while the resource is attached or associated and
+	// cannot be deleted yet.
+	InUse bool
+}
+
+// DescribeOwnedResources returns the volumes, network interfaces and
+// elastic IPs with the tag.
+func DescribeOwnedResources(ctx context.Context, cfg *aws.Config, key, value string) ([]OwnedResource, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	filters := []*ec2.Filter{
+		{
+			Name:   aws.String("tag:" + key),
+			Values: aws.StringSlice([]string{value}),
+		},
+	}
+	resources := make([]OwnedResource, 0)
+	vinput := &ec2.DescribeVolumesInput{Filters: filters}
+	for {
+		resp, err := svc.DescribeVolumesWithContext(ctx, vinput)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range resp.Volumes {
+			if aws.StringValue(v.State) == ec2.VolumeStateDeleting || aws.StringValue(v.State) == ec2.VolumeStateDeleted {
+				continue
+			}
+			resources = append(resources, OwnedResource{
+				Kind:  ResourceVolume,
+				ID:    aws.StringValue(v.VolumeId),
+				InUse: aws.StringValue(v.State) != ec2.VolumeStateAvailable,
+			})
+		}
+		if aws.StringValue(resp.NextToken) == "" {
+			break
+		}
+		vinput.NextToken = resp.NextToken
+	}
+	ninput := &ec2.DescribeNetworkInterfacesInput{Filters: filters}
+	for {
+		resp, err := svc.DescribeNetworkInterfacesWithContext(ctx, ninput)
+		if err != nil {
+			return nil, err
+		}
+		for _, ni := range resp.NetworkInterfaces {
+			resources = append(resources, OwnedResource{
+				Kind:  ResourceNetworkInterface,
+				ID:    aws.StringValue(ni.NetworkInterfaceId),
+				InUse: aws.StringValue(ni.Status) != ec2.NetworkInterfaceStatusAvailable,
+			})
+		}
+		if aws.StringValue(resp.NextToken) == "" {
+			break
+		}
+		ninput.NextToken = resp.NextToken
+	}
+	resp, err := svc.DescribeAddressesWithContext(ctx, &ec2.DescribeAddressesInput{Filters: filters})
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range resp.Addresses {
+		resources = append(resources, OwnedResource{
+			Kind:  ResourceElasticIP,
+			ID:    aws.StringValue(a.AllocationId),
+			InUse: a.AssociationId != nil,
+		})
+	}
+	return resources, nil
+}
+
+// DeleteOwnedResource deletes the volume or network interface, or releases
+// the elastic IP. Resources that no longer exist are not an error.
+func DeleteOwnedResource(ctx context.Context, cfg *aws.Config, r OwnedResource) error {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	var err error
+	switch r.Kind {
+	case ResourceVolume:
+		_, err = svc.DeleteVolumeWithContext(ctx, &ec2.DeleteVolumeInput{
+			VolumeId: aws.String(r.ID),
+		})
+	case ResourceNetworkInterface:
+		_, err = svc.DeleteNetworkInterfaceWithContext(ctx, &ec2.DeleteNetworkInterfaceInput{
+			NetworkInterfaceId: aws.String(r.ID),
+		})
+	case ResourceElasticIP:
+		_, err = svc.ReleaseAddressWithContext(ctx, &ec2.ReleaseAddressInput{
+			AllocationId: aws.String(r.ID),
+		})
+	default:
+		return errors.Errorf("unknown resource kind: %q", r.Kind)
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// AttachedNetworkInterfaces returns the network interfaces still attached to
+// the instance. Interfaces of terminated instances remain attached while
+// they are detaching, which can take minutes, and block deleting their
+// subnet until released.
+func AttachedNetworkInterfaces(ctx context.Context, cfg *aws.Config, instanceID string) ([]string, error) {
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	input := &ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("attachment.instance-id"),
+				Values: aws.StringSlice([]string{instanceID}),
+			},
+		},
+	}
+	ids := make([]string, 0)
+	for {
+		resp, err := svc.DescribeNetworkInterfacesWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, ni := range resp.NetworkInterfaces {
+			if aws.StringValue(ni.Status) == ec2.NetworkInterfaceStatusAvailable {
+				continue
+			}
+			ids = append(ids, aws.StringValue(ni.NetworkInterfaceId))
+		}
+		if aws.StringValue(resp.NextToken) == "" {
+			return ids, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
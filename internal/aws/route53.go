@@ -5,7 +5,6 @@ import (
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/route53"
 	"github.com/pkg/errors"
 	"golang.org/x/time/rate"
@@ -19,32 +18,82 @@ type Route53Client struct {
 
 func NewRoute53Client(cfg *aws.Config) *Route53Client {
 	return &Route53Client{
-		Route53: route53.New(session.New(cfg)),
+		Route53: route53.New(withUserAgent(newBaseSession(cfg))),
 		limit:   rate.NewLimiter(5, 5),
 	}
 }
 
-func (r *Route53Client) LookupZoneID(ctx context.Context, name string) (string, error) {
-	zones := make(map[string]string)
+// LookupZoneID returns the hosted zone of the longest domain containing the
+// name. Only private zones are considered when private is set, and of those
+// only zones associated with the VPC when vpcID is set. Only public zones
+// are considered otherwise, so that public and private zones of the same
+// domain are not confused.
+func (r *Route53Client) LookupZoneID(ctx context.Context, name string, private bool, vpcID string) (string, error) {
+	candidates := make([]*route53.HostedZone, 0)
 	if err := r.ListHostedZonesPagesWithContext(ctx, &route53.ListHostedZonesInput{}, func(page *route53.ListHostedZonesOutput, lastPage bool) bool {
 		for _, zone := range page.HostedZones {
-			zones[strings.TrimSuffix(aws.StringValue(zone.Name), ".")] = strings.TrimPrefix(aws.StringValue(zone.Id), "/hostedzone/")
+			if zone.Config != nil && aws.BoolValue(zone.Config.PrivateZone) != private {
+				continue
+			}
+			domain := strings.TrimSuffix(aws.StringValue(zone.Name), ".")
+			if !strings.HasSuffix(name, "."+domain) {
+				continue
+			}
+			candidates = append(candidates, zone)
 		}
 		return !lastPage
 	}); err != nil {
 		return "", err
 	}
-	parts := strings.SplitAfterN(name, ".", 2)
-	if len(parts) != 2 {
-		return "", errors.Errorf("invalid name: %#v", name)
+	var best string
+	var bestLen int
+	for _, zone := range candidates {
+		id := strings.TrimPrefix(aws.StringValue(zone.Id), "/hostedzone/")
+		if private && vpcID != "" {
+			ok, err := r.IsAssociated(ctx, id, vpcID)
+			if err != nil {
+				return "", err
+			}
+			if !ok {
+				continue
+			}
+		}
+		n := len(aws.StringValue(zone.Name))
+		switch {
+		case n > bestLen:
+			best, bestLen = id, n
+		case n == bestLen:
+			return "", errors.Errorf("multiple hosted zones match name %#v: %s, %s", name, best, id)
+		}
 	}
-	zone, ok := zones[parts[1]]
-	if !ok {
+	if best == "" {
 		return "", errors.Errorf("cannot determine HostedZoneId for name: %#v", name)
 	}
-	return zone, nil
+	return best, nil
+}
+
+// IsAssociated returns true if the hosted zone is public, or a private zone
+// associated with the VPC.
+func (r *Route53Client) IsAssociated(ctx context.Context, hostedZoneID, vpcID string) (bool, error) {
+	resp, err := r.GetHostedZoneWithContext(ctx, &route53.GetHostedZoneInput{
+		Id: aws.String(hostedZoneID),
+	})
+	if err != nil {
+		return false, err
+	}
+	if resp.HostedZone.Config == nil || !aws.BoolValue(resp.HostedZone.Config.PrivateZone) {
+		return true, nil
+	}
+	for _, vpc := range resp.VPCs {
+		if aws.StringValue(vpc.VPCId) == vpcID {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
+// List returns the addresses of the simple A record with the given name.
+// Weighted and multi-value record sets of the name are not included.
 func (r *Route53Client) List(ctx context.Context, hostedZoneID, name string) ([]string, error) {
 	addrs := make([]string, 0)
 	if err := r.ListResourceRecordSetsPagesWithContext(ctx, &route53.ListResourceRecordSetsInput{
@@ -55,6 +104,9 @@ func (r *Route53Client) List(ctx context.Context, hostedZoneID, name string) ([]
 			if strings.TrimSuffix(aws.StringValue(rs.Name), ".") != name {
 				return false
 			}
+			if rs.SetIdentifier != nil {
+				continue
+			}
 			for _, rr := range rs.ResourceRecords {
 				addrs = append(addrs, aws.StringValue(rr.Value))
 			}
@@ -66,13 +118,51 @@ func (r *Route53Client) List(ctx context.Context, hostedZoneID, name string) ([]
 	return addrs, nil
 }
 
-func (r *Route53Client) Update(ctx context.Context, hostedZoneID, name string, addrs []string) error {
+// RecordRouting is the routing policy of a record set. The zero value is a
+// simple record.
+type RecordRouting struct {
+	// SetIdentifier distinguishes record sets with the same name, and is
+	// required for weighted and multi-value records.
+	SetIdentifier string
+
+	// Weight makes the record set weighted.
+	Weight *int64
+
+	// MultiValue makes the record set a multi-value answer.
+	MultiValue bool
+
+	// HealthCheckID is the health check that determines whether the record
+	// set is returned.
+	HealthCheckID string
+}
+
+// Update creates or replaces the A record set with the given name and
+// routing.
+func (r *Route53Client) Update(ctx context.Context, hostedZoneID, name string, addrs []string, routing RecordRouting) error {
 	records := make([]*route53.ResourceRecord, 0)
 	for _, addr := range addrs {
 		records = append(records, &route53.ResourceRecord{
 			Value: aws.String(addr)},
 		)
 	}
+	rrset := &route53.ResourceRecordSet{
+		Name:            aws.String(name),
+		ResourceRecords: records,
+		TTL:             aws.Int64(60),
+		Type:            aws.String("A"),
+	}
+	if routing.SetIdentifier != "" {
+		rrset.SetIdentifier = aws.String(routing.SetIdentifier)
+	}
+	if routing.Weight != nil {
+		rrset.Weight = routing.Weight
+	}
+	if routing.MultiValue {
+		rrset.MultiValueAnswer = aws.Bool(true)
+	}
+	if routing.HealthCheckID != "" {
+		rrset.HealthCheckId = aws.String(routing.HealthCheckID)
+	}
 	if err := r.limit.Wait(ctx); err != nil {
 		return err
 	}
@@ -80,13 +170,8 @@ func (r *Route53Client) Update(ctx context.Context, hostedZoneID, name string, a
 		ChangeBatch: &route53.ChangeBatch{
 			Changes: []*route53.Change{
 				{
-					Action: aws.String("UPSERT"),
-					ResourceRecordSet: &route53.ResourceRecordSet{
-						Name:            aws.String(name),
-						ResourceRecords: records,
-						TTL:             aws.Int64(60),
-						Type:            aws.String("A"),
-					},
+					Action:            aws.String("UPSERT"),
+					ResourceRecordSet: rrset,
 				},
 			},
 		},
@@ -102,3 +187,147 @@ func ParseDomain(name string) (string, error) {
 	}
 	return parts[1], nil
 }
+
+// Delete deletes the A record set with the given name and set identifier,
+// if it exists. An empty set identifier deletes the simple record.
+func (r *Route53Client) Delete(ctx context.Context, hostedZoneID, name, setIdentifier string) error {
+	var rrset *route53.ResourceRecordSet
+	if err := r.ListResourceRecordSetsPagesWithContext(ctx, &route53.ListResourceRecordSetsInput{
+		HostedZoneId:    aws.String(hostedZoneID),
+		StartRecordName: aws.String(name),
+		StartRecordType: aws.String("A"),
+	}, func(page *route53.ListResourceRecordSetsOutput, lastPage bool) bool {
+		for _, rs := range page.ResourceRecordSets {
+			if strings.TrimSuffix(aws.StringValue(rs.Name), ".") != name || aws.StringValue(rs.Type) != "A" {
+				return false
+			}
+			if aws.StringValue(rs.SetIdentifier) == setIdentifier {
+				rrset = rs
+				return false
+			}
+		}
+		return !lastPage
+	}); err != nil {
+		return err
+	}
+	if rrset == nil {
+		return nil
+	}
+	if err := r.limit.Wait(ctx); err != nil {
+		return err
+	}
+	_, err := r.ChangeResourceRecordSetsWithContext(ctx, &route53.ChangeResourceRecordSetsInput{
+		ChangeBatch: &route53.ChangeBatch{
+			Changes: []*route53.Change{
+				{
+					Action:            aws.String("DELETE"),
+					ResourceRecordSet: rrset,
+				},
+			},
+		},
+		HostedZoneId: aws.String(hostedZoneID),
+	})
+	return err
+}
+
+// EnsureHealthCheck creates a health check of the address, returning the
+// health check already created with the same caller reference.
+func (r *Route53Client) EnsureHealthCheck(ctx context.Context, callerReference, addr, checkType string, port int64, resourcePath string) (string, error) {
+	cfg := &route53.HealthCheckConfig{
+		IPAddress: aws.String(addr),
+		Port:      aws.Int64(port),
+		Type:      aws.String(checkType),
+	}
+	if resourcePath != "" && checkType != route53.HealthCheckTypeTcp {
+		cfg.ResourcePath = aws.String(resourcePath)
+	}
+	if err := r.limit.Wait(ctx); err != nil {
+		return "", err
+	}
+	resp, err := r.CreateHealthCheckWithContext(ctx, &route53.CreateHealthCheckInput{
+		CallerReference:   aws.String(callerReference),
+		HealthCheckConfig: cfg,
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(resp.HealthCheck.Id), nil
+}
+
+// healthyCheckerRatio is the share of Route53 health checkers that must
+// report an endpoint healthy for Route53 to consider it healthy.
+const healthyCheckerRatio = 0.18
+
+// HealthCheckHealthy returns true if enough Route53 health checkers report
+// the endpoint of the health check healthy. Health checks without
+// observations yet are unhealthy.
+func (r *Route53Client) HealthCheckHealthy(ctx context.Context, id string) (bool, error) {
+	resp, err := r.GetHealthCheckStatusWithContext(ctx, &route53.GetHealthCheckStatusInput{
+		HealthCheckId: aws.String(id),
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(resp.HealthCheckObservations) == 0 {
+		return false, nil
+	}
+	healthy := 0
+	for _, o := range resp.HealthCheckObservations {
+		if o.StatusReport != nil && strings.HasPrefix(aws.StringValue(o.StatusReport.Status), "Success") {
+			healthy++
+		}
+	}
+	return float64(healthy)/float64(len(resp.HealthCheckObservations)) > healthyCheckerRatio, nil
+}
+
+// DeleteHealthCheck deletes the health check, if it exists.
+func (r *Route53Client) DeleteHealthCheck(ctx context.Context, id string) error {
+	if err := r.limit.Wait(ctx); err != nil {
+		return err
+	}
+	_, err := r.DeleteHealthCheckWithContext(ctx, &route53.DeleteHealthCheckInput{
+		HealthCheckId: aws.String(id),
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// AddAddress adds the address to the simple A record with the given name, keeping
+// the addresses already in the record.
+func (r *Route53Client) AddAddress(ctx context.Context, hostedZoneID, name, addr string) error {
+	addrs, err := r.List(ctx, hostedZoneID, name)
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if a == addr {
+			return nil
+		}
+	}
+	return r.Update(ctx, hostedZoneID, name, append(addrs, addr), RecordRouting{})
+}
+
+// RemoveAddress removes the address from the simple A record with the given name,
+// deleting the record when no addresses remain.
+func (r *Route53Client) RemoveAddress(ctx context.Context, hostedZoneID, name, addr string) error {
+	addrs, err := r.List(ctx, hostedZoneID, name)
+	if err != nil {
+		return err
+	}
+	remaining := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		if a != addr {
+			remaining = append(remaining, a)
+		}
+	}
+	switch {
+	case len(remaining) == len(addrs):
+		return nil
+	case len(remaining) == 0:
+		return r.Delete(ctx, hostedZoneID, name, "")
+	default:
+		return r.Update(ctx, hostedZoneID, name, remaining, RecordRouting{})
+	}
+}
@@ -0,0 +1,29 @@
+package aws
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+)
+
+// PutObject writes the object to the bucket, which may be in a region other
+// than the region of the config.
+func PutObject(ctx context.Context, cfg *aws.Config, bucket, key, contentType string, body []byte) error {
+	sess := withUserAgent(newBaseSession(cfg))
+	region, err := s3manager.GetBucketRegion(ctx, sess, bucket, aws.StringValue(sess.Config.Region))
+	if err != nil {
+		return errors.Wrapf(err, "cannot determine region of bucket %s", bucket)
+	}
+	svc := s3.New(sess, &aws.Config{Region: aws.String(region)})
+	_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+		Body:        bytes.NewReader(body),
+	})
+	return err
+}
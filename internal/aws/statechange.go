@@ -0,0 +1,92 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+// instanceStateChangeDetailType is the detail-type of the EventBridge
+// events sent when an instance changes state.
+const instanceStateChangeDetailType = "EC2 Instance State-change Notification"
+
+// InstanceStateChange is an instance changing state, as received from an
+// EventBridge rule delivering to an SQS queue.
+type InstanceStateChange struct {
+	Region     string
+	InstanceID string
+	State      string
+}
+
+// instanceStateChangeEvent is the EventBridge event of an instance state
+// change.
+type instanceStateChangeEvent struct {
+	DetailType string `json:"detail-type"`
+	Region     string `json:"region"`
+	Detail     struct {
+		InstanceID string `json:"instance-id"`
+		State      string `json:"state"`
+	} `json:"detail"`
+}
+
+// ParseQueueRegion returns the region of an SQS queue URL, e.g.
+// https://sqs.us-east-1.amazonaws.com/123456789012/queue.
+func ParseQueueRegion(queueURL string) (string, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(u.Hostname(), ".")
+	if len(parts) < 3 || parts[0] != "sqs" {
+		return "", errors.Errorf("cannot find region in SQS queue URL: %q", queueURL)
+	}
+	return parts[1], nil
+}
+
+// ReceiveInstanceStateChanges waits up to 20 seconds for instance state
+// change events on the queue. Received messages are deleted, including
+// messages that are not instance state changes.
+func ReceiveInstanceStateChanges(ctx context.Context, cfg *aws.Config, queueURL string) ([]InstanceStateChange, error) {
+	svc := sqs.New(withUserAgent(newBaseSession(cfg)))
+	resp, err := svc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(queueURL),
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds:     aws.Int64(20),
+	})
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]InstanceStateChange, 0)
+	entries := make([]*sqs.DeleteMessageBatchRequestEntry, 0)
+	for _, msg := range resp.Messages {
+		entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+			Id:            msg.MessageId,
+			ReceiptHandle: msg.ReceiptHandle,
+		})
+		var e instanceStateChangeEvent
+		if err := json.Unmarshal([]byte(aws.StringValue(msg.Body)), &e); err != nil {
+			continue
+		}
+		if e.DetailType != instanceStateChangeDetailType || e.Detail.InstanceID == "" {
+			continue
+		}
+		changes = append(changes, InstanceStateChange{
+			Region:     e.Region,
+			InstanceID: e.Detail.InstanceID,
+			State:      e.Detail.State,
+		})
+	}
+	if len(entries) == 0 {
+		return changes, nil
+	}
+	_, err = svc.DeleteMessageBatchWithContext(ctx, &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(queueURL),
+		Entries:  entries,
+	})
+	return changes, err
+}
@@ -0,0 +1,221 @@
+package aws
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Terminator coalesces the terminations of instances into fewer
+// TerminateInstances calls. Batching is disabled when nil.
+var Terminator *TerminateBatcher
+
+var terminationsPending = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "mapa_terminations_pending",
+	Help: "Number of instances queued for termination in a batch that has not been submitted.",
+}, func() float64 {
+	if Terminator == nil {
+		return 0
+	}
+	return float64(Terminator.Pending())
+})
+
+func init() {
+	metrics.Registry.MustRegister(terminationsPending)
+}
+
+// maxTerminateBatch is the most instance IDs TerminateInstances accepts.
+const maxTerminateBatch = 1000
+
+// terminateLedgerTTL is how long a submitted termination is remembered, so
+// that reconciles made before the instance leaves the running state do not
+// submit it again.
+const terminateLedgerTTL = 10 * time.Minute
+
+// TerminateBatcher collects the instances terminated within a window and
+// terminates those in the same region with the same credentials in a single
+// call. Unlike launches, terminations do not wait for their batch: the
+// ledger records each instance queued or submitted, so that the reconciles
+// of deleted machines can requeue until the instance state changes, and the
+// error of a failed termination is returned on the next attempt. Since the
+// state of the instances is kept by EC2, terminations interrupted by a
+// restart of the controller are resumed by submitting them again. Batches
+// already queued are still submitted when the controller shuts down, see
+// Inflight.
+type TerminateBatcher struct {
+	Window time.Duration
+
+	mu      sync.Mutex
+	batches map[string]*terminateBatch
+	ledger  map[string]*terminateEntry
+}
+
+func NewTerminateBatcher(window time.Duration) *TerminateBatcher {
+	return &TerminateBatcher{
+		Window:  window,
+		batches: make(map[string]*terminateBatch),
+		ledger:  make(map[string]*terminateEntry),
+	}
+}
+
+type terminateBatch struct {
+	cfg *aws.Config
+	ids []string
+}
+
+type terminateEntry struct {
+	submitted time.Time
+	err       error
+}
+
+// Pending returns the number of instances waiting for their batch to be
+// submitted.
+func (b *TerminateBatcher) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, e := range b.ledger {
+		if e.submitted.IsZero() {
+			n++
+		}
+	}
+	return n
+}
+
+// terminate queues the instance for termination unless it is already
+// queued or was recently submitted. The error of a failed termination is
+// returned once, after which the instance may be queued again. Nothing is
+// queued when ctx is done, but once queued the batch is submitted
+// regardless of ctx, since other terminations wait on it.
+func (b *TerminateBatcher) terminate(ctx context.Context, cfg *aws.Config, instanceID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key, err := terminateKey(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune()
+	if e, ok := b.ledger[instanceID]; ok {
+		if e.err != nil {
+			delete(b.ledger, instanceID)
+			return e.err
+		}
+		return nil
+	}
+	batch, ok := b.batches[key]
+	if !ok {
+		batch = &terminateBatch{cfg: cfg}
+		b.batches[key] = batch
+		Inflight.hold()
+		time.AfterFunc(b.Window, func() { b.flush(key, batch) })
+	}
+	batch.ids = append(batch.ids, instanceID)
+	b.ledger[instanceID] = &terminateEntry{}
+	trace.SpanFromContext(ctx).AddEvent("queued for termination batch")
+	if len(batch.ids) >= maxTerminateBatch {
+		delete(b.batches, key)
+		go b.run(batch)
+	}
+	return nil
+}
+
+// prune forgets submitted terminations older than terminateLedgerTTL.
+func (b *TerminateBatcher) prune() {
+	for id, e := range b.ledger {
+		if !e.submitted.IsZero() && e.err == nil && time.Since(e.submitted) > terminateLedgerTTL {
+			delete(b.ledger, id)
+		}
+	}
+}
+
+// flush submits the batch unless it has already been submitted.
+func (b *TerminateBatcher) flush(key string, batch *terminateBatch) {
+	b.mu.Lock()
+	if b.batches[key] != batch {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.batches, key)
+	b.mu.Unlock()
+	b.run(batch)
+}
+
+func (b *TerminateBatcher) run(batch *terminateBatch) {
+	defer Inflight.End()
+	ctx, cancel := context.WithTimeout(context.Background(), batchTimeout)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, "TerminateInstances", trace.WithAttributes(
+		attribute.String("region", aws.StringValue(batch.cfg.Region)),
+		attribute.Int("batchSize", len(batch.ids)),
+	))
+	defer span.End()
+
+	svc := ec2.New(newSession(batch.cfg, ec2Limiter))
+	errs := make(map[string]error)
+	if err := terminateInstances(ctx, svc, batch.ids); err != nil {
+		// a single instance that cannot be terminated fails the whole
+		// call, so the instances are retried individually
+		if len(batch.ids) == 1 || !isInstanceError(err) {
+			for _, id := range batch.ids {
+				errs[id] = err
+			}
+		} else {
+			for _, id := range batch.ids {
+				if err := terminateInstances(ctx, svc, []string{id}); err != nil {
+					errs[id] = err
+				}
+			}
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for _, id := range batch.ids {
+		b.ledger[id] = &terminateEntry{submitted: now, err: errs[id]}
+	}
+}
+
+func terminateInstances(ctx context.Context, svc *ec2.EC2, ids []string) error {
+	_, err := svc.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: aws.StringSlice(ids),
+	})
+	return err
+}
+
+// isInstanceError returns true if the error is caused by one of the
+// instances of the request rather than the request as a whole.
+func isInstanceError(err error) bool {
+	for _, kind := range []error{ErrInstanceNotFound, ErrInvalidParameter, ErrIncorrectState, ErrUnauthorized} {
+		if errors.Is(err, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// terminateKey identifies terminations that can be batched: those made in
+// the same region with the same credentials. The credentials are compared
+// by access key, since each reconcile builds its own credentials.
+func terminateKey(ctx context.Context, cfg *aws.Config) (string, error) {
+	accessKey := ""
+	if cfg.Credentials != nil {
+		v, err := cfg.Credentials.GetWithContext(ctx)
+		if err != nil {
+			return "", errors.Wrap(err, "cannot get credentials")
+		}
+		accessKey = v.AccessKeyID
+	}
+	return accessKey + "/" + aws.StringValue(cfg.Region), nil
+}
@@ -0,0 +1,187 @@
+package aws
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// terminateServer answers TerminateInstances requests, failing those that
+// include an instance in notFound, and records the instance IDs of each.
+type terminateServer struct {
+	notFound map[string]bool
+
+	mu    sync.Mutex
+	calls [][]string
+}
+
+func (s *terminateServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0)
+	for i := 1; form.Get(fmt.Sprintf("InstanceId.%d", i)) != ""; i++ {
+		ids = append(ids, form.Get(fmt.Sprintf("InstanceId.%d", i)))
+	}
+	s.mu.Lock()
+	s.calls = append(s.calls, ids)
+	s.mu.Unlock()
+
+	status, resp := http.StatusOK, "<TerminateInstancesResponse></TerminateInstancesResponse>"
+	for _, id := range ids {
+		if s.notFound[id] {
+			status = http.StatusBadRequest
+			resp = fmt.Sprintf("<Response><Errors><Error><Code>InvalidInstanceID.NotFound</Code><Message>The instance ID '%s' does not exist</Message></Error></Errors></Response>", id)
+			break
+		}
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"text/xml"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(resp)),
+		Request:    req,
+	}, nil
+}
+
+func (s *terminateServer) requests() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.calls...)
+}
+
+func newTerminateTest(notFound ...string) (*TerminateBatcher, *terminateServer, *aws.Config) {
+	s := &terminateServer{notFound: make(map[string]bool)}
+	for _, id := range notFound {
+		s.notFound[id] = true
+	}
+	cfg := &aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("AKIDTEST", "secret", ""),
+		HTTPClient:  &http.Client{Transport: s},
+		MaxRetries:  aws.Int(0),
+	}
+	// the window is never reached, batches are flushed by the test
+	return NewTerminateBatcher(time.Hour), s, cfg
+}
+
+// flushAll submits every pending batch.
+func flushAll(b *TerminateBatcher) {
+	b.mu.Lock()
+	batches := make(map[string]*terminateBatch)
+	for key, batch := range b.batches {
+		batches[key] = batch
+	}
+	b.mu.Unlock()
+	for key, batch := range batches {
+		b.flush(key, batch)
+	}
+}
+
+func TestTerminateBatcherLedger(t *testing.T) {
+	b, s, cfg := newTerminateTest()
+	ctx := context.Background()
+
+	for _, id := range []string{"i-1", "i-2", "i-1"} {
+		if err := b.terminate(ctx, cfg, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := b.Pending(); n != 2 {
+		t.Errorf("expected 2 pending terminations, got %d", n)
+	}
+	flushAll(b)
+	if expected := [][]string{{"i-1", "i-2"}}; !reflect.DeepEqual(s.requests(), expected) {
+		t.Fatalf("expected requests %v, got %v", expected, s.requests())
+	}
+	if n := b.Pending(); n != 0 {
+		t.Errorf("expected no pending terminations, got %d", n)
+	}
+
+	// submitted terminations are not queued again until they expire from
+	// the ledger
+	if err := b.terminate(ctx, cfg, "i-2"); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(b)
+	if n := len(s.requests()); n != 1 {
+		t.Fatalf("expected the submitted instance not to be terminated again, got %d requests", n)
+	}
+	b.mu.Lock()
+	b.ledger["i-2"].submitted = time.Now().Add(-terminateLedgerTTL - time.Second)
+	b.mu.Unlock()
+	if err := b.terminate(ctx, cfg, "i-2"); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(b)
+	if expected := [][]string{{"i-1", "i-2"}, {"i-2"}}; !reflect.DeepEqual(s.requests(), expected) {
+		t.Fatalf("expected requests %v, got %v", expected, s.requests())
+	}
+}
+
+func TestTerminateBatcherErrorReplay(t *testing.T) {
+	b, s, cfg := newTerminateTest("i-gone")
+	ctx := context.Background()
+
+	for _, id := range []string{"i-1", "i-gone", "i-2"} {
+		if err := b.terminate(ctx, cfg, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(b)
+
+	// the failed batch is retried one instance at a time
+	expected := [][]string{{"i-1", "i-gone", "i-2"}, {"i-1"}, {"i-gone"}, {"i-2"}}
+	if !reflect.DeepEqual(s.requests(), expected) {
+		t.Fatalf("expected requests %v, got %v", expected, s.requests())
+	}
+	for _, id := range []string{"i-1", "i-2"} {
+		if err := b.terminate(ctx, cfg, id); err != nil {
+			t.Errorf("%s: unexpected error: %v", id, err)
+		}
+	}
+
+	// the error is returned once, then the instance is queued again
+	err := b.terminate(ctx, cfg, "i-gone")
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "InvalidInstanceID.NotFound" {
+		t.Fatalf("expected InvalidInstanceID.NotFound, got %v", err)
+	}
+	if err := b.terminate(ctx, cfg, "i-gone"); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.Pending(); n != 1 {
+		t.Errorf("expected the failed instance to be queued again, got %d pending", n)
+	}
+}
+
+func TestTerminateBatcherCanceled(t *testing.T) {
+	b, s, cfg := newTerminateTest()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := b.terminate(ctx, cfg, "i-1"); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	flushAll(b)
+	if n := b.Pending(); n != 0 {
+		t.Errorf("expected nothing queued, got %d pending", n)
+	}
+	if n := len(s.requests()); n != 0 {
+		t.Errorf("expected no requests, got %d", n)
+	}
+}
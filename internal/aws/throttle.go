@@ -0,0 +1,73 @@
+package aws
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var throttledRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mapa_aws_throttled_requests_total",
+	Help: "Number of AWS requests that were throttled, by provider namespace, service and operation.",
+}, []string{"namespace", "service", "operation"})
+
+func init() {
+	metrics.Registry.MustRegister(throttledRequestsTotal)
+}
+
+type namespaceKey struct{}
+
+// WithNamespace returns a context attributing AWS requests made with it to
+// the provider in the namespace.
+func WithNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, namespaceKey{}, namespace)
+}
+
+// Throttling tracks throttled requests for all AWS requests made by this
+// process.
+var Throttling = &ThrottleTracker{}
+
+// ThrottleStats is the throttling history of a provider namespace.
+type ThrottleStats struct {
+	Count         int64
+	LastThrottled time.Time
+}
+
+// ThrottleTracker counts throttled AWS requests per provider namespace.
+type ThrottleTracker struct {
+	mu    sync.Mutex
+	stats map[string]ThrottleStats
+}
+
+func (t *ThrottleTracker) record(namespace string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stats == nil {
+		t.stats = make(map[string]ThrottleStats)
+	}
+	s := t.stats[namespace]
+	s.Count++
+	s.LastThrottled = time.Now()
+	t.stats[namespace] = s
+}
+
+// Stats returns the throttling history of the provider namespace.
+func (t *ThrottleTracker) Stats(namespace string) ThrottleStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats[namespace]
+}
+
+// recordThrottle is a retry handler counting throttled request attempts.
+func recordThrottle(r *request.Request) {
+	if !request.IsErrorThrottle(r.Error) {
+		return
+	}
+	namespace, _ := r.Context().Value(namespaceKey{}).(string)
+	Throttling.record(namespace)
+	throttledRequestsTotal.WithLabelValues(namespace, r.ClientInfo.ServiceName, r.Operation.Name).Inc()
+}
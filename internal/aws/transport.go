@@ -0,0 +1,130 @@
+package aws
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// HTTPClient is used for all AWS requests when set. It is set once at
+// startup.
+var HTTPClient *http.Client
+
+// CallTimeout bounds each AWS request, including its retries and the time
+// spent waiting on rate limiters, when it is greater than 0. It is set once
+// at startup.
+var CallTimeout = time.Minute
+
+// TransportOptions configure the HTTP client used for AWS requests.
+type TransportOptions struct {
+	// HTTPSProxy is the URL of the proxy AWS requests are sent through.
+	// Defaults to $HTTPS_PROXY.
+	HTTPSProxy string
+
+	// NoProxy is a comma-separated list of hosts, domains and CIDRs that
+	// are not proxied. Defaults to $NO_PROXY.
+	NoProxy string
+
+	// CABundle is the path of a PEM file of certificate authorities trusted
+	// in addition to the system roots, e.g. of a TLS-intercepting proxy.
+	CABundle string
+}
+
+// NewHTTPClient returns an HTTP client for AWS requests with the proxy and
+// certificate authorities of the options.
+func NewHTTPClient(o TransportOptions) (*http.Client, error) {
+	proxy := httpproxy.FromEnvironment()
+	if o.HTTPSProxy != "" {
+		proxy.HTTPSProxy = o.HTTPSProxy
+	}
+	if o.NoProxy != "" {
+		proxy.NoProxy = o.NoProxy
+	}
+	proxyFunc := proxy.ProxyFunc()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+	if o.CABundle != "" {
+		pem, err := ioutil.ReadFile(o.CABundle)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read CA bundle")
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in CA bundle %q", o.CABundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// regionSessions caches the base sessions of configs that set nothing but
+// the region, so that the shared config and the default credential chain
+// are not loaded again for each call. Machines spanning many regions each
+// use the session of their region.
+var regionSessions sync.Map
+
+// regionSessionKey identifies a cached session. The HTTP client and profile
+// are only set at startup, but are part of the key so that sessions are
+// never shared across them.
+type regionSessionKey struct {
+	region  string
+	client  *http.Client
+	profile string
+}
+
+// newBaseSession returns a session using HTTPClient, unless cfg sets its
+// own client, and the shared config Profile, if set. Requests are bounded by
+// CallTimeout, and requests rejected due to their credentials are tracked by
+// CredentialOutages.
+func newBaseSession(cfg *aws.Config) *session.Session {
+	if !reflect.DeepEqual(cfg, &aws.Config{Region: cfg.Region}) {
+		return newRegionSession(cfg)
+	}
+	key := regionSessionKey{region: aws.StringValue(cfg.Region), client: HTTPClient, profile: Profile}
+	if sess, ok := regionSessions.Load(key); ok {
+		return sess.(*session.Session).Copy()
+	}
+	sess, _ := regionSessions.LoadOrStore(key, newRegionSession(cfg))
+	return sess.(*session.Session).Copy()
+}
+
+func newRegionSession(cfg *aws.Config) *session.Session {
+	var sess *session.Session
+	if Profile != "" {
+		sess = newProfileSession(cfg)
+	} else {
+		sess = session.New(&aws.Config{HTTPClient: HTTPClient}, cfg)
+	}
+	sess.Handlers.Validate.PushFront(withCallTimeout)
+	sess.Handlers.Complete.PushBack(recordCredentialOutage)
+	sess.Handlers.AfterRetry.PushBack(classifyError)
+	return sess
+}
+
+// withCallTimeout sets the deadline of the request to CallTimeout from now,
+// unless its context already has an earlier deadline.
+func withCallTimeout(r *request.Request) {
+	if CallTimeout <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), CallTimeout)
+	r.SetContext(ctx)
+	r.Handlers.Complete.PushBack(func(*request.Request) { cancel() })
+}
@@ -4,10 +4,12 @@ import (
 	"math/rand"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/pkg/errors"
 )
 
@@ -18,7 +20,39 @@ func ParseRegionFromAZ(s string) string {
 }
 
 func LookupRegion() (string, error) {
-	return ec2metadata.New(session.New()).Region()
+	// instance metadata is link-local and never proxied, so the session does
+	// not use HTTPClient
+	sess := session.New()
+	sess.Handlers.AfterRetry.PushBack(classifyError)
+	return ec2metadata.New(sess).Region()
+}
+
+// DefaultRegion is used when a resource does not specify a region. When it
+// is also empty, the region the controller is running in is looked up from
+// EC2 instance metadata.
+var DefaultRegion string
+
+var (
+	metadataRegionOnce sync.Once
+	metadataRegion     string
+	metadataRegionErr  error
+)
+
+// ResolveRegion returns region, or the default region when it is empty.
+func ResolveRegion(region string) (string, error) {
+	if region != "" {
+		return region, nil
+	}
+	if DefaultRegion != "" {
+		return DefaultRegion, nil
+	}
+	metadataRegionOnce.Do(func() {
+		metadataRegion, metadataRegionErr = LookupRegion()
+	})
+	if metadataRegionErr != nil {
+		return "", NewConfigurationError("region is not set and cannot be determined from EC2 instance metadata: %v", metadataRegionErr)
+	}
+	return metadataRegion, nil
 }
 
 var providerIDRegex = regexp.MustCompile("^[^:]+://.*[^/]$")
@@ -46,10 +80,22 @@ func VerifyProviderID(s string) bool {
 	return providerIDRegex.MatchString(s)
 }
 
+var instanceIDRegex = regexp.MustCompile("^i-[0-9a-f]+$")
+
+// IsEC2ProviderID returns true if the ProviderID is of an EC2 instance, as
+// opposed to e.g. a Fargate task or a node of another cloud provider.
+func IsEC2ProviderID(s string) bool {
+	if !strings.HasPrefix(s, "aws://") || !VerifyProviderID(s) {
+		return false
+	}
+	ss := strings.Split(s, "/")
+	return instanceIDRegex.MatchString(ss[len(ss)-1])
+}
+
 func init() {
 	rand.Seed(time.Now().Unix())
 }
 
-func random(ss []string) string {
-	return ss[rand.Intn(len(ss))]
+func randomSubnet(subnets []*ec2.Subnet) *ec2.Subnet {
+	return subnets[rand.Intn(len(subnets))]
 }
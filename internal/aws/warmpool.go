@@ -0,0 +1,45 @@
+package aws
+
+import (
+	"context"
+	"encoding/base64"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// WarmPoolTagKey is the tag identifying the warm pool (namespace/name) an
+// instance was launched for.
+const WarmPoolTagKey = "infrastructure.crit.sh/warm-pool"
+
+// DescribeWarmPoolInstances returns the instances of a warm pool that are not
+// yet terminated, including those already claimed by an AWSMachine.
+func DescribeWarmPoolInstances(ctx context.Context, cfg *aws.Config, namespace, pool string) ([]*ec2.Instance, error) {
+	return DescribeInstancesByTag(ctx, cfg, WarmPoolTagKey, namespace+"/"+pool)
+}
+
+// IsClaimed returns true if the instance belongs to an AWSMachine.
+func IsClaimed(instance *ec2.Instance) bool {
+	uid, _ := TagValue(instance.Tags, MachineUIDTagKey)
+	return uid != ""
+}
+
+// StartInstance replaces the user data of a stopped instance with the
+// base64-encoded userData and starts it.
+func StartInstance(ctx context.Context, cfg *aws.Config, instanceID, userData string) error {
+	data, err := base64.StdEncoding.DecodeString(userData)
+	if err != nil {
+		return err
+	}
+	svc := ec2.New(newSession(cfg, ec2Limiter))
+	if _, err := svc.ModifyInstanceAttributeWithContext(ctx, &ec2.ModifyInstanceAttributeInput{
+		InstanceId: aws.String(instanceID),
+		UserData:   &ec2.BlobAttributeValue{Value: data},
+	}); err != nil {
+		return err
+	}
+	_, err = svc.StartInstancesWithContext(ctx, &ec2.StartInstancesInput{
+		InstanceIds: aws.StringSlice([]string{instanceID}),
+	})
+	return err
+}
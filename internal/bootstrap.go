@@ -0,0 +1,395 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// cloudConfig is the subset of cloud-config used by bootstrap data that can
+// be translated into the native formats of operating systems without
+// cloud-init.
+type cloudConfig struct {
+	WriteFiles        []cloudConfigFile `json:"write_files,omitempty"`
+	RunCmd            []json.RawMessage `json:"runcmd,omitempty"`
+	SSHAuthorizedKeys []string          `json:"ssh_authorized_keys,omitempty"`
+}
+
+type cloudConfigFile struct {
+	Path        string `json:"path"`
+	Content     string `json:"content,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+	Permissions string `json:"permissions,omitempty"`
+}
+
+// decode returns the content of the file after applying its encoding.
+func (f cloudConfigFile) decode() ([]byte, error) {
+	switch strings.ToLower(f.Encoding) {
+	case "", "text/plain":
+		return []byte(f.Content), nil
+	case "b64", "base64":
+		return base64.StdEncoding.DecodeString(f.Content)
+	case "gz", "gzip":
+		return gunzip([]byte(f.Content))
+	case "gz+b64", "gz+base64", "gzip+b64", "gzip+base64":
+		data, err := base64.StdEncoding.DecodeString(f.Content)
+		if err != nil {
+			return nil, err
+		}
+		return gunzip(data)
+	default:
+		return nil, errors.Errorf("unsupported encoding %q", f.Encoding)
+	}
+}
+
+// mode returns the permissions of the file, defaulting to 0644.
+func (f cloudConfigFile) mode() (int, error) {
+	if f.Permissions == "" {
+		return 0644, nil
+	}
+	mode, err := strconv.ParseInt(f.Permissions, 8, 32)
+	if err != nil {
+		return 0, errors.Errorf("invalid permissions %q", f.Permissions)
+	}
+	return int(mode), nil
+}
+
+func parseCloudConfig(data []byte) (*cloudConfig, error) {
+	var cc cloudConfig
+	if err := yaml.Unmarshal(data, &cc); err != nil {
+		return nil, errors.Wrap(err, "cannot parse bootstrap cloud-config")
+	}
+	return &cc, nil
+}
+
+// commands returns the runcmd entries as shell commands. Entries given as a
+// list are quoted and joined, as cloud-init does.
+func (cc *cloudConfig) commands() ([]string, error) {
+	cmds := make([]string, 0, len(cc.RunCmd))
+	for _, raw := range cc.RunCmd {
+		var cmd string
+		if err := json.Unmarshal(raw, &cmd); err == nil {
+			cmds = append(cmds, cmd)
+			continue
+		}
+		var args []string
+		if err := json.Unmarshal(raw, &args); err != nil {
+			return nil, errors.Errorf("invalid runcmd entry %s", raw)
+		}
+		for i := range args {
+			args[i] = shellQuote(args[i])
+		}
+		cmds = append(cmds, strings.Join(args, " "))
+	}
+	return cmds, nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// workerConfiguration is the subset of a crit WorkerConfiguration needed to
+// join a node that does not run crit.
+type workerConfiguration struct {
+	APIVersion           string          `json:"apiVersion"`
+	Kind                 string          `json:"kind"`
+	ClusterName          string          `json:"clusterName,omitempty"`
+	ControlPlaneEndpoint json.RawMessage `json:"controlPlaneEndpoint,omitempty"`
+	BootstrapToken       string          `json:"bootstrapToken,omitempty"`
+	CACert               string          `json:"caCert,omitempty"`
+	NodeConfiguration    struct {
+		KubeDir string `json:"kubeDir,omitempty"`
+	} `json:"node,omitempty"`
+}
+
+// apiServer returns the URL of the control plane endpoint, which is a
+// HOST[:PORT] string in v1alpha1 and a host and port in v1alpha2.
+func (wc *workerConfiguration) apiServer() (string, error) {
+	var host string
+	var port int
+	var endpoint string
+	if err := json.Unmarshal(wc.ControlPlaneEndpoint, &endpoint); err == nil {
+		h, p, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			h = endpoint
+		} else if port, err = strconv.Atoi(p); err != nil {
+			return "", errors.Errorf("invalid controlPlaneEndpoint %q", endpoint)
+		}
+		host = h
+	} else {
+		var ep struct {
+			Host string `json:"host"`
+			Port int    `json:"port"`
+		}
+		if err := json.Unmarshal(wc.ControlPlaneEndpoint, &ep); err != nil {
+			return "", errors.Errorf("invalid controlPlaneEndpoint %s", wc.ControlPlaneEndpoint)
+		}
+		host, port = ep.Host, ep.Port
+	}
+	if host == "" {
+		return "", errors.New("WorkerConfiguration has no controlPlaneEndpoint")
+	}
+	if port == 0 {
+		port = 6443
+	}
+	return "https://" + net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// caCertPath returns the path of the cluster CA certificate, defaulting to
+// the CA in the kube dir.
+func (wc *workerConfiguration) caCertPath() string {
+	if wc.CACert != "" {
+		return wc.CACert
+	}
+	kubeDir := wc.NodeConfiguration.KubeDir
+	if kubeDir == "" {
+		kubeDir = "/etc/kubernetes"
+	}
+	return path.Join(kubeDir, "pki", "ca.crt")
+}
+
+var errNoWorkerConfiguration = errors.New("bootstrap data does not contain a crit WorkerConfiguration")
+
+// workerConfiguration returns the crit WorkerConfiguration written by the
+// bootstrap data.
+func (cc *cloudConfig) workerConfiguration() (*workerConfiguration, error) {
+	wc, _, err := cc.workerConfigurationFile()
+	return wc, err
+}
+
+// workerConfigurationFile returns the crit WorkerConfiguration written by
+// the bootstrap data and the index of the file in WriteFiles.
+func (cc *cloudConfig) workerConfigurationFile() (*workerConfiguration, int, error) {
+	for i, f := range cc.WriteFiles {
+		data, err := f.decode()
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "cannot decode %s", f.Path)
+		}
+		var wc workerConfiguration
+		if err := yaml.Unmarshal(data, &wc); err != nil {
+			continue
+		}
+		if wc.Kind != "WorkerConfiguration" || !strings.HasPrefix(wc.APIVersion, "crit.") {
+			continue
+		}
+		if wc.ClusterName == "" {
+			wc.ClusterName = "crit"
+		}
+		return &wc, i, nil
+	}
+	return nil, 0, errNoWorkerConfiguration
+}
+
+// file returns the decoded content of the file written to path.
+func (cc *cloudConfig) file(path string) ([]byte, error) {
+	for _, f := range cc.WriteFiles {
+		if f.Path == path {
+			return f.decode()
+		}
+	}
+	return nil, errors.Errorf("bootstrap data does not write %s", path)
+}
+
+// BottlerocketSettings translates the bootstrap cloud-config of a worker
+// into Bottlerocket TOML settings. Bottlerocket joins the cluster itself, so
+// only the settings.kubernetes values taken from the crit
+// WorkerConfiguration are used and the rest of the cloud-config is ignored.
+func BottlerocketSettings(data []byte) ([]byte, error) {
+	cc, err := parseCloudConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	wc, err := cc.workerConfiguration()
+	if err != nil {
+		return nil, err
+	}
+	apiServer, err := wc.apiServer()
+	if err != nil {
+		return nil, err
+	}
+	if wc.BootstrapToken == "" {
+		return nil, errors.New("WorkerConfiguration has no bootstrapToken")
+	}
+	ca, err := cc.file(wc.caCertPath())
+	if err != nil {
+		return nil, err
+	}
+	settings := map[string]string{
+		"api-server":          apiServer,
+		"cluster-name":        wc.ClusterName,
+		"bootstrap-token":     wc.BootstrapToken,
+		"cluster-certificate": base64.StdEncoding.EncodeToString(ca),
+	}
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	b.WriteString("[settings.kubernetes]\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s = %s\n", k, tomlQuote(settings[k]))
+	}
+	return b.Bytes(), nil
+}
+
+// tomlQuote returns s as a TOML basic string.
+func tomlQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+const (
+	// ignitionRunCmdPath is where Flatcar machines write the runcmd of the
+	// bootstrap data as a script.
+	ignitionRunCmdPath = "/opt/bootstrap/runcmd.sh"
+
+	ignitionBootstrapUnit = `[Unit]
+Description=Run bootstrap commands
+Wants=network-online.target
+After=network-online.target
+ConditionPathExists=!/opt/bootstrap/.done
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=` + ignitionRunCmdPath + `
+ExecStartPost=/usr/bin/touch /opt/bootstrap/.done
+
+[Install]
+WantedBy=multi-user.target
+`
+)
+
+type ignitionConfig struct {
+	Ignition struct {
+		Version string `json:"version"`
+	} `json:"ignition"`
+	Passwd  ignitionPasswd   `json:"passwd,omitempty"`
+	Storage ignitionStorage  `json:"storage,omitempty"`
+	Systemd *ignitionSystemd `json:"systemd,omitempty"`
+}
+
+type ignitionPasswd struct {
+	Users []ignitionUser `json:"users,omitempty"`
+}
+
+type ignitionUser struct {
+	Name              string   `json:"name"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+}
+
+type ignitionStorage struct {
+	Files []ignitionFile `json:"files,omitempty"`
+}
+
+type ignitionFile struct {
+	Path      string          `json:"path"`
+	Mode      int             `json:"mode"`
+	Overwrite bool            `json:"overwrite"`
+	User      *ignitionOwner  `json:"user,omitempty"`
+	Group     *ignitionOwner  `json:"group,omitempty"`
+	Contents  ignitionContent `json:"contents"`
+}
+
+type ignitionOwner struct {
+	Name string `json:"name"`
+}
+
+type ignitionContent struct {
+	Source string `json:"source"`
+}
+
+type ignitionSystemd struct {
+	Units []ignitionUnit `json:"units"`
+}
+
+type ignitionUnit struct {
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Contents string `json:"contents"`
+}
+
+// IgnitionConfig translates the bootstrap cloud-config into an Ignition v3
+// config for Flatcar. Files are written by Ignition, the runcmd entries are
+// run once by a systemd unit and the SSH keys are authorized for the core
+// user.
+func IgnitionConfig(data []byte) ([]byte, error) {
+	cc, err := parseCloudConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	var ic ignitionConfig
+	ic.Ignition.Version = "3.0.0"
+	if len(cc.SSHAuthorizedKeys) > 0 {
+		ic.Passwd.Users = []ignitionUser{{Name: "core", SSHAuthorizedKeys: cc.SSHAuthorizedKeys}}
+	}
+	for _, f := range cc.WriteFiles {
+		content, err := f.decode()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot decode %s", f.Path)
+		}
+		mode, err := f.mode()
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot write %s", f.Path)
+		}
+		file := ignitionFile{
+			Path:      f.Path,
+			Mode:      mode,
+			Overwrite: true,
+			Contents:  ignitionContent{Source: dataURL(content)},
+		}
+		if f.Owner != "" {
+			owner := strings.SplitN(f.Owner, ":", 2)
+			file.User = &ignitionOwner{Name: owner[0]}
+			if len(owner) == 2 {
+				file.Group = &ignitionOwner{Name: owner[1]}
+			}
+		}
+		ic.Storage.Files = append(ic.Storage.Files, file)
+	}
+	cmds, err := cc.commands()
+	if err != nil {
+		return nil, err
+	}
+	if len(cmds) > 0 {
+		script := "#!/bin/bash\nset -e\n" + strings.Join(cmds, "\n") + "\n"
+		ic.Storage.Files = append(ic.Storage.Files, ignitionFile{
+			Path:      ignitionRunCmdPath,
+			Mode:      0700,
+			Overwrite: true,
+			Contents:  ignitionContent{Source: dataURL([]byte(script))},
+		})
+		ic.Systemd = &ignitionSystemd{
+			Units: []ignitionUnit{{Name: "bootstrap.service", Enabled: true, Contents: ignitionBootstrapUnit}},
+		}
+	}
+	return json.Marshal(ic)
+}
+
+func dataURL(data []byte) string {
+	return "data:;base64," + base64.StdEncoding.EncodeToString(data)
+}
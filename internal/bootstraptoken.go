@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+const (
+	// bootstrapTokenPlaceholder takes the place of the join token in the
+	// WorkerConfiguration until the token is decrypted on the instance.
+	bootstrapTokenPlaceholder = "kms-encrypted-bootstrap-token"
+
+	// bootstrapTokenCiphertextPath is where the encrypted join token is
+	// written on the instance. /run is not persisted across reboots.
+	bootstrapTokenCiphertextPath = "/run/crit/bootstrap-token.enc"
+)
+
+// workerCloudConfig is a bootstrap cloud-config writing a crit
+// WorkerConfiguration with a join token, which is rewritten from a map so
+// that the fields unknown to cloudConfig are kept.
+type workerCloudConfig struct {
+	raw     map[string]interface{}
+	file    map[string]interface{}
+	path    string
+	content string
+	token   string
+
+	// join returns the bootstrap data with the rewritten cloud-config,
+	// e.g. put back into the MIME message of a crit Config.
+	join func(cloudConfig []byte) ([]byte, error)
+}
+
+// parseWorkerCloudConfig returns the cloud-config of the bootstrap data, or
+// nil when it writes no WorkerConfiguration with a join token, e.g. for
+// control plane machines. The cloud-config may be the text/cloud-config
+// part of a MIME multi-part message, as rendered by crit Configs. The
+// feature rewriting the cloud-config is named in errors.
+func parseWorkerCloudConfig(osFamily infrav1.OSFamily, format infrav1.UserDataFormat, data []byte, feature string) (*workerCloudConfig, error) {
+	if !isCloudInit(osFamily, format) {
+		return nil, errors.Errorf("%s requires Linux cloud-init bootstrap data", feature)
+	}
+	data, join, err := splitCloudConfig(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s requires cloud-config bootstrap data", feature)
+	}
+	cc, err := parseCloudConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	wc, i, err := cc.workerConfigurationFile()
+	if err == errNoWorkerConfiguration || (err == nil && wc.BootstrapToken == "") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	content, err := cc.WriteFiles[i].decode()
+	if err != nil {
+		return nil, err
+	}
+	w := &workerCloudConfig{path: cc.WriteFiles[i].Path, content: string(content), token: wc.BootstrapToken, join: join}
+	if err := yaml.Unmarshal(data, &w.raw); err != nil {
+		return nil, errors.Wrap(err, "cannot parse bootstrap cloud-config")
+	}
+	files, _ := w.raw["write_files"].([]interface{})
+	w.file, _ = files[i].(map[string]interface{})
+	return w, nil
+}
+
+// setToken replaces the join token in the WorkerConfiguration, which is
+// written as plain text from then on.
+func (w *workerCloudConfig) setToken(token string) {
+	w.content = strings.Replace(w.content, w.token, token, -1)
+	w.token = token
+	w.file["content"] = w.content
+	delete(w.file, "encoding")
+}
+
+func (w *workerCloudConfig) bytes() ([]byte, error) {
+	out, err := yaml.Marshal(w.raw)
+	if err != nil {
+		return nil, err
+	}
+	return w.join(append([]byte("#cloud-config\n"), out...))
+}
+
+// splitCloudConfig returns the cloud-config of the bootstrap data, and a
+// function that returns the bootstrap data with another cloud-config in its
+// place.
+func splitCloudConfig(data []byte) ([]byte, func([]byte) ([]byte, error), error) {
+	if bytes.HasPrefix(data, []byte("#cloud-config")) {
+		return data, func(cc []byte) ([]byte, error) { return cc, nil }, nil
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, errors.New("bootstrap data is neither a cloud-config nor a MIME message")
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, nil, errors.New("bootstrap data is not a MIME multi-part message")
+	}
+	type part struct {
+		header textproto.MIMEHeader
+		body   []byte
+	}
+	parts := make([]part, 0)
+	found := -1
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, errors.Wrap(err, "cannot read bootstrap data MIME message")
+		}
+		body, err := ioutil.ReadAll(p)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "cannot read bootstrap data MIME message")
+		}
+		if found < 0 && strings.HasPrefix(p.Header.Get("Content-Type"), "text/cloud-config") {
+			found = len(parts)
+		}
+		parts = append(parts, part{header: p.Header, body: body})
+	}
+	if found < 0 {
+		return nil, nil, errors.New("bootstrap data MIME message has no text/cloud-config part")
+	}
+	join := func(cc []byte) ([]byte, error) {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "MIME-Version: 1.0\nContent-Type: %s\n\n", mime.FormatMediaType(mediaType, params))
+		w := multipart.NewWriter(&b)
+		if err := w.SetBoundary(params["boundary"]); err != nil {
+			return nil, err
+		}
+		for i, p := range parts {
+			body := p.body
+			if i == found {
+				body = cc
+			}
+			pw, err := w.CreatePart(p.header)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := pw.Write(body); err != nil {
+				return nil, err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+	return parts[found].body, join, nil
+}
+
+// SetBootstrapToken returns the bootstrap data with the join token of its
+// crit WorkerConfiguration replaced by the token returned by newToken.
+// Bootstrap data without a join token is returned as is, without calling
+// newToken.
+func SetBootstrapToken(osFamily infrav1.OSFamily, format infrav1.UserDataFormat, data []byte, newToken func() (string, error)) ([]byte, error) {
+	w, err := parseWorkerCloudConfig(osFamily, format, data, "bootstrapTokenTTL")
+	if err != nil {
+		return nil, err
+	}
+	if w == nil {
+		return data, nil
+	}
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	w.setToken(token)
+	return w.bytes()
+}
+
+// EncryptBootstrapToken returns the bootstrap data with the join token of
+// its crit WorkerConfiguration encrypted by encrypt. The ciphertext is
+// written to the instance along with the WorkerConfiguration, and a command
+// run before the other runcmd entries decrypts it with the AWS CLI and puts
+// the token back in place, so that the token is not readable from the user
+// data of the instance. The instance needs kms:Decrypt on the key with the
+// encryption context. Bootstrap data without a join token, e.g. of control
+// plane machines, is returned as is.
+func EncryptBootstrapToken(osFamily infrav1.OSFamily, format infrav1.UserDataFormat, data []byte, region string, encryptionContext map[string]string, encrypt func(token []byte) ([]byte, error)) ([]byte, error) {
+	w, err := parseWorkerCloudConfig(osFamily, format, data, "bootstrapTokenKMSKeyID")
+	if err != nil {
+		return nil, err
+	}
+	if w == nil {
+		return data, nil
+	}
+	ciphertext, err := encrypt([]byte(w.token))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encrypt bootstrap token")
+	}
+	w.setToken(bootstrapTokenPlaceholder)
+	files, _ := w.raw["write_files"].([]interface{})
+	w.raw["write_files"] = append(files, map[string]interface{}{
+		"path":        bootstrapTokenCiphertextPath,
+		"content":     base64.StdEncoding.EncodeToString(ciphertext),
+		"encoding":    "b64",
+		"permissions": "0600",
+	})
+	runcmd, _ := w.raw["runcmd"].([]interface{})
+	w.raw["runcmd"] = append([]interface{}{decryptBootstrapTokenCommand(w.path, region, encryptionContext)}, runcmd...)
+	return w.bytes()
+}
+
+// decryptBootstrapTokenCommand returns the shell command decrypting the
+// join token into the WorkerConfiguration at path. It fails with a message
+// in the cloud-init output, before crit runs, when the AMI has no AWS CLI
+// or the token cannot be decrypted, instead of crit failing to join with
+// the placeholder.
+func decryptBootstrapTokenCommand(path, region string, encryptionContext map[string]string) string {
+	pairs := make([]string, 0, len(encryptionContext))
+	for k, v := range encryptionContext {
+		pairs = append(pairs, shellQuote(k+"="+v))
+	}
+	sort.Strings(pairs)
+	var b strings.Builder
+	b.WriteString(`command -v aws >/dev/null 2>&1 || { echo "bootstrapTokenKMSKeyID requires the AWS CLI on the AMI, cannot decrypt the bootstrap token" >&2; exit 1; }; `)
+	fmt.Fprintf(&b, `token="$(aws kms decrypt --region %s --ciphertext-blob fileb://%s --encryption-context %s --query Plaintext --output text | base64 -d)"; `,
+		shellQuote(region), bootstrapTokenCiphertextPath, strings.Join(pairs, " "))
+	b.WriteString(`[ -n "$token" ] || { echo "cannot decrypt the bootstrap token with KMS, check kms:Decrypt of the instance profile" >&2; exit 1; }; `)
+	fmt.Fprintf(&b, `sed -i "s/%s/$token/" %s && rm -f %s`, bootstrapTokenPlaceholder, shellQuote(path), bootstrapTokenCiphertextPath)
+	return b.String()
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// EKSBootstrapScript returns user data running the bootstrap script of EKS
+// optimized Amazon Linux 2 AMIs to join the cluster, which also prepares the
+// instance store volumes according to the policy.
+func EKSBootstrapScript(e *infrav1.EKSBootstrap, policy infrav1.InstanceStorePolicy) []byte {
+	args := []string{
+		"/etc/eks/bootstrap.sh", shellQuote(e.ClusterName),
+		"--apiserver-endpoint", shellQuote(e.APIServerEndpoint),
+		"--b64-cluster-ca", shellQuote(e.CertificateAuthority),
+	}
+	if policy == infrav1.InstanceStorePolicyRAID0 {
+		args = append(args, "--local-disks", "raid0")
+	}
+	if len(e.KubeletExtraArgs) != 0 {
+		args = append(args, "--kubelet-extra-args", shellQuote(strings.Join(e.KubeletExtraArgs, " ")))
+	}
+	return []byte("#!/bin/bash\nset -o errexit\n" + strings.Join(args, " ") + "\n")
+}
+
+// nodeadmBoundary separates the parts of nodeadm user data.
+const nodeadmBoundary = "MACHINEAPIPROVIDERAWS"
+
+// NodeadmConfig returns MIME multi-part user data with the nodeadm
+// NodeConfig of EKS optimized Amazon Linux 2023 AMIs to join the cluster,
+// which also prepares the instance store volumes according to the policy.
+func NodeadmConfig(e *infrav1.EKSBootstrap, policy infrav1.InstanceStorePolicy) ([]byte, error) {
+	spec := map[string]interface{}{
+		"cluster": map[string]string{
+			"name":                 e.ClusterName,
+			"apiServerEndpoint":    e.APIServerEndpoint,
+			"certificateAuthority": e.CertificateAuthority,
+			"cidr":                 e.ServiceCIDR,
+		},
+		"kubelet": map[string]interface{}{
+			"flags": e.KubeletExtraArgs,
+		},
+	}
+	if policy == infrav1.InstanceStorePolicyRAID0 {
+		spec["instance"] = map[string]interface{}{
+			"localStorage": map[string]string{"strategy": "RAID0"},
+		}
+	}
+	config := map[string]interface{}{
+		"apiVersion": "node.eks.aws/v1alpha1",
+		"kind":       "NodeConfig",
+		"spec":       spec,
+	}
+	b, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\nContent-Type: multipart/mixed; boundary=%q\n\n", nodeadmBoundary)
+	fmt.Fprintf(&buf, "--%s\nContent-Type: application/node.eks.aws\n\n---\n", nodeadmBoundary)
+	buf.Write(b)
+	fmt.Fprintf(&buf, "\n--%s--\n", nodeadmBoundary)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,23 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// WithHostname returns the bootstrap data combined with a cloud-config
+// setting the hostname of the instance, as MIME multi-part user data. Only
+// Linux cloud-init user data can be combined.
+func WithHostname(hostname string, osFamily infrav1.OSFamily, format infrav1.UserDataFormat, data []byte) ([]byte, error) {
+	if hostname == "" {
+		return data, nil
+	}
+	if !isCloudInit(osFamily, format) {
+		return nil, errors.New("naming.hostname requires Linux cloud-init user data")
+	}
+	part := fmt.Sprintf("#cloud-config\npreserve_hostname: false\nhostname: %s\n", hostname)
+	return withBootPart(data, "text/cloud-config", part, "naming.hostname")
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"github.com/pkg/errors"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// instanceStoreRAID0 is a cloud-init boothook assembling the NVMe instance
+// store volumes into a RAID0 array, mounted at /mnt/k8s-disks/0 with the
+// kubelet and containerd state directories bind mounted from it, as the
+// setup-local-disks script of the EKS optimized AMIs does. Boothooks run on
+// every boot, so an array that survived a reboot is assembled again rather
+// than created.
+const instanceStoreRAID0 = `#!/bin/sh
+set -e
+array=/dev/md/kubernetes
+mnt=/mnt/k8s-disks/0
+mountpoint -q "$mnt" && exit 0
+disks=""
+for d in /sys/block/nvme*n1; do
+	grep -q "Instance Storage" "$d/device/model" 2>/dev/null && disks="$disks /dev/${d##*/}"
+done
+[ -n "$disks" ] || exit 0
+[ -e "$array" ] || mdadm --assemble --scan || true
+if [ ! -e "$array" ]; then
+	mdadm --create "$array" --level=0 --name=kubernetes --force --run --raid-devices=$(echo $disks | wc -w) $disks
+	mkfs.ext4 -F "$array"
+fi
+mkdir -p "$mnt"
+mount "$array" "$mnt"
+for dir in kubelet containerd; do
+	mkdir -p "$mnt/$dir" "/var/lib/$dir"
+	mount --bind "$mnt/$dir" "/var/lib/$dir"
+done
+`
+
+// WithInstanceStore returns the bootstrap data combined with a boothook
+// preparing the instance store volumes according to the policy, as MIME
+// multi-part user data. Only Linux cloud-init user data can be combined.
+func WithInstanceStore(policy infrav1.InstanceStorePolicy, osFamily infrav1.OSFamily, format infrav1.UserDataFormat, data []byte) ([]byte, error) {
+	if policy == "" {
+		return data, nil
+	}
+	if policy != infrav1.InstanceStorePolicyRAID0 {
+		return nil, errors.Errorf("unknown instance store policy %q", policy)
+	}
+	if !isCloudInit(osFamily, format) {
+		return nil, errors.Errorf("instance store policy %s requires Linux cloud-init user data", policy)
+	}
+	return withBootPart(data, "text/cloud-boothook", instanceStoreRAID0, "instance store policy "+string(policy))
+}
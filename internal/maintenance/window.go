@@ -0,0 +1,45 @@
+package maintenance
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// Open reports whether now falls within any of the maintenance windows. When
+// it does not, the start of the next window is returned. An empty list of
+// windows places no restriction, so it is always open.
+func Open(windows []infrav1.MaintenanceWindow, now time.Time) (bool, time.Time, error) {
+	if len(windows) == 0 {
+		return true, now, nil
+	}
+	var next time.Time
+	for _, w := range windows {
+		loc := time.UTC
+		if w.TimeZone != "" {
+			var err error
+			loc, err = time.LoadLocation(w.TimeZone)
+			if err != nil {
+				return false, next, errors.Wrapf(err, "invalid maintenance window time zone %q", w.TimeZone)
+			}
+		}
+		sched, err := cron.ParseStandard(w.Schedule)
+		if err != nil {
+			return false, next, errors.Wrapf(err, "invalid maintenance window schedule %q", w.Schedule)
+		}
+
+		// The first activation after (now - duration) is either a window
+		// that is currently open, or the next window to open.
+		start := sched.Next(now.In(loc).Add(-w.Duration.Duration))
+		if !start.After(now) {
+			return true, now, nil
+		}
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return false, next, nil
+}
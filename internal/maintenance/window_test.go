@@ -0,0 +1,133 @@
+package maintenance
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+func TestOpen(t *testing.T) {
+	window := func(schedule string, d time.Duration, tz string) infrav1.MaintenanceWindow {
+		return infrav1.MaintenanceWindow{Schedule: schedule, Duration: metav1.Duration{Duration: d}, TimeZone: tz}
+	}
+	at := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	// 23:00 to 01:00 UTC every night
+	overnight := window("0 23 * * *", 2*time.Hour, "")
+	// 02:00 to 03:00 in New York, which is 06:00 UTC in summer and 07:00
+	// UTC in winter
+	newYork := window("0 2 * * *", time.Hour, "America/New_York")
+
+	cases := []struct {
+		name    string
+		windows []infrav1.MaintenanceWindow
+		now     string
+		open    bool
+		next    string
+		wantErr bool
+	}{
+		{
+			name: "no windows",
+			now:  "2020-06-01T12:00:00Z",
+			open: true,
+		},
+		{
+			name:    "before the window",
+			windows: []infrav1.MaintenanceWindow{overnight},
+			now:     "2020-06-01T22:59:00Z",
+			next:    "2020-06-01T23:00:00Z",
+		},
+		{
+			name:    "at the start of the window",
+			windows: []infrav1.MaintenanceWindow{overnight},
+			now:     "2020-06-01T23:00:00Z",
+			open:    true,
+		},
+		{
+			name:    "past midnight",
+			windows: []infrav1.MaintenanceWindow{overnight},
+			now:     "2020-06-02T00:30:00Z",
+			open:    true,
+		},
+		{
+			name:    "at the end of the window",
+			windows: []infrav1.MaintenanceWindow{overnight},
+			now:     "2020-06-02T01:00:00Z",
+			next:    "2020-06-02T23:00:00Z",
+		},
+		{
+			name:    "time zone in summer",
+			windows: []infrav1.MaintenanceWindow{newYork},
+			now:     "2020-06-01T06:30:00Z",
+			open:    true,
+		},
+		{
+			name:    "time zone in winter",
+			windows: []infrav1.MaintenanceWindow{newYork},
+			now:     "2020-01-15T06:30:00Z",
+			next:    "2020-01-15T07:00:00Z",
+		},
+		{
+			name:    "time zone across midnight UTC",
+			windows: []infrav1.MaintenanceWindow{window("0 20 * * *", 3*time.Hour, "America/Los_Angeles")},
+			now:     "2020-06-02T04:30:00Z",
+			open:    true,
+		},
+		{
+			name:    "earliest of several windows",
+			windows: []infrav1.MaintenanceWindow{overnight, newYork},
+			now:     "2020-06-01T12:00:00Z",
+			next:    "2020-06-01T23:00:00Z",
+		},
+		{
+			name:    "any of several windows",
+			windows: []infrav1.MaintenanceWindow{overnight, newYork},
+			now:     "2020-06-01T06:30:00Z",
+			open:    true,
+		},
+		{
+			name:    "invalid time zone",
+			windows: []infrav1.MaintenanceWindow{window("0 2 * * *", time.Hour, "Mars/Olympus_Mons")},
+			now:     "2020-06-01T12:00:00Z",
+			wantErr: true,
+		},
+		{
+			name:    "invalid schedule",
+			windows: []infrav1.MaintenanceWindow{window("at night", time.Hour, "")},
+			now:     "2020-06-01T12:00:00Z",
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := at(tc.now)
+			open, next, err := Open(tc.windows, now)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if open != tc.open {
+				t.Errorf("open = %v, want %v", open, tc.open)
+			}
+			if open {
+				if !next.Equal(now) {
+					t.Errorf("next = %v, want now for an open window", next)
+				}
+				return
+			}
+			if want := at(tc.next); !next.Equal(want) {
+				t.Errorf("next = %v, want %v", next.UTC(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// multipartBoundary separates the parts of user data combined with parts
+// added by the provider.
+const multipartBoundary = "MACHINEAPIPROVIDERAWS"
+
+// multipartHeader starts user data combined by withBootPart.
+var multipartHeader = fmt.Sprintf("MIME-Version: 1.0\nContent-Type: multipart/mixed; boundary=%q\n\n", multipartBoundary)
+
+// userDataContentTypes are the MIME types of cloud-init user data, by the
+// line the user data starts with.
+var userDataContentTypes = map[string]string{
+	"#cloud-config":   "text/cloud-config",
+	"#!":              "text/x-shellscript",
+	"#cloud-boothook": "text/cloud-boothook",
+	"#include":        "text/x-include-url",
+}
+
+// isCloudInit returns true if the user data of the operating system family
+// and format is run by cloud-init.
+func isCloudInit(osFamily infrav1.OSFamily, format infrav1.UserDataFormat) bool {
+	return (osFamily == "" || osFamily == infrav1.OSFamilyLinux) && (format == "" || format == infrav1.UserDataFormatCloudConfig || format == infrav1.UserDataFormatCloudConfigGzip)
+}
+
+// withBootPart returns the bootstrap data as MIME multi-part user data with
+// the part of the content type before it. Parts are added to user data that
+// was already combined by withBootPart. The feature adding the part is
+// named in errors.
+func withBootPart(data []byte, contentType, part, feature string) ([]byte, error) {
+	if bytes.HasPrefix(data, []byte(multipartHeader)) {
+		var buf bytes.Buffer
+		buf.WriteString(multipartHeader)
+		fmt.Fprintf(&buf, "--%s\nContent-Type: %s\n\n%s", multipartBoundary, contentType, part)
+		buf.Write(data[len(multipartHeader):])
+		return buf.Bytes(), nil
+	}
+	dataType := ""
+	for prefix, t := range userDataContentTypes {
+		if bytes.HasPrefix(data, []byte(prefix)) {
+			dataType = t
+		}
+	}
+	if dataType == "" {
+		return nil, errors.Errorf("%s cannot be combined with bootstrap data that is not a cloud-config or script", feature)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(multipartHeader)
+	fmt.Fprintf(&buf, "--%s\nContent-Type: %s\n\n%s", multipartBoundary, contentType, part)
+	fmt.Fprintf(&buf, "--%s\nContent-Type: %s\n\n", multipartBoundary, dataType)
+	buf.Write(data)
+	fmt.Fprintf(&buf, "\n--%s--\n", multipartBoundary)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,57 @@
+package pricing
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// Estimator estimates the hourly on-demand cost in USD of running an
+// instance type.
+type Estimator interface {
+	HourlyPrice(ctx context.Context, region, instanceType string, osFamily infrav1.OSFamily) (float64, error)
+}
+
+// ForProvider returns the Estimator configured for the provider, which is
+// the AWS Pricing API unless the provider has a static price sheet. A nil
+// provider uses the AWS Pricing API.
+func ForProvider(cfg *aws.Config, p *infrav1.AWSInfrastructureProvider) Estimator {
+	if p != nil && p.Spec.Pricing != nil && len(p.Spec.Pricing.StaticPrices) > 0 {
+		prices := make(StaticPrices)
+		for k, v := range p.Spec.Pricing.StaticPrices {
+			prices[k] = float64(v.MilliValue()) / 1000
+		}
+		return prices
+	}
+	return &AWSPricing{Config: cfg}
+}
+
+// AWSPricing estimates prices using the AWS Pricing API.
+type AWSPricing struct {
+	Config *aws.Config
+}
+
+func (p *AWSPricing) HourlyPrice(ctx context.Context, region, instanceType string, osFamily infrav1.OSFamily) (float64, error) {
+	os := "Linux"
+	if osFamily == infrav1.OSFamilyWindows {
+		os = "Windows"
+	}
+	return awsutil.DescribeOnDemandPrice(ctx, p.Config, region, instanceType, os)
+}
+
+// StaticPrices is a price sheet of hourly prices by instance type, for
+// accounts without access to the AWS Pricing API. The same prices are used
+// for every region and operating system.
+type StaticPrices map[string]float64
+
+func (p StaticPrices) HourlyPrice(ctx context.Context, region, instanceType string, osFamily infrav1.OSFamily) (float64, error) {
+	price, ok := p[instanceType]
+	if !ok {
+		return 0, errors.Errorf("cannot find price for instance type: %#v", instanceType)
+	}
+	return price, nil
+}
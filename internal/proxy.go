@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// defaultNoProxy are always reached directly, since the kubelet and
+// cloud-init cannot reach the instance metadata service through a proxy.
+var defaultNoProxy = []string{"localhost", "127.0.0.1", "169.254.169.254"}
+
+// proxyUnits are the services the proxy environment is set for.
+var proxyUnits = []string{"containerd", "kubelet"}
+
+// WithProxy returns the bootstrap data combined with a boothook setting the
+// proxy environment of containerd, the kubelet and login shells, as MIME
+// multi-part user data. Boothooks run before the bootstrap data, so that
+// containerd is restarted with the proxy before images are pulled. Only
+// Linux cloud-init user data can be combined.
+func WithProxy(proxy *infrav1.Proxy, osFamily infrav1.OSFamily, format infrav1.UserDataFormat, data []byte) ([]byte, error) {
+	if proxy == nil || (proxy.HTTPProxy == "" && proxy.HTTPSProxy == "") {
+		return data, nil
+	}
+	if !isCloudInit(osFamily, format) {
+		return nil, errors.New("proxy requires Linux cloud-init user data")
+	}
+	env, err := proxyEnvironment(proxy)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\nset -e\n")
+	for _, unit := range proxyUnits {
+		dir := fmt.Sprintf("/etc/systemd/system/%s.service.d", unit)
+		fmt.Fprintf(&b, "mkdir -p %s\ncat > %s/http-proxy.conf <<'EOF'\n[Service]\n", dir, dir)
+		for _, v := range env {
+			fmt.Fprintf(&b, "Environment=\"%s\"\n", v)
+		}
+		b.WriteString("EOF\n")
+	}
+	// boothooks run on every boot, so the previous proxy is replaced
+	b.WriteString("sed -i '/^\\(https\\?\\|no\\)_proxy=/Id' /etc/environment\ncat >> /etc/environment <<'EOF'\n")
+	for _, v := range env {
+		b.WriteString(v + "\n")
+	}
+	b.WriteString("EOF\nsystemctl daemon-reload\nsystemctl --no-block try-restart containerd.service\n")
+	return withBootPart(data, "text/cloud-boothook", b.String(), "proxy")
+}
+
+// proxyEnvironment returns the proxy environment variables, in upper and
+// lower case since programs disagree on which they read.
+func proxyEnvironment(proxy *infrav1.Proxy) ([]string, error) {
+	noProxy := append([]string(nil), defaultNoProxy...)
+	for _, h := range proxy.NoProxy {
+		if !containsString(noProxy, h) {
+			noProxy = append(noProxy, h)
+		}
+	}
+	vars := []struct{ name, value string }{
+		{"HTTP_PROXY", proxy.HTTPProxy},
+		{"HTTPS_PROXY", proxy.HTTPSProxy},
+		{"NO_PROXY", strings.Join(noProxy, ",")},
+	}
+	env := make([]string, 0, 2*len(vars))
+	for _, v := range vars {
+		if v.value == "" {
+			continue
+		}
+		// values are written unquoted to /etc/environment and within
+		// quotes to systemd units, which expand specifiers
+		if strings.ContainsAny(v.value, " \t\r\n\"'\\$%`") {
+			return nil, errors.Errorf("proxy value %q contains whitespace, quotes or special characters", v.value)
+		}
+		env = append(env, v.name+"="+v.value, strings.ToLower(v.name)+"="+v.value)
+	}
+	return env, nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
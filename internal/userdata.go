@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+)
+
+// EncodeUserData converts raw bootstrap data into the base64 encoded user
+// data expected by EC2 for the given format, which defaults to the encoding
+// of the operating system family.
+func EncodeUserData(osFamily infrav1.OSFamily, format infrav1.UserDataFormat, data []byte) (string, error) {
+	data, err := userDataAsRun(osFamily, format, data)
+	if err != nil {
+		return "", err
+	}
+	gzipped := isGzipped(osFamily, format)
+	if gzipped {
+		data, err = Gzip(data)
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(data) > MaxUserDataSize {
+		return "", userDataSizeError(osFamily, format, len(data), gzipped)
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// MaxUserDataSize is the most bytes of user data EC2 accepts, before base64
+// encoding.
+const MaxUserDataSize = 16384
+
+// userDataSizeError describes user data over MaxUserDataSize, suggesting
+// how it can be made to fit.
+func userDataSizeError(osFamily infrav1.OSFamily, format infrav1.UserDataFormat, size int, gzipped bool) error {
+	msg := fmt.Sprintf("user data is %d bytes", size)
+	if gzipped {
+		msg += " after gzip"
+	}
+	msg += fmt.Sprintf(", over the EC2 limit of %d bytes", MaxUserDataSize)
+	if !gzipped && isCloudInit(osFamily, format) {
+		return errors.Errorf("%s: set userDataFormat to %s to compress it, or fetch large files at boot instead of embedding them", msg, infrav1.UserDataFormatCloudConfigGzip)
+	}
+	return errors.Errorf("%s: fetch large files at boot instead of embedding them in the bootstrap data", msg)
+}
+
+// userDataAsRun returns the bootstrap data as it is run on an instance of
+// the operating system family. Bootstrap data is translated into the native
+// format of operating systems without cloud-init unless a format is set.
+func userDataAsRun(osFamily infrav1.OSFamily, format infrav1.UserDataFormat, data []byte) ([]byte, error) {
+	if format != "" {
+		return data, nil
+	}
+	switch osFamily {
+	case infrav1.OSFamilyWindows:
+		return wrapPowerShell(data), nil
+	case infrav1.OSFamilyBottlerocket:
+		return BottlerocketSettings(data)
+	case infrav1.OSFamilyFlatcar:
+		return IgnitionConfig(data)
+	default:
+		return data, nil
+	}
+}
+
+// isGzipped returns true if user data of the format is gzipped.
+func isGzipped(osFamily infrav1.OSFamily, format infrav1.UserDataFormat) bool {
+	if format == "" {
+		return osFamily == "" || osFamily == infrav1.OSFamilyLinux
+	}
+	return format == infrav1.UserDataFormatCloudConfigGzip
+}
+
+// wrapPowerShell encloses the data in <powershell> tags unless it already
+// contains them, since EC2Launch does not decompress user data and only
+// executes scripts enclosed in <powershell> tags.
+func wrapPowerShell(data []byte) []byte {
+	if bytes.Contains(data, []byte("<powershell>")) {
+		return data
+	}
+	return append(append([]byte("<powershell>\n"), data...), []byte("\n</powershell>")...)
+}
+
+// DecodeUserData returns the user data of an instance as it is run,
+// decompressing gzipped user data.
+func DecodeUserData(osFamily infrav1.OSFamily, format infrav1.UserDataFormat, data []byte) ([]byte, error) {
+	if !isGzipped(osFamily, format) {
+		return data, nil
+	}
+	return gunzip(data)
+}
+
+// UserDataHash returns the hex encoded SHA-256 of bootstrap data as it is
+// run on an instance of the operating system family, so that bootstrap data
+// can be compared with the decoded user data of an instance.
+func UserDataHash(osFamily infrav1.OSFamily, format infrav1.UserDataFormat, data []byte) string {
+	if run, err := userDataAsRun(osFamily, format, data); err == nil {
+		data = run
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -3,6 +3,7 @@ package internal
 import (
 	"bytes"
 	"compress/gzip"
+	"io/ioutil"
 )
 
 func Gzip(data []byte) ([]byte, error) {
@@ -16,3 +17,12 @@ func Gzip(data []byte) ([]byte, error) {
 	}
 	return b.Bytes(), nil
 }
+
+func gunzip(data []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	return ioutil.ReadAll(gr)
+}
@@ -0,0 +1,60 @@
+package version
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// The build of the controller, set at build time with -ldflags, e.g.
+// -X github.com/criticalstack/machine-api-provider-aws/internal/version.Version=v0.1.0,
+// see the Makefile.
+var (
+	Version   = "dev"
+	GitCommit = ""
+	BuildDate = ""
+)
+
+// Info describes the build of the controller.
+type Info struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+}
+
+// Get returns the build of the running controller.
+func Get() Info {
+	return Info{
+		Version:   Version,
+		GitCommit: GitCommit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+func (i Info) String() string {
+	s := "machine-api-provider-aws " + i.Version
+	if i.GitCommit != "" {
+		s += fmt.Sprintf(" (%s)", i.GitCommit)
+	}
+	if i.BuildDate != "" {
+		s += " built " + i.BuildDate
+	}
+	return s + fmt.Sprintf(" %s %s", i.GoVersion, i.Platform)
+}
+
+var buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "mapa_build_info",
+	Help: "Build of the controller, always 1.",
+}, []string{"version", "git_commit", "go_version"})
+
+func init() {
+	metrics.Registry.MustRegister(buildInfo)
+	i := Get()
+	buildInfo.WithLabelValues(i.Version, i.GitCommit, i.GoVersion).Set(1)
+}
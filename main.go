@@ -17,19 +17,38 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	machinev1alpha1 "github.com/criticalstack/machine-api/api/v1alpha1"
+	"go.opentelemetry.io/otel/exporters/trace/jaeger"
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	infrastructurev1alpha1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	infrastructurev1alpha2 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha2"
 	"github.com/criticalstack/machine-api-provider-aws/controllers"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+	"github.com/criticalstack/machine-api-provider-aws/internal/version"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -42,6 +61,7 @@ func init() {
 	_ = clientgoscheme.AddToScheme(scheme)
 
 	_ = infrastructurev1alpha1.AddToScheme(scheme)
+	_ = infrastructurev1alpha2.AddToScheme(scheme)
 	_ = machinev1alpha1.AddToScheme(scheme)
 	// +kubebuilder:scaffold:scheme
 }
@@ -49,61 +69,758 @@ func init() {
 func main() {
 	var metricsAddr string
 	var awsMachineConcurrency int
+	var awsMachineRefreshConcurrency int
+	var awsMachineNamespaceConcurrency int
+	var awsMachineStatusConcurrency int
+	var statusQPS float64
+	var statusBurst int
 	var nodeConcurrency int
 	var enableLeaderElection bool
+	var enableAWSMachineController bool
+	var enableNodeController bool
+	var enableProviderController bool
+	var enableCredentialsController bool
+	var enableRefreshController bool
+	var enableMachinePoolController bool
+	var enableWebhooks bool
+	var enablePprof bool
+	var enableConfigz bool
+	var deleteNodes bool
+	var printVersion bool
+	var defaultTags string
+	var watchFilter string
+	var clusterName string
+	var clusterAPIContract bool
+	var defaultRegion string
+	var awsProfile string
+	var leaderElectionNamespace string
+	var jaegerEndpoint string
+	var recommendationInterval time.Duration
+	var eventPollInterval time.Duration
+	var statusSyncPeriod time.Duration
+	var eventDrainLeadTime time.Duration
+	var configRequeueInterval time.Duration
+	var deleteRequeueInterval time.Duration
+	var deleteTimeout time.Duration
+	var reconcileTimeout time.Duration
+	var awsCallTimeout time.Duration
+	var shutdownGracePeriod time.Duration
+	var capacityCooldown time.Duration
+	var launchBatchWindow time.Duration
+	var launchBatchSize int
+	var terminateBatchWindow time.Duration
+	var launchBackoffBase time.Duration
+	var launchBackoffMax time.Duration
+	var maxLaunchAttempts int
+	var transportOpts awsutil.TransportOptions
+	var instanceStateQueueURL string
+	var decisionEventBus string
+	var decisionLogGroup string
+	var consolidationInterval time.Duration
+	var inventoryInterval time.Duration
+	var inventoryFormat string
+	var inventoryBucket string
+	var inventoryKey string
+	var inventoryConfigMap string
+	var decommissionWebhookURL string
+	var decommissionWebhookTimeout time.Duration
+	var decommissionWebhookRetries int
+	var leaderElectionID string
+	var rateLimiterBaseDelay time.Duration
+	var rateLimiterMaxDelay time.Duration
+	var rateLimiterQPS float64
+	var rateLimiterBucketSize int
+	var ec2QPS float64
+	var ec2Burst int
+	var autoscalingQPS float64
+	var autoscalingBurst int
+	var cloudwatchQPS float64
+	var cloudwatchBurst int
+	var servicequotasQPS float64
+	var servicequotasBurst int
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8081", "The address the metric endpoint binds to.")
 	flag.IntVar(&awsMachineConcurrency, "awsmachine-concurrency", 10,
 		"Number of machines to process simultaneously")
+	flag.IntVar(&awsMachineRefreshConcurrency, "awsmachine-refresh-concurrency", 0,
+		"Number of ready machines whose status may be refreshed simultaneously, "+
+			"leaving the remaining workers for creating and deleting machines. Defaults to half of --awsmachine-concurrency.")
+	flag.IntVar(&awsMachineNamespaceConcurrency, "awsmachine-namespace-concurrency", 0,
+		"Number of workers the AWSMachines of a single namespace may use simultaneously, so that a scale-up in one namespace "+
+			"does not delay the machines of other namespaces. Unlimited when 0.")
+	flag.IntVar(&awsMachineStatusConcurrency, "awsmachine-status-concurrency", 0,
+		"Number of ready machines whose status is refreshed simultaneously in a work queue separate from creating and deleting machines, "+
+			"instead of sharing the --awsmachine-concurrency workers. Disabled when 0.")
 	flag.IntVar(&nodeConcurrency, "node-concurrency", 10,
 		"Number of nodes to process simultaneously")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&enableAWSMachineController, "enable-awsmachine-controller", true,
+		"Enable the AWSMachine controller, which launches and terminates instances.")
+	flag.BoolVar(&enableNodeController, "enable-node-controller", true,
+		"Enable the Node controller, which adopts nodes of EC2 instances without an AWSMachine "+
+			"and links nodes to their Machines.")
+	flag.BoolVar(&enableProviderController, "enable-provider-controller", true,
+		"Enable the AWSInfrastructureProvider controller, which resolves provider regions and maintains warm pools.")
+	flag.BoolVar(&enableCredentialsController, "enable-credentials-controller", true,
+		"Enable the AWSCredentials controller, which validates AWS credentials.")
+	flag.BoolVar(&enableRefreshController, "enable-refresh-controller", false,
+		"Enable the AWSMachineRefresh controller for rolling AMI updates across machines.")
+	flag.BoolVar(&enableMachinePoolController, "enable-machine-pool-controller", false,
+		"Enable the AWSMachinePool controller, which rolls template changes out to Auto Scaling groups with instance refreshes.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", false,
+		"Serve the AWSMachine conversion, defaulting and validating webhooks and the Node owner validating webhook on port 9443. Requires serving certificates in "+
+			"/tmp/k8s-webhook-server/serving-certs.")
+	flag.BoolVar(&enablePprof, "enable-pprof", false,
+		"Serve the net/http/pprof profiles under /debug/pprof/ on the metrics address. Controller work queue depth and latency are "+
+			"always exported as workqueue_* metrics labeled with the name of the controller.")
+	flag.BoolVar(&enableConfigz, "enable-configz", false,
+		"Serve the build, flags, region and credential source of the controller as JSON under /configz on the metrics address.")
+	flag.BoolVar(&printVersion, "version", false, "Print the version of the controller and exit.")
+	flag.BoolVar(&deleteNodes, "delete-nodes", false,
+		"Delete the Node of a deleted AWSMachine once its instance has terminated, instead of leaving Node cleanup to the kubelet "+
+			"or the node lifecycle controller.")
+	flag.StringVar(&defaultTags, "default-tags", os.Getenv("DEFAULT_AWS_TAGS"),
+		"Comma-separated key=value tags applied to every AWS resource the controller creates. "+
+			"These override tags set on AWSMachines and AWSInfrastructureProviders. Defaults to $DEFAULT_AWS_TAGS.")
+	flag.StringVar(&watchFilter, "watch-filter", "",
+		"Label selector restricting the controller to matching AWSMachines, AWSMachineRefreshes, AWSMachinePools and AWSInfrastructureProviders. "+
+			"Used to shard objects across multiple controller instances, e.g. by region or AWS account. The Node controller "+
+			"of a filtered instance does not adopt nodes without an AWSMachine, which is left to an unfiltered instance.")
+	flag.StringVar(&clusterName, "cluster-name", "",
+		"Name of the cluster. When set, the Node controller only adopts nodes whose instances are tagged "+
+			"kubernetes.io/cluster/<name>, so that nodes of another cluster sharing the API server are left alone.")
+	flag.BoolVar(&clusterAPIContract, "cluster-api-contract", false,
+		"Also accept AWSMachines owned by upstream Cluster API (cluster.x-k8s.io) Machines, "+
+			"launching them with the bootstrap data secret of their Machine.")
+	flag.StringVar(&leaderElectionID, "leader-election-id", "",
+		"Name of the leader election lock. Each shard selected with --watch-filter needs its own. "+
+			"Defaults to "+leaderElectionIDBase+" whenever --enable-awsmachine-controller is set, or to a lock of "+
+			"the node controller when only --enable-node-controller is set, so that node adoption can run in a "+
+			"separate deployment.")
+	flag.StringVar(&leaderElectionNamespace, "leader-election-namespace", "",
+		"Namespace of the leader election lock. Required with --enable-leader-election when running outside of a cluster.")
+	flag.DurationVar(&rateLimiterBaseDelay, "rate-limiter-base-delay", 5*time.Millisecond,
+		"Initial per-item delay when requeueing a failed reconcile, doubled on each failure.")
+	flag.DurationVar(&rateLimiterMaxDelay, "rate-limiter-max-delay", 1000*time.Second,
+		"Maximum per-item delay when requeueing a failed reconcile.")
+	flag.Float64Var(&rateLimiterQPS, "rate-limiter-qps", 10,
+		"Overall rate at which each controller requeues items.")
+	flag.IntVar(&rateLimiterBucketSize, "rate-limiter-bucket-size", 100,
+		"Burst size of the overall requeue rate limit of each controller.")
+	flag.Float64Var(&ec2QPS, "ec2-qps", 0,
+		"Maximum EC2 API requests per second across all controllers. Unlimited when 0.")
+	flag.IntVar(&ec2Burst, "ec2-burst", 10,
+		"Burst size of the EC2 API rate limit.")
+	flag.Float64Var(&autoscalingQPS, "autoscaling-qps", 0,
+		"Maximum Auto Scaling API requests per second across all controllers. Unlimited when 0.")
+	flag.IntVar(&autoscalingBurst, "autoscaling-burst", 10,
+		"Burst size of the Auto Scaling API rate limit.")
+	flag.Float64Var(&cloudwatchQPS, "cloudwatch-qps", 0,
+		"Maximum CloudWatch API requests per second across all controllers. Unlimited when 0.")
+	flag.IntVar(&cloudwatchBurst, "cloudwatch-burst", 10,
+		"Burst size of the CloudWatch API rate limit.")
+	flag.Float64Var(&servicequotasQPS, "servicequotas-qps", 0,
+		"Maximum Service Quotas API requests per second across all controllers. Unlimited when 0.")
+	flag.IntVar(&servicequotasBurst, "servicequotas-burst", 10,
+		"Burst size of the Service Quotas API rate limit.")
+	flag.Float64Var(&statusQPS, "status-qps", 0,
+		"Maximum AWS API requests per second made by the status workers enabled with --awsmachine-status-concurrency, "+
+			"which are not counted against the limits of the services. Unlimited when 0.")
+	flag.IntVar(&statusBurst, "status-burst", 10,
+		"Burst size of the status rate limit.")
+	flag.StringVar(&defaultRegion, "default-region", os.Getenv("AWS_REGION"),
+		"Region used when neither an AWSMachine nor its provider sets one. "+
+			"Defaults to $AWS_REGION, and then to the region the controller runs in.")
+	flag.StringVar(&defaultRegion, "aws-region", os.Getenv("AWS_REGION"),
+		"Alias of --default-region. Set when running the controller outside of EC2, "+
+			"where the region cannot be determined from instance metadata.")
+	flag.StringVar(&awsProfile, "aws-profile", "",
+		"Shared config profile (e.g. an SSO profile) to use for AWS requests instead of the default credential chain, "+
+			"for running the controller locally. --default-region defaults to the region of the profile.")
+	flag.StringVar(&jaegerEndpoint, "jaeger-endpoint", "",
+		"Jaeger collector endpoint (e.g. http://jaeger-collector:14268/api/traces) to export provisioning traces to. Tracing is disabled when empty.")
+	flag.StringVar(&decommissionWebhookURL, "decommission-webhook-url", "",
+		"URL notified with a POST before the instance of a deleted AWSMachine is terminated. "+
+			"Termination waits until the webhook returns a 2xx response.")
+	flag.DurationVar(&decommissionWebhookTimeout, "decommission-webhook-timeout", 10*time.Second,
+		"Timeout of each call to the decommissioning webhook.")
+	flag.IntVar(&decommissionWebhookRetries, "decommission-webhook-retries", 3,
+		"Number of times a failed call to the decommissioning webhook is retried before deletion is requeued.")
+	flag.DurationVar(&recommendationInterval, "recommendation-interval", 0,
+		"How often the CloudWatch utilization of ready machines is evaluated for instance type recommendations, e.g. 6h. Disabled when 0.")
+	flag.DurationVar(&eventPollInterval, "event-poll-interval", 0,
+		"How often ready machines are checked for EC2 scheduled events and spot interruptions, e.g. 1m. Disabled when 0.")
+	flag.DurationVar(&statusSyncPeriod, "status-sync-period", 10*time.Minute,
+		"How often the instance status of ready machines is refreshed, jittered by up to 20%. Disabled when 0.")
+	flag.DurationVar(&eventDrainLeadTime, "event-drain-lead-time", 30*time.Minute,
+		"How long before a scheduled event the node of a machine is drained.")
+	flag.DurationVar(&configRequeueInterval, "config-requeue-interval", 5*time.Second,
+		"How often a machine checks whether its Cluster API bootstrap config or launch group is ready. Machine API Configs are watched instead. Can be overridden by the provider.")
+	flag.DurationVar(&deleteRequeueInterval, "delete-requeue-interval", 10*time.Second,
+		"How often a deleted machine checks whether its instance has terminated. Can be overridden by the provider.")
+	flag.DurationVar(&deleteTimeout, "delete-timeout", time.Hour,
+		"How long a deleted machine waits for its instance to terminate before it is marked failed. "+
+			"Waits forever when 0. Can be overridden by the provider.")
+	flag.DurationVar(&reconcileTimeout, "reconcile-timeout", 5*time.Minute,
+		"How long a single reconcile may take before its AWS requests are canceled and it is retried. Unbounded when 0.")
+	flag.DurationVar(&shutdownGracePeriod, "shutdown-grace-period", 30*time.Second,
+		"How long the controller waits on shutdown for in-flight AWSMachine reconciles, such as launches and terminations, "+
+			"to finish and record their results. Should be less than the termination grace period of the pod.")
+	flag.DurationVar(&awsCallTimeout, "aws-call-timeout", time.Minute,
+		"How long a single AWS request may take, including retries and rate limiting. Unbounded when 0.")
+	flag.DurationVar(&capacityCooldown, "capacity-cooldown", awsutil.DefaultCapacityCooldown,
+		"How long launches avoid an availability zone for an instance type after it ran out of capacity.")
+	flag.DurationVar(&launchBatchWindow, "launch-batch-window", 0,
+		"How long launches are collected so that identical instances are launched in a single RunInstances call, "+
+			"e.g. 2s. Only machines with identical specs and bootstrap data are batched. Disabled when 0.")
+	flag.IntVar(&launchBatchSize, "launch-batch-size", 50,
+		"Maximum number of instances launched in a single RunInstances call. "+
+			"Batches are also bounded by --awsmachine-concurrency.")
+	flag.DurationVar(&terminateBatchWindow, "terminate-batch-window", 0,
+		"How long terminations are collected so that instances in the same region are terminated in a single "+
+			"TerminateInstances call of up to 1000 instances, e.g. 2s, for deleting many machines at once. Disabled when 0.")
+	flag.DurationVar(&launchBackoffBase, "launch-backoff-base", 10*time.Second,
+		"How long a machine waits before retrying a failed launch. The wait doubles with each consecutive failure.")
+	flag.DurationVar(&launchBackoffMax, "launch-backoff-max", 10*time.Minute,
+		"Maximum wait between attempts to launch a machine.")
+	flag.IntVar(&maxLaunchAttempts, "max-launch-attempts", 10,
+		"How many consecutive launches of a machine may fail before the machine is marked failed. Unlimited when 0.")
+	flag.StringVar(&transportOpts.HTTPSProxy, "https-proxy", "",
+		"URL of the proxy AWS requests are sent through. Defaults to $HTTPS_PROXY.")
+	flag.StringVar(&transportOpts.NoProxy, "no-proxy", "",
+		"Comma-separated hosts, domains and CIDRs AWS requests to which are not proxied. Defaults to $NO_PROXY.")
+	flag.StringVar(&instanceStateQueueURL, "instance-state-queue-url", "",
+		"URL of an SQS queue receiving EC2 instance state change notifications from an EventBridge rule. "+
+			"AWSMachines are reconciled as soon as their instances change state. Disabled when empty.")
+	flag.StringVar(&decisionEventBus, "decision-event-bus", "",
+		"Name or ARN of an EventBridge event bus the provisioning decisions of the AWSMachine controller are put on, "+
+			"e.g. where instances were launched and why launches failed. Disabled when empty.")
+	flag.StringVar(&decisionLogGroup, "decision-log-group", "",
+		"Name of a CloudWatch Logs group the provisioning decisions of the AWSMachine controller are written to, "+
+			"in a log stream named after the controller. Disabled when empty.")
+	flag.DurationVar(&consolidationInterval, "consolidation-interval", 0,
+		"How often the machines of each provider namespace are evaluated for consolidation onto fewer machines. "+
+			"Machines are only deleted when the provider enables it. Disabled when 0.")
+	flag.DurationVar(&inventoryInterval, "inventory-interval", 0,
+		"How often a snapshot of all AWSMachines is exported to the inventory S3 object and/or ConfigMap. Disabled when 0.")
+	flag.StringVar(&inventoryFormat, "inventory-format", controllers.InventoryFormatJSON,
+		"Format of the exported inventory, json or csv.")
+	flag.StringVar(&inventoryBucket, "inventory-bucket", "",
+		"S3 bucket the inventory is exported to.")
+	flag.StringVar(&inventoryKey, "inventory-key", "",
+		"Key of the S3 object the inventory is exported to. Defaults to awsmachines.json or awsmachines.csv.")
+	flag.StringVar(&inventoryConfigMap, "inventory-configmap", "",
+		"ConfigMap the inventory is exported to, as namespace/name.")
+	flag.StringVar(&transportOpts.CABundle, "ca-bundle", "",
+		"Path of a PEM bundle of certificate authorities trusted for AWS requests in addition to the system roots, "+
+			"e.g. mounted from a secret.")
+	opts := zap.Options{}
+	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
 
-	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+	if printVersion {
+		fmt.Println(version.Get())
+		os.Exit(0)
+	}
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	tags, err := parseTags(defaultTags)
+	if err != nil {
+		setupLog.Error(err, "invalid default tags")
+		os.Exit(1)
+	}
+	awsutil.DefaultTags = tags
+	httpClient, err := awsutil.NewHTTPClient(transportOpts)
+	if err != nil {
+		setupLog.Error(err, "invalid AWS transport options")
+		os.Exit(1)
+	}
+	awsutil.HTTPClient = httpClient
+	awsutil.CallTimeout = awsCallTimeout
+	awsutil.Capacity.Cooldown = capacityCooldown
+	if awsProfile != "" {
+		region, err := awsutil.SetProfile(awsProfile)
+		if err != nil {
+			setupLog.Error(err, "cannot load AWS profile", "profile", awsProfile)
+			os.Exit(1)
+		}
+		if defaultRegion == "" {
+			defaultRegion = region
+		}
+	}
+	awsutil.DefaultRegion = defaultRegion
+	if hostname, err := os.Hostname(); err == nil {
+		awsutil.ControllerIdentity = hostname
+	}
+	if awsMachineRefreshConcurrency <= 0 {
+		awsMachineRefreshConcurrency = awsMachineConcurrency / 2
+		if awsMachineRefreshConcurrency < 1 {
+			awsMachineRefreshConcurrency = 1
+		}
+	}
+	runtimeConfig := newRuntimeConfig()
+	setupLog.Info("effective configuration", "version", runtimeConfig.Version.Version, "gitCommit", runtimeConfig.Version.GitCommit,
+		"region", awsutil.DefaultRegion, "flags", runtimeConfig.Flags)
+
+	awsutil.SetEC2RateLimit(ec2QPS, ec2Burst)
+	awsutil.SetAutoscalingRateLimit(autoscalingQPS, autoscalingBurst)
+	awsutil.SetCloudWatchRateLimit(cloudwatchQPS, cloudwatchBurst)
+	awsutil.SetServiceQuotasRateLimit(servicequotasQPS, servicequotasBurst)
+	awsutil.SetStatusRateLimit(statusQPS, statusBurst)
+	if launchBatchWindow > 0 {
+		awsutil.Batcher = awsutil.NewLaunchBatcher(launchBatchWindow, launchBatchSize)
+	}
+	if terminateBatchWindow > 0 {
+		awsutil.Terminator = awsutil.NewTerminateBatcher(terminateBatchWindow)
+	}
+
+	// each controller gets its own rate limiter, since the limiter tracks
+	// per-item failures and the overall bucket is per workqueue
+	newRateLimiter := func() workqueue.RateLimiter {
+		return workqueue.NewMaxOfRateLimiter(
+			workqueue.NewItemExponentialFailureRateLimiter(rateLimiterBaseDelay, rateLimiterMaxDelay),
+			&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(rateLimiterQPS), rateLimiterBucketSize)},
+		)
+	}
+
+	var filter labels.Selector
+	if watchFilter != "" {
+		filter, err = labels.Parse(watchFilter)
+		if err != nil {
+			setupLog.Error(err, "invalid watch filter")
+			os.Exit(1)
+		}
+	}
+
+	if jaegerEndpoint != "" {
+		tp, err := jaeger.InstallNewPipeline(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(jaegerEndpoint)))
+		if err != nil {
+			setupLog.Error(err, "unable to configure tracing")
+			os.Exit(1)
+		}
+		defer func() {
+			_ = tp.Shutdown(context.Background())
+		}()
+	}
+
+	if leaderElectionID == "" {
+		leaderElectionID = defaultLeaderElectionID(enableAWSMachineController, enableNodeController)
+	}
+	setupLog.Info("leader election", "enabled", enableLeaderElection, "id", leaderElectionID)
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:             scheme,
-		MetricsBindAddress: metricsAddr,
-		Port:               9443,
-		LeaderElection:     enableLeaderElection,
-		LeaderElectionID:   "4466ae64.crit.sh",
+		Scheme:                  scheme,
+		MetricsBindAddress:      metricsAddr,
+		Port:                    9443,
+		LeaderElection:          enableLeaderElection,
+		LeaderElectionID:        leaderElectionID,
+		LeaderElectionNamespace: leaderElectionNamespace,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
-	if err = (&controllers.AWSMachineReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("AWSMachine"),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr, controller.Options{MaxConcurrentReconciles: awsMachineConcurrency}); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "AWSMachine")
-		os.Exit(1)
+	if enablePprof {
+		for path, h := range pprofHandlers {
+			if err := mgr.AddMetricsExtraHandler(path, h); err != nil {
+				setupLog.Error(err, "unable to serve profiles", "path", path)
+				os.Exit(1)
+			}
+		}
 	}
-	if err = (&controllers.NodeReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("Node"),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr, controller.Options{MaxConcurrentReconciles: nodeConcurrency}); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Node")
-		os.Exit(1)
+	if enableConfigz {
+		if err := mgr.AddMetricsExtraHandler("/configz", &configzHandler{config: *runtimeConfig}); err != nil {
+			setupLog.Error(err, "unable to serve configuration", "path", "/configz")
+			os.Exit(1)
+		}
 	}
-	if err = (&controllers.AWSInfrastructureProviderReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("AWSInfrastructureProvider"),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr, controller.Options{}); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "AWSInfrastructureProvider")
+
+	if err = controllers.IndexInstanceID(context.Background(), mgr.GetFieldIndexer()); err != nil {
+		setupLog.Error(err, "unable to index AWSMachines by instance ID")
 		os.Exit(1)
 	}
+
+	var stateChanges chan event.GenericEvent
+	if instanceStateQueueURL != "" && enableAWSMachineController {
+		stateChanges = make(chan event.GenericEvent)
+		if err = (&controllers.InstanceStateListener{
+			Client:   mgr.GetClient(),
+			Log:      ctrl.Log.WithName("controllers").WithName("InstanceStateListener"),
+			QueueURL: instanceStateQueueURL,
+			Events:   stateChanges,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create instance state listener")
+			os.Exit(1)
+		}
+	}
+	var decisions *controllers.DecisionPublisher
+	if (decisionEventBus != "" || decisionLogGroup != "") && enableAWSMachineController {
+		sinkcfg := &aws.Config{Region: aws.String(awsutil.DefaultRegion)}
+		decisions = &controllers.DecisionPublisher{
+			Log: ctrl.Log.WithName("controllers").WithName("DecisionPublisher"),
+		}
+		if decisionEventBus != "" {
+			decisions.Sink = awsutil.NewEventBridgeSink(sinkcfg, decisionEventBus)
+		}
+		if decisionLogGroup != "" {
+			stream := awsutil.ControllerIdentity
+			if stream == "" {
+				stream = "machine-api-provider-aws"
+			}
+			logs := awsutil.NewCloudWatchLogsSink(sinkcfg, decisionLogGroup, stream)
+			if decisions.Sink != nil {
+				decisions.Sink = awsutil.MultiDecisionSink{decisions.Sink, logs}
+			} else {
+				decisions.Sink = logs
+			}
+		}
+		if err = decisions.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create decision publisher")
+			os.Exit(1)
+		}
+	}
+	if enableAWSMachineController {
+		// both work queues learn of instance state changes when the status
+		// of ready machines is refreshed separately
+		var statusStateChanges <-chan event.GenericEvent
+		var machineStateChanges <-chan event.GenericEvent = stateChanges
+		if stateChanges != nil && awsMachineStatusConcurrency > 0 {
+			machineStateChanges, statusStateChanges = teeEvents(stateChanges)
+		}
+		awsMachineReconciler := &controllers.AWSMachineReconciler{
+			Client:                    mgr.GetClient(),
+			Log:                       ctrl.Log.WithName("controllers").WithName("AWSMachine"),
+			Scheme:                    mgr.GetScheme(),
+			WatchFilter:               filter,
+			MaxConcurrentRefreshes:    awsMachineRefreshConcurrency,
+			MaxConcurrentPerNamespace: awsMachineNamespaceConcurrency,
+			RecommendationInterval:    recommendationInterval,
+			EventPollInterval:         eventPollInterval,
+			StatusSyncPeriod:          statusSyncPeriod,
+			EventDrainLeadTime:        eventDrainLeadTime,
+			ConfigRequeueInterval:     configRequeueInterval,
+			DeleteRequeueInterval:     deleteRequeueInterval,
+			DeleteTimeout:             deleteTimeout,
+			ReconcileTimeout:          reconcileTimeout,
+			LaunchBackoffBase:         launchBackoffBase,
+			LaunchBackoffMax:          launchBackoffMax,
+			MaxLaunchAttempts:         maxLaunchAttempts,
+			ClusterAPIContract:        clusterAPIContract,
+			DeleteNodes:               deleteNodes,
+			Decommission: &controllers.DecommissionWebhook{
+				URL:     decommissionWebhookURL,
+				Timeout: decommissionWebhookTimeout,
+				Retries: decommissionWebhookRetries,
+			},
+			InstanceStateChanges: machineStateChanges,
+			Recorder:             mgr.GetEventRecorderFor("awsmachine-controller"),
+			Decisions:            decisions,
+		}
+		if err = awsMachineReconciler.SetupWithManager(mgr, controller.Options{MaxConcurrentReconciles: awsMachineConcurrency, RateLimiter: newRateLimiter()}); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "AWSMachine")
+			os.Exit(1)
+		}
+		if awsMachineStatusConcurrency > 0 {
+			if err = (&controllers.AWSMachineStatusReconciler{
+				AWSMachineReconciler: awsMachineReconciler,
+				InstanceStateChanges: statusStateChanges,
+			}).SetupWithManager(mgr, controller.Options{MaxConcurrentReconciles: awsMachineStatusConcurrency, RateLimiter: newRateLimiter()}); err != nil {
+				setupLog.Error(err, "unable to create controller", "controller", "AWSMachineStatus")
+				os.Exit(1)
+			}
+		}
+	}
+	if enableNodeController {
+		if err = (&controllers.NodeReconciler{
+			Client:           mgr.GetClient(),
+			Log:              ctrl.Log.WithName("controllers").WithName("Node"),
+			Scheme:           mgr.GetScheme(),
+			WatchFilter:      filter,
+			ClusterName:      clusterName,
+			ReconcileTimeout: reconcileTimeout,
+			Recorder:         mgr.GetEventRecorderFor("node-controller"),
+		}).SetupWithManager(mgr, controller.Options{MaxConcurrentReconciles: nodeConcurrency, RateLimiter: newRateLimiter()}); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Node")
+			os.Exit(1)
+		}
+	}
+	if enableProviderController {
+		if err = (&controllers.AWSInfrastructureProviderReconciler{
+			Client:           mgr.GetClient(),
+			Log:              ctrl.Log.WithName("controllers").WithName("AWSInfrastructureProvider"),
+			Scheme:           mgr.GetScheme(),
+			WatchFilter:      filter,
+			ReconcileTimeout: reconcileTimeout,
+			Recorder:         mgr.GetEventRecorderFor("awsinfrastructureprovider-controller"),
+		}).SetupWithManager(mgr, controller.Options{RateLimiter: newRateLimiter()}); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "AWSInfrastructureProvider")
+			os.Exit(1)
+		}
+	}
+	if enableCredentialsController {
+		if err = (&controllers.AWSCredentialsReconciler{
+			Client:           mgr.GetClient(),
+			Log:              ctrl.Log.WithName("controllers").WithName("AWSCredentials"),
+			Scheme:           mgr.GetScheme(),
+			WatchFilter:      filter,
+			ReconcileTimeout: reconcileTimeout,
+		}).SetupWithManager(mgr, controller.Options{RateLimiter: newRateLimiter()}); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "AWSCredentials")
+			os.Exit(1)
+		}
+	}
+	if enableRefreshController {
+		if err = (&controllers.AWSMachineRefreshReconciler{
+			Client:           mgr.GetClient(),
+			Log:              ctrl.Log.WithName("controllers").WithName("AWSMachineRefresh"),
+			Scheme:           mgr.GetScheme(),
+			WatchFilter:      filter,
+			ReconcileTimeout: reconcileTimeout,
+		}).SetupWithManager(mgr, controller.Options{RateLimiter: newRateLimiter()}); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "AWSMachineRefresh")
+			os.Exit(1)
+		}
+	}
+	if enableMachinePoolController {
+		if err = (&controllers.AWSMachinePoolReconciler{
+			Client:           mgr.GetClient(),
+			Log:              ctrl.Log.WithName("controllers").WithName("AWSMachinePool"),
+			Scheme:           mgr.GetScheme(),
+			Recorder:         mgr.GetEventRecorderFor("awsmachinepool-controller"),
+			WatchFilter:      filter,
+			ReconcileTimeout: reconcileTimeout,
+		}).SetupWithManager(mgr, controller.Options{RateLimiter: newRateLimiter()}); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "AWSMachinePool")
+			os.Exit(1)
+		}
+	}
+	if consolidationInterval > 0 {
+		if err = (&controllers.ConsolidationReconciler{
+			Client:      mgr.GetClient(),
+			Log:         ctrl.Log.WithName("controllers").WithName("Consolidation"),
+			Recorder:    mgr.GetEventRecorderFor("consolidation-controller"),
+			WatchFilter: filter,
+			Interval:    consolidationInterval,
+		}).SetupWithManager(mgr, controller.Options{RateLimiter: newRateLimiter()}); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Consolidation")
+			os.Exit(1)
+		}
+	}
+	if inventoryInterval > 0 {
+		exporter := &controllers.InventoryExporter{
+			Client:   mgr.GetClient(),
+			Log:      ctrl.Log.WithName("controllers").WithName("InventoryExporter"),
+			Interval: inventoryInterval,
+			Format:   inventoryFormat,
+			Bucket:   inventoryBucket,
+			Key:      inventoryKey,
+		}
+		if exporter.Key == "" {
+			exporter.Key = "awsmachines." + inventoryFormat
+		}
+		if inventoryConfigMap != "" {
+			parts := strings.SplitN(inventoryConfigMap, "/", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				setupLog.Error(fmt.Errorf("inventory ConfigMap %q must be in the form namespace/name", inventoryConfigMap), "invalid inventory ConfigMap")
+				os.Exit(1)
+			}
+			exporter.ConfigMap = types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+		}
+		if err = exporter.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create inventory exporter")
+			os.Exit(1)
+		}
+	}
+	if enableWebhooks {
+		if err = (&infrastructurev1alpha1.AWSMachine{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "AWSMachine")
+			os.Exit(1)
+		}
+		if err = (&controllers.AWSMachineDefaulter{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("webhooks").WithName("AWSMachineDefaulter"),
+		}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "AWSMachineDefaulter")
+			os.Exit(1)
+		}
+		if err = (&controllers.AWSMachineValidator{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("webhooks").WithName("AWSMachineValidator"),
+		}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "AWSMachineValidator")
+			os.Exit(1)
+		}
+		if err = (&controllers.NodeOwnerValidator{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("webhooks").WithName("NodeOwnerValidator"),
+		}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "NodeOwnerValidator")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		controllers.LogMissingPermissions(ctx, setupLog)
+	}()
+
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
+	setupLog.Info("waiting for in-flight reconciles and batches", "gracePeriod", shutdownGracePeriod)
+	if !controllers.DrainInflight(shutdownGracePeriod) {
+		setupLog.Info("shutdown grace period expired with reconciles in flight")
+	}
+}
+
+// leaderElectionIDBase is the leader election lock of deployments running
+// the AWSMachine controller.
+const leaderElectionIDBase = "4466ae64.crit.sh"
+
+// defaultLeaderElectionID returns the leader election lock of the enabled
+// controller group. Deployments running the AWSMachine controller always
+// take the lock of earlier releases, so that a deployment split off to only
+// provision machines never launches instances alongside a combined
+// deployment that is still running, e.g. during a rollout. Deployments that
+// only adopt nodes take a separate lock, allowing them to be active at the
+// same time.
+func defaultLeaderElectionID(machines, nodes bool) string {
+	if nodes && !machines {
+		return "4466ae64-nodes.crit.sh"
+	}
+	return leaderElectionIDBase
+}
+
+// pprofHandlers are the profiling handlers served with --enable-pprof. The
+// index serves the named profiles, e.g. /debug/pprof/goroutine.
+var pprofHandlers = map[string]http.Handler{
+	"/debug/pprof/":        http.HandlerFunc(pprof.Index),
+	"/debug/pprof/cmdline": http.HandlerFunc(pprof.Cmdline),
+	"/debug/pprof/profile": http.HandlerFunc(pprof.Profile),
+	"/debug/pprof/symbol":  http.HandlerFunc(pprof.Symbol),
+	"/debug/pprof/trace":   http.HandlerFunc(pprof.Trace),
+}
+
+// runtimeConfig is the effective configuration of the controller, logged at
+// startup and served under /configz with --enable-configz. The region and
+// credential source are only looked up for /configz.
+type runtimeConfig struct {
+	Version          version.Info      `json:"version"`
+	Flags            map[string]string `json:"flags"`
+	Region           string            `json:"region,omitempty"`
+	CredentialSource string            `json:"credentialSource,omitempty"`
+}
+
+// newRuntimeConfig returns the effective configuration after the flags are
+// parsed and defaulted and the AWS options are set. Credentials in flag
+// values are redacted, see redactFlagValue.
+func newRuntimeConfig() *runtimeConfig {
+	c := &runtimeConfig{
+		Version: version.Get(),
+		Flags:   make(map[string]string),
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		c.Flags[f.Name] = redactFlagValue(f.Value.String())
+	})
+	return c
+}
+
+// resolveAWS looks up the region and credential source of the controller,
+// returning false if either cannot be determined. They are left empty then,
+// since the controller may still get them from AWSMachines and credential
+// secrets.
+func (c *runtimeConfig) resolveAWS(ctx context.Context) bool {
+	region, err := awsutil.ResolveRegion("")
+	if err != nil {
+		setupLog.Info("no default AWS region", "reason", err.Error())
+		return false
+	}
+	c.Region = region
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	c.CredentialSource, err = awsutil.CredentialSource(ctx, region)
+	if err != nil {
+		setupLog.Info("no default AWS credentials", "reason", err.Error())
+		return false
+	}
+	return true
+}
+
+// redactFlagValue hides the user info and query of URL flag values, e.g. of
+// --https-proxy or --decommission-webhook-url, which may carry credentials
+// or tokens.
+func redactFlagValue(v string) string {
+	u, err := url.Parse(v)
+	if err != nil || u.Host == "" {
+		return v
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "REDACTED"
+	}
+	return u.String()
+}
+
+// configzHandler serves the runtime configuration under /configz. The
+// region and credential source may need instance metadata and STS, so they
+// are looked up on the first request instead of delaying startup, and again
+// by later requests until the lookup succeeds.
+type configzHandler struct {
+	mu       sync.Mutex
+	config   runtimeConfig
+	resolved bool
+}
+
+func (h *configzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	if !h.resolved {
+		h.resolved = h.config.resolveAWS(r.Context())
+	}
+	c := h.config
+	h.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(c)
+}
+
+// teeEvents sends each event received from in to both returned channels.
+func teeEvents(in <-chan event.GenericEvent) (<-chan event.GenericEvent, <-chan event.GenericEvent) {
+	a := make(chan event.GenericEvent)
+	b := make(chan event.GenericEvent)
+	go func() {
+		defer close(a)
+		defer close(b)
+		for e := range in {
+			a <- e
+			b <- e
+		}
+	}()
+	return a, b
+}
+
+// parseTags parses a comma-separated list of key=value pairs.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("tag %q must be in the form key=value", kv)
+		}
+		tags[parts[0]] = parts[1]
+	}
+	return tags, nil
 }
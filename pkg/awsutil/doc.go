@@ -0,0 +1,28 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package awsutil exposes the AWS helpers of the provider for other tools,
+// e.g. cluster installers and debugging CLIs, that need to find, launch or
+// inspect the instances of AWSMachines the way the provider does.
+//
+// The package follows the semantic version of the module. Exported
+// identifiers are not removed and their signatures and documented behavior
+// do not change incompatibly within a major version; while the module is
+// at v0, incompatible changes are only made in minor releases and are noted
+// in the release notes. Behavior that is not documented here, such as the
+// order of AWS API calls, retries and the tags added to resources other
+// than those of OwnerTags, may change in any release.
+package awsutil
@@ -0,0 +1,32 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package awsutil_test
+
+import (
+	"fmt"
+
+	"github.com/criticalstack/machine-api-provider-aws/pkg/awsutil"
+)
+
+func ExampleParseProviderID() {
+	p, err := awsutil.ParseProviderID("aws:///us-west-2c/i-0123456789abcdef0")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(p.Region, p.AvailabilityZone, p.InstanceID)
+	// Output: us-west-2 us-west-2c i-0123456789abcdef0
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package awsutil
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/pkg/errors"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	"github.com/criticalstack/machine-api-provider-aws/internal"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// Instances manages the instances of AWSMachines in a region.
+type Instances interface {
+	// Launch launches the instance of the machine with the bootstrap
+	// data, which is encoded for the OSFamily and UserDataFormat of the
+	// machine. The instance is tagged with OwnerTags.
+	Launch(ctx context.Context, m *infrav1.AWSMachine, bootstrapData []byte) (*ec2.Instance, error)
+
+	// Describe returns the instance, and false if it does not exist.
+	Describe(ctx context.Context, instanceID string) (*ec2.Instance, bool, error)
+
+	// DescribeByOwner returns the instances launched for the machine that
+	// are not terminated yet, as found by their OwnerTags.
+	DescribeByOwner(ctx context.Context, m *infrav1.AWSMachine) ([]*ec2.Instance, error)
+
+	// State returns the state of the instance, e.g. running. Instances
+	// that no longer exist are terminated.
+	State(ctx context.Context, instanceID string) (string, error)
+
+	// Reboot reboots the instance.
+	Reboot(ctx context.Context, instanceID string) error
+
+	// Terminate terminates the instance.
+	Terminate(ctx context.Context, instanceID string) error
+
+	// Subnets returns the subnets the instance of the machine may be
+	// launched in, as selected by the VPC and subnets of its spec.
+	// Machines attached to network interfaces have none. A
+	// *SubnetsExhaustedError is returned when every matching subnet was
+	// rejected, as it is by Launch.
+	Subnets(ctx context.Context, m *infrav1.AWSMachine) ([]*ec2.Subnet, error)
+}
+
+// SubnetsExhaustedError indicates that every subnet matching the machine was
+// rejected, e.g. because none has a free IP address.
+type SubnetsExhaustedError struct {
+	// VPCID is the VPC the subnets were selected from.
+	VPCID string
+
+	// Rejected are the subnets that were considered and why each was
+	// rejected.
+	Rejected []SubnetRejection
+}
+
+// SubnetRejection is a subnet that was rejected for a launch.
+type SubnetRejection struct {
+	SubnetID string
+	Reason   string
+}
+
+func (e *SubnetsExhaustedError) Error() string {
+	return fmt.Sprintf("cannot determine subnet from VPC: %#v: %s", e.VPCID, e.Rejections())
+}
+
+// Rejections describes each rejected subnet and why it was rejected.
+func (e *SubnetsExhaustedError) Rejections() string {
+	rejected := make([]string, 0, len(e.Rejected))
+	for _, r := range e.Rejected {
+		rejected = append(rejected, fmt.Sprintf("%s (%s)", r.SubnetID, r.Reason))
+	}
+	return strings.Join(rejected, ", ")
+}
+
+// subnetsExhausted converts the SubnetsExhaustedError of the internal
+// package, leaving other errors unchanged.
+func subnetsExhausted(err error) error {
+	var serr *awsutil.SubnetsExhaustedError
+	if !errors.As(err, &serr) {
+		return err
+	}
+	e := &SubnetsExhaustedError{VPCID: serr.VPCID}
+	for _, r := range serr.Rejected {
+		e.Rejected = append(e.Rejected, SubnetRejection{SubnetID: r.SubnetID, Reason: r.Reason})
+	}
+	return e
+}
+
+// NewInstances returns Instances using the AWS config, whose region must be
+// set.
+func NewInstances(cfg *aws.Config) Instances {
+	return &instances{cfg: cfg}
+}
+
+type instances struct {
+	cfg *aws.Config
+}
+
+func (i *instances) Launch(ctx context.Context, m *infrav1.AWSMachine, bootstrapData []byte) (*ec2.Instance, error) {
+	userData, err := internal.EncodeUserData(m.Spec.OSFamily, m.Spec.UserDataFormat, bootstrapData)
+	if err != nil {
+		return nil, err
+	}
+	instance, err := awsutil.LaunchInstance(ctx, i.cfg, m, userData)
+	if err != nil {
+		return nil, subnetsExhausted(err)
+	}
+	return instance, nil
+}
+
+func (i *instances) Describe(ctx context.Context, instanceID string) (*ec2.Instance, bool, error) {
+	return awsutil.DescribeInstance(ctx, i.cfg, instanceID)
+}
+
+func (i *instances) DescribeByOwner(ctx context.Context, m *infrav1.AWSMachine) ([]*ec2.Instance, error) {
+	return awsutil.DescribeInstancesByTag(ctx, i.cfg, awsutil.MachineUIDTagKey, string(m.UID))
+}
+
+func (i *instances) State(ctx context.Context, instanceID string) (string, error) {
+	return awsutil.DescribeInstanceStatus(ctx, i.cfg, instanceID)
+}
+
+func (i *instances) Reboot(ctx context.Context, instanceID string) error {
+	return awsutil.RebootInstance(ctx, i.cfg, instanceID)
+}
+
+func (i *instances) Terminate(ctx context.Context, instanceID string) error {
+	return awsutil.TerminateInstance(ctx, i.cfg, instanceID)
+}
+
+func (i *instances) Subnets(ctx context.Context, m *infrav1.AWSMachine) ([]*ec2.Subnet, error) {
+	subnets, err := awsutil.LaunchSubnets(ctx, i.cfg, m)
+	if err != nil {
+		return nil, subnetsExhausted(err)
+	}
+	return subnets, nil
+}
+
+// OwnerTags returns the tags identifying the AWSMachine that owns an
+// instance.
+func OwnerTags(m *infrav1.AWSMachine) map[string]string {
+	return awsutil.OwnerTags(m)
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package awsutil
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+func TestSubnetsExhausted(t *testing.T) {
+	err := errors.Wrap(&awsutil.SubnetsExhaustedError{
+		VPCID: "vpc-1",
+		Rejected: []awsutil.SubnetRejection{
+			{SubnetID: "subnet-1", Reason: "no free IP addresses"},
+			{SubnetID: "subnet-2", Reason: "not in availability zone us-east-1a"},
+		},
+	}, "cannot launch instance")
+
+	var serr *SubnetsExhaustedError
+	if !errors.As(subnetsExhausted(err), &serr) {
+		t.Fatalf("expected *SubnetsExhaustedError, got %T", subnetsExhausted(err))
+	}
+	expected := `cannot determine subnet from VPC: "vpc-1": subnet-1 (no free IP addresses), subnet-2 (not in availability zone us-east-1a)`
+	if serr.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, serr.Error())
+	}
+
+	other := errors.New("throttled")
+	if got := subnetsExhausted(other); got != other {
+		t.Errorf("expected other errors unchanged, got %v", got)
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package awsutil
+
+import (
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+// ProviderID is a parsed ProviderID of the form
+// aws:///<availability zone>/<instance ID>.
+type ProviderID struct {
+	// AvailabilityZone is the availability zone of the instance, e.g.
+	// us-east-1a.
+	AvailabilityZone string
+
+	// Region is the region of the availability zone, e.g. us-east-1.
+	Region string
+
+	// InstanceID is the ID of the instance, e.g. i-0123456789abcdef0.
+	InstanceID string
+}
+
+// ParseProviderID parses the ProviderID of a Machine or Node, deriving the
+// region from the availability zone.
+func ParseProviderID(s string) (*ProviderID, error) {
+	p, err := awsutil.ParseProviderID(s)
+	if err != nil {
+		return nil, err
+	}
+	return &ProviderID{
+		AvailabilityZone: p.AvailabilityZone,
+		Region:           p.Region,
+		InstanceID:       p.InstanceID,
+	}, nil
+}
+
+// VerifyProviderID returns true if s has the form of a ProviderID.
+func VerifyProviderID(s string) bool {
+	return awsutil.VerifyProviderID(s)
+}
+
+// IsEC2ProviderID returns true if the ProviderID is of an EC2 instance, as
+// opposed to e.g. a Fargate task or a node of another cloud provider.
+func IsEC2ProviderID(s string) bool {
+	return awsutil.IsEC2ProviderID(s)
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package awsutil
+
+import (
+	"testing"
+)
+
+func TestParseProviderID(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected *ProviderID
+	}{
+		{
+			name:  "instance",
+			input: "aws:///us-east-1a/i-0123456789abcdef0",
+			expected: &ProviderID{
+				AvailabilityZone: "us-east-1a",
+				Region:           "us-east-1",
+				InstanceID:       "i-0123456789abcdef0",
+			},
+		},
+		{
+			name:  "fargate",
+			input: "aws:///eu-west-2b/fargate-ip-10-0-1-2.eu-west-2.compute.internal",
+			expected: &ProviderID{
+				AvailabilityZone: "eu-west-2b",
+				Region:           "eu-west-2",
+				InstanceID:       "fargate-ip-10-0-1-2.eu-west-2.compute.internal",
+			},
+		},
+		{name: "empty", input: ""},
+		{name: "no scheme", input: "us-east-1a/i-0123456789abcdef0"},
+		{name: "trailing slash", input: "aws:///us-east-1a/i-0123456789abcdef0/"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := ParseProviderID(tc.input)
+			if tc.expected == nil {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *p != *tc.expected {
+				t.Errorf("expected %+v, got %+v", tc.expected, p)
+			}
+		})
+	}
+}
+
+func TestIsEC2ProviderID(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected bool
+	}{
+		{"aws:///us-east-1a/i-0123456789abcdef0", true},
+		{"aws:///us-east-1a/i-abc", true},
+		{"aws:///eu-west-2b/fargate-ip-10-0-1-2.eu-west-2.compute.internal", false},
+		{"aws:///us-east-1a/i-0123456789ABCDEF0", false},
+		{"gce://project/us-central1-a/i-0123456789abcdef0", false},
+		{"aws:///us-east-1a/i-0123456789abcdef0/", false},
+		{"", false},
+	}
+	for _, tc := range cases {
+		if got := IsEC2ProviderID(tc.input); got != tc.expected {
+			t.Errorf("IsEC2ProviderID(%q): expected %v, got %v", tc.input, tc.expected, got)
+		}
+	}
+}
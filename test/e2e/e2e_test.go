@@ -0,0 +1,344 @@
+//go:build e2e
+// +build e2e
+
+/*
+Copyright 2020 Critical Stack, LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package e2e runs AWSMachines against a real AWS account. The tests only
+// build with the e2e tag and are skipped unless E2E_AWS_REGION, E2E_AMI and
+// E2E_VPC_ID are set, using the default AWS credential chain:
+//
+//	E2E_AWS_REGION=us-east-1 E2E_AMI=ami-... E2E_VPC_ID=vpc-... make test-e2e
+//
+// Every instance launched is tagged with the run ID and terminated when the
+// tests finish, even if they fail.
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	machinev1 "github.com/criticalstack/machine-api/api/v1alpha1"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	infrav1 "github.com/criticalstack/machine-api-provider-aws/api/v1alpha1"
+	"github.com/criticalstack/machine-api-provider-aws/controllers"
+	awsutil "github.com/criticalstack/machine-api-provider-aws/internal/aws"
+)
+
+const (
+	// runTagKey tags every instance launched by a test run so that it can
+	// be cleaned up.
+	runTagKey = "machine-api-provider-aws/e2e-run"
+
+	// adoptTagKey tags the instance launched outside of the controller to
+	// test importing instances.
+	adoptTagKey = "machine-api-provider-aws/e2e-adopt"
+
+	namespace = "default"
+	timeout   = 10 * time.Minute
+	interval  = 10 * time.Second
+)
+
+type config struct {
+	region       string
+	ami          string
+	vpcID        string
+	subnetIDs    []string
+	instanceType string
+	runID        string
+}
+
+func loadConfig(t *testing.T) *config {
+	c := &config{
+		region:       os.Getenv("E2E_AWS_REGION"),
+		ami:          os.Getenv("E2E_AMI"),
+		vpcID:        os.Getenv("E2E_VPC_ID"),
+		instanceType: os.Getenv("E2E_INSTANCE_TYPE"),
+		runID:        fmt.Sprintf("e2e-%d", time.Now().Unix()),
+	}
+	if c.region == "" || c.ami == "" || c.vpcID == "" {
+		t.Skip("E2E_AWS_REGION, E2E_AMI and E2E_VPC_ID must be set to run e2e tests")
+	}
+	if s := os.Getenv("E2E_SUBNET_IDS"); s != "" {
+		c.subnetIDs = strings.Split(s, ",")
+	}
+	if c.instanceType == "" {
+		c.instanceType = "t3.micro"
+	}
+	return c
+}
+
+// machineAPICRDs returns the directory holding the machine-api CRDs in the
+// module cache.
+func machineAPICRDs(t *testing.T) string {
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", "github.com/criticalstack/machine-api").Output()
+	if err != nil {
+		t.Fatalf("cannot find machine-api module: %v", err)
+	}
+	return filepath.Join(strings.TrimSpace(string(out)), "config", "crd", "bases")
+}
+
+func TestLifecycle(t *testing.T) {
+	cfg := loadConfig(t)
+	g := NewGomegaWithT(t)
+	ctx := context.Background()
+	awscfg := &aws.Config{Region: aws.String(cfg.region)}
+	defer cleanup(t, awscfg, cfg.runID)
+
+	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+	testEnv := &envtest.Environment{
+		CRDDirectoryPaths: []string{
+			filepath.Join("..", "..", "config", "crd", "bases"),
+			machineAPICRDs(t),
+		},
+	}
+	restcfg, err := testEnv.Start()
+	g.Expect(err).NotTo(HaveOccurred())
+	defer func() {
+		if err := testEnv.Stop(); err != nil {
+			t.Errorf("cannot stop test environment: %v", err)
+		}
+	}()
+
+	scheme := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	g.Expect(infrav1.AddToScheme(scheme)).To(Succeed())
+	g.Expect(machinev1.AddToScheme(scheme)).To(Succeed())
+
+	mgr, err := ctrl.NewManager(restcfg, ctrl.Options{Scheme: scheme, MetricsBindAddress: "0"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect((&controllers.AWSMachineReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("AWSMachine"),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr, controller.Options{MaxConcurrentReconciles: 1})).To(Succeed())
+	g.Expect((&controllers.AWSInfrastructureProviderReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("AWSInfrastructureProvider"),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr, controller.Options{MaxConcurrentReconciles: 1})).To(Succeed())
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		if err := mgr.Start(stop); err != nil {
+			t.Errorf("manager stopped: %v", err)
+		}
+	}()
+	c := mgr.GetClient()
+
+	t.Run("launch", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		am := createMachine(ctx, g, c, cfg, "e2e-launch")
+
+		g.Eventually(func() (string, error) {
+			if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: am.Name}, am); err != nil {
+				return "", err
+			}
+			if am.Status.FailureMessage != nil {
+				return "", fmt.Errorf("machine failed: %s", *am.Status.FailureMessage)
+			}
+			return am.Status.InstanceState, nil
+		}, timeout, interval).Should(Equal(ec2.InstanceStateNameRunning))
+		g.Expect(am.Spec.ProviderID).NotTo(BeNil())
+		g.Expect(am.Status.Addresses).NotTo(BeEmpty())
+
+		p, err := awsutil.ParseProviderID(*am.Spec.ProviderID)
+		g.Expect(err).NotTo(HaveOccurred())
+		instance, exists, err := awsutil.DescribeInstance(ctx, awscfg, p.InstanceID)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(exists).To(BeTrue())
+		g.Expect(aws.StringValue(instance.ImageId)).To(Equal(cfg.ami))
+
+		t.Log("deleting the machine terminates the instance")
+		g.Expect(c.Delete(ctx, am)).To(Succeed())
+		g.Eventually(func() bool {
+			return apierrors.IsNotFound(c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: am.Name}, am))
+		}, timeout, interval).Should(BeTrue())
+		state, err := awsutil.DescribeInstanceStatus(ctx, awscfg, p.InstanceID)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(state).To(BeElementOf(ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameTerminated, ""))
+	})
+
+	t.Run("adopt", func(t *testing.T) {
+		g := NewGomegaWithT(t)
+		instanceID := launchUnmanagedInstance(ctx, g, awscfg, cfg)
+
+		ip := &infrav1.AWSInfrastructureProvider{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "e2e",
+				Namespace: namespace,
+				Annotations: map[string]string{
+					infrav1.ImportAnnotation: adoptTagKey + "=" + cfg.runID,
+				},
+			},
+			Spec: infrav1.AWSInfrastructureProviderSpec{Region: cfg.region},
+		}
+		g.Expect(c.Create(ctx, ip)).To(Succeed())
+
+		am := &infrav1.AWSMachine{}
+		g.Eventually(func() error {
+			return c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: instanceID}, am)
+		}, timeout, interval).Should(Succeed())
+		g.Expect(am.Spec.AMI).To(Equal(cfg.ami))
+		g.Expect(am.Spec.InstanceType).To(Equal(cfg.instanceType))
+		g.Expect(am.Spec.VPCID).To(Equal(cfg.vpcID))
+
+		instance, _, err := awsutil.DescribeInstance(ctx, awscfg, instanceID)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(tagValue(instance.Tags, awsutil.MachineUIDTagKey)).To(Equal(string(am.UID)))
+
+		g.Eventually(func() (bool, error) {
+			if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ip.Name}, ip); err != nil {
+				return false, err
+			}
+			_, ok := ip.Annotations[infrav1.ImportAnnotation]
+			return ok, nil
+		}, timeout, interval).Should(BeFalse())
+	})
+}
+
+// createMachine creates an AWSMachine owned by a Machine whose bootstrap
+// Config is already ready.
+func createMachine(ctx context.Context, g *GomegaWithT, c client.Client, cfg *config, name string) *infrav1.AWSMachine {
+	s := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name + "-bootstrap", Namespace: namespace},
+		Data:       map[string][]byte{"cloud-config": []byte("#cloud-config\n")},
+	}
+	g.Expect(c.Create(ctx, s)).To(Succeed())
+
+	mc := &machinev1.Config{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	g.Expect(c.Create(ctx, mc)).To(Succeed())
+	mc.Status.Ready = true
+	mc.Status.DataSecretName = pointer.StringPtr(s.Name)
+	g.Expect(c.Status().Update(ctx, mc)).To(Succeed())
+
+	m := &machinev1.Machine{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: machinev1.MachineSpec{
+			ConfigRef: corev1.ObjectReference{Name: mc.Name},
+			InfrastructureRef: corev1.ObjectReference{
+				APIVersion: infrav1.GroupVersion.String(),
+				Kind:       "AWSMachine",
+				Name:       name,
+				Namespace:  namespace,
+			},
+		},
+	}
+	g.Expect(c.Create(ctx, m)).To(Succeed())
+
+	am := &infrav1.AWSMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: machinev1.GroupVersion.String(),
+				Kind:       "Machine",
+				Name:       m.Name,
+				UID:        m.UID,
+			}},
+		},
+		Spec: infrav1.AWSMachineSpec{
+			AMI:          cfg.ami,
+			InstanceType: cfg.instanceType,
+			Region:       cfg.region,
+			VPCID:        cfg.vpcID,
+			SubnetIDs:    cfg.subnetIDs,
+			Tags:         map[string]string{runTagKey: cfg.runID},
+		},
+	}
+	g.Expect(c.Create(ctx, am)).To(Succeed())
+	return am
+}
+
+// launchUnmanagedInstance launches an instance directly through EC2, as a
+// user would before adopting it.
+func launchUnmanagedInstance(ctx context.Context, g *GomegaWithT, awscfg *aws.Config, cfg *config) string {
+	subnets := cfg.subnetIDs
+	if len(subnets) == 0 {
+		var err error
+		subnets, err = awsutil.DescribeSubnets(ctx, awscfg, cfg.vpcID)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(subnets).NotTo(BeEmpty())
+	}
+	svc := ec2.New(session.New(awscfg))
+	resp, err := svc.RunInstancesWithContext(ctx, &ec2.RunInstancesInput{
+		ImageId:      aws.String(cfg.ami),
+		InstanceType: aws.String(cfg.instanceType),
+		SubnetId:     aws.String(subnets[0]),
+		MinCount:     aws.Int64(1),
+		MaxCount:     aws.Int64(1),
+		TagSpecifications: []*ec2.TagSpecification{{
+			ResourceType: aws.String(ec2.ResourceTypeInstance),
+			Tags: []*ec2.Tag{
+				{Key: aws.String(runTagKey), Value: aws.String(cfg.runID)},
+				{Key: aws.String(adoptTagKey), Value: aws.String(cfg.runID)},
+			},
+		}},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(resp.Instances).To(HaveLen(1))
+	return aws.StringValue(resp.Instances[0].InstanceId)
+}
+
+// cleanup terminates every instance launched by the run.
+func cleanup(t *testing.T, awscfg *aws.Config, runID string) {
+	ctx := context.Background()
+	instances, err := awsutil.DescribeInstancesByTag(ctx, awscfg, runTagKey, runID)
+	if err != nil {
+		t.Errorf("cannot list instances of run %q, they must be terminated manually: %v", runID, err)
+		return
+	}
+	for _, instance := range instances {
+		id := aws.StringValue(instance.InstanceId)
+		if aws.StringValue(instance.State.Name) == ec2.InstanceStateNameTerminated {
+			continue
+		}
+		t.Logf("terminating instance %s", id)
+		if err := awsutil.TerminateInstance(ctx, awscfg, id); err != nil {
+			t.Errorf("cannot terminate instance %s: %v", id, err)
+		}
+	}
+}
+
+func tagValue(tags []*ec2.Tag, key string) string {
+	for _, t := range tags {
+		if aws.StringValue(t.Key) == key {
+			return aws.StringValue(t.Value)
+		}
+	}
+	return ""
+}